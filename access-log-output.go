@@ -0,0 +1,157 @@
+package rdns
+
+import (
+	"bytes"
+	"context"
+	"fmt"
+	"net"
+	"net/http"
+	"os"
+	"sync"
+	"time"
+)
+
+// RotatingFile is an access log output that appends to a file and rotates it
+// once it reaches a maximum size. Rotated files get a numeric suffix, the most
+// recent being <filename>.1.
+type RotatingFile struct {
+	filename   string
+	maxSize    int64
+	maxBackups int
+
+	mu   sync.Mutex
+	f    *os.File
+	size int64
+}
+
+// NewRotatingFile opens a file for appending. It is rotated when a write would
+// take it over maxSize bytes, keeping up to maxBackups old files. Files are
+// never rotated if maxSize is 0.
+func NewRotatingFile(filename string, maxSize int64, maxBackups int) (*RotatingFile, error) {
+	w := &RotatingFile{
+		filename:   filename,
+		maxSize:    maxSize,
+		maxBackups: maxBackups,
+	}
+	if err := w.open(); err != nil {
+		return nil, err
+	}
+	return w, nil
+}
+
+func (w *RotatingFile) Write(b []byte) (int, error) {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+	if w.f == nil {
+		return 0, os.ErrClosed
+	}
+	if w.maxSize > 0 && w.size > 0 && w.size+int64(len(b)) > w.maxSize {
+		if err := w.rotate(); err != nil {
+			return 0, err
+		}
+	}
+	n, err := w.f.Write(b)
+	w.size += int64(n)
+	return n, err
+}
+
+func (w *RotatingFile) Close() error {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+	if w.f == nil {
+		return nil
+	}
+	err := w.f.Close()
+	w.f = nil
+	return err
+}
+
+func (w *RotatingFile) open() error {
+	f, err := os.OpenFile(w.filename, os.O_APPEND|os.O_CREATE|os.O_WRONLY, 0644)
+	if err != nil {
+		return err
+	}
+	info, err := f.Stat()
+	if err != nil {
+		f.Close()
+		return err
+	}
+	w.f = f
+	w.size = info.Size()
+	return nil
+}
+
+// Shift the existing backups by one, dropping the oldest, and start a new file.
+// Must be called with the lock held.
+func (w *RotatingFile) rotate() error {
+	if err := w.f.Close(); err != nil {
+		return err
+	}
+	w.f = nil
+	if w.maxBackups > 0 {
+		os.Remove(fmt.Sprintf("%s.%d", w.filename, w.maxBackups))
+		for i := w.maxBackups - 1; i > 0; i-- {
+			os.Rename(fmt.Sprintf("%s.%d", w.filename, i), fmt.Sprintf("%s.%d", w.filename, i+1))
+		}
+		if err := os.Rename(w.filename, w.filename+".1"); err != nil {
+			return err
+		}
+	} else if err := os.Remove(w.filename); err != nil {
+		return err
+	}
+	return w.open()
+}
+
+// NewUDPLogOutput returns an access log output that sends every record as a
+// datagram to a remote address.
+func NewUDPLogOutput(address string) (net.Conn, error) {
+	return net.Dial("udp", address)
+}
+
+// HTTPLogOutput is an access log output that sends every record in a POST
+// request to a remote endpoint.
+type HTTPLogOutput struct {
+	url         string
+	contentType string
+	client      *http.Client
+	timeout     time.Duration
+}
+
+// NewHTTPLogOutput returns an output that posts records to the URL. The content
+// type should match the format of the records. Requests are cancelled after the
+// timeout, which defaults to 5 seconds.
+func NewHTTPLogOutput(url, contentType string, timeout time.Duration) *HTTPLogOutput {
+	if timeout <= 0 {
+		timeout = 5 * time.Second
+	}
+	return &HTTPLogOutput{
+		url:         url,
+		contentType: contentType,
+		client:      new(http.Client),
+		timeout:     timeout,
+	}
+}
+
+func (w *HTTPLogOutput) Write(b []byte) (int, error) {
+	ctx, cancel := context.WithTimeout(context.Background(), w.timeout)
+	defer cancel()
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, w.url, bytes.NewReader(b))
+	if err != nil {
+		return 0, err
+	}
+	req.Header.Set("Content-Type", w.contentType)
+	resp, err := w.client.Do(req)
+	if err != nil {
+		return 0, err
+	}
+	resp.Body.Close()
+	if resp.StatusCode/100 != 2 {
+		return 0, fmt.Errorf("unexpected response from %s: %s", w.url, resp.Status)
+	}
+	return len(b), nil
+}
+
+func (w *HTTPLogOutput) Close() error {
+	w.client.CloseIdleConnections()
+	return nil
+}
@@ -0,0 +1,249 @@
+package rdns
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"expvar"
+	"fmt"
+	"io"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/miekg/dns"
+)
+
+// AccessLogger forwards every query unmodified and writes one record per query
+// to an access log. Records are written asynchronously so a slow log output
+// doesn't add latency to queries. Records are dropped if the buffer is full.
+type AccessLogger struct {
+	id       string
+	resolver Resolver
+	opt      AccessLogOptions
+	fields   []string
+
+	mu      sync.RWMutex
+	closed  bool
+	records chan accessLogRecord
+	done    chan struct{}
+
+	// Number of records dropped because the buffer was full
+	dropped *expvar.Int
+}
+
+var _ Resolver = &AccessLogger{}
+
+type AccessLogOptions struct {
+	// Destination of the access log records. Closed when the logger is closed.
+	Output io.WriteCloser
+
+	// Record format, "json" or "text". Defaults to "json".
+	Format string
+
+	// Fields to include in the records, in order. Defaults to all fields.
+	Fields []string
+
+	// Number of records that can be buffered before new ones are dropped.
+	// Defaults to 1024.
+	BufferSize int
+}
+
+// Fields available for access log records.
+var AccessLogFields = []string{"time", "client", "qname", "qtype", "rcode", "latency_ms", "resolver", "ede", "error"}
+
+type accessLogRecord struct {
+	time     time.Time
+	client   string
+	qname    string
+	qtype    string
+	rcode    string
+	latency  time.Duration
+	resolver string
+	ede      string
+	err      string
+}
+
+// NewAccessLogger returns a new instance of an access logger.
+func NewAccessLogger(id string, resolver Resolver, opt AccessLogOptions) (*AccessLogger, error) {
+	if opt.Output == nil {
+		return nil, errors.New("no access log output")
+	}
+	switch opt.Format {
+	case "":
+		opt.Format = "json"
+	case "json", "text":
+	default:
+		return nil, fmt.Errorf("unsupported access log format %q", opt.Format)
+	}
+	fields := opt.Fields
+	if len(fields) == 0 {
+		fields = AccessLogFields
+	}
+	for _, f := range fields {
+		if !isAccessLogField(f) {
+			return nil, fmt.Errorf("unsupported access log field %q", f)
+		}
+	}
+	if opt.BufferSize <= 0 {
+		opt.BufferSize = 1024
+	}
+	r := &AccessLogger{
+		id:       id,
+		resolver: resolver,
+		opt:      opt,
+		fields:   fields,
+		records:  make(chan accessLogRecord, opt.BufferSize),
+		done:     make(chan struct{}),
+		dropped:  getVarInt("accesslog", id, "dropped"),
+	}
+	go r.run()
+	return r, nil
+}
+
+// Resolve passes a DNS query through unmodified and queues an access log record.
+func (r *AccessLogger) Resolve(q *dns.Msg, ci ClientInfo) (*dns.Msg, error) {
+	start := time.Now()
+	a, err := r.resolver.Resolve(q, ci)
+
+	rec := accessLogRecord{
+		time:     start,
+		qname:    qName(q),
+		qtype:    qType(q),
+		latency:  time.Since(start),
+		resolver: r.resolver.String(),
+	}
+	if ci.SourceIP != nil {
+		rec.client = ci.SourceIP.String()
+	}
+	if err != nil {
+		rec.err = err.Error()
+	} else if a != nil {
+		rec.rcode = dns.RcodeToString[a.Rcode]
+		rec.ede = extendedError(a)
+	}
+
+	r.mu.RLock()
+	if !r.closed {
+		select {
+		case r.records <- rec:
+		default:
+			r.dropped.Add(1)
+		}
+	}
+	r.mu.RUnlock()
+	return a, err
+}
+
+// Close stops accepting new records, writes all buffered records and closes
+// the output.
+func (r *AccessLogger) Close() error {
+	r.mu.Lock()
+	if r.closed {
+		r.mu.Unlock()
+		return nil
+	}
+	r.closed = true
+	close(r.records)
+	r.mu.Unlock()
+	<-r.done
+	return r.opt.Output.Close()
+}
+
+func (r *AccessLogger) String() string {
+	return r.id
+}
+
+// Write records to the output until the logger is closed.
+func (r *AccessLogger) run() {
+	defer close(r.done)
+	var buf bytes.Buffer
+	for rec := range r.records {
+		buf.Reset()
+		r.format(&buf, rec)
+		if _, err := r.opt.Output.Write(buf.Bytes()); err != nil {
+			Log.WithField("id", r.id).WithError(err).Error("failed to write access log")
+		}
+	}
+}
+
+// Format a record as one line in the configured format, including only the
+// selected fields.
+func (r *AccessLogger) format(buf *bytes.Buffer, rec accessLogRecord) {
+	values := make(map[string]any, len(r.fields))
+	for _, f := range r.fields {
+		switch f {
+		case "time":
+			values[f] = rec.time.UTC().Format(time.RFC3339Nano)
+		case "client":
+			values[f] = rec.client
+		case "qname":
+			values[f] = rec.qname
+		case "qtype":
+			values[f] = rec.qtype
+		case "rcode":
+			values[f] = rec.rcode
+		case "latency_ms":
+			values[f] = float64(rec.latency.Microseconds()) / 1000
+		case "resolver":
+			values[f] = rec.resolver
+		case "ede":
+			if rec.ede != "" {
+				values[f] = rec.ede
+			}
+		case "error":
+			if rec.err != "" {
+				values[f] = rec.err
+			}
+		}
+	}
+
+	if r.opt.Format == "json" {
+		b, _ := json.Marshal(values)
+		buf.Write(b)
+		buf.WriteByte('\n')
+		return
+	}
+	var items []string
+	for _, f := range r.fields {
+		v, ok := values[f]
+		if !ok {
+			continue
+		}
+		s := fmt.Sprint(v)
+		if s == "" || strings.ContainsAny(s, " \"=") {
+			s = fmt.Sprintf("%q", s)
+		}
+		items = append(items, f+"="+s)
+	}
+	buf.WriteString(strings.Join(items, " "))
+	buf.WriteByte('\n')
+}
+
+// Returns the extended DNS errors of a response as "<code>: <text>", separated
+// by "; ", or an empty string if there are none. Elements like blocklists use
+// them to report why a query was blocked.
+func extendedError(a *dns.Msg) string {
+	var errs []string
+	for _, ede := range extendedErrors(a) {
+		code, ok := dns.ExtendedErrorCodeToString[ede.InfoCode]
+		if !ok {
+			code = fmt.Sprint(ede.InfoCode)
+		}
+		if ede.ExtraText == "" {
+			errs = append(errs, code)
+			continue
+		}
+		errs = append(errs, code+": "+ede.ExtraText)
+	}
+	return strings.Join(errs, "; ")
+}
+
+func isAccessLogField(name string) bool {
+	for _, f := range AccessLogFields {
+		if f == name {
+			return true
+		}
+	}
+	return false
+}
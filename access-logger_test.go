@@ -0,0 +1,206 @@
+package rdns
+
+import (
+	"bytes"
+	"encoding/json"
+	"io"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/miekg/dns"
+	"github.com/stretchr/testify/require"
+)
+
+// Output that records everything written to it, optionally blocking writes
+// until released.
+type testLogOutput struct {
+	mu      sync.Mutex
+	buf     bytes.Buffer
+	release chan struct{}
+	closed  bool
+}
+
+func (o *testLogOutput) Write(b []byte) (int, error) {
+	if o.release != nil {
+		<-o.release
+	}
+	o.mu.Lock()
+	defer o.mu.Unlock()
+	return o.buf.Write(b)
+}
+
+func (o *testLogOutput) Close() error {
+	o.mu.Lock()
+	defer o.mu.Unlock()
+	o.closed = true
+	return nil
+}
+
+func (o *testLogOutput) String() string {
+	o.mu.Lock()
+	defer o.mu.Unlock()
+	return o.buf.String()
+}
+
+func TestAccessLoggerJSON(t *testing.T) {
+	out := new(testLogOutput)
+	r := new(TestResolver)
+	l, err := NewAccessLogger("test-accesslog", r, AccessLogOptions{Output: out})
+	require.NoError(t, err)
+
+	q := new(dns.Msg)
+	q.SetQuestion("example.com.", dns.TypeAAAA)
+	_, err = l.Resolve(q, ClientInfo{SourceIP: net.ParseIP("192.168.1.1")})
+	require.NoError(t, err)
+
+	// Close should flush all buffered records and close the output
+	require.NoError(t, l.Close())
+	require.True(t, out.closed)
+
+	var rec map[string]any
+	require.NoError(t, json.Unmarshal([]byte(out.String()), &rec))
+	require.Equal(t, "192.168.1.1", rec["client"])
+	require.Equal(t, "example.com.", rec["qname"])
+	require.Equal(t, "AAAA", rec["qtype"])
+	require.Equal(t, "NOERROR", rec["rcode"])
+	require.Equal(t, r.String(), rec["resolver"])
+	require.Contains(t, rec, "time")
+	require.Contains(t, rec, "latency_ms")
+	require.NotContains(t, rec, "error")
+}
+
+func TestAccessLoggerTextFields(t *testing.T) {
+	out := new(testLogOutput)
+	l, err := NewAccessLogger("test-accesslog-text", new(TestResolver), AccessLogOptions{
+		Output: out,
+		Format: "text",
+		Fields: []string{"qname", "qtype", "rcode"},
+	})
+	require.NoError(t, err)
+
+	q := new(dns.Msg)
+	q.SetQuestion("example.com.", dns.TypeA)
+	_, err = l.Resolve(q, ClientInfo{})
+	require.NoError(t, err)
+	require.NoError(t, l.Close())
+	require.Equal(t, "qname=example.com. qtype=A rcode=NOERROR\n", out.String())
+
+	_, err = NewAccessLogger("test-accesslog-invalid", new(TestResolver), AccessLogOptions{
+		Output: out,
+		Fields: []string{"qname", "invalid"},
+	})
+	require.Error(t, err)
+}
+
+func TestAccessLoggerSlowOutput(t *testing.T) {
+	out := &testLogOutput{release: make(chan struct{})}
+	l, err := NewAccessLogger("test-accesslog-slow", new(TestResolver), AccessLogOptions{
+		Output:     out,
+		BufferSize: 2,
+	})
+	require.NoError(t, err)
+
+	// Writes are blocked, queries should still be answered without delay and
+	// records dropped once the buffer is full
+	q := new(dns.Msg)
+	q.SetQuestion("example.com.", dns.TypeA)
+	start := time.Now()
+	for i := 0; i < 10; i++ {
+		_, err = l.Resolve(q, ClientInfo{})
+		require.NoError(t, err)
+	}
+	require.Less(t, time.Since(start), time.Second)
+	require.Positive(t, l.dropped.Value())
+
+	close(out.release)
+	require.NoError(t, l.Close())
+	lines := strings.Count(out.String(), "\n")
+	require.Equal(t, int64(10), int64(lines)+l.dropped.Value())
+}
+
+func TestAccessLoggerEDE(t *testing.T) {
+	out := new(testLogOutput)
+	r := &TestResolver{
+		ResolveFunc: func(q *dns.Msg, ci ClientInfo) (*dns.Msg, error) {
+			a := nxdomain(q)
+			a.SetEdns0(4096, false)
+			edns0 := a.IsEdns0()
+			edns0.Option = append(edns0.Option, &dns.EDNS0_EDE{InfoCode: dns.ExtendedErrorCodeBlocked, ExtraText: "blocked by ads"})
+			return a, nil
+		},
+	}
+	l, err := NewAccessLogger("test-accesslog-ede", r, AccessLogOptions{
+		Output: out,
+		Format: "text",
+		Fields: []string{"qname", "rcode", "ede"},
+	})
+	require.NoError(t, err)
+
+	q := new(dns.Msg)
+	q.SetQuestion("ads.example.com.", dns.TypeA)
+	_, err = l.Resolve(q, ClientInfo{})
+	require.NoError(t, err)
+	require.NoError(t, l.Close())
+	require.Equal(t, "qname=ads.example.com. rcode=NXDOMAIN ede=\"Blocked: blocked by ads\"\n", out.String())
+}
+
+func TestRotatingFile(t *testing.T) {
+	filename := filepath.Join(t.TempDir(), "access.log")
+	w, err := NewRotatingFile(filename, 10, 2)
+	require.NoError(t, err)
+
+	for _, line := range []string{"line-1\n", "line-2\n", "line-3\n", "line-4\n"} {
+		_, err := w.Write([]byte(line))
+		require.NoError(t, err)
+	}
+	require.NoError(t, w.Close())
+
+	// Each write goes over the limit, so every line ends up in its own file.
+	// Only two backups are kept.
+	for name, content := range map[string]string{
+		filename:        "line-4\n",
+		filename + ".1": "line-3\n",
+		filename + ".2": "line-2\n",
+	} {
+		b, err := os.ReadFile(name)
+		require.NoError(t, err)
+		require.Equal(t, content, string(b))
+	}
+	_, err = os.Stat(filename + ".3")
+	require.True(t, os.IsNotExist(err))
+}
+
+func TestHTTPLogOutput(t *testing.T) {
+	var mu sync.Mutex
+	var received []string
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		b, _ := io.ReadAll(r.Body)
+		mu.Lock()
+		received = append(received, r.Header.Get("Content-Type")+" "+string(b))
+		mu.Unlock()
+	}))
+	defer srv.Close()
+
+	l, err := NewAccessLogger("test-accesslog-http", new(TestResolver), AccessLogOptions{
+		Output: NewHTTPLogOutput(srv.URL, "text/plain", 0),
+		Format: "text",
+		Fields: []string{"qname"},
+	})
+	require.NoError(t, err)
+	q := new(dns.Msg)
+	q.SetQuestion("example.com.", dns.TypeA)
+	_, err = l.Resolve(q, ClientInfo{})
+	require.NoError(t, err)
+	require.NoError(t, l.Close())
+
+	mu.Lock()
+	defer mu.Unlock()
+	require.Equal(t, []string{"text/plain qname=example.com.\n"}, received)
+}
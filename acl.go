@@ -0,0 +1,212 @@
+package rdns
+
+import (
+	"errors"
+	"fmt"
+	"net"
+	"strings"
+	"sync"
+	"time"
+)
+
+// ACLAction is the result of checking a client address against an ACL.
+type ACLAction int
+
+const (
+	// ACLAllow lets the query through.
+	ACLAllow ACLAction = iota
+	// ACLRefuse answers the query with REFUSED.
+	ACLRefuse
+	// ACLDrop doesn't respond at all.
+	ACLDrop
+)
+
+func (a ACLAction) String() string {
+	switch a {
+	case ACLAllow:
+		return "allow"
+	case ACLRefuse:
+		return "refuse"
+	case ACLDrop:
+		return "drop"
+	default:
+		return fmt.Sprintf("ACLAction(%d)", int(a))
+	}
+}
+
+// ParseACLAction returns the action with the given name.
+func ParseACLAction(s string) (ACLAction, error) {
+	switch s {
+	case "allow":
+		return ACLAllow, nil
+	case "refuse", "deny":
+		return ACLRefuse, nil
+	case "drop":
+		return ACLDrop, nil
+	default:
+		return 0, fmt.Errorf("unsupported acl action '%s'", s)
+	}
+}
+
+// ACLRule applies an action to clients in a network.
+type ACLRule struct {
+	Net    *net.IPNet
+	Action ACLAction
+}
+
+// ACL is an ordered list of rules for client addresses on a listener. The
+// first rule matching the client decides the action. Rules can be loaded from
+// a file and reloaded at runtime.
+type ACL struct {
+	id  string
+	opt ACLOptions
+
+	mu          sync.RWMutex
+	rules       []ACLRule // Inline rules followed by the rules from the loader
+	inlineRules []ACLRule
+}
+
+// ACLOptions contain settings for listener ACLs.
+type ACLOptions struct {
+	// Rules in the form "<action> <network>", for example "allow 10.0.0.0/8".
+	// They're evaluated before the rules from the loader.
+	Rules []string
+
+	// Optional, loads more rules in the same format, one per line. Lines
+	// starting with # are ignored.
+	Loader BlocklistLoader
+
+	// Reload the rules from the loader periodically. Disabled if 0.
+	Refresh time.Duration
+
+	// Action for clients that don't match any rule.
+	DefaultAction ACLAction
+}
+
+// NewACL returns an ACL with rules from the options. Fails if the rules can't
+// be loaded or parsed.
+func NewACL(id string, opt ACLOptions) (*ACL, error) {
+	inline, err := parseACLRules(opt.Rules)
+	if err != nil {
+		return nil, err
+	}
+	a := &ACL{id: id, opt: opt, inlineRules: inline, rules: inline}
+	if opt.Loader != nil {
+		if err := a.ReloadAll(); err != nil {
+			return nil, err
+		}
+		if opt.Refresh > 0 {
+			go a.refreshLoop()
+		}
+	}
+	return a, nil
+}
+
+// Check returns the action of the first rule that matches the address, or the
+// default action if none does.
+func (a *ACL) Check(ip net.IP) ACLAction {
+	a.mu.RLock()
+	defer a.mu.RUnlock()
+	for _, rule := range a.rules {
+		if rule.Net.Contains(ip) {
+			return rule.Action
+		}
+	}
+	return a.opt.DefaultAction
+}
+
+// ReloadAll loads the rules from the loader again. The current rules are kept
+// if they can't be loaded.
+func (a *ACL) ReloadAll() error {
+	if a.opt.Loader == nil {
+		return nil
+	}
+	lines, err := a.opt.Loader.Load()
+	if errors.Is(err, ErrNotModified) {
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+	loaded, err := parseACLRules(lines)
+	if err != nil {
+		return err
+	}
+	rules := make([]ACLRule, 0, len(a.inlineRules)+len(loaded))
+	rules = append(rules, a.inlineRules...)
+	rules = append(rules, loaded...)
+	a.mu.Lock()
+	a.rules = rules
+	a.mu.Unlock()
+	return nil
+}
+
+func (a *ACL) String() string {
+	return a.id
+}
+
+func (a *ACL) refreshLoop() {
+	log := Log.WithField("id", a.id)
+	// ACLs are reloaded in place and live as long as their listener
+	newRefresher(log, a.opt.Refresh).run(nil, func() error {
+		log.Debug("reloading acl")
+		return a.ReloadAll()
+	})
+}
+
+// Parses rules like "allow 10.0.0.0/8" or "drop 2001:db8::1". Addresses
+// without prefix length match a single IP. Empty lines and comments are
+// skipped.
+func parseACLRules(lines []string) ([]ACLRule, error) {
+	var rules []ACLRule
+	for _, line := range lines {
+		line, _, _ = strings.Cut(line, "#")
+		fields := strings.Fields(line)
+		if len(fields) == 0 {
+			continue
+		}
+		if len(fields) != 2 {
+			return nil, fmt.Errorf("invalid acl rule '%s'", line)
+		}
+		action, err := ParseACLAction(fields[0])
+		if err != nil {
+			return nil, err
+		}
+		network, err := parseACLNet(fields[1])
+		if err != nil {
+			return nil, err
+		}
+		rules = append(rules, ACLRule{Net: network, Action: action})
+	}
+	return rules, nil
+}
+
+func parseACLNet(s string) (*net.IPNet, error) {
+	if !strings.Contains(s, "/") {
+		ip := net.ParseIP(s)
+		if ip == nil {
+			return nil, fmt.Errorf("invalid address '%s' in acl rule", s)
+		}
+		if ip4 := ip.To4(); ip4 != nil {
+			return &net.IPNet{IP: ip4, Mask: net.CIDRMask(32, 32)}, nil
+		}
+		return &net.IPNet{IP: ip, Mask: net.CIDRMask(128, 128)}, nil
+	}
+	_, n, err := net.ParseCIDR(s)
+	if err != nil {
+		return nil, fmt.Errorf("invalid network '%s' in acl rule: %w", s, err)
+	}
+	return n, nil
+}
+
+// Returns the action for a client address on a listener, considering the
+// allowed networks as well as the ACL.
+func (opt ListenOptions) access(ip net.IP) ACLAction {
+	if !isAllowed(opt.AllowedNet, ip) {
+		return ACLRefuse
+	}
+	if opt.ACL == nil {
+		return ACLAllow
+	}
+	return opt.ACL.Check(ip)
+}
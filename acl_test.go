@@ -0,0 +1,109 @@
+package rdns
+
+import (
+	"net"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/miekg/dns"
+	"github.com/stretchr/testify/require"
+)
+
+func TestACLCheck(t *testing.T) {
+	acl, err := NewACL("test-acl", ACLOptions{
+		Rules: []string{
+			"drop 192.0.2.66",
+			"allow 192.0.2.0/24 # office",
+			"refuse 2001:db8::/32",
+			"",
+			"# comment",
+			"allow ::/0",
+		},
+		DefaultAction: ACLRefuse,
+	})
+	require.NoError(t, err)
+
+	require.Equal(t, ACLDrop, acl.Check(net.ParseIP("192.0.2.66")))
+	require.Equal(t, ACLAllow, acl.Check(net.ParseIP("192.0.2.1")))
+	require.Equal(t, ACLRefuse, acl.Check(net.ParseIP("2001:db8::1")))
+	require.Equal(t, ACLAllow, acl.Check(net.ParseIP("2001:db9::1")))
+	require.Equal(t, ACLRefuse, acl.Check(net.ParseIP("198.51.100.1")))
+}
+
+func TestACLInvalidRules(t *testing.T) {
+	for _, rule := range []string{
+		"allow",
+		"permit 192.0.2.0/24",
+		"allow 192.0.2.0/33",
+		"allow example.com",
+		"allow 192.0.2.1 192.0.2.2",
+	} {
+		_, err := NewACL("test-acl", ACLOptions{Rules: []string{rule}})
+		require.Error(t, err, rule)
+	}
+}
+
+func TestACLReload(t *testing.T) {
+	file := filepath.Join(t.TempDir(), "acl.txt")
+	require.NoError(t, os.WriteFile(file, []byte("allow 192.0.2.0/24\n"), 0o644))
+
+	acl, err := NewACL("test-acl", ACLOptions{
+		Rules:         []string{"drop 192.0.2.66"},
+		Loader:        NewFileLoader(file, FileLoaderOptions{}),
+		DefaultAction: ACLDrop,
+	})
+	require.NoError(t, err)
+	require.Equal(t, ACLDrop, acl.Check(net.ParseIP("192.0.2.66")))
+	require.Equal(t, ACLAllow, acl.Check(net.ParseIP("192.0.2.1")))
+
+	// Inline rules are kept, the file rules are replaced
+	require.NoError(t, os.WriteFile(file, []byte("refuse 192.0.2.0/24\n"), 0o644))
+	require.NoError(t, acl.ReloadAll())
+	require.Equal(t, ACLDrop, acl.Check(net.ParseIP("192.0.2.66")))
+	require.Equal(t, ACLRefuse, acl.Check(net.ParseIP("192.0.2.1")))
+
+	// Invalid rules leave the current ones in place
+	require.NoError(t, os.WriteFile(file, []byte("invalid\n"), 0o644))
+	require.Error(t, acl.ReloadAll())
+	require.Equal(t, ACLRefuse, acl.Check(net.ParseIP("192.0.2.1")))
+}
+
+func TestDNSListenerACL(t *testing.T) {
+	file := filepath.Join(t.TempDir(), "acl.txt")
+	require.NoError(t, os.WriteFile(file, []byte("refuse 127.0.0.0/8\n"), 0o644))
+	acl, err := NewACL("test-listener-acl", ACLOptions{
+		Loader: NewFileLoader(file, FileLoaderOptions{}),
+	})
+	require.NoError(t, err)
+
+	upstream := new(TestResolver)
+	addr, err := getLnAddress()
+	require.NoError(t, err)
+	s := NewDNSListener("test-listener-acl", addr, "tcp", ListenOptions{ACL: acl}, upstream)
+	go s.Start()
+	defer s.Shutdown()
+	time.Sleep(time.Second)
+
+	c := &dns.Client{Net: "tcp", Timeout: time.Second}
+	q := new(dns.Msg)
+	q.SetQuestion("example.com.", dns.TypeA)
+	a, _, err := c.Exchange(q, addr)
+	require.NoError(t, err)
+	require.Equal(t, dns.RcodeRefused, a.Rcode)
+	require.Equal(t, 0, upstream.HitCount())
+
+	// Dropped queries don't get a response
+	require.NoError(t, os.WriteFile(file, []byte("drop 127.0.0.0/8\n"), 0o644))
+	require.NoError(t, acl.ReloadAll())
+	_, _, err = c.Exchange(q, addr)
+	require.Error(t, err)
+	require.Equal(t, 0, upstream.HitCount())
+
+	require.NoError(t, os.WriteFile(file, []byte("allow 127.0.0.0/8\n"), 0o644))
+	require.NoError(t, acl.ReloadAll())
+	_, _, err = c.Exchange(q, addr)
+	require.NoError(t, err)
+	require.Equal(t, 1, upstream.HitCount())
+}
@@ -0,0 +1,393 @@
+package rdns
+
+import (
+	"crypto/subtle"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net"
+	"net/http"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/miekg/dns"
+	"github.com/sirupsen/logrus"
+)
+
+// Status of an element as returned by the admin API. Fields other than the ID
+// and type are only set for elements that support them.
+type elementStatus struct {
+	ID         string                `json:"id"`
+	Type       string                `json:"type"`
+	CacheSize  *int                  `json:"cache-size,omitempty"`
+	Routes     []RouteStatus         `json:"routes,omitempty"`
+	BlockRules []string              `json:"block-rules,omitempty"`
+	AllowRules []string              `json:"allow-rules,omitempty"`
+	Clients    []CaptivePortalClient `json:"clients,omitempty"`
+}
+
+// Body of requests to add rules to a blocklist.
+type apiRulesRequest struct {
+	Allow bool     `json:"allow"`
+	Rules []string `json:"rules"`
+}
+
+// Body of requests to authorize a client in a captive portal.
+type apiClientRequest struct {
+	IP       string `json:"ip"`
+	Duration string `json:"duration"`
+}
+
+// Register the handlers of the management API.
+func (s *AdminListener) registerAPI() {
+	s.mux.HandleFunc("GET /routedns/api/elements", s.authorize(s.apiElements))
+	s.mux.HandleFunc("GET /routedns/api/elements/{id}", s.authorize(s.apiElement))
+	s.mux.HandleFunc("POST /routedns/api/elements/{id}/flush", s.authorize(s.apiFlush))
+	s.mux.HandleFunc("GET /routedns/api/elements/{id}/entries", s.authorize(s.apiCacheEntries))
+	s.mux.HandleFunc("POST /routedns/api/elements/{id}/reload", s.authorize(s.apiReload))
+	s.mux.HandleFunc("POST /routedns/api/elements/{id}/rules", s.authorize(s.apiRules))
+	s.mux.HandleFunc("GET /routedns/api/elements/{id}/stats", s.authorize(s.apiBlocklistStats))
+	s.mux.HandleFunc("POST /routedns/api/elements/{id}/routes/{index}/disable", s.authorize(s.apiDisableRoute))
+	s.mux.HandleFunc("POST /routedns/api/elements/{id}/routes/{index}/enable", s.authorize(s.apiEnableRoute))
+	s.mux.HandleFunc("POST /routedns/api/elements/{id}/clients", s.authorize(s.apiAuthorizeClient))
+	s.mux.HandleFunc("DELETE /routedns/api/elements/{id}/clients/{ip}", s.authorize(s.apiDeauthorizeClient))
+}
+
+// Wraps a handler and only calls it for requests from allowed networks that
+// carry the API token, if one is configured.
+func (s *AdminListener) authorize(next http.HandlerFunc) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		host, _, _ := net.SplitHostPort(r.RemoteAddr)
+		if s.opt.access(net.ParseIP(host)) != ACLAllow {
+			apiError(w, http.StatusForbidden, errors.New(http.StatusText(http.StatusForbidden)))
+			return
+		}
+		if s.opt.APIToken != "" {
+			token, ok := strings.CutPrefix(r.Header.Get("Authorization"), "Bearer ")
+			if !ok || subtle.ConstantTimeCompare([]byte(token), []byte(s.opt.APIToken)) != 1 {
+				w.Header().Set("WWW-Authenticate", "Bearer")
+				apiError(w, http.StatusUnauthorized, errors.New(http.StatusText(http.StatusUnauthorized)))
+				return
+			}
+		}
+		next(w, r)
+	}
+}
+
+func (s *AdminListener) apiElements(w http.ResponseWriter, r *http.Request) {
+	elements := s.opt.Elements()
+	status := make([]elementStatus, 0, len(elements))
+	for id, e := range elements {
+		status = append(status, getElementStatus(id, e))
+	}
+	sort.Slice(status, func(i, j int) bool { return status[i].ID < status[j].ID })
+	apiRespond(w, status)
+}
+
+func (s *AdminListener) apiElement(w http.ResponseWriter, r *http.Request) {
+	e, ok := s.apiLookup(w, r)
+	if !ok {
+		return
+	}
+	apiRespond(w, getElementStatus(r.PathValue("id"), e))
+}
+
+func (s *AdminListener) apiFlush(w http.ResponseWriter, r *http.Request) {
+	c, ok := s.apiCache(w, r)
+	if !ok {
+		return
+	}
+	f, err := apiCacheFilter(r)
+	if err != nil {
+		apiError(w, http.StatusBadRequest, err)
+		return
+	}
+	if f == (CacheFilter{}) {
+		Log.WithField("id", c.String()).Info("flushing cache")
+		c.Flush()
+	} else {
+		n := c.FlushMatch(f)
+		Log.WithFields(logrus.Fields{"id": c.String(), "name": f.Name, "suffix": f.Suffix, "qtype": f.Type, "removed": n}).Info("flushing cache entries")
+	}
+	apiRespond(w, getElementStatus(r.PathValue("id"), c))
+}
+
+func (s *AdminListener) apiCacheEntries(w http.ResponseWriter, r *http.Request) {
+	c, ok := s.apiCache(w, r)
+	if !ok {
+		return
+	}
+	f, err := apiCacheFilter(r)
+	if err != nil {
+		apiError(w, http.StatusBadRequest, err)
+		return
+	}
+	entries := c.Entries(f)
+	if entries == nil {
+		entries = []CacheEntry{}
+	}
+	apiRespond(w, entries)
+}
+
+func (s *AdminListener) apiReload(w http.ResponseWriter, r *http.Request) {
+	e, ok := s.apiLookup(w, r)
+	if !ok {
+		return
+	}
+	rr, ok := e.(ReloadableResolver)
+	if !ok {
+		apiError(w, http.StatusBadRequest, fmt.Errorf("%q does not support reloading", r.PathValue("id")))
+		return
+	}
+	if err := rr.ReloadAll(); err != nil {
+		apiError(w, http.StatusInternalServerError, err)
+		return
+	}
+	Log.WithField("id", rr.String()).Info("reloaded rules")
+	apiRespond(w, getElementStatus(r.PathValue("id"), e))
+}
+
+func (s *AdminListener) apiRules(w http.ResponseWriter, r *http.Request) {
+	e, ok := s.apiLookup(w, r)
+	if !ok {
+		return
+	}
+	b, ok := e.(*Blocklist)
+	if !ok {
+		apiError(w, http.StatusBadRequest, fmt.Errorf("%q is not a blocklist", r.PathValue("id")))
+		return
+	}
+	var req apiRulesRequest
+	if err := json.NewDecoder(http.MaxBytesReader(w, r.Body, 1<<20)).Decode(&req); err != nil {
+		apiError(w, http.StatusBadRequest, err)
+		return
+	}
+	if len(req.Rules) == 0 {
+		apiError(w, http.StatusBadRequest, errors.New("no rules"))
+		return
+	}
+	if err := b.AddRules(req.Allow, req.Rules...); err != nil {
+		apiError(w, http.StatusBadRequest, err)
+		return
+	}
+	apiRespond(w, getElementStatus(r.PathValue("id"), e))
+}
+
+func (s *AdminListener) apiBlocklistStats(w http.ResponseWriter, r *http.Request) {
+	e, ok := s.apiLookup(w, r)
+	if !ok {
+		return
+	}
+	v, ok := blocklistMetrics.Load(e.String())
+	if !ok {
+		apiError(w, http.StatusBadRequest, fmt.Errorf("%q is not a blocklist", r.PathValue("id")))
+		return
+	}
+	top := topBlockedExport
+	if t := r.URL.Query().Get("top"); t != "" {
+		n, err := strconv.Atoi(t)
+		if err != nil || n < 0 {
+			apiError(w, http.StatusBadRequest, fmt.Errorf("invalid top %q", t))
+			return
+		}
+		top = n
+	}
+	apiRespond(w, v.(*BlocklistMetrics).Stats(top))
+}
+
+func (s *AdminListener) apiDisableRoute(w http.ResponseWriter, r *http.Request) {
+	router, index, ok := s.apiRoute(w, r)
+	if !ok {
+		return
+	}
+	var d time.Duration
+	if v := r.URL.Query().Get("duration"); v != "" {
+		var err error
+		if d, err = time.ParseDuration(v); err != nil {
+			apiError(w, http.StatusBadRequest, err)
+			return
+		}
+	}
+	if err := router.DisableRoute(index, d); err != nil {
+		apiError(w, http.StatusNotFound, err)
+		return
+	}
+	apiRespond(w, getElementStatus(r.PathValue("id"), router))
+}
+
+func (s *AdminListener) apiEnableRoute(w http.ResponseWriter, r *http.Request) {
+	router, index, ok := s.apiRoute(w, r)
+	if !ok {
+		return
+	}
+	if err := router.EnableRoute(index); err != nil {
+		apiError(w, http.StatusNotFound, err)
+		return
+	}
+	apiRespond(w, getElementStatus(r.PathValue("id"), router))
+}
+
+func (s *AdminListener) apiAuthorizeClient(w http.ResponseWriter, r *http.Request) {
+	portal, ok := s.apiCaptivePortal(w, r)
+	if !ok {
+		return
+	}
+	var req apiClientRequest
+	if err := json.NewDecoder(http.MaxBytesReader(w, r.Body, 1<<20)).Decode(&req); err != nil {
+		apiError(w, http.StatusBadRequest, err)
+		return
+	}
+	ip := net.ParseIP(req.IP)
+	if ip == nil {
+		apiError(w, http.StatusBadRequest, fmt.Errorf("invalid ip %q", req.IP))
+		return
+	}
+	var d time.Duration
+	if req.Duration != "" {
+		var err error
+		if d, err = time.ParseDuration(req.Duration); err != nil {
+			apiError(w, http.StatusBadRequest, err)
+			return
+		}
+	}
+	portal.Authorize(ip, d)
+	apiRespond(w, getElementStatus(r.PathValue("id"), portal))
+}
+
+func (s *AdminListener) apiDeauthorizeClient(w http.ResponseWriter, r *http.Request) {
+	portal, ok := s.apiCaptivePortal(w, r)
+	if !ok {
+		return
+	}
+	ip := net.ParseIP(r.PathValue("ip"))
+	if ip == nil {
+		apiError(w, http.StatusBadRequest, fmt.Errorf("invalid ip %q", r.PathValue("ip")))
+		return
+	}
+	if !portal.Deauthorize(ip) {
+		apiError(w, http.StatusNotFound, fmt.Errorf("client %s not authorized", ip))
+		return
+	}
+	apiRespond(w, getElementStatus(r.PathValue("id"), portal))
+}
+
+// Returns the element with the ID in the request path, or responds with an
+// error if it doesn't exist.
+func (s *AdminListener) apiLookup(w http.ResponseWriter, r *http.Request) (Resolver, bool) {
+	e, ok := s.opt.Elements()[r.PathValue("id")]
+	if !ok {
+		apiError(w, http.StatusNotFound, fmt.Errorf("element %q not found", r.PathValue("id")))
+	}
+	return e, ok
+}
+
+// Returns the cache with the ID in the request path.
+func (s *AdminListener) apiCache(w http.ResponseWriter, r *http.Request) (*Cache, bool) {
+	e, ok := s.apiLookup(w, r)
+	if !ok {
+		return nil, false
+	}
+	c, ok := e.(*Cache)
+	if !ok {
+		apiError(w, http.StatusBadRequest, fmt.Errorf("%q is not a cache", r.PathValue("id")))
+	}
+	return c, ok
+}
+
+// Reads a cache filter from the name, suffix and type URL parameters.
+func apiCacheFilter(r *http.Request) (CacheFilter, error) {
+	var f CacheFilter
+	params := r.URL.Query()
+	if name := params.Get("name"); name != "" {
+		if _, ok := dns.IsDomainName(name); !ok {
+			return f, fmt.Errorf("invalid name %q", name)
+		}
+		f.Name = dns.Fqdn(name)
+	}
+	if v := params.Get("suffix"); v != "" {
+		suffix, err := strconv.ParseBool(v)
+		if err != nil {
+			return f, fmt.Errorf("invalid suffix %q", v)
+		}
+		if suffix && f.Name == "" {
+			return f, errors.New("suffix requires a name")
+		}
+		f.Suffix = suffix
+	}
+	if v := params.Get("type"); v != "" {
+		qtype, ok := dns.StringToType[strings.ToUpper(v)]
+		if !ok {
+			n, err := strconv.ParseUint(v, 10, 16)
+			if err != nil {
+				return f, fmt.Errorf("invalid type %q", v)
+			}
+			qtype = uint16(n)
+		}
+		f.Type = qtype
+	}
+	return f, nil
+}
+
+// Returns the router and route index in the request path.
+func (s *AdminListener) apiRoute(w http.ResponseWriter, r *http.Request) (*Router, int, bool) {
+	e, ok := s.apiLookup(w, r)
+	if !ok {
+		return nil, 0, false
+	}
+	router, ok := e.(*Router)
+	if !ok {
+		apiError(w, http.StatusBadRequest, fmt.Errorf("%q is not a router", r.PathValue("id")))
+		return nil, 0, false
+	}
+	index, err := strconv.Atoi(r.PathValue("index"))
+	if err != nil {
+		apiError(w, http.StatusBadRequest, err)
+		return nil, 0, false
+	}
+	return router, index, true
+}
+
+// Returns the captive portal with the ID in the request path.
+func (s *AdminListener) apiCaptivePortal(w http.ResponseWriter, r *http.Request) (*CaptivePortal, bool) {
+	e, ok := s.apiLookup(w, r)
+	if !ok {
+		return nil, false
+	}
+	portal, ok := e.(*CaptivePortal)
+	if !ok {
+		apiError(w, http.StatusBadRequest, fmt.Errorf("%q is not a captive portal", r.PathValue("id")))
+	}
+	return portal, ok
+}
+
+func getElementStatus(id string, e Resolver) elementStatus {
+	status := elementStatus{
+		ID:   id,
+		Type: strings.TrimPrefix(fmt.Sprintf("%T", e), "*rdns."),
+	}
+	switch e := e.(type) {
+	case *Cache:
+		size := e.Size()
+		status.CacheSize = &size
+	case *Router:
+		status.Routes = e.Routes()
+	case *Blocklist:
+		status.BlockRules, status.AllowRules = e.RuntimeRules()
+	case *CaptivePortal:
+		status.Clients = e.Clients()
+	}
+	return status
+}
+
+func apiRespond(w http.ResponseWriter, v any) {
+	w.Header().Set("Content-Type", "application/json")
+	_ = json.NewEncoder(w).Encode(v)
+}
+
+func apiError(w http.ResponseWriter, status int, err error) {
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(status)
+	_ = json.NewEncoder(w).Encode(map[string]string{"error": err.Error()})
+}
@@ -0,0 +1,195 @@
+package rdns
+
+import (
+	"encoding/json"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	"github.com/miekg/dns"
+	"github.com/stretchr/testify/require"
+)
+
+func TestAdminAPI(t *testing.T) {
+	upstream := new(TestResolver)
+	cache := NewCache("test-api-cache", upstream, CacheOptions{})
+	blockDB, err := NewDomainDB("testlist", NewStaticLoader(nil))
+	require.NoError(t, err)
+	blocklist, err := NewBlocklist("test-api-blocklist", cache, BlocklistOptions{BlocklistDB: blockDB})
+	require.NoError(t, err)
+	route1, _ := NewRoute("", "", nil, nil, "", "", "", "", "", "", blocklist)
+	route2, _ := NewRoute("", "", nil, nil, "", "", "", "", "", "", cache)
+	router := NewRouter("test-api-router")
+	router.Add(route1, route2)
+	elements := map[string]Resolver{
+		"cache":     cache,
+		"blocklist": blocklist,
+		"router":    router,
+	}
+
+	l, err := NewAdminListener("test-admin-api", "", AdminListenerOptions{
+		Elements: func() map[string]Resolver { return elements },
+		APIToken: "secret",
+	})
+	require.NoError(t, err)
+
+	request := func(method, path, token, body string) (int, []byte) {
+		req := httptest.NewRequest(method, path, strings.NewReader(body))
+		req.RemoteAddr = "127.0.0.1:1234"
+		if token != "" {
+			req.Header.Set("Authorization", "Bearer "+token)
+		}
+		w := httptest.NewRecorder()
+		l.mux.ServeHTTP(w, req)
+		return w.Code, w.Body.Bytes()
+	}
+	resolve := func(name string) *dns.Msg {
+		q := new(dns.Msg)
+		q.SetQuestion(name, dns.TypeA)
+		a, err := router.Resolve(q, ClientInfo{})
+		require.NoError(t, err)
+		return a
+	}
+
+	// The token is required
+	code, _ := request(http.MethodGet, "/routedns/api/elements", "", "")
+	require.Equal(t, http.StatusUnauthorized, code)
+	code, _ = request(http.MethodGet, "/routedns/api/elements", "wrong", "")
+	require.Equal(t, http.StatusUnauthorized, code)
+
+	// List the elements
+	code, body := request(http.MethodGet, "/routedns/api/elements", "secret", "")
+	require.Equal(t, http.StatusOK, code)
+	var status []elementStatus
+	require.NoError(t, json.Unmarshal(body, &status))
+	require.Len(t, status, 3)
+	require.Equal(t, "blocklist", status[0].ID)
+	require.Equal(t, "Blocklist", status[0].Type)
+	require.Equal(t, "Cache", status[1].Type)
+	require.Len(t, status[2].Routes, 2)
+
+	code, _ = request(http.MethodGet, "/routedns/api/elements/missing", "secret", "")
+	require.Equal(t, http.StatusNotFound, code)
+
+	// Flush the cache
+	resolve("example.com.")
+	require.Equal(t, 1, cache.Size())
+	code, _ = request(http.MethodPost, "/routedns/api/elements/cache/flush", "secret", "")
+	require.Equal(t, http.StatusOK, code)
+	require.Equal(t, 0, cache.Size())
+	code, _ = request(http.MethodPost, "/routedns/api/elements/router/flush", "secret", "")
+	require.Equal(t, http.StatusBadRequest, code)
+
+	// Inspect the cache and flush only some entries
+	resolve("example.com.")
+	resolve("www.example.com.")
+	resolve("example.net.")
+	code, body = request(http.MethodGet, "/routedns/api/elements/cache/entries?name=example.com&suffix=true", "secret", "")
+	require.Equal(t, http.StatusOK, code)
+	var entries []CacheEntry
+	require.NoError(t, json.Unmarshal(body, &entries))
+	require.Len(t, entries, 2)
+	code, _ = request(http.MethodPost, "/routedns/api/elements/cache/flush?name=example.com&suffix=true&type=A", "secret", "")
+	require.Equal(t, http.StatusOK, code)
+	require.Equal(t, 1, cache.Size())
+	code, _ = request(http.MethodPost, "/routedns/api/elements/cache/flush?type=invalid", "secret", "")
+	require.Equal(t, http.StatusBadRequest, code)
+	code, _ = request(http.MethodPost, "/routedns/api/elements/cache/flush?suffix=true", "secret", "")
+	require.Equal(t, http.StatusBadRequest, code)
+	code, _ = request(http.MethodGet, "/routedns/api/elements/router/entries", "secret", "")
+	require.Equal(t, http.StatusBadRequest, code)
+	cache.Flush()
+
+	// Add a rule to the blocklist
+	code, _ = request(http.MethodPost, "/routedns/api/elements/blocklist/rules", "secret", `{"rules": ["block.test"]}`)
+	require.Equal(t, http.StatusOK, code)
+	require.Equal(t, dns.RcodeNameError, resolve("block.test.").Rcode)
+	code, _ = request(http.MethodPost, "/routedns/api/elements/blocklist/rules", "secret", `{"rules": []}`)
+	require.Equal(t, http.StatusBadRequest, code)
+
+	// Reload the blocklist, the rule added at runtime is kept
+	code, _ = request(http.MethodPost, "/routedns/api/elements/blocklist/reload", "secret", "")
+	require.Equal(t, http.StatusOK, code)
+	require.Equal(t, dns.RcodeNameError, resolve("block.test.").Rcode)
+
+	// Disable the route to the blocklist
+	code, body = request(http.MethodPost, "/routedns/api/elements/router/routes/0/disable?duration=1h", "secret", "")
+	require.Equal(t, http.StatusOK, code)
+	var routerStatus elementStatus
+	require.NoError(t, json.Unmarshal(body, &routerStatus))
+	require.NotNil(t, routerStatus.Routes[0].DisabledUntil)
+	require.Equal(t, dns.RcodeSuccess, resolve("block.test.").Rcode)
+	code, _ = request(http.MethodPost, "/routedns/api/elements/router/routes/0/disable?duration=x", "secret", "")
+	require.Equal(t, http.StatusBadRequest, code)
+	code, _ = request(http.MethodPost, "/routedns/api/elements/router/routes/5/disable", "secret", "")
+	require.Equal(t, http.StatusNotFound, code)
+
+	// And enable it again
+	code, _ = request(http.MethodPost, "/routedns/api/elements/router/routes/0/enable", "secret", "")
+	require.Equal(t, http.StatusOK, code)
+	require.Equal(t, dns.RcodeNameError, resolve("block.test.").Rcode)
+
+	// Blocklist statistics
+	code, body = request(http.MethodGet, "/routedns/api/elements/blocklist/stats?top=5", "secret", "")
+	require.Equal(t, http.StatusOK, code)
+	var stats BlocklistStats
+	require.NoError(t, json.Unmarshal(body, &stats))
+	require.Equal(t, int64(3), stats.Blocked)
+	require.Equal(t, []NameCount{{Name: "block.test.", Count: 3}}, stats.TopBlocked)
+	code, _ = request(http.MethodGet, "/routedns/api/elements/blocklist/stats?top=x", "secret", "")
+	require.Equal(t, http.StatusBadRequest, code)
+	code, _ = request(http.MethodGet, "/routedns/api/elements/cache/stats", "secret", "")
+	require.Equal(t, http.StatusBadRequest, code)
+
+	// The API can't be enabled without a token
+	_, err = NewAdminListener("test-admin-api-notoken", "", AdminListenerOptions{
+		Elements: func() map[string]Resolver { return elements },
+	})
+	require.Error(t, err)
+}
+
+func TestAdminAPICaptivePortal(t *testing.T) {
+	portal, err := NewCaptivePortal("test-api-portal", new(TestResolver), CaptivePortalOptions{
+		PortalIPs: []net.IP{net.ParseIP("192.0.2.1")},
+	})
+	require.NoError(t, err)
+	elements := map[string]Resolver{
+		"portal": portal,
+		"other":  new(TestResolver),
+	}
+	l, err := NewAdminListener("test-admin-api-portal", "", AdminListenerOptions{
+		Elements: func() map[string]Resolver { return elements },
+		APIToken: "secret",
+	})
+	require.NoError(t, err)
+
+	request := func(method, path, body string) (int, []byte) {
+		req := httptest.NewRequest(method, path, strings.NewReader(body))
+		req.RemoteAddr = "127.0.0.1:1234"
+		req.Header.Set("Authorization", "Bearer secret")
+		w := httptest.NewRecorder()
+		l.mux.ServeHTTP(w, req)
+		return w.Code, w.Body.Bytes()
+	}
+
+	code, body := request(http.MethodPost, "/routedns/api/elements/portal/clients", `{"ip": "192.0.2.10", "duration": "1h"}`)
+	require.Equal(t, http.StatusOK, code)
+	var status elementStatus
+	require.NoError(t, json.Unmarshal(body, &status))
+	require.Len(t, status.Clients, 1)
+	require.Equal(t, "192.0.2.10", status.Clients[0].IP)
+	require.NotNil(t, status.Clients[0].Expires)
+
+	code, _ = request(http.MethodPost, "/routedns/api/elements/portal/clients", `{"ip": "invalid"}`)
+	require.Equal(t, http.StatusBadRequest, code)
+	code, _ = request(http.MethodPost, "/routedns/api/elements/other/clients", `{"ip": "192.0.2.10"}`)
+	require.Equal(t, http.StatusBadRequest, code)
+
+	code, _ = request(http.MethodDelete, "/routedns/api/elements/portal/clients/192.0.2.10", "")
+	require.Equal(t, http.StatusOK, code)
+	code, _ = request(http.MethodDelete, "/routedns/api/elements/portal/clients/192.0.2.10", "")
+	require.Equal(t, http.StatusNotFound, code)
+	require.Empty(t, portal.Clients())
+}
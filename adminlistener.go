@@ -3,12 +3,14 @@ package rdns
 import (
 	"context"
 	"crypto/tls"
+	"errors"
 	"expvar"
 	"fmt"
 	"net"
 	"net/http"
 	"time"
 
+	"github.com/prometheus/client_golang/prometheus/promhttp"
 	"github.com/quic-go/quic-go"
 	"github.com/quic-go/quic-go/http3"
 	"github.com/sirupsen/logrus"
@@ -39,6 +41,21 @@ type AdminListenerOptions struct {
 	Transport string
 
 	TLSConfig *tls.Config
+
+	// Serve metrics in Prometheus format on /metrics in addition to expvar.
+	Prometheus bool
+
+	// Called on POST requests to /routedns/reload, to reload the configuration.
+	// The endpoint isn't available if nil.
+	Reload func() error
+
+	// Returns the elements that can be inspected and managed through the API
+	// under /routedns/api/, by ID. Requires an APIToken.
+	Elements func() map[string]Resolver
+
+	// Token that has to be sent as "Authorization: Bearer <token>" in requests
+	// to the API and the reload endpoint.
+	APIToken string
 }
 
 // NewAdminListener returns an instance of an admin service listener.
@@ -60,9 +77,37 @@ func NewAdminListener(id, addr string, opt AdminListenerOptions) (*AdminListener
 	}
 	// Serve metrics.
 	l.mux.Handle("/routedns/vars", expvar.Handler())
+	if opt.Prometheus {
+		if err := RegisterPrometheus(); err != nil {
+			return nil, err
+		}
+		l.mux.Handle("/metrics", promhttp.Handler())
+	}
+	if opt.Reload != nil {
+		l.mux.HandleFunc("/routedns/reload", l.authorize(l.reloadHandler))
+	}
+	if opt.Elements != nil {
+		if opt.APIToken == "" {
+			return nil, errors.New("admin api requires a token")
+		}
+		l.registerAPI()
+	}
 	return l, nil
 }
 
+func (s *AdminListener) reloadHandler(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodPost {
+		http.Error(w, http.StatusText(http.StatusMethodNotAllowed), http.StatusMethodNotAllowed)
+		return
+	}
+	if err := s.opt.Reload(); err != nil {
+		Log.WithField("id", s.id).WithError(err).Error("failed to reload configuration")
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	w.Write([]byte("ok\n"))
+}
+
 // Start the admin server.
 func (s *AdminListener) Start() error {
 	Log.WithFields(logrus.Fields{"id": s.id, "protocol": s.opt.Transport, "addr": s.addr}).Info("starting listener")
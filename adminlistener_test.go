@@ -0,0 +1,45 @@
+package rdns
+
+import (
+	"errors"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/stretchr/testify/require"
+)
+
+func TestAdminListenerReload(t *testing.T) {
+	var reloads int
+	var reloadErr error
+	_, allowed, _ := net.ParseCIDR("127.0.0.0/8")
+	l, err := NewAdminListener("test-admin", "", AdminListenerOptions{
+		ListenOptions: ListenOptions{AllowedNet: []*net.IPNet{allowed}},
+		Reload: func() error {
+			reloads++
+			return reloadErr
+		},
+	})
+	require.NoError(t, err)
+
+	request := func(method, remoteAddr string) int {
+		req := httptest.NewRequest(method, "/routedns/reload", nil)
+		req.RemoteAddr = remoteAddr
+		w := httptest.NewRecorder()
+		l.mux.ServeHTTP(w, req)
+		return w.Code
+	}
+
+	require.Equal(t, http.StatusOK, request(http.MethodPost, "127.0.0.1:1234"))
+	require.Equal(t, http.StatusMethodNotAllowed, request(http.MethodGet, "127.0.0.1:1234"))
+	require.Equal(t, http.StatusForbidden, request(http.MethodPost, "192.168.1.1:1234"))
+	reloadErr = errors.New("invalid config")
+	require.Equal(t, http.StatusInternalServerError, request(http.MethodPost, "127.0.0.1:1234"))
+	require.Equal(t, 2, reloads)
+
+	// Not available unless enabled
+	l, err = NewAdminListener("test-admin-noreload", "", AdminListenerOptions{})
+	require.NoError(t, err)
+	require.Equal(t, http.StatusNotFound, request(http.MethodPost, "127.0.0.1:1234"))
+}
@@ -0,0 +1,109 @@
+package rdns
+
+import (
+	"errors"
+	"fmt"
+	"net"
+	"strconv"
+	"strings"
+
+	"github.com/oschwald/maxminddb-golang"
+)
+
+// ASNDB holds blocklist rules based on the autonomous system an IP belongs
+// to. The AS number of an IP is looked up in a database and compared to the
+// blocklist rules.
+type ASNDB struct {
+	name      string
+	loader    BlocklistLoader
+	asnDB     *maxminddb.Reader
+	asnDBFile string
+	db        map[uint64]struct{}
+}
+
+var _ IPBlocklistDB = &ASNDB{}
+
+// NewASNDB returns a new instance of a matcher for AS number rules. Rules are
+// AS numbers, optionally prefixed with "AS", like "AS64496".
+func NewASNDB(name string, loader BlocklistLoader, asnDBFile string) (*ASNDB, error) {
+	if asnDBFile == "" {
+		asnDBFile = "/usr/share/GeoIP/GeoLite2-ASN.mmdb"
+	}
+	asnDB, err := maxminddb.Open(asnDBFile)
+	if err != nil {
+		return nil, fmt.Errorf("failed to open ASN database file: %w", err)
+	}
+
+	rules, err := loader.Load()
+	if err != nil {
+		asnDB.Close()
+		return nil, err
+	}
+
+	db := make(map[uint64]struct{})
+	for _, r := range rules {
+		r = strings.TrimSpace(r)
+		if strings.HasPrefix(r, "#") || r == "" {
+			continue
+		}
+		r = strings.Split(r, "#")[0] // possible comment at the end of the line
+		r = strings.TrimSpace(r)
+		value, err := parseASN(r)
+		if err != nil {
+			asnDB.Close()
+			return nil, fmt.Errorf("unable to parse AS number in rule '%s': %w", r, err)
+		}
+		db[value] = struct{}{}
+	}
+	return &ASNDB{
+		name:      name,
+		asnDB:     asnDB,
+		asnDBFile: asnDBFile,
+		db:        db,
+		loader:    loader,
+	}, nil
+}
+
+func (m *ASNDB) Reload() (IPBlocklistDB, error) {
+	db, err := NewASNDB(m.name, m.loader, m.asnDBFile)
+	if errors.Is(err, ErrNotModified) {
+		return m, nil
+	}
+	return db, err
+}
+
+func (m *ASNDB) Match(ip net.IP) (*BlocklistMatch, bool) {
+	var record struct {
+		ASN uint64 `maxminddb:"autonomous_system_number"`
+	}
+	if err := m.asnDB.Lookup(ip, &record); err != nil {
+		Log.WithField("ip", ip).WithError(err).Error("failed to lookup ip in ASN database")
+		return nil, false
+	}
+	if record.ASN == 0 {
+		return nil, false
+	}
+	if _, ok := m.db[record.ASN]; ok {
+		return &BlocklistMatch{
+			List: m.name,
+			Rule: fmt.Sprintf("AS%d", record.ASN),
+		}, true
+	}
+	return nil, false
+}
+
+func (m *ASNDB) Close() error {
+	return m.asnDB.Close()
+}
+
+func (m *ASNDB) String() string {
+	return "ASN-blocklist"
+}
+
+// Parse an AS number with or without "AS" prefix.
+func parseASN(s string) (uint64, error) {
+	if len(s) > 2 && strings.EqualFold(s[:2], "as") {
+		s = s[2:]
+	}
+	return strconv.ParseUint(s, 10, 32)
+}
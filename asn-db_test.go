@@ -0,0 +1,19 @@
+package rdns
+
+import (
+	"testing"
+
+	"github.com/stretchr/testify/require"
+)
+
+func TestParseASN(t *testing.T) {
+	for _, s := range []string{"64496", "AS64496", "as64496"} {
+		asn, err := parseASN(s)
+		require.NoError(t, err, s)
+		require.Equal(t, uint64(64496), asn)
+	}
+	for _, s := range []string{"", "AS", "ASN64496", "4294967296"} {
+		_, err := parseASN(s)
+		require.Error(t, err, s)
+	}
+}
@@ -0,0 +1,19 @@
+package rdns
+
+import (
+	"syscall"
+)
+
+// Returns a socket control function that binds sockets to a network interface
+// with SO_BINDTODEVICE. Requires CAP_NET_RAW on older kernels.
+func bindToDevice(iface string) func(network, address string, c syscall.RawConn) error {
+	return func(network, address string, c syscall.RawConn) error {
+		var err error
+		if cerr := c.Control(func(fd uintptr) {
+			err = syscall.SetsockoptString(int(fd), syscall.SOL_SOCKET, syscall.SO_BINDTODEVICE, iface)
+		}); cerr != nil {
+			return cerr
+		}
+		return err
+	}
+}
@@ -0,0 +1,17 @@
+//go:build !linux
+
+package rdns
+
+import (
+	"errors"
+	"syscall"
+)
+
+var errBindToDeviceUnsupported = errors.New("binding to an interface is not supported on this platform")
+
+// Binding sockets to an interface is only supported on Linux.
+func bindToDevice(iface string) func(network, address string, c syscall.RawConn) error {
+	return func(network, address string, c syscall.RawConn) error {
+		return errBindToDeviceUnsupported
+	}
+}
@@ -0,0 +1,144 @@
+package rdns
+
+import (
+	"fmt"
+	"net"
+	"strconv"
+	"strings"
+)
+
+// BlocklistActionType defines how a query that matched a rule is answered.
+type BlocklistActionType int
+
+const (
+	// Use the behavior configured in the blocklist, only override the TTL.
+	BlocklistActionDefault BlocklistActionType = iota
+	// Respond with NXDOMAIN.
+	BlocklistActionNXDomain
+	// Respond with REFUSED.
+	BlocklistActionRefused
+	// Respond with 0.0.0.0 or :: to A or AAAA queries, NXDOMAIN otherwise.
+	BlocklistActionNull
+	// Respond with the given IPs to A or AAAA queries, NXDOMAIN otherwise.
+	BlocklistActionIP
+	// Forward the query to another resolver.
+	BlocklistActionForward
+	// Respond with NOERROR and an empty answer.
+	BlocklistActionNoData
+	// Don't respond at all.
+	BlocklistActionDrop
+)
+
+// BlockResponse defines how a blocked query is answered when there are no
+// spoofed records to respond with and no blocklist-resolver to forward to.
+type BlockResponse int
+
+const (
+	// Respond with NXDOMAIN.
+	BlockResponseNXDomain BlockResponse = iota
+	// Respond with REFUSED.
+	BlockResponseRefused
+	// Respond with NOERROR and an empty answer (NODATA).
+	BlockResponseNoData
+	// Drop the query without responding.
+	BlockResponseDrop
+)
+
+// BlocklistAction is the response for queries matching a specific rule,
+// overriding the behavior of the blocklist.
+type BlocklistAction struct {
+	Type BlocklistActionType
+
+	// IPs to respond with, for BlocklistActionIP.
+	IPs []net.IP
+
+	// ID of the resolver to forward to, for BlocklistActionForward.
+	Resolver string
+
+	// TTL of the records in the response, and of the SOA in negative
+	// responses. Uses the blocklist's TTL if 0.
+	TTL uint32
+}
+
+// Split the options off the end of a rule. Options are separated from the
+// rule and from each other by whitespace:
+//
+//	action=nxdomain|refused|nodata|drop|null|ip:<ip>[,<ip>...]|forward:<resolver>
+//	ttl=<seconds>
+//
+// Returns nil if the rule has no options.
+func parseBlocklistAction(rule string) (string, *BlocklistAction, error) {
+	// Most rules have no options, don't split them up
+	if !strings.Contains(rule, "=") {
+		return strings.TrimSpace(rule), nil, nil
+	}
+	fields := strings.Fields(rule)
+	var action *BlocklistAction
+	for len(fields) > 1 {
+		key, value, ok := strings.Cut(fields[len(fields)-1], "=")
+		if !ok || (key != "action" && key != "ttl") {
+			break
+		}
+		if action == nil {
+			action = new(BlocklistAction)
+		}
+		switch key {
+		case "ttl":
+			ttl, err := strconv.ParseUint(value, 10, 32)
+			if err != nil {
+				return "", nil, fmt.Errorf("invalid ttl in rule '%s'", rule)
+			}
+			action.TTL = uint32(ttl)
+		case "action":
+			name, arg, _ := strings.Cut(value, ":")
+			switch name {
+			case "nxdomain":
+				action.Type = BlocklistActionNXDomain
+			case "refused":
+				action.Type = BlocklistActionRefused
+			case "nodata":
+				action.Type = BlocklistActionNoData
+			case "drop":
+				action.Type = BlocklistActionDrop
+			case "null":
+				action.Type = BlocklistActionNull
+			case "ip":
+				action.Type = BlocklistActionIP
+				for _, s := range strings.Split(arg, ",") {
+					ip := net.ParseIP(s)
+					if ip == nil {
+						return "", nil, fmt.Errorf("invalid ip '%s' in rule '%s'", s, rule)
+					}
+					if ip4 := ip.To4(); ip4 != nil {
+						ip = ip4
+					}
+					action.IPs = append(action.IPs, ip)
+				}
+			case "forward":
+				if arg == "" {
+					return "", nil, fmt.Errorf("no resolver in rule '%s'", rule)
+				}
+				action.Type = BlocklistActionForward
+				action.Resolver = arg
+			default:
+				return "", nil, fmt.Errorf("unsupported action '%s' in rule '%s'", name, rule)
+			}
+		}
+		fields = fields[:len(fields)-1]
+	}
+	if action == nil {
+		return strings.TrimSpace(rule), nil, nil
+	}
+	return strings.Join(fields, " "), action, nil
+}
+
+// Returns the IPs to respond with for null and ip actions.
+func (a *BlocklistAction) spoofIPs() []net.IP {
+	switch a.Type {
+	case BlocklistActionNull:
+		return []net.IP{net.IPv4zero.To4(), net.IPv6zero}
+	case BlocklistActionIP:
+		return a.IPs
+	}
+	return nil
+}
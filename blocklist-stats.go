@@ -0,0 +1,263 @@
+package rdns
+
+import (
+	"container/heap"
+	"encoding/json"
+	"expvar"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+)
+
+const (
+	// Max number of rules a blocklist counts blocked queries for. Rules that
+	// first match after that are only counted in the totals.
+	maxRuleCounters = 10000
+
+	// Number of names counted in each window of the top blocked names. Once
+	// the table is full, new names replace the one with the fewest blocks.
+	topBlockedCapacity = 1000
+
+	// Length of the windows the top blocked names are counted in. The table
+	// covers the current and the previous window.
+	topBlockedWindow = time.Hour
+
+	// Number of names published in expvar and the Prometheus metrics.
+	topBlockedExport = 20
+)
+
+// BlocklistStats are the counters of a blocklist as returned by the admin API.
+type BlocklistStats struct {
+	Blocked    int64                       `json:"blocked"`
+	Allowed    int64                       `json:"allowed"`
+	WouldBlock int64                       `json:"would-block"`
+	ByList     map[string]int64            `json:"by-list"`
+	ByRule     map[string]map[string]int64 `json:"by-rule"`
+	TopBlocked []NameCount                 `json:"top-blocked"`
+}
+
+// NameCount is the number of blocked queries for a name.
+type NameCount struct {
+	Name  string `json:"name"`
+	Count int64  `json:"count"`
+}
+
+// Stats returns a snapshot of the counters with up to top of the most blocked
+// names.
+func (m *BlocklistMetrics) Stats(top int) BlocklistStats {
+	s := BlocklistStats{
+		Blocked:    m.blocked.Value(),
+		Allowed:    m.allowed.Value(),
+		WouldBlock: m.wouldBlock.Value(),
+		ByList:     make(map[string]int64),
+		ByRule:     m.blockedByRule.snapshot(),
+		TopBlocked: m.topBlocked.top(top),
+	}
+	m.blockedByList.Do(func(kv expvar.KeyValue) {
+		if v, ok := kv.Value.(*expvar.Int); ok {
+			s.ByList[kv.Key] = v.Value()
+		}
+	})
+	return s
+}
+
+// ruleCounters counts blocked queries by list and rule.
+type ruleCounters struct {
+	mu     sync.Mutex
+	counts map[string]map[string]int64
+	rules  int
+}
+
+var _ expvar.Var = &ruleCounters{}
+
+func (c *ruleCounters) add(list, rule string) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	rules, ok := c.counts[list]
+	if !ok {
+		rules = make(map[string]int64)
+		c.counts[list] = rules
+	}
+	if _, ok := rules[rule]; !ok {
+		if c.rules >= maxRuleCounters {
+			return
+		}
+		c.rules++
+	}
+	rules[rule]++
+}
+
+func (c *ruleCounters) snapshot() map[string]map[string]int64 {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	out := make(map[string]map[string]int64, len(c.counts))
+	for list, rules := range c.counts {
+		m := make(map[string]int64, len(rules))
+		for rule, n := range rules {
+			m[rule] = n
+		}
+		out[list] = m
+	}
+	return out
+}
+
+// String returns the counters as JSON for expvar.
+func (c *ruleCounters) String() string {
+	b, _ := json.Marshal(c.snapshot())
+	return string(b)
+}
+
+// topCounter keeps track of the most blocked names of the last one to two
+// windows. The number of names is limited, when a window is full, the name
+// with the lowest count is replaced and its count is carried over to the new
+// name (Space-Saving algorithm). This overestimates rare names a little, but
+// frequently blocked names can't be pushed out by a burst of new ones.
+type topCounter struct {
+	mu       sync.Mutex
+	window   time.Duration
+	capacity int
+	start    time.Time
+	current  *topWindow
+	previous *topWindow
+	now      func() time.Time
+}
+
+var _ expvar.Var = &topCounter{}
+
+func newTopCounter(window time.Duration, capacity int) *topCounter {
+	return &topCounter{
+		window:   window,
+		capacity: capacity,
+		current:  newTopWindow(),
+		previous: newTopWindow(),
+		now:      time.Now,
+	}
+}
+
+func (c *topCounter) add(name string) {
+	name = strings.ToLower(name)
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.rotate()
+	c.current.add(name, c.capacity)
+}
+
+// Returns up to n names with the highest counts in the current and previous
+// window.
+func (c *topCounter) top(n int) []NameCount {
+	c.mu.Lock()
+	c.rotate()
+	merged := make(map[string]int64, len(c.current.heap)+len(c.previous.heap))
+	for _, w := range []*topWindow{c.previous, c.current} {
+		for _, e := range w.heap {
+			merged[e.name] += e.count
+		}
+	}
+	c.mu.Unlock()
+
+	top := make([]NameCount, 0, len(merged))
+	for name, count := range merged {
+		top = append(top, NameCount{Name: name, Count: count})
+	}
+	sort.Slice(top, func(i, j int) bool {
+		if top[i].Count != top[j].Count {
+			return top[i].Count > top[j].Count
+		}
+		return top[i].Name < top[j].Name
+	})
+	if len(top) > n {
+		top = top[:n]
+	}
+	return top
+}
+
+// Starts a new window if the current one is over. Must be called with the
+// lock held.
+func (c *topCounter) rotate() {
+	now := c.now()
+	if c.start.IsZero() {
+		c.start = now
+		return
+	}
+	elapsed := now.Sub(c.start)
+	if elapsed < c.window {
+		return
+	}
+	if elapsed < 2*c.window {
+		c.previous = c.current
+	} else {
+		c.previous = newTopWindow()
+	}
+	c.current = newTopWindow()
+	c.start = now
+}
+
+// String returns the most blocked names as JSON for expvar.
+func (c *topCounter) String() string {
+	b, _ := json.Marshal(c.top(topBlockedExport))
+	return string(b)
+}
+
+// topWindow holds the counts of one window in a min-heap by count, so the name
+// with the lowest count can be found and replaced in O(log n).
+type topWindow struct {
+	index map[string]*topEntry
+	heap  topHeap
+}
+
+type topEntry struct {
+	name  string
+	count int64
+	pos   int // position in the heap
+}
+
+func newTopWindow() *topWindow {
+	return &topWindow{index: make(map[string]*topEntry)}
+}
+
+// Counts a name. If it's new and the window already holds capacity names, it
+// replaces the one with the lowest count.
+func (w *topWindow) add(name string, capacity int) {
+	if e, ok := w.index[name]; ok {
+		e.count++
+		heap.Fix(&w.heap, e.pos)
+		return
+	}
+	if len(w.heap) < capacity {
+		e := &topEntry{name: name, count: 1}
+		w.index[name] = e
+		heap.Push(&w.heap, e)
+		return
+	}
+	e := w.heap[0]
+	delete(w.index, e.name)
+	e.name = name
+	e.count++
+	w.index[name] = e
+	heap.Fix(&w.heap, 0)
+}
+
+// topHeap implements heap.Interface for the entries of a window.
+type topHeap []*topEntry
+
+func (h topHeap) Len() int           { return len(h) }
+func (h topHeap) Less(i, j int) bool { return h[i].count < h[j].count }
+func (h topHeap) Swap(i, j int) {
+	h[i], h[j] = h[j], h[i]
+	h[i].pos = i
+	h[j].pos = j
+}
+
+func (h *topHeap) Push(x any) {
+	e := x.(*topEntry)
+	e.pos = len(*h)
+	*h = append(*h, e)
+}
+
+func (h *topHeap) Pop() any {
+	old := *h
+	e := old[len(old)-1]
+	*h = old[:len(old)-1]
+	return e
+}
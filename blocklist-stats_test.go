@@ -0,0 +1,58 @@
+package rdns
+
+import (
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/require"
+)
+
+func TestTopCounter(t *testing.T) {
+	now := time.Now()
+	c := newTopCounter(time.Hour, 3)
+	c.now = func() time.Time { return now }
+
+	for _, name := range []string{"a.", "a.", "a.", "B.", "b.", "c."} {
+		c.add(name)
+	}
+	require.Equal(t, []NameCount{{"a.", 3}, {"b.", 2}, {"c.", 1}}, c.top(10))
+	require.Equal(t, []NameCount{{"a.", 3}}, c.top(1))
+
+	// The table is full, the name with the lowest count is replaced and its
+	// count carried over
+	c.add("d.")
+	require.Equal(t, []NameCount{{"a.", 3}, {"b.", 2}, {"d.", 2}}, c.top(10))
+
+	// The previous window is still included
+	now = now.Add(time.Hour)
+	c.add("e.")
+	require.Equal(t, []NameCount{{"a.", 3}, {"b.", 2}, {"d.", 2}, {"e.", 1}}, c.top(10))
+
+	// Older windows are dropped
+	now = now.Add(time.Hour)
+	require.Equal(t, []NameCount{{"e.", 1}}, c.top(10))
+	now = now.Add(3 * time.Hour)
+	require.Empty(t, c.top(10))
+}
+
+// Frequently blocked names stay in the table when it's flooded with new ones.
+func TestTopCounterBurst(t *testing.T) {
+	c := newTopCounter(time.Hour, 100)
+	for i := 0; i < 50; i++ {
+		c.add("a.")
+	}
+	for i := 0; i < 1000; i++ {
+		c.add(time.Duration(i).String() + ".")
+	}
+	require.Equal(t, []NameCount{{"a.", 50}}, c.top(1))
+}
+
+func TestRuleCountersLimit(t *testing.T) {
+	c := &ruleCounters{counts: make(map[string]map[string]int64)}
+	for i := 0; i < maxRuleCounters+10; i++ {
+		c.add("list", string(rune('a'+i%26))+time.Duration(i).String())
+	}
+	c.add("list", "a0s")
+	require.Len(t, c.snapshot()["list"], maxRuleCounters)
+	require.Equal(t, int64(2), c.snapshot()["list"]["a0s"])
+}
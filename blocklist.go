@@ -3,7 +3,10 @@ package rdns
 import (
 	"errors"
 	"expvar"
+	"fmt"
 	"net"
+	"regexp"
+	"strings"
 	"sync"
 	"time"
 
@@ -19,6 +22,25 @@ type Blocklist struct {
 	resolver Resolver
 	mu       sync.RWMutex
 	metrics  *BlocklistMetrics
+
+	// Client networks of the scoped blocklists, indexes into ScopedBlocklists
+	scoped ipNetworks
+
+	// Set if any of the scoped blocklists select clients by more than the
+	// network, they're then matched one by one instead of with the trie
+	scopedSelectors bool
+
+	// Prevents overlapping reloads of the same list
+	reloads reloadGroup
+
+	// Rules added at runtime with AddRules, and the lists built from them
+	runtimeBlockRules []string
+	runtimeAllowRules []string
+	runtimeBlocklist  BlocklistDB
+	runtimeAllowlist  BlocklistDB
+
+	// Stops the refresh loops
+	loops stopper
 }
 
 var _ Resolver = &Blocklist{}
@@ -46,6 +68,124 @@ type BlocklistOptions struct {
 	// Optional, allows specifying extended errors to be used in the
 	// response when blocking.
 	EDNS0EDETemplate *EDNS0EDETemplate
+
+	// Add an EDE option with code 15 (Blocked) and the name of the matching
+	// list to negative responses of blocked queries if no EDNS0EDETemplate is
+	// set. Only used if the query has EDNS0.
+	DefaultEDE bool
+
+	// Response to blocked queries that aren't spoofed or forwarded to the
+	// BlocklistResolver. Defaults to NXDOMAIN.
+	BlockResponse BlockResponse
+
+	// TTL of spoofed A, AAAA, and PTR records in responses to blocked queries.
+	// Defaults to 3600.
+	SpoofTTL uint32
+
+	// Add a synthetic SOA to the authority section of NXDOMAIN and NODATA
+	// responses for blocked queries, with this value as TTL and MINIMUM. Allows clients and
+	// downstream caches to cache the response as per RFC2308. Disabled if 0.
+	BlockSOATTL uint32
+
+	// MNAME and RNAME of the synthetic SOA. Default to "ns.routedns.invalid."
+	// and "hostmaster.routedns.invalid.".
+	BlockSOAMname string
+	BlockSOARname string
+
+	// If enabled, queries that don't match the blocklist are forwarded and
+	// the CNAME targets in the response are checked against the blocklist.
+	// Finding a match blocks the response as if the query name had matched.
+	// Used to defend against CNAME cloaking.
+	FollowCNAME bool
+
+	// Match every question of queries with more than one question and block
+	// the query if any of them is blocked. Such queries are refused with
+	// FORMERR otherwise.
+	MatchAllQuestions bool
+
+	// Don't block queries that match the blocklist, only log and count them.
+	// Used to evaluate a blocklist against live traffic before enabling it.
+	ReportOnly bool
+
+	// Optional, only enforce the blocklist while the schedule is active. Queries
+	// outside of it are forwarded unmodified. Always active if nil.
+	ActiveSchedule *Schedule
+
+	// Add an EDNS0 EDE option with the matching allowlist and rule to responses
+	// of queries that matched the allowlist. Only used if the query has EDNS0.
+	AnnotateAllowed bool
+
+	// Resolvers that rules with a forward action can send queries to, by ID.
+	// Queries matching rules with unknown resolvers are blocked with NXDOMAIN.
+	ActionResolvers map[string]Resolver
+
+	// Optional, blocklists that only apply to specific clients. If a client
+	// matches more than one, the one with the most specific network is used,
+	// then the one with the most selectors, then the first one.
+	ScopedBlocklists []ScopedBlocklist
+}
+
+// ScopedBlocklist is a blocklist that is only applied to queries from clients
+// in the given networks, or with the given DoH path, TLS server name or TLS
+// client certificate identity. All selectors that are set have to match.
+type ScopedBlocklist struct {
+	Networks      []*net.IPNet
+	DoHPath       *regexp.Regexp
+	TLSServerName *regexp.Regexp
+	TLSClientName *regexp.Regexp
+
+	DB BlocklistDB
+
+	// Optional allowlist for matching clients.
+	AllowlistDB BlocklistDB
+
+	// Use these lists instead of the default ones for matching clients, rather
+	// than in addition to them.
+	Replace bool
+}
+
+// Returns true if the client is selected by the scoped blocklist, and how
+// specific the match is. The specificity is the prefix length of the matching
+// network, or -1 if there are no networks.
+func (s ScopedBlocklist) matches(ci ClientInfo) (int, bool) {
+	if s.DoHPath != nil && !s.DoHPath.MatchString(ci.DoHPath) {
+		return 0, false
+	}
+	if s.TLSServerName != nil && !s.TLSServerName.MatchString(ci.TLSServerName) {
+		return 0, false
+	}
+	if s.TLSClientName != nil && !matchTLSClientName(s.TLSClientName, ci.TLSClientNames) {
+		return 0, false
+	}
+	if len(s.Networks) == 0 {
+		return -1, true
+	}
+	bits, ok := -1, false
+	for _, n := range s.Networks {
+		if !n.Contains(ci.SourceIP) {
+			continue
+		}
+		if ones, _ := n.Mask.Size(); ones > bits {
+			bits = ones
+		}
+		ok = true
+	}
+	return bits, ok
+}
+
+// Number of selectors other than the network.
+func (s ScopedBlocklist) selectors() int {
+	var n int
+	if s.DoHPath != nil {
+		n++
+	}
+	if s.TLSServerName != nil {
+		n++
+	}
+	if s.TLSClientName != nil {
+		n++
+	}
+	return n
 }
 
 type BlocklistMetrics struct {
@@ -53,6 +193,14 @@ type BlocklistMetrics struct {
 	blocked *expvar.Int
 	// Allowed queries count.
 	allowed *expvar.Int
+	// Blocked queries by the name of the list that matched.
+	blockedByList *expvar.Map
+	// Queries that matched the blocklist but were forwarded in report-only mode.
+	wouldBlock *expvar.Int
+	// Blocked queries by list and rule.
+	blockedByRule *ruleCounters
+	// Most blocked query names.
+	topBlocked *topCounter
 }
 
 const (
@@ -61,9 +209,28 @@ const (
 )
 
 func NewBlocklistMetrics(id string) *BlocklistMetrics {
-	return &BlocklistMetrics{
-		allowed: getVarInt("router", id, "allow"),
-		blocked: getVarInt("router", id, "deny"),
+	m := &BlocklistMetrics{
+		allowed:       getVarInt("router", id, "allow"),
+		blocked:       getVarInt("router", id, "deny"),
+		blockedByList: getVarMap("router", id, "deny-by-list"),
+		wouldBlock:    getVarInt("router", id, "would_block"),
+		blockedByRule: getVarRuleCounters("router", id, "deny-by-rule"),
+		topBlocked:    getVarTopCounter("router", id, "top-deny"),
+	}
+	blocklistMetrics.Store(id, m)
+	return m
+}
+
+// Count a blocked query, its name, and the list and rule responsible for it.
+// The per-list and per-rule counters are created on first use.
+func (m *BlocklistMetrics) countBlocked(q *dns.Msg, match *BlocklistMatch) {
+	m.blocked.Add(1)
+	if name := qName(q); name != "" {
+		m.topBlocked.add(name)
+	}
+	if match != nil {
+		m.blockedByList.Add(match.List, 1)
+		m.blockedByRule.add(match.List, match.Rule)
 	}
 }
 
@@ -76,6 +243,23 @@ func NewBlocklist(id string, resolver Resolver, opt BlocklistOptions) (*Blocklis
 		metrics:          NewBlocklistMetrics(id),
 	}
 
+	// Copy the scoped lists since they are updated on reload
+	blocklist.ScopedBlocklists = append([]ScopedBlocklist(nil), opt.ScopedBlocklists...)
+	for i, scoped := range blocklist.ScopedBlocklists {
+		if scoped.DB == nil {
+			return nil, fmt.Errorf("no blocklist defined for scoped blocklist %d in %q", i, id)
+		}
+		if len(scoped.Networks) == 0 && scoped.selectors() == 0 {
+			return nil, fmt.Errorf("no networks or other client selectors defined for scoped blocklist %d in %q", i, id)
+		}
+		if scoped.selectors() > 0 {
+			blocklist.scopedSelectors = true
+		}
+		for _, n := range scoped.Networks {
+			blocklist.scoped.add(n, i)
+		}
+	}
+
 	// Start the refresh goroutines if we have a list and a refresh period was given
 	if blocklist.BlocklistDB != nil && blocklist.BlocklistRefresh > 0 {
 		go blocklist.refreshLoopBlocklist(blocklist.BlocklistRefresh)
@@ -95,48 +279,325 @@ func (r *Blocklist) Resolve(q *dns.Msg, ci ClientInfo) (*dns.Msg, error) {
 	question := q.Question[0]
 	log := logger(r.id, q, ci)
 
-	r.mu.RLock()
-	blocklistDB := r.BlocklistDB
-	allowlistDB := r.AllowlistDB
-	r.mu.RUnlock()
+	// Only the first question would be matched, don't let others through unchecked
+	if len(q.Question) > 1 && !r.MatchAllQuestions {
+		log.Debug("refusing query with multiple questions")
+		return responseWithCode(q, dns.RcodeFormatError), nil
+	}
+
+	// Outside the schedule, the blocklist isn't enforced
+	if !r.ActiveSchedule.Active() {
+		log.WithField("resolver", r.resolver.String()).Debug("blocklist not active, forwarding")
+		r.metrics.allowed.Add(1)
+		return r.resolver.Resolve(q, ci)
+	}
+
+	blocklistDB, allowlistDB := r.listsForClient(ci)
+	question, res := matchQuestions(q.Question, blocklistDB, allowlistDB)
+	if len(q.Question) > 1 {
+		log = log.WithField("matched-qname", question.Name)
+	}
 
 	// Forward to upstream or the optional allowlist-resolver immediately if there's a match in the allowlist
-	if allowlistDB != nil {
-		if _, _, match, ok := allowlistDB.Match(question); ok {
-			log = log.WithFields(logrus.Fields{"list": match.List, "rule": match.Rule})
-			r.metrics.allowed.Add(1)
-			if r.AllowListResolver != nil {
-				log.WithField("resolver", r.AllowListResolver.String()).Debug("matched allowlist, forwarding")
-				return r.AllowListResolver.Resolve(q, ci)
+	if match := res.allowed; match != nil {
+		log = log.WithFields(logrus.Fields{"list": match.List, "rule": match.Rule})
+		r.metrics.allowed.Add(1)
+
+		// Show the blocklist rule the allowlist takes precedence over, if any
+		if log.Logger.IsLevelEnabled(logrus.DebugLevel) {
+			if _, _, blocked, ok := blocklistDB.Match(question); ok {
+				log = log.WithFields(logrus.Fields{"overridden-list": blocked.List, "overridden-rule": blocked.Rule})
 			}
-			log.WithField("resolver", r.resolver.String()).Debug("matched allowlist, forwarding")
-			return r.resolver.Resolve(q, ci)
 		}
+		resolver := r.resolver
+		if r.AllowListResolver != nil {
+			resolver = r.AllowListResolver
+		}
+		log.WithField("resolver", resolver.String()).Debug("matched allowlist, forwarding")
+		a, err := resolver.Resolve(q, ci)
+		if err == nil && a != nil && r.AnnotateAllowed {
+			annotateAllowed(a, q, match)
+		}
+		return a, err
 	}
 
-	ips, names, match, ok := blocklistDB.Match(question)
-	if !ok {
+	match := res.blocked
+	if match == nil {
 		// Didn't match anything, pass it on to the next resolver
 		log.WithField("resolver", r.resolver.String()).Debug("forwarding unmodified query to resolver")
+		if r.FollowCNAME {
+			return r.resolveFollowCNAME(q, ci, blocklistDB, allowlistDB)
+		}
 		r.metrics.allowed.Add(1)
 		return r.resolver.Resolve(q, ci)
 	}
 	log = log.WithFields(logrus.Fields{"list": match.List, "rule": match.Rule})
-	r.metrics.blocked.Add(1)
+	if r.ReportOnly {
+		r.reportMatch(log)
+		return r.resolver.Resolve(q, ci)
+	}
+	r.metrics.countBlocked(q, match)
+	return r.blockResponse(q, question, ci, log, res)
+}
+
+// Check returns whether a query for the name and type would be blocked, along with
+// the list and rule that matched, and the IPs the response would be spoofed with.
+// If the name matches the allowlist, blocked is false and the allowlist rule is
+// returned. The same matching as in Resolve is used, but without client-specific
+// blocklists, schedule, or report-only mode. No query is sent upstream.
+func (r *Blocklist) Check(name string, qtype uint16) (blocked bool, list, rule string, spoofIPs []net.IP) {
+	question := dns.Question{Name: dns.Fqdn(name), Qtype: qtype, Qclass: dns.ClassINET}
+	blocklistDB, allowlistDB := r.listsForClient(ClientInfo{})
+	res := matchLists(question, blocklistDB, allowlistDB)
+	switch {
+	case res.allowed != nil:
+		return false, res.allowed.GetList(), res.allowed.GetRule(), nil
+	case res.blocked != nil:
+		ips := res.ips
+		if action := res.blocked.Action; action != nil && action.Type != BlocklistActionDefault {
+			ips = action.spoofIPs()
+		}
+		return true, res.blocked.GetList(), res.blocked.GetRule(), spoofedIPs(qtype, ips)
+	}
+	return false, "", "", nil
+}
+
+// Returns the blocklist and allowlist that apply to queries from a client.
+func (r *Blocklist) listsForClient(ci ClientInfo) (blocklistDB, allowlistDB BlocklistDB) {
+	r.mu.RLock()
+	defer r.mu.RUnlock()
+	blocklistDB = r.BlocklistDB
+	allowlistDB = r.AllowlistDB
+	if i, ok := r.scopeForClient(ci); ok {
+		scoped := r.ScopedBlocklists[i]
+		if scoped.Replace {
+			blocklistDB = scoped.DB
+		} else {
+			blocklistDB = MultiDB{dbs: []BlocklistDB{scoped.DB, blocklistDB}}
+		}
+		switch {
+		case scoped.AllowlistDB == nil:
+		case scoped.Replace || allowlistDB == nil:
+			allowlistDB = scoped.AllowlistDB
+		default:
+			allowlistDB = MultiDB{dbs: []BlocklistDB{scoped.AllowlistDB, allowlistDB}}
+		}
+	}
+	if r.runtimeBlocklist != nil {
+		blocklistDB = MultiDB{dbs: []BlocklistDB{r.runtimeBlocklist, blocklistDB}}
+	}
+	if r.runtimeAllowlist != nil {
+		if allowlistDB == nil {
+			allowlistDB = r.runtimeAllowlist
+		} else {
+			allowlistDB = MultiDB{dbs: []BlocklistDB{r.runtimeAllowlist, allowlistDB}}
+		}
+	}
+	return blocklistDB, allowlistDB
+}
+
+// AddRules adds rules in domain format to the blocklist, or to the allowlist
+// if allow is true. They apply to all clients in addition to the configured
+// lists and are kept when those are reloaded, but not across restarts.
+func (r *Blocklist) AddRules(allow bool, rules ...string) error {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	current := r.runtimeBlockRules
+	if allow {
+		current = r.runtimeAllowRules
+	}
+	updated := append(append([]string(nil), current...), rules...)
+	db, err := NewDomainDB("runtime", NewStaticLoader(updated))
+	if err != nil {
+		return err
+	}
+	if allow {
+		r.runtimeAllowRules, r.runtimeAllowlist = updated, db
+	} else {
+		r.runtimeBlockRules, r.runtimeBlocklist = updated, db
+	}
+	Log.WithFields(logrus.Fields{"id": r.id, "allow": allow, "rules": rules}).Info("added rules")
+	return nil
+}
+
+// RuntimeRules returns the rules that were added with AddRules.
+func (r *Blocklist) RuntimeRules() (block, allow []string) {
+	r.mu.RLock()
+	defer r.mu.RUnlock()
+	return r.runtimeBlockRules, r.runtimeAllowRules
+}
+
+// Returns the index of the scoped blocklist that applies to a client. Must be
+// called with the lock held.
+func (r *Blocklist) scopeForClient(ci ClientInfo) (int, bool) {
+	if !r.scopedSelectors {
+		return r.scoped.lookup(ci.SourceIP)
+	}
+	index, bits, selectors := -1, 0, 0
+	for i, scoped := range r.ScopedBlocklists {
+		b, ok := scoped.matches(ci)
+		if !ok {
+			continue
+		}
+		n := scoped.selectors()
+		if index < 0 || b > bits || (b == bits && n > selectors) {
+			index, bits, selectors = i, b, n
+		}
+	}
+	return index, index >= 0
+}
+
+// blocklistResult is the outcome of matching a query against the allowlist and
+// the blocklist.
+type blocklistResult struct {
+	// Set if the allowlist matched, it takes precedence over the blocklist
+	allowed *BlocklistMatch
+	// Set if the blocklist matched, and the allowlist didn't
+	blocked *BlocklistMatch
+	ips     []net.IP
+	names   []string
+}
+
+// Match a query against the allowlist first, then the blocklist.
+func matchLists(question dns.Question, blocklistDB, allowlistDB BlocklistDB) blocklistResult {
+	if allowlistDB != nil {
+		if _, _, match, ok := allowlistDB.Match(question); ok {
+			return blocklistResult{allowed: match}
+		}
+	}
+	if ips, names, match, ok := blocklistDB.Match(question); ok {
+		return blocklistResult{blocked: match, ips: ips, names: names}
+	}
+	return blocklistResult{}
+}
+
+// Match all questions against the lists. Returns the first question that is
+// blocked, or else the first that is allowed, along with the result.
+func matchQuestions(questions []dns.Question, blocklistDB, allowlistDB BlocklistDB) (dns.Question, blocklistResult) {
+	question := questions[0]
+	res := matchLists(question, blocklistDB, allowlistDB)
+	for _, qq := range questions[1:] {
+		if res.blocked != nil {
+			break
+		}
+		next := matchLists(qq, blocklistDB, allowlistDB)
+		if next.blocked != nil || (res.allowed == nil && next.allowed != nil) {
+			question, res = qq, next
+		}
+	}
+	return question, res
+}
+
+// Returns the IPs of a blocklist match that can be used to answer a query of
+// the given type. ANY queries are answered with all IPs.
+func spoofedIPs(qtype uint16, ips []net.IP) []net.IP {
+	if qtype == dns.TypeANY {
+		return ips
+	}
+	var spoof []net.IP
+	for _, ip := range ips {
+		if ip4 := ip.To4(); len(ip4) == net.IPv4len && qtype == dns.TypeA {
+			spoof = append(spoof, ip)
+		} else if len(ip) == net.IPv6len && qtype == dns.TypeAAAA {
+			spoof = append(spoof, ip)
+		}
+	}
+	return spoof
+}
+
+// Log and count a query that would have been blocked if not in report-only mode.
+func (r *Blocklist) reportMatch(log *logrus.Entry) {
+	log.WithFields(logrus.Fields{"report_only": true, "resolver": r.resolver.String()}).Info("matched blocklist, forwarding")
+	r.metrics.wouldBlock.Add(1)
+}
+
+// Forward the query upstream and check the CNAME targets in the response against
+// the blocklist. Targets that are on the allowlist are not blocked.
+func (r *Blocklist) resolveFollowCNAME(q *dns.Msg, ci ClientInfo, blocklistDB, allowlistDB BlocklistDB) (*dns.Msg, error) {
+	a, err := r.resolver.Resolve(q, ci)
+	if err != nil || a == nil {
+		r.metrics.allowed.Add(1)
+		return a, err
+	}
+	log := logger(r.id, q, ci)
+	question := q.Question[0]
+
+	// Responses can contain self-referencing or looping CNAME chains, only look at
+	// every target once.
+	seen := make(map[string]struct{})
+	for _, rr := range a.Answer {
+		cname, ok := rr.(*dns.CNAME)
+		if !ok {
+			continue
+		}
+		target := strings.ToLower(cname.Target)
+		if _, ok := seen[target]; ok {
+			continue
+		}
+		seen[target] = struct{}{}
+		targetQ := dns.Question{Name: cname.Target, Qtype: question.Qtype, Qclass: question.Qclass}
+		res := matchLists(targetQ, blocklistDB, allowlistDB)
+		match := res.blocked
+		if match == nil {
+			continue
+		}
+		log = log.WithFields(logrus.Fields{"list": match.List, "rule": match.Rule, "cname": cname.Target})
+		if r.ReportOnly {
+			r.reportMatch(log)
+			return a, nil
+		}
+		r.metrics.countBlocked(q, match)
+		return r.blockResponse(q, q.Question[0], ci, log, res)
+	}
+	r.metrics.allowed.Add(1)
+	return a, nil
+}
+
+// Build the response for a query that matched the blocklist.
+func (r *Blocklist) blockResponse(q *dns.Msg, question dns.Question, ci ClientInfo, log *logrus.Entry, res blocklistResult) (*dns.Msg, error) {
+	ips, names := res.ips, res.names
+	ttl, soaTTL := r.spoofTTL(), r.BlockSOATTL
+	blocklistResolver := r.BlocklistResolver
+	mode := r.BlockResponse
+
+	// Rules can override the response
+	if action := res.blocked.Action; action != nil {
+		if action.TTL > 0 {
+			ttl, soaTTL = action.TTL, action.TTL
+		}
+		switch action.Type {
+		case BlocklistActionNXDomain:
+			ips, names, blocklistResolver, mode = nil, nil, nil, BlockResponseNXDomain
+		case BlocklistActionRefused:
+			ips, names, blocklistResolver, mode = nil, nil, nil, BlockResponseRefused
+		case BlocklistActionNoData:
+			ips, names, blocklistResolver, mode = nil, nil, nil, BlockResponseNoData
+		case BlocklistActionDrop:
+			ips, names, blocklistResolver, mode = nil, nil, nil, BlockResponseDrop
+		case BlocklistActionNull, BlocklistActionIP:
+			ips, names, blocklistResolver = action.spoofIPs(), nil, nil
+		case BlocklistActionForward:
+			resolver, ok := r.ActionResolvers[action.Resolver]
+			if !ok {
+				log.WithField("resolver", action.Resolver).Warn("unknown resolver in blocklist rule, blocking")
+			}
+			ips, names, blocklistResolver = nil, nil, resolver
+		}
+	}
 
 	// If we got names for the PTR query, respond to it
 	if question.Qtype == dns.TypePTR && len(names) > 0 {
-		log.Debug("responding with ptr blocklist from blocklist")
+		log.WithField("ttl", ttl).Debug("responding with ptr blocklist from blocklist")
 		if len(names) > maxPTRResponses {
 			names = names[:maxPTRResponses]
 		}
-		return ptr(q, names), nil
+		return ptr(q, names, ttl), nil
 	}
 
 	// If an optional blocklist-resolver was given, send the query to that instead of returning NXDOMAIN.
-	if r.BlocklistResolver != nil {
-		log.WithField("resolver", r.BlocklistResolver.String()).Debug("matched blocklist, forwarding")
-		return r.BlocklistResolver.Resolve(q, ci)
+	if blocklistResolver != nil {
+		log.WithField("resolver", blocklistResolver.String()).Debug("matched blocklist, forwarding")
+		return blocklistResolver.Resolve(q, ci)
 	}
 
 	answer := new(dns.Msg)
@@ -144,24 +605,24 @@ func (r *Blocklist) Resolve(q *dns.Msg, ci ClientInfo) (*dns.Msg, error) {
 
 	// We have an IP address to return, make sure it's of the right type. If not return NXDOMAIN.
 	var spoof []dns.RR
-	for _, ip := range ips {
-		if ip4 := ip.To4(); len(ip4) == net.IPv4len && question.Qtype == dns.TypeA {
+	for _, ip := range spoofedIPs(question.Qtype, ips) {
+		if question.Qtype == dns.TypeA || (question.Qtype == dns.TypeANY && ip.To4() != nil) {
 			spoof = append(spoof, &dns.A{
 				Hdr: dns.RR_Header{
 					Name:   question.Name,
 					Rrtype: dns.TypeA,
 					Class:  question.Qclass,
-					Ttl:    3600,
+					Ttl:    ttl,
 				},
 				A: ip,
 			})
-		} else if len(ip) == net.IPv6len && question.Qtype == dns.TypeAAAA {
+		} else {
 			spoof = append(spoof, &dns.AAAA{
 				Hdr: dns.RR_Header{
 					Name:   question.Name,
 					Rrtype: dns.TypeAAAA,
 					Class:  question.Qclass,
-					Ttl:    3600,
+					Ttl:    ttl,
 				},
 				AAAA: ip,
 			})
@@ -169,51 +630,218 @@ func (r *Blocklist) Resolve(q *dns.Msg, ci ClientInfo) (*dns.Msg, error) {
 	}
 
 	if len(spoof) > 0 {
-		log.Debug("spoofing response")
+		log.WithField("ttl", ttl).Debug("spoofing response")
 		answer.Answer = spoof
 		return answer, nil
 	}
 
-	// Block the request with NXDOMAIN if there was a match but no valid spoofed IP is given
-	log.Debug("blocking request")
-	if err := r.EDNS0EDETemplate.Apply(answer, q); err != nil {
-		log.WithError(err).Error("failed to apply edns0ede template")
+	// Block the request if there was a match but no valid spoofed IP is given
+	switch mode {
+	case BlockResponseDrop:
+		log.Debug("dropping blocked request")
+		return nil, nil
+	case BlockResponseRefused:
+		log.Debug("refusing blocked request")
+		answer.SetRcode(q, dns.RcodeRefused)
+	case BlockResponseNoData:
+		log.Debug("blocking request with empty response")
+		if soaTTL > 0 {
+			answer.Ns = []dns.RR{r.blockSOA(question, soaTTL)}
+		}
+	default:
+		log.Debug("blocking request")
+		answer.SetRcode(q, dns.RcodeNameError)
+		if soaTTL > 0 {
+			answer.Ns = []dns.RR{r.blockSOA(question, soaTTL)}
+		}
+	}
+	if r.EDNS0EDETemplate != nil {
+		if err := r.EDNS0EDETemplate.Apply(answer, q); err != nil {
+			log.WithError(err).Error("failed to apply edns0ede template")
+		}
+	} else if r.DefaultEDE {
+		addBlockedEDE(answer, q, res.blocked)
 	}
-	answer.SetRcode(q, dns.RcodeNameError)
 	return answer, nil
 }
 
+func (r *Blocklist) spoofTTL() uint32 {
+	if r.SpoofTTL == 0 {
+		return 3600
+	}
+	return r.SpoofTTL
+}
+
+// Returns a SOA record for negative responses to blocked queries.
+func (r *Blocklist) blockSOA(question dns.Question, ttl uint32) *dns.SOA {
+	mname := r.BlockSOAMname
+	if mname == "" {
+		mname = "ns.routedns.invalid."
+	}
+	rname := r.BlockSOARname
+	if rname == "" {
+		rname = "hostmaster.routedns.invalid."
+	}
+	return &dns.SOA{
+		Hdr: dns.RR_Header{
+			Name:   question.Name,
+			Rrtype: dns.TypeSOA,
+			Class:  question.Qclass,
+			Ttl:    ttl,
+		},
+		Ns:      dns.Fqdn(mname),
+		Mbox:    dns.Fqdn(rname),
+		Serial:  1,
+		Refresh: 3600,
+		Retry:   600,
+		Expire:  86400,
+		Minttl:  ttl,
+	}
+}
+
+// Add an EDE option with code 15 (Blocked) and the list that matched the query.
+func addBlockedEDE(a, q *dns.Msg, match *BlocklistMatch) {
+	addEDE(a, q, dns.ExtendedErrorCodeBlocked, fmt.Sprintf("blocked by %s", match.GetList()))
+}
+
+// Add an EDE option to the response with the allowlist rule that matched the query.
+func annotateAllowed(a, q *dns.Msg, match *BlocklistMatch) {
+	addEDE(a, q, dns.ExtendedErrorCodeOther, fmt.Sprintf("allowed by %s: %s", match.GetList(), match.GetRule()))
+}
+
 func (r *Blocklist) String() string {
 	return r.id
 }
 
+// Close stops the periodic refresh of the lists.
+func (r *Blocklist) Close() error {
+	r.loops.stop()
+	return nil
+}
+
+// ReloadAll reloads the blocklist, allowlist, and any scoped blocklists
+// concurrently. The new lists are only used if all of them loaded successfully.
+func (r *Blocklist) ReloadAll() error {
+	r.mu.RLock()
+	dbs := []BlocklistDB{r.BlocklistDB, r.AllowlistDB}
+	for _, scoped := range r.ScopedBlocklists {
+		dbs = append(dbs, scoped.DB)
+	}
+	for _, scoped := range r.ScopedBlocklists {
+		dbs = append(dbs, scoped.AllowlistDB)
+	}
+	r.mu.RUnlock()
+
+	reloaded := make([]BlocklistDB, len(dbs))
+	errs := make([]error, len(dbs))
+	var wg sync.WaitGroup
+	for i, db := range dbs {
+		if db == nil {
+			continue
+		}
+		wg.Add(1)
+		go func(i int, db BlocklistDB) {
+			defer wg.Done()
+			reloaded[i], errs[i] = r.reloads.do(r.reloadKey(i), db)
+		}(i, db)
+	}
+	wg.Wait()
+	if err := errors.Join(errs...); err != nil {
+		return err
+	}
+
+	r.mu.Lock()
+	r.BlocklistDB = reloaded[0]
+	r.AllowlistDB = reloaded[1]
+	n := len(r.ScopedBlocklists)
+	for i := range r.ScopedBlocklists {
+		r.ScopedBlocklists[i].DB = reloaded[i+2]
+		r.ScopedBlocklists[i].AllowlistDB = reloaded[i+2+n]
+	}
+	r.mu.Unlock()
+	return nil
+}
+
+// Returns the key used to deduplicate reloads of a list. Index 0 is the blocklist,
+// 1 the allowlist, followed by the scoped blocklists and then their allowlists.
+func (r *Blocklist) reloadKey(i int) string {
+	n := len(r.ScopedBlocklists)
+	switch {
+	case i == 0:
+		return "blocklist"
+	case i == 1:
+		return "allowlist"
+	case i < 2+n:
+		return fmt.Sprintf("scoped-%d", i-2)
+	default:
+		return fmt.Sprintf("scoped-allowlist-%d", i-2-n)
+	}
+}
+
 func (r *Blocklist) refreshLoopBlocklist(refresh time.Duration) {
-	for {
-		time.Sleep(refresh)
-		log := Log.WithField("id", r.id)
+	log := Log.WithField("id", r.id)
+	newRefresher(log, refresh).run(r.loops.done(), func() error {
 		log.Debug("reloading blocklist")
-		db, err := r.BlocklistDB.Reload()
+		r.mu.RLock()
+		db := r.BlocklistDB
+		r.mu.RUnlock()
+		db, err := r.reloads.do(r.reloadKey(0), db)
+		if err != nil {
+			return err
+		}
+		r.mu.Lock()
+		r.BlocklistDB = db
+		r.mu.Unlock()
+		r.reloadScopedBlocklists()
+		return nil
+	})
+}
+
+// Reloads the scoped blocklists and their allowlists, keeping the current
+// lists on failure.
+func (r *Blocklist) reloadScopedBlocklists() {
+	n := len(r.ScopedBlocklists)
+	for i := range r.ScopedBlocklists {
+		log := Log.WithFields(logrus.Fields{"id": r.id, "scoped": i})
+		r.mu.RLock()
+		db, allowDB := r.ScopedBlocklists[i].DB, r.ScopedBlocklists[i].AllowlistDB
+		r.mu.RUnlock()
+		db, err := r.reloads.do(r.reloadKey(i+2), db)
 		if err != nil {
 			log.WithError(err).Error("failed to load rules")
+		} else {
+			r.mu.Lock()
+			r.ScopedBlocklists[i].DB = db
+			r.mu.Unlock()
+		}
+		if allowDB == nil {
+			continue
+		}
+		allowDB, err = r.reloads.do(r.reloadKey(i+2+n), allowDB)
+		if err != nil {
+			log.WithError(err).Error("failed to load allowlist rules")
 			continue
 		}
 		r.mu.Lock()
-		r.BlocklistDB = db
+		r.ScopedBlocklists[i].AllowlistDB = allowDB
 		r.mu.Unlock()
 	}
 }
+
 func (r *Blocklist) refreshLoopAllowlist(refresh time.Duration) {
-	for {
-		time.Sleep(refresh)
-		log := Log.WithField("id", r.id)
+	log := Log.WithField("id", r.id)
+	newRefresher(log, refresh).run(r.loops.done(), func() error {
 		log.Debug("reloading allowlist")
-		db, err := r.AllowlistDB.Reload()
+		r.mu.RLock()
+		db := r.AllowlistDB
+		r.mu.RUnlock()
+		db, err := r.reloads.do(r.reloadKey(1), db)
 		if err != nil {
-			log.WithError(err).Error("failed to load rules")
-			continue
+			return err
 		}
 		r.mu.Lock()
 		r.AllowlistDB = db
 		r.mu.Unlock()
-	}
+		return nil
+	})
 }
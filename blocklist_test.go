@@ -1,9 +1,16 @@
 package rdns
 
 import (
+	"expvar"
+	"net"
+	"regexp"
+	"sync"
 	"testing"
+	"time"
 
 	"github.com/miekg/dns"
+	"github.com/sirupsen/logrus"
+	"github.com/sirupsen/logrus/hooks/test"
 	"github.com/stretchr/testify/require"
 )
 
@@ -82,3 +89,841 @@ func TestBlocklistAllow(t *testing.T) {
 	require.NoError(t, err)
 	require.Equal(t, 2, r.HitCount())
 }
+
+func TestBlocklistFollowCNAME(t *testing.T) {
+	var ci ClientInfo
+	r, err := NewStaticResolver("test-static", StaticResolverOptions{
+		Answer: []string{
+			"clean.test. 3600 IN CNAME loop.test.",
+			"loop.test. 3600 IN CNAME loop.test.",
+			"loop.test. 3600 IN CNAME tracker.evil.test.",
+			"tracker.evil.test. 3600 IN A 1.2.3.4",
+		},
+	})
+	require.NoError(t, err)
+
+	blockDB, err := NewDomainDB("testlist", NewStaticLoader([]string{".evil.test"}))
+	require.NoError(t, err)
+
+	q := new(dns.Msg)
+	q.SetQuestion("clean.test.", dns.TypeA)
+
+	// Without following CNAMEs, the response is passed through
+	b, err := NewBlocklist("test-bl-cname-off", r, BlocklistOptions{BlocklistDB: blockDB})
+	require.NoError(t, err)
+	a, err := b.Resolve(q, ci)
+	require.NoError(t, err)
+	require.Equal(t, dns.RcodeSuccess, a.Rcode)
+	require.Len(t, a.Answer, 4)
+
+	// The CNAME target is on the blocklist, the response should be blocked
+	b, err = NewBlocklist("test-bl-cname", r, BlocklistOptions{
+		BlocklistDB: blockDB,
+		FollowCNAME: true,
+	})
+	require.NoError(t, err)
+	a, err = b.Resolve(q, ci)
+	require.NoError(t, err)
+	require.Equal(t, dns.RcodeNameError, a.Rcode)
+	require.Empty(t, a.Answer)
+	require.Equal(t, int64(1), b.metrics.blocked.Value())
+
+	// A CNAME target on the allowlist should not be blocked
+	allowDB, err := NewDomainDB("allowlist", NewStaticLoader([]string{"tracker.evil.test"}))
+	require.NoError(t, err)
+	b, err = NewBlocklist("test-bl-cname-allow", r, BlocklistOptions{
+		BlocklistDB: blockDB,
+		AllowlistDB: allowDB,
+		FollowCNAME: true,
+	})
+	require.NoError(t, err)
+	a, err = b.Resolve(q, ci)
+	require.NoError(t, err)
+	require.Equal(t, dns.RcodeSuccess, a.Rcode)
+	require.Len(t, a.Answer, 4)
+}
+
+func TestBlocklistSchedule(t *testing.T) {
+	var ci ClientInfo
+	q := new(dns.Msg)
+	r := new(TestResolver)
+
+	loader := NewStaticLoader([]string{"social.test"})
+	db, err := NewDomainDB("testlist", loader)
+	require.NoError(t, err)
+
+	// Only block in the evening, until the next morning
+	w, err := NewScheduleWindow(nil, "20:00", "06:00")
+	require.NoError(t, err)
+	schedule := NewSchedule(time.UTC, w)
+
+	opt := BlocklistOptions{
+		BlocklistDB:    db,
+		ActiveSchedule: schedule,
+	}
+	b, err := NewBlocklist("test-bl-schedule", r, opt)
+	require.NoError(t, err)
+	q.SetQuestion("social.test.", dns.TypeA)
+
+	// Inside the window the query is blocked
+	schedule.now = func() time.Time { return time.Date(2024, 5, 10, 23, 0, 0, 0, time.UTC) }
+	a, err := b.Resolve(q, ci)
+	require.NoError(t, err)
+	require.Equal(t, dns.RcodeNameError, a.Rcode)
+	require.Equal(t, 0, r.HitCount())
+	require.Equal(t, int64(1), b.metrics.blocked.Value())
+
+	// Outside of it, it's forwarded and counted as allowed
+	schedule.now = func() time.Time { return time.Date(2024, 5, 11, 12, 0, 0, 0, time.UTC) }
+	_, err = b.Resolve(q, ci)
+	require.NoError(t, err)
+	require.Equal(t, 1, r.HitCount())
+	require.Equal(t, int64(1), b.metrics.blocked.Value())
+	require.Equal(t, int64(1), b.metrics.allowed.Value())
+}
+
+func TestBlocklistScoped(t *testing.T) {
+	q := new(dns.Msg)
+	r := new(TestResolver)
+
+	defaultDB, err := NewDomainDB("default", NewStaticLoader([]string{"ads.test"}))
+	require.NoError(t, err)
+	strictDB, err := NewDomainDB("strict", NewStaticLoader([]string{"games.test"}))
+	require.NoError(t, err)
+	_, kids, err := net.ParseCIDR("192.168.1.0/28")
+	require.NoError(t, err)
+	_, guest, err := net.ParseCIDR("192.168.2.0/24")
+	require.NoError(t, err)
+
+	opt := BlocklistOptions{
+		BlocklistDB: defaultDB,
+		ScopedBlocklists: []ScopedBlocklist{
+			{Networks: []*net.IPNet{kids}, DB: strictDB},
+			{Networks: []*net.IPNet{guest}, DB: strictDB, Replace: true},
+		},
+	}
+	b, err := NewBlocklist("test-bl-scoped", r, opt)
+	require.NoError(t, err)
+
+	inScope := ClientInfo{SourceIP: net.ParseIP("192.168.1.5")}
+	outOfScope := ClientInfo{SourceIP: net.ParseIP("192.168.1.100")}
+	replaced := ClientInfo{SourceIP: net.ParseIP("192.168.2.1")}
+
+	tests := []struct {
+		name    string
+		ci      ClientInfo
+		blocked bool
+	}{
+		{"games.test.", inScope, true},
+		{"ads.test.", inScope, true}, // Default list still applies
+		{"games.test.", outOfScope, false},
+		{"ads.test.", outOfScope, true},
+		{"games.test.", replaced, true},
+		{"ads.test.", replaced, false}, // Replaced by the scoped list
+	}
+	for _, test := range tests {
+		q.SetQuestion(test.name, dns.TypeA)
+		a, err := b.Resolve(q, test.ci)
+		require.NoError(t, err)
+		if test.blocked {
+			require.Equal(t, dns.RcodeNameError, a.Rcode, "%s from %s", test.name, test.ci.SourceIP)
+		} else {
+			require.Equal(t, dns.RcodeSuccess, a.Rcode, "%s from %s", test.name, test.ci.SourceIP)
+		}
+	}
+	require.Equal(t, 2, r.HitCount())
+
+	// Scoped blocklists need a DB
+	_, err = NewBlocklist("test-bl-scoped-invalid", r, BlocklistOptions{
+		BlocklistDB:      defaultDB,
+		ScopedBlocklists: []ScopedBlocklist{{Networks: []*net.IPNet{kids}}},
+	})
+	require.Error(t, err)
+}
+
+func TestBlocklistScopedSelectors(t *testing.T) {
+	q := new(dns.Msg)
+	r := new(TestResolver)
+
+	defaultDB, err := NewDomainDB("default", NewStaticLoader([]string{"ads.test", "video.test"}))
+	require.NoError(t, err)
+	kidsDB, err := NewDomainDB("kids", NewStaticLoader([]string{"games.test"}))
+	require.NoError(t, err)
+	kidsAllowDB, err := NewDomainDB("kids-allow", NewStaticLoader([]string{"video.test"}))
+	require.NoError(t, err)
+	tabletDB, err := NewDomainDB("tablet", NewStaticLoader([]string{"chat.test"}))
+	require.NoError(t, err)
+	guestDB, err := NewDomainDB("guest", NewStaticLoader([]string{"files.test"}))
+	require.NoError(t, err)
+	_, home, err := net.ParseCIDR("192.168.1.0/24")
+	require.NoError(t, err)
+
+	opt := BlocklistOptions{
+		BlocklistDB: defaultDB,
+		ScopedBlocklists: []ScopedBlocklist{
+			// Any client using the kids DoH path
+			{DoHPath: regexp.MustCompile(`^/kids`), DB: kidsDB, AllowlistDB: kidsAllowDB},
+			// Kids tablet on the home network, more specific than the one above
+			{Networks: []*net.IPNet{home}, TLSServerName: regexp.MustCompile(`^tablet\.`), DB: tabletDB, Replace: true},
+			// Clients with a certificate for the guest network
+			{TLSClientName: regexp.MustCompile(`\.guest\.test$`), DB: guestDB},
+		},
+	}
+	b, err := NewBlocklist("test-bl-scoped-selectors", r, opt)
+	require.NoError(t, err)
+
+	kids := ClientInfo{SourceIP: net.ParseIP("10.0.0.1"), DoHPath: "/kids/dns-query"}
+	tablet := ClientInfo{SourceIP: net.ParseIP("192.168.1.5"), DoHPath: "/kids/dns-query", TLSServerName: "tablet.dns.test"}
+	other := ClientInfo{SourceIP: net.ParseIP("192.168.1.5"), DoHPath: "/dns-query"}
+	guest := ClientInfo{SourceIP: net.ParseIP("192.168.1.5"), TLSClientNames: []string{"Guest", "laptop.guest.test"}}
+
+	tests := []struct {
+		name    string
+		ci      ClientInfo
+		blocked bool
+	}{
+		{"games.test.", kids, true},
+		{"ads.test.", kids, true},
+		{"video.test.", kids, false}, // Allowed by the scoped allowlist
+		{"chat.test.", tablet, true},
+		{"games.test.", tablet, false}, // Network match is more specific
+		{"ads.test.", tablet, false},   // Replaced by the scoped list
+		{"games.test.", other, false},
+		{"video.test.", other, true},
+		{"files.test.", guest, true},
+		{"files.test.", other, false},
+	}
+	for _, test := range tests {
+		q.SetQuestion(test.name, dns.TypeA)
+		a, err := b.Resolve(q, test.ci)
+		require.NoError(t, err)
+		if test.blocked {
+			require.Equal(t, dns.RcodeNameError, a.Rcode, "%s from %+v", test.name, test.ci)
+		} else {
+			require.Equal(t, dns.RcodeSuccess, a.Rcode, "%s from %+v", test.name, test.ci)
+		}
+	}
+
+	// Scoped blocklists need at least one selector
+	_, err = NewBlocklist("test-bl-scoped-selectors-invalid", r, BlocklistOptions{
+		BlocklistDB:      defaultDB,
+		ScopedBlocklists: []ScopedBlocklist{{DB: kidsDB}},
+	})
+	require.Error(t, err)
+}
+
+func TestBlocklistMetricsByList(t *testing.T) {
+	var ci ClientInfo
+	q := new(dns.Msg)
+	r := new(TestResolver)
+
+	ads, err := NewDomainDB("ads", NewStaticLoader([]string{"ads.test"}))
+	require.NoError(t, err)
+	trackers, err := NewDomainDB("trackers", NewStaticLoader([]string{"tracker.test"}))
+	require.NoError(t, err)
+	db, err := NewMultiDB(ads, trackers)
+	require.NoError(t, err)
+
+	b, err := NewBlocklist("test-bl-by-list", r, BlocklistOptions{BlocklistDB: db})
+	require.NoError(t, err)
+
+	for _, name := range []string{"ads.test.", "tracker.test.", "tracker.test.", "other.test."} {
+		q.SetQuestion(name, dns.TypeA)
+		_, err = b.Resolve(q, ci)
+		require.NoError(t, err)
+	}
+	require.Equal(t, int64(3), b.metrics.blocked.Value())
+	require.Equal(t, int64(1), b.metrics.allowed.Value())
+	require.Equal(t, int64(1), b.metrics.blockedByList.Get("ads").(*expvar.Int).Value())
+	require.Equal(t, int64(2), b.metrics.blockedByList.Get("trackers").(*expvar.Int).Value())
+
+	// Rules and names
+	stats := b.metrics.Stats(10)
+	require.Equal(t, map[string]map[string]int64{
+		"ads":      {"ads.test": 1},
+		"trackers": {"tracker.test": 2},
+	}, stats.ByRule)
+	require.Equal(t, []NameCount{
+		{Name: "tracker.test.", Count: 2},
+		{Name: "ads.test.", Count: 1},
+	}, stats.TopBlocked)
+}
+
+func TestBlocklistAnnotateAllowed(t *testing.T) {
+	var ci ClientInfo
+	upstream, err := NewStaticResolver("test-static", StaticResolverOptions{
+		Answer: []string{"good.evil.test. 60 IN A 1.2.3.4"},
+	})
+	require.NoError(t, err)
+	blockDB, err := NewDomainDB("block", NewStaticLoader([]string{".evil.test"}))
+	require.NoError(t, err)
+	allowDB, err := NewDomainDB("allow", NewStaticLoader([]string{"good.evil.test"}))
+	require.NoError(t, err)
+
+	b, err := NewBlocklist("test-bl-annotate", upstream, BlocklistOptions{
+		BlocklistDB:     blockDB,
+		AllowlistDB:     allowDB,
+		AnnotateAllowed: true,
+	})
+	require.NoError(t, err)
+
+	q := new(dns.Msg)
+	q.SetQuestion("good.evil.test.", dns.TypeA)
+	q.SetEdns0(1232, false)
+	a, err := b.Resolve(q, ci)
+	require.NoError(t, err)
+
+	// The answer is unchanged, the EDE option names the allowlist rule
+	require.Len(t, a.Answer, 1)
+	require.Equal(t, "1.2.3.4", a.Answer[0].(*dns.A).A.String())
+	opt := a.IsEdns0()
+	require.NotNil(t, opt)
+	require.Len(t, opt.Option, 1)
+	ede, ok := opt.Option[0].(*dns.EDNS0_EDE)
+	require.True(t, ok)
+	require.Equal(t, dns.ExtendedErrorCodeOther, ede.InfoCode)
+	require.Equal(t, "allowed by allow: good.evil.test", ede.ExtraText)
+
+	// Without EDNS0 in the query, nothing is added
+	q = new(dns.Msg)
+	q.SetQuestion("good.evil.test.", dns.TypeA)
+	a, err = b.Resolve(q, ci)
+	require.NoError(t, err)
+	require.Nil(t, a.IsEdns0())
+
+	// Off by default
+	b, err = NewBlocklist("test-bl-no-annotate", upstream, BlocklistOptions{
+		BlocklistDB: blockDB,
+		AllowlistDB: allowDB,
+	})
+	require.NoError(t, err)
+	q.SetEdns0(1232, false)
+	a, err = b.Resolve(q, ci)
+	require.NoError(t, err)
+	require.Nil(t, a.IsEdns0())
+}
+
+// Loader that counts the loads and blocks until released.
+type blockingLoader struct {
+	mu      sync.Mutex
+	loads   int
+	release chan struct{}
+}
+
+func (l *blockingLoader) Load() ([]string, error) {
+	l.mu.Lock()
+	l.loads++
+	l.mu.Unlock()
+	<-l.release
+	return []string{"evil.test"}, nil
+}
+
+func TestBlocklistReloadDedup(t *testing.T) {
+	loader := &blockingLoader{release: make(chan struct{})}
+	close(loader.release)
+	db, err := NewDomainDB("test", loader)
+	require.NoError(t, err)
+	b, err := NewBlocklist("test-bl-dedup", new(TestResolver), BlocklistOptions{BlocklistDB: db})
+	require.NoError(t, err)
+
+	// Block the next load and trigger two overlapping reloads
+	loader.mu.Lock()
+	loader.loads = 0
+	loader.release = make(chan struct{})
+	loader.mu.Unlock()
+	errs := make(chan error, 2)
+	for i := 0; i < 2; i++ {
+		go func() { errs <- b.ReloadAll() }()
+	}
+	time.Sleep(100 * time.Millisecond)
+	close(loader.release)
+	require.NoError(t, <-errs)
+	require.NoError(t, <-errs)
+
+	// Only one load should have happened
+	require.Equal(t, 1, loader.loads)
+}
+
+func TestBlocklistAllowedChildLogged(t *testing.T) {
+	var ci ClientInfo
+	r := new(TestResolver)
+	blockDB, err := NewDomainDB("block", NewStaticLoader([]string{"*.tracking.example.com"}))
+	require.NoError(t, err)
+	allowDB, err := NewDomainDB("allow", NewStaticLoader([]string{"safe.tracking.example.com"}))
+	require.NoError(t, err)
+	b, err := NewBlocklist("test-bl-override", r, BlocklistOptions{
+		BlocklistDB: blockDB,
+		AllowlistDB: allowDB,
+	})
+	require.NoError(t, err)
+
+	level := Log.GetLevel()
+	Log.SetLevel(logrus.DebugLevel)
+	defer Log.SetLevel(level)
+	hook := test.NewLocal(Log)
+	defer Log.ReplaceHooks(make(logrus.LevelHooks))
+
+	// Other subdomains of the blocked parent are blocked
+	q := new(dns.Msg)
+	q.SetQuestion("ads.tracking.example.com.", dns.TypeA)
+	a, err := b.Resolve(q, ci)
+	require.NoError(t, err)
+	require.Equal(t, dns.RcodeNameError, a.Rcode)
+	require.Equal(t, 0, r.HitCount())
+
+	// The allowed child is forwarded, and both rules are logged
+	hook.Reset()
+	q.SetQuestion("safe.tracking.example.com.", dns.TypeA)
+	_, err = b.Resolve(q, ci)
+	require.NoError(t, err)
+	require.Equal(t, 1, r.HitCount())
+
+	entry := hook.LastEntry()
+	require.NotNil(t, entry)
+	require.Equal(t, "matched allowlist, forwarding", entry.Message)
+	require.Equal(t, "allow", entry.Data["list"])
+	require.Equal(t, "safe.tracking.example.com", entry.Data["rule"])
+	require.Equal(t, "block", entry.Data["overridden-list"])
+	require.Equal(t, "*.tracking.example.com", entry.Data["overridden-rule"])
+}
+
+func TestBlocklistReportOnly(t *testing.T) {
+	var ci ClientInfo
+	r := new(TestResolver)
+	blockDB, err := NewDomainDB("block", NewStaticLoader([]string{".evil.test"}))
+	require.NoError(t, err)
+	allowDB, err := NewDomainDB("allow", NewStaticLoader([]string{"good.evil.test"}))
+	require.NoError(t, err)
+	b, err := NewBlocklist("test-bl-report-only", r, BlocklistOptions{
+		BlocklistDB: blockDB,
+		AllowlistDB: allowDB,
+		ReportOnly:  true,
+	})
+	require.NoError(t, err)
+
+	// A matching query is forwarded and only counted as would-block
+	q := new(dns.Msg)
+	q.SetQuestion("bad.evil.test.", dns.TypeA)
+	a, err := b.Resolve(q, ci)
+	require.NoError(t, err)
+	require.Equal(t, dns.RcodeSuccess, a.Rcode)
+	require.Equal(t, 1, r.HitCount())
+	require.Equal(t, int64(1), b.metrics.wouldBlock.Value())
+	require.Equal(t, int64(0), b.metrics.blocked.Value())
+	require.Equal(t, int64(0), b.metrics.allowed.Value())
+
+	// The allowlist still short-circuits without counting
+	q.SetQuestion("good.evil.test.", dns.TypeA)
+	_, err = b.Resolve(q, ci)
+	require.NoError(t, err)
+	require.Equal(t, 2, r.HitCount())
+	require.Equal(t, int64(1), b.metrics.wouldBlock.Value())
+	require.Equal(t, int64(0), b.metrics.blocked.Value())
+	require.Equal(t, int64(1), b.metrics.allowed.Value())
+}
+
+func TestBlocklistBlockSOA(t *testing.T) {
+	var ci ClientInfo
+	blockDB, err := NewDomainDB("block", NewStaticLoader([]string{".evil.test"}))
+	require.NoError(t, err)
+	b, err := NewBlocklist("test-bl-soa", new(TestResolver), BlocklistOptions{
+		BlocklistDB:   blockDB,
+		BlockSOATTL:   300,
+		BlockSOARname: "admin.example.com",
+	})
+	require.NoError(t, err)
+
+	q := new(dns.Msg)
+	q.SetQuestion("www.evil.test.", dns.TypeA)
+	a, err := b.Resolve(q, ci)
+	require.NoError(t, err)
+	require.Equal(t, dns.RcodeNameError, a.Rcode)
+	require.Len(t, a.Ns, 1)
+	soa, ok := a.Ns[0].(*dns.SOA)
+	require.True(t, ok)
+	require.Equal(t, "www.evil.test.", soa.Hdr.Name)
+	require.Equal(t, uint32(300), soa.Hdr.Ttl)
+	require.Equal(t, uint32(300), soa.Minttl)
+	require.Equal(t, "ns.routedns.invalid.", soa.Ns)
+	require.Equal(t, "admin.example.com.", soa.Mbox)
+
+	// No SOA unless enabled
+	b, err = NewBlocklist("test-bl-no-soa", new(TestResolver), BlocklistOptions{BlocklistDB: blockDB})
+	require.NoError(t, err)
+	a, err = b.Resolve(q, ci)
+	require.NoError(t, err)
+	require.Empty(t, a.Ns)
+}
+
+func TestBlocklistBlockResponse(t *testing.T) {
+	var ci ClientInfo
+	blockDB, err := NewDomainDB("block", NewStaticLoader([]string{
+		".evil.test",
+		"nx.test action=nxdomain",
+		"drop.test action=drop",
+		"nodata.test action=nodata",
+	}))
+	require.NoError(t, err)
+	hostsDB, err := NewHostsDB("spoof", NewStaticLoader([]string{"192.0.2.1 spoof.test"}))
+	require.NoError(t, err)
+
+	resolve := func(mode BlockResponse, name string) *dns.Msg {
+		b, err := NewBlocklist("test-bl-response", new(TestResolver), BlocklistOptions{
+			BlocklistDB:   MultiDB{dbs: []BlocklistDB{blockDB, hostsDB}},
+			BlockResponse: mode,
+			BlockSOATTL:   300,
+		})
+		require.NoError(t, err)
+		q := new(dns.Msg)
+		q.SetQuestion(name, dns.TypeA)
+		a, err := b.Resolve(q, ci)
+		require.NoError(t, err)
+		return a
+	}
+
+	// NODATA with a SOA for negative caching
+	a := resolve(BlockResponseNoData, "www.evil.test.")
+	require.Equal(t, dns.RcodeSuccess, a.Rcode)
+	require.Empty(t, a.Answer)
+	require.Len(t, a.Ns, 1)
+
+	a = resolve(BlockResponseRefused, "www.evil.test.")
+	require.Equal(t, dns.RcodeRefused, a.Rcode)
+	require.Empty(t, a.Ns)
+
+	// A nil response means drop
+	a = resolve(BlockResponseDrop, "www.evil.test.")
+	require.Nil(t, a)
+
+	// Spoofed responses and rule actions take precedence
+	a = resolve(BlockResponseDrop, "spoof.test.")
+	require.Len(t, a.Answer, 1)
+	a = resolve(BlockResponseDrop, "nx.test.")
+	require.Equal(t, dns.RcodeNameError, a.Rcode)
+	a = resolve(BlockResponseNXDomain, "drop.test.")
+	require.Nil(t, a)
+	a = resolve(BlockResponseNXDomain, "nodata.test.")
+	require.Equal(t, dns.RcodeSuccess, a.Rcode)
+	require.Empty(t, a.Answer)
+}
+
+func TestBlocklistCheck(t *testing.T) {
+	r := new(TestResolver)
+	blockDB, err := NewHostsDB("block", NewStaticLoader([]string{
+		"0.0.0.0 ads.example.com",
+		"192.0.2.1 spoof.example.com",
+		"0.0.0.0 good.example.com",
+	}))
+	require.NoError(t, err)
+	allowDB, err := NewDomainDB("allow", NewStaticLoader([]string{"good.example.com"}))
+	require.NoError(t, err)
+	b, err := NewBlocklist("test-bl-check", r, BlocklistOptions{
+		BlocklistDB: blockDB,
+		AllowlistDB: allowDB,
+	})
+	require.NoError(t, err)
+
+	// Plain block
+	blocked, list, rule, ips := b.Check("ads.example.com", dns.TypeA)
+	require.True(t, blocked)
+	require.Equal(t, "block", list)
+	require.Equal(t, "ads.example.com", rule)
+	require.Empty(t, ips)
+
+	// Spoofed response
+	blocked, _, _, ips = b.Check("spoof.example.com.", dns.TypeA)
+	require.True(t, blocked)
+	require.Len(t, ips, 1)
+	require.Equal(t, "192.0.2.1", ips[0].String())
+
+	// The allowlist overrides the blocklist
+	blocked, list, rule, _ = b.Check("good.example.com.", dns.TypeA)
+	require.False(t, blocked)
+	require.Equal(t, "allow", list)
+	require.Equal(t, "good.example.com", rule)
+
+	// No match
+	blocked, list, _, _ = b.Check("www.example.com.", dns.TypeA)
+	require.False(t, blocked)
+	require.Empty(t, list)
+
+	// Nothing was sent upstream
+	require.Equal(t, 0, r.HitCount())
+}
+
+func TestBlocklistSpoofTTL(t *testing.T) {
+	var ci ClientInfo
+	blockDB, err := NewHostsDB("block", NewStaticLoader([]string{
+		"192.0.2.1 spoof.example.com",
+		"192.0.2.2 spoof.example.com",
+		"2001:db8::1 spoof.example.com",
+	}))
+	require.NoError(t, err)
+
+	requireTTL := func(a *dns.Msg, ttl uint32) {
+		require.NotEmpty(t, a.Answer)
+		for _, rr := range a.Answer {
+			require.Equal(t, ttl, rr.Header().Ttl, rr.String())
+		}
+	}
+
+	for _, test := range []struct {
+		opt uint32
+		ttl uint32
+	}{
+		{0, 3600}, // default
+		{60, 60},
+	} {
+		b, err := NewBlocklist("test-bl-spoof-ttl", new(TestResolver), BlocklistOptions{
+			BlocklistDB: blockDB,
+			SpoofTTL:    test.opt,
+		})
+		require.NoError(t, err)
+
+		q := new(dns.Msg)
+		q.SetQuestion("spoof.example.com.", dns.TypeA)
+		a, err := b.Resolve(q, ci)
+		require.NoError(t, err)
+		require.Len(t, a.Answer, 2)
+		requireTTL(a, test.ttl)
+
+		q.SetQuestion("spoof.example.com.", dns.TypeAAAA)
+		a, err = b.Resolve(q, ci)
+		require.NoError(t, err)
+		requireTTL(a, test.ttl)
+
+		q.SetQuestion("1.2.0.192.in-addr.arpa.", dns.TypePTR)
+		a, err = b.Resolve(q, ci)
+		require.NoError(t, err)
+		require.Equal(t, dns.TypePTR, a.Answer[0].Header().Rrtype)
+		requireTTL(a, test.ttl)
+	}
+}
+
+func TestBlocklistANY(t *testing.T) {
+	var ci ClientInfo
+	r := new(TestResolver)
+	domainDB, err := NewDomainDB("domains", NewStaticLoader([]string{".evil.test"}))
+	require.NoError(t, err)
+	hostsDB, err := NewHostsDB("hosts", NewStaticLoader([]string{
+		"192.0.2.1 spoof.test",
+		"2001:db8::1 spoof.test",
+	}))
+	require.NoError(t, err)
+	db, err := NewMultiDB(domainDB, hostsDB)
+	require.NoError(t, err)
+	b, err := NewBlocklist("test-bl-any", r, BlocklistOptions{BlocklistDB: db})
+	require.NoError(t, err)
+
+	// ANY queries for blocked names are blocked
+	q := new(dns.Msg)
+	q.SetQuestion("www.evil.test.", dns.TypeANY)
+	a, err := b.Resolve(q, ci)
+	require.NoError(t, err)
+	require.Equal(t, dns.RcodeNameError, a.Rcode)
+
+	// ANY queries for spoofed names get all spoofed records
+	q.SetQuestion("spoof.test.", dns.TypeANY)
+	a, err = b.Resolve(q, ci)
+	require.NoError(t, err)
+	require.Equal(t, dns.RcodeSuccess, a.Rcode)
+	require.Len(t, a.Answer, 2)
+	require.IsType(t, &dns.A{}, a.Answer[0])
+	require.IsType(t, &dns.AAAA{}, a.Answer[1])
+	require.Equal(t, 0, r.HitCount())
+}
+
+func TestBlocklistMultipleQuestions(t *testing.T) {
+	var ci ClientInfo
+	r := new(TestResolver)
+	blockDB, err := NewDomainDB("block", NewStaticLoader([]string{".evil.test"}))
+	require.NoError(t, err)
+
+	q := new(dns.Msg)
+	q.SetQuestion("www.good.test.", dns.TypeA)
+	q.Question = append(q.Question, dns.Question{Name: "www.evil.test.", Qtype: dns.TypeA, Qclass: dns.ClassINET})
+
+	// Refused by default
+	b, err := NewBlocklist("test-bl-multi", r, BlocklistOptions{BlocklistDB: blockDB})
+	require.NoError(t, err)
+	a, err := b.Resolve(q, ci)
+	require.NoError(t, err)
+	require.Equal(t, dns.RcodeFormatError, a.Rcode)
+	require.Equal(t, 0, r.HitCount())
+
+	// Blocked if any of the questions matches
+	b, err = NewBlocklist("test-bl-multi-all", r, BlocklistOptions{BlocklistDB: blockDB, MatchAllQuestions: true})
+	require.NoError(t, err)
+	a, err = b.Resolve(q, ci)
+	require.NoError(t, err)
+	require.Equal(t, dns.RcodeNameError, a.Rcode)
+	require.Equal(t, 0, r.HitCount())
+
+	// Forwarded if none match
+	q.Question[1].Name = "www.other.test."
+	_, err = b.Resolve(q, ci)
+	require.NoError(t, err)
+	require.Equal(t, 1, r.HitCount())
+}
+
+func TestBlocklistDefaultEDE(t *testing.T) {
+	var ci ClientInfo
+	blockDB, err := NewDomainDB("ads", NewStaticLoader([]string{".evil.test"}))
+	require.NoError(t, err)
+
+	requireEDE := func(a *dns.Msg, code uint16, text string) {
+		require.Equal(t, dns.RcodeNameError, a.Rcode)
+		opt := a.IsEdns0()
+		require.NotNil(t, opt)
+		require.Len(t, opt.Option, 1)
+		ede, ok := opt.Option[0].(*dns.EDNS0_EDE)
+		require.True(t, ok)
+		require.Equal(t, code, ede.InfoCode)
+		require.Equal(t, text, ede.ExtraText)
+	}
+
+	q := new(dns.Msg)
+	q.SetQuestion("www.evil.test.", dns.TypeA)
+	q.SetEdns0(1232, false)
+
+	// Default EDE with the list name
+	b, err := NewBlocklist("test-bl-ede", new(TestResolver), BlocklistOptions{BlocklistDB: blockDB, DefaultEDE: true})
+	require.NoError(t, err)
+	a, err := b.Resolve(q, ci)
+	require.NoError(t, err)
+	requireEDE(a, dns.ExtendedErrorCodeBlocked, "blocked by ads")
+	require.Equal(t, uint16(1232), a.IsEdns0().UDPSize())
+
+	// No EDNS0 in the query, no EDE in the response
+	q2 := new(dns.Msg)
+	q2.SetQuestion("www.evil.test.", dns.TypeA)
+	a, err = b.Resolve(q2, ci)
+	require.NoError(t, err)
+	require.Nil(t, a.IsEdns0())
+
+	// An explicit template takes precedence
+	tpl, err := NewEDNS0EDETemplate(dns.ExtendedErrorCodeFiltered, "filtered {{ .Question }}")
+	require.NoError(t, err)
+	b, err = NewBlocklist("test-bl-ede-tpl", new(TestResolver), BlocklistOptions{
+		BlocklistDB:      blockDB,
+		EDNS0EDETemplate: tpl,
+		DefaultEDE:       true,
+	})
+	require.NoError(t, err)
+	a, err = b.Resolve(q, ci)
+	require.NoError(t, err)
+	requireEDE(a, dns.ExtendedErrorCodeFiltered, "filtered www.evil.test.")
+
+	// Disabled by default
+	b, err = NewBlocklist("test-bl-no-ede", new(TestResolver), BlocklistOptions{BlocklistDB: blockDB})
+	require.NoError(t, err)
+	a, err = b.Resolve(q, ci)
+	require.NoError(t, err)
+	require.Nil(t, a.IsEdns0())
+}
+
+func TestBlocklistRuntimeRules(t *testing.T) {
+	r := new(TestResolver)
+	blockDB, err := NewDomainDB("testlist", NewStaticLoader([]string{"block.test"}))
+	require.NoError(t, err)
+	b, err := NewBlocklist("test-bl-runtime", r, BlocklistOptions{BlocklistDB: blockDB})
+	require.NoError(t, err)
+
+	blocked := func(name string) bool {
+		q := new(dns.Msg)
+		q.SetQuestion(name, dns.TypeA)
+		a, err := b.Resolve(q, ClientInfo{})
+		require.NoError(t, err)
+		return a.Rcode == dns.RcodeNameError
+	}
+	require.True(t, blocked("block.test."))
+	require.False(t, blocked("evil.test."))
+
+	// Added rules apply in addition to the configured list
+	require.NoError(t, b.AddRules(false, ".evil.test"))
+	require.True(t, blocked("evil.test."))
+	require.True(t, blocked("www.evil.test."))
+
+	// Allow rules override both
+	require.NoError(t, b.AddRules(true, "www.evil.test", "block.test"))
+	require.False(t, blocked("www.evil.test."))
+	require.False(t, blocked("block.test."))
+	require.True(t, blocked("evil.test."))
+
+	// The rules are kept when the lists are reloaded
+	require.NoError(t, b.ReloadAll())
+	require.True(t, blocked("evil.test."))
+	block, allow := b.RuntimeRules()
+	require.Equal(t, []string{".evil.test"}, block)
+	require.Equal(t, []string{"www.evil.test", "block.test"}, allow)
+}
+
+func TestBlocklistRuleActions(t *testing.T) {
+	var ci ClientInfo
+	upstream := new(TestResolver)
+	sinkhole := new(TestResolver)
+	blockDB, err := NewDomainDB("block", NewStaticLoader([]string{
+		".evil.test",
+		"refused.test action=refused",
+		"null.test action=null ttl=60",
+		".redirect.test action=ip:192.0.2.1,2001:db8::1",
+		"forward.test action=forward:sinkhole",
+		"missing.test action=forward:missing",
+		"nx.test action=nxdomain ttl=30",
+	}))
+	require.NoError(t, err)
+	static, err := NewStaticResolver("test-static", StaticResolverOptions{RCode: dns.RcodeSuccess})
+	require.NoError(t, err)
+	b, err := NewBlocklist("test-bl-actions", upstream, BlocklistOptions{
+		BlocklistDB:       blockDB,
+		BlocklistResolver: static,
+		ActionResolvers:   map[string]Resolver{"sinkhole": sinkhole},
+	})
+	require.NoError(t, err)
+
+	resolve := func(name string, qtype uint16) *dns.Msg {
+		q := new(dns.Msg)
+		q.SetQuestion(name, qtype)
+		a, err := b.Resolve(q, ci)
+		require.NoError(t, err)
+		return a
+	}
+
+	// Rules without action use the blocklist-resolver
+	a := resolve("www.evil.test.", dns.TypeA)
+	require.Equal(t, dns.RcodeSuccess, a.Rcode)
+	require.Empty(t, a.Answer)
+
+	a = resolve("refused.test.", dns.TypeA)
+	require.Equal(t, dns.RcodeRefused, a.Rcode)
+
+	a = resolve("null.test.", dns.TypeAAAA)
+	require.Len(t, a.Answer, 1)
+	require.Equal(t, "::", a.Answer[0].(*dns.AAAA).AAAA.String())
+	require.Equal(t, uint32(60), a.Answer[0].Header().Ttl)
+
+	a = resolve("www.redirect.test.", dns.TypeA)
+	require.Len(t, a.Answer, 1)
+	require.Equal(t, "192.0.2.1", a.Answer[0].(*dns.A).A.String())
+	a = resolve("www.redirect.test.", dns.TypeAAAA)
+	require.Len(t, a.Answer, 1)
+	require.Equal(t, "2001:db8::1", a.Answer[0].(*dns.AAAA).AAAA.String())
+
+	_ = resolve("forward.test.", dns.TypeA)
+	require.Equal(t, 1, sinkhole.HitCount())
+
+	// Unknown resolvers and nxdomain actions block the query
+	a = resolve("missing.test.", dns.TypeA)
+	require.Equal(t, dns.RcodeNameError, a.Rcode)
+	a = resolve("nx.test.", dns.TypeA)
+	require.Equal(t, dns.RcodeNameError, a.Rcode)
+	require.Len(t, a.Ns, 1)
+	require.Equal(t, uint32(30), a.Ns[0].(*dns.SOA).Minttl)
+	require.Equal(t, 0, upstream.HitCount())
+
+	// Invalid rule options
+	_, err = NewDomainDB("invalid", NewStaticLoader([]string{"bad.test action=unknown"}))
+	require.Error(t, err)
+	_, err = NewRegexpDB("invalid", NewStaticLoader([]string{`^bad\.test\.$ ttl=x`}))
+	require.Error(t, err)
+}
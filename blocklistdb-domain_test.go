@@ -1,6 +1,8 @@
 package rdns
 
 import (
+	"fmt"
+	"runtime"
 	"testing"
 
 	"github.com/miekg/dns"
@@ -52,6 +54,39 @@ func TestDomainDB(t *testing.T) {
 	}
 }
 
+func TestDomainDBOverlappingRules(t *testing.T) {
+	loader := NewStaticLoader([]string{
+		"# comment, ignored",
+		"",
+		"example.com",
+		"www.example.com",
+		"*.ads.example.com",
+	})
+	m, err := NewDomainDB("testlist", loader)
+	require.NoError(t, err)
+
+	tests := []struct {
+		q     string
+		match bool
+		rule  string
+	}{
+		// An exact rule still matches with longer rules below it
+		{"example.com.", true, "example.com"},
+		{"www.example.com.", true, "www.example.com"},
+		{"other.example.com.", false, ""},
+		{"ads.example.com.", false, ""},
+		{"x.ads.example.com.", true, "*.ads.example.com"},
+	}
+	for _, test := range tests {
+		q := dns.Question{Name: test.q, Qtype: dns.TypeA, Qclass: dns.ClassINET}
+		_, _, match, ok := m.Match(q)
+		require.Equal(t, test.match, ok, "query: %s", test.q)
+		if ok {
+			require.Equal(t, test.rule, match.Rule, "query: %s", test.q)
+		}
+	}
+}
+
 func TestDomainDBError(t *testing.T) {
 	tests := []struct {
 		name string
@@ -65,3 +100,76 @@ func TestDomainDBError(t *testing.T) {
 		require.Error(t, err)
 	}
 }
+
+func TestDomainDBBloom(t *testing.T) {
+	rules := make([]string, 0, 100000)
+	for i := 0; i < 100000; i++ {
+		rules = append(rules, fmt.Sprintf("host%d.domain%d.test", i, i%100))
+	}
+	m, err := NewDomainDBWithOptions("testlist", NewStaticLoader(rules), DomainDBOptions{BloomFalsePositiveRate: 0.01})
+	require.NoError(t, err)
+	require.NotNil(t, m.bloom)
+
+	// No entry on the list is ever missed
+	for _, r := range rules {
+		_, _, _, ok := m.Match(dns.Question{Name: r + ".", Qtype: dns.TypeA, Qclass: dns.ClassINET})
+		require.True(t, ok, r)
+	}
+
+	// False positives of the filter don't result in matches
+	for i := 0; i < 100000; i++ {
+		name := fmt.Sprintf("other%d.domain%d.test.", i, i%100)
+		_, _, _, ok := m.Match(dns.Question{Name: name, Qtype: dns.TypeA, Qclass: dns.ClassINET})
+		require.False(t, ok, name)
+	}
+
+	// The filter is rebuilt on reload
+	db, err := m.Reload()
+	require.NoError(t, err)
+	require.NotNil(t, db.(*DomainDB).bloom)
+
+	// The filter isn't used with wildcard rules
+	m, err = NewDomainDBWithOptions("testlist", NewStaticLoader([]string{"a.test", ".b.test"}), DomainDBOptions{BloomFalsePositiveRate: 0.01})
+	require.NoError(t, err)
+	require.Nil(t, m.bloom)
+	_, _, _, ok := m.Match(dns.Question{Name: "sub.b.test.", Qtype: dns.TypeA, Qclass: dns.ClassINET})
+	require.True(t, ok)
+}
+
+func BenchmarkDomainDBBloom(b *testing.B) {
+	rules := benchmarkDomainRules()
+	for _, rate := range []float64{0, 0.01} {
+		db, err := NewDomainDBWithOptions("bench", NewStaticLoader(rules), DomainDBOptions{BloomFalsePositiveRate: rate})
+		require.NoError(b, err)
+		b.Run(fmt.Sprintf("miss-bloom-%v", rate), func(b *testing.B) {
+			q := dns.Question{Name: "www.unblocked.com.", Qtype: dns.TypeA}
+			b.ReportAllocs()
+			for i := 0; i < b.N; i++ {
+				db.Match(q)
+			}
+		})
+		b.Run(fmt.Sprintf("hit-bloom-%v", rate), func(b *testing.B) {
+			q := dns.Question{Name: "host123456.domain456.com.", Qtype: dns.TypeA}
+			b.ReportAllocs()
+			for i := 0; i < b.N; i++ {
+				db.Match(q)
+			}
+		})
+	}
+}
+
+// Reports the memory used by a list with a million rules, after it's loaded.
+func BenchmarkDomainDBMemory(b *testing.B) {
+	rules := realisticDomainRules(1000000)
+	for i := 0; i < b.N; i++ {
+		var before, after runtime.MemStats
+		runtime.GC()
+		runtime.ReadMemStats(&before)
+		db, err := NewDomainDB("bench", NewStaticLoader(rules))
+		require.NoError(b, err)
+		runtime.GC()
+		runtime.ReadMemStats(&after)
+		runtime.KeepAlive(db)
+		b.ReportMetric(float64(int64(after.HeapAlloc)-int64(before.HeapAlloc))/(1<<20), "MB/1M-rules")
+	}
+}
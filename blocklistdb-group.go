@@ -0,0 +1,79 @@
+package rdns
+
+import (
+	"errors"
+	"fmt"
+	"net"
+
+	"github.com/miekg/dns"
+	"github.com/sirupsen/logrus"
+)
+
+// GroupDB combines multiple named blocklist DBs in priority order. Queries are
+// matched against the members in the declared order and the match from the
+// first, highest-priority, member is returned. Unlike MultiDB, members are
+// reloaded independently, a member that fails to reload keeps its last-good
+// rules without affecting the others.
+type GroupDB struct {
+	name    string
+	members []GroupMember
+}
+
+// GroupMember is a named blocklist DB in a GroupDB.
+type GroupMember struct {
+	Name string
+	DB   BlocklistDB
+}
+
+var _ BlocklistDB = GroupDB{}
+
+// NewGroupDB returns a new instance of a blocklist group. The members are
+// listed in priority order, highest first.
+func NewGroupDB(name string, members ...GroupMember) (GroupDB, error) {
+	for _, m := range members {
+		if m.DB == nil {
+			return GroupDB{}, fmt.Errorf("no blocklist for member %q", m.Name)
+		}
+	}
+	return GroupDB{name: name, members: members}, nil
+}
+
+// Reload all members. Members that fail to reload keep their current rules.
+// An error is only returned if all members failed.
+func (g GroupDB) Reload() (BlocklistDB, error) {
+	members := make([]GroupMember, 0, len(g.members))
+	var errs []error
+	for _, m := range g.members {
+		db, err := m.DB.Reload()
+		if err != nil {
+			Log.WithFields(logrus.Fields{"id": g.name, "list": m.Name}).WithError(err).Error("failed to reload list, keeping previous rules")
+			errs = append(errs, fmt.Errorf("%s: %w", m.Name, err))
+			db = m.DB
+		}
+		members = append(members, GroupMember{Name: m.Name, DB: db})
+	}
+	if len(errs) > 0 && len(errs) == len(g.members) {
+		return nil, errors.Join(errs...)
+	}
+	return NewGroupDB(g.name, members...)
+}
+
+func (g GroupDB) Match(q dns.Question) ([]net.IP, []string, *BlocklistMatch, bool) {
+	for _, m := range g.members {
+		ip, names, match, ok := m.DB.Match(q)
+		if !ok {
+			continue
+		}
+		if match == nil {
+			match = &BlocklistMatch{List: m.Name}
+		} else if match.List == "" {
+			match = &BlocklistMatch{List: m.Name, Rule: match.Rule, Action: match.Action}
+		}
+		return ip, names, match, true
+	}
+	return nil, nil, nil, false
+}
+
+func (g GroupDB) String() string {
+	return "Group-Blocklist"
+}
@@ -0,0 +1,95 @@
+package rdns
+
+import (
+	"errors"
+	"testing"
+
+	"github.com/miekg/dns"
+	"github.com/stretchr/testify/require"
+)
+
+// Loader that returns its rules, or an error if set.
+type failingLoader struct {
+	rules []string
+	err   error
+}
+
+func (l *failingLoader) Load() ([]string, error) {
+	return l.rules, l.err
+}
+
+func TestGroupDBPriority(t *testing.T) {
+	high, err := NewDomainDB("high", NewStaticLoader([]string{"www.example.com"}))
+	require.NoError(t, err)
+	low, err := NewHostsDB("low", NewStaticLoader([]string{
+		"192.0.2.1 www.example.com",
+		"192.0.2.2 other.example.com",
+	}))
+	require.NoError(t, err)
+
+	tests := []struct {
+		members []GroupMember
+		q       string
+		list    string
+		ips     int
+	}{
+		// The highest-priority list that matches wins
+		{[]GroupMember{{"high", high}, {"low", low}}, "www.example.com.", "high", 0},
+		{[]GroupMember{{"low", low}, {"high", high}}, "www.example.com.", "low", 1},
+		// Lower-priority lists are used if the others don't match
+		{[]GroupMember{{"high", high}, {"low", low}}, "other.example.com.", "low", 1},
+	}
+	for _, test := range tests {
+		g, err := NewGroupDB("test", test.members...)
+		require.NoError(t, err)
+		ips, _, match, ok := g.Match(dns.Question{Name: test.q, Qtype: dns.TypeA, Qclass: dns.ClassINET})
+		require.True(t, ok, test.q)
+		require.Equal(t, test.list, match.List)
+		require.Len(t, ips, test.ips)
+	}
+
+	g, err := NewGroupDB("test", GroupMember{"high", high}, GroupMember{"low", low})
+	require.NoError(t, err)
+	_, _, _, ok := g.Match(dns.Question{Name: "none.example.com.", Qtype: dns.TypeA, Qclass: dns.ClassINET})
+	require.False(t, ok)
+}
+
+func TestGroupDBPartialReload(t *testing.T) {
+	aLoader := &failingLoader{rules: []string{"a.test"}}
+	bLoader := &failingLoader{rules: []string{"b.test"}}
+	a, err := NewDomainDB("a", aLoader)
+	require.NoError(t, err)
+	b, err := NewDomainDB("b", bLoader)
+	require.NoError(t, err)
+	g, err := NewGroupDB("test", GroupMember{"a", a}, GroupMember{"b", b})
+	require.NoError(t, err)
+
+	match := func(db BlocklistDB, name string) bool {
+		_, _, _, ok := db.Match(dns.Question{Name: name, Qtype: dns.TypeA, Qclass: dns.ClassINET})
+		return ok
+	}
+
+	// Member a fails and keeps its rules while b is updated
+	aLoader.err = errors.New("unavailable")
+	bLoader.rules = []string{"b2.test"}
+	db, err := g.Reload()
+	require.NoError(t, err)
+	require.True(t, match(db, "a.test."))
+	require.False(t, match(db, "b.test."))
+	require.True(t, match(db, "b2.test."))
+
+	// a recovers on the next reload
+	aLoader.err = nil
+	aLoader.rules = []string{"a2.test"}
+	db, err = db.Reload()
+	require.NoError(t, err)
+	require.False(t, match(db, "a.test."))
+	require.True(t, match(db, "a2.test."))
+	require.True(t, match(db, "b2.test."))
+
+	// The reload fails if no member could be reloaded
+	aLoader.err = errors.New("unavailable")
+	bLoader.err = errors.New("unavailable")
+	_, err = db.Reload()
+	require.Error(t, err)
+}
@@ -1,6 +1,7 @@
 package rdns
 
 import (
+	"errors"
 	"net"
 	"strings"
 
@@ -10,6 +11,8 @@ import (
 // HostsDB holds a list of hosts-file entries that are used in blocklists to spoof or bloc requests.
 // IP4 and IP6 records can be spoofed independently, however it's not possible to block only one type. If
 // IP4 is given but no IP6, then a domain match will still result in an NXDOMAIN for the IP6 address.
+// Entries with the unspecified address (0.0.0.0 or ::) block the name rather than spoofing it. Lines
+// that don't start with a valid IP address are ignored.
 type HostsDB struct {
 	name    string
 	filters map[string]ipRecords
@@ -36,20 +39,18 @@ func NewHostsDB(name string, loader BlocklistLoader) (*HostsDB, error) {
 	filters := make(map[string]ipRecords)
 	ptrMap := make(map[string][]string)
 	for _, r := range rules {
-		r = strings.TrimSpace(r)
+		// Drop comments, including those at the end of a line
+		r, _, _ = strings.Cut(r, "#")
 		fields := strings.Fields(r)
-		if len(fields) == 0 {
+		if len(fields) < 2 {
 			continue
 		}
 		ipString := fields[0]
 		names := fields[1:]
-		if strings.HasPrefix(ipString, "#") {
-			continue
-		}
-		if len(names) == 0 {
+		ip := net.ParseIP(ipString)
+		if ip == nil {
 			continue
 		}
-		ip := net.ParseIP(ipString)
 		var isIP4 bool
 		if ip4 := ip.To4(); len(ip4) == net.IPv4len {
 			isIP4 = true
@@ -61,12 +62,12 @@ func NewHostsDB(name string, loader BlocklistLoader) (*HostsDB, error) {
 			name = strings.TrimSuffix(name, ".")
 			ips := filters[name]
 			if isIP4 {
-				if len(ips.ip4) > maxHostsResponses {
+				if len(ips.ip4) >= maxHostsResponses {
 					continue
 				}
 				ips.ip4 = append(ips.ip4, ip)
 			} else {
-				if len(ips.ip6) > maxHostsResponses {
+				if len(ips.ip6) >= maxHostsResponses {
 					continue
 				}
 				ips.ip6 = append(ips.ip6, ip)
@@ -83,7 +84,11 @@ func NewHostsDB(name string, loader BlocklistLoader) (*HostsDB, error) {
 }
 
 func (m *HostsDB) Reload() (BlocklistDB, error) {
-	return NewHostsDB(m.name, m.loader)
+	db, err := NewHostsDB(m.name, m.loader)
+	if errors.Is(err, ErrNotModified) {
+		return m, nil
+	}
+	return db, err
 }
 
 func (m *HostsDB) Match(q dns.Question) ([]net.IP, []string, *BlocklistMatch, bool) {
@@ -100,6 +105,15 @@ func (m *HostsDB) Match(q dns.Question) ([]net.IP, []string, *BlocklistMatch, bo
 	}
 	name := strings.TrimSuffix(q.Name, ".")
 	ips, ok := m.filters[name]
+	if q.Qtype == dns.TypeANY {
+		return append(append([]net.IP{}, ips.ip4...), ips.ip6...),
+			nil,
+			&BlocklistMatch{
+				List: m.name,
+				Rule: name,
+			},
+			ok
+	}
 	if q.Qtype == dns.TypeA {
 		return ips.ip4,
 			nil,
@@ -18,6 +18,9 @@ func TestHostsDB(t *testing.T) {
 		"::          domain5.com",
 		"::1         domain6.com",
 		"192.168.1.1 domain6.com",
+		"10.0.0.1    domain7.com # sinkhole",
+		"not-an-ip   domain8.com",
+		"10.0.0.2",
 	})
 
 	m, err := NewHostsDB("testlist", loader)
@@ -35,6 +38,11 @@ func TestHostsDB(t *testing.T) {
 		{"domain5.com.", dns.TypeA, true, []net.IP(nil)},
 		{"domain6.com.", dns.TypeA, true, []net.IP{net.ParseIP("192.168.1.1")}},
 		{"domain6.com.", dns.TypeAAAA, true, []net.IP{net.ParseIP("::1")}},
+		{"domain7.com.", dns.TypeA, true, []net.IP{net.ParseIP("10.0.0.1")}},
+		{"domain7.com.", dns.TypeAAAA, true, []net.IP(nil)},
+		{"sinkhole.", dns.TypeA, false, nil},
+		{"domain8.com.", dns.TypeA, false, nil},
+		{"domain8.com.", dns.TypeAAAA, false, nil},
 		{"domainX.com.", dns.TypeA, false, nil},
 	}
 	for _, test := range tests {
@@ -46,3 +54,40 @@ func TestHostsDB(t *testing.T) {
 		require.Equal(t, "testlist", match.List)
 	}
 }
+
+func TestHostsDBSpoof(t *testing.T) {
+	var ci ClientInfo
+	loader := NewStaticLoader([]string{
+		"10.0.0.1    sinkhole.test",
+		"fd00::1     sinkhole.test",
+		"0.0.0.0     ads.test",
+	})
+	db, err := NewHostsDB("testlist", loader)
+	require.NoError(t, err)
+	r := new(TestResolver)
+	b, err := NewBlocklist("test-hosts", r, BlocklistOptions{BlocklistDB: db})
+	require.NoError(t, err)
+
+	// The address from the hosts file is returned for both types
+	q := new(dns.Msg)
+	q.SetQuestion("sinkhole.test.", dns.TypeA)
+	a, err := b.Resolve(q, ci)
+	require.NoError(t, err)
+	require.Equal(t, dns.RcodeSuccess, a.Rcode)
+	require.Len(t, a.Answer, 1)
+	require.Equal(t, "10.0.0.1", a.Answer[0].(*dns.A).A.String())
+
+	q.SetQuestion("sinkhole.test.", dns.TypeAAAA)
+	a, err = b.Resolve(q, ci)
+	require.NoError(t, err)
+	require.Len(t, a.Answer, 1)
+	require.Equal(t, "fd00::1", a.Answer[0].(*dns.AAAA).AAAA.String())
+
+	// The unspecified address blocks the name
+	q.SetQuestion("ads.test.", dns.TypeA)
+	a, err = b.Resolve(q, ci)
+	require.NoError(t, err)
+	require.Equal(t, dns.RcodeNameError, a.Rcode)
+	require.Empty(t, a.Answer)
+	require.Equal(t, 0, r.HitCount())
+}
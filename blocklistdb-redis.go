@@ -0,0 +1,276 @@
+package rdns
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/miekg/dns"
+	"github.com/redis/go-redis/v9"
+)
+
+// RedisBlocklistDB is a blocklist DB with rules stored in a Redis hash so that
+// one set of rules can be shared by multiple routedns instances. Rules use the
+// same format as DomainDB. The hash fields are the names that are matched, with
+// wildcard rules stored as "*.domain", and the values hold the list and rule.
+type RedisBlocklistDB struct {
+	opt   RedisBlocklistOptions
+	bloom *bloomFilter
+}
+
+var _ BlocklistDB = &RedisBlocklistDB{}
+
+type RedisBlocklistOptions struct {
+	Client *redis.Client
+
+	// Prefix of the keys used in Redis. The rules are stored in <prefix>rules.
+	KeyPrefix string
+
+	// Name of the list stored with the imported rules.
+	Name string
+
+	// Source of the rules that are imported into Redis on load. If nil, the
+	// rules already in Redis are used as-is, for example when they are
+	// maintained by another instance.
+	Loader BlocklistLoader
+
+	// Keep a local bloom filter of the rules to avoid queries to Redis for
+	// names that don't match.
+	Bloom bool
+
+	// Target false-positive rate of the bloom filter. Defaults to 0.01.
+	BloomFalsePositiveRate float64
+
+	// Timeout for lookups in Redis. Defaults to 100ms.
+	Timeout time.Duration
+}
+
+// Stored as value for every name in the hash.
+type redisBlocklistRule struct {
+	List string `json:"list"`
+	Rule string `json:"rule"`
+}
+
+// Number of fields written to Redis per command when importing rules.
+const redisImportBatch = 1000
+
+// NewRedisBlocklistDB returns a new instance of a blocklist DB backed by Redis.
+// Rules from the loader, if any, are imported before it is returned.
+func NewRedisBlocklistDB(opt RedisBlocklistOptions) (*RedisBlocklistDB, error) {
+	if opt.Client == nil {
+		return nil, errors.New("no redis client")
+	}
+	if opt.BloomFalsePositiveRate <= 0 {
+		opt.BloomFalsePositiveRate = 0.01
+	}
+	if opt.Timeout <= 0 {
+		opt.Timeout = 100 * time.Millisecond
+	}
+	m := &RedisBlocklistDB{opt: opt}
+	if err := m.load(); err != nil {
+		return nil, err
+	}
+	return m, nil
+}
+
+func (m *RedisBlocklistDB) Reload() (BlocklistDB, error) {
+	db := &RedisBlocklistDB{opt: m.opt}
+	err := db.load()
+	if errors.Is(err, ErrNotModified) {
+		return m, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	return db, nil
+}
+
+func (m *RedisBlocklistDB) Match(q dns.Question) ([]net.IP, []string, *BlocklistMatch, bool) {
+	keys := redisBlocklistKeys(q.Name)
+	if m.bloom != nil {
+		var maybe bool
+		for _, k := range keys {
+			if m.bloom.mayContain(k) {
+				maybe = true
+				break
+			}
+		}
+		if !maybe {
+			return nil, nil, nil, false
+		}
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), m.opt.Timeout)
+	defer cancel()
+	values, err := m.opt.Client.HMGet(ctx, m.key(), keys...).Result()
+	if err != nil {
+		Log.WithField("list", m.opt.Name).WithError(err).Error("failed to read blocklist from redis")
+		return nil, nil, nil, false
+	}
+
+	// Like in the DomainDB, the most general rule takes precedence
+	for i := len(values) - 1; i >= 0; i-- {
+		s, ok := values[i].(string)
+		if !ok {
+			continue
+		}
+		var rule redisBlocklistRule
+		if err := json.Unmarshal([]byte(s), &rule); err != nil {
+			Log.WithField("list", m.opt.Name).WithError(err).Error("invalid blocklist rule in redis")
+			continue
+		}
+		return nil, nil, &BlocklistMatch{List: rule.List, Rule: rule.Rule}, true
+	}
+	return nil, nil, nil, false
+}
+
+func (m *RedisBlocklistDB) String() string {
+	return "Redis"
+}
+
+func (m *RedisBlocklistDB) key() string {
+	return m.opt.KeyPrefix + "rules"
+}
+
+// Import the rules into Redis if there is a loader, and build the bloom filter.
+func (m *RedisBlocklistDB) load() error {
+	if m.opt.Loader == nil {
+		if m.opt.Bloom {
+			return m.loadBloom()
+		}
+		return nil
+	}
+	rules, err := m.opt.Loader.Load()
+	if err != nil {
+		return err
+	}
+	fields, err := redisBlocklistFields(m.opt.Name, rules)
+	if err != nil {
+		return err
+	}
+	if err := m.importFields(fields); err != nil {
+		return err
+	}
+	if m.opt.Bloom {
+		m.bloom = newBloomFilter(len(fields), m.opt.BloomFalsePositiveRate)
+		for name := range fields {
+			m.bloom.add(name)
+		}
+	}
+	return nil
+}
+
+// Write the fields into a new hash, then rename it to replace the current
+// rules. RENAME is atomic so queries always see either the old rules or the
+// new ones.
+func (m *RedisBlocklistDB) importFields(fields map[string]string) error {
+	ctx := context.Background()
+	if len(fields) == 0 {
+		return m.opt.Client.Del(ctx, m.key()).Err()
+	}
+	tmp := m.key() + ":import:" + strconv.FormatInt(time.Now().UnixNano(), 10)
+	batch := make([]any, 0, 2*redisImportBatch)
+	flush := func() error {
+		if len(batch) == 0 {
+			return nil
+		}
+		err := m.opt.Client.HSet(ctx, tmp, batch...).Err()
+		batch = batch[:0]
+		return err
+	}
+	for name, value := range fields {
+		batch = append(batch, name, value)
+		if len(batch) >= 2*redisImportBatch {
+			if err := flush(); err != nil {
+				m.opt.Client.Del(ctx, tmp)
+				return fmt.Errorf("failed to import blocklist into redis: %w", err)
+			}
+		}
+	}
+	if err := flush(); err != nil {
+		m.opt.Client.Del(ctx, tmp)
+		return fmt.Errorf("failed to import blocklist into redis: %w", err)
+	}
+	if err := m.opt.Client.Rename(ctx, tmp, m.key()).Err(); err != nil {
+		m.opt.Client.Del(ctx, tmp)
+		return fmt.Errorf("failed to replace blocklist in redis: %w", err)
+	}
+	return nil
+}
+
+// Build the bloom filter from the rules currently stored in Redis.
+func (m *RedisBlocklistDB) loadBloom() error {
+	ctx := context.Background()
+	count, err := m.opt.Client.HLen(ctx, m.key()).Result()
+	if err != nil {
+		return err
+	}
+	bloom := newBloomFilter(int(count), m.opt.BloomFalsePositiveRate)
+	iter := m.opt.Client.HScan(ctx, m.key(), 0, "", redisImportBatch).Iterator()
+	for i := 0; iter.Next(ctx); i++ {
+		// The scan returns field names and values alternately
+		if i%2 == 0 {
+			bloom.add(iter.Val())
+		}
+	}
+	if err := iter.Err(); err != nil {
+		return err
+	}
+	m.bloom = bloom
+	return nil
+}
+
+// Convert domain rules into hash fields and values. Rules matching a domain and
+// its subdomains are stored as two fields, the name and the wildcard.
+func redisBlocklistFields(list string, rules []string) (map[string]string, error) {
+	fields := make(map[string]string, len(rules))
+	for _, r := range rules {
+		r = strings.ToLower(strings.TrimSuffix(strings.TrimSpace(r), "."))
+		if r == "" || strings.HasPrefix(r, "#") {
+			continue
+		}
+		var names []string
+		switch {
+		case strings.HasPrefix(r, "*."):
+			names = []string{r}
+		case strings.HasPrefix(r, "."):
+			names = []string{r[1:], "*" + r}
+		default:
+			names = []string{r}
+		}
+		for _, name := range names {
+			if strings.Contains(strings.TrimPrefix(name, "*."), "*") {
+				return nil, fmt.Errorf("invalid blocklist item: '%s'", r)
+			}
+		}
+		value, err := json.Marshal(redisBlocklistRule{List: list, Rule: r})
+		if err != nil {
+			return nil, err
+		}
+		for _, name := range names {
+			fields[name] = string(value)
+		}
+	}
+	return fields, nil
+}
+
+// Returns the hash fields that can match a query name, the name itself
+// followed by wildcards for each parent domain.
+func redisBlocklistKeys(name string) []string {
+	name = strings.ToLower(strings.TrimSuffix(name, "."))
+	keys := []string{name}
+	for {
+		i := strings.Index(name, ".")
+		if i < 0 {
+			break
+		}
+		name = name[i+1:]
+		keys = append(keys, "*."+name)
+	}
+	return keys
+}
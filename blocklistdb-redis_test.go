@@ -0,0 +1,58 @@
+package rdns
+
+import (
+	"testing"
+	"time"
+
+	"github.com/miekg/dns"
+	"github.com/redis/go-redis/v9"
+	"github.com/stretchr/testify/require"
+)
+
+func TestRedisBlocklistFields(t *testing.T) {
+	fields, err := redisBlocklistFields("test", []string{
+		"# comment",
+		"Domain1.com.",
+		".domain2.com",
+		"*.domain3.com",
+		"",
+	})
+	require.NoError(t, err)
+	require.Equal(t, map[string]string{
+		"domain1.com":   `{"list":"test","rule":"domain1.com"}`,
+		"domain2.com":   `{"list":"test","rule":".domain2.com"}`,
+		"*.domain2.com": `{"list":"test","rule":".domain2.com"}`,
+		"*.domain3.com": `{"list":"test","rule":"*.domain3.com"}`,
+	}, fields)
+
+	_, err = redisBlocklistFields("test", []string{"a.*.com"})
+	require.Error(t, err)
+}
+
+func TestRedisBlocklistKeys(t *testing.T) {
+	require.Equal(t,
+		[]string{"www.sub.example.com", "*.sub.example.com", "*.example.com", "*.com"},
+		redisBlocklistKeys("WWW.sub.example.com."),
+	)
+}
+
+func TestRedisBlocklistBloom(t *testing.T) {
+	// Client for a server that doesn't exist, names that aren't in the bloom
+	// filter must not be looked up
+	client := redis.NewClient(&redis.Options{Addr: "127.0.0.1:1", MaxRetries: -1})
+	defer client.Close()
+	db := &RedisBlocklistDB{
+		opt:   RedisBlocklistOptions{Client: client, Timeout: 10 * time.Millisecond},
+		bloom: newBloomFilter(10, 0.01),
+	}
+	db.bloom.add("*.example.com")
+
+	_, _, _, ok := db.Match(dns.Question{Name: "www.example.org.", Qtype: dns.TypeA})
+	require.False(t, ok)
+	require.Zero(t, client.PoolStats().Misses)
+
+	// Names that may match are looked up in Redis
+	_, _, _, ok = db.Match(dns.Question{Name: "www.example.com.", Qtype: dns.TypeA})
+	require.False(t, ok)
+	require.NotZero(t, client.PoolStats().Misses)
+}
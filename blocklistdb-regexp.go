@@ -1,6 +1,8 @@
 package rdns
 
 import (
+	"errors"
+	"fmt"
 	"net"
 	"regexp"
 	"strings"
@@ -10,9 +12,10 @@ import (
 
 // RegexpDB holds a list of regular expressions against which it evaluates DNS queries.
 type RegexpDB struct {
-	name   string
-	rules  []*regexp.Regexp
-	loader BlocklistLoader
+	name    string
+	rules   []*regexp.Regexp
+	actions []*BlocklistAction // per-rule actions, nil if the rule has none
+	loader  BlocklistLoader
 }
 
 var _ BlocklistDB = &RegexpDB{}
@@ -23,30 +26,42 @@ func NewRegexpDB(name string, loader BlocklistLoader) (*RegexpDB, error) {
 	if err != nil {
 		return nil, err
 	}
-	var filters []*regexp.Regexp
-	for _, r := range rules {
+	var (
+		filters []*regexp.Regexp
+		actions []*BlocklistAction
+	)
+	for i, r := range rules {
 		r = strings.TrimSpace(r)
 		if r == "" || strings.HasPrefix(r, "#") {
 			continue
 		}
+		r, action, err := parseBlocklistAction(r)
+		if err != nil {
+			return nil, fmt.Errorf("%s: invalid rule on line %d: %w", name, i+1, err)
+		}
 		re, err := regexp.Compile(r)
 		if err != nil {
-			return nil, err
+			return nil, fmt.Errorf("%s: invalid rule on line %d: %w", name, i+1, err)
 		}
 		filters = append(filters, re)
+		actions = append(actions, action)
 	}
 
-	return &RegexpDB{name, filters, loader}, nil
+	return &RegexpDB{name, filters, actions, loader}, nil
 }
 
 func (m *RegexpDB) Reload() (BlocklistDB, error) {
-	return NewRegexpDB(m.name, m.loader)
+	db, err := NewRegexpDB(m.name, m.loader)
+	if errors.Is(err, ErrNotModified) {
+		return m, nil
+	}
+	return db, err
 }
 
 func (m *RegexpDB) Match(q dns.Question) ([]net.IP, []string, *BlocklistMatch, bool) {
-	for _, rule := range m.rules {
+	for i, rule := range m.rules {
 		if rule.MatchString(q.Name) {
-			return nil, nil, &BlocklistMatch{List: m.name, Rule: rule.String()}, true
+			return nil, nil, &BlocklistMatch{List: m.name, Rule: rule.String(), Action: m.actions[i]}, true
 		}
 	}
 	return nil, nil, nil, false
@@ -0,0 +1,73 @@
+package rdns
+
+import (
+	"fmt"
+	"testing"
+
+	"github.com/miekg/dns"
+	"github.com/stretchr/testify/require"
+)
+
+func TestRegexpDB(t *testing.T) {
+	loader := NewStaticLoader([]string{
+		"# ad servers in any domain",
+		`^ads?[0-9]*\.`,
+		"",
+		`(^|\.)tracker\.test\.$`,
+	})
+	m, err := NewRegexpDB("testlist", loader)
+	require.NoError(t, err)
+
+	tests := []struct {
+		q     string
+		match bool
+		rule  string
+	}{
+		{"ad.example.com.", true, `^ads?[0-9]*\.`},
+		{"ads12.example.org.", true, `^ads?[0-9]*\.`},
+		{"x.tracker.test.", true, `(^|\.)tracker\.test\.$`},
+		{"tracker.test.", true, `(^|\.)tracker\.test\.$`},
+		{"bad.example.com.", false, ""},
+		{"nottracker.test.", false, ""},
+		{"tracker.test.com.", false, ""},
+	}
+	for _, test := range tests {
+		q := dns.Question{Name: test.q, Qtype: dns.TypeA, Qclass: dns.ClassINET}
+		_, _, match, ok := m.Match(q)
+		require.Equal(t, test.match, ok, "query: %s", test.q)
+		if test.match {
+			require.Equal(t, "testlist", match.List)
+			require.Equal(t, test.rule, match.Rule)
+		}
+	}
+}
+
+func TestRegexpDBInvalid(t *testing.T) {
+	loader := NewStaticLoader([]string{
+		"# comment",
+		`^ads?\.`,
+		`(unclosed\.`,
+	})
+	_, err := NewRegexpDB("testlist", loader)
+	require.Error(t, err)
+	require.Contains(t, err.Error(), "line 3")
+}
+
+func BenchmarkRegexpDB(b *testing.B) {
+	for _, n := range []int{10, 100, 1000} {
+		rules := make([]string, 0, n)
+		for i := 0; i < n; i++ {
+			rules = append(rules, fmt.Sprintf(`(^|\.)domain%d\.test\.$`, i))
+		}
+		m, err := NewRegexpDB("testlist", NewStaticLoader(rules))
+		require.NoError(b, err)
+		q := dns.Question{Name: "www.example.com.", Qtype: dns.TypeA, Qclass: dns.ClassINET}
+
+		// Worst case, the name doesn't match any of the rules
+		b.Run(fmt.Sprintf("%d-rules", n), func(b *testing.B) {
+			for i := 0; i < b.N; i++ {
+				m.Match(q)
+			}
+		})
+	}
+}
@@ -0,0 +1,95 @@
+package rdns
+
+import (
+	"errors"
+	"net"
+	"strings"
+
+	"github.com/miekg/dns"
+)
+
+// TrieBlocklistDB holds a list of domains in a compact trie, the same that's
+// used by the DomainDB. Rules use the same format as the DomainDB:
+// domain.com: matches just domain.com and not subdomains
+// .domain.com: matches domain.com and all subdomains
+// *.domain.com: matches all subdomains but not domain.com
+// Unlike the DomainDB, names are matched case-insensitively, and comments and
+// blank lines are allowed in the list.
+type TrieBlocklistDB struct {
+	opt  TrieOptions
+	trie *domainTrie
+}
+
+var _ BlocklistDB = &TrieBlocklistDB{}
+
+type TrieOptions struct {
+	// Name of the list, used in matches.
+	Name string
+
+	Loader BlocklistLoader
+
+	// Rules without leading "." or "*." match subdomains as well.
+	WildcardSubdomains bool
+}
+
+// NewTrieBlocklistDB returns a new instance of a trie-based blocklist.
+func NewTrieBlocklistDB(opt TrieOptions) (*TrieBlocklistDB, error) {
+	if opt.Loader == nil {
+		return nil, errors.New("no loader for trie blocklist")
+	}
+	rules, err := opt.Loader.Load()
+	if err != nil {
+		return nil, err
+	}
+	parsed := make([]domainTrieRule, 0, len(rules))
+	for _, r := range rules {
+		r = strings.ToLower(strings.TrimSuffix(strings.TrimSpace(r), "."))
+		if r == "" || strings.HasPrefix(r, "#") {
+			continue
+		}
+		rule, err := parseDomainTrieRule(r, opt.WildcardSubdomains)
+		if err != nil {
+			return nil, err
+		}
+		parsed = append(parsed, rule)
+	}
+	trie, err := newDomainTrie(parsed)
+	if err != nil {
+		return nil, err
+	}
+	return &TrieBlocklistDB{opt: opt, trie: trie}, nil
+}
+
+// Reload builds a new trie with the current rules. The existing one is used
+// for queries until the new one is complete.
+func (m *TrieBlocklistDB) Reload() (BlocklistDB, error) {
+	db, err := NewTrieBlocklistDB(m.opt)
+	if errors.Is(err, ErrNotModified) {
+		return m, nil
+	}
+	return db, err
+}
+
+func (m *TrieBlocklistDB) Match(q dns.Question) ([]net.IP, []string, *BlocklistMatch, bool) {
+	name := strings.ToLower(strings.TrimSuffix(q.Name, "."))
+	domain, flags, ok := m.trie.lookup(name)
+	if !ok {
+		return nil, nil, nil, false
+	}
+	return nil, nil, &BlocklistMatch{List: m.opt.Name, Rule: domainTrieRuleString(domain, flags)}, true
+}
+
+func (m *TrieBlocklistDB) String() string {
+	return "Trie"
+}
+
+// Returns the rule in domain format for a match on the given domain.
+func domainTrieRuleString(domain string, flags byte) string {
+	switch {
+	case flags&trieSubdomains != 0 && flags&trieExact != 0:
+		return "." + domain
+	case flags&trieSubdomains != 0:
+		return "*." + domain
+	}
+	return domain
+}
@@ -0,0 +1,120 @@
+package rdns
+
+import (
+	"fmt"
+	"testing"
+
+	"github.com/miekg/dns"
+	"github.com/stretchr/testify/require"
+)
+
+func TestTrieBlocklistDB(t *testing.T) {
+	loader := NewStaticLoader([]string{
+		"domain1.com.",    // exact match
+		".domain2.com.",   // exact match and subdomains
+		"x.domain2.com",   // above rule should take precendence
+		"*.domain3.com",   // subdomains only
+		"x.x.domain3.com", // more general wildcard above should take precedence
+		"domain4.com",     // the more general rule below wins
+		".domain4.com",
+		"Upper.Case.com",
+	})
+
+	m, err := NewTrieBlocklistDB(TrieOptions{Name: "testlist", Loader: loader})
+	require.NoError(t, err)
+
+	tests := []struct {
+		q     string
+		match bool
+		rule  string
+	}{
+		// exact
+		{"domain1.com.", true, "domain1.com"},
+		{"x.domain1.com.", false, ""},
+
+		// exact and subdomains
+		{"domain2.com.", true, ".domain2.com"},
+		{"x.domain2.com.", true, ".domain2.com"},
+		{"sub.sub.domain2.com.", true, ".domain2.com"},
+
+		// wildcard (match only on subdomains)
+		{"domain3.com.", false, ""},
+		{"sub.domain3.com.", true, "*.domain3.com"},
+		{"x.x.domain3.com.", true, "*.domain3.com"},
+
+		// two rules for this, the generic one wins
+		{"domain4.com.", true, ".domain4.com"},
+		{"sub.domain4.com.", true, ".domain4.com"},
+
+		// case-insensitive
+		{"upper.CASE.com.", true, "upper.case.com"},
+
+		// not matching
+		{"unblocked.test.", false, ""},
+		{"com.", false, ""},
+		{".", false, ""},
+	}
+	for _, test := range tests {
+		q := dns.Question{Name: test.q, Qtype: dns.TypeA, Qclass: dns.ClassINET}
+		_, _, match, ok := m.Match(q)
+		require.Equal(t, test.match, ok, "query: %s", test.q)
+		if ok {
+			require.Equal(t, "testlist", match.List)
+			require.Equal(t, test.rule, match.Rule, "query: %s", test.q)
+		}
+	}
+}
+
+func TestTrieBlocklistDBWildcardSubdomains(t *testing.T) {
+	loader := NewStaticLoader([]string{"evil.example.com"})
+	m, err := NewTrieBlocklistDB(TrieOptions{Loader: loader, WildcardSubdomains: true})
+	require.NoError(t, err)
+
+	for _, name := range []string{"evil.example.com.", "sub.evil.example.com."} {
+		_, _, _, ok := m.Match(dns.Question{Name: name, Qtype: dns.TypeA})
+		require.True(t, ok, name)
+	}
+	_, _, _, ok := m.Match(dns.Question{Name: "example.com.", Qtype: dns.TypeA})
+	require.False(t, ok)
+}
+
+func TestTrieBlocklistDBError(t *testing.T) {
+	for _, rule := range []string{"sub.*.com", "*domain.com", "a..com"} {
+		_, err := NewTrieBlocklistDB(TrieOptions{Loader: NewStaticLoader([]string{rule})})
+		require.Error(t, err, rule)
+	}
+}
+
+// Rules for benchmarks, with a million entries
+func benchmarkDomainRules() []string {
+	rules := make([]string, 0, 1000000)
+	for i := 0; i < 1000000; i++ {
+		rules = append(rules, fmt.Sprintf("host%d.domain%d.com", i, i%1000))
+	}
+	return rules
+}
+
+func benchmarkBlocklistDB(b *testing.B, db BlocklistDB) {
+	questions := []dns.Question{
+		{Name: "host123456.domain456.com.", Qtype: dns.TypeA},
+		{Name: "www.unblocked.com.", Qtype: dns.TypeA},
+		{Name: "host1.domain2.com.", Qtype: dns.TypeA},
+	}
+	b.ReportAllocs()
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		db.Match(questions[i%len(questions)])
+	}
+}
+
+func BenchmarkTrieBlocklistDB(b *testing.B) {
+	db, err := NewTrieBlocklistDB(TrieOptions{Loader: NewStaticLoader(benchmarkDomainRules())})
+	require.NoError(b, err)
+	benchmarkBlocklistDB(b, db)
+}
+
+func BenchmarkDomainDB(b *testing.B) {
+	db, err := NewDomainDB("bench", NewStaticLoader(benchmarkDomainRules()))
+	require.NoError(b, err)
+	benchmarkBlocklistDB(b, db)
+}
@@ -26,6 +26,9 @@ type BlocklistDB interface {
 type BlocklistMatch struct {
 	List string // Identifier or name of the blocklist
 	Rule string // Identifier for the rule that matched
+
+	// Optional response for this rule, overriding the blocklist's behavior
+	Action *BlocklistAction
 }
 
 func (m *BlocklistMatch) GetList() string {
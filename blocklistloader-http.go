@@ -4,11 +4,13 @@ import (
 	"bufio"
 	"context"
 	"crypto/sha256"
+	"errors"
 	"fmt"
 	"io/ioutil"
 	"net/http"
 	"os"
 	"path/filepath"
+	"strings"
 	"time"
 )
 
@@ -17,7 +19,12 @@ type HTTPLoader struct {
 	url         string
 	opt         HTTPLoaderOptions
 	fromDisk    bool
-	lastSuccess []string
+	loaded      bool     // The last load was successful
+	lastSuccess []string // Only kept with AllowFailure
+
+	// Validators of the last successful download, used to make conditional requests
+	etag         string
+	lastModified string
 }
 
 // HTTPLoaderOptions holds options for HTTP blocklist loaders.
@@ -33,7 +40,7 @@ var _ BlocklistLoader = &HTTPLoader{}
 const httpTimeout = 30 * time.Minute
 
 func NewHTTPLoader(url string, opt HTTPLoaderOptions) *HTTPLoader {
-	return &HTTPLoader{url, opt, opt.CacheDir != "", nil}
+	return &HTTPLoader{url: url, opt: opt, fromDisk: opt.CacheDir != ""}
 }
 
 func (l *HTTPLoader) Load() (rules []string, err error) {
@@ -43,11 +50,17 @@ func (l *HTTPLoader) Load() (rules []string, err error) {
 	// If AllowFailure is enabled, return the last successfully loaded list
 	// and nil
 	defer func() {
+		if errors.Is(err, ErrNotModified) {
+			return
+		}
 		if err != nil && l.opt.AllowFailure {
 			log.WithError(err).Warn("failed to load blocklist, continuing with previous ruleset")
 			rules = l.lastSuccess
 			err = nil
-		} else {
+			return
+		}
+		l.loaded = err == nil
+		if l.opt.AllowFailure {
 			l.lastSuccess = rules
 		}
 	}()
@@ -72,50 +85,119 @@ func (l *HTTPLoader) Load() (rules []string, err error) {
 		return nil, err
 	}
 
+	// Only ask for changes if the previous list was downloaded successfully
+	conditional := l.loaded && (l.etag != "" || l.lastModified != "")
+	if conditional {
+		if l.etag != "" {
+			req.Header.Set("If-None-Match", l.etag)
+		}
+		if l.lastModified != "" {
+			req.Header.Set("If-Modified-Since", l.lastModified)
+		}
+	}
+
 	resp, err := http.DefaultClient.Do(req)
 	if err != nil {
 		return nil, err
 	}
 	defer resp.Body.Close()
 
+	if conditional && resp.StatusCode == http.StatusNotModified {
+		log.Trace("blocklist not modified")
+		return nil, ErrNotModified
+	}
 	if resp.StatusCode < 200 || resp.StatusCode > 299 {
 		return nil, fmt.Errorf("got unexpected status code %d from %s", resp.StatusCode, l.url)
 	}
 
+	// Lists can be gzip-compressed, either with Content-Encoding (decoded by
+	// the HTTP client) or as .gz file
 	start := time.Now()
-	scanner := bufio.NewScanner(resp.Body)
-	for scanner.Scan() {
-		rules = append(rules, scanner.Text())
+	rules, err = readRules(resp.Body)
+	if err != nil {
+		return nil, err
 	}
 	log.WithField("load-time", time.Since(start)).Trace("completed loading blocklist")
+	l.etag = resp.Header.Get("ETag")
+	l.lastModified = resp.Header.Get("Last-Modified")
 
-	// Cache the content to disk if the read from the remote server was successful
-	if scanner.Err() == nil && l.opt.CacheDir != "" {
+	// Cache the content to disk since the read from the remote server was successful
+	if l.opt.CacheDir != "" {
 		log.Trace("writing rules to cache-dir")
 		if err := l.writeToDisk(rules); err != nil {
 			log.WithError(err).Error("failed to write rules to cache")
 		}
 	}
-	return rules, scanner.Err()
+	return rules, nil
 }
 
 // Loads a cached version of the list from disk. The filename is made by hashing the URL with SHA256
-// and the file is expect to be in cache-dir.
+// and the file is expect to be in cache-dir. The validators of the cached list are loaded as well
+// so the next refresh only downloads the list if it changed.
 func (l *HTTPLoader) loadFromDisk() ([]string, error) {
 	f, err := os.Open(l.cacheFilename())
 	if err != nil {
 		return nil, err
 	}
 	defer f.Close()
-	var rules []string
-	scanner := bufio.NewScanner(f)
-	for scanner.Scan() {
-		rules = append(rules, scanner.Text())
+	rules, err := readRules(f)
+	if err != nil {
+		return nil, err
+	}
+	if b, err := os.ReadFile(l.cacheFilename() + ".meta"); err == nil {
+		for _, line := range strings.Split(string(b), "\n") {
+			key, value, _ := strings.Cut(line, ": ")
+			switch key {
+			case "ETag":
+				l.etag = value
+			case "Last-Modified":
+				l.lastModified = value
+			}
+		}
+	}
+	return rules, nil
+}
+
+// Writes the list and its validators to the cache directory. The validators
+// of the old list are removed first and only written again once the new list
+// is in place, so they can't end up next to an older list. Conditional requests
+// with them would keep that list forever.
+func (l *HTTPLoader) writeToDisk(rules []string) error {
+	metaFilename := l.cacheFilename() + ".meta"
+	if err := os.Remove(metaFilename); err != nil && !errors.Is(err, os.ErrNotExist) {
+		return err
+	}
+	if err := l.writeList(rules); err != nil {
+		return err
+	}
+
+	// Store the validators next to the list
+	var meta string
+	if l.etag != "" {
+		meta += "ETag: " + l.etag + "\n"
+	}
+	if l.lastModified != "" {
+		meta += "Last-Modified: " + l.lastModified + "\n"
+	}
+	if meta == "" {
+		return nil
+	}
+	f, err := os.CreateTemp(l.opt.CacheDir, "routedns")
+	if err != nil {
+		return err
+	}
+	defer os.Remove(f.Name())
+	_, err = f.WriteString(meta)
+	if cerr := f.Close(); err == nil {
+		err = cerr
+	}
+	if err != nil {
+		return err
 	}
-	return rules, scanner.Err()
+	return os.Rename(f.Name(), metaFilename)
 }
 
-func (l *HTTPLoader) writeToDisk(rules []string) (err error) {
+func (l *HTTPLoader) writeList(rules []string) (err error) {
 	f, err := ioutil.TempFile(l.opt.CacheDir, "routedns")
 	if err != nil {
 		return
@@ -0,0 +1,156 @@
+package rdns
+
+import (
+	"compress/gzip"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/miekg/dns"
+	"github.com/stretchr/testify/require"
+)
+
+func TestHTTPLoaderETag(t *testing.T) {
+	var requests, downloads int
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		requests++
+		if r.Header.Get("If-None-Match") == `"v1"` {
+			w.WriteHeader(http.StatusNotModified)
+			return
+		}
+		downloads++
+		w.Header().Set("ETag", `"v1"`)
+		fmt.Fprintln(w, "evil.test")
+	}))
+	defer server.Close()
+
+	db, err := NewDomainDB("test", NewHTTPLoader(server.URL, HTTPLoaderOptions{}))
+	require.NoError(t, err)
+	require.Equal(t, 1, downloads)
+
+	// The second request gets a 304, the DB should be returned unchanged
+	reloaded, err := db.Reload()
+	require.NoError(t, err)
+	require.Equal(t, 2, requests)
+	require.Equal(t, 1, downloads)
+	require.Same(t, db, reloaded)
+
+	_, _, _, ok := reloaded.Match(dns.Question{Name: "evil.test.", Qtype: dns.TypeA, Qclass: dns.ClassINET})
+	require.True(t, ok)
+}
+
+func TestHTTPLoaderLastModified(t *testing.T) {
+	modified := time.Date(2024, 5, 1, 12, 0, 0, 0, time.UTC)
+	var downloads int
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if since, err := http.ParseTime(r.Header.Get("If-Modified-Since")); err == nil && !modified.After(since) {
+			w.WriteHeader(http.StatusNotModified)
+			return
+		}
+		downloads++
+		w.Header().Set("Last-Modified", modified.Format(http.TimeFormat))
+		fmt.Fprintln(w, "evil.test")
+	}))
+	defer server.Close()
+
+	loader := NewHTTPLoader(server.URL, HTTPLoaderOptions{})
+	rules, err := loader.Load()
+	require.NoError(t, err)
+	require.Equal(t, []string{"evil.test"}, rules)
+
+	_, err = loader.Load()
+	require.ErrorIs(t, err, ErrNotModified)
+	require.Equal(t, 1, downloads)
+
+	// Once the list changes on the server, it's downloaded again
+	modified = modified.Add(time.Hour)
+	rules, err = loader.Load()
+	require.NoError(t, err)
+	require.Equal(t, []string{"evil.test"}, rules)
+	require.Equal(t, 2, downloads)
+}
+
+func TestHTTPLoaderNotModifiedAllowFailure(t *testing.T) {
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.Header.Get("If-None-Match") != "" {
+			w.WriteHeader(http.StatusNotModified)
+			return
+		}
+		w.Header().Set("ETag", `"v1"`)
+		fmt.Fprintln(w, "evil.test")
+	}))
+	defer server.Close()
+
+	// A 304 isn't a failure and shouldn't be replaced with the previous rules
+	db, err := NewDomainDB("test", NewHTTPLoader(server.URL, HTTPLoaderOptions{AllowFailure: true}))
+	require.NoError(t, err)
+	reloaded, err := db.Reload()
+	require.NoError(t, err)
+	require.Same(t, db, reloaded)
+}
+
+func TestHTTPLoaderGzip(t *testing.T) {
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		zw := gzip.NewWriter(w)
+		fmt.Fprintln(zw, "evil.test")
+		fmt.Fprintln(zw, "bad.test")
+		zw.Close()
+	}))
+	defer server.Close()
+
+	rules, err := NewHTTPLoader(server.URL+"/list.gz", HTTPLoaderOptions{}).Load()
+	require.NoError(t, err)
+	require.Equal(t, []string{"evil.test", "bad.test"}, rules)
+}
+
+func TestHTTPLoaderCachedValidators(t *testing.T) {
+	var downloads int
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.Header.Get("If-None-Match") == `"v1"` {
+			w.WriteHeader(http.StatusNotModified)
+			return
+		}
+		downloads++
+		w.Header().Set("ETag", `"v1"`)
+		fmt.Fprintln(w, "evil.test")
+	}))
+	defer server.Close()
+	opt := HTTPLoaderOptions{CacheDir: t.TempDir()}
+
+	// Nothing in the cache yet, load the list from the server
+	rules, err := NewHTTPLoader(server.URL, opt).Load()
+	require.NoError(t, err)
+	require.Equal(t, []string{"evil.test"}, rules)
+	require.Equal(t, 1, downloads)
+
+	// A new loader reads the list from the cache first, then only makes a
+	// conditional request on refresh
+	l := NewHTTPLoader(server.URL, opt)
+	rules, err = l.Load()
+	require.NoError(t, err)
+	require.Equal(t, []string{"evil.test"}, rules)
+	_, err = l.Load()
+	require.ErrorIs(t, err, ErrNotModified)
+	require.Equal(t, 1, downloads)
+}
+
+// Validators aren't kept if the list can't be written
+func TestHTTPLoaderValidatorsWithoutList(t *testing.T) {
+	l := NewHTTPLoader("https://example.com/list", HTTPLoaderOptions{CacheDir: t.TempDir()})
+	l.etag = `"v1"`
+	require.NoError(t, l.writeToDisk([]string{"evil.test"}))
+	_, err := os.Stat(l.cacheFilename() + ".meta")
+	require.NoError(t, err)
+
+	// Replace the list with a directory so it can't be overwritten
+	require.NoError(t, os.Remove(l.cacheFilename()))
+	require.NoError(t, os.MkdirAll(filepath.Join(l.cacheFilename(), "dir"), 0o755))
+	l.etag = `"v2"`
+	require.Error(t, l.writeToDisk([]string{"bad.test"}))
+	_, err = os.Stat(l.cacheFilename() + ".meta")
+	require.ErrorIs(t, err, os.ErrNotExist)
+}
@@ -1,7 +1,6 @@
 package rdns
 
 import (
-	"bufio"
 	"os"
 )
 
@@ -10,7 +9,7 @@ import (
 type FileLoader struct {
 	filename    string
 	opt         FileLoaderOptions
-	lastSuccess []string
+	lastSuccess []string // Only kept with AllowFailure
 }
 
 // FileLoaderOptions holds options for file blocklist loaders.
@@ -36,7 +35,7 @@ func (l *FileLoader) Load() (rules []string, err error) {
 			log.WithError(err).Warn("failed to load blocklist, continuing with previous ruleset")
 			rules = l.lastSuccess
 			err = nil
-		} else {
+		} else if l.opt.AllowFailure {
 			l.lastSuccess = rules
 		}
 	}()
@@ -46,10 +45,7 @@ func (l *FileLoader) Load() (rules []string, err error) {
 		return nil, err
 	}
 	defer f.Close()
-	scanner := bufio.NewScanner(f)
-	for scanner.Scan() {
-		rules = append(rules, scanner.Text())
-	}
+	rules, err = readRules(f)
 	log.Trace("completed loading blocklist")
-	return rules, scanner.Err()
+	return rules, err
 }
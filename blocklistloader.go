@@ -1,6 +1,42 @@
 package rdns
 
+import (
+	"bufio"
+	"bytes"
+	"compress/gzip"
+	"errors"
+	"io"
+)
+
 type BlocklistLoader interface {
 	// Returns a list of rules that can then be stored into a blocklist DB.
+	// Returns ErrNotModified if the rules haven't changed since the last load.
 	Load() ([]string, error)
 }
+
+// ErrNotModified is returned by loaders that know the rules haven't changed
+// since they were last loaded. DBs keep their current rules on reload in that
+// case instead of parsing them again.
+var ErrNotModified = errors.New("blocklist not modified")
+
+// Reads the rules from r line by line. Gzip-compressed lists are detected by
+// their header and decompressed.
+func readRules(r io.Reader) ([]string, error) {
+	br := bufio.NewReader(r)
+	if magic, err := br.Peek(2); err == nil && bytes.Equal(magic, []byte{0x1f, 0x8b}) {
+		zr, err := gzip.NewReader(br)
+		if err != nil {
+			return nil, err
+		}
+		defer zr.Close()
+		r = zr
+	} else {
+		r = br
+	}
+	var rules []string
+	scanner := bufio.NewScanner(r)
+	for scanner.Scan() {
+		rules = append(rules, scanner.Text())
+	}
+	return rules, scanner.Err()
+}
@@ -0,0 +1,66 @@
+package rdns
+
+import (
+	"hash/maphash"
+	"math"
+)
+
+// bloomFilter is a probabilistic set used to quickly rule out names that are
+// not in a list. It can return false positives, but never false negatives.
+type bloomFilter struct {
+	seed maphash.Seed
+	bits []uint64
+	m    uint64 // number of bits
+	k    uint64 // number of hash functions
+}
+
+// Returns a bloom filter sized for n items with the given target false-positive
+// rate.
+func newBloomFilter(n int, p float64) *bloomFilter {
+	if n < 1 {
+		n = 1
+	}
+	if p <= 0 || p >= 1 {
+		p = 0.01
+	}
+	m := uint64(math.Ceil(-float64(n) * math.Log(p) / (math.Ln2 * math.Ln2)))
+	if m < 64 {
+		m = 64
+	}
+	k := uint64(math.Round(float64(m) / float64(n) * math.Ln2))
+	if k < 1 {
+		k = 1
+	}
+	return &bloomFilter{
+		seed: maphash.MakeSeed(),
+		bits: make([]uint64, (m+63)/64),
+		m:    m,
+		k:    k,
+	}
+}
+
+func (f *bloomFilter) add(s string) {
+	h1, h2 := f.hash(s)
+	for i := uint64(0); i < f.k; i++ {
+		bit := (h1 + i*h2) % f.m
+		f.bits[bit/64] |= 1 << (bit % 64)
+	}
+}
+
+// Returns false if s is definitely not in the set.
+func (f *bloomFilter) mayContain(s string) bool {
+	h1, h2 := f.hash(s)
+	for i := uint64(0); i < f.k; i++ {
+		bit := (h1 + i*h2) % f.m
+		if f.bits[bit/64]&(1<<(bit%64)) == 0 {
+			return false
+		}
+	}
+	return true
+}
+
+// Derive two hashes from one for double hashing.
+func (f *bloomFilter) hash(s string) (uint64, uint64) {
+	h := maphash.String(f.seed, s)
+	return h & 0xffffffff, h>>32 | 1
+}
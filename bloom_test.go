@@ -0,0 +1,30 @@
+package rdns
+
+import (
+	"fmt"
+	"testing"
+
+	"github.com/stretchr/testify/require"
+)
+
+func TestBloomFilter(t *testing.T) {
+	const n = 10000
+	f := newBloomFilter(n, 0.01)
+	for i := 0; i < n; i++ {
+		f.add(fmt.Sprintf("host%d.example.com", i))
+	}
+
+	// No false negatives
+	for i := 0; i < n; i++ {
+		require.True(t, f.mayContain(fmt.Sprintf("host%d.example.com", i)))
+	}
+
+	// False positives are close to the target rate
+	var fp int
+	for i := 0; i < n; i++ {
+		if f.mayContain(fmt.Sprintf("other%d.example.com", i)) {
+			fp++
+		}
+	}
+	require.Less(t, fp, n*3/100)
+}
@@ -0,0 +1,337 @@
+package rdns
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net"
+	"sort"
+	"sync"
+	"time"
+
+	"github.com/miekg/dns"
+	"github.com/sirupsen/logrus"
+)
+
+// Bootstrapper resolves the hostnames of upstream servers through a list of
+// bootstrap resolvers. Addresses are cached for the TTL of the records and
+// refreshed while there are open connections to the name. Connections to
+// addresses that are no longer returned are closed so that they're re-dialed
+// to the new address.
+type Bootstrapper struct {
+	resolvers []Resolver
+
+	mu    sync.Mutex
+	names map[string]*bootstrapName
+}
+
+// Cached addresses of a name along with the connections using them.
+type bootstrapName struct {
+	ips     []net.IP
+	expires time.Time
+	conns   map[*bootstrapConn]struct{}
+	timer   *time.Timer
+}
+
+// Limits for the time addresses are cached, regardless of the record TTL.
+const (
+	bootstrapMinTTL = time.Minute
+	bootstrapMaxTTL = time.Hour
+)
+
+// Timeout for looking up a name with one bootstrap resolver.
+const bootstrapQueryTimeout = 5 * time.Second
+
+// NewBootstrapper returns a bootstrapper that sends queries to the resolvers
+// in order, moving on to the next if a resolver fails.
+func NewBootstrapper(resolvers ...Resolver) *Bootstrapper {
+	return &Bootstrapper{
+		resolvers: resolvers,
+		names:     make(map[string]*bootstrapName),
+	}
+}
+
+// LookupIP returns the addresses of a name, from cache if they haven't
+// expired yet. If all bootstrap resolvers fail, expired addresses are
+// returned if available.
+func (b *Bootstrapper) LookupIP(name string) ([]net.IP, error) {
+	name = dns.CanonicalName(name)
+	b.mu.Lock()
+	entry, ok := b.names[name]
+	if ok && time.Now().Before(entry.expires) {
+		ips := entry.ips
+		b.mu.Unlock()
+		return ips, nil
+	}
+	b.mu.Unlock()
+
+	ips, ttl, err := b.resolve(name)
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	entry = b.entry(name)
+	if err != nil {
+		if len(entry.ips) > 0 {
+			Log.WithError(err).WithField("name", name).Warn("failed to bootstrap name, using expired addresses")
+			return entry.ips, nil
+		}
+		return nil, err
+	}
+	b.update(name, entry, ips, ttl)
+	return ips, nil
+}
+
+// Dialer returns a dialer that resolves hostnames with the bootstrapper. IP
+// addresses are dialed directly.
+func (b *Bootstrapper) Dialer(localAddr net.IP, timeout time.Duration) Dialer {
+	return &bootstrapDialer{b: b, localAddr: localAddr, timeout: timeout}
+}
+
+// Query the bootstrap resolvers in order for A and AAAA records of the name.
+// Returns the addresses along with the lowest TTL.
+func (b *Bootstrapper) resolve(name string) ([]net.IP, time.Duration, error) {
+	if len(b.resolvers) == 0 {
+		return nil, 0, errors.New("no bootstrap resolvers")
+	}
+	var err error
+	for _, r := range b.resolvers {
+		var (
+			ips []net.IP
+			ttl uint32
+		)
+		ips, ttl, err = bootstrapQuery(r, name)
+		if err != nil {
+			Log.WithError(err).WithFields(logrus.Fields{"name": name, "resolver": r.String()}).Debug("bootstrap query failed")
+			continue
+		}
+		d := time.Duration(ttl) * time.Second
+		if d < bootstrapMinTTL {
+			d = bootstrapMinTTL
+		}
+		if d > bootstrapMaxTTL {
+			d = bootstrapMaxTTL
+		}
+		return ips, d, nil
+	}
+	return nil, 0, fmt.Errorf("failed to bootstrap %s: %w", name, err)
+}
+
+// Returns the A and AAAA records of a name with the lowest TTL using one
+// resolver.
+func bootstrapQuery(r Resolver, name string) ([]net.IP, uint32, error) {
+	var (
+		ips []net.IP
+		ttl uint32
+	)
+	for _, qtype := range []uint16{dns.TypeA, dns.TypeAAAA} {
+		q := new(dns.Msg)
+		q.SetQuestion(name, qtype)
+		a, err := resolveWithTimeout(r, q, bootstrapQueryTimeout)
+		if err != nil {
+			return nil, 0, err
+		}
+		if a.Rcode != dns.RcodeSuccess {
+			return nil, 0, fmt.Errorf("received %s", rCode(a))
+		}
+		for _, rr := range a.Answer {
+			var ip net.IP
+			switch rr := rr.(type) {
+			case *dns.A:
+				ip = rr.A
+			case *dns.AAAA:
+				ip = rr.AAAA
+			default:
+				continue
+			}
+			if len(ips) == 0 || rr.Header().Ttl < ttl {
+				ttl = rr.Header().Ttl
+			}
+			ips = append(ips, ip)
+		}
+	}
+	if len(ips) == 0 {
+		return nil, 0, errors.New("no addresses")
+	}
+	return ips, ttl, nil
+}
+
+// Sends a query to the resolver and gives up after the timeout.
+func resolveWithTimeout(r Resolver, q *dns.Msg, timeout time.Duration) (*dns.Msg, error) {
+	ctx, cancel := context.WithTimeout(context.Background(), timeout)
+	defer cancel()
+	type result struct {
+		a   *dns.Msg
+		err error
+	}
+	ch := make(chan result, 1)
+	go func() {
+		a, err := r.Resolve(q, ClientInfo{})
+		ch <- result{a, err}
+	}()
+	select {
+	case res := <-ch:
+		if res.err == nil && res.a == nil {
+			return nil, errors.New("no response")
+		}
+		return res.a, res.err
+	case <-ctx.Done():
+		return nil, ctx.Err()
+	}
+}
+
+// Returns the cache entry of a name, creating it if needed. Must be called
+// with the lock held.
+func (b *Bootstrapper) entry(name string) *bootstrapName {
+	entry, ok := b.names[name]
+	if !ok {
+		entry = &bootstrapName{conns: make(map[*bootstrapConn]struct{})}
+		b.names[name] = entry
+	}
+	return entry
+}
+
+// Store new addresses for a name and close connections to addresses that
+// went away. Must be called with the lock held.
+func (b *Bootstrapper) update(name string, entry *bootstrapName, ips []net.IP, ttl time.Duration) {
+	if len(entry.ips) > 0 && !sameIPs(entry.ips, ips) {
+		Log.WithFields(logrus.Fields{"name": name, "old": entry.ips, "new": ips}).Info("bootstrap addresses changed")
+		for c := range entry.conns {
+			if !containsIP(ips, c.ip) {
+				// Closing it here would deadlock, the connection removes itself
+				go c.Close()
+			}
+		}
+	}
+	entry.ips = ips
+	entry.expires = time.Now().Add(ttl)
+}
+
+// Refresh the addresses of a name when they expire, as long as there are
+// connections to it. Must be called with the lock held.
+func (b *Bootstrapper) scheduleRefresh(name string, entry *bootstrapName) {
+	if entry.timer != nil || len(entry.conns) == 0 {
+		return
+	}
+	d := time.Until(entry.expires)
+	if d < 0 {
+		d = 0
+	}
+	entry.timer = time.AfterFunc(d, func() {
+		ips, ttl, err := b.resolve(name)
+		b.mu.Lock()
+		defer b.mu.Unlock()
+		entry.timer = nil
+		if err != nil {
+			// Keep the current addresses and try again later
+			Log.WithError(err).WithField("name", name).Warn("failed to refresh bootstrap addresses")
+			entry.expires = time.Now().Add(bootstrapMinTTL)
+		} else {
+			b.update(name, entry, ips, ttl)
+		}
+		b.scheduleRefresh(name, entry)
+	})
+}
+
+// Track a connection to a name so it can be closed if the address changes.
+func (b *Bootstrapper) register(c *bootstrapConn) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	entry := b.entry(c.name)
+	entry.conns[c] = struct{}{}
+	b.scheduleRefresh(c.name, entry)
+}
+
+func (b *Bootstrapper) unregister(c *bootstrapConn) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	entry, ok := b.names[c.name]
+	if !ok {
+		return
+	}
+	delete(entry.conns, c)
+	if len(entry.conns) == 0 && entry.timer != nil {
+		entry.timer.Stop()
+		entry.timer = nil
+	}
+}
+
+type bootstrapDialer struct {
+	b         *Bootstrapper
+	localAddr net.IP
+	timeout   time.Duration
+}
+
+var _ Dialer = &bootstrapDialer{}
+
+func (d *bootstrapDialer) Dial(network, address string) (net.Conn, error) {
+	dialer := net.Dialer{Timeout: d.timeout}
+	if d.localAddr != nil {
+		switch network {
+		case "udp", "udp4", "udp6":
+			dialer.LocalAddr = &net.UDPAddr{IP: d.localAddr}
+		default:
+			dialer.LocalAddr = &net.TCPAddr{IP: d.localAddr}
+		}
+	}
+	host, port, err := net.SplitHostPort(address)
+	if err != nil {
+		return nil, err
+	}
+	if net.ParseIP(host) != nil {
+		return dialer.Dial(network, address)
+	}
+	ips, err := d.b.LookupIP(host)
+	if err != nil {
+		return nil, err
+	}
+
+	// Try the addresses in order until one works, IPv4 first
+	ips = append([]net.IP(nil), ips...)
+	sort.SliceStable(ips, func(i, j int) bool { return ips[i].To4() != nil && ips[j].To4() == nil })
+	for _, ip := range ips {
+		var conn net.Conn
+		conn, err = dialer.Dial(network, net.JoinHostPort(ip.String(), port))
+		if err != nil {
+			continue
+		}
+		c := &bootstrapConn{Conn: conn, b: d.b, name: dns.CanonicalName(host), ip: ip}
+		d.b.register(c)
+		return c, nil
+	}
+	return nil, err
+}
+
+// Connection to a bootstrapped address.
+type bootstrapConn struct {
+	net.Conn
+	b    *Bootstrapper
+	name string
+	ip   net.IP
+	once sync.Once
+}
+
+func (c *bootstrapConn) Close() error {
+	c.once.Do(func() { c.b.unregister(c) })
+	return c.Conn.Close()
+}
+
+// Returns true if both lists contain the same addresses, in any order.
+func sameIPs(a, b []net.IP) bool {
+	if len(a) != len(b) {
+		return false
+	}
+	for _, ip := range a {
+		if !containsIP(b, ip) {
+			return false
+		}
+	}
+	return true
+}
+
+func containsIP(ips []net.IP, ip net.IP) bool {
+	for _, v := range ips {
+		if v.Equal(ip) {
+			return true
+		}
+	}
+	return false
+}
@@ -0,0 +1,101 @@
+package rdns
+
+import (
+	"errors"
+	"net"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/miekg/dns"
+	"github.com/stretchr/testify/require"
+)
+
+// Resolver answering A queries with the address in ip.
+func newBootstrapTestResolver(ip *atomic.Value, hits *atomic.Int32) *TestResolver {
+	return &TestResolver{
+		ResolveFunc: func(q *dns.Msg, ci ClientInfo) (*dns.Msg, error) {
+			hits.Add(1)
+			a := new(dns.Msg)
+			a.SetReply(q)
+			if q.Question[0].Qtype == dns.TypeA {
+				a.Answer = append(a.Answer, &dns.A{
+					Hdr: dns.RR_Header{Name: q.Question[0].Name, Rrtype: dns.TypeA, Class: dns.ClassINET, Ttl: 300},
+					A:   net.ParseIP(ip.Load().(string)),
+				})
+			}
+			return a, nil
+		},
+	}
+}
+
+func TestBootstrapperLookup(t *testing.T) {
+	var ip atomic.Value
+	ip.Store("192.0.2.1")
+	var hits atomic.Int32
+	failing := &TestResolver{
+		ResolveFunc: func(q *dns.Msg, ci ClientInfo) (*dns.Msg, error) {
+			return nil, errors.New("failed")
+		},
+	}
+	b := NewBootstrapper(failing, newBootstrapTestResolver(&ip, &hits))
+
+	// The first resolver fails, the second one is used
+	ips, err := b.LookupIP("dns.example.com")
+	require.NoError(t, err)
+	require.Equal(t, "192.0.2.1", ips[0].String())
+	require.Equal(t, int32(2), hits.Load()) // A and AAAA
+
+	// Cached for the TTL
+	_, err = b.LookupIP("dns.example.com.")
+	require.NoError(t, err)
+	require.Equal(t, int32(2), hits.Load())
+
+	// Looked up again once expired
+	ip.Store("192.0.2.2")
+	b.names["dns.example.com."].expires = time.Now()
+	ips, err = b.LookupIP("dns.example.com")
+	require.NoError(t, err)
+	require.Equal(t, "192.0.2.2", ips[0].String())
+	require.Equal(t, int32(4), hits.Load())
+}
+
+func TestBootstrapperRedial(t *testing.T) {
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	require.NoError(t, err)
+	defer ln.Close()
+	go func() {
+		for {
+			conn, err := ln.Accept()
+			if err != nil {
+				return
+			}
+			go func() {
+				defer conn.Close()
+				_, _ = conn.Read(make([]byte, 1))
+			}()
+		}
+	}()
+	_, port, _ := net.SplitHostPort(ln.Addr().String())
+
+	var ip atomic.Value
+	ip.Store("127.0.0.1")
+	var hits atomic.Int32
+	b := NewBootstrapper(newBootstrapTestResolver(&ip, &hits))
+	conn, err := b.Dialer(nil, time.Second).Dial("tcp", net.JoinHostPort("dns.example.com", port))
+	require.NoError(t, err)
+	defer conn.Close()
+	require.Len(t, b.names["dns.example.com."].conns, 1)
+
+	// The address changes, the connection to the old one is closed
+	b.mu.Lock()
+	b.update("dns.example.com.", b.names["dns.example.com."], []net.IP{net.ParseIP("192.0.2.1")}, time.Minute)
+	b.mu.Unlock()
+	require.Eventually(t, func() bool {
+		b.mu.Lock()
+		defer b.mu.Unlock()
+		return len(b.names["dns.example.com."].conns) == 0
+	}, time.Second, 10*time.Millisecond)
+	_, err = conn.Read(make([]byte, 1))
+	require.Error(t, err)
+}
@@ -1,7 +1,10 @@
 package rdns
 
 import (
+	"errors"
+	"io/fs"
 	"os"
+	"path/filepath"
 	"sync"
 	"time"
 
@@ -10,9 +13,10 @@ import (
 )
 
 type memoryBackend struct {
-	lru *lruCache
-	mu  sync.Mutex
-	opt MemoryBackendOptions
+	lru   *lruCache
+	mu    sync.Mutex
+	opt   MemoryBackendOptions
+	loops stopper // stops garbage collection and saving
 }
 
 type MemoryBackendOptions struct {
@@ -30,6 +34,7 @@ type MemoryBackendOptions struct {
 }
 
 var _ CacheBackend = (*memoryBackend)(nil)
+var _ cacheEvicter = (*memoryBackend)(nil)
 
 func NewMemoryBackend(opt MemoryBackendOptions) *memoryBackend {
 	if opt.GCPeriod == 0 {
@@ -53,29 +58,31 @@ func (b *memoryBackend) Store(query *dns.Msg, item *cacheAnswer) {
 	b.mu.Unlock()
 }
 
-func (b *memoryBackend) Lookup(q *dns.Msg) (*dns.Msg, bool, bool) {
+func (b *memoryBackend) Lookup(q *dns.Msg) (*dns.Msg, bool, bool, bool) {
 	var answer *dns.Msg
 	var timestamp time.Time
 	var prefetchEligible bool
 	var expiry time.Time
+	var staleTTL uint32
 	b.mu.Lock()
 	if a := b.lru.get(q); a != nil {
 		answer = a.Msg.Copy()
 		timestamp = a.Timestamp
 		prefetchEligible = a.PrefetchEligible
 		expiry = a.Expiry
+		staleTTL = a.StaleTTL
 	}
 	b.mu.Unlock()
 
 	// Return a cache-miss if there's no answer record in the map
 	if answer == nil {
-		return nil, false, false
+		return nil, false, false, false
 	}
 
 	// Check if item has expired from the cache
 	if time.Now().After(expiry) {
 		b.Evict(q)
-		return nil, false, false
+		return nil, false, false, false
 	}
 
 	// Make a copy of the response before returning it. Some later
@@ -83,28 +90,15 @@ func (b *memoryBackend) Lookup(q *dns.Msg) (*dns.Msg, bool, bool) {
 	answer = answer.Copy()
 	answer.Id = q.Id
 
-	// Calculate the time the record spent in the cache. We need to
-	// subtract that from the TTL of each answer record.
-	age := uint32(time.Since(timestamp).Seconds())
-
-	// Go through all the answers, NS, and Extra and adjust the TTL (subtract the time
-	// it's spent in the cache). If the record is too old, evict it from the cache
-	// and return a cache-miss. OPT records have a TTL of 0 and are ignored.
-	for _, rr := range [][]dns.RR{answer.Answer, answer.Ns, answer.Extra} {
-		for _, a := range rr {
-			if _, ok := a.(*dns.OPT); ok {
-				continue
-			}
-			h := a.Header()
-			if age >= h.Ttl {
-				b.Evict(q)
-				return nil, false, false
-			}
-			h.Ttl -= age
-		}
+	// Subtract the time the record spent in the cache from the TTLs. If the record
+	// is too old and can't be served stale, evict it and return a cache-miss.
+	stale, ok := adjustCachedTTL(answer, time.Since(timestamp), staleTTL)
+	if !ok {
+		b.Evict(q)
+		return nil, false, false, false
 	}
 
-	return answer, prefetchEligible, true
+	return answer, prefetchEligible, stale, true
 }
 
 func (b *memoryBackend) Evict(queries ...*dns.Msg) {
@@ -121,14 +115,41 @@ func (b *memoryBackend) Flush() {
 	b.lru.reset()
 }
 
+func (b *memoryBackend) FlushMatch(f CacheFilter) int {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	return b.lru.deleteItemFunc(func(item *cacheItem) bool {
+		return f.match(item.Key.Question)
+	})
+}
+
+func (b *memoryBackend) Entries(f CacheFilter) []CacheEntry {
+	now := time.Now()
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	var entries []CacheEntry
+	b.lru.each(func(item *cacheItem) {
+		if f.match(item.Key.Question) {
+			entries = append(entries, newCacheEntry(item.Key, item.Answer, now))
+		}
+	})
+	return entries
+}
+
 // Runs every period time and evicts all items from the cache that are
 // older than max, regardless of TTL. Note that the cache can hold old
 // records that are no longer valid. These will only be evicted once
 // a new query for them is made (and TTL is too old) or when they are
 // older than max.
 func (b *memoryBackend) startGC(period time.Duration) {
+	ticker := time.NewTicker(period)
+	defer ticker.Stop()
 	for {
-		time.Sleep(period)
+		select {
+		case <-b.loops.done():
+			return
+		case <-ticker.C:
+		}
 		now := time.Now()
 		var total, removed int
 		b.mu.Lock()
@@ -153,47 +174,67 @@ func (b *memoryBackend) Size() int {
 }
 
 func (b *memoryBackend) Close() error {
+	b.loops.stop()
 	if b.opt.Filename != "" {
 		return b.writeToFile(b.opt.Filename)
 	}
 	return nil
 }
 
+// Writes the cache to a temporary file which then replaces the existing one,
+// so a crash while saving doesn't leave a truncated cache file behind.
 func (b *memoryBackend) writeToFile(filename string) error {
 	b.mu.Lock()
 	defer b.mu.Unlock()
 	log := Log.WithField("filename", filename)
 	log.Info("writing cache file")
-	f, err := os.Create(filename)
+	f, err := os.CreateTemp(filepath.Dir(filename), filepath.Base(filename)+".tmp*")
 	if err != nil {
 		log.WithError(err).Warn("failed to create cache file")
 		return err
 	}
-	defer f.Close()
+	defer os.Remove(f.Name())
 
 	if err := b.lru.serialize(f); err != nil {
+		f.Close()
+		log.WithError(err).Warn("failed to persist cache to disk")
+		return err
+	}
+	if err := f.Close(); err != nil {
 		log.WithError(err).Warn("failed to persist cache to disk")
 		return err
 	}
+	if err := os.Rename(f.Name(), filename); err != nil {
+		log.WithError(err).Warn("failed to replace cache file")
+		return err
+	}
 	return nil
 }
 
+// Loads the cache from file. Entries keep the time they were cached at, so the
+// TTLs of responses served after a restart reflect the time spent in the file.
 func (b *memoryBackend) loadFromFile(filename string) error {
 	b.mu.Lock()
 	defer b.mu.Unlock()
 	log := Log.WithField("filename", filename)
 	log.Info("reading cache file")
 	f, err := os.Open(filename)
+	if errors.Is(err, fs.ErrNotExist) {
+		log.Info("no cache file found, starting with empty cache")
+		return nil
+	}
 	if err != nil {
 		log.WithError(err).Warn("failed to open cache file")
 		return err
 	}
 	defer f.Close()
 
-	if err := b.lru.deserialize(f); err != nil {
+	n, err := b.lru.deserialize(f)
+	if err != nil {
 		log.WithError(err).Warn("failed to read cache from disk")
 		return err
 	}
+	log.WithField("items", n).Info("loaded cache from file")
 	return nil
 }
 
@@ -201,8 +242,14 @@ func (b *memoryBackend) intervalSave() {
 	if b.opt.Filename == "" || b.opt.SaveInterval == 0 {
 		return
 	}
+	ticker := time.NewTicker(b.opt.SaveInterval)
+	defer ticker.Stop()
 	for {
-		time.Sleep(b.opt.SaveInterval)
+		select {
+		case <-b.loops.done():
+			return
+		case <-ticker.C:
+		}
 		b.writeToFile(b.opt.Filename)
 	}
 }
@@ -12,6 +12,10 @@ import (
 	"github.com/redis/go-redis/v9"
 )
 
+// Time to iterate over all keys in redis when flushing or listing specific
+// responses.
+const redisScanTimeout = 10 * time.Second
+
 type redisBackend struct {
 	client *redis.Client
 	opt    RedisBackendOptions
@@ -23,6 +27,7 @@ type RedisBackendOptions struct {
 }
 
 var _ CacheBackend = (*redisBackend)(nil)
+var _ cacheEvicter = (*redisBackend)(nil)
 
 func NewRedisBackend(opt RedisBackendOptions) *redisBackend {
 	b := &redisBackend{
@@ -46,49 +51,51 @@ func (b *redisBackend) Store(query *dns.Msg, item *cacheAnswer) {
 	}
 }
 
-func (b *redisBackend) Lookup(q *dns.Msg) (*dns.Msg, bool, bool) {
+func (b *redisBackend) Lookup(q *dns.Msg) (*dns.Msg, bool, bool, bool) {
 	ctx, cancel := context.WithTimeout(context.Background(), 100*time.Millisecond)
 	defer cancel()
 	key := b.keyFromQuery(q)
 	value, err := b.client.Get(ctx, key).Result()
 	if err != nil {
 		if errors.Is(err, redis.Nil) { // Return a cache-miss if there's no such key
-			return nil, false, false
+			return nil, false, false, false
 		}
 		Log.WithError(err).Error("failed to read from redis")
-		return nil, false, false
+		return nil, false, false, false
 	}
 	var a *cacheAnswer
 	if err := json.Unmarshal([]byte(value), &a); err != nil {
 		Log.WithError(err).Error("failed to unmarshal cache record from redis")
-		return nil, false, false
+		return nil, false, false, false
 	}
 
 	answer := a.Msg
 	prefetchEligible := a.PrefetchEligible
 	answer.Id = q.Id
 
-	// Calculate the time the record spent in the cache. We need to
-	// subtract that from the TTL of each answer record.
-	age := uint32(time.Since(a.Timestamp).Seconds())
-
-	// Go through all the answers, NS, and Extra and adjust the TTL (subtract the time
-	// it's spent in the cache). If the record is too old, evict it from the cache
-	// and return a cache-miss. OPT records have a TTL of 0 and are ignored.
-	for _, rr := range [][]dns.RR{answer.Answer, answer.Ns, answer.Extra} {
-		for _, a := range rr {
-			if _, ok := a.(*dns.OPT); ok {
-				continue
-			}
-			h := a.Header()
-			if age >= h.Ttl {
-				return nil, false, false
-			}
-			h.Ttl -= age
-		}
+	// Subtract the time the record spent in the cache from the TTLs. If the record
+	// is too old and can't be served stale, return a cache-miss.
+	stale, ok := adjustCachedTTL(answer, time.Since(a.Timestamp), a.StaleTTL)
+	if !ok {
+		return nil, false, false, false
 	}
 
-	return answer, prefetchEligible, true
+	return answer, prefetchEligible, stale, true
+}
+
+func (b *redisBackend) Evict(queries ...*dns.Msg) {
+	if len(queries) == 0 {
+		return
+	}
+	ctx, cancel := context.WithTimeout(context.Background(), 100*time.Millisecond)
+	defer cancel()
+	keys := make([]string, 0, len(queries))
+	for _, q := range queries {
+		keys = append(keys, b.keyFromQuery(q))
+	}
+	if err := b.client.Del(ctx, keys...).Err(); err != nil {
+		Log.WithError(err).Error("failed to delete keys in redis")
+	}
 }
 
 func (b *redisBackend) Flush() {
@@ -99,6 +106,61 @@ func (b *redisBackend) Flush() {
 	}
 }
 
+func (b *redisBackend) FlushMatch(f CacheFilter) int {
+	ctx, cancel := context.WithTimeout(context.Background(), redisScanTimeout)
+	defer cancel()
+	var keys []string
+	b.scan(ctx, func(key string, a *cacheAnswer) {
+		if f.match(a.Msg.Question[0]) {
+			keys = append(keys, key)
+		}
+	})
+	if len(keys) == 0 {
+		return 0
+	}
+	n, err := b.client.Del(ctx, keys...).Result()
+	if err != nil {
+		Log.WithError(err).Error("failed to delete keys in redis")
+	}
+	return int(n)
+}
+
+func (b *redisBackend) Entries(f CacheFilter) []CacheEntry {
+	ctx, cancel := context.WithTimeout(context.Background(), redisScanTimeout)
+	defer cancel()
+	now := time.Now()
+	var entries []CacheEntry
+	b.scan(ctx, func(key string, a *cacheAnswer) {
+		if f.match(a.Msg.Question[0]) {
+			// The response carries the same question and EDNS0 options as
+			// the query it was cached for
+			entries = append(entries, newCacheEntry(lruKeyFromQuery(a.Msg), a, now))
+		}
+	})
+	return entries
+}
+
+// Calls the function for every cached response with the key prefix. Records
+// that can't be read are skipped.
+func (b *redisBackend) scan(ctx context.Context, f func(key string, a *cacheAnswer)) {
+	iter := b.client.Scan(ctx, 0, b.opt.KeyPrefix+"*", 0).Iterator()
+	for iter.Next(ctx) {
+		key := iter.Val()
+		value, err := b.client.Get(ctx, key).Result()
+		if err != nil {
+			continue
+		}
+		var a *cacheAnswer
+		if err := json.Unmarshal([]byte(value), &a); err != nil || a == nil || len(a.Msg.Question) == 0 {
+			continue
+		}
+		f(key, a)
+	}
+	if err := iter.Err(); err != nil {
+		Log.WithError(err).Error("failed to scan keys in redis")
+	}
+}
+
 func (b *redisBackend) Size() int {
 	ctx, cancel := context.WithTimeout(context.Background(), 100*time.Millisecond)
 	defer cancel()
@@ -21,6 +21,26 @@ type Cache struct {
 	resolver Resolver
 	metrics  *CacheMetrics
 	backend  CacheBackend
+
+	// Queries with NXDOMAIN responses in the cache, by name. Used to invalidate
+	// them when another type under the same name has a positive answer.
+	mu        sync.Mutex
+	nxdomains map[string]map[lruKey]nxdomainEntry
+
+	// Keys of stale records that are currently being refreshed
+	refreshing sync.Map
+
+	// Set if the backend was created by the cache and is closed with it
+	ownBackend bool
+
+	// Stops the metrics loop
+	loops stopper
+}
+
+// nxdomainEntry is a cached NXDOMAIN response that may need to be invalidated.
+type nxdomainEntry struct {
+	query  *dns.Msg
+	expiry time.Time
 }
 
 type CacheMetrics struct {
@@ -30,6 +50,12 @@ type CacheMetrics struct {
 	miss *expvar.Int
 	// Current cache entry count.
 	entries *expvar.Int
+	// Cache hits with a negative (NXDOMAIN or NODATA) response.
+	negativeHit *expvar.Int
+	// Cache misses that resulted in a negative response from upstream.
+	negativeMiss *expvar.Int
+	// Cache hits served with an expired record.
+	staleHit *expvar.Int
 }
 
 var _ Resolver = &Cache{}
@@ -49,6 +75,23 @@ type CacheOptions struct {
 	// TTL to use for negative responses that do not have an SOA record, default 60
 	NegativeTTL uint32
 
+	// Cache negative (NXDOMAIN and NODATA) responses for the time given by the SOA
+	// record in the authority section, as per RFC2308. A cached NXDOMAIN is removed
+	// when another type under the same name returns an answer.
+	NegativeCacheEnabled bool
+
+	// Upper limit for how long negative responses are kept in the cache if
+	// NegativeCacheEnabled is set. No limit if 0.
+	NegativeCacheTTL time.Duration
+
+	// Lower limit for how long negative responses are kept in the cache if
+	// NegativeCacheEnabled is set, even if the SOA has a lower TTL.
+	NegativeCacheMinTTL time.Duration
+
+	// Time SERVFAIL responses are cached for, capped at 5 minutes as per
+	// RFC2308. Uses NegativeTTL if 0.
+	ServfailTTL time.Duration
+
 	// Define upper limits on cache TTLs based on RCODE, regardless of SOA. For example this
 	// allows settings a limit on how long NXDOMAIN (code 3) responses can be kept in the cache.
 	CacheRcodeMaxTTL map[int]uint32
@@ -74,6 +117,15 @@ type CacheOptions struct {
 	// Only records with at least PrefetchEligible seconds TTL are eligible to be prefetched.
 	PrefetchEligible uint32
 
+	// Keep records in the cache for up to ServeStale after they expired and serve
+	// them stale while they are refreshed in the background, as per RFC8767. If
+	// the refresh fails, for example because upstream is unavailable, the stale
+	// record continues to be served. Disabled if 0.
+	ServeStale time.Duration
+
+	// TTL of stale records in responses. Defaults to 30 seconds.
+	StaleAnswerTTL uint32
+
 	// Cache backend used to store records.
 	Backend CacheBackend
 }
@@ -81,8 +133,9 @@ type CacheOptions struct {
 type CacheBackend interface {
 	Store(query *dns.Msg, item *cacheAnswer)
 
-	// Lookup a cached response
-	Lookup(q *dns.Msg) (answer *dns.Msg, prefetchEligible bool, ok bool)
+	// Lookup a cached response. If stale is true, the response has expired and
+	// is served with the stale TTL of the item.
+	Lookup(q *dns.Msg) (answer *dns.Msg, prefetchEligible bool, stale bool, ok bool)
 
 	// Return the number of items in the cache
 	Size() int
@@ -90,9 +143,89 @@ type CacheBackend interface {
 	// Flush all records in the store
 	Flush()
 
+	// Remove cached responses for queries matching the filter and return the
+	// number of removed responses
+	FlushMatch(f CacheFilter) int
+
+	// Return the cached responses for queries matching the filter
+	Entries(f CacheFilter) []CacheEntry
+
 	Close() error
 }
 
+// cacheEvicter is implemented by cache backends that can remove the responses
+// for individual queries. Other backends remove all responses for the name and
+// type of the query instead.
+type cacheEvicter interface {
+	Evict(queries ...*dns.Msg)
+}
+
+// CacheFilter selects cached responses by query name and type. The zero value
+// matches all responses.
+type CacheFilter struct {
+	// Query name, all names if empty
+	Name string
+
+	// Also match names under Name, for example www.example.com. for
+	// example.com.
+	Suffix bool
+
+	// Query type, all types if 0
+	Type uint16
+}
+
+func (f CacheFilter) match(q dns.Question) bool {
+	if f.Type != 0 && f.Type != q.Qtype {
+		return false
+	}
+	if f.Name == "" {
+		return true
+	}
+	name := strings.ToLower(dns.Fqdn(f.Name))
+	qName := strings.ToLower(q.Name)
+	if qName == name {
+		return true
+	}
+	return f.Suffix && (name == "." || strings.HasSuffix(qName, "."+name))
+}
+
+// CacheEntry describes a cached response.
+type CacheEntry struct {
+	Name     string    `json:"name"`
+	Type     string    `json:"type"`
+	Class    string    `json:"class"`
+	DO       bool      `json:"do,omitempty"`  // Cached for queries with the DNSSEC OK bit
+	ECS      string    `json:"ecs,omitempty"` // Client subnet of the query
+	Rcode    string    `json:"rcode"`
+	Answers  int       `json:"answers"`
+	TTL      uint32    `json:"ttl"`             // Seconds until the records expire, 0 when stale
+	Stale    bool      `json:"stale,omitempty"` // The records have expired and are only served stale
+	Cached   time.Time `json:"cached"`
+	Expiry   time.Time `json:"expiry"`             // Time the response is removed from the cache
+	Resolver string    `json:"resolver,omitempty"` // Upstream resolver of the cache
+}
+
+func newCacheEntry(key lruKey, a *cacheAnswer, now time.Time) CacheEntry {
+	e := CacheEntry{
+		Name:    key.Question.Name,
+		Type:    dns.Type(key.Question.Qtype).String(),
+		Class:   dns.Class(key.Question.Qclass).String(),
+		DO:      key.Do,
+		ECS:     key.Net,
+		Rcode:   dns.RcodeToString[a.Msg.Rcode],
+		Answers: len(a.Msg.Answer),
+		Cached:  a.Timestamp,
+		Expiry:  a.Expiry,
+	}
+	age := uint32(now.Sub(a.Timestamp).Seconds())
+	if ttl, ok := minTTL(a.Msg); ok && ttl > age {
+		e.TTL = ttl - age
+	} else {
+		e.Stale = true
+	}
+	return e
+}
+
 // NewCache returns a new instance of a Cache resolver.
 func NewCache(id string, resolver Resolver, opt CacheOptions) *Cache {
 	c := &Cache{
@@ -100,34 +233,60 @@ func NewCache(id string, resolver Resolver, opt CacheOptions) *Cache {
 		id:           id,
 		resolver:     resolver,
 		metrics: &CacheMetrics{
-			hit:     getVarInt("cache", id, "hit"),
-			miss:    getVarInt("cache", id, "miss"),
-			entries: getVarInt("cache", id, "entries"),
+			hit:          getVarInt("cache", id, "hit"),
+			miss:         getVarInt("cache", id, "miss"),
+			entries:      getVarInt("cache", id, "entries"),
+			negativeHit:  getVarInt("cache", id, "negative_hits"),
+			negativeMiss: getVarInt("cache", id, "negative_misses"),
+			staleHit:     getVarInt("cache", id, "stale_hits"),
 		},
+		nxdomains: make(map[string]map[lruKey]nxdomainEntry),
 	}
 	if c.NegativeTTL == 0 {
 		c.NegativeTTL = 60
 	}
+	if c.StaleAnswerTTL == 0 {
+		c.StaleAnswerTTL = 30
+	}
 	if opt.Backend == nil {
 		opt.Backend = NewMemoryBackend(MemoryBackendOptions{
 			Capacity: opt.Capacity,
 			GCPeriod: opt.GCPeriod,
 		})
+		c.ownBackend = true
 	}
 	c.backend = opt.Backend
 
 	// Regularly query the cache size and emit metrics
 	go func() {
+		ticker := time.NewTicker(time.Minute)
+		defer ticker.Stop()
 		for {
-			time.Sleep(time.Minute)
+			select {
+			case <-c.loops.done():
+				return
+			case <-ticker.C:
+			}
 			total := c.backend.Size()
 			c.metrics.entries.Set(int64(total))
+			c.pruneNXDOMAINs()
 		}
 	}()
 
 	return c
 }
 
+// Close stops the background job that updates the metrics. The backend is
+// closed as well if it was created by the cache, backends passed in the
+// options are left to the caller.
+func (r *Cache) Close() error {
+	r.loops.stop()
+	if r.ownBackend {
+		return r.backend.Close()
+	}
+	return nil
+}
+
 // Resolve a DNS query by first checking an internal cache for existing
 // results
 func (r *Cache) Resolve(q *dns.Msg, ci ClientInfo) (*dns.Msg, error) {
@@ -152,21 +311,38 @@ func (r *Cache) Resolve(q *dns.Msg, ci ClientInfo) (*dns.Msg, error) {
 	}
 
 	// Returned an answer from the cache if one exists
-	a, prefetchEligible, ok := r.answerFromCache(q)
+	a, prefetchEligible, stale, ok := r.answerFromCache(q)
 	if ok {
-		log.Debug("cache-hit")
+		log.WithField("stale", stale).Debug("cache-hit")
 		r.metrics.hit.Add(1)
+		if isNegative(a) {
+			r.metrics.negativeHit.Add(1)
+		}
+
+		// Serve expired records right away and refresh them in the background
+		if stale {
+			r.metrics.staleHit.Add(1)
+			r.refreshStale(q, ci)
+			if a.Rcode == dns.RcodeNameError {
+				addEDE(a, q, dns.ExtendedErrorCodeStaleNXDOMAINAnswer, "")
+			} else {
+				addEDE(a, q, dns.ExtendedErrorCodeStaleAnswer, "")
+			}
+			return a, nil
+		}
 
 		// If prefetch is enabled and the TTL has fallen below the trigger time, send
 		// a concurrent query upstream (to refresh the cached record)
 		if prefetchEligible && r.CacheOptions.PrefetchTrigger > 0 {
 			if min, ok := minTTL(a); ok && min < r.CacheOptions.PrefetchTrigger {
 				prefetchQ := q.Copy()
+				prefetchCI := ci
+				prefetchCI.Done = nil // the prefetch outlives the client query
 				go func() {
 					log.Debug("prefetching record")
 
 					// Send the same query upstream
-					prefetchA, err := r.resolver.Resolve(prefetchQ, ci)
+					prefetchA, err := r.resolver.Resolve(prefetchQ, prefetchCI)
 					if err != nil || prefetchA == nil {
 						return
 					}
@@ -205,6 +381,9 @@ func (r *Cache) Resolve(q *dns.Msg, ci ClientInfo) (*dns.Msg, error) {
 	if a.Truncated {
 		return a, nil
 	}
+	if isNegative(a) {
+		r.metrics.negativeMiss.Add(1)
+	}
 
 	// Put the upstream response into the cache and return it. Need to store
 	// a copy since other elements might modify the response, like the replacer.
@@ -216,14 +395,68 @@ func (r *Cache) String() string {
 	return r.id
 }
 
+// Flush removes all responses from the cache.
+func (r *Cache) Flush() {
+	r.backend.Flush()
+}
+
+// FlushMatch removes the responses for queries matching the filter, for example
+// all responses for names under a domain after records were changed. Returns
+// the number of removed responses.
+func (r *Cache) FlushMatch(f CacheFilter) int {
+	return r.backend.FlushMatch(f)
+}
+
+// Entries returns the cached responses for queries matching the filter.
+func (r *Cache) Entries(f CacheFilter) []CacheEntry {
+	entries := r.backend.Entries(f)
+	for i := range entries {
+		entries[i].Resolver = r.resolver.String()
+	}
+	return entries
+}
+
+// Size returns the number of responses in the cache.
+func (r *Cache) Size() int {
+	return r.backend.Size()
+}
+
+// Sends a query for a stale record upstream and updates the cache with the
+// response. Only one refresh per record is sent at a time. Errors and SERVFAIL
+// responses are not cached so the stale record is served until it's removed.
+func (r *Cache) refreshStale(q *dns.Msg, ci ClientInfo) {
+	key := lruKeyFromQuery(q)
+	if _, loaded := r.refreshing.LoadOrStore(key, struct{}{}); loaded {
+		return
+	}
+	refreshQ := q.Copy()
+	ci.Done = nil // the refresh outlives the client query
+	go func() {
+		defer r.refreshing.Delete(key)
+		log := logger(r.id, refreshQ, ci)
+		log.Debug("refreshing stale record")
+
+		a, err := r.resolver.Resolve(refreshQ, ci)
+		if err != nil || a == nil {
+			log.WithError(err).Debug("failed to refresh stale record")
+			return
+		}
+		if a.Truncated || a.Rcode == dns.RcodeServerFailure {
+			return
+		}
+		r.storeInCache(refreshQ, a)
+	}()
+}
+
 // Returns an answer from the cache with it's TTL updated or false in case of a cache-miss.
-func (r *Cache) answerFromCache(q *dns.Msg) (*dns.Msg, bool, bool) {
-	a, prefetchEligible, ok := r.backend.Lookup(q)
+// The answer may be stale if ServeStale is enabled.
+func (r *Cache) answerFromCache(q *dns.Msg) (*dns.Msg, bool, bool, bool) {
+	a, prefetchEligible, stale, ok := r.backend.Lookup(q)
 	if ok {
 		if r.ShuffleAnswerFunc != nil {
 			r.ShuffleAnswerFunc(a)
 		}
-		return a, prefetchEligible, true
+		return a, prefetchEligible, stale, true
 	}
 
 	// We couldn't find it in the cache, but a parent domain may already be with NXDOMAIN.
@@ -234,21 +467,29 @@ func (r *Cache) answerFromCache(q *dns.Msg) (*dns.Msg, bool, bool) {
 		fragments := strings.Split(name, ".")
 		for i := 1; i < len(fragments)-1; i++ {
 			newQ.Question[0].Name = strings.Join(fragments[i:], ".")
-			if a, _, ok := r.backend.Lookup(newQ); ok {
+			if a, _, _, ok := r.backend.Lookup(newQ); ok {
 				if a.Rcode == dns.RcodeNameError {
-					return nxdomain(q), false, true
+					return nxdomain(q), false, false, true
 				}
 				break
 			}
 		}
 	}
 
-	return nil, false, false
+	return nil, false, false, false
 }
 
 func (r *Cache) storeInCache(query, answer *dns.Msg) {
 	now := time.Now()
 
+	if r.NegativeCacheEnabled {
+		if isNegative(answer) {
+			r.limitNegativeTTL(answer)
+		} else if answer.Rcode == dns.RcodeSuccess {
+			r.invalidateNXDOMAINs(query)
+		}
+	}
+
 	// Prepare an item for the cache, without expiry for now
 	item := &cacheAnswer{Msg: answer, Timestamp: now}
 
@@ -266,11 +507,14 @@ func (r *Cache) storeInCache(query, answer *dns.Msg) {
 		}
 	case dns.RcodeServerFailure:
 		// According to RFC2308, a SERVFAIL response must not be cached for longer than 5 minutes.
-		if r.NegativeTTL < 300 {
-			item.Expiry = now.Add(time.Duration(r.NegativeTTL) * time.Second)
-		} else {
-			item.Expiry = now.Add(300 * time.Second)
+		ttl := time.Duration(r.NegativeTTL) * time.Second
+		if r.ServfailTTL > 0 {
+			ttl = r.ServfailTTL
+		}
+		if ttl > 300*time.Second {
+			ttl = 300 * time.Second
 		}
+		item.Expiry = now.Add(ttl)
 	default:
 		return
 	}
@@ -283,8 +527,139 @@ func (r *Cache) storeInCache(query, answer *dns.Msg) {
 		}
 	}
 
+	// Keep positive and NXDOMAIN responses past their expiry to serve them stale
+	if r.ServeStale > 0 && (answer.Rcode == dns.RcodeSuccess || answer.Rcode == dns.RcodeNameError) {
+		item.Expiry = item.Expiry.Add(r.ServeStale)
+		item.StaleTTL = r.StaleAnswerTTL
+	}
+
 	// Store it in the cache
 	r.backend.Store(query, item)
+
+	if r.NegativeCacheEnabled && answer.Rcode == dns.RcodeNameError {
+		r.trackNXDOMAIN(query, item.Expiry)
+	}
+}
+
+// Subtracts the time a response spent in the cache from the TTL of its records.
+// If any record has expired, all records are set to staleTTL instead and stale
+// is true. Returns false if the response has expired and staleTTL is 0. OPT
+// records have a TTL of 0 and are ignored.
+func adjustCachedTTL(answer *dns.Msg, age time.Duration, staleTTL uint32) (stale bool, ok bool) {
+	seconds := uint32(age.Seconds())
+	for _, rr := range [][]dns.RR{answer.Answer, answer.Ns, answer.Extra} {
+		for _, a := range rr {
+			if _, ok := a.(*dns.OPT); ok {
+				continue
+			}
+			if seconds >= a.Header().Ttl {
+				stale = true
+			}
+		}
+	}
+	if stale && staleTTL == 0 {
+		return false, false
+	}
+	for _, rr := range [][]dns.RR{answer.Answer, answer.Ns, answer.Extra} {
+		for _, a := range rr {
+			if _, ok := a.(*dns.OPT); ok {
+				continue
+			}
+			h := a.Header()
+			if stale {
+				h.Ttl = staleTTL
+			} else {
+				h.Ttl -= seconds
+			}
+		}
+	}
+	return stale, true
+}
+
+// Returns true if the response is NXDOMAIN or NODATA (NOERROR without answer).
+func isNegative(a *dns.Msg) bool {
+	switch a.Rcode {
+	case dns.RcodeNameError:
+		return true
+	case dns.RcodeSuccess:
+		return len(a.Answer) == 0
+	}
+	return false
+}
+
+// Set the TTL of the SOA in a negative response to the lower of its own TTL
+// and the SOA MINIMUM field as per RFC2308, limited by NegativeCacheMinTTL and
+// NegativeCacheTTL. The SOA TTL then determines how long the response is
+// cached.
+func (r *Cache) limitNegativeTTL(answer *dns.Msg) {
+	for _, rr := range answer.Ns {
+		soa, ok := rr.(*dns.SOA)
+		if !ok {
+			continue
+		}
+		ttl := min(soa.Hdr.Ttl, soa.Minttl)
+		if r.NegativeCacheMinTTL > 0 {
+			ttl = max(ttl, uint32(r.NegativeCacheMinTTL.Seconds()))
+		}
+		if r.NegativeCacheTTL > 0 {
+			ttl = min(ttl, uint32(r.NegativeCacheTTL.Seconds()))
+		}
+		soa.Hdr.Ttl = ttl
+	}
+}
+
+// Remember a query that has NXDOMAIN in the cache so it can be invalidated later.
+func (r *Cache) trackNXDOMAIN(query *dns.Msg, expiry time.Time) {
+	name := strings.ToLower(query.Question[0].Name)
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	entries, ok := r.nxdomains[name]
+	if !ok {
+		entries = make(map[lruKey]nxdomainEntry)
+		r.nxdomains[name] = entries
+	}
+	entries[lruKeyFromQuery(query)] = nxdomainEntry{query: query.Copy(), expiry: expiry}
+}
+
+// The name in the query exists, remove any cached NXDOMAIN responses for
+// other types under this name.
+func (r *Cache) invalidateNXDOMAINs(query *dns.Msg) {
+	name := strings.ToLower(query.Question[0].Name)
+	r.mu.Lock()
+	entries, ok := r.nxdomains[name]
+	delete(r.nxdomains, name)
+	r.mu.Unlock()
+	if !ok {
+		return
+	}
+	queries := make([]*dns.Msg, 0, len(entries))
+	for _, e := range entries {
+		queries = append(queries, e.query)
+	}
+	if b, ok := r.backend.(cacheEvicter); ok {
+		b.Evict(queries...)
+		return
+	}
+	for _, q := range queries {
+		r.backend.FlushMatch(CacheFilter{Name: q.Question[0].Name, Type: q.Question[0].Qtype})
+	}
+}
+
+// Remove expired entries from the list of tracked NXDOMAIN responses.
+func (r *Cache) pruneNXDOMAINs() {
+	now := time.Now()
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	for name, entries := range r.nxdomains {
+		for key, e := range entries {
+			if now.After(e.expiry) {
+				delete(entries, key)
+			}
+		}
+		if len(entries) == 0 {
+			delete(r.nxdomains, name)
+		}
+	}
 }
 
 // Find the lowest TTL in all resource records (except OPT).
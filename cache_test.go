@@ -1,7 +1,11 @@
 package rdns
 
 import (
+	"errors"
 	"net"
+	"os"
+	"path/filepath"
+	"sync"
 	"testing"
 	"time"
 
@@ -99,6 +103,187 @@ func TestCacheNXDOMAIN(t *testing.T) {
 	require.Equal(t, 1, r.HitCount())
 }
 
+func TestCacheNegativeSOAMinimum(t *testing.T) {
+	var ci ClientInfo
+	q := new(dns.Msg)
+	r := &TestResolver{
+		ResolveFunc: func(q *dns.Msg, ci ClientInfo) (*dns.Msg, error) {
+			a := new(dns.Msg)
+			a.SetRcode(q, dns.RcodeNameError)
+			soa, _ := dns.NewRR("example.com. 3600 IN SOA ns.example.com. admin.example.com. 1 7200 3600 86400 1")
+			a.Ns = []dns.RR{soa}
+			return a, nil
+		},
+	}
+	c := NewCache("test-cache-negative-soa", r, CacheOptions{NegativeCacheEnabled: true})
+
+	// The response is cached for the SOA MINIMUM, not the SOA TTL
+	q.SetQuestion("example.com.", dns.TypeA)
+	_, err := c.Resolve(q, ci)
+	require.NoError(t, err)
+	a, err := c.Resolve(q, ci)
+	require.NoError(t, err)
+	require.Equal(t, 1, r.HitCount())
+	require.Equal(t, uint32(1), a.Ns[0].Header().Ttl)
+	require.Equal(t, int64(1), c.metrics.negativeHit.Value())
+	require.Equal(t, int64(1), c.metrics.negativeMiss.Value())
+
+	// After the SOA MINIMUM it's sent upstream again
+	time.Sleep(1100 * time.Millisecond)
+	_, err = c.Resolve(q, ci)
+	require.NoError(t, err)
+	require.Equal(t, 2, r.HitCount())
+}
+
+func TestCacheNegativeTTLLimit(t *testing.T) {
+	var ci ClientInfo
+	q := new(dns.Msg)
+	r := &TestResolver{
+		ResolveFunc: func(q *dns.Msg, ci ClientInfo) (*dns.Msg, error) {
+			a := new(dns.Msg)
+			a.SetReply(q)
+			soa, _ := dns.NewRR("example.com. 3600 IN SOA ns.example.com. admin.example.com. 1 7200 3600 86400 900")
+			a.Ns = []dns.RR{soa}
+			return a, nil
+		},
+	}
+	c := NewCache("test-cache-negative-limit", r, CacheOptions{
+		NegativeCacheEnabled: true,
+		NegativeCacheTTL:     time.Minute,
+	})
+
+	// NODATA response, cached for no longer than NegativeCacheTTL
+	q.SetQuestion("example.com.", dns.TypeAAAA)
+	_, err := c.Resolve(q, ci)
+	require.NoError(t, err)
+	a, err := c.Resolve(q, ci)
+	require.NoError(t, err)
+	require.Equal(t, 1, r.HitCount())
+	require.Equal(t, uint32(60), a.Ns[0].Header().Ttl)
+}
+
+func TestCacheNegativeMinTTL(t *testing.T) {
+	var ci ClientInfo
+	q := new(dns.Msg)
+	r := &TestResolver{
+		ResolveFunc: func(q *dns.Msg, ci ClientInfo) (*dns.Msg, error) {
+			a := new(dns.Msg)
+			a.SetRcode(q, dns.RcodeNameError)
+			soa, _ := dns.NewRR("example.com. 3600 IN SOA ns.example.com. admin.example.com. 1 7200 3600 86400 1")
+			a.Ns = []dns.RR{soa}
+			return a, nil
+		},
+	}
+	c := NewCache("test-cache-negative-min", r, CacheOptions{
+		NegativeCacheEnabled: true,
+		NegativeCacheMinTTL:  time.Minute,
+	})
+
+	// The SOA MINIMUM is raised to NegativeCacheMinTTL
+	q.SetQuestion("example.com.", dns.TypeA)
+	_, err := c.Resolve(q, ci)
+	require.NoError(t, err)
+	time.Sleep(1100 * time.Millisecond)
+	a, err := c.Resolve(q, ci)
+	require.NoError(t, err)
+	require.Equal(t, 1, r.HitCount())
+	require.Equal(t, uint32(59), a.Ns[0].Header().Ttl)
+}
+
+func TestCacheServfailTTL(t *testing.T) {
+	var ci ClientInfo
+	q := new(dns.Msg)
+	r := &TestResolver{
+		ResolveFunc: func(q *dns.Msg, ci ClientInfo) (*dns.Msg, error) {
+			a := new(dns.Msg)
+			a.SetRcode(q, dns.RcodeServerFailure)
+			return a, nil
+		},
+	}
+	c := NewCache("test-cache-servfail-ttl", r, CacheOptions{
+		NegativeTTL: 3600,
+		ServfailTTL: time.Second,
+	})
+
+	// SERVFAIL is cached for ServfailTTL instead of NegativeTTL
+	q.SetQuestion("example.com.", dns.TypeA)
+	_, err := c.Resolve(q, ci)
+	require.NoError(t, err)
+	a, err := c.Resolve(q, ci)
+	require.NoError(t, err)
+	require.Equal(t, dns.RcodeServerFailure, a.Rcode)
+	require.Equal(t, 1, r.HitCount())
+
+	time.Sleep(1100 * time.Millisecond)
+	_, err = c.Resolve(q, ci)
+	require.NoError(t, err)
+	require.Equal(t, 2, r.HitCount())
+
+	// Not cached at all with an rcode limit of 0
+	c = NewCache("test-cache-servfail-disabled", r, CacheOptions{
+		ServfailTTL:      time.Minute,
+		CacheRcodeMaxTTL: map[int]uint32{dns.RcodeServerFailure: 0},
+	})
+	_, err = c.Resolve(q, ci)
+	require.NoError(t, err)
+	_, err = c.Resolve(q, ci)
+	require.NoError(t, err)
+	require.Equal(t, 4, r.HitCount())
+}
+
+func TestCacheNegativeInvalidate(t *testing.T) {
+	t.Run("evict", func(t *testing.T) {
+		testCacheNegativeInvalidate(t, "test-cache-negative-invalidate", nil)
+	})
+
+	// Backends that can't evict individual queries
+	t.Run("flush", func(t *testing.T) {
+		backend := struct{ CacheBackend }{NewMemoryBackend(MemoryBackendOptions{})}
+		defer backend.Close()
+		testCacheNegativeInvalidate(t, "test-cache-negative-invalidate-flush", backend)
+	})
+}
+
+func testCacheNegativeInvalidate(t *testing.T, id string, backend CacheBackend) {
+	var ci ClientInfo
+	q := new(dns.Msg)
+	exists := false
+	r := &TestResolver{
+		ResolveFunc: func(q *dns.Msg, ci ClientInfo) (*dns.Msg, error) {
+			a := new(dns.Msg)
+			if !exists {
+				a.SetRcode(q, dns.RcodeNameError)
+				return a, nil
+			}
+			a.SetReply(q)
+			rr, _ := dns.NewRR(q.Question[0].Name + " 60 IN TXT test")
+			a.Answer = []dns.RR{rr}
+			return a, nil
+		},
+	}
+	c := NewCache(id, r, CacheOptions{NegativeCacheEnabled: true, Backend: backend})
+
+	// Cache an NXDOMAIN for the A record
+	q.SetQuestion("example.com.", dns.TypeA)
+	_, err := c.Resolve(q, ci)
+	require.NoError(t, err)
+	require.Equal(t, 1, r.HitCount())
+
+	// The name now exists, a query for another type returns an answer
+	exists = true
+	q.SetQuestion("example.com.", dns.TypeTXT)
+	_, err = c.Resolve(q, ci)
+	require.NoError(t, err)
+	require.Equal(t, 2, r.HitCount())
+
+	// The cached NXDOMAIN for A should be gone and the query sent upstream
+	q.SetQuestion("example.com.", dns.TypeA)
+	a, err := c.Resolve(q, ci)
+	require.NoError(t, err)
+	require.Equal(t, 3, r.HitCount())
+	require.Equal(t, dns.RcodeSuccess, a.Rcode)
+}
+
 func TestCacheHardenBelowNXDOMAIN(t *testing.T) {
 	var ci ClientInfo
 	q := new(dns.Msg)
@@ -212,3 +397,210 @@ func TestCacheNoTruncated(t *testing.T) {
 	require.NoError(t, err)
 	require.Equal(t, 2, r.HitCount())
 }
+
+func TestCacheMemoryBackendFile(t *testing.T) {
+	filename := filepath.Join(t.TempDir(), "cache.json")
+
+	// No file yet, the cache starts empty
+	b := NewMemoryBackend(MemoryBackendOptions{Filename: filename})
+	require.Equal(t, 0, b.Size())
+
+	answer := func(name string, ttl uint32) (*dns.Msg, *dns.Msg) {
+		q := new(dns.Msg)
+		q.SetQuestion(name, dns.TypeA)
+		a := new(dns.Msg)
+		a.SetReply(q)
+		a.Answer = []dns.RR{
+			&dns.A{
+				Hdr: dns.RR_Header{Name: name, Rrtype: dns.TypeA, Class: dns.ClassINET, Ttl: ttl},
+				A:   net.IP{127, 0, 0, 1},
+			},
+		}
+		return q, a
+	}
+	now := time.Now()
+	q1, a1 := answer("valid.test.", 3600)
+	b.Store(q1, &cacheAnswer{Timestamp: now.Add(-10 * time.Second), Expiry: now.Add(time.Hour), Msg: a1})
+	q2, a2 := answer("expired.test.", 1)
+	b.Store(q2, &cacheAnswer{Timestamp: now.Add(-time.Minute), Expiry: now.Add(-time.Second), Msg: a2})
+	require.NoError(t, b.Close())
+
+	// Only the valid record is loaded, with its TTL reduced by the time it's been cached
+	b = NewMemoryBackend(MemoryBackendOptions{Filename: filename})
+	require.Equal(t, 1, b.Size())
+	a, _, _, ok := b.Lookup(q1)
+	require.True(t, ok)
+	require.LessOrEqual(t, a.Answer[0].Header().Ttl, uint32(3590))
+
+	// The temporary file is removed after writing
+	files, err := os.ReadDir(filepath.Dir(filename))
+	require.NoError(t, err)
+	require.Len(t, files, 1)
+}
+
+func TestCacheServeStale(t *testing.T) {
+	var ci ClientInfo
+	var mu sync.Mutex
+	fail := false
+	r := &TestResolver{
+		ResolveFunc: func(q *dns.Msg, ci ClientInfo) (*dns.Msg, error) {
+			mu.Lock()
+			defer mu.Unlock()
+			if fail {
+				return nil, errors.New("upstream unavailable")
+			}
+			a := new(dns.Msg)
+			a.SetReply(q)
+			a.Answer = []dns.RR{
+				&dns.A{
+					Hdr: dns.RR_Header{Name: q.Question[0].Name, Rrtype: dns.TypeA, Class: dns.ClassINET, Ttl: 1},
+					A:   net.IP{127, 0, 0, 1},
+				},
+			}
+			return a, nil
+		},
+	}
+	c := NewCache("test-cache-stale", r, CacheOptions{ServeStale: time.Minute})
+
+	q := new(dns.Msg)
+	q.SetQuestion("example.com.", dns.TypeA)
+	_, err := c.Resolve(q, ci)
+	require.NoError(t, err)
+	require.Equal(t, 1, r.HitCount())
+
+	// Let the record expire and fail upstream, the stale record is served
+	// with the stale TTL and refreshed in the background
+	time.Sleep(1100 * time.Millisecond)
+	mu.Lock()
+	fail = true
+	mu.Unlock()
+	a, err := c.Resolve(q, ci)
+	require.NoError(t, err)
+	require.Equal(t, dns.RcodeSuccess, a.Rcode)
+	require.Equal(t, uint32(30), a.Answer[0].Header().Ttl)
+	require.Eventually(t, func() bool { return r.HitCount() == 2 }, time.Second, 10*time.Millisecond)
+
+	// The failed refresh didn't replace the record, it's still served stale
+	require.Eventually(t, func() bool {
+		_, loaded := c.refreshing.Load(lruKeyFromQuery(q))
+		return !loaded
+	}, time.Second, 10*time.Millisecond)
+	a, err = c.Resolve(q, ci)
+	require.NoError(t, err)
+	require.Equal(t, uint32(30), a.Answer[0].Header().Ttl)
+	require.Eventually(t, func() bool { return r.HitCount() == 3 }, time.Second, 10*time.Millisecond)
+
+	// Once upstream is back, the refreshed record replaces the stale one
+	require.Eventually(t, func() bool {
+		_, loaded := c.refreshing.Load(lruKeyFromQuery(q))
+		return !loaded
+	}, time.Second, 10*time.Millisecond)
+	mu.Lock()
+	fail = false
+	mu.Unlock()
+	_, err = c.Resolve(q, ci)
+	require.NoError(t, err)
+	require.Eventually(t, func() bool {
+		a, _, stale, ok := c.backend.Lookup(q)
+		return ok && !stale && a.Answer[0].Header().Ttl == 1
+	}, time.Second, 10*time.Millisecond)
+}
+
+func TestCacheServeStaleEDE(t *testing.T) {
+	var ci ClientInfo
+	r := &TestResolver{
+		ResolveFunc: func(q *dns.Msg, ci ClientInfo) (*dns.Msg, error) {
+			a := new(dns.Msg)
+			a.SetReply(q)
+			a.Answer = []dns.RR{
+				&dns.A{
+					Hdr: dns.RR_Header{Name: q.Question[0].Name, Rrtype: dns.TypeA, Class: dns.ClassINET, Ttl: 1},
+					A:   net.IP{127, 0, 0, 1},
+				},
+			}
+			return a, nil
+		},
+	}
+	c := NewCache("test-cache-stale-ede", r, CacheOptions{ServeStale: time.Minute})
+
+	q := new(dns.Msg)
+	q.SetQuestion("example.com.", dns.TypeA)
+	q.SetEdns0(1232, false)
+	a, err := c.Resolve(q, ci)
+	require.NoError(t, err)
+	require.Empty(t, extendedErrors(a))
+
+	// Stale answers carry EDE code 3 (Stale Answer), once
+	time.Sleep(1100 * time.Millisecond)
+	for i := 0; i < 2; i++ {
+		a, err = c.Resolve(q, ci)
+		require.NoError(t, err)
+		errs := extendedErrors(a)
+		require.Len(t, errs, 1)
+		require.Equal(t, dns.ExtendedErrorCodeStaleAnswer, errs[0].InfoCode)
+	}
+}
+
+func TestCacheFlushMatch(t *testing.T) {
+	upstream := &TestResolver{
+		ResolveFunc: func(q *dns.Msg, ci ClientInfo) (*dns.Msg, error) {
+			a := new(dns.Msg)
+			a.SetReply(q)
+			switch q.Question[0].Qtype {
+			case dns.TypeA:
+				a.Answer = []dns.RR{mustRR(t, q.Question[0].Name+" 300 IN A 192.0.2.1")}
+			case dns.TypeAAAA:
+				a.Answer = []dns.RR{mustRR(t, q.Question[0].Name+" 300 IN AAAA 2001:db8::1")}
+			}
+			return a, nil
+		},
+	}
+	c := NewCache("test-cache-flush-match", upstream, CacheOptions{})
+
+	fill := func() {
+		c.Flush()
+		for _, name := range []string{"example.com.", "www.example.com.", "notexample.com.", "example.net."} {
+			for _, qtype := range []uint16{dns.TypeA, dns.TypeAAAA} {
+				q := new(dns.Msg)
+				q.SetQuestion(name, qtype)
+				_, err := c.Resolve(q, ClientInfo{})
+				require.NoError(t, err)
+			}
+		}
+		require.Equal(t, 8, c.Size())
+	}
+
+	tests := []struct {
+		filter  CacheFilter
+		removed int
+	}{
+		{CacheFilter{Name: "example.com."}, 2},
+		{CacheFilter{Name: "EXAMPLE.com"}, 2},
+		{CacheFilter{Name: "example.com.", Suffix: true}, 4},
+		{CacheFilter{Name: "example.com.", Suffix: true, Type: dns.TypeAAAA}, 2},
+		{CacheFilter{Type: dns.TypeA}, 4},
+		{CacheFilter{Name: ".", Suffix: true}, 8},
+		{CacheFilter{Name: "missing.com."}, 0},
+	}
+	for _, test := range tests {
+		fill()
+		require.Equal(t, test.removed, c.FlushMatch(test.filter), "%+v", test.filter)
+		require.Equal(t, 8-test.removed, c.Size(), "%+v", test.filter)
+		require.Empty(t, c.Entries(test.filter), "%+v", test.filter)
+	}
+
+	// Inspect entries
+	fill()
+	entries := c.Entries(CacheFilter{Name: "www.example.com.", Type: dns.TypeA})
+	require.Len(t, entries, 1)
+	e := entries[0]
+	require.Equal(t, "www.example.com.", e.Name)
+	require.Equal(t, "A", e.Type)
+	require.Equal(t, "IN", e.Class)
+	require.Equal(t, "NOERROR", e.Rcode)
+	require.Equal(t, 1, e.Answers)
+	require.False(t, e.Stale)
+	require.InDelta(t, 300, e.TTL, 1)
+	require.Equal(t, "TestResolver()", e.Resolver)
+	require.Len(t, c.Entries(CacheFilter{}), 8)
+}
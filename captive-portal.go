@@ -0,0 +1,228 @@
+package rdns
+
+import (
+	"errors"
+	"expvar"
+	"net"
+	"sort"
+	"sync"
+	"time"
+
+	"github.com/miekg/dns"
+	"github.com/sirupsen/logrus"
+)
+
+// CaptivePortal answers queries of unauthorized clients with the IPs of a
+// portal, building a walled garden in front of the resolver. Clients are
+// authorized at runtime, typically by the portal after a login. Implements
+// the Resolver interface.
+type CaptivePortal struct {
+	id       string
+	resolver Resolver
+	opt      CaptivePortalOptions
+	metrics  *CaptivePortalMetrics
+
+	mu      sync.RWMutex
+	clients map[string]time.Time // Authorized client IPs and their expiry, zero if not expiring
+}
+
+var _ Resolver = &CaptivePortal{}
+
+// CaptivePortalOptions contain settings for the captive portal.
+type CaptivePortalOptions struct {
+	// IPs of the portal, used to answer A and AAAA queries of unauthorized
+	// clients. Other query types get an empty response.
+	PortalIPs []net.IP
+
+	// Clients in these networks are always authorized.
+	AllowedNet []*net.IPNet
+
+	// Optional, queries for names on this list are resolved normally for
+	// unauthorized clients as well, to make the portal itself or a payment
+	// provider reachable.
+	WalledGardenDB BlocklistDB
+
+	// Only rewrite NXDOMAIN responses for unauthorized clients, other
+	// queries are resolved normally.
+	NXDomainOnly bool
+
+	// TTL of the portal records. Defaults to 0 so clients query again
+	// once they're authorized.
+	TTL uint32
+
+	// Time after which clients authorized with a duration of 0 need to be
+	// authorized again. The authorization doesn't expire if 0.
+	ClientTimeout time.Duration
+}
+
+type CaptivePortalMetrics struct {
+	// Queries of unauthorized clients answered with the portal.
+	redirected *expvar.Int
+	// Queries forwarded to the resolver.
+	allowed *expvar.Int
+}
+
+func NewCaptivePortalMetrics(id string) *CaptivePortalMetrics {
+	return &CaptivePortalMetrics{
+		redirected: getVarInt("router", id, "redirected"),
+		allowed:    getVarInt("router", id, "allowed"),
+	}
+}
+
+// CaptivePortalClient is a client that was authorized at runtime.
+type CaptivePortalClient struct {
+	IP string `json:"ip"`
+
+	// Set if the authorization expires.
+	Expires *time.Time `json:"expires,omitempty"`
+}
+
+// NewCaptivePortal returns a new instance of a captive portal.
+func NewCaptivePortal(id string, resolver Resolver, opt CaptivePortalOptions) (*CaptivePortal, error) {
+	if len(opt.PortalIPs) == 0 {
+		return nil, errors.New("no portal ip defined")
+	}
+	ips := make([]net.IP, 0, len(opt.PortalIPs))
+	for _, ip := range opt.PortalIPs {
+		ips = append(ips, normalizeIP(ip))
+	}
+	opt.PortalIPs = ips
+	return &CaptivePortal{
+		id:       id,
+		resolver: resolver,
+		opt:      opt,
+		metrics:  NewCaptivePortalMetrics(id),
+		clients:  make(map[string]time.Time),
+	}, nil
+}
+
+// Resolve a DNS query. Queries of authorized clients and for names in the
+// walled garden are forwarded, all others are answered with the portal.
+func (r *CaptivePortal) Resolve(q *dns.Msg, ci ClientInfo) (*dns.Msg, error) {
+	if len(q.Question) < 1 {
+		return nil, errors.New("no question in query")
+	}
+	question := q.Question[0]
+	log := logger(r.id, q, ci)
+
+	if r.authorized(ci.SourceIP) {
+		r.metrics.allowed.Add(1)
+		return r.resolver.Resolve(q, ci)
+	}
+	if r.opt.WalledGardenDB != nil {
+		if _, _, match, ok := r.opt.WalledGardenDB.Match(question); ok {
+			log.WithField("rule", match.Rule).Debug("name in walled garden, forwarding")
+			r.metrics.allowed.Add(1)
+			return r.resolver.Resolve(q, ci)
+		}
+	}
+	if r.opt.NXDomainOnly {
+		a, err := r.resolver.Resolve(q, ci)
+		if err != nil || a == nil || a.Rcode != dns.RcodeNameError {
+			r.metrics.allowed.Add(1)
+			return a, err
+		}
+	}
+	log.Debug("unauthorized client, responding with portal")
+	r.metrics.redirected.Add(1)
+	return r.portalResponse(q), nil
+}
+
+// Authorize a client IP. The authorization expires after the duration, or
+// after the client-timeout if 0.
+func (r *CaptivePortal) Authorize(ip net.IP, d time.Duration) {
+	if d == 0 {
+		d = r.opt.ClientTimeout
+	}
+	var expires time.Time
+	if d > 0 {
+		expires = time.Now().Add(d)
+	}
+	r.mu.Lock()
+	r.clients[normalizeIP(ip).String()] = expires
+	r.mu.Unlock()
+	Log.WithFields(logrus.Fields{"id": r.id, "client": ip, "expires": expires}).Info("authorized client")
+}
+
+// Deauthorize removes a client IP that was authorized at runtime. Returns
+// false if the client wasn't authorized.
+func (r *CaptivePortal) Deauthorize(ip net.IP) bool {
+	key := normalizeIP(ip).String()
+	r.mu.Lock()
+	_, ok := r.clients[key]
+	delete(r.clients, key)
+	r.mu.Unlock()
+	if ok {
+		Log.WithFields(logrus.Fields{"id": r.id, "client": ip}).Info("deauthorized client")
+	}
+	return ok
+}
+
+// Clients returns the clients that are authorized at runtime, sorted by IP.
+func (r *CaptivePortal) Clients() []CaptivePortalClient {
+	now := time.Now()
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	clients := make([]CaptivePortalClient, 0, len(r.clients))
+	for ip, expires := range r.clients {
+		if !expires.IsZero() && now.After(expires) {
+			delete(r.clients, ip)
+			continue
+		}
+		client := CaptivePortalClient{IP: ip}
+		if !expires.IsZero() {
+			expires := expires
+			client.Expires = &expires
+		}
+		clients = append(clients, client)
+	}
+	sort.Slice(clients, func(i, j int) bool { return clients[i].IP < clients[j].IP })
+	return clients
+}
+
+func (r *CaptivePortal) String() string {
+	return r.id
+}
+
+// Returns true if the client is in one of the allowed networks or was
+// authorized and didn't expire yet.
+func (r *CaptivePortal) authorized(ip net.IP) bool {
+	for _, n := range r.opt.AllowedNet {
+		if n.Contains(ip) {
+			return true
+		}
+	}
+	if ip == nil {
+		return false
+	}
+	r.mu.RLock()
+	expires, ok := r.clients[normalizeIP(ip).String()]
+	r.mu.RUnlock()
+	return ok && (expires.IsZero() || time.Now().Before(expires))
+}
+
+// Build a response with the portal IPs matching the query type.
+func (r *CaptivePortal) portalResponse(q *dns.Msg) *dns.Msg {
+	question := q.Question[0]
+	a := new(dns.Msg)
+	a.SetReply(q)
+	for _, ip := range spoofedIPs(question.Qtype, r.opt.PortalIPs) {
+		hdr := dns.RR_Header{Name: question.Name, Class: question.Qclass, Ttl: r.opt.TTL}
+		if ip4 := ip.To4(); len(ip4) == net.IPv4len {
+			hdr.Rrtype = dns.TypeA
+			a.Answer = append(a.Answer, &dns.A{Hdr: hdr, A: ip4})
+		} else {
+			hdr.Rrtype = dns.TypeAAAA
+			a.Answer = append(a.Answer, &dns.AAAA{Hdr: hdr, AAAA: ip})
+		}
+	}
+	return a
+}
+
+// Returns the 4-byte form of IPv4 and IPv4-mapped IPv6 addresses.
+func normalizeIP(ip net.IP) net.IP {
+	if ip4 := ip.To4(); ip4 != nil {
+		return ip4
+	}
+	return ip
+}
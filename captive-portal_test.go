@@ -0,0 +1,105 @@
+package rdns
+
+import (
+	"net"
+	"testing"
+	"time"
+
+	"github.com/miekg/dns"
+	"github.com/stretchr/testify/require"
+)
+
+func TestCaptivePortal(t *testing.T) {
+	upstream := new(TestResolver)
+	walledGarden, err := NewDomainDB("walled-garden", NewStaticLoader([]string{"portal.test"}))
+	require.NoError(t, err)
+	_, staff, _ := net.ParseCIDR("192.0.2.0/28")
+	portal, err := NewCaptivePortal("test-portal", upstream, CaptivePortalOptions{
+		PortalIPs:      []net.IP{net.ParseIP("192.0.2.1"), net.ParseIP("2001:db8::1")},
+		AllowedNet:     []*net.IPNet{staff},
+		WalledGardenDB: walledGarden,
+	})
+	require.NoError(t, err)
+
+	resolve := func(name string, qtype uint16, ip string) *dns.Msg {
+		q := new(dns.Msg)
+		q.SetQuestion(name, qtype)
+		a, err := portal.Resolve(q, ClientInfo{SourceIP: net.ParseIP(ip)})
+		require.NoError(t, err)
+		return a
+	}
+
+	// Unauthorized clients get the portal
+	a := resolve("example.com.", dns.TypeA, "192.0.2.100")
+	require.Len(t, a.Answer, 1)
+	require.Equal(t, "192.0.2.1", a.Answer[0].(*dns.A).A.String())
+	a = resolve("example.com.", dns.TypeAAAA, "192.0.2.100")
+	require.Len(t, a.Answer, 1)
+	require.Equal(t, "2001:db8::1", a.Answer[0].(*dns.AAAA).AAAA.String())
+	a = resolve("example.com.", dns.TypeMX, "192.0.2.100")
+	require.Equal(t, dns.RcodeSuccess, a.Rcode)
+	require.Empty(t, a.Answer)
+	require.Equal(t, 0, upstream.HitCount())
+
+	// Except for names in the walled garden, and clients in allowed networks
+	resolve("portal.test.", dns.TypeA, "192.0.2.100")
+	require.Equal(t, 1, upstream.HitCount())
+	resolve("example.com.", dns.TypeA, "192.0.2.5")
+	require.Equal(t, 2, upstream.HitCount())
+
+	// Authorize the client
+	portal.Authorize(net.ParseIP("::ffff:192.0.2.100"), 0)
+	resolve("example.com.", dns.TypeA, "192.0.2.100")
+	require.Equal(t, 3, upstream.HitCount())
+	require.Equal(t, []CaptivePortalClient{{IP: "192.0.2.100"}}, portal.Clients())
+
+	// And remove it again
+	require.True(t, portal.Deauthorize(net.ParseIP("192.0.2.100")))
+	require.False(t, portal.Deauthorize(net.ParseIP("192.0.2.100")))
+	resolve("example.com.", dns.TypeA, "192.0.2.100")
+	require.Equal(t, 3, upstream.HitCount())
+
+	// Authorizations expire
+	portal.Authorize(net.ParseIP("192.0.2.101"), 50*time.Millisecond)
+	require.Len(t, portal.Clients(), 1)
+	require.NotNil(t, portal.Clients()[0].Expires)
+	resolve("example.com.", dns.TypeA, "192.0.2.101")
+	require.Equal(t, 4, upstream.HitCount())
+	time.Sleep(60 * time.Millisecond)
+	resolve("example.com.", dns.TypeA, "192.0.2.101")
+	require.Equal(t, 4, upstream.HitCount())
+	require.Empty(t, portal.Clients())
+}
+
+func TestCaptivePortalNXDomainOnly(t *testing.T) {
+	upstream := &TestResolver{
+		ResolveFunc: func(q *dns.Msg, ci ClientInfo) (*dns.Msg, error) {
+			if q.Question[0].Name == "missing.test." {
+				return nxdomain(q), nil
+			}
+			a := new(dns.Msg)
+			a.SetReply(q)
+			return a, nil
+		},
+	}
+	portal, err := NewCaptivePortal("test-portal-nxdomain", upstream, CaptivePortalOptions{
+		PortalIPs:    []net.IP{net.ParseIP("192.0.2.1")},
+		NXDomainOnly: true,
+		TTL:          10,
+	})
+	require.NoError(t, err)
+
+	q := new(dns.Msg)
+	q.SetQuestion("missing.test.", dns.TypeA)
+	a, err := portal.Resolve(q, ClientInfo{SourceIP: net.ParseIP("192.0.2.100")})
+	require.NoError(t, err)
+	require.Equal(t, dns.RcodeSuccess, a.Rcode)
+	require.Len(t, a.Answer, 1)
+	require.Equal(t, uint32(10), a.Answer[0].Header().Ttl)
+
+	q.SetQuestion("example.com.", dns.TypeA)
+	a, err = portal.Resolve(q, ClientInfo{SourceIP: net.ParseIP("192.0.2.100")})
+	require.NoError(t, err)
+	require.Empty(t, a.Answer)
+	require.Equal(t, 2, upstream.HitCount())
+}
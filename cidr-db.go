@@ -1,6 +1,7 @@
 package rdns
 
 import (
+	"errors"
 	"net"
 	"strings"
 )
@@ -55,7 +56,11 @@ func NewCidrDB(name string, loader BlocklistLoader) (*CidrDB, error) {
 }
 
 func (m *CidrDB) Reload() (IPBlocklistDB, error) {
-	return NewCidrDB(m.name, m.loader)
+	db, err := NewCidrDB(m.name, m.loader)
+	if errors.Is(err, ErrNotModified) {
+		return m, nil
+	}
+	return db, err
 }
 
 func (m *CidrDB) Match(ip net.IP) (*BlocklistMatch, bool) {
@@ -0,0 +1,214 @@
+package rdns
+
+import (
+	"expvar"
+	"fmt"
+	"sync"
+	"time"
+
+	"github.com/miekg/dns"
+	"github.com/sirupsen/logrus"
+)
+
+// CircuitBreaker is a resolver that stops sending queries to an upstream
+// resolver after a number of consecutive failures. While the circuit is open,
+// queries are answered immediately. After a cool-down period, the circuit is
+// half-open and single probe queries are sent upstream again, one at a time.
+// The circuit closes once enough of them succeed.
+type CircuitBreaker struct {
+	id       string
+	resolver Resolver
+	opt      CircuitBreakerOptions
+
+	mu        sync.Mutex
+	state     circuitState
+	failures  int
+	successes int
+	openedAt  time.Time
+	probing   bool // a probe query is in progress while half-open
+
+	// State gauges, 1 for the current state and 0 for the others
+	gauges map[circuitState]*expvar.Int
+
+	// Returns the current time, can be replaced in tests
+	now func() time.Time
+}
+
+var _ Resolver = &CircuitBreaker{}
+
+// CircuitBreakerOptions contain settings for the circuit breaker.
+type CircuitBreakerOptions struct {
+	// Number of consecutive failures that open the circuit. Default 5.
+	FailureThreshold int
+
+	// Number of successful queries in the half-open state that are needed to
+	// close the circuit again. Default 1.
+	SuccessThreshold int
+
+	// Time the circuit stays open before queries are sent upstream again.
+	// Default 30 seconds.
+	OpenDuration time.Duration
+
+	// Optional, builds the response to queries while the circuit is open.
+	// Responds with SERVFAIL if nil.
+	OpenResponse func(q *dns.Msg) *dns.Msg
+
+	// Consider SERVFAIL responses from the upstream resolver as failures.
+	ServfailError bool
+}
+
+type circuitState int
+
+const (
+	circuitClosed circuitState = iota
+	circuitOpen
+	circuitHalfOpen
+)
+
+func (s circuitState) String() string {
+	switch s {
+	case circuitClosed:
+		return "closed"
+	case circuitOpen:
+		return "open"
+	case circuitHalfOpen:
+		return "half-open"
+	default:
+		return "unknown"
+	}
+}
+
+// NewCircuitBreaker returns a new instance of a circuit breaker.
+func NewCircuitBreaker(id string, resolver Resolver, opt CircuitBreakerOptions) (*CircuitBreaker, error) {
+	if opt.FailureThreshold < 0 || opt.SuccessThreshold < 0 || opt.OpenDuration < 0 {
+		return nil, fmt.Errorf("invalid circuit-breaker options in %q", id)
+	}
+	if opt.FailureThreshold == 0 {
+		opt.FailureThreshold = 5
+	}
+	if opt.SuccessThreshold == 0 {
+		opt.SuccessThreshold = 1
+	}
+	if opt.OpenDuration == 0 {
+		opt.OpenDuration = 30 * time.Second
+	}
+	if opt.OpenResponse == nil {
+		opt.OpenResponse = servfail
+	}
+	states := getVarMap("router", id, "state")
+	gauges := make(map[circuitState]*expvar.Int)
+	for _, s := range []circuitState{circuitClosed, circuitOpen, circuitHalfOpen} {
+		gauges[s] = new(expvar.Int)
+		states.Set(s.String(), gauges[s])
+	}
+	gauges[circuitClosed].Set(1)
+	return &CircuitBreaker{
+		id:       id,
+		resolver: resolver,
+		opt:      opt,
+		gauges:   gauges,
+		now:      time.Now,
+	}, nil
+}
+
+// Resolve a DNS query using the upstream resolver unless the circuit is open.
+func (r *CircuitBreaker) Resolve(q *dns.Msg, ci ClientInfo) (*dns.Msg, error) {
+	log := logger(r.id, q, ci)
+	allowed, probe := r.allow()
+	if !allowed {
+		log.Debug("circuit open, not forwarding query")
+		return r.opt.OpenResponse(q), nil
+	}
+	a, err := r.resolver.Resolve(q, ci)
+	if err != nil || a == nil || (r.opt.ServfailError && a.Rcode == dns.RcodeServerFailure) {
+		r.failure(log, probe)
+	} else {
+		r.success(log, probe)
+	}
+	return a, err
+}
+
+// String returns the id of the circuit breaker.
+func (r *CircuitBreaker) String() string {
+	return r.id
+}
+
+// State returns the current state of the circuit, "closed", "open" or
+// "half-open".
+func (r *CircuitBreaker) State() string {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	return r.state.String()
+}
+
+// Returns true if a query can be sent upstream, and if it is the probe of a
+// half-open circuit. Moves an open circuit into half-open once the open
+// duration has passed. Only one probe is sent at a time, other queries are
+// refused until it completes.
+func (r *CircuitBreaker) allow() (allowed, probe bool) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	switch r.state {
+	case circuitOpen:
+		if r.now().Sub(r.openedAt) < r.opt.OpenDuration {
+			return false, false
+		}
+		r.setState(circuitHalfOpen)
+	case circuitClosed:
+		return true, false
+	}
+	if r.probing {
+		return false, false
+	}
+	r.probing = true
+	return true, true
+}
+
+func (r *CircuitBreaker) failure(log *logrus.Entry, probe bool) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	if r.state == circuitHalfOpen && !probe {
+		// Queries that were sent before the circuit opened
+		return
+	}
+	r.successes = 0
+	switch r.state {
+	case circuitClosed:
+		r.failures++
+		if r.failures < r.opt.FailureThreshold {
+			return
+		}
+	case circuitOpen:
+		// Queries that were sent before the circuit opened
+		return
+	case circuitHalfOpen:
+		r.probing = false
+	}
+	log.WithField("failures", r.failures).Warn("opening circuit")
+	r.failures = 0
+	r.openedAt = r.now()
+	r.setState(circuitOpen)
+}
+
+func (r *CircuitBreaker) success(log *logrus.Entry, probe bool) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	r.failures = 0
+	if r.state != circuitHalfOpen || !probe {
+		return
+	}
+	r.probing = false
+	r.successes++
+	if r.successes >= r.opt.SuccessThreshold {
+		log.Info("closing circuit")
+		r.successes = 0
+		r.setState(circuitClosed)
+	}
+}
+
+// Must be called with the lock held.
+func (r *CircuitBreaker) setState(s circuitState) {
+	r.gauges[r.state].Set(0)
+	r.gauges[s].Set(1)
+	r.state = s
+}
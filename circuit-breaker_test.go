@@ -0,0 +1,151 @@
+package rdns
+
+import (
+	"errors"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/miekg/dns"
+	"github.com/stretchr/testify/require"
+)
+
+func TestCircuitBreaker(t *testing.T) {
+	var ci ClientInfo
+	upstream := new(TestResolver)
+	r, err := NewCircuitBreaker("test-cb", upstream, CircuitBreakerOptions{
+		FailureThreshold: 2,
+		SuccessThreshold: 2,
+		OpenDuration:     time.Minute,
+	})
+	require.NoError(t, err)
+	now := time.Date(2024, 5, 1, 12, 0, 0, 0, time.UTC)
+	r.now = func() time.Time { return now }
+
+	q := new(dns.Msg)
+	q.SetQuestion("test.com.", dns.TypeA)
+	require.Equal(t, "test-cb", r.String())
+	require.Equal(t, "closed", r.State())
+
+	// Two consecutive failures open the circuit
+	upstream.SetFail(true)
+	_, err = r.Resolve(q, ci)
+	require.Error(t, err)
+	_, err = r.Resolve(q, ci)
+	require.Error(t, err)
+	require.Equal(t, 2, upstream.HitCount())
+	require.Equal(t, "open", r.State())
+	require.Equal(t, int64(1), r.gauges[circuitOpen].Value())
+	require.Equal(t, int64(0), r.gauges[circuitClosed].Value())
+
+	// While open, queries aren't forwarded
+	a, err := r.Resolve(q, ci)
+	require.NoError(t, err)
+	require.Equal(t, dns.RcodeServerFailure, a.Rcode)
+	require.Equal(t, 2, upstream.HitCount())
+
+	// After the open duration, a failure in half-open state opens it right away
+	now = now.Add(time.Minute)
+	_, err = r.Resolve(q, ci)
+	require.Error(t, err)
+	require.Equal(t, 3, upstream.HitCount())
+	require.Equal(t, "open", r.State())
+
+	// Recover, it takes two successes to close the circuit
+	upstream.SetFail(false)
+	now = now.Add(time.Minute)
+	_, err = r.Resolve(q, ci)
+	require.NoError(t, err)
+	require.Equal(t, "half-open", r.State())
+	require.Equal(t, int64(1), r.gauges[circuitHalfOpen].Value())
+	_, err = r.Resolve(q, ci)
+	require.NoError(t, err)
+	require.Equal(t, "closed", r.State())
+	require.Equal(t, 5, upstream.HitCount())
+}
+
+func TestCircuitBreakerConsecutive(t *testing.T) {
+	var ci ClientInfo
+	fail := true
+	upstream := &TestResolver{ResolveFunc: func(q *dns.Msg, ci ClientInfo) (*dns.Msg, error) {
+		if fail {
+			return servfail(q), nil
+		}
+		return q, nil
+	}}
+	r, err := NewCircuitBreaker("test-cb-consecutive", upstream, CircuitBreakerOptions{
+		FailureThreshold: 2,
+		ServfailError:    true,
+		OpenResponse:     refused,
+	})
+	require.NoError(t, err)
+
+	q := new(dns.Msg)
+	q.SetQuestion("test.com.", dns.TypeA)
+
+	// A success in between resets the failure count
+	_, _ = r.Resolve(q, ci)
+	fail = false
+	_, _ = r.Resolve(q, ci)
+	fail = true
+	_, _ = r.Resolve(q, ci)
+	require.Equal(t, "closed", r.State())
+
+	// The second consecutive SERVFAIL opens the circuit, open responses are REFUSED
+	_, _ = r.Resolve(q, ci)
+	require.Equal(t, "open", r.State())
+	a, err := r.Resolve(q, ci)
+	require.NoError(t, err)
+	require.Equal(t, dns.RcodeRefused, a.Rcode)
+	require.Equal(t, 4, upstream.HitCount())
+}
+
+func TestCircuitBreakerSingleProbe(t *testing.T) {
+	var ci ClientInfo
+	var fail atomic.Bool
+	fail.Store(true)
+	release := make(chan struct{})
+	started := make(chan struct{}, 1)
+	upstream := &TestResolver{ResolveFunc: func(q *dns.Msg, ci ClientInfo) (*dns.Msg, error) {
+		if fail.Load() {
+			return nil, errors.New("failed")
+		}
+		started <- struct{}{}
+		<-release
+		return q, nil
+	}}
+	r, err := NewCircuitBreaker("test-cb-probe", upstream, CircuitBreakerOptions{
+		FailureThreshold: 1,
+		OpenDuration:     time.Minute,
+	})
+	require.NoError(t, err)
+	now := time.Date(2024, 5, 1, 12, 0, 0, 0, time.UTC)
+	r.now = func() time.Time { return now }
+
+	q := new(dns.Msg)
+	q.SetQuestion("test.com.", dns.TypeA)
+	_, err = r.Resolve(q, ci)
+	require.Error(t, err)
+	require.Equal(t, "open", r.State())
+
+	// Once half-open, a single probe is sent upstream
+	fail.Store(false)
+	now = now.Add(time.Minute)
+	probe := make(chan *dns.Msg)
+	go func() {
+		a, _ := r.Resolve(q, ci)
+		probe <- a
+	}()
+	<-started
+	require.Equal(t, "half-open", r.State())
+
+	// Other queries are refused until the probe completes
+	a, err := r.Resolve(q, ci)
+	require.NoError(t, err)
+	require.Equal(t, dns.RcodeServerFailure, a.Rcode)
+	require.Equal(t, 2, upstream.HitCount())
+
+	close(release)
+	require.Equal(t, dns.RcodeSuccess, (<-probe).Rcode)
+	require.Equal(t, "closed", r.State())
+}
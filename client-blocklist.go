@@ -15,6 +15,7 @@ type ClientBlocklist struct {
 	resolver Resolver
 	mu       sync.RWMutex
 	metrics  *BlocklistMetrics
+	loops    stopper // stops the refresh loop
 }
 
 var _ Resolver = &ClientBlocklist{}
@@ -51,7 +52,7 @@ func NewClientBlocklist(id string, resolver Resolver, opt ClientBlocklistOptions
 func (r *ClientBlocklist) Resolve(q *dns.Msg, ci ClientInfo) (*dns.Msg, error) {
 	if match, ok := r.BlocklistDB.Match(ci.SourceIP); ok {
 		log := Log.WithFields(logrus.Fields{"id": r.id, "qname": qName(q), "list": match.List, "rule": match.Rule, "ip": ci.SourceIP})
-		r.metrics.blocked.Add(1)
+		r.metrics.countBlocked(q, match)
 		if r.BlocklistResolver != nil {
 			log.WithField("resolver", r.BlocklistResolver).Debug("client on blocklist, forwarding to blocklist-resolver")
 			return r.BlocklistResolver.Resolve(q, ci)
@@ -68,19 +69,40 @@ func (r *ClientBlocklist) String() string {
 	return r.id
 }
 
+// Close stops the periodic refresh of the blocklist.
+func (r *ClientBlocklist) Close() error {
+	r.loops.stop()
+	return nil
+}
+
+// ReloadAll reloads the blocklist immediately.
+func (r *ClientBlocklist) ReloadAll() error {
+	r.mu.RLock()
+	db := r.BlocklistDB
+	r.mu.RUnlock()
+	db, err := db.Reload()
+	if err != nil {
+		return err
+	}
+	r.mu.Lock()
+	closeReplacedIPDB(r.BlocklistDB, db)
+	r.BlocklistDB = db
+	r.mu.Unlock()
+	return nil
+}
+
 func (r *ClientBlocklist) refreshLoopBlocklist(refresh time.Duration) {
-	for {
-		time.Sleep(refresh)
-		log := Log.WithField("id", r.id)
+	log := Log.WithField("id", r.id)
+	newRefresher(log, refresh).run(r.loops.done(), func() error {
 		log.Debug("reloading blocklist")
 		db, err := r.BlocklistDB.Reload()
 		if err != nil {
-			Log.WithError(err).Error("failed to load rules")
-			continue
+			return err
 		}
 		r.mu.Lock()
-		r.BlocklistDB.Close()
+		closeReplacedIPDB(r.BlocklistDB, db)
 		r.BlocklistDB = db
 		r.mu.Unlock()
-	}
+		return nil
+	})
 }
@@ -0,0 +1,88 @@
+package rdns
+
+import (
+	"errors"
+	"fmt"
+	"net"
+
+	"github.com/miekg/dns"
+	"github.com/sirupsen/logrus"
+)
+
+// ClientRouter sends queries to resolvers based on the source IP of the client.
+// If the client IP is covered by more than one network, the most specific one
+// is used. Queries from clients that don't match any of the networks are sent
+// to the default resolver.
+type ClientRouter struct {
+	id              string
+	routes          []ClientRoute
+	networks        ipNetworks
+	defaultResolver Resolver
+	metrics         *RouterMetrics
+}
+
+var _ Resolver = &ClientRouter{}
+
+// ClientRoute associates a client network with a resolver.
+type ClientRoute struct {
+	Network  *net.IPNet
+	Resolver Resolver
+}
+
+// NewClientRouter returns a new instance of a router that uses the client IP to
+// pick a resolver. The default resolver is optional, queries without match are
+// answered with REFUSED if it's nil.
+func NewClientRouter(id string, routes []ClientRoute, defaultResolver Resolver) (*ClientRouter, error) {
+	r := &ClientRouter{
+		id:              id,
+		routes:          routes,
+		defaultResolver: defaultResolver,
+	}
+	for i, route := range routes {
+		if route.Network == nil {
+			return nil, fmt.Errorf("no network defined for route %d in %q", i, id)
+		}
+		if route.Resolver == nil {
+			return nil, fmt.Errorf("no resolver defined for route %s in %q", route.Network, id)
+		}
+		r.networks.add(route.Network, i)
+	}
+	available := len(routes)
+	if defaultResolver != nil {
+		available++
+	}
+	r.metrics = NewRouterMetrics(id, available)
+	return r, nil
+}
+
+// Resolve a query by sending it to the resolver responsible for the client's network.
+func (r *ClientRouter) Resolve(q *dns.Msg, ci ClientInfo) (*dns.Msg, error) {
+	if len(q.Question) < 1 {
+		return nil, errors.New("no question in query")
+	}
+	log := logger(r.id, q, ci)
+	resolver := r.defaultResolver
+	network := "(default)"
+	if i, ok := r.networks.lookup(ci.SourceIP); ok {
+		resolver = r.routes[i].Resolver
+		network = r.routes[i].Network.String()
+	}
+	if resolver == nil {
+		log.Debug("no route for client, refusing")
+		return refused(q), nil
+	}
+	log.WithFields(logrus.Fields{
+		"network":  network,
+		"resolver": resolver.String(),
+	}).Debug("routing query to resolver")
+	r.metrics.route.Add(resolver.String(), 1)
+	a, err := resolver.Resolve(q, ci)
+	if err != nil {
+		r.metrics.failure.Add(resolver.String(), 1)
+	}
+	return a, err
+}
+
+func (r *ClientRouter) String() string {
+	return r.id
+}
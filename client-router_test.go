@@ -0,0 +1,79 @@
+package rdns
+
+import (
+	"fmt"
+	"net"
+	"testing"
+
+	"github.com/miekg/dns"
+	"github.com/stretchr/testify/require"
+)
+
+func TestClientRouter(t *testing.T) {
+	internal4 := new(TestResolver)
+	internal4Sub := new(TestResolver)
+	internal6 := new(TestResolver)
+	guest := new(TestResolver)
+
+	mustNet := func(s string) *net.IPNet {
+		_, n, err := net.ParseCIDR(s)
+		require.NoError(t, err)
+		return n
+	}
+	r, err := NewClientRouter("test-client-router", []ClientRoute{
+		{Network: mustNet("10.0.0.0/8"), Resolver: internal4},
+		{Network: mustNet("10.1.0.0/16"), Resolver: internal4Sub},
+		{Network: mustNet("2001:db8::/32"), Resolver: internal6},
+	}, guest)
+	require.NoError(t, err)
+
+	q := new(dns.Msg)
+	q.SetQuestion("test.com.", dns.TypeA)
+
+	tests := []struct {
+		ip       string
+		resolver *TestResolver
+	}{
+		{"10.2.3.4", internal4},
+		{"10.1.2.3", internal4Sub},     // more specific network wins
+		{"::ffff:10.2.3.4", internal4}, // IPv4-mapped IPv6
+		{"2001:db8:1::1", internal6},   // IPv6
+		{"192.168.1.1", guest},         // default
+		{"2001:db9::1", guest},         // default
+	}
+	for _, test := range tests {
+		before := test.resolver.HitCount()
+		_, err := r.Resolve(q, ClientInfo{SourceIP: net.ParseIP(test.ip)})
+		require.NoError(t, err)
+		require.Equal(t, before+1, test.resolver.HitCount(), "client: %s", test.ip)
+	}
+}
+
+func TestClientRouterNoDefault(t *testing.T) {
+	_, n, _ := net.ParseCIDR("10.0.0.0/8")
+	r, err := NewClientRouter("test-client-router-nodefault", []ClientRoute{
+		{Network: n, Resolver: new(TestResolver)},
+	}, nil)
+	require.NoError(t, err)
+
+	q := new(dns.Msg)
+	q.SetQuestion("test.com.", dns.TypeA)
+	a, err := r.Resolve(q, ClientInfo{SourceIP: net.ParseIP("192.168.1.1")})
+	require.NoError(t, err)
+	require.Equal(t, dns.RcodeRefused, a.Rcode)
+}
+
+func BenchmarkClientRouter(b *testing.B) {
+	var routes []ClientRoute
+	for i := 0; i < 4096; i++ {
+		_, n, _ := net.ParseCIDR(fmt.Sprintf("10.%d.%d.0/24", i/256, i%256))
+		routes = append(routes, ClientRoute{Network: n, Resolver: new(TestResolver)})
+	}
+	r, err := NewClientRouter("bench-client-router", routes, new(TestResolver))
+	require.NoError(b, err)
+	ip := net.ParseIP("10.15.255.1")
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		r.networks.lookup(ip)
+	}
+}
@@ -2,21 +2,28 @@ package main
 
 import (
 	"bytes"
+	"fmt"
 	"io"
 	"net"
 	"os"
+	"strings"
 
 	"github.com/BurntSushi/toml"
 	rdns "github.com/folbricht/routedns"
+	"github.com/miekg/dns"
 )
 
 type config struct {
-	Title             string
-	BootstrapResolver resolver `toml:"bootstrap-resolver"`
-	Listeners         map[string]listener
-	Resolvers         map[string]resolver
-	Groups            map[string]group
-	Routers           map[string]router
+	Title              string
+	BootstrapResolver  resolver   `toml:"bootstrap-resolver"`
+	BootstrapResolvers []resolver `toml:"bootstrap-resolvers"`
+	Listeners          map[string]listener
+	Resolvers          map[string]resolver
+	Groups             map[string]group
+	Routers            map[string]router
+
+	// Keys in the files that don't match any option
+	undecoded []toml.Key
 }
 
 type listener struct {
@@ -30,7 +37,48 @@ type listener struct {
 	MutualTLS  bool     `toml:"mutual-tls"`
 	NoTLS      bool     `toml:"no-tls"` // Disable TLS in DoH servers
 	AllowedNet []string `toml:"allowed-net"`
+	EnableJSON bool     `toml:"enable-json"` // Serve JSON (application/dns-json) queries in DoH servers
+	JSONPath   string   `toml:"json-path"`
+	Paths      []string // URL paths of DoH queries, any path if empty
 	Frontend   dohFrontend
+	Prometheus bool   // Serve Prometheus metrics on /metrics, admin listener only
+	ReloadAPI  bool   `toml:"reload-api"` // Reload the configuration on POST /routedns/reload, admin listener only
+	APIToken   string `toml:"api-token"`  // Enable the management API with this bearer token, admin listener only
+
+	// DNSCrypt listener options
+	ProviderName string `toml:"provider-name"` // DNSCrypt provider name, 2.dnscrypt-cert.<domain>
+	ProviderKey  string `toml:"provider-key"`  // Hex-encoded 32 byte Ed25519 seed of the provider key
+	CertLifetime int    `toml:"cert-lifetime"` // Validity of DNSCrypt certificates in hours, default 24
+	XSalsa20     bool   `toml:"xsalsa20"`      // Use X25519-XSalsa20Poly1305 certificates instead of X25519-XChacha20Poly1305
+
+	// ODoH relay options
+	AllowedTargets []string `toml:"allowed-targets"` // Hostnames of ODoH targets queries can be relayed to
+
+	// PROXY protocol options, TCP, DoT and DoH listeners only
+	ProxyProtocol    bool     `toml:"proxy-protocol"`     // Read the client address from PROXY protocol v1/v2 headers
+	ProxyProtocolNet []string `toml:"proxy-protocol-net"` // Networks of load balancers sending headers, all clients if empty
+
+	// Interface binding options, UDP, TCP, DoT and DoH (interface-addresses not for DoH) listeners only
+	BindInterface      string `toml:"bind-interface"`      // Only receive queries on this interface, SO_BINDTODEVICE, Linux only
+	InterfaceAddresses string `toml:"interface-addresses"` // Listen on all addresses of this interface, following changes
+	InterfaceRefresh   int    `toml:"interface-refresh"`   // Seconds between checks for interface address changes, default 10
+
+	// Largest UDP response, regardless of the EDNS0 size of the client. UDP and DTLS listeners only
+	MaxUDPSize uint16 `toml:"max-udp-size"`
+
+	// Milliseconds a query can take across all elements and upstream resolvers, no limit if 0
+	QueryDeadline int `toml:"query-deadline"`
+
+	// DoQ listener options
+	Allow0RTT   bool  `toml:"enable-0rtt"`  // Accept queries in 0-RTT data from clients resuming a session
+	MaxStreams  int64 `toml:"max-streams"`  // Max concurrent queries per connection, default 100
+	IdleTimeout int   `toml:"idle-timeout"` // Seconds a connection without queries is kept open, default 2
+
+	// Access control rules, evaluated in order after allowed-net
+	ACL        []string `toml:"acl"`         // Rules like "allow 10.0.0.0/8" or "drop 192.0.2.0/24"
+	ACLFile    string   `toml:"acl-file"`    // File with more rules, one per line
+	ACLRefresh int      `toml:"acl-refresh"` // Time interval (in seconds) in which the ACL file is reloaded
+	ACLDefault string   `toml:"acl-default"` // Action for clients not matching any rule, "refuse" by default
 }
 
 // DoH listener frontend options
@@ -50,16 +98,40 @@ type resolver struct {
 	BootstrapAddr string `toml:"bootstrap-address"`
 	LocalAddr     string `toml:"local-address"`
 	EDNS0UDPSize  uint16 `toml:"edns0-udp-size"` // UDP resolver option
+	TCPFallback   bool   `toml:"tcp-fallback"`   // Retry truncated UDP responses over TCP, UDP resolver option
 	QueryTimeout  int    `toml:"query-timeout"`  // Query timeout in seconds
 
+	// Retries of failed queries, for all protocols
+	Retries             int     `toml:"retries"`               // Number of times a failed query is retried, default 0
+	RetryInitialBackoff int     `toml:"retry-initial-backoff"` // Milliseconds to wait before the first retry, retries immediately if 0
+	RetryMaxBackoff     int     `toml:"retry-max-backoff"`     // Upper limit of the wait in milliseconds, default 60000
+	RetryMultiplier     float64 `toml:"retry-multiplier"`      // Factor applied to the wait with every retry, default 2
+	RetryJitter         bool    `toml:"retry-jitter"`          // Randomize the wait to between half and all of it
+	QueryDeadline       int     `toml:"query-deadline"`        // Milliseconds for all attempts of a query together, no limit if 0
+
+	// Connection pool for TCP and DoT resolvers
+	Connections int `toml:"connections"`  // Max number of connections to the server, default 1
+	IdleTimeout int `toml:"idle-timeout"` // Seconds after which idle connections are closed, default 10
+	MaxInFlight int `toml:"max-inflight"` // Max number of queries waiting for a response per connection
+
 	// Proxy configuration
 	Socks5Address      string `toml:"socks5-address"`
 	Socks5Username     string `toml:"socks5-username"`
 	Socks5Password     string `toml:"socks5-password"`
 	Socks5ResolveLocal bool   `toml:"socks5-resolve-local"` // Resolve DNS server address locally (i.e. bootstrap-resolver), not on the SOCK5 proxy
+	HTTPProxyAddress   string `toml:"http-proxy-address"`   // HTTP proxy supporting CONNECT, host:port
+	HTTPProxyUsername  string `toml:"http-proxy-username"`
+	HTTPProxyPassword  string `toml:"http-proxy-password"`
 
 	//QUIC and DoH/3 configuration
-	Use0RTT       bool   `toml:"enable-0rtt"`
+	Use0RTT bool `toml:"enable-0rtt"`
+
+	// mDNS configuration
+	MDNSSuffix    string `toml:"mdns-suffix"`    // Domain of the names resolved with mDNS, default "local."
+	MDNSInterface string `toml:"mdns-interface"` // Network interface to send mDNS queries on
+
+	// ODoH configuration
+	Relay string // URL of the ODoH relay queries are sent through
 }
 
 // DoH-specific resolver options
@@ -86,35 +158,95 @@ type cacheBackend struct {
 }
 
 type group struct {
-	Resolvers  []string
-	Type       string
-	Replace    []rdns.ReplaceOperation // only used by "replace" type
-	ECSOp      string                  `toml:"ecs-op"`      // ECS modifier operation, "add", "delete", "privacy"
-	ECSAddress net.IP                  `toml:"ecs-address"` // ECS address. If empty for "add", uses the client IP. Ignored for "privacy" and "delete"
-	ECSPrefix4 uint8                   `toml:"ecs-prefix4"` // ECS IPv4 address prefix, 0-32. Used for "add" and "privacy"
-	ECSPrefix6 uint8                   `toml:"ecs-prefix6"` // ECS IPv6 address prefix, 0-128. Used for "add" and "privacy"
-	TTLMin     uint32                  `toml:"ttl-min"`     // TTL minimum to apply to responses in the TTL-modifier
-	TTLMax     uint32                  `toml:"ttl-max"`     // TTL maximum to apply to responses in the TTL-modifier
-	TTLSelect  string                  `toml:"ttl-select"`  // Modifier selection function, "lowest", "highest", "average", "first", "last", "random"
-	EDNS0Op    string                  `toml:"edns0-op"`    // EDNS0 modifier operation, "add" or "delete"
-	EDNS0Code  uint16                  `toml:"edns0-code"`  // EDNS0 modifier option code
-	EDNS0Data  []byte                  `toml:"edns0-data"`  // EDNS0 modifier option data
+	Resolvers    []string
+	Type         string
+	Replace      []rdns.ReplaceOperation // only used by "replace" type
+	Rewrite      []rdns.RewriteRule      // only used by "rewrite" type
+	ECSOp        string                  `toml:"ecs-op"`          // ECS modifier operation, "add", "delete", "privacy"
+	ECSAddress   net.IP                  `toml:"ecs-address"`     // ECS address. If empty for "add", uses the client IP. Ignored for "privacy" and "delete"
+	ECSPrefix4   uint8                   `toml:"ecs-prefix4"`     // ECS IPv4 address prefix, 0-32. Used for "add" and "privacy"
+	ECSPrefix6   uint8                   `toml:"ecs-prefix6"`     // ECS IPv6 address prefix, 0-128. Used for "add" and "privacy"
+	ECSDomains   []string                `toml:"ecs-domains"`     // Only apply ecs-op to queries for these domains and their subdomains
+	ECSOtherOp   string                  `toml:"ecs-other-op"`    // ECS modifier operation for queries not in ecs-domains
+	TTLMin       uint32                  `toml:"ttl-min"`         // TTL minimum to apply to responses in the TTL-modifier
+	TTLMax       uint32                  `toml:"ttl-max"`         // TTL maximum to apply to responses in the TTL-modifier
+	TTLMaxByType map[string]uint32       `toml:"ttl-max-by-type"` // TTL maximum by record type in the TTL-modifier, e.g. {TXT = 300}
+	TTLSelect    string                  `toml:"ttl-select"`      // Modifier selection function, "lowest", "highest", "average", "first", "last", "random"
+	EDNS0Op      string                  `toml:"edns0-op"`        // EDNS0 modifier operation, "add" or "delete"
+	EDNS0Code    uint16                  `toml:"edns0-code"`      // EDNS0 modifier option code
+	EDNS0Data    []byte                  `toml:"edns0-data"`      // EDNS0 modifier option data
+
+	// DNS64 options
+	DNS64Prefix  string   `toml:"dns64-prefix"`  // NAT64 prefix to synthesize AAAA records with, default "64:ff9b::/96"
+	DNS64Exclude []string `toml:"dns64-exclude"` // Ignore AAAA records in these networks, default "::ffff:0:0/96"
+
+	// Response-modifier options
+	ResponseRules []responseRule `toml:"response-rules"` // Rules applied to matching responses, in order
+
+	// Round-robin options
+	Weights []int `toml:"weights"` // Relative weights of the resolvers, in the same order
+	Sticky  bool  `toml:"sticky"`  // Send all queries of a client to the same resolver
 
 	// Failover/Failback options
 	ResetAfter    int  `toml:"reset-after"`    // Time in seconds after which to reset resolvers in fail-back and random groups, default 60.
 	ServfailError bool `toml:"servfail-error"` // If true, SERVFAIL responses are considered errors and cause failover etc.
 
+	// Health-check options for fail-back groups
+	HealthCheckInterval  int    `toml:"health-check-interval"`           // Time in seconds between health probes, disabled if 0
+	HealthCheckTimeout   int    `toml:"health-check-timeout"`            // Time in seconds before a probe is considered failed, default 2
+	HealthCheckQuery     string `toml:"health-check-query"`              // Probe query in the form "<type> <name>", default "A healthcheck.local."
+	HealthCheckThreshold int    `toml:"health-check-threshold"`          // Consecutive failed probes before a resolver is marked down, default 1
+	HealthCheckRecovery  int    `toml:"health-check-recovery-threshold"` // Consecutive successful probes before a resolver is marked up again, default 1
+
+	// Recursive resolver options
+	RootHints           []string `toml:"root-hints"`            // IP addresses of the root servers, defaults to the IANA root servers
+	NoQNameMinimization bool     `toml:"no-qname-minimization"` // Send the full query name to all name servers
+	RecursiveIPv6       bool     `toml:"recursive-ipv6"`        // Also query name servers over IPv6
+	RecursiveTimeout    int      `toml:"recursive-timeout"`     // Time in milliseconds to wait for a name server response, default 2000
+
+	// Lowest-latency group options
+	LatencySmoothing float64 `toml:"latency-smoothing"` // Weight of new measurements in the moving average, default 0.3
+	ReprobeInterval  int     `toml:"reprobe-interval"`  // Seconds between latency measurements of slower resolvers, default 60
+	FailurePenalty   int     `toml:"failure-penalty"`   // Latency in milliseconds recorded for failed queries, default 2000
+
+	// Back-off options for fail-back groups
+	RetryInitialBackoff int     `toml:"retry-initial-backoff"` // Milliseconds a failed resolver is skipped for, disabled if 0
+	RetryMaxBackoff     int     `toml:"retry-max-backoff"`     // Upper limit of the back-off in milliseconds, default 60000
+	RetryMultiplier     float64 `toml:"retry-multiplier"`      // Factor applied to the back-off with every failure, default 2
+	RetryJitter         bool    `toml:"retry-jitter"`          // Randomize the back-off between half and all of its value
+
+	// Fastest group options
+	StartDelay int  `toml:"start-delay"` // Milliseconds to wait for a response before querying the next resolver
+	RequireAD  bool `toml:"require-ad"`  // Only accept responses with the AD flag set
+
+	// Circuit-breaker options
+	FailureThreshold int `toml:"failure-threshold"` // Consecutive failures that open the circuit, default 5
+	SuccessThreshold int `toml:"success-threshold"` // Successful queries in half-open state that close the circuit, default 1
+	OpenDuration     int `toml:"open-duration"`     // Time in seconds the circuit stays open, default 30
+	OpenRCode        int `toml:"open-rcode"`        // Response code while the circuit is open, default 2 (SERVFAIL)
+
+	// DNSSEC validator options
+	TrustAnchors  []string `toml:"trust-anchors"`  // DS records of trusted keys, defaults to the root zone KSKs
+	AllowUnsigned bool     `toml:"allow-unsigned"` // Pass unsigned responses through instead of failing them
+	KeyCacheTTL   int      `toml:"key-cache-ttl"`  // Max time in seconds to cache validated DNSKEYs, default 3600
+
 	// Cache options
 	Backend                  *cacheBackend
 	GCPeriod                 int               `toml:"gc-period"`                   // Time-period (seconds) used to expire cached items in the "cache" type. Deprecated, use backend
 	CacheSize                int               `toml:"cache-size"`                  // Max number of items to keep in the cache. Default 0 == unlimited. Deprecated, use backend
 	CacheNegativeTTL         uint32            `toml:"cache-negative-ttl"`          // TTL to apply to negative responses, default 60.
+	CacheNegative            bool              `toml:"cache-negative"`              // Cache NXDOMAIN and NODATA responses based on the SOA as per RFC2308
+	CacheNegativeMaxTTL      uint32            `toml:"cache-negative-max-ttl"`      // Max time (seconds) to cache negative responses if cache-negative is enabled
+	CacheNegativeMinTTL      uint32            `toml:"cache-negative-min-ttl"`      // Min time (seconds) to cache negative responses if cache-negative is enabled
+	CacheServfailTTL         uint32            `toml:"cache-servfail-ttl"`          // Time (seconds) to cache SERVFAIL responses, max 300, defaults to cache-negative-ttl
 	CacheAnswerShuffle       string            `toml:"cache-answer-shuffle"`        // Algorithm to use for modifying the response order of cached items
 	CacheHardenBelowNXDOMAIN bool              `toml:"cache-harden-below-nxdomain"` // Return NXDOMAIN if an NXDOMAIN is cached for a parent domain
 	CacheFlushQuery          string            `toml:"cache-flush-query"`           // Flush the cache when a query for this name is received
 	PrefetchTrigger          uint32            `toml:"cache-prefetch-trigger"`      // Prefetch when the TTL of a query has fallen below this value
 	PrefetchEligible         uint32            `toml:"cache-prefetch-eligible"`     // Only records with TTL greater than this are considered for prefetch
 	CacheRcodeMaxTTL         map[string]uint32 `toml:"cache-rcode-max-ttl"`         // Rcode specific max TTL to keep in the cache
+	CacheServeStale          uint32            `toml:"cache-serve-stale"`           // Seconds to serve expired records while refreshing them, RFC8767
+	CacheStaleAnswerTTL      uint32            `toml:"cache-stale-answer-ttl"`      // TTL of stale records in responses, default 30
 
 	// Blocklist options
 	Blocklist []string // Blocklist rules, only used by "blocklist" type
@@ -123,18 +255,33 @@ type group struct {
 	Refresh   int      // Blocklist refresh when using an external source, in seconds
 
 	// Blocklist-v2 options
-	Filter            bool     // Filter response records rather than return NXDOMAIN
-	BlockListResolver string   `toml:"blocklist-resolver"`
-	AllowListResolver string   `toml:"allowlist-resolver"`
-	BlocklistFormat   string   `toml:"blocklist-format"` // only used for static blocklists in the config
-	BlocklistSource   []list   `toml:"blocklist-source"`
-	BlocklistRefresh  int      `toml:"blocklist-refresh"`
-	Allowlist         []string // Rules to override the blocklist rules
-	AllowlistFormat   string   `toml:"allowlist-format"` // only used for static allowlists in the config
-	AllowlistSource   []list   `toml:"allowlist-source"`
-	AllowlistRefresh  int      `toml:"allowlist-refresh"`
-	LocationDB        string   `toml:"location-db"` // GeoIP database file for response blocklist. Default "/usr/share/GeoIP/GeoLite2-City.mmdb"
-	Inverted          bool     // Only allow IPs on the blocklist. Supported in response-blocklist-ip and response-blocklist-name
+	Filter            bool              // Filter response records rather than return NXDOMAIN
+	BlockListResolver string            `toml:"blocklist-resolver"`
+	AllowListResolver string            `toml:"allowlist-resolver"`
+	ActionResolvers   []string          `toml:"action-resolvers"` // Resolvers rules with a forward action can use, blocklist-v2 only
+	BlocklistFormat   string            `toml:"blocklist-format"` // only used for static blocklists in the config
+	BlocklistSource   []list            `toml:"blocklist-source"`
+	BlocklistRefresh  int               `toml:"blocklist-refresh"`
+	Allowlist         []string          // Rules to override the blocklist rules
+	AllowlistFormat   string            `toml:"allowlist-format"` // only used for static allowlists in the config
+	AllowlistSource   []list            `toml:"allowlist-source"`
+	AllowlistRefresh  int               `toml:"allowlist-refresh"`
+	LocationDB        string            `toml:"location-db"` // GeoIP database file for response blocklist. Default "/usr/share/GeoIP/GeoLite2-City.mmdb"
+	ASNDB             string            `toml:"asn-db"`      // GeoIP ASN database file for response blocklist. Default "/usr/share/GeoIP/GeoLite2-ASN.mmdb"
+	Inverted          bool              // Only allow IPs on the blocklist. Supported in response-blocklist-ip and response-blocklist-name
+	FollowCNAME       bool              `toml:"follow-cname"`        // Check CNAME targets in responses against the blocklist, blocklist-v2 only
+	AnnotateAllowed   bool              `toml:"annotate-allowed"`    // Add an EDE option with the matching allowlist rule to responses, blocklist-v2 only
+	MatchAllQuestions bool              `toml:"match-all-questions"` // Match every question of multi-question queries rather than refusing them, blocklist-v2 only
+	ReportOnly        bool              `toml:"report-only"`         // Log and count matches without blocking, blocklist-v2 only
+	IndependentReload bool              `toml:"independent-reload"`  // Reload each source list separately, keeping the last-good rules of failed ones, blocklist-v2 only
+	BlockResponse     string            `toml:"block-response"`      // Response to blocked queries: "nxdomain" (default), "refused", "nodata" or "drop", blocklist-v2 only
+	SpoofTTL          uint32            `toml:"spoof-ttl"`           // TTL of spoofed records in blocked responses, blocklist-v2 only
+	BlockSOATTL       uint32            `toml:"block-soa-ttl"`       // Add a SOA with this TTL to blocked NXDOMAIN and NODATA responses, blocklist-v2 only
+	BlockSOAMname     string            `toml:"block-soa-mname"`     // MNAME of the SOA in blocked responses
+	BlockSOARname     string            `toml:"block-soa-rname"`     // RNAME of the SOA in blocked responses
+	ClientBlocklists  []clientBlocklist `toml:"client-blocklists"`   // Blocklists only applied to clients in specific networks, blocklist-v2 only
+	Schedule          []scheduleWindow  `toml:"schedule"`            // Only enforce the blocklist during these windows, blocklist-v2 only
+	ScheduleTimezone  string            `toml:"schedule-timezone"`   // Timezone of the schedule, e.g. "Europe/Berlin". Defaults to local time
 
 	// Static responder options
 	Answer   []string
@@ -145,14 +292,35 @@ type group struct {
 		Code uint16 `toml:"code"` // Code defined in https://datatracker.ietf.org/doc/html/rfc8914
 		Text string `toml:"text"` // Extra text containing additional information
 	} `toml:"edns0-ede"` // Extended DNS Errors
-	Truncate bool `toml:"truncate"` // When true, TC-Bit is set
+	DefaultEDE bool `toml:"default-ede"` // Add EDE code 15 (Blocked) to blocked responses if no edns0-ede is set, blocklist-v2 only
+	Truncate   bool `toml:"truncate"`    // When true, TC-Bit is set
+
+	// DHCP lease options
+	LeaseFiles   []leaseFile `toml:"lease-files"`   // DHCP lease files to answer queries from
+	LeaseDomain  string      `toml:"lease-domain"`  // Domain appended to hostnames in the leases
+	LeaseTTL     uint32      `toml:"lease-ttl"`     // TTL of records in responses, default 60
+	LeaseRefresh int         `toml:"lease-refresh"` // Seconds between checks for changed lease files, default 10
+
+	// Hosts file options
+	HostsFiles []string `toml:"hosts-files"` // Files in /etc/hosts format, or directories with such files
+	HostsTTL   uint32   `toml:"hosts-ttl"`   // TTL of records in responses, default 60
+
+	// Static zone options
+	ZoneFiles []string `toml:"zone-files"` // Zone files in RFC 1035 format to answer authoritatively for
 
 	// Rate-limiting options
-	Requests      uint   // Number of requests allowed
-	Window        uint   // Time period in seconds for the requests
-	Prefix4       uint8  // Prefix bits to identify IPv4 client
-	Prefix6       uint8  // Prefix bits to identify IPv6 client
-	LimitResolver string `toml:"limit-resolver"` // Resolver to use when rate-limit exceeded
+	Requests      uint     // Number of requests allowed
+	Window        uint     // Time period in seconds for the requests
+	Prefix4       uint8    // Prefix bits to identify IPv4 client
+	Prefix6       uint8    // Prefix bits to identify IPv6 client
+	LimitResolver string   `toml:"limit-resolver"` // Resolver to use when rate-limit exceeded
+	Rate          float64  // Queries per second per client, uses a token bucket instead of windows if set
+	Burst         int      // Max queries a client can send at once when rate is used
+	MaxClients    int      `toml:"max-clients"`    // Max number of clients to track when rate is used
+	ExceededRCode int      `toml:"exceeded-rcode"` // Respond with this code to rate-limited queries instead of dropping them
+	Exempt        []string // Networks in CIDR notation that are not rate-limited
+	LimitBy       string   `toml:"limit-by"` // What the limit applies to, "client" (default), "name", or "client-name"
+	Slip          uint     // Respond to every Nth dropped query with a truncated response, 0 disables it
 
 	// Fastest-TCP probe options
 	Port          int
@@ -165,6 +333,25 @@ type group struct {
 	// Truncate-Retry options
 	RetryResolver string `toml:"retry-resolver"`
 
+	// Response-router options, using the retry-resolver
+	ResponseRcodes   []int    `toml:"response-rcodes"`   // Response codes that are retried, e.g. 3 for NXDOMAIN
+	ResponseNetworks []string `toml:"response-networks"` // Responses with addresses in these networks are retried
+	ResponseBogons   bool     `toml:"response-bogons"`   // Retry responses with private or reserved addresses
+
+	// SVCB filter options
+	SVCBStripECH     bool     `toml:"svcb-strip-ech"`      // Remove the ech parameter from SVCB and HTTPS records
+	SVCBStripIPHints bool     `toml:"svcb-strip-ip-hints"` // Remove the ipv4hint and ipv6hint parameters
+	SVCBStripALPN    []string `toml:"svcb-strip-alpn"`     // Protocols removed from the alpn parameter, e.g. "h3"
+	SVCBDrop         bool     `toml:"svcb-drop"`           // Remove all SVCB and HTTPS records from responses
+
+	// Script options
+	ScriptQuery     string   `toml:"script-query"`     // Template run for every query, prints commands like "block" or "route <resolver>"
+	ScriptResponse  string   `toml:"script-response"`  // Template run for every response
+	ScriptResolvers []string `toml:"script-resolvers"` // Resolvers the scripts can route queries to
+
+	// Client-router options
+	ClientRoutes []clientRoute `toml:"client-routes"`
+
 	// Syslog options
 	Network     string `toml:"network"`  // "udp", "tcp", "unix"
 	Address     string `toml:"address"`  // Endpoint address, defaults to local syslog server
@@ -173,15 +360,95 @@ type group struct {
 	LogRequest  bool   `toml:"log-request"`  // Logs request records to syslog
 	LogResponse bool   `toml:"log-response"` // Logs response records to syslog
 	Verbose     bool   `toml:"verbose"`      // When logging responses, include types that don't match the query type
+
+	// Access log options
+	AccessLogOutput     string   `toml:"access-log-output"`      // File to write the access log to, "syslog", or a udp:// or http(s):// URL
+	AccessLogFormat     string   `toml:"access-log-format"`      // "json" or "text"
+	AccessLogFields     []string `toml:"access-log-fields"`      // Fields to include in access log records
+	AccessLogMaxSize    int      `toml:"access-log-max-size"`    // Size in MB at which the access log file is rotated, no rotation if 0
+	AccessLogMaxBackups int      `toml:"access-log-max-backups"` // Number of rotated access log files to keep
+
+	// Dnstap options
+	DnstapOutput      string `toml:"dnstap-output"`       // unix:// or tcp:// URL of a dnstap collector, or a file
+	DnstapIdentity    string `toml:"dnstap-identity"`     // Server identity in dnstap messages
+	DnstapVersion     string `toml:"dnstap-version"`      // Server version in dnstap messages, defaults to the routedns version
+	DnstapMessageType string `toml:"dnstap-message-type"` // "client" or "forwarder"
+
+	// Captive portal options
+	PortalIPs     []string `toml:"portal-ips"`     // IPs of the portal returned to unauthorized clients
+	AllowedNet    []string `toml:"allowed-net"`    // Networks of clients that are always authorized
+	WalledGarden  []string `toml:"walled-garden"`  // Domains that are resolved normally for unauthorized clients
+	NXDomainOnly  bool     `toml:"nxdomain-only"`  // Only rewrite NXDOMAIN responses of unauthorized clients
+	PortalTTL     uint32   `toml:"portal-ttl"`     // TTL of portal records, default 0
+	ClientTimeout int      `toml:"client-timeout"` // Time in seconds after which authorized clients expire, no expiry if 0
+}
+
+// Blocklist for specific clients in blocklist-v2
+type clientBlocklist struct {
+	Network         []string // List of networks in CIDR notation
+	DoHPath         string   `toml:"doh-path"`        // Regexp matching the DoH query path
+	TLSServerName   string   `toml:"tls-server-name"` // Regexp matching the TLS SNI server name
+	TLSClientName   string   `toml:"tls-client-name"` // Regexp matching an identity in the TLS client certificate
+	Replace         bool     // Use instead of the default lists, rather than in addition to them
+	Blocklist       []string // Static blocklist rules
+	BlocklistFormat string   `toml:"blocklist-format"` // only used for static blocklists in the config
+	BlocklistSource []list   `toml:"blocklist-source"`
+	Allowlist       []string // Static allowlist rules
+	AllowlistFormat string   `toml:"allowlist-format"` // only used for static allowlists in the config
+	AllowlistSource []list   `toml:"allowlist-source"`
+}
+
+// Time window in a blocklist or route schedule
+type scheduleWindow struct {
+	Weekdays []string // "mon", "tue", "wed", "thu", "fri", "sat", "sun". Every day if empty
+	Start    string   // "HH:MM"
+	End      string   // "HH:MM", can be before start for windows that end the next day
+}
+
+// DHCP lease file
+type leaseFile struct {
+	Path   string
+	Format string // "dnsmasq", "isc", or "kea"
+}
+
+// Rule of a response-modifier
+type responseRule struct {
+	Name       string   // Regexp matching the query name, all names if empty
+	Types      []string // Query types the rule applies to, all types if empty
+	TTLMin     uint32   `toml:"ttl-min"`     // Minimum TTL of records in the response
+	TTLMax     uint32   `toml:"ttl-max"`     // Maximum TTL of records in the response, no limit if 0
+	StripTypes []string `toml:"strip-types"` // Remove records of these types from the response
+	StripEDNS0 []uint16 `toml:"strip-edns0"` // Remove EDNS0 options with these codes from the response
 }
 
 // Block/Allowlist items for blocklist-v2
 type list struct {
-	Name         string
-	Format       string
-	Source       string
-	CacheDir     string `toml:"cache-dir"`     // Where to store copies of remote blocklists for faster startup
-	AllowFailure bool   `toml:"allow-failure"` // Don't fail on error and keep using the prior ruleset
+	Name               string
+	Format             string
+	Source             string
+	CacheDir           string    `toml:"cache-dir"`     // Where to store copies of remote blocklists for faster startup
+	AllowFailure       bool      `toml:"allow-failure"` // Don't fail on error and keep using the prior ruleset
+	Redis              redisList // Connection options for lists with format "redis"
+	WildcardSubdomains bool      `toml:"wildcard-subdomains"`       // Rules match subdomains too, format "trie" only
+	BloomRate          float64   `toml:"bloom-false-positive-rate"` // Enables a bloom filter for lists without wildcards, format "domain" only
+}
+
+// Redis options of blocklists stored in Redis
+type redisList struct {
+	Network   string
+	Address   string
+	Username  string
+	Password  string
+	DB        int
+	KeyPrefix string  `toml:"key-prefix"`
+	Bloom     bool    // Keep a local bloom filter to avoid lookups in Redis for names that don't match
+	BloomRate float64 `toml:"bloom-false-positive-rate"`
+}
+
+// Client network to resolver mapping used in client-router groups
+type clientRoute struct {
+	Network  []string // List of networks in CIDR notation
+	Resolver string
 }
 
 type router struct {
@@ -189,18 +456,26 @@ type router struct {
 }
 
 type route struct {
-	Type          string // Deprecated, use "Types" instead
-	Types         []string
-	Class         string
-	Name          string
-	Source        string
-	Weekdays      []string // 'mon', 'tue', 'wed', 'thu', 'fri', 'sat', 'sun'
-	After, Before string   // Hour:Minute in 24h format, for example "14:30"
-	Invert        bool     // Invert the result of the match
-	DoHPath       string   `toml:"doh-path"` // DoH query path if received over DoH (regexp)
-	Resolver      string
-	Listener      string // ID of the listener that received the original request
-	TLSServerName string `toml:"servername"` // TLS servername
+	Type             string // Deprecated, use "Types" instead
+	Types            []string
+	Class            string
+	Name             string
+	Source           string
+	Weekdays         []string         // 'mon', 'tue', 'wed', 'thu', 'fri', 'sat', 'sun'
+	After, Before    string           // Hour:Minute in 24h format, for example "14:30"
+	Schedule         []scheduleWindow // Only match during these windows
+	ScheduleTimezone string           `toml:"schedule-timezone"` // Timezone of the schedule, defaults to local time
+	Invert           bool             // Invert the result of the match
+	DoHPath          string           `toml:"doh-path"` // DoH query path if received over DoH (regexp)
+	Resolver         string
+	Listener         string   // ID of the listener that received the original request
+	TLSServerName    string   `toml:"servername"`      // TLS servername
+	TLSClientName    string   `toml:"tls-client-name"` // Identity of the TLS client certificate (regexp)
+	DO               *bool    // DNSSEC OK bit set (true) or not set (false)
+	CD               *bool    // Checking Disabled flag set (true) or not set (false)
+	EDNS0Options     []uint16 `toml:"edns0-options"` // Codes of EDNS0 options that have to be present
+	MinSize          int      `toml:"min-size"`      // Minimum query size in bytes
+	MaxSize          int      `toml:"max-size"`      // Maximum query size in bytes
 }
 
 // LoadConfig reads a config file and returns the decoded structure.
@@ -213,7 +488,8 @@ func loadConfig(name ...string) (config, error) {
 		}
 		b.WriteString("\n")
 	}
-	_, err := toml.DecodeReader(b, &c)
+	md, err := toml.DecodeReader(b, &c)
+	c.undecoded = md.Undecoded()
 	return c, err
 }
 
@@ -238,3 +514,15 @@ func parseCIDRList(networks []string) ([]*net.IPNet, error) {
 	}
 	return out, nil
 }
+
+func parseRRTypes(types []string) ([]uint16, error) {
+	var out []uint16
+	for _, s := range types {
+		t, ok := dns.StringToType[strings.ToUpper(s)]
+		if !ok {
+			return out, fmt.Errorf("unknown record type %q", s)
+		}
+		out = append(out, t)
+	}
+	return out, nil
+}
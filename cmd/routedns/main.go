@@ -1,28 +1,37 @@
 package main
 
 import (
+	"crypto/ed25519"
 	"crypto/tls"
+	"encoding/hex"
 	"errors"
 	"fmt"
+	"io"
 	"net"
 	"net/url"
 	"os"
 	"os/signal"
+	"regexp"
 	"strconv"
+	"strings"
 	"syscall"
 	"time"
 
 	syslog "github.com/RackSec/srslog"
 	rdns "github.com/folbricht/routedns"
 	"github.com/heimdalr/dag"
+	"github.com/miekg/dns"
 	"github.com/redis/go-redis/v9"
 	"github.com/sirupsen/logrus"
 	"github.com/spf13/cobra"
 )
 
 type options struct {
-	logLevel uint32
-	version  bool
+	logLevel  uint32
+	version   bool
+	validate  bool
+	dryRun    bool
+	hotReload bool
 }
 
 func main() {
@@ -55,6 +64,9 @@ arguments.
 
 	cmd.Flags().Uint32VarP(&opt.logLevel, "log-level", "l", 4, "log level; 0=None .. 6=Trace")
 	cmd.Flags().BoolVarP(&opt.version, "version", "v", false, "Prints code version string")
+	cmd.Flags().BoolVar(&opt.validate, "validate", false, "Validate the configuration and exit")
+	cmd.Flags().BoolVar(&opt.dryRun, "dry-run", false, "Validate the configuration, instantiate all elements without starting the listeners, and exit")
+	cmd.Flags().BoolVar(&opt.hotReload, "hot-reload", false, "Reload the configuration on SIGHUP instead of only the blocklists")
 
 	if err := cmd.Execute(); err != nil {
 		os.Exit(1)
@@ -96,55 +108,158 @@ func start(opt options, args []string) error {
 	if err != nil {
 		return err
 	}
+	if err := ValidateConfig(&config); err != nil {
+		return err
+	}
+	for _, w := range unusedElements(&config) {
+		if opt.validate || opt.dryRun {
+			fmt.Fprintln(os.Stderr, "warning:", w)
+		} else {
+			rdns.Log.Warn(w)
+		}
+	}
+	if opt.validate {
+		fmt.Println("configuration is valid")
+		return nil
+	}
+
+	resolvers, err := buildResolvers(&config)
+	if err != nil {
+		return err
+	}
+
+	// Build the Listeners last as they can point to routers, groups or resolvers directly.
+	// The resolvers are wrapped so they can be replaced when the configuration is reloaded.
+	r := newReloader(args)
+	r.setElements(resolvers)
+	var listeners []rdns.Listener
+	for id, l := range config.Listeners {
+		var (
+			handle   *rdns.HotSwapResolver
+			resolver rdns.Resolver
+		)
+		// All Listeners should route queries (except the admin service and ODoH relays).
+		if l.Protocol != "admin" && l.Protocol != "odoh-relay" {
+			target, ok := resolvers[l.Resolver]
+			if !ok {
+				return fmt.Errorf("listener '%s' references non-existent resolver, group or router '%s'", id, l.Resolver)
+			}
+			handle = rdns.NewHotSwapResolver(target)
+			resolver = handle
+		}
+		acl, err := newACL(id, l)
+		if err != nil {
+			return err
+		}
+		ln, err := newListener(id, l, acl, resolver, r.reload, r.elements)
+		if err != nil {
+			return elementError("listener", id, err)
+		}
+		listeners = append(listeners, ln)
+		r.add(id, l, handle, acl)
+	}
+	if opt.dryRun {
+		fmt.Println("configuration is valid")
+		return nil
+	}
+
+	if opt.hotReload {
+		// Reload the whole configuration on SIGHUP
+		r.registerSignal()
+	} else {
+		// Reload blocklists on SIGHUP
+		var reloadable []rdns.ReloadableResolver
+		for _, r := range resolvers {
+			if rr, ok := r.(rdns.ReloadableResolver); ok {
+				reloadable = append(reloadable, rr)
+			}
+		}
+		reloadable = append(reloadable, r.acls()...)
+		rdns.RegisterSignalReload(reloadable...)
+	}
 
+	// Start the listeners
+	for _, l := range listeners {
+		go func(l rdns.Listener) {
+			for {
+				err := l.Start()
+				rdns.Log.WithError(err).Error("listener failed")
+				time.Sleep(time.Second)
+			}
+		}(l)
+	}
+
+	// Graceful shutdown
+	sig := make(chan os.Signal, 1)
+	signal.Notify(sig, os.Interrupt, syscall.SIGTERM)
+	<-sig
+	rdns.Log.Info("stopping")
+	r.close()
+
+	return nil
+}
+
+// Instantiate all resolvers, groups and routers of the configuration and return them
+// by ID.
+func buildResolvers(config *config) (map[string]rdns.Resolver, error) {
 	// Map to hold all the resolvers extracted from the config, key'ed by resolver ID. It
 	// holds configured resolvers, groups, as well as routers (since they all implement
 	// rdns.Resolver)
 	resolvers := make(map[string]rdns.Resolver)
 
-	// See if a bootstrap-resolver was defined in the config. If so, instantiate it,
-	// wrap it in a net.Resolver wrapper and replace the net.DefaultResolver with it
-	// for all other entities to use.
+	// See if bootstrap resolvers were defined in the config. If so, instantiate them,
+	// wrap them in a net.Resolver wrapper and replace the net.DefaultResolver with it
+	// for all other entities to use. Upstream resolvers use them to lookup and
+	// refresh the addresses of their servers.
+	var (
+		bootstrapResolvers []rdns.Resolver
+		bootstrapper       *rdns.Bootstrapper
+	)
 	if config.BootstrapResolver.Address != "" {
-		if err := instantiateResolver("bootstrap-resolver", config.BootstrapResolver, resolvers); err != nil {
-			return fmt.Errorf("failed to instantiate bootstrap-resolver: %w", err)
+		if err := instantiateResolver("bootstrap-resolver", config.BootstrapResolver, resolvers, nil); err != nil {
+			return nil, fmt.Errorf("failed to instantiate bootstrap-resolver: %w", err)
+		}
+		bootstrapResolvers = append(bootstrapResolvers, resolvers["bootstrap-resolver"])
+	}
+	for i, r := range config.BootstrapResolvers {
+		id := fmt.Sprintf("bootstrap-resolver-%d", i)
+		if err := instantiateResolver(id, r, resolvers, nil); err != nil {
+			return nil, fmt.Errorf("failed to instantiate bootstrap-resolvers: %w", err)
+		}
+		bootstrapResolvers = append(bootstrapResolvers, resolvers[id])
+	}
+	if len(bootstrapResolvers) > 0 {
+		bootstrap := bootstrapResolvers[0]
+		if len(bootstrapResolvers) > 1 {
+			bootstrap = rdns.NewFailRotate("bootstrap-resolvers", rdns.FailRotateOptions{}, bootstrapResolvers...)
 		}
-		net.DefaultResolver = rdns.NewNetResolver(resolvers["bootstrap-resolver"])
+		net.DefaultResolver = rdns.NewNetResolver(bootstrap)
+		bootstrapper = rdns.NewBootstrapper(bootstrapResolvers...)
 	}
 	// Add all types of nodes to a DAG, this is to find duplicates. Then populate the edges (dependencies).
 	graph := dag.NewDAG()
-	edges := make(map[string][]string)
 	for id, v := range config.Resolvers {
 		node := &Node{id, v}
 		_, err := graph.AddVertex(node)
 		if err != nil {
-			return err
+			return nil, err
 		}
 	}
 	for id, v := range config.Groups {
 		node := &Node{id, v}
 		_, err := graph.AddVertex(node)
 		if err != nil {
-			return err
+			return nil, err
 		}
-		edges[id] = append(v.Resolvers, v.AllowListResolver, v.BlockListResolver, v.LimitResolver, v.RetryResolver)
 	}
 	for id, v := range config.Routers {
 		node := &Node{id, v}
 		_, err := graph.AddVertex(node)
 		if err != nil {
-			return err
-		}
-		// One router can have multiple edges to the same resolver.
-		// Dedup them before adding to the list of edges.
-		dep := make(map[string]struct{})
-		for _, route := range v.Routes {
-			dep[route.Resolver] = struct{}{}
-		}
-		for r := range dep {
-			edges[id] = append(edges[id], r)
+			return nil, err
 		}
 	}
+	edges := configDependencies(config)
 	// Add the edges to the DAG. This will fail if there are duplicate edges, recursion or missing nodes
 	for id, es := range edges {
 		for _, e := range es {
@@ -152,7 +267,7 @@ func start(opt options, args []string) error {
 				continue
 			}
 			if err := graph.AddEdge(id, e); err != nil {
-				return err
+				return nil, err
 			}
 		}
 	}
@@ -163,151 +278,240 @@ func start(opt options, args []string) error {
 		for id, v := range leaves {
 			node := v.(*Node)
 			if r, ok := node.value.(resolver); ok {
-				if err := instantiateResolver(id, r, resolvers); err != nil {
-					return err
+				if err := instantiateResolver(id, r, resolvers, bootstrapper); err != nil {
+					return nil, elementError("resolver", id, err)
 				}
 			}
 			if g, ok := node.value.(group); ok {
 				if err := instantiateGroup(id, g, resolvers); err != nil {
-					return err
+					return nil, elementError("group", id, err)
+				}
+				// Groups with background jobs or outputs are closed when
+				// they're replaced on reload, or on shutdown
+				if c, ok := resolvers[id].(io.Closer); ok {
+					onClose = append(onClose, func() { c.Close() })
 				}
 			}
 			if r, ok := node.value.(router); ok {
 				if err := instantiateRouter(id, r, resolvers); err != nil {
-					return err
+					return nil, elementError("router", id, err)
 				}
 			}
 			if err := graph.DeleteVertex(id); err != nil {
-				return err
+				return nil, err
 			}
 		}
 	}
+	return resolvers, nil
+}
 
-	// Build the Listeners last as they can point to routers, groups or resolvers directly.
-	var listeners []rdns.Listener
-	for id, l := range config.Listeners {
-		resolver, ok := resolvers[l.Resolver]
-		// All Listeners should route queries (except the admin service).
-		if !ok && l.Protocol != "admin" {
-			return fmt.Errorf("listener '%s' references non-existent resolver, group or router '%s'", id, l.Resolver)
-		}
-		allowedNet, err := parseCIDRList(l.AllowedNet)
+// Instantiate the ACL of a listener. Returns nil if the listener has no
+// access control rules.
+func newACL(id string, l listener) (*rdns.ACL, error) {
+	if len(l.ACL) == 0 && l.ACLFile == "" {
+		return nil, nil
+	}
+	opt := rdns.ACLOptions{
+		Rules:         l.ACL,
+		Refresh:       time.Duration(l.ACLRefresh) * time.Second,
+		DefaultAction: rdns.ACLRefuse,
+	}
+	if l.ACLDefault != "" {
+		action, err := rdns.ParseACLAction(l.ACLDefault)
 		if err != nil {
-			return err
+			return nil, fmt.Errorf("listener '%s': %w", id, err)
 		}
+		opt.DefaultAction = action
+	}
+	if l.ACLFile != "" {
+		opt.Loader = rdns.NewFileLoader(l.ACLFile, rdns.FileLoaderOptions{})
+	}
+	acl, err := rdns.NewACL(id, opt)
+	if err != nil {
+		return nil, fmt.Errorf("listener '%s': %w", id, err)
+	}
+	return acl, nil
+}
 
-		opt := rdns.ListenOptions{AllowedNet: allowedNet}
+// Instantiate a listener. The resolver is nil for admin listeners, reload and
+// elements are made available to them if enabled in the configuration.
+func newListener(id string, l listener, acl *rdns.ACL, resolver rdns.Resolver, reload func() error, elements func() map[string]rdns.Resolver) (rdns.Listener, error) {
+	allowedNet, err := parseCIDRList(l.AllowedNet)
+	if err != nil {
+		return nil, err
+	}
 
-		switch l.Protocol {
-		case "tcp":
-			l.Address = rdns.AddressWithDefault(l.Address, rdns.PlainDNSPort)
-			listeners = append(listeners, rdns.NewDNSListener(id, l.Address, "tcp", opt, resolver))
-		case "udp":
-			l.Address = rdns.AddressWithDefault(l.Address, rdns.PlainDNSPort)
-			listeners = append(listeners, rdns.NewDNSListener(id, l.Address, "udp", opt, resolver))
-		case "admin":
-			tlsConfig, err := rdns.TLSServerConfig(l.CA, l.ServerCrt, l.ServerKey, l.MutualTLS)
-			if err != nil {
-				return err
-			}
-			opt := rdns.AdminListenerOptions{
-				TLSConfig:     tlsConfig,
-				ListenOptions: opt,
-				Transport:     l.Transport,
-			}
-			ln, err := rdns.NewAdminListener(id, l.Address, opt)
-			if err != nil {
-				return err
-			}
-			listeners = append(listeners, ln)
-		case "dot":
-			l.Address = rdns.AddressWithDefault(l.Address, rdns.DoTPort)
-			tlsConfig, err := rdns.TLSServerConfig(l.CA, l.ServerCrt, l.ServerKey, l.MutualTLS)
-			if err != nil {
-				return err
+	proxyProtocolNet, err := parseCIDRList(l.ProxyProtocolNet)
+	if err != nil {
+		return nil, err
+	}
+	if l.ProxyProtocol && l.Protocol != "tcp" && l.Protocol != "dot" && (l.Protocol != "doh" || l.Transport == "quic") {
+		return nil, fmt.Errorf("listener '%s' doesn't support proxy-protocol", id)
+	}
+
+	if l.BindInterface != "" && l.Protocol != "udp" && l.Protocol != "tcp" && l.Protocol != "dot" && (l.Protocol != "doh" || l.Transport == "quic") {
+		return nil, fmt.Errorf("listener '%s' doesn't support bind-interface", id)
+	}
+	if l.InterfaceAddresses != "" && l.Protocol != "udp" && l.Protocol != "tcp" && l.Protocol != "dot" {
+		return nil, fmt.Errorf("listener '%s' doesn't support interface-addresses", id)
+	}
+	if l.MaxUDPSize > 0 && l.Protocol != "udp" && l.Protocol != "dtls" {
+		return nil, fmt.Errorf("listener '%s' doesn't support max-udp-size", id)
+	}
+	if l.QueryDeadline > 0 && (l.Protocol == "admin" || l.Protocol == "odoh-relay") {
+		return nil, fmt.Errorf("listener '%s' doesn't support query-deadline", id)
+	}
+	if (l.Allow0RTT || l.MaxStreams > 0 || l.IdleTimeout > 0) && l.Protocol != "doq" {
+		return nil, fmt.Errorf("listener '%s' doesn't support enable-0rtt, max-streams or idle-timeout", id)
+	}
+
+	opt := rdns.ListenOptions{
+		AllowedNet:       allowedNet,
+		ACL:              acl,
+		ProxyProtocol:    l.ProxyProtocol,
+		ProxyProtocolNet: proxyProtocolNet,
+		BindInterface:    l.BindInterface,
+		InterfaceAddrs:   l.InterfaceAddresses,
+		InterfaceRefresh: time.Duration(l.InterfaceRefresh) * time.Second,
+		MaxUDPSize:       l.MaxUDPSize,
+		QueryDeadline:    time.Duration(l.QueryDeadline) * time.Millisecond,
+	}
+
+	switch l.Protocol {
+	case "tcp":
+		l.Address = rdns.AddressWithDefault(l.Address, rdns.PlainDNSPort)
+		return rdns.NewDNSListener(id, l.Address, "tcp", opt, resolver), nil
+	case "udp":
+		l.Address = rdns.AddressWithDefault(l.Address, rdns.PlainDNSPort)
+		return rdns.NewDNSListener(id, l.Address, "udp", opt, resolver), nil
+	case "admin":
+		tlsConfig, err := rdns.TLSServerConfig(l.CA, l.ServerCrt, l.ServerKey, l.MutualTLS)
+		if err != nil {
+			return nil, err
+		}
+		opt := rdns.AdminListenerOptions{
+			TLSConfig:     tlsConfig,
+			ListenOptions: opt,
+			Transport:     l.Transport,
+			Prometheus:    l.Prometheus,
+		}
+		if l.ReloadAPI {
+			opt.Reload = reload
+		}
+		if l.APIToken != "" {
+			opt.Elements = elements
+			opt.APIToken = l.APIToken
+		}
+		ln, err := rdns.NewAdminListener(id, l.Address, opt)
+		if err != nil {
+			return nil, err
+		}
+		return ln, nil
+	case "dot":
+		l.Address = rdns.AddressWithDefault(l.Address, rdns.DoTPort)
+		tlsConfig, err := rdns.TLSServerConfig(l.CA, l.ServerCrt, l.ServerKey, l.MutualTLS)
+		if err != nil {
+			return nil, err
+		}
+		ln := rdns.NewDoTListener(id, l.Address, rdns.DoTListenerOptions{TLSConfig: tlsConfig, ListenOptions: opt}, resolver)
+		return ln, nil
+	case "dtls":
+		l.Address = rdns.AddressWithDefault(l.Address, rdns.DTLSPort)
+		dtlsConfig, err := rdns.DTLSServerConfig(l.CA, l.ServerCrt, l.ServerKey, l.MutualTLS)
+		if err != nil {
+			return nil, err
+		}
+		ln := rdns.NewDTLSListener(id, l.Address, rdns.DTLSListenerOptions{DTLSConfig: dtlsConfig, ListenOptions: opt}, resolver)
+		return ln, nil
+	case "doh":
+		if l.Transport != "quic" {
+			l.Address = rdns.AddressWithDefault(l.Address, rdns.DoHPort)
+		} else if l.Transport == "quic" {
+			l.Address = rdns.AddressWithDefault(l.Address, rdns.DohQuicPort)
+		}
+		var tlsConfig *tls.Config
+		if l.NoTLS {
+			if l.Transport == "quic" {
+				return nil, errors.New("no-tls is not supported for doh servers with quic transport")
 			}
-			ln := rdns.NewDoTListener(id, l.Address, rdns.DoTListenerOptions{TLSConfig: tlsConfig, ListenOptions: opt}, resolver)
-			listeners = append(listeners, ln)
-		case "dtls":
-			l.Address = rdns.AddressWithDefault(l.Address, rdns.DTLSPort)
-			dtlsConfig, err := rdns.DTLSServerConfig(l.CA, l.ServerCrt, l.ServerKey, l.MutualTLS)
+		} else {
+			fmt.Println("p4")
+			tlsConfig, err = rdns.TLSServerConfig(l.CA, l.ServerCrt, l.ServerKey, l.MutualTLS)
 			if err != nil {
-				return err
+				return nil, err
 			}
-			ln := rdns.NewDTLSListener(id, l.Address, rdns.DTLSListenerOptions{DTLSConfig: dtlsConfig, ListenOptions: opt}, resolver)
-			listeners = append(listeners, ln)
-		case "doh":
-			if l.Transport != "quic" {
-				l.Address = rdns.AddressWithDefault(l.Address, rdns.DoHPort)
-			} else if l.Transport == "quic" {
-				l.Address = rdns.AddressWithDefault(l.Address, rdns.DohQuicPort)
-			}
-			var tlsConfig *tls.Config
-			if l.NoTLS {
-				if l.Transport == "quic" {
-					return errors.New("no-tls is not supported for doh servers with quic transport")
-				}
-			} else {
-				fmt.Println("p4")
-				tlsConfig, err = rdns.TLSServerConfig(l.CA, l.ServerCrt, l.ServerKey, l.MutualTLS)
-				if err != nil {
-					return err
-				}
-			}
-			var httpProxyNet *net.IPNet
-			if l.Frontend.HTTPProxyNet != "" {
-				_, httpProxyNet, err = net.ParseCIDR(l.Frontend.HTTPProxyNet)
-				if err != nil {
-					return fmt.Errorf("listener '%s' trusted-proxy '%s': %v", id, l.Frontend.HTTPProxyNet, err)
-				}
-			}
-			opt := rdns.DoHListenerOptions{
-				TLSConfig:     tlsConfig,
-				ListenOptions: opt,
-				Transport:     l.Transport,
-				HTTPProxyNet:  httpProxyNet,
-				NoTLS:         l.NoTLS,
-			}
-			ln, err := rdns.NewDoHListener(id, l.Address, opt, resolver)
+		}
+		var httpProxyNet *net.IPNet
+		if l.Frontend.HTTPProxyNet != "" {
+			_, httpProxyNet, err = net.ParseCIDR(l.Frontend.HTTPProxyNet)
 			if err != nil {
-				return err
+				return nil, fmt.Errorf("listener '%s' trusted-proxy '%s': %v", id, l.Frontend.HTTPProxyNet, err)
 			}
-			listeners = append(listeners, ln)
-		case "doq":
-			l.Address = rdns.AddressWithDefault(l.Address, rdns.DoQPort)
+		}
+		opt := rdns.DoHListenerOptions{
+			TLSConfig:     tlsConfig,
+			ListenOptions: opt,
+			Transport:     l.Transport,
+			HTTPProxyNet:  httpProxyNet,
+			NoTLS:         l.NoTLS,
+			EnableJSON:    l.EnableJSON,
+			JSONPath:      l.JSONPath,
+			Paths:         l.Paths,
+		}
+		ln, err := rdns.NewDoHListener(id, l.Address, opt, resolver)
+		if err != nil {
+			return nil, err
+		}
+		return ln, nil
+	case "doq":
+		l.Address = rdns.AddressWithDefault(l.Address, rdns.DoQPort)
+
+		tlsConfig, err := rdns.TLSServerConfig(l.CA, l.ServerCrt, l.ServerKey, l.MutualTLS)
+		if err != nil {
+			return nil, err
+		}
+		ln := rdns.NewQUICListener(id, l.Address, rdns.DoQListenerOptions{
+			ListenOptions: opt,
+			TLSConfig:     tlsConfig,
+			Allow0RTT:     l.Allow0RTT,
+			MaxStreams:    l.MaxStreams,
+			IdleTimeout:   time.Duration(l.IdleTimeout) * time.Second,
+		}, resolver)
+		return ln, nil
+	case "dnscrypt":
+		l.Address = rdns.AddressWithDefault(l.Address, rdns.DNSCryptPort)
 
-			tlsConfig, err := rdns.TLSServerConfig(l.CA, l.ServerCrt, l.ServerKey, l.MutualTLS)
+		seed, err := hex.DecodeString(l.ProviderKey)
+		if err != nil || len(seed) != ed25519.SeedSize {
+			return nil, fmt.Errorf("listener '%s' requires a provider-key with a hex-encoded %d byte seed", id, ed25519.SeedSize)
+		}
+		opt := rdns.DNSCryptListenerOptions{
+			ListenOptions: opt,
+			ProviderName:  l.ProviderName,
+			ProviderKey:   ed25519.NewKeyFromSeed(seed),
+			CertLifetime:  time.Duration(l.CertLifetime) * time.Hour,
+			XSalsa20:      l.XSalsa20,
+		}
+		return rdns.NewDNSCryptListener(id, l.Address, opt, resolver)
+	case "odoh-relay":
+		l.Address = rdns.AddressWithDefault(l.Address, rdns.DoHPort)
+		var tlsConfig *tls.Config
+		if !l.NoTLS {
+			tlsConfig, err = rdns.TLSServerConfig(l.CA, l.ServerCrt, l.ServerKey, l.MutualTLS)
 			if err != nil {
-				return err
+				return nil, err
 			}
-			ln := rdns.NewQUICListener(id, l.Address, rdns.DoQListenerOptions{TLSConfig: tlsConfig, ListenOptions: opt}, resolver)
-			listeners = append(listeners, ln)
-		default:
-			return fmt.Errorf("unsupported protocol '%s' for listener '%s'", l.Protocol, id)
 		}
+		opt := rdns.ODoHRelayOptions{
+			ListenOptions:  opt,
+			TLSConfig:      tlsConfig,
+			NoTLS:          l.NoTLS,
+			AllowedTargets: l.AllowedTargets,
+		}
+		return rdns.NewODoHRelay(id, l.Address, opt)
+	default:
+		return nil, fmt.Errorf("unsupported protocol '%s' for listener '%s'", l.Protocol, id)
 	}
-
-	// Start the listeners
-	for _, l := range listeners {
-		go func(l rdns.Listener) {
-			for {
-				err := l.Start()
-				rdns.Log.WithError(err).Error("listener failed")
-				time.Sleep(time.Second)
-			}
-		}(l)
-	}
-
-	// Graceful shutdown
-	sig := make(chan os.Signal, 1)
-	signal.Notify(sig, os.Interrupt, syscall.SIGTERM, syscall.SIGHUP)
-	<-sig
-	rdns.Log.Info("stopping")
-	for _, f := range onClose {
-		f()
-	}
-
-	return nil
 }
 
 // Instantiate a group object based on configuration and add to the map of resolvers by ID.
@@ -323,7 +527,19 @@ func instantiateGroup(id string, g group, resolvers map[string]rdns.Resolver) er
 	}
 	switch g.Type {
 	case "round-robin":
-		resolvers[id] = rdns.NewRoundRobin(id, gr...)
+		if len(g.Weights) > 0 && len(g.Weights) != len(gr) {
+			return fmt.Errorf("group '%s' has %d weights for %d resolvers", id, len(g.Weights), len(gr))
+		}
+		for _, w := range g.Weights {
+			if w < 1 {
+				return fmt.Errorf("group '%s' has invalid weight %d, must be at least 1", id, w)
+			}
+		}
+		opt := rdns.RoundRobinOptions{
+			Weights: g.Weights,
+			Sticky:  g.Sticky,
+		}
+		resolvers[id] = rdns.NewRoundRobinWithOptions(id, opt, gr...)
 	case "fail-rotate":
 		opt := rdns.FailRotateOptions{
 			ServfailError: g.ServfailError,
@@ -333,10 +549,38 @@ func instantiateGroup(id string, g group, resolvers map[string]rdns.Resolver) er
 		opt := rdns.FailBackOptions{
 			ResetAfter:    time.Duration(time.Duration(g.ResetAfter) * time.Second),
 			ServfailError: g.ServfailError,
+			HealthCheck: rdns.HealthCheckOptions{
+				Interval:         time.Duration(g.HealthCheckInterval) * time.Second,
+				Timeout:          time.Duration(g.HealthCheckTimeout) * time.Second,
+				Query:            g.HealthCheckQuery,
+				ThresholdFails:   g.HealthCheckThreshold,
+				ThresholdSuccess: g.HealthCheckRecovery,
+			},
+			RetryPolicy: rdns.RetryPolicy{
+				InitialBackoff: time.Duration(g.RetryInitialBackoff) * time.Millisecond,
+				MaxBackoff:     time.Duration(g.RetryMaxBackoff) * time.Millisecond,
+				Multiplier:     g.RetryMultiplier,
+				Jitter:         g.RetryJitter,
+			},
 		}
 		resolvers[id] = rdns.NewFailBack(id, opt, gr...)
 	case "fastest":
-		resolvers[id] = rdns.NewFastest(id, gr...)
+		opt := rdns.RacingOptions{
+			StartDelay: time.Duration(g.StartDelay) * time.Millisecond,
+			RequireAD:  g.RequireAD,
+		}
+		resolvers[id], err = rdns.NewRacingResolver(id, gr, opt)
+		if err != nil {
+			return err
+		}
+	case "lowest-latency":
+		opt := rdns.LowestLatencyOptions{
+			Smoothing:       g.LatencySmoothing,
+			ReprobeInterval: time.Duration(g.ReprobeInterval) * time.Second,
+			FailurePenalty:  time.Duration(g.FailurePenalty) * time.Millisecond,
+			ServfailError:   g.ServfailError,
+		}
+		resolvers[id] = rdns.NewLowestLatency(id, opt, gr...)
 	case "random":
 		opt := rdns.RandomOptions{
 			ResetAfter:    time.Duration(time.Duration(g.ResetAfter) * time.Second),
@@ -379,15 +623,7 @@ func instantiateGroup(id string, g group, resolvers map[string]rdns.Resolver) er
 				return err
 			}
 		} else {
-			var dbs []rdns.BlocklistDB
-			for _, s := range g.BlocklistSource {
-				db, err := newBlocklistDB(s, nil)
-				if err != nil {
-					return fmt.Errorf("%s: %w", id, err)
-				}
-				dbs = append(dbs, db)
-			}
-			blocklistDB, err = rdns.NewMultiDB(dbs...)
+			blocklistDB, err = newBlocklistSourceDB(id, g.BlocklistSource, g.IndependentReload)
 			if err != nil {
 				return err
 			}
@@ -399,15 +635,7 @@ func instantiateGroup(id string, g group, resolvers map[string]rdns.Resolver) er
 				return err
 			}
 		} else {
-			var dbs []rdns.BlocklistDB
-			for _, s := range g.AllowlistSource {
-				db, err := newBlocklistDB(s, nil)
-				if err != nil {
-					return fmt.Errorf("%s: %w", id, err)
-				}
-				dbs = append(dbs, db)
-			}
-			allowlistDB, err = rdns.NewMultiDB(dbs...)
+			allowlistDB, err = newBlocklistSourceDB(id, g.AllowlistSource, g.IndependentReload)
 			if err != nil {
 				return err
 			}
@@ -416,6 +644,74 @@ func instantiateGroup(id string, g group, resolvers map[string]rdns.Resolver) er
 		if err != nil {
 			return fmt.Errorf("failed to parse edn0 template in %q: %w", id, err)
 		}
+		var scoped []rdns.ScopedBlocklist
+		for i, c := range g.ClientBlocklists {
+			networks, err := parseCIDRList(c.Network)
+			if err != nil {
+				return fmt.Errorf("failed to parse client-blocklists in '%s': %w", id, err)
+			}
+			if len(c.Blocklist) > 0 && len(c.BlocklistSource) > 0 {
+				return fmt.Errorf("static blocklist can't be used with 'source' in client-blocklist %d of '%s'", i, id)
+			}
+			if len(c.Allowlist) > 0 && len(c.AllowlistSource) > 0 {
+				return fmt.Errorf("static allowlist can't be used with 'source' in client-blocklist %d of '%s'", i, id)
+			}
+			s := rdns.ScopedBlocklist{Networks: networks, Replace: c.Replace}
+			if c.DoHPath != "" {
+				if s.DoHPath, err = regexp.Compile(c.DoHPath); err != nil {
+					return fmt.Errorf("failed to parse doh-path in client-blocklist %d of '%s': %w", i, id, err)
+				}
+			}
+			if c.TLSServerName != "" {
+				if s.TLSServerName, err = regexp.Compile(c.TLSServerName); err != nil {
+					return fmt.Errorf("failed to parse tls-server-name in client-blocklist %d of '%s': %w", i, id, err)
+				}
+			}
+			if c.TLSClientName != "" {
+				if s.TLSClientName, err = regexp.Compile(c.TLSClientName); err != nil {
+					return fmt.Errorf("failed to parse tls-client-name in client-blocklist %d of '%s': %w", i, id, err)
+				}
+			}
+			s.DB, err = newClientBlocklistDB(fmt.Sprintf("%s-client-%d", id, i), c.BlocklistFormat, c.Blocklist, c.BlocklistSource)
+			if err != nil {
+				return err
+			}
+			if len(c.Allowlist) > 0 || len(c.AllowlistSource) > 0 {
+				s.AllowlistDB, err = newClientBlocklistDB(fmt.Sprintf("%s-client-allow-%d", id, i), c.AllowlistFormat, c.Allowlist, c.AllowlistSource)
+				if err != nil {
+					return err
+				}
+			}
+			scoped = append(scoped, s)
+		}
+		schedule, err := newSchedule(g.Schedule, g.ScheduleTimezone)
+		if err != nil {
+			return fmt.Errorf("invalid schedule in %q: %w", id, err)
+		}
+		var blockResponse rdns.BlockResponse
+		switch g.BlockResponse {
+		case "", "nxdomain":
+			blockResponse = rdns.BlockResponseNXDomain
+		case "refused":
+			blockResponse = rdns.BlockResponseRefused
+		case "nodata":
+			blockResponse = rdns.BlockResponseNoData
+		case "drop":
+			blockResponse = rdns.BlockResponseDrop
+		default:
+			return fmt.Errorf("unsupported block-response '%s' in '%s'", g.BlockResponse, id)
+		}
+		var actionResolvers map[string]rdns.Resolver
+		for _, rid := range g.ActionResolvers {
+			resolver, ok := resolvers[rid]
+			if !ok {
+				return fmt.Errorf("group '%s' references non-existent resolver or group '%s'", id, rid)
+			}
+			if actionResolvers == nil {
+				actionResolvers = make(map[string]rdns.Resolver)
+			}
+			actionResolvers[rid] = resolver
+		}
 		opt := rdns.BlocklistOptions{
 			BlocklistResolver: resolvers[g.BlockListResolver],
 			BlocklistDB:       blocklistDB,
@@ -424,6 +720,19 @@ func instantiateGroup(id string, g group, resolvers map[string]rdns.Resolver) er
 			AllowlistDB:       allowlistDB,
 			AllowlistRefresh:  time.Duration(g.AllowlistRefresh) * time.Second,
 			EDNS0EDETemplate:  edeTpl,
+			DefaultEDE:        g.DefaultEDE,
+			FollowCNAME:       g.FollowCNAME,
+			ActiveSchedule:    schedule,
+			ScopedBlocklists:  scoped,
+			ActionResolvers:   actionResolvers,
+			AnnotateAllowed:   g.AnnotateAllowed,
+			ReportOnly:        g.ReportOnly,
+			MatchAllQuestions: g.MatchAllQuestions,
+			BlockResponse:     blockResponse,
+			SpoofTTL:          g.SpoofTTL,
+			BlockSOATTL:       g.BlockSOATTL,
+			BlockSOAMname:     g.BlockSOAMname,
+			BlockSOARname:     g.BlockSOARname,
 		}
 		resolvers[id], err = rdns.NewBlocklist(id, gr[0], opt)
 		if err != nil {
@@ -437,6 +746,14 @@ func instantiateGroup(id string, g group, resolvers map[string]rdns.Resolver) er
 		if err != nil {
 			return err
 		}
+	case "rewrite":
+		if len(gr) != 1 {
+			return fmt.Errorf("type rewrite only supports one resolver in '%s'", id)
+		}
+		resolvers[id], err = rdns.NewRewrite(id, gr[0], g.Rewrite...)
+		if err != nil {
+			return fmt.Errorf("%s: %w", id, err)
+		}
 	case "ttl-modifier":
 		if len(gr) != 1 {
 			return fmt.Errorf("type ttl-modifier only supports one resolver in '%s'", id)
@@ -459,12 +776,52 @@ func instantiateGroup(id string, g group, resolvers map[string]rdns.Resolver) er
 		default:
 			return fmt.Errorf("invalid ttl-select value: %q", g.TTLSelect)
 		}
+		var overrideMap map[uint16]uint32
+		for k, v := range g.TTLMaxByType {
+			rrType, ok := dns.StringToType[strings.ToUpper(k)]
+			if !ok {
+				return fmt.Errorf("unknown record type %q in ttl-max-by-type", k)
+			}
+			if overrideMap == nil {
+				overrideMap = make(map[uint16]uint32)
+			}
+			overrideMap[rrType] = v
+		}
 		opt := rdns.TTLModifierOptions{
-			SelectFunc: selectFunc,
-			MinTTL:     g.TTLMin,
-			MaxTTL:     g.TTLMax,
+			SelectFunc:  selectFunc,
+			MinTTL:      g.TTLMin,
+			MaxTTL:      g.TTLMax,
+			OverrideMap: overrideMap,
 		}
 		resolvers[id] = rdns.NewTTLModifier(id, gr[0], opt)
+	case "response-modifier":
+		if len(gr) != 1 {
+			return fmt.Errorf("type response-modifier only supports one resolver in '%s'", id)
+		}
+		var opt rdns.ResponseModifierOptions
+		for i, r := range g.ResponseRules {
+			rule := rdns.ResponseModifierRule{
+				MinTTL:     r.TTLMin,
+				MaxTTL:     r.TTLMax,
+				StripEDNS0: r.StripEDNS0,
+			}
+			if r.Name != "" {
+				re, err := regexp.Compile(r.Name)
+				if err != nil {
+					return fmt.Errorf("invalid name in response rule %d of '%s': %w", i, id, err)
+				}
+				rule.Name = re
+			}
+			var err error
+			if rule.Types, err = parseRRTypes(r.Types); err != nil {
+				return fmt.Errorf("invalid type in response rule %d of '%s': %w", i, id, err)
+			}
+			if rule.StripTypes, err = parseRRTypes(r.StripTypes); err != nil {
+				return fmt.Errorf("invalid strip-types in response rule %d of '%s': %w", i, id, err)
+			}
+			opt.Rules = append(opt.Rules, rule)
+		}
+		resolvers[id] = rdns.NewResponseModifier(id, gr[0], opt)
 	case "truncate-retry":
 		if len(gr) != 1 {
 			return fmt.Errorf("type truncate-retry only supports one resolver in '%s'", id)
@@ -475,6 +832,62 @@ func instantiateGroup(id string, g group, resolvers map[string]rdns.Resolver) er
 		}
 		opt := rdns.TruncateRetryOptions{}
 		resolvers[id] = rdns.NewTruncateRetry(id, gr[0], retryResolver, opt)
+	case "response-router":
+		if len(gr) != 1 {
+			return fmt.Errorf("type response-router only supports one resolver in '%s'", id)
+		}
+		retryResolver := resolvers[g.RetryResolver]
+		if retryResolver == nil {
+			return errors.New("type response-router requires 'retry-resolver' option")
+		}
+		networks, err := parseCIDRList(g.ResponseNetworks)
+		if err != nil {
+			return fmt.Errorf("%s: %w", id, err)
+		}
+		if len(g.ResponseRcodes) == 0 && len(networks) == 0 && !g.ResponseBogons {
+			return fmt.Errorf("type response-router requires 'response-rcodes', 'response-networks' or 'response-bogons' in '%s'", id)
+		}
+		opt := rdns.ResponseRouterOptions{
+			Rcodes:   g.ResponseRcodes,
+			Networks: networks,
+			Bogons:   g.ResponseBogons,
+		}
+		resolvers[id] = rdns.NewResponseRouter(id, gr[0], retryResolver, opt)
+	case "script":
+		if len(gr) != 1 {
+			return fmt.Errorf("type script only supports one resolver in '%s'", id)
+		}
+		scriptResolvers := make(map[string]rdns.Resolver)
+		for _, rid := range g.ScriptResolvers {
+			resolver, ok := resolvers[rid]
+			if !ok {
+				return fmt.Errorf("group '%s' references non-existent resolver or group '%s'", id, rid)
+			}
+			scriptResolvers[rid] = resolver
+		}
+		opt := rdns.ScriptOptions{
+			Query:     g.ScriptQuery,
+			Response:  g.ScriptResponse,
+			Resolvers: scriptResolvers,
+		}
+		resolvers[id], err = rdns.NewScript(id, gr[0], opt)
+		if err != nil {
+			return err
+		}
+	case "svcb-filter":
+		if len(gr) != 1 {
+			return fmt.Errorf("type svcb-filter only supports one resolver in '%s'", id)
+		}
+		if !g.SVCBStripECH && !g.SVCBStripIPHints && len(g.SVCBStripALPN) == 0 && !g.SVCBDrop {
+			return fmt.Errorf("type svcb-filter requires 'svcb-strip-ech', 'svcb-strip-ip-hints', 'svcb-strip-alpn' or 'svcb-drop' in '%s'", id)
+		}
+		opt := rdns.SVCBFilterOptions{
+			StripECH:     g.SVCBStripECH,
+			StripIPHints: g.SVCBStripIPHints,
+			StripALPN:    g.SVCBStripALPN,
+			Drop:         g.SVCBDrop,
+		}
+		resolvers[id] = rdns.NewSVCBFilter(id, gr[0], opt)
 	case "request-dedup":
 		if len(gr) != 1 {
 			return fmt.Errorf("type request-dedup only supports one resolver in '%s'", id)
@@ -494,19 +907,18 @@ func instantiateGroup(id string, g group, resolvers map[string]rdns.Resolver) er
 		if len(gr) != 1 {
 			return fmt.Errorf("type ecs-modifier only supports one resolver in '%s'", id)
 		}
-		var f rdns.ECSModifierFunc
-		switch g.ECSOp {
-		case "add":
-			f = rdns.ECSModifierAdd(g.ECSAddress, g.ECSPrefix4, g.ECSPrefix6)
-		case "add-if-missing":
-			f = rdns.ECSModifierAddIfMissing(g.ECSAddress, g.ECSPrefix4, g.ECSPrefix6)
-		case "delete":
-			f = rdns.ECSModifierDelete
-		case "privacy":
-			f = rdns.ECSModifierPrivacy(g.ECSPrefix4, g.ECSPrefix6)
-		case "":
-		default:
-			return fmt.Errorf("unsupported ecs-modifier operation '%s'", g.ECSOp)
+		f, err := ecsModifierFunc(g.ECSOp, g)
+		if err != nil {
+			return err
+		}
+		if len(g.ECSDomains) > 0 {
+			other, err := ecsModifierFunc(g.ECSOtherOp, g)
+			if err != nil {
+				return err
+			}
+			f = rdns.ECSModifierDomains(g.ECSDomains, f, other)
+		} else if g.ECSOtherOp != "" {
+			return fmt.Errorf("ecs-other-op requires ecs-domains in '%s'", id)
 		}
 		resolvers[id], err = rdns.NewECSModifier(id, gr[0], f)
 		if err != nil {
@@ -534,26 +946,9 @@ func instantiateGroup(id string, g group, resolvers map[string]rdns.Resolver) er
 		if len(gr) != 1 {
 			return fmt.Errorf("type syslog only supports one resolver in '%s'", id)
 		}
-		var priority int
-		switch g.Priority {
-		case "emergency", "":
-			priority = int(syslog.LOG_EMERG)
-		case "alert":
-			priority = int(syslog.LOG_ALERT)
-		case "critical":
-			priority = int(syslog.LOG_CRIT)
-		case "error":
-			priority = int(syslog.LOG_ERR)
-		case "warning":
-			priority = int(syslog.LOG_WARNING)
-		case "notice":
-			priority = int(syslog.LOG_NOTICE)
-		case "info":
-			priority = int(syslog.LOG_INFO)
-		case "debug":
-			priority = int(syslog.LOG_DEBUG)
-		default:
-			return fmt.Errorf("unsupported syslog priority %q", g.Priority)
+		priority, err := syslogPriority(g.Priority)
+		if err != nil {
+			return err
 		}
 		opt := rdns.SyslogOptions{
 			Network:     g.Network,
@@ -565,6 +960,95 @@ func instantiateGroup(id string, g group, resolvers map[string]rdns.Resolver) er
 			Verbose:     g.Verbose,
 		}
 		resolvers[id] = rdns.NewSyslog(id, gr[0], opt)
+	case "access-log":
+		if len(gr) != 1 {
+			return fmt.Errorf("type access-log only supports one resolver in '%s'", id)
+		}
+		var output io.WriteCloser
+		switch g.AccessLogOutput {
+		case "":
+			return fmt.Errorf("no access-log-output defined for '%s'", id)
+		case "syslog":
+			priority, err := syslogPriority(g.Priority)
+			if err != nil {
+				return err
+			}
+			output, err = syslog.Dial(g.Network, g.Address, syslog.Priority(priority), g.Tag)
+			if err != nil {
+				return fmt.Errorf("failed to initialize syslog for '%s': %w", id, err)
+			}
+		default:
+			u, err := url.Parse(g.AccessLogOutput)
+			if err != nil {
+				return err
+			}
+			switch u.Scheme {
+			case "udp":
+				output, err = rdns.NewUDPLogOutput(u.Host)
+				if err != nil {
+					return fmt.Errorf("failed to initialize access log output for '%s': %w", id, err)
+				}
+			case "http", "https":
+				contentType := "application/json"
+				if g.AccessLogFormat == "text" {
+					contentType = "text/plain"
+				}
+				output = rdns.NewHTTPLogOutput(g.AccessLogOutput, contentType, 0)
+			default:
+				output, err = rdns.NewRotatingFile(g.AccessLogOutput, int64(g.AccessLogMaxSize)<<20, g.AccessLogMaxBackups)
+				if err != nil {
+					return err
+				}
+			}
+		}
+		opt := rdns.AccessLogOptions{
+			Output: output,
+			Format: g.AccessLogFormat,
+			Fields: g.AccessLogFields,
+		}
+		l, err := rdns.NewAccessLogger(id, gr[0], opt)
+		if err != nil {
+			return err
+		}
+		resolvers[id] = l
+	case "dnstap":
+		if len(gr) != 1 {
+			return fmt.Errorf("type dnstap only supports one resolver in '%s'", id)
+		}
+		if g.DnstapOutput == "" {
+			return fmt.Errorf("no dnstap-output defined for '%s'", id)
+		}
+		u, err := url.Parse(g.DnstapOutput)
+		if err != nil {
+			return err
+		}
+		var output *rdns.FrameStreamWriter
+		switch u.Scheme {
+		case "unix":
+			output, err = rdns.NewFrameStreamSocket("unix", u.Path, rdns.DnstapContentType, 0)
+		case "tcp":
+			output, err = rdns.NewFrameStreamSocket("tcp", u.Host, rdns.DnstapContentType, 0)
+		default:
+			output, err = rdns.NewFrameStreamFile(g.DnstapOutput, rdns.DnstapContentType)
+		}
+		if err != nil {
+			return fmt.Errorf("failed to initialize dnstap output for '%s': %w", id, err)
+		}
+		version := g.DnstapVersion
+		if version == "" {
+			version = "routedns " + rdns.BuildVersion
+		}
+		opt := rdns.DnstapOptions{
+			Output:      output,
+			Identity:    g.DnstapIdentity,
+			Version:     version,
+			MessageType: g.DnstapMessageType,
+		}
+		d, err := rdns.NewDnstap(id, gr[0], opt)
+		if err != nil {
+			return err
+		}
+		resolvers[id] = d
 	case "cache":
 		var shuffleFunc rdns.AnswerShuffleFunc
 		switch g.CacheAnswerShuffle {
@@ -587,15 +1071,21 @@ func instantiateGroup(id string, g group, resolvers map[string]rdns.Resolver) er
 		}
 
 		opt := rdns.CacheOptions{
-			GCPeriod:            time.Duration(g.GCPeriod) * time.Second,
-			Capacity:            g.CacheSize,
-			NegativeTTL:         g.CacheNegativeTTL,
-			CacheRcodeMaxTTL:    cacheRcodeMaxTTL,
-			ShuffleAnswerFunc:   shuffleFunc,
-			HardenBelowNXDOMAIN: g.CacheHardenBelowNXDOMAIN,
-			FlushQuery:          g.CacheFlushQuery,
-			PrefetchTrigger:     g.PrefetchTrigger,
-			PrefetchEligible:    g.PrefetchEligible,
+			GCPeriod:             time.Duration(g.GCPeriod) * time.Second,
+			Capacity:             g.CacheSize,
+			NegativeTTL:          g.CacheNegativeTTL,
+			NegativeCacheEnabled: g.CacheNegative,
+			NegativeCacheTTL:     time.Duration(g.CacheNegativeMaxTTL) * time.Second,
+			NegativeCacheMinTTL:  time.Duration(g.CacheNegativeMinTTL) * time.Second,
+			ServfailTTL:          time.Duration(g.CacheServfailTTL) * time.Second,
+			CacheRcodeMaxTTL:     cacheRcodeMaxTTL,
+			ShuffleAnswerFunc:    shuffleFunc,
+			HardenBelowNXDOMAIN:  g.CacheHardenBelowNXDOMAIN,
+			FlushQuery:           g.CacheFlushQuery,
+			PrefetchTrigger:      g.PrefetchTrigger,
+			PrefetchEligible:     g.PrefetchEligible,
+			ServeStale:           time.Duration(g.CacheServeStale) * time.Second,
+			StaleAnswerTTL:       g.CacheStaleAnswerTTL,
 		}
 		if g.Backend != nil {
 			var backend rdns.CacheBackend
@@ -646,14 +1136,14 @@ func instantiateGroup(id string, g group, resolvers map[string]rdns.Resolver) er
 		}
 		var blocklistDB rdns.IPBlocklistDB
 		if len(g.Blocklist) > 0 {
-			blocklistDB, err = newIPBlocklistDB(list{Name: id, Format: g.BlocklistFormat}, g.LocationDB, g.Blocklist)
+			blocklistDB, err = newIPBlocklistDB(list{Name: id, Format: g.BlocklistFormat}, g.LocationDB, g.ASNDB, g.Blocklist)
 			if err != nil {
 				return err
 			}
 		} else {
 			var dbs []rdns.IPBlocklistDB
 			for _, s := range g.BlocklistSource {
-				db, err := newIPBlocklistDB(s, g.LocationDB, nil)
+				db, err := newIPBlocklistDB(s, g.LocationDB, g.ASNDB, nil)
 				if err != nil {
 					return fmt.Errorf("%s: %w", id, err)
 				}
@@ -694,24 +1184,21 @@ func instantiateGroup(id string, g group, resolvers map[string]rdns.Resolver) er
 				return err
 			}
 		} else {
-			var dbs []rdns.BlocklistDB
-			for _, s := range g.BlocklistSource {
-				db, err := newBlocklistDB(s, nil)
-				if err != nil {
-					return fmt.Errorf("%s: %w", id, err)
-				}
-				dbs = append(dbs, db)
-			}
-			blocklistDB, err = rdns.NewMultiDB(dbs...)
+			blocklistDB, err = newBlocklistSourceDB(id, g.BlocklistSource, g.IndependentReload)
 			if err != nil {
 				return err
 			}
 		}
+		edeTpl, err := rdns.NewEDNS0EDETemplate(g.EDNS0EDE.Code, g.EDNS0EDE.Text)
+		if err != nil {
+			return fmt.Errorf("failed to parse edn0 template in %q: %w", id, err)
+		}
 		opt := rdns.ResponseBlocklistNameOptions{
 			BlocklistResolver: resolvers[g.BlockListResolver],
 			BlocklistDB:       blocklistDB,
 			BlocklistRefresh:  time.Duration(g.BlocklistRefresh) * time.Second,
 			Inverted:          g.Inverted,
+			EDNS0EDETemplate:  edeTpl,
 		}
 		resolvers[id], err = rdns.NewResponseBlocklistName(id, gr[0], opt)
 		if err != nil {
@@ -726,14 +1213,14 @@ func instantiateGroup(id string, g group, resolvers map[string]rdns.Resolver) er
 		}
 		var blocklistDB rdns.IPBlocklistDB
 		if len(g.Blocklist) > 0 {
-			blocklistDB, err = newIPBlocklistDB(list{Name: id, Format: g.BlocklistFormat}, g.LocationDB, g.Blocklist)
+			blocklistDB, err = newIPBlocklistDB(list{Name: id, Format: g.BlocklistFormat}, g.LocationDB, g.ASNDB, g.Blocklist)
 			if err != nil {
 				return err
 			}
 		} else {
 			var dbs []rdns.IPBlocklistDB
 			for _, s := range g.BlocklistSource {
-				db, err := newIPBlocklistDB(s, g.LocationDB, nil)
+				db, err := newIPBlocklistDB(s, g.LocationDB, g.ASNDB, nil)
 				if err != nil {
 					return fmt.Errorf("%s: %w", id, err)
 				}
@@ -771,6 +1258,51 @@ func instantiateGroup(id string, g group, resolvers map[string]rdns.Resolver) er
 		if err != nil {
 			return err
 		}
+	case "dhcp-leases":
+		refresh := g.LeaseRefresh
+		if refresh == 0 {
+			refresh = 10
+		}
+		opt := rdns.DHCPLeasesOptions{
+			Domain:  g.LeaseDomain,
+			TTL:     g.LeaseTTL,
+			Refresh: time.Duration(refresh) * time.Second,
+		}
+		for _, f := range g.LeaseFiles {
+			opt.Files = append(opt.Files, rdns.DHCPLeaseFile{Path: f.Path, Format: f.Format})
+		}
+		resolvers[id], err = rdns.NewDHCPLeases(id, opt)
+		if err != nil {
+			return fmt.Errorf("%s: %w", id, err)
+		}
+	case "hosts":
+		opt := rdns.HostsOptions{
+			Paths: g.HostsFiles,
+			TTL:   g.HostsTTL,
+		}
+		resolvers[id], err = rdns.NewHosts(id, opt)
+		if err != nil {
+			return fmt.Errorf("%s: %w", id, err)
+		}
+	case "static-zone":
+		opt := rdns.StaticZoneOptions{
+			Files: g.ZoneFiles,
+		}
+		resolvers[id], err = rdns.NewStaticZone(id, opt)
+		if err != nil {
+			return fmt.Errorf("%s: %w", id, err)
+		}
+	case "recursive":
+		opt := rdns.RecursiveOptions{
+			RootHints:           g.RootHints,
+			NoQNameMinimization: g.NoQNameMinimization,
+			IPv6:                g.RecursiveIPv6,
+			QueryTimeout:        time.Duration(g.RecursiveTimeout) * time.Millisecond,
+		}
+		resolvers[id], err = rdns.NewRecursive(id, opt)
+		if err != nil {
+			return fmt.Errorf("%s: %w", id, err)
+		}
 	case "static-template":
 		edeTpl, err := rdns.NewEDNS0EDETemplate(g.EDNS0EDE.Code, g.EDNS0EDE.Text)
 		if err != nil {
@@ -801,8 +1333,140 @@ func instantiateGroup(id string, g group, resolvers map[string]rdns.Resolver) er
 			NullRCode: g.NullRCode,
 		}
 		resolvers[id] = rdns.NewResponseCollapse(id, gr[0], opt)
+	case "circuit-breaker":
+		if len(gr) != 1 {
+			return fmt.Errorf("type circuit-breaker only supports one resolver in '%s'", id)
+		}
+		opt := rdns.CircuitBreakerOptions{
+			FailureThreshold: g.FailureThreshold,
+			SuccessThreshold: g.SuccessThreshold,
+			OpenDuration:     time.Duration(g.OpenDuration) * time.Second,
+			ServfailError:    g.ServfailError,
+		}
+		if g.OpenRCode != 0 {
+			rcode := g.OpenRCode
+			opt.OpenResponse = func(q *dns.Msg) *dns.Msg {
+				a := new(dns.Msg)
+				return a.SetRcode(q, rcode)
+			}
+		}
+		resolvers[id], err = rdns.NewCircuitBreaker(id, gr[0], opt)
+		if err != nil {
+			return err
+		}
+	case "dnssec-validator":
+		if len(gr) != 1 {
+			return fmt.Errorf("type dnssec-validator only supports one resolver in '%s'", id)
+		}
+		opt := rdns.DNSSECOptions{
+			AllowUnsigned: g.AllowUnsigned,
+			KeyCacheTTL:   time.Duration(g.KeyCacheTTL) * time.Second,
+		}
+		for _, s := range g.TrustAnchors {
+			rr, err := dns.NewRR(s)
+			if err != nil {
+				return fmt.Errorf("invalid trust anchor in '%s': %w", id, err)
+			}
+			ds, ok := rr.(*dns.DS)
+			if !ok {
+				return fmt.Errorf("trust anchor %q in '%s' is not a DS record", s, id)
+			}
+			opt.TrustAnchors = append(opt.TrustAnchors, *ds)
+		}
+		resolvers[id], err = rdns.NewDNSSECValidator(id, gr[0], opt)
+		if err != nil {
+			return err
+		}
+	case "rebinding-blocker":
+		if len(gr) != 1 {
+			return fmt.Errorf("type rebinding-blocker only supports one resolver in '%s'", id)
+		}
+		opt := rdns.RebindingOptions{
+			Allowlist:  g.Allowlist,
+			BlockRcode: g.RCode,
+		}
+		resolvers[id], err = rdns.NewRebindingBlocker(id, gr[0], opt)
+		if err != nil {
+			return fmt.Errorf("%s: %w", id, err)
+		}
+	case "dns64":
+		if len(gr) != 1 {
+			return fmt.Errorf("type dns64 only supports one resolver in '%s'", id)
+		}
+		var opt rdns.DNS64Options
+		if g.DNS64Prefix != "" {
+			_, prefix, err := net.ParseCIDR(g.DNS64Prefix)
+			if err != nil {
+				return fmt.Errorf("invalid dns64-prefix in '%s': %w", id, err)
+			}
+			opt.Prefix = prefix
+		}
+		opt.Exclude, err = parseCIDRList(g.DNS64Exclude)
+		if err != nil {
+			return fmt.Errorf("invalid dns64-exclude in '%s': %w", id, err)
+		}
+		resolvers[id], err = rdns.NewDNS64(id, gr[0], opt)
+		if err != nil {
+			return fmt.Errorf("%s: %w", id, err)
+		}
+	case "captive-portal":
+		if len(gr) != 1 {
+			return fmt.Errorf("type captive-portal only supports one resolver in '%s'", id)
+		}
+		opt := rdns.CaptivePortalOptions{
+			NXDomainOnly:  g.NXDomainOnly,
+			TTL:           g.PortalTTL,
+			ClientTimeout: time.Duration(g.ClientTimeout) * time.Second,
+		}
+		for _, s := range g.PortalIPs {
+			ip := net.ParseIP(s)
+			if ip == nil {
+				return fmt.Errorf("invalid portal-ips value '%s' in '%s'", s, id)
+			}
+			opt.PortalIPs = append(opt.PortalIPs, ip)
+		}
+		opt.AllowedNet, err = parseCIDRList(g.AllowedNet)
+		if err != nil {
+			return fmt.Errorf("invalid allowed-net in '%s': %w", id, err)
+		}
+		if len(g.WalledGarden) > 0 {
+			opt.WalledGardenDB, err = rdns.NewDomainDB(id+"-walled-garden", rdns.NewStaticLoader(g.WalledGarden))
+			if err != nil {
+				return fmt.Errorf("%s: %w", id, err)
+			}
+		}
+		resolvers[id], err = rdns.NewCaptivePortal(id, gr[0], opt)
+		if err != nil {
+			return fmt.Errorf("%s: %w", id, err)
+		}
 	case "drop":
 		resolvers[id] = rdns.NewDropResolver(id)
+	case "client-router":
+		if len(gr) > 1 {
+			return fmt.Errorf("type client-router only supports one default resolver in '%s'", id)
+		}
+		var defaultResolver rdns.Resolver
+		if len(gr) == 1 {
+			defaultResolver = gr[0]
+		}
+		var routes []rdns.ClientRoute
+		for _, route := range g.ClientRoutes {
+			resolver, ok := resolvers[route.Resolver]
+			if !ok {
+				return fmt.Errorf("group '%s' references non-existent resolver or group '%s'", id, route.Resolver)
+			}
+			networks, err := parseCIDRList(route.Network)
+			if err != nil {
+				return fmt.Errorf("failed to parse client-routes in '%s': %w", id, err)
+			}
+			for _, n := range networks {
+				routes = append(routes, rdns.ClientRoute{Network: n, Resolver: resolver})
+			}
+		}
+		resolvers[id], err = rdns.NewClientRouter(id, routes, defaultResolver)
+		if err != nil {
+			return err
+		}
 	case "rate-limiter":
 		if len(gr) != 1 {
 			return fmt.Errorf("type rate-limiter only supports one resolver in '%s'", id)
@@ -813,6 +1477,28 @@ func instantiateGroup(id string, g group, resolvers map[string]rdns.Resolver) er
 			Prefix4:       g.Prefix4,
 			Prefix6:       g.Prefix6,
 			LimitResolver: resolvers[g.LimitResolver],
+			Rate:          g.Rate,
+			Burst:         g.Burst,
+			MaxClients:    g.MaxClients,
+			ExceededRcode: g.ExceededRCode,
+			Slip:          g.Slip,
+		}
+		switch g.LimitBy {
+		case "client", "":
+			opt.Key = rdns.RateLimitKeyClient
+		case "name":
+			opt.Key = rdns.RateLimitKeyName
+		case "client-name":
+			opt.Key = rdns.RateLimitKeyClientName
+		default:
+			return fmt.Errorf("invalid limit-by value %q in '%s'", g.LimitBy, id)
+		}
+		for _, s := range g.Exempt {
+			_, n, err := net.ParseCIDR(s)
+			if err != nil {
+				return fmt.Errorf("invalid exempt network in '%s': %w", id, err)
+			}
+			opt.Exempt = append(opt.Exempt, n)
 		}
 		resolvers[id] = rdns.NewRateLimiter(id, gr[0], opt)
 
@@ -822,6 +1508,24 @@ func instantiateGroup(id string, g group, resolvers map[string]rdns.Resolver) er
 	return nil
 }
 
+// Returns the ECS modifier function for an operation, nil if none is given.
+func ecsModifierFunc(op string, g group) (rdns.ECSModifierFunc, error) {
+	switch op {
+	case "add":
+		return rdns.ECSModifierAdd(g.ECSAddress, g.ECSPrefix4, g.ECSPrefix6), nil
+	case "add-if-missing":
+		return rdns.ECSModifierAddIfMissing(g.ECSAddress, g.ECSPrefix4, g.ECSPrefix6), nil
+	case "delete":
+		return rdns.ECSModifierDelete, nil
+	case "privacy":
+		return rdns.ECSModifierPrivacy(g.ECSPrefix4, g.ECSPrefix6), nil
+	case "":
+		return nil, nil
+	default:
+		return nil, fmt.Errorf("unsupported ecs-modifier operation '%s'", op)
+	}
+}
+
 // Instantiate a router object based on configuration and add to the map of resolvers by ID.
 func instantiateRouter(id string, r router, resolvers map[string]rdns.Resolver) error {
 	router := rdns.NewRouter(id)
@@ -839,12 +1543,91 @@ func instantiateRouter(id string, r router, resolvers map[string]rdns.Resolver)
 			return fmt.Errorf("failure parsing routes for router '%s' : %s", id, err.Error())
 		}
 		r.Invert(route.Invert)
+		schedule, err := newSchedule(route.Schedule, route.ScheduleTimezone)
+		if err != nil {
+			return fmt.Errorf("invalid schedule in router '%s': %w", id, err)
+		}
+		r.SetSchedule(schedule)
+		if route.TLSClientName != "" {
+			re, err := regexp.Compile(route.TLSClientName)
+			if err != nil {
+				return fmt.Errorf("invalid tls-client-name in router '%s': %w", id, err)
+			}
+			r.SetTLSClientName(re)
+		}
+		if route.MaxSize > 0 && route.MinSize > route.MaxSize {
+			return fmt.Errorf("min-size can't be larger than max-size in router '%s'", id)
+		}
+		r.SetQueryConditions(rdns.QueryConditions{
+			DO:           route.DO,
+			CD:           route.CD,
+			EDNS0Options: route.EDNS0Options,
+			MinSize:      route.MinSize,
+			MaxSize:      route.MaxSize,
+		})
 		router.Add(r)
 	}
 	resolvers[id] = router
 	return nil
 }
 
+// Build a schedule out of the configured windows. Returns nil if there are no
+// windows, meaning always active.
+func newSchedule(windows []scheduleWindow, timezone string) (*rdns.Schedule, error) {
+	if len(windows) == 0 {
+		return nil, nil
+	}
+	loc := time.Local
+	if timezone != "" {
+		var err error
+		loc, err = time.LoadLocation(timezone)
+		if err != nil {
+			return nil, fmt.Errorf("invalid schedule-timezone: %w", err)
+		}
+	}
+	var result []rdns.ScheduleWindow
+	for _, w := range windows {
+		window, err := rdns.NewScheduleWindow(w.Weekdays, w.Start, w.End)
+		if err != nil {
+			return nil, err
+		}
+		result = append(result, window)
+	}
+	return rdns.NewSchedule(loc, result...), nil
+}
+
+// Combine the lists of a blocklist source into one DB. The lists either reload
+// together, or independently if the group has independent-reload.
+func newBlocklistSourceDB(id string, sources []list, independent bool) (rdns.BlocklistDB, error) {
+	var dbs []rdns.BlocklistDB
+	var members []rdns.GroupMember
+	for _, s := range sources {
+		db, err := newBlocklistDB(s, nil)
+		if err != nil {
+			return nil, fmt.Errorf("%s: %w", id, err)
+		}
+		dbs = append(dbs, db)
+		name := s.Name
+		if name == "" {
+			name = s.Source
+		}
+		members = append(members, rdns.GroupMember{Name: name, DB: db})
+	}
+	if independent {
+		return rdns.NewGroupDB(id, members...)
+	}
+	return rdns.NewMultiDB(dbs...)
+}
+
+// Returns the DB of a list in client-blocklists, either from static rules or
+// from sources.
+func newClientBlocklistDB(name, format string, rules []string, sources []list) (rdns.BlocklistDB, error) {
+	if len(rules) > 0 {
+		return newBlocklistDB(list{Name: name, Format: format}, rules)
+	}
+	return newBlocklistSourceDB(name, sources, false)
+}
+
 func newBlocklistDB(l list, rules []string) (rdns.BlocklistDB, error) {
 	loc, err := url.Parse(l.Source)
 	if err != nil {
@@ -857,7 +1640,7 @@ func newBlocklistDB(l list, rules []string) (rdns.BlocklistDB, error) {
 	var loader rdns.BlocklistLoader
 	if len(rules) > 0 {
 		loader = rdns.NewStaticLoader(rules)
-	} else {
+	} else if l.Format != "redis" || l.Source != "" { // Redis lists without source use the rules already in Redis
 		switch loc.Scheme {
 		case "http", "https":
 			opt := rdns.HTTPLoaderOptions{
@@ -878,15 +1661,37 @@ func newBlocklistDB(l list, rules []string) (rdns.BlocklistDB, error) {
 	case "regexp", "":
 		return rdns.NewRegexpDB(name, loader)
 	case "domain":
-		return rdns.NewDomainDB(name, loader)
+		return rdns.NewDomainDBWithOptions(name, loader, rdns.DomainDBOptions{BloomFalsePositiveRate: l.BloomRate})
 	case "hosts":
 		return rdns.NewHostsDB(name, loader)
+	case "trie":
+		return rdns.NewTrieBlocklistDB(rdns.TrieOptions{
+			Name:               name,
+			Loader:             loader,
+			WildcardSubdomains: l.WildcardSubdomains,
+		})
+	case "redis":
+		return rdns.NewRedisBlocklistDB(rdns.RedisBlocklistOptions{
+			Client: redis.NewClient(&redis.Options{
+				Network:               l.Redis.Network,
+				Addr:                  l.Redis.Address,
+				Username:              l.Redis.Username,
+				Password:              l.Redis.Password,
+				DB:                    l.Redis.DB,
+				ContextTimeoutEnabled: true,
+			}),
+			KeyPrefix:              l.Redis.KeyPrefix,
+			Name:                   name,
+			Loader:                 loader,
+			Bloom:                  l.Redis.Bloom,
+			BloomFalsePositiveRate: l.Redis.BloomRate,
+		})
 	default:
 		return nil, fmt.Errorf("unsupported format '%s'", l.Format)
 	}
 }
 
-func newIPBlocklistDB(l list, locationDB string, rules []string) (rdns.IPBlocklistDB, error) {
+func newIPBlocklistDB(l list, locationDB, asnDB string, rules []string) (rdns.IPBlocklistDB, error) {
 	loc, err := url.Parse(l.Source)
 	if err != nil {
 		return nil, err
@@ -921,6 +1726,8 @@ func newIPBlocklistDB(l list, locationDB string, rules []string) (rdns.IPBlockli
 		return rdns.NewCidrDB(name, loader)
 	case "location":
 		return rdns.NewGeoIPDB(name, loader, locationDB)
+	case "asn":
+		return rdns.NewASNDB(name, loader, asnDB)
 	default:
 		return nil, fmt.Errorf("unsupported format '%s'", l.Format)
 	}
@@ -931,3 +1738,26 @@ func printVersion() {
 	fmt.Println("Build Time: ", rdns.BuildTime)
 	fmt.Println("Version: ", rdns.BuildVersion)
 }
+
+// Returns the syslog priority value for its name. Defaults to "emergency".
+func syslogPriority(name string) (int, error) {
+	switch name {
+	case "emergency", "":
+		return int(syslog.LOG_EMERG), nil
+	case "alert":
+		return int(syslog.LOG_ALERT), nil
+	case "critical":
+		return int(syslog.LOG_CRIT), nil
+	case "error":
+		return int(syslog.LOG_ERR), nil
+	case "warning":
+		return int(syslog.LOG_WARNING), nil
+	case "notice":
+		return int(syslog.LOG_NOTICE), nil
+	case "info":
+		return int(syslog.LOG_INFO), nil
+	case "debug":
+		return int(syslog.LOG_DEBUG), nil
+	}
+	return 0, fmt.Errorf("unsupported syslog priority %q", name)
+}
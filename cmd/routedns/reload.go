@@ -0,0 +1,191 @@
+package main
+
+import (
+	"fmt"
+	"os"
+	"os/signal"
+	"reflect"
+	"sync"
+	"sync/atomic"
+	"syscall"
+	"time"
+
+	rdns "github.com/folbricht/routedns"
+)
+
+// Time to wait for queries that are still in progress in the old resolvers
+// before they're closed.
+const reloadDrainTimeout = 30 * time.Second
+
+// reloader rebuilds all resolvers, groups and routers from the configuration
+// files and replaces them behind the running listeners. Listeners and their
+// sockets are kept, changes to the listeners themselves need a restart.
+type reloader struct {
+	args      []string
+	resolvers atomic.Value // map[string]rdns.Resolver
+
+	mu        sync.Mutex
+	listeners map[string]reloadListener
+}
+
+type reloadListener struct {
+	config   listener
+	resolver *rdns.HotSwapResolver // nil for admin listeners and ODoH relays
+	acl      *rdns.ACL             // nil if the listener has no access control rules
+}
+
+func newReloader(args []string) *reloader {
+	return &reloader{
+		args:      args,
+		listeners: make(map[string]reloadListener),
+	}
+}
+
+// Register a running listener.
+func (r *reloader) add(id string, l listener, resolver *rdns.HotSwapResolver, acl *rdns.ACL) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	r.listeners[id] = reloadListener{config: l, resolver: resolver, acl: acl}
+}
+
+// Set the resolvers, groups and routers that are currently in use.
+func (r *reloader) setElements(resolvers map[string]rdns.Resolver) {
+	r.resolvers.Store(resolvers)
+}
+
+// Returns the resolvers, groups and routers that are currently in use by ID.
+func (r *reloader) elements() map[string]rdns.Resolver {
+	return r.resolvers.Load().(map[string]rdns.Resolver)
+}
+
+// Returns the ACLs of all listeners that have one.
+func (r *reloader) acls() []rdns.ReloadableResolver {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	var acls []rdns.ReloadableResolver
+	for _, l := range r.listeners {
+		if l.acl != nil {
+			acls = append(acls, l.acl)
+		}
+	}
+	return acls
+}
+
+// Reload the configuration whenever the process receives SIGHUP.
+func (r *reloader) registerSignal() {
+	sig := make(chan os.Signal, 1)
+	signal.Notify(sig, syscall.SIGHUP)
+	go func() {
+		for range sig {
+			if err := r.reload(); err != nil {
+				rdns.Log.WithError(err).Error("failed to reload configuration")
+			}
+		}
+	}()
+}
+
+// Load the configuration and swap the resolvers of all listeners. The running
+// configuration is left untouched if the new one is invalid.
+func (r *reloader) reload() error {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	config, err := loadConfig(r.args...)
+	if err != nil {
+		return err
+	}
+	if err := ValidateConfig(&config); err != nil {
+		return err
+	}
+
+	// Collect the close functions of the new elements separately, they're
+	// either called when the new config fails, or on the next reload/shutdown.
+	previous := onClose
+	onClose = nil
+	rollback := func() {
+		closeAll(onClose)
+		onClose = previous
+	}
+	resolvers, err := buildResolvers(&config)
+	if err != nil {
+		rollback()
+		return err
+	}
+	targets := make(map[string]rdns.Resolver)
+	for id, l := range config.Listeners {
+		current, ok := r.listeners[id]
+		if !ok {
+			rdns.Log.WithField("id", id).Warn("new listener requires a restart")
+			continue
+		}
+		if !sameListener(current.config, l) {
+			rdns.Log.WithField("id", id).Warn("changes to listener require a restart")
+		}
+		if current.resolver == nil {
+			continue
+		}
+		resolver, ok := resolvers[l.Resolver]
+		if !ok {
+			rollback()
+			return fmt.Errorf("listener '%s' references non-existent resolver, group or router '%s'", id, l.Resolver)
+		}
+		targets[id] = resolver
+	}
+	for id := range r.listeners {
+		if _, ok := config.Listeners[id]; !ok {
+			rdns.Log.WithField("id", id).Warn("removed listener requires a restart")
+		}
+	}
+
+	// Send new queries to the new resolvers and wait for the old ones to finish
+	// with the queries they're still handling before closing them
+	var wg sync.WaitGroup
+	for id, resolver := range targets {
+		current := r.listeners[id]
+		current.config.Resolver = config.Listeners[id].Resolver
+		r.listeners[id] = current
+		wg.Add(1)
+		go func(id string, handle *rdns.HotSwapResolver, resolver rdns.Resolver) {
+			defer wg.Done()
+			if !handle.Swap(resolver, reloadDrainTimeout) {
+				rdns.Log.WithField("id", id).Warn("timed out waiting for queries to complete")
+			}
+		}(id, current.resolver, resolver)
+	}
+	r.setElements(resolvers)
+	wg.Wait()
+	closeAll(previous)
+
+	// ACL files are reloaded in place, the listeners keep running
+	for id, l := range r.listeners {
+		if l.acl == nil {
+			continue
+		}
+		if err := l.acl.ReloadAll(); err != nil {
+			rdns.Log.WithError(err).WithField("id", id).Error("failed to reload acl")
+		}
+	}
+
+	rdns.Log.Info("reloaded configuration")
+	return nil
+}
+
+// Close all elements on shutdown.
+func (r *reloader) close() {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	closeAll(onClose)
+}
+
+func closeAll(funcs []func()) {
+	for _, f := range funcs {
+		f()
+	}
+}
+
+// Returns true if the listener config is the same, ignoring the resolver which
+// can be replaced without restart.
+func sameListener(a, b listener) bool {
+	a.Resolver, b.Resolver = "", ""
+	return reflect.DeepEqual(a, b)
+}
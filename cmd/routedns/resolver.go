@@ -8,12 +8,23 @@ import (
 	rdns "github.com/folbricht/routedns"
 )
 
-// Instantiates an rdns.Resolver from a resolver config
-func instantiateResolver(id string, r resolver, resolvers map[string]rdns.Resolver) error {
+// Instantiates an rdns.Resolver from a resolver config. Hostnames of the upstream
+// server are resolved with the bootstrapper if one is given.
+func instantiateResolver(id string, r resolver, resolvers map[string]rdns.Resolver, bootstrapper *rdns.Bootstrapper) error {
 	var err error
+	if r.Socks5Address != "" && r.HTTPProxyAddress != "" {
+		return fmt.Errorf("resolver '%s' can't use socks5-address and http-proxy-address together", id)
+	}
+	dialer := proxyDialerFromConfig(r)
+	if dialer == nil && bootstrapper != nil && r.BootstrapAddr == "" {
+		dialer = bootstrapper.Dialer(net.ParseIP(r.LocalAddr), 0)
+	}
 	switch r.Protocol {
 
 	case "doq":
+		if r.Socks5Address != "" || r.HTTPProxyAddress != "" {
+			return fmt.Errorf("resolver '%s' doesn't support proxies with protocol doq", id)
+		}
 		r.Address = rdns.AddressWithDefault(r.Address, rdns.DoQPort)
 
 		tlsConfig, err := rdns.TLSClientConfig(r.CA, r.ClientCrt, r.ClientKey, r.ServerName)
@@ -43,7 +54,10 @@ func instantiateResolver(id string, r resolver, resolvers map[string]rdns.Resolv
 			LocalAddr:     net.ParseIP(r.LocalAddr),
 			TLSConfig:     tlsConfig,
 			QueryTimeout:  time.Duration(r.QueryTimeout) * time.Second,
-			Dialer:        socks5DialerFromConfig(r),
+			Dialer:        dialer,
+			Connections:   r.Connections,
+			IdleTimeout:   time.Duration(r.IdleTimeout) * time.Second,
+			MaxInFlight:   r.MaxInFlight,
 		}
 		resolvers[id], err = rdns.NewDoTClient(id, r.Address, opt)
 		if err != nil {
@@ -81,7 +95,7 @@ func instantiateResolver(id string, r resolver, resolvers map[string]rdns.Resolv
 			Transport:     r.Transport,
 			LocalAddr:     net.ParseIP(r.LocalAddr),
 			QueryTimeout:  time.Duration(r.QueryTimeout) * time.Second,
-			Dialer:        socks5DialerFromConfig(r),
+			Dialer:        dialer,
 			Use0RTT:       r.Use0RTT,
 		}
 		resolvers[id], err = rdns.NewDoHClient(id, r.Address, opt)
@@ -95,18 +109,92 @@ func instantiateResolver(id string, r resolver, resolvers map[string]rdns.Resolv
 			LocalAddr:    net.ParseIP(r.LocalAddr),
 			UDPSize:      r.EDNS0UDPSize,
 			QueryTimeout: time.Duration(r.QueryTimeout) * time.Second,
-			Dialer:       socks5DialerFromConfig(r),
+			TCPFallback:  r.TCPFallback,
+			Dialer:       dialer,
+			Connections:  r.Connections,
+			IdleTimeout:  time.Duration(r.IdleTimeout) * time.Second,
+			MaxInFlight:  r.MaxInFlight,
 		}
 		resolvers[id], err = rdns.NewDNSClient(id, r.Address, r.Protocol, opt)
 		if err != nil {
 			return err
 		}
+	case "mdns":
+		if r.Address == "" {
+			r.Address = "224.0.0.251"
+		}
+		r.Address = rdns.AddressWithDefault(r.Address, rdns.MDNSPort)
+
+		opt := rdns.MDNSClientOptions{
+			Suffix:       r.MDNSSuffix,
+			Interface:    r.MDNSInterface,
+			LocalAddr:    net.ParseIP(r.LocalAddr),
+			QueryTimeout: time.Duration(r.QueryTimeout) * time.Second,
+		}
+		resolvers[id], err = rdns.NewMDNSClient(id, r.Address, opt)
+		if err != nil {
+			return err
+		}
+	case "dnscrypt":
+		opt := rdns.DNSCryptClientOptions{
+			LocalAddr:    net.ParseIP(r.LocalAddr),
+			QueryTimeout: time.Duration(r.QueryTimeout) * time.Second,
+			TCP:          r.Transport == "tcp",
+		}
+		resolvers[id], err = rdns.NewDNSCryptClient(id, r.Address, opt)
+		if err != nil {
+			return err
+		}
+	case "odoh":
+		tlsConfig, err := rdns.TLSClientConfig(r.CA, r.ClientCrt, r.ClientKey, r.ServerName)
+		if err != nil {
+			return err
+		}
+		opt := rdns.ODoHClientOptions{
+			Relay:         r.Relay,
+			TLSConfig:     tlsConfig,
+			BootstrapAddr: r.BootstrapAddr,
+			LocalAddr:     net.ParseIP(r.LocalAddr),
+			QueryTimeout:  time.Duration(r.QueryTimeout) * time.Second,
+			Dialer:        dialer,
+		}
+		resolvers[id], err = rdns.NewODoHClient(id, r.Address, opt)
+		if err != nil {
+			return err
+		}
 	default:
 		return fmt.Errorf("unsupported protocol '%s' for resolver '%s'", r.Protocol, id)
 	}
+	if r.Retries > 0 || r.QueryDeadline > 0 {
+		opt := rdns.UpstreamRetryOptions{
+			Retries: r.Retries,
+			RetryPolicy: rdns.RetryPolicy{
+				InitialBackoff: time.Duration(r.RetryInitialBackoff) * time.Millisecond,
+				MaxBackoff:     time.Duration(r.RetryMaxBackoff) * time.Millisecond,
+				Multiplier:     r.RetryMultiplier,
+				Jitter:         r.RetryJitter,
+			},
+			Deadline: time.Duration(r.QueryDeadline) * time.Millisecond,
+		}
+		resolvers[id] = rdns.NewUpstreamRetry(id, resolvers[id], opt)
+	}
 	return nil
 }
 
+// Returns a dialer if a socks5 or http proxy is configured, nil otherwise
+func proxyDialerFromConfig(cfg resolver) rdns.Dialer {
+	if cfg.HTTPProxyAddress != "" {
+		return rdns.NewHTTPProxyDialer(
+			cfg.HTTPProxyAddress,
+			rdns.HTTPProxyDialerOptions{
+				Username:  cfg.HTTPProxyUsername,
+				Password:  cfg.HTTPProxyPassword,
+				LocalAddr: net.ParseIP(cfg.LocalAddr),
+			})
+	}
+	return socks5DialerFromConfig(cfg)
+}
+
 // Returns a dialer if a socks5 proxy is configured, nil otherwise
 func socks5DialerFromConfig(cfg resolver) rdns.Dialer {
 	if cfg.Socks5Address == "" {
@@ -0,0 +1,215 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"sort"
+	"strings"
+
+	"github.com/BurntSushi/toml"
+)
+
+// ValidateConfig checks the references between the elements of a config. It
+// reports IDs that are used more than once, references to IDs that aren't
+// defined, circular dependencies between groups and routers, and options that
+// don't exist.
+func ValidateConfig(cfg *config) error {
+	var errs []error
+	for _, key := range cfg.undecoded {
+		errs = append(errs, unknownOption(key))
+	}
+
+	// Element type by ID, used to find duplicates and dangling references
+	kinds := make(map[string]string)
+	add := func(kind string, ids []string) {
+		for _, id := range ids {
+			if other, ok := kinds[id]; ok {
+				errs = append(errs, fmt.Errorf("duplicate id '%s' used by %s and %s", id, other, kind))
+				continue
+			}
+			kinds[id] = kind
+		}
+	}
+	listeners := sortedKeys(cfg.Listeners)
+	add("resolver", sortedKeys(cfg.Resolvers))
+	add("group", sortedKeys(cfg.Groups))
+	add("router", sortedKeys(cfg.Routers))
+
+	deps := configDependencies(cfg)
+	for _, id := range dependents(deps) {
+		for _, dep := range deps[id] {
+			if dep == "" {
+				continue
+			}
+			if _, ok := kinds[dep]; !ok {
+				errs = append(errs, fmt.Errorf("%s '%s' references non-existent resolver, group or router '%s'", kinds[id], id, dep))
+			}
+		}
+	}
+	for _, id := range listeners {
+		l := cfg.Listeners[id]
+		if l.Protocol == "admin" || l.Protocol == "odoh-relay" {
+			continue
+		}
+		if _, ok := kinds[l.Resolver]; !ok {
+			errs = append(errs, fmt.Errorf("listener '%s' references non-existent resolver, group or router '%s'", id, l.Resolver))
+		}
+	}
+
+	if err := findCycle(deps); err != nil {
+		errs = append(errs, err)
+	}
+	return errors.Join(errs...)
+}
+
+// Returns a description for every resolver, group and router that no listener
+// sends queries to, directly or through other elements.
+func unusedElements(cfg *config) []string {
+	deps := configDependencies(cfg)
+	used := make(map[string]bool)
+	var visit func(id string)
+	visit = func(id string) {
+		if used[id] {
+			return
+		}
+		used[id] = true
+		for _, dep := range deps[id] {
+			visit(dep)
+		}
+	}
+	for _, l := range cfg.Listeners {
+		visit(l.Resolver)
+	}
+
+	var unused []string
+	for _, e := range []struct {
+		kind string
+		ids  []string
+	}{
+		{"resolver", sortedKeys(cfg.Resolvers)},
+		{"group", sortedKeys(cfg.Groups)},
+		{"router", sortedKeys(cfg.Routers)},
+	} {
+		for _, id := range e.ids {
+			if !used[id] {
+				unused = append(unused, fmt.Sprintf("%s '%s' is not used by any listener", e.kind, id))
+			}
+		}
+	}
+	return unused
+}
+
+// Returns an error for a key that doesn't match an option, naming the element
+// it's in for keys in listeners, resolvers, groups and routers.
+func unknownOption(key toml.Key) error {
+	kinds := map[string]string{
+		"listeners": "listener",
+		"resolvers": "resolver",
+		"groups":    "group",
+		"routers":   "router",
+	}
+	if kind, ok := kinds[key[0]]; ok && len(key) > 2 {
+		return fmt.Errorf("%s '%s' has unknown option '%s'", kind, key[1], strings.Join(key[2:], "."))
+	}
+	return fmt.Errorf("unknown option '%s'", key)
+}
+
+// Adds the type and ID of an element to an error, unless the message already
+// names the element.
+func elementError(kind, id string, err error) error {
+	if strings.Contains(err.Error(), "'"+id+"'") || strings.HasPrefix(err.Error(), id+":") {
+		return err
+	}
+	return fmt.Errorf("%s '%s': %w", kind, id, err)
+}
+
+func sortedKeys[T any](m map[string]T) []string {
+	keys := make([]string, 0, len(m))
+	for k := range m {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+	return keys
+}
+
+// Returns the IDs of the resolvers, groups and routers each group and router
+// forwards queries to.
+func configDependencies(cfg *config) map[string][]string {
+	deps := make(map[string][]string)
+	for id, v := range cfg.Groups {
+		deps[id] = append(v.Resolvers, v.AllowListResolver, v.BlockListResolver, v.LimitResolver, v.RetryResolver)
+		deps[id] = append(deps[id], v.ActionResolvers...)
+		deps[id] = append(deps[id], v.ScriptResolvers...)
+		for _, route := range v.ClientRoutes {
+			deps[id] = append(deps[id], route.Resolver)
+		}
+	}
+	for id, v := range cfg.Routers {
+		// One router can have multiple routes to the same resolver.
+		// Dedup them before adding to the list of dependencies.
+		seen := make(map[string]struct{})
+		for _, route := range v.Routes {
+			if _, ok := seen[route.Resolver]; ok {
+				continue
+			}
+			seen[route.Resolver] = struct{}{}
+			deps[id] = append(deps[id], route.Resolver)
+		}
+	}
+	return deps
+}
+
+// Depth-first search for a cycle in the dependencies. The error contains the
+// path of the first cycle found.
+func findCycle(deps map[string][]string) error {
+	const (
+		visiting = iota + 1
+		done
+	)
+	state := make(map[string]int)
+	var path []string
+	var visit func(id string) error
+	visit = func(id string) error {
+		switch state[id] {
+		case visiting:
+			// Found a cycle, it starts where the ID first appears in the path
+			for i, p := range path {
+				if p == id {
+					cycle := append(append([]string{}, path[i:]...), id)
+					return fmt.Errorf("circular dependency detected: %s", strings.Join(cycle, " → "))
+				}
+			}
+		case done:
+			return nil
+		}
+		state[id] = visiting
+		path = append(path, id)
+		for _, dep := range deps[id] {
+			if dep == "" {
+				continue
+			}
+			if err := visit(dep); err != nil {
+				return err
+			}
+		}
+		path = path[:len(path)-1]
+		state[id] = done
+		return nil
+	}
+	for _, id := range dependents(deps) {
+		if err := visit(id); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// Returns the IDs that have dependencies in sorted order.
+func dependents(deps map[string][]string) []string {
+	ids := make([]string, 0, len(deps))
+	for id := range deps {
+		ids = append(ids, id)
+	}
+	sort.Strings(ids)
+	return ids
+}
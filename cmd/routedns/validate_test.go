@@ -0,0 +1,166 @@
+package main
+
+import (
+	"path/filepath"
+	"testing"
+
+	"github.com/BurntSushi/toml"
+	"github.com/stretchr/testify/require"
+)
+
+func parseTestConfig(t *testing.T, s string) *config {
+	var c config
+	md, err := toml.Decode(s, &c)
+	require.NoError(t, err)
+	c.undecoded = md.Undecoded()
+	return &c
+}
+
+func TestValidateConfig(t *testing.T) {
+	c := parseTestConfig(t, `
+[resolvers.upstream]
+address = "1.1.1.1:53"
+protocol = "udp"
+
+[groups.cache-1]
+type = "cache"
+resolvers = ["failover-1"]
+
+[groups.failover-1]
+type = "fail-rotate"
+resolvers = ["upstream"]
+
+[routers.router-1]
+routes = [
+  { type = "MX", resolver = "cache-1" },
+  { resolver = "upstream" },
+]
+
+[listeners.local]
+address = ":53"
+protocol = "udp"
+resolver = "router-1"
+`)
+	require.NoError(t, ValidateConfig(c))
+}
+
+func TestValidateConfigDirectCycle(t *testing.T) {
+	c := parseTestConfig(t, `
+[groups.cache-1]
+type = "cache"
+resolvers = ["failover-1"]
+
+[groups.failover-1]
+type = "fail-rotate"
+resolvers = ["cache-1"]
+`)
+	err := ValidateConfig(c)
+	require.EqualError(t, err, "circular dependency detected: cache-1 → failover-1 → cache-1")
+}
+
+func TestValidateConfigIndirectCycle(t *testing.T) {
+	c := parseTestConfig(t, `
+[resolvers.upstream]
+address = "1.1.1.1:53"
+protocol = "udp"
+
+[groups.a]
+type = "cache"
+resolvers = ["b"]
+
+[groups.b]
+type = "blocklist-v2"
+resolvers = ["upstream"]
+blocklist-resolver = "router-1"
+
+[routers.router-1]
+routes = [
+  { type = "MX", resolver = "upstream" },
+  { resolver = "a" },
+]
+`)
+	err := ValidateConfig(c)
+	require.EqualError(t, err, "circular dependency detected: a → b → router-1 → a")
+}
+
+func TestValidateConfigReferences(t *testing.T) {
+	c := parseTestConfig(t, `
+[resolvers.upstream]
+address = "1.1.1.1:53"
+protocol = "udp"
+
+[groups.upstream]
+type = "cache"
+resolvers = ["upstream"]
+
+[groups.cache]
+type = "cache"
+resolvers = ["missing"]
+
+[listeners.local]
+address = ":53"
+protocol = "udp"
+resolver = "other"
+`)
+	err := ValidateConfig(c)
+	require.Error(t, err)
+	require.Contains(t, err.Error(), "duplicate id 'upstream' used by resolver and group")
+	require.Contains(t, err.Error(), "group 'cache' references non-existent resolver, group or router 'missing'")
+	require.Contains(t, err.Error(), "listener 'local' references non-existent resolver, group or router 'other'")
+}
+
+func TestValidateConfigUnknownOption(t *testing.T) {
+	c := parseTestConfig(t, `
+[resolvers.upstream]
+adress = "1.1.1.1:53"
+protocol = "udp"
+
+[listeners.local]
+address = ":53"
+protocol = "udp"
+resolver = "upstream"
+`)
+	err := ValidateConfig(c)
+	require.EqualError(t, err, "resolver 'upstream' has unknown option 'adress'")
+}
+
+func TestUnusedElements(t *testing.T) {
+	c := parseTestConfig(t, `
+[resolvers.upstream]
+address = "1.1.1.1:53"
+protocol = "udp"
+
+[resolvers.spare]
+address = "8.8.8.8:53"
+protocol = "udp"
+
+[groups.cache]
+type = "cache"
+resolvers = ["upstream"]
+
+[groups.old-cache]
+type = "cache"
+resolvers = ["spare"]
+
+[listeners.local]
+address = ":53"
+protocol = "udp"
+resolver = "cache"
+`)
+	require.NoError(t, ValidateConfig(c))
+	require.Equal(t, []string{
+		"resolver 'spare' is not used by any listener",
+		"group 'old-cache' is not used by any listener",
+	}, unusedElements(c))
+}
+
+func TestValidateExampleConfigs(t *testing.T) {
+	files, err := filepath.Glob("example-config/*.toml")
+	require.NoError(t, err)
+	require.NotEmpty(t, files)
+	for _, f := range files {
+		c, err := loadConfig(f)
+		require.NoError(t, err, f)
+		require.NoError(t, ValidateConfig(&c), f)
+	}
+}
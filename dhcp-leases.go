@@ -0,0 +1,419 @@
+package rdns
+
+import (
+	"bufio"
+	"encoding/csv"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"os"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/miekg/dns"
+)
+
+// DHCPLeases is a resolver that answers A, AAAA, and PTR queries for the
+// hostnames of clients in DHCP lease files. The files are read again when they
+// change. Names that aren't in the leases are answered with NXDOMAIN.
+type DHCPLeases struct {
+	id string
+	DHCPLeasesOptions
+
+	mu      sync.RWMutex
+	byName  map[string][]dhcpLease
+	byAddr  map[string]dhcpLease // by reverse lookup name
+	modTime []time.Time
+	loops   stopper // stops the refresh loop
+}
+
+var _ Resolver = &DHCPLeases{}
+var _ ReloadableResolver = &DHCPLeases{}
+
+type DHCPLeasesOptions struct {
+	Files []DHCPLeaseFile
+
+	// Domain appended to the hostnames in the leases, for example "lan.". If
+	// empty, hostnames are answered as single-label names.
+	Domain string
+
+	// TTL of the records in responses, default 60.
+	TTL uint32
+
+	// Time between checks for changes of the lease files. Disabled if 0.
+	Refresh time.Duration
+}
+
+// DHCPLeaseFile is a lease file and the format of it.
+type DHCPLeaseFile struct {
+	Path string
+
+	// Lease file format, "dnsmasq", "isc" (dhcpd.leases), or "kea" (memfile CSV)
+	Format string
+}
+
+type dhcpLease struct {
+	name   string    // fully qualified, lower-case
+	ip     net.IP    // Address of the lease
+	expiry time.Time // Zero if the lease doesn't expire
+}
+
+// NewDHCPLeases loads the lease files and returns a new instance of the resolver.
+func NewDHCPLeases(id string, opt DHCPLeasesOptions) (*DHCPLeases, error) {
+	if len(opt.Files) == 0 {
+		return nil, errors.New("no lease files")
+	}
+	for _, f := range opt.Files {
+		if _, ok := dhcpLeaseParsers[f.Format]; !ok {
+			return nil, fmt.Errorf("unsupported lease file format %q", f.Format)
+		}
+	}
+	if opt.TTL == 0 {
+		opt.TTL = 60
+	}
+	opt.Domain = strings.ToLower(strings.Trim(opt.Domain, "."))
+	r := &DHCPLeases{
+		id:                id,
+		DHCPLeasesOptions: opt,
+		modTime:           make([]time.Time, len(opt.Files)),
+	}
+	if err := r.ReloadAll(); err != nil {
+		return nil, err
+	}
+	if opt.Refresh > 0 {
+		go r.refreshLoop()
+	}
+	return r, nil
+}
+
+// Resolve a query with the hostnames and addresses of the leases.
+func (r *DHCPLeases) Resolve(q *dns.Msg, ci ClientInfo) (*dns.Msg, error) {
+	if len(q.Question) < 1 {
+		return nil, errors.New("no question in query")
+	}
+	question := q.Question[0]
+	name := strings.ToLower(question.Name)
+	log := logger(r.id, q, ci)
+	now := time.Now()
+
+	a := new(dns.Msg)
+	a.SetReply(q)
+	a.Authoritative = true
+
+	r.mu.RLock()
+	defer r.mu.RUnlock()
+
+	// Reverse lookups
+	if strings.HasSuffix(name, ".in-addr.arpa.") || strings.HasSuffix(name, ".ip6.arpa.") {
+		lease, ok := r.byAddr[name]
+		if !ok || lease.expired(now) {
+			log.Debug("no lease for address")
+			a.Rcode = dns.RcodeNameError
+			return a, nil
+		}
+		if question.Qtype == dns.TypePTR {
+			a.Answer = append(a.Answer, &dns.PTR{
+				Hdr: dns.RR_Header{Name: question.Name, Rrtype: dns.TypePTR, Class: dns.ClassINET, Ttl: r.TTL},
+				Ptr: lease.name,
+			})
+		}
+		log.WithField("name", lease.name).Debug("responding with lease name")
+		return a, nil
+	}
+
+	var found bool
+	for _, lease := range r.byName[name] {
+		if lease.expired(now) {
+			continue
+		}
+		found = true
+		hdr := dns.RR_Header{Name: question.Name, Class: dns.ClassINET, Ttl: r.TTL}
+		if ip4 := lease.ip.To4(); ip4 != nil && question.Qtype == dns.TypeA {
+			hdr.Rrtype = dns.TypeA
+			a.Answer = append(a.Answer, &dns.A{Hdr: hdr, A: ip4})
+		} else if ip4 == nil && question.Qtype == dns.TypeAAAA {
+			hdr.Rrtype = dns.TypeAAAA
+			a.Answer = append(a.Answer, &dns.AAAA{Hdr: hdr, AAAA: lease.ip})
+		}
+	}
+	if !found {
+		log.Debug("no lease for name")
+		a.Rcode = dns.RcodeNameError
+		return a, nil
+	}
+	log.WithField("answers", len(a.Answer)).Debug("responding with lease addresses")
+	return a, nil
+}
+
+func (r *DHCPLeases) String() string {
+	return r.id
+}
+
+// Close stops the periodic reload of the lease files.
+func (r *DHCPLeases) Close() error {
+	r.loops.stop()
+	return nil
+}
+
+// ReloadAll reads all lease files again. The current leases are kept if any of
+// them fail to load.
+func (r *DHCPLeases) ReloadAll() error {
+	return r.reload(true)
+}
+
+// Loads the lease files. Unless forced, only if any of them changed since they
+// were last loaded.
+func (r *DHCPLeases) reload(force bool) error {
+	modTime := make([]time.Time, len(r.Files))
+	var changed bool
+	for i, f := range r.Files {
+		fi, err := os.Stat(f.Path)
+		if err != nil {
+			return err
+		}
+		modTime[i] = fi.ModTime()
+		r.mu.RLock()
+		if !modTime[i].Equal(r.modTime[i]) {
+			changed = true
+		}
+		r.mu.RUnlock()
+	}
+	if !changed && !force {
+		return nil
+	}
+
+	byName := make(map[string][]dhcpLease)
+	byAddr := make(map[string]dhcpLease)
+	for _, f := range r.Files {
+		leases, err := r.loadFile(f)
+		if err != nil {
+			return fmt.Errorf("%s: %w", f.Path, err)
+		}
+		for _, lease := range leases {
+			reverse, err := dns.ReverseAddr(lease.ip.String())
+			if err != nil {
+				return err
+			}
+			// Later entries replace earlier ones for the same address
+			if old, ok := byAddr[reverse]; ok {
+				byName[old.name] = removeLease(byName[old.name], old.ip)
+			}
+			byAddr[reverse] = lease
+			byName[lease.name] = append(byName[lease.name], lease)
+		}
+	}
+	r.mu.Lock()
+	r.byName = byName
+	r.byAddr = byAddr
+	r.modTime = modTime
+	r.mu.Unlock()
+	Log.WithField("id", r.id).WithField("leases", len(byAddr)).Debug("loaded dhcp leases")
+	return nil
+}
+
+func (r *DHCPLeases) refreshLoop() {
+	log := Log.WithField("id", r.id)
+	newRefresher(log, r.Refresh).run(r.loops.done(), func() error {
+		return r.reload(false)
+	})
+}
+
+func (r *DHCPLeases) loadFile(f DHCPLeaseFile) ([]dhcpLease, error) {
+	fh, err := os.Open(f.Path)
+	if err != nil {
+		return nil, err
+	}
+	defer fh.Close()
+	leases, err := dhcpLeaseParsers[f.Format](fh)
+	if err != nil {
+		return nil, err
+	}
+
+	// Build the names of the leases and drop those without (valid) hostname
+	out := leases[:0]
+	for _, lease := range leases {
+		name := strings.ToLower(strings.TrimSuffix(lease.name, "."))
+		if name == "" || name == "*" {
+			continue
+		}
+		if !strings.Contains(name, ".") && r.Domain != "" {
+			name += "." + r.Domain
+		}
+		name = dns.Fqdn(name)
+		if _, ok := dns.IsDomainName(name); !ok {
+			continue
+		}
+		lease.name = name
+		out = append(out, lease)
+	}
+	return out, nil
+}
+
+func (l dhcpLease) expired(now time.Time) bool {
+	return !l.expiry.IsZero() && now.After(l.expiry)
+}
+
+func removeLease(leases []dhcpLease, ip net.IP) []dhcpLease {
+	out := leases[:0]
+	for _, l := range leases {
+		if !l.ip.Equal(ip) {
+			out = append(out, l)
+		}
+	}
+	return out
+}
+
+var dhcpLeaseParsers = map[string]func(io.Reader) ([]dhcpLease, error){
+	"dnsmasq": parseDnsmasqLeases,
+	"isc":     parseISCLeases,
+	"kea":     parseKeaLeases,
+}
+
+// Parses dnsmasq lease files. Each line is "<expiry> <mac> <ip> <hostname>
+// <client-id>" for IPv4, and "<expiry> <iaid> <ip> <hostname> <duid>" for IPv6
+// after the "duid" line. An expiry of 0 means the lease doesn't expire.
+func parseDnsmasqLeases(r io.Reader) ([]dhcpLease, error) {
+	var leases []dhcpLease
+	scanner := bufio.NewScanner(r)
+	for scanner.Scan() {
+		fields := strings.Fields(scanner.Text())
+		if len(fields) < 4 || fields[0] == "duid" {
+			continue
+		}
+		expiry, err := strconv.ParseInt(fields[0], 10, 64)
+		if err != nil {
+			return nil, fmt.Errorf("invalid expiry %q", fields[0])
+		}
+		ip := net.ParseIP(fields[2])
+		if ip == nil {
+			return nil, fmt.Errorf("invalid address %q", fields[2])
+		}
+		lease := dhcpLease{name: fields[3], ip: ip}
+		if expiry != 0 {
+			lease.expiry = time.Unix(expiry, 0)
+		}
+		leases = append(leases, lease)
+	}
+	return leases, scanner.Err()
+}
+
+// Parses ISC dhcpd lease files, for example:
+//
+//	lease 192.168.1.10 {
+//	  ends 4 2024/01/04 12:00:00;
+//	  binding state active;
+//	  client-hostname "laptop";
+//	}
+//
+// Only active leases are used. Leases for the same address later in the file
+// replace earlier ones.
+func parseISCLeases(r io.Reader) ([]dhcpLease, error) {
+	var (
+		leases  []dhcpLease
+		byAddr  = make(map[string]int) // Index of the active lease by address
+		current *dhcpLease
+		active  bool
+	)
+	scanner := bufio.NewScanner(r)
+	for scanner.Scan() {
+		line := strings.TrimSpace(scanner.Text())
+		fields := strings.Fields(strings.TrimSuffix(line, ";"))
+		switch {
+		case len(fields) == 0 || strings.HasPrefix(line, "#"):
+		case fields[0] == "lease" && len(fields) == 3 && fields[2] == "{":
+			ip := net.ParseIP(fields[1])
+			if ip == nil {
+				return nil, fmt.Errorf("invalid address %q", fields[1])
+			}
+			current = &dhcpLease{ip: ip}
+			active = false
+		case current == nil:
+		case line == "}":
+			key := current.ip.String()
+			if i, ok := byAddr[key]; ok {
+				leases = append(leases[:i], leases[i+1:]...)
+				delete(byAddr, key)
+				for k, j := range byAddr {
+					if j > i {
+						byAddr[k] = j - 1
+					}
+				}
+			}
+			if active {
+				byAddr[key] = len(leases)
+				leases = append(leases, *current)
+			}
+			current = nil
+		case fields[0] == "ends" && len(fields) >= 2:
+			if fields[1] == "never" {
+				continue
+			}
+			if len(fields) != 4 {
+				return nil, fmt.Errorf("invalid lease end %q", line)
+			}
+			t, err := time.Parse("2006/01/02 15:04:05", fields[2]+" "+fields[3])
+			if err != nil {
+				return nil, err
+			}
+			current.expiry = t
+		case fields[0] == "binding" && len(fields) == 3 && fields[1] == "state":
+			active = fields[2] == "active"
+		case fields[0] == "client-hostname" && len(fields) == 2:
+			current.name = strings.Trim(fields[1], `"`)
+		}
+	}
+	return leases, scanner.Err()
+}
+
+// Parses Kea memfile lease files in CSV format, IPv4 or IPv6. The columns are
+// identified by the header. Only leases in the default state (0) are used.
+func parseKeaLeases(r io.Reader) ([]dhcpLease, error) {
+	cr := csv.NewReader(r)
+	cr.FieldsPerRecord = -1
+	header, err := cr.Read()
+	if err == io.EOF {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	columns := make(map[string]int)
+	for i, name := range header {
+		columns[name] = i
+	}
+	for _, name := range []string{"address", "expire", "hostname", "state"} {
+		if _, ok := columns[name]; !ok {
+			return nil, fmt.Errorf("missing column %q", name)
+		}
+	}
+	var leases []dhcpLease
+	for {
+		record, err := cr.Read()
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			return nil, err
+		}
+		if len(record) != len(header) || record[columns["state"]] != "0" {
+			continue
+		}
+		ip := net.ParseIP(record[columns["address"]])
+		if ip == nil {
+			return nil, fmt.Errorf("invalid address %q", record[columns["address"]])
+		}
+		expiry, err := strconv.ParseInt(record[columns["expire"]], 10, 64)
+		if err != nil {
+			return nil, fmt.Errorf("invalid expiry %q", record[columns["expire"]])
+		}
+		leases = append(leases, dhcpLease{
+			name:   record[columns["hostname"]],
+			ip:     ip,
+			expiry: time.Unix(expiry, 0),
+		})
+	}
+	return leases, nil
+}
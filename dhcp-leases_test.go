@@ -0,0 +1,104 @@
+package rdns
+
+import (
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/miekg/dns"
+	"github.com/stretchr/testify/require"
+)
+
+func TestDHCPLeases(t *testing.T) {
+	r, err := NewDHCPLeases("test-leases", DHCPLeasesOptions{
+		Files: []DHCPLeaseFile{
+			{Path: "testdata/dnsmasq.leases", Format: "dnsmasq"},
+			{Path: "testdata/dhcpd.leases", Format: "isc"},
+			{Path: "testdata/kea-leases4.csv", Format: "kea"},
+		},
+		Domain: "lan.",
+	})
+	require.NoError(t, err)
+
+	resolve := func(name string, qtype uint16) *dns.Msg {
+		q := new(dns.Msg)
+		q.SetQuestion(name, qtype)
+		a, err := r.Resolve(q, ClientInfo{})
+		require.NoError(t, err)
+		return a
+	}
+
+	// dnsmasq, IPv4 and IPv6
+	a := resolve("laptop.lan.", dns.TypeA)
+	require.Len(t, a.Answer, 1)
+	require.Equal(t, "192.168.1.10", a.Answer[0].(*dns.A).A.String())
+	require.Equal(t, uint32(60), a.Answer[0].Header().Ttl)
+	a = resolve("laptop.lan.", dns.TypeAAAA)
+	require.Len(t, a.Answer, 1)
+	require.Equal(t, "fd00::10", a.Answer[0].(*dns.AAAA).AAAA.String())
+
+	// NODATA for other types
+	a = resolve("laptop.lan.", dns.TypeMX)
+	require.Equal(t, dns.RcodeSuccess, a.Rcode)
+	require.Empty(t, a.Answer)
+
+	// Expired leases and those without names are ignored
+	a = resolve("expired.lan.", dns.TypeA)
+	require.Equal(t, dns.RcodeNameError, a.Rcode)
+	a = resolve("12.1.168.192.in-addr.arpa.", dns.TypePTR)
+	require.Equal(t, dns.RcodeNameError, a.Rcode)
+
+	// Reverse lookups
+	a = resolve("10.1.168.192.in-addr.arpa.", dns.TypePTR)
+	require.Len(t, a.Answer, 1)
+	require.Equal(t, "laptop.lan.", a.Answer[0].(*dns.PTR).Ptr)
+	reverse, err := dns.ReverseAddr("fd00::10")
+	require.NoError(t, err)
+	a = resolve(reverse, dns.TypePTR)
+	require.Equal(t, "laptop.lan.", a.Answer[0].(*dns.PTR).Ptr)
+
+	// ISC, the later free lease replaces the active one
+	a = resolve("printer.lan.", dns.TypeA)
+	require.Equal(t, "192.168.2.10", a.Answer[0].(*dns.A).A.String())
+	a = resolve("nas.lan.", dns.TypeA)
+	require.Equal(t, dns.RcodeNameError, a.Rcode)
+
+	// Kea, qualified hostnames are used as they are, declined leases ignored
+	a = resolve("tv.example.com.", dns.TypeA)
+	require.Equal(t, "192.168.3.10", a.Answer[0].(*dns.A).A.String())
+	a = resolve("declined.lan.", dns.TypeA)
+	require.Equal(t, dns.RcodeNameError, a.Rcode)
+}
+
+func TestDHCPLeasesRefresh(t *testing.T) {
+	file := filepath.Join(t.TempDir(), "dnsmasq.leases")
+	require.NoError(t, os.WriteFile(file, []byte("0 aa:bb:cc:dd:ee:01 192.168.1.10 laptop *\n"), 0644))
+	r, err := NewDHCPLeases("test-leases-refresh", DHCPLeasesOptions{
+		Files: []DHCPLeaseFile{{Path: file, Format: "dnsmasq"}},
+	})
+	require.NoError(t, err)
+
+	resolve := func() *dns.Msg {
+		q := new(dns.Msg)
+		q.SetQuestion("laptop.", dns.TypeA)
+		a, err := r.Resolve(q, ClientInfo{})
+		require.NoError(t, err)
+		return a
+	}
+	require.Equal(t, "192.168.1.10", resolve().Answer[0].(*dns.A).A.String())
+
+	// Unchanged files aren't loaded again
+	require.NoError(t, r.reload(false))
+
+	require.NoError(t, os.WriteFile(file, []byte("0 aa:bb:cc:dd:ee:01 192.168.1.20 laptop *\n"), 0644))
+	future := time.Now().Add(time.Minute)
+	require.NoError(t, os.Chtimes(file, future, future))
+	require.NoError(t, r.reload(false))
+	require.Equal(t, "192.168.1.20", resolve().Answer[0].(*dns.A).A.String())
+
+	// Invalid files keep the current leases
+	require.NoError(t, os.WriteFile(file, []byte("x aa:bb:cc:dd:ee:01 192.168.1.30 laptop *\n"), 0644))
+	require.Error(t, r.ReloadAll())
+	require.Equal(t, "192.168.1.20", resolve().Answer[0].(*dns.A).A.String())
+}
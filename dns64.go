@@ -0,0 +1,211 @@
+package rdns
+
+import (
+	"expvar"
+	"fmt"
+	"net"
+
+	"github.com/miekg/dns"
+)
+
+// DNS64 synthesizes AAAA records from A records for names that don't have any
+// IPv6 addresses, as defined in RFC 6147. The synthesized addresses embed the
+// IPv4 address in a NAT64 prefix, allowing IPv6-only clients to reach IPv4-only
+// services through a NAT64 gateway.
+type DNS64 struct {
+	id       string
+	resolver Resolver
+	DNS64Options
+	metrics *DNS64Metrics
+}
+
+var _ Resolver = &DNS64{}
+
+type DNS64Options struct {
+	// NAT64 prefix used to synthesize addresses. Must be one of the lengths in
+	// RFC 6052, /32, /40, /48, /56, /64, or /96. Default 64:ff9b::/96.
+	Prefix *net.IPNet
+
+	// AAAA records with addresses in these networks are ignored, and addresses
+	// are synthesized as if there were none. Default ::ffff:0:0/96.
+	Exclude []*net.IPNet
+}
+
+type DNS64Metrics struct {
+	// Count of responses with synthesized records.
+	synthesized *expvar.Int
+}
+
+// The Well-Known Prefix from RFC 6052.
+var dns64WellKnownPrefix = &net.IPNet{
+	IP:   net.ParseIP("64:ff9b::"),
+	Mask: net.CIDRMask(96, 128),
+}
+
+// IPv4-mapped addresses, RFC 6147 section 5.1.4.
+var dns64DefaultExclude = &net.IPNet{
+	IP:   net.ParseIP("::ffff:0:0"),
+	Mask: net.CIDRMask(96, 128),
+}
+
+// TTL of synthesized records if the negative AAAA response had no SOA, RFC 6147
+// section 5.1.7.
+const dns64DefaultTTL = 600
+
+// NewDNS64 returns a new instance of a DNS64 element.
+func NewDNS64(id string, resolver Resolver, opt DNS64Options) (*DNS64, error) {
+	if opt.Prefix == nil {
+		opt.Prefix = dns64WellKnownPrefix
+	}
+	if opt.Prefix.IP.To4() != nil {
+		return nil, fmt.Errorf("dns64 prefix %s is not an IPv6 network", opt.Prefix)
+	}
+	switch ones, _ := opt.Prefix.Mask.Size(); ones {
+	case 32, 40, 48, 56, 64, 96:
+	default:
+		return nil, fmt.Errorf("unsupported dns64 prefix length /%d, must be 32, 40, 48, 56, 64, or 96", ones)
+	}
+	if len(opt.Exclude) == 0 {
+		opt.Exclude = []*net.IPNet{dns64DefaultExclude}
+	}
+	return &DNS64{
+		id:           id,
+		resolver:     resolver,
+		DNS64Options: opt,
+		metrics: &DNS64Metrics{
+			synthesized: getVarInt("router", id, "synthesized"),
+		},
+	}, nil
+}
+
+// Resolve a DNS query. If an AAAA query has no usable answer, the A records of
+// the name are queried and returned as synthesized AAAA records.
+func (r *DNS64) Resolve(q *dns.Msg, ci ClientInfo) (*dns.Msg, error) {
+	if len(q.Question) != 1 || q.Question[0].Qtype != dns.TypeAAAA || q.Question[0].Qclass != dns.ClassINET {
+		return r.resolver.Resolve(q, ci)
+	}
+	a, err := r.resolver.Resolve(q, ci)
+	if err != nil || a == nil {
+		return a, err
+	}
+
+	// Clients that validate DNSSEC themselves get the unmodified response,
+	// RFC 6147 section 5.5
+	if q.CheckingDisabled {
+		return a, nil
+	}
+
+	// The name doesn't exist, so won't have A records either. Any other error
+	// response is treated like an empty answer, RFC 6147 section 5.1.2.
+	if a.Rcode == dns.RcodeNameError || a.Truncated || r.hasAAAA(a) {
+		return a, nil
+	}
+	log := logger(r.id, q, ci)
+
+	aq := q.Copy()
+	aq.Question[0].Qtype = dns.TypeA
+	aa, err := r.resolver.Resolve(aq, ci)
+	if err != nil || aa == nil || aa.Rcode != dns.RcodeSuccess {
+		log.Debug("no usable A response, not synthesizing")
+		return a, nil
+	}
+	ttl := uint32(dns64DefaultTTL)
+	for _, rr := range a.Ns {
+		if soa, ok := rr.(*dns.SOA); ok {
+			ttl = soa.Hdr.Ttl
+		}
+	}
+
+	answer := new(dns.Msg)
+	answer.SetReply(q)
+	answer.RecursionAvailable = aa.RecursionAvailable
+	if edns0 := aa.IsEdns0(); edns0 != nil {
+		answer.Extra = append(answer.Extra, edns0)
+	}
+	var synthesized bool
+	for _, rr := range aa.Answer {
+		switch rr := rr.(type) {
+		case *dns.CNAME, *dns.DNAME:
+			answer.Answer = append(answer.Answer, rr)
+		case *dns.A:
+			ip := r.synthesize(rr.A)
+			if ip == nil {
+				continue
+			}
+			answer.Answer = append(answer.Answer, &dns.AAAA{
+				Hdr: dns.RR_Header{
+					Name:   rr.Hdr.Name,
+					Rrtype: dns.TypeAAAA,
+					Class:  rr.Hdr.Class,
+					Ttl:    min(rr.Hdr.Ttl, ttl),
+				},
+				AAAA: ip,
+			})
+			synthesized = true
+		}
+	}
+	if !synthesized {
+		return a, nil
+	}
+	log.Debug("synthesized AAAA records")
+	r.metrics.synthesized.Add(1)
+	return answer, nil
+}
+
+func (r *DNS64) String() string {
+	return r.id
+}
+
+// Returns true if the response has AAAA records that aren't excluded.
+func (r *DNS64) hasAAAA(a *dns.Msg) bool {
+	if a.Rcode != dns.RcodeSuccess {
+		return false
+	}
+	for _, rr := range a.Answer {
+		record, ok := rr.(*dns.AAAA)
+		if !ok {
+			continue
+		}
+		var excluded bool
+		for _, n := range r.Exclude {
+			if n.Contains(record.AAAA) {
+				excluded = true
+				break
+			}
+		}
+		if !excluded {
+			return true
+		}
+	}
+	return false
+}
+
+// Embeds the IPv4 address in the prefix as per RFC 6052 section 2.2. Returns
+// nil for addresses that can't be used with the prefix.
+func (r *DNS64) synthesize(ip net.IP) net.IP {
+	ip4 := ip.To4()
+	if ip4 == nil {
+		return nil
+	}
+
+	// The Well-Known Prefix must not be used for non-global addresses, RFC 6052
+	// section 3.1
+	if r.Prefix.IP.Equal(dns64WellKnownPrefix.IP) && (isRebindingIP(ip4) || !ip4.IsGlobalUnicast()) {
+		return nil
+	}
+
+	// Bits 64 to 71 are reserved and always 0, the address is split around them
+	// if the prefix is shorter than 64 bits
+	ones, _ := r.Prefix.Mask.Size()
+	out := make(net.IP, net.IPv6len)
+	copy(out, r.Prefix.IP.To16()[:ones/8])
+	pos := ones / 8
+	for _, b := range ip4 {
+		if pos == 8 {
+			pos++
+		}
+		out[pos] = b
+		pos++
+	}
+	return out
+}
@@ -0,0 +1,126 @@
+package rdns
+
+import (
+	"net"
+	"testing"
+
+	"github.com/miekg/dns"
+	"github.com/stretchr/testify/require"
+)
+
+func TestDNS64(t *testing.T) {
+	records := map[string][]string{
+		"ipv4.example.com. A":    {"ipv4.example.com. 3600 IN A 192.0.2.1"},
+		"ipv4.example.com. AAAA": nil,
+		"mapped.example.com. A":  {"mapped.example.com. 60 IN A 192.0.2.2"},
+		"mapped.example.com. AAAA": {
+			"mapped.example.com. 60 IN AAAA ::ffff:192.0.2.2",
+		},
+		"dual.example.com. A":    {"dual.example.com. 60 IN A 192.0.2.3"},
+		"dual.example.com. AAAA": {"dual.example.com. 60 IN AAAA 2001:db8::1"},
+		"alias.example.com. A": {
+			"alias.example.com. 60 IN CNAME ipv4.example.com.",
+			"ipv4.example.com. 3600 IN A 192.0.2.1",
+		},
+		"alias.example.com. AAAA": {"alias.example.com. 60 IN CNAME ipv4.example.com."},
+		"private.example.com. A":  {"private.example.com. 60 IN A 10.0.0.1"},
+	}
+	upstream := &TestResolver{
+		ResolveFunc: func(q *dns.Msg, ci ClientInfo) (*dns.Msg, error) {
+			a := new(dns.Msg)
+			a.SetReply(q)
+			rrs, ok := records[q.Question[0].Name+" "+dns.TypeToString[q.Question[0].Qtype]]
+			if !ok && q.Question[0].Name == "missing.example.com." {
+				a.Rcode = dns.RcodeNameError
+			}
+			for _, s := range rrs {
+				a.Answer = append(a.Answer, mustRR(t, s))
+			}
+			if len(a.Answer) == 0 {
+				a.Ns = []dns.RR{mustRR(t, "example.com. 300 IN SOA ns.example.com. hostmaster.example.com. 1 7200 3600 1209600 300")}
+			}
+			return a, nil
+		},
+	}
+	r, err := NewDNS64("test-dns64", upstream, DNS64Options{})
+	require.NoError(t, err)
+
+	resolve := func(name string) *dns.Msg {
+		q := new(dns.Msg)
+		q.SetQuestion(name, dns.TypeAAAA)
+		a, err := r.Resolve(q, ClientInfo{})
+		require.NoError(t, err)
+		require.Equal(t, name, a.Question[0].Name)
+		require.Equal(t, dns.TypeAAAA, a.Question[0].Qtype)
+		return a
+	}
+
+	// Synthesized from the A record, the TTL is limited by the SOA
+	a := resolve("ipv4.example.com.")
+	require.Len(t, a.Answer, 1)
+	aaaa := a.Answer[0].(*dns.AAAA)
+	require.Equal(t, "64:ff9b::c000:201", aaaa.AAAA.String())
+	require.Equal(t, uint32(300), aaaa.Hdr.Ttl)
+
+	// IPv4-mapped addresses are ignored
+	a = resolve("mapped.example.com.")
+	require.Len(t, a.Answer, 1)
+	require.Equal(t, "64:ff9b::c000:202", a.Answer[0].(*dns.AAAA).AAAA.String())
+
+	// Real IPv6 addresses are returned unchanged
+	a = resolve("dual.example.com.")
+	require.Equal(t, "2001:db8::1", a.Answer[0].(*dns.AAAA).AAAA.String())
+
+	// CNAMEs are kept
+	a = resolve("alias.example.com.")
+	require.Len(t, a.Answer, 2)
+	require.IsType(t, &dns.CNAME{}, a.Answer[0])
+	require.Equal(t, "64:ff9b::c000:201", a.Answer[1].(*dns.AAAA).AAAA.String())
+
+	// Private addresses can't be used with the well-known prefix
+	a = resolve("private.example.com.")
+	require.Empty(t, a.Answer)
+
+	// NXDOMAIN is returned without querying A
+	upstream.hitCount = 0
+	a = resolve("missing.example.com.")
+	require.Equal(t, dns.RcodeNameError, a.Rcode)
+	require.Equal(t, 1, upstream.HitCount())
+
+	// Other query types are passed through
+	q := new(dns.Msg)
+	q.SetQuestion("ipv4.example.com.", dns.TypeA)
+	a, err = r.Resolve(q, ClientInfo{})
+	require.NoError(t, err)
+	require.IsType(t, &dns.A{}, a.Answer[0])
+
+	require.Equal(t, int64(3), r.metrics.synthesized.Value())
+}
+
+func TestDNS64Prefix(t *testing.T) {
+	tests := []struct {
+		prefix string
+		ip     string
+		result string
+	}{
+		{"2001:db8::/32", "192.0.2.33", "2001:db8:c000:221::"},
+		{"2001:db8:100::/40", "192.0.2.33", "2001:db8:1c0:2:21::"},
+		{"2001:db8:122::/48", "192.0.2.33", "2001:db8:122:c000:2:2100::"},
+		{"2001:db8:122:300::/56", "192.0.2.33", "2001:db8:122:3c0:0:221::"},
+		{"2001:db8:122:344::/64", "192.0.2.33", "2001:db8:122:344:c0:2:2100:0"},
+		{"2001:db8:122:344::/96", "192.0.2.33", "2001:db8:122:344::192.0.2.33"},
+		{"2001:db8:122:344::/96", "10.0.0.1", "2001:db8:122:344::a00:1"},
+	}
+	for _, test := range tests {
+		_, prefix, err := net.ParseCIDR(test.prefix)
+		require.NoError(t, err)
+		r, err := NewDNS64("test-dns64-prefix", nil, DNS64Options{Prefix: prefix})
+		require.NoError(t, err)
+		require.Equal(t, net.ParseIP(test.result), r.synthesize(net.ParseIP(test.ip)), test.prefix)
+	}
+
+	_, prefix, err := net.ParseCIDR("2001:db8::/80")
+	require.NoError(t, err)
+	_, err = NewDNS64("test-dns64-prefix", nil, DNS64Options{Prefix: prefix})
+	require.Error(t, err)
+}
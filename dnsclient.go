@@ -16,6 +16,7 @@ type DNSClient struct {
 	endpoint string
 	net      string
 	pipeline *Pipeline // Pipeline also provides operation metrics.
+	tcp      *Pipeline // Retries truncated UDP responses, if enabled
 	opt      DNSClientOptions
 }
 
@@ -33,14 +34,23 @@ type DNSClientOptions struct {
 
 	QueryTimeout time.Duration
 
+	// Send the query again over TCP if a UDP response is truncated, instead
+	// of passing the truncated response on.
+	TCPFallback bool
+
 	// Optional dialer, e.g. proxy
 	Dialer Dialer
+
+	// Connection pool settings, see PipelineOptions.
+	Connections int
+	IdleTimeout time.Duration
+	MaxInFlight int
 }
 
 var _ Resolver = &DNSClient{}
 
 // NewDNSClient returns a new instance of DNSClient which is a plain DNS resolver
-// that supports pipelining over a single connection.
+// that supports pipelining over one or more connections.
 func NewDNSClient(id, endpoint, network string, opt DNSClientOptions) (*DNSClient, error) {
 	if err := validEndpoint(endpoint); err != nil {
 		return nil, err
@@ -52,13 +62,24 @@ func NewDNSClient(id, endpoint, network string, opt DNSClientOptions) (*DNSClien
 		LocalAddr: opt.LocalAddr,
 		Timeout:   opt.QueryTimeout,
 	}
-	return &DNSClient{
+	pipelineOpt := PipelineOptions{
+		QueryTimeout: opt.QueryTimeout,
+		Connections:  opt.Connections,
+		IdleTimeout:  opt.IdleTimeout,
+		MaxInFlight:  opt.MaxInFlight,
+	}
+	d := &DNSClient{
 		id:       id,
 		net:      network,
 		endpoint: endpoint,
-		pipeline: NewPipeline(id, endpoint, client, opt.QueryTimeout),
+		pipeline: NewPipelineWithOptions(id, endpoint, client, pipelineOpt),
 		opt:      opt,
-	}, nil
+	}
+	if opt.TCPFallback && network == "udp" {
+		client.Net = "tcp"
+		d.tcp = NewPipelineWithOptions(id+"-tcp", endpoint, client, pipelineOpt)
+	}
+	return d, nil
 }
 
 // Resolve a DNS query.
@@ -75,7 +96,12 @@ func (d *DNSClient) Resolve(q *dns.Msg, ci ClientInfo) (*dns.Msg, error) {
 
 	// Remove padding before sending over the wire in plain
 	stripPadding(q)
-	return d.pipeline.Resolve(q)
+	a, err := d.pipeline.resolve(q, ci.Deadline, ci.Done)
+	if err == nil && a != nil && a.Truncated && d.tcp != nil {
+		logger(d.id, q, ci).WithField("resolver", d.endpoint).Debug("response truncated, retrying over tcp")
+		return d.tcp.resolve(q, ci.Deadline, ci.Done)
+	}
+	return a, err
 }
 
 func (d *DNSClient) String() string {
@@ -1,7 +1,10 @@
 package rdns
 
 import (
+	"net"
+	"strings"
 	"testing"
+	"time"
 
 	"github.com/miekg/dns"
 	"github.com/stretchr/testify/require"
@@ -24,3 +27,111 @@ func TestDNSClientSimpleUDP(t *testing.T) {
 	require.NoError(t, err)
 	require.NotEmpty(t, r.Answer)
 }
+
+func TestDNSClientTCPFallback(t *testing.T) {
+	// Upstream with a response that doesn't fit into 512 bytes
+	upstream := &TestResolver{
+		ResolveFunc: func(q *dns.Msg, ci ClientInfo) (*dns.Msg, error) {
+			a := new(dns.Msg)
+			a.SetReply(q)
+			for i := 1; i <= 40; i++ {
+				a.Answer = append(a.Answer, &dns.A{
+					Hdr: dns.RR_Header{Name: q.Question[0].Name, Rrtype: dns.TypeA, Class: dns.ClassINET, Ttl: 300},
+					A:   net.IPv4(192, 0, 2, byte(i)),
+				})
+			}
+			return a, nil
+		},
+	}
+	addr, err := getLnAddress()
+	require.NoError(t, err)
+	udp := NewDNSListener("test-fallback-udp", addr, "udp", ListenOptions{}, upstream)
+	tcp := NewDNSListener("test-fallback-tcp", addr, "tcp", ListenOptions{}, upstream)
+	go udp.Start()
+	go tcp.Start()
+	defer udp.Shutdown()
+	defer tcp.Shutdown()
+	time.Sleep(time.Second)
+
+	q := new(dns.Msg)
+	q.SetQuestion("example.com.", dns.TypeA)
+
+	// The listener truncates the response and doesn't send partial answers
+	d, err := NewDNSClient("test-dns", addr, "udp", DNSClientOptions{})
+	require.NoError(t, err)
+	a, err := d.Resolve(q, ClientInfo{})
+	require.NoError(t, err)
+	require.True(t, a.Truncated)
+	require.Empty(t, a.Answer)
+
+	// With fallback, the query is sent again over TCP
+	d, err = NewDNSClient("test-dns-fallback", addr, "udp", DNSClientOptions{TCPFallback: true})
+	require.NoError(t, err)
+	a, err = d.Resolve(q, ClientInfo{})
+	require.NoError(t, err)
+	require.False(t, a.Truncated)
+	require.Len(t, a.Answer, 40)
+}
+
+func TestTruncateResponse(t *testing.T) {
+	q := new(dns.Msg)
+	q.SetQuestion("example.com.", dns.TypeA)
+	q.SetEdns0(4096, true)
+
+	response := func(answers, extras int) *dns.Msg {
+		a := new(dns.Msg)
+		a.SetReply(q)
+		for i := 0; i < answers; i++ {
+			a.Answer = append(a.Answer, &dns.A{
+				Hdr: dns.RR_Header{Name: "example.com.", Rrtype: dns.TypeA, Class: dns.ClassINET, Ttl: 300},
+				A:   net.IPv4(192, 0, 2, byte(i)),
+			})
+		}
+		for i := 0; i < extras; i++ {
+			a.Extra = append(a.Extra, &dns.TXT{
+				Hdr: dns.RR_Header{Name: "example.com.", Rrtype: dns.TypeTXT, Class: dns.ClassINET, Ttl: 300},
+				Txt: []string{strings.Repeat("x", 100)},
+			})
+		}
+		a.SetEdns0(4096, true)
+		return a
+	}
+
+	// The size advertised by the client is limited by the listener
+	require.Equal(t, 4096, udpResponseSize(q, 0))
+	require.Equal(t, 1232, udpResponseSize(q, 1232))
+	require.Equal(t, dns.MinMsgSize, udpResponseSize(new(dns.Msg), 0))
+
+	// Fits
+	a := response(10, 0)
+	truncateResponse(a, 512)
+	require.False(t, a.Truncated)
+	require.Len(t, a.Answer, 10)
+
+	// Additional records are removed first, the OPT record is kept
+	a = response(10, 10)
+	truncateResponse(a, 512)
+	require.False(t, a.Truncated)
+	require.Len(t, a.Answer, 10)
+	require.Len(t, a.Extra, 1)
+	require.NotNil(t, a.IsEdns0())
+
+	// Answers are not split up
+	a = response(50, 0)
+	truncateResponse(a, 512)
+	require.True(t, a.Truncated)
+	require.Empty(t, a.Answer)
+	require.NotNil(t, a.IsEdns0())
+	require.LessOrEqual(t, a.Len(), 512)
+}
+
+func TestSetUDPSize(t *testing.T) {
+	q := new(dns.Msg)
+	q.SetQuestion("example.com.", dns.TypeA)
+
+	// An OPT record is added to the copy, the original isn't changed
+	c := setUDPSize(q, 1232)
+	require.NotNil(t, c.IsEdns0())
+	require.Equal(t, uint16(1232), c.IsEdns0().UDPSize())
+	require.Nil(t, q.IsEdns0())
+}
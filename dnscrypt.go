@@ -0,0 +1,313 @@
+package rdns
+
+import (
+	"bytes"
+	"crypto/ed25519"
+	"crypto/rand"
+	"crypto/subtle"
+	"encoding/base64"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"strconv"
+	"strings"
+	"time"
+
+	"golang.org/x/crypto/chacha20"
+	"golang.org/x/crypto/curve25519"
+	"golang.org/x/crypto/nacl/secretbox"
+	"golang.org/x/crypto/poly1305"
+	"golang.org/x/crypto/salsa20/salsa"
+)
+
+// Implementation of the DNSCrypt v2 protocol shared by the client and the
+// listener. See https://dnscrypt.info/protocol for the specification.
+
+// Encryption systems used in DNSCrypt certificates.
+const (
+	dnscryptXSalsa20Poly1305  uint16 = 1
+	dnscryptXChacha20Poly1305 uint16 = 2
+)
+
+const (
+	dnscryptCertSize        = 124
+	dnscryptQueryHeaderSize = 8 + 32 + 12 // client-magic, client-pk, client-nonce
+	dnscryptRespHeaderSize  = 8 + 24      // resolver-magic, nonce
+	dnscryptMinQuerySize    = 256         // min padded UDP query length
+	dnscryptStampProtocol   = 0x01
+)
+
+var (
+	dnscryptCertMagic     = []byte("DNSC")
+	dnscryptResolverMagic = []byte{0x72, 0x36, 0x66, 0x6e, 0x76, 0x57, 0x6a, 0x38}
+)
+
+// DNSCryptStamp holds the information in a DNSCrypt server stamp (sdns://).
+type DNSCryptStamp struct {
+	Props        uint64
+	Address      string
+	ProviderKey  ed25519.PublicKey
+	ProviderName string
+}
+
+// Server stamp properties.
+const (
+	DNSCryptStampDNSSEC   uint64 = 1 << 0
+	DNSCryptStampNoLog    uint64 = 1 << 1
+	DNSCryptStampNoFilter uint64 = 1 << 2
+)
+
+// ParseDNSCryptStamp decodes an sdns:// stamp for a DNSCrypt server.
+func ParseDNSCryptStamp(s string) (DNSCryptStamp, error) {
+	var stamp DNSCryptStamp
+	if !strings.HasPrefix(s, "sdns://") {
+		return stamp, fmt.Errorf("invalid dnscrypt stamp %q, expected sdns:// prefix", s)
+	}
+	b, err := base64.RawURLEncoding.DecodeString(strings.TrimPrefix(s, "sdns://"))
+	if err != nil {
+		return stamp, fmt.Errorf("invalid dnscrypt stamp: %w", err)
+	}
+	if len(b) < 9 || b[0] != dnscryptStampProtocol {
+		return stamp, errors.New("invalid dnscrypt stamp, not a dnscrypt server")
+	}
+	stamp.Props = binary.LittleEndian.Uint64(b[1:9])
+	b = b[9:]
+	var fields [3][]byte
+	for i := range fields {
+		if len(b) < 1 || len(b) < 1+int(b[0]) {
+			return stamp, errors.New("invalid dnscrypt stamp, too short")
+		}
+		fields[i] = b[1 : 1+int(b[0])]
+		b = b[1+int(b[0]):]
+	}
+	if len(fields[1]) != ed25519.PublicKeySize {
+		return stamp, errors.New("invalid dnscrypt stamp, bad provider key length")
+	}
+	stamp.Address = AddressWithDefault(string(fields[0]), DNSCryptPort)
+	stamp.ProviderKey = ed25519.PublicKey(fields[1])
+	stamp.ProviderName = string(fields[2])
+	return stamp, nil
+}
+
+// String returns the stamp in sdns:// form.
+func (s DNSCryptStamp) String() string {
+	b := []byte{dnscryptStampProtocol}
+	b = binary.LittleEndian.AppendUint64(b, s.Props)
+	for _, field := range [][]byte{[]byte(s.Address), s.ProviderKey, []byte(s.ProviderName)} {
+		b = append(b, byte(len(field)))
+		b = append(b, field...)
+	}
+	return "sdns://" + base64.RawURLEncoding.EncodeToString(b)
+}
+
+// dnscryptCert is a certificate published by a DNSCrypt server, holding its
+// short-term public key.
+type dnscryptCert struct {
+	esVersion   uint16
+	resolverPK  [32]byte
+	clientMagic [8]byte
+	serial      uint32
+	notBefore   time.Time
+	notAfter    time.Time
+}
+
+// Encode and sign the certificate with the provider key.
+func (c *dnscryptCert) marshal(key ed25519.PrivateKey) []byte {
+	b := make([]byte, 0, dnscryptCertSize)
+	b = append(b, dnscryptCertMagic...)
+	b = binary.BigEndian.AppendUint16(b, c.esVersion)
+	b = binary.BigEndian.AppendUint16(b, 0) // protocol minor version
+	signed := make([]byte, 0, 52)
+	signed = append(signed, c.resolverPK[:]...)
+	signed = append(signed, c.clientMagic[:]...)
+	signed = binary.BigEndian.AppendUint32(signed, c.serial)
+	signed = binary.BigEndian.AppendUint32(signed, uint32(c.notBefore.Unix()))
+	signed = binary.BigEndian.AppendUint32(signed, uint32(c.notAfter.Unix()))
+	b = append(b, ed25519.Sign(key, signed)...)
+	return append(b, signed...)
+}
+
+// Decode a certificate and verify its signature with the provider key.
+func parseDNSCryptCert(b []byte, key ed25519.PublicKey) (*dnscryptCert, error) {
+	if len(b) < dnscryptCertSize || !bytes.Equal(b[:4], dnscryptCertMagic) {
+		return nil, errors.New("invalid dnscrypt certificate")
+	}
+	signature, signed := b[8:72], b[72:]
+	if !ed25519.Verify(key, signed, signature) {
+		return nil, errors.New("invalid dnscrypt certificate signature")
+	}
+	c := &dnscryptCert{
+		esVersion: binary.BigEndian.Uint16(b[4:6]),
+		serial:    binary.BigEndian.Uint32(signed[40:44]),
+		notBefore: time.Unix(int64(binary.BigEndian.Uint32(signed[44:48])), 0),
+		notAfter:  time.Unix(int64(binary.BigEndian.Uint32(signed[48:52])), 0),
+	}
+	copy(c.resolverPK[:], signed[:32])
+	copy(c.clientMagic[:], signed[32:40])
+	return c, nil
+}
+
+// Returns true if the certificate is valid at the given time.
+func (c *dnscryptCert) validAt(t time.Time) bool {
+	return !t.Before(c.notBefore) && t.Before(c.notAfter)
+}
+
+// Generate an X25519 key pair.
+func dnscryptKeyPair() (sk, pk [32]byte, err error) {
+	if _, err = rand.Read(sk[:]); err != nil {
+		return
+	}
+	var p []byte
+	p, err = curve25519.X25519(sk[:], curve25519.Basepoint)
+	copy(pk[:], p)
+	return
+}
+
+// Compute the shared key for the encryption system from a secret and a
+// public key.
+func dnscryptSharedKey(esVersion uint16, sk, pk [32]byte) ([32]byte, error) {
+	var key [32]byte
+	shared, err := curve25519.X25519(sk[:], pk[:])
+	if err != nil {
+		return key, err
+	}
+	copy(key[:], shared)
+	var zero [16]byte
+	switch esVersion {
+	case dnscryptXSalsa20Poly1305:
+		salsa.HSalsa20(&key, &zero, &key, &salsa.Sigma)
+	case dnscryptXChacha20Poly1305:
+		k, err := chacha20.HChaCha20(key[:], zero[:])
+		if err != nil {
+			return key, err
+		}
+		copy(key[:], k)
+	default:
+		return key, fmt.Errorf("unsupported dnscrypt encryption system %d", esVersion)
+	}
+	return key, nil
+}
+
+// Encrypt and authenticate a message. The output is the authenticator
+// followed by the ciphertext, for both encryption systems.
+func dnscryptSeal(esVersion uint16, key *[32]byte, nonce *[24]byte, msg []byte) []byte {
+	if esVersion == dnscryptXSalsa20Poly1305 {
+		return secretbox.Seal(nil, msg, nonce, key)
+	}
+	out := make([]byte, poly1305.TagSize+len(msg))
+	polyKey := xchachaStream(key, nonce, out[poly1305.TagSize:], msg)
+	var tag [poly1305.TagSize]byte
+	poly1305.Sum(&tag, out[poly1305.TagSize:], &polyKey)
+	copy(out, tag[:])
+	return out
+}
+
+// Verify and decrypt a message produced by dnscryptSeal.
+func dnscryptOpen(esVersion uint16, key *[32]byte, nonce *[24]byte, box []byte) ([]byte, error) {
+	if esVersion == dnscryptXSalsa20Poly1305 {
+		msg, ok := secretbox.Open(nil, box, nonce, key)
+		if !ok {
+			return nil, errors.New("failed to decrypt dnscrypt message")
+		}
+		return msg, nil
+	}
+	if len(box) < poly1305.TagSize {
+		return nil, errors.New("dnscrypt message too short")
+	}
+	var tag [poly1305.TagSize]byte
+	copy(tag[:], box)
+	ciphertext := box[poly1305.TagSize:]
+	msg := make([]byte, len(ciphertext))
+	polyKey := xchachaStream(key, nonce, msg, ciphertext)
+	if !poly1305.Verify(&tag, ciphertext, &polyKey) {
+		return nil, errors.New("failed to decrypt dnscrypt message")
+	}
+	return msg, nil
+}
+
+// Applies the XChaCha20 key stream to src the way secretbox does with
+// XSalsa20: the first 32 bytes of the stream are the Poly1305 key and the
+// message starts at byte 32. Returns the Poly1305 key.
+func xchachaStream(key *[32]byte, nonce *[24]byte, dst, src []byte) [32]byte {
+	cipher, _ := chacha20.NewUnauthenticatedCipher(key[:], nonce[:])
+	var firstBlock [64]byte
+	cipher.XORKeyStream(firstBlock[:], firstBlock[:])
+	var polyKey [32]byte
+	copy(polyKey[:], firstBlock[:32])
+	n := min(len(src), 32)
+	subtle.XORBytes(dst[:n], src[:n], firstBlock[32:32+n])
+	if len(src) > n {
+		cipher.SetCounter(1)
+		cipher.XORKeyStream(dst[n:], src[n:])
+	}
+	return polyKey
+}
+
+// Pad a message to a multiple of 64 bytes, and at least minLen, with
+// ISO/IEC 7816-4 padding.
+func dnscryptPad(msg []byte, minLen int) []byte {
+	n := max(minLen, (len(msg)+1+63)/64*64)
+	padded := make([]byte, n)
+	copy(padded, msg)
+	padded[len(msg)] = 0x80
+	return padded
+}
+
+// Remove the padding from a message.
+func dnscryptUnpad(msg []byte) ([]byte, error) {
+	// The padding is a 0x80 byte followed by zeros
+	i := len(msg) - 1
+	for i >= 0 && msg[i] == 0 {
+		i--
+	}
+	if i < 0 || msg[i] != 0x80 {
+		return nil, errors.New("invalid dnscrypt padding")
+	}
+	return msg[:i], nil
+}
+
+// Encode binary data as TXT record string in presentation format.
+func txtEscape(b []byte) string {
+	var s strings.Builder
+	for _, c := range b {
+		switch {
+		case c == '"' || c == '\\':
+			s.WriteByte('\\')
+			s.WriteByte(c)
+		case c < ' ' || c > '~':
+			fmt.Fprintf(&s, "\\%03d", c)
+		default:
+			s.WriteByte(c)
+		}
+	}
+	return s.String()
+}
+
+// Decode the binary content of a TXT record string in presentation format.
+func txtUnescape(s string) ([]byte, error) {
+	b := make([]byte, 0, len(s))
+	for i := 0; i < len(s); i++ {
+		if s[i] != '\\' {
+			b = append(b, s[i])
+			continue
+		}
+		if i+3 < len(s) && isDigit(s[i+1]) && isDigit(s[i+2]) && isDigit(s[i+3]) {
+			n, err := strconv.Atoi(s[i+1 : i+4])
+			if err != nil || n > 255 {
+				return nil, fmt.Errorf("invalid escape sequence in %q", s)
+			}
+			b = append(b, byte(n))
+			i += 3
+			continue
+		}
+		if i+1 < len(s) {
+			b = append(b, s[i+1])
+			i++
+		}
+	}
+	return b, nil
+}
+
+func isDigit(c byte) bool {
+	return c >= '0' && c <= '9'
+}
@@ -0,0 +1,104 @@
+package rdns
+
+import (
+	"crypto/ed25519"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/require"
+)
+
+func TestDNSCryptStamp(t *testing.T) {
+	pk, _, err := ed25519.GenerateKey(nil)
+	require.NoError(t, err)
+	stamp := DNSCryptStamp{
+		Props:        DNSCryptStampDNSSEC | DNSCryptStampNoLog,
+		Address:      "192.0.2.1:8443",
+		ProviderKey:  pk,
+		ProviderName: "2.dnscrypt-cert.example.com",
+	}
+	s, err := ParseDNSCryptStamp(stamp.String())
+	require.NoError(t, err)
+	require.Equal(t, stamp, s)
+
+	// The port defaults to 443
+	stamp.Address = "192.0.2.1"
+	s, err = ParseDNSCryptStamp(stamp.String())
+	require.NoError(t, err)
+	require.Equal(t, "192.0.2.1:443", s.Address)
+
+	_, err = ParseDNSCryptStamp("sdns://AgcAAAAAAAAA")
+	require.Error(t, err)
+}
+
+func TestDNSCryptCert(t *testing.T) {
+	pk, sk, err := ed25519.GenerateKey(nil)
+	require.NoError(t, err)
+	now := time.Now().Truncate(time.Second)
+	cert := &dnscryptCert{
+		esVersion:   dnscryptXChacha20Poly1305,
+		resolverPK:  [32]byte{1, 2, 3},
+		clientMagic: [8]byte{'"', '\\', 0, 255},
+		serial:      42,
+		notBefore:   now,
+		notAfter:    now.Add(time.Hour),
+	}
+	b, err := txtUnescape(txtEscape(cert.marshal(sk)))
+	require.NoError(t, err)
+	require.Len(t, b, dnscryptCertSize)
+	c, err := parseDNSCryptCert(b, pk)
+	require.NoError(t, err)
+	require.Equal(t, cert, c)
+
+	// Signed by a different key
+	other, _, err := ed25519.GenerateKey(nil)
+	require.NoError(t, err)
+	_, err = parseDNSCryptCert(b, other)
+	require.Error(t, err)
+}
+
+func TestDNSCryptSealOpen(t *testing.T) {
+	for _, es := range []uint16{dnscryptXSalsa20Poly1305, dnscryptXChacha20Poly1305} {
+		clientSK, clientPK, err := dnscryptKeyPair()
+		require.NoError(t, err)
+		serverSK, serverPK, err := dnscryptKeyPair()
+		require.NoError(t, err)
+		clientKey, err := dnscryptSharedKey(es, clientSK, serverPK)
+		require.NoError(t, err)
+		serverKey, err := dnscryptSharedKey(es, serverSK, clientPK)
+		require.NoError(t, err)
+		require.Equal(t, clientKey, serverKey)
+
+		nonce := [24]byte{1}
+		msg := dnscryptPad([]byte("query with more than 32 bytes of content"), dnscryptMinQuerySize)
+		require.Len(t, msg, dnscryptMinQuerySize)
+		box := dnscryptSeal(es, &clientKey, &nonce, msg)
+		out, err := dnscryptOpen(es, &serverKey, &nonce, box)
+		require.NoError(t, err)
+		out, err = dnscryptUnpad(out)
+		require.NoError(t, err)
+		require.Equal(t, "query with more than 32 bytes of content", string(out))
+
+		// Tampered messages are rejected
+		box[len(box)-1] ^= 1
+		_, err = dnscryptOpen(es, &serverKey, &nonce, box)
+		require.Error(t, err)
+	}
+}
+
+func TestDNSCryptPadding(t *testing.T) {
+	// Messages can end with any byte, including those that look like the
+	// start of a multi-byte UTF-8 sequence
+	for b := 0; b < 256; b++ {
+		msg := []byte{0x12, 0x34, byte(b)}
+		out, err := dnscryptUnpad(dnscryptPad(msg, dnscryptMinQuerySize))
+		require.NoError(t, err, "last byte %#x", b)
+		require.Equal(t, msg, out, "last byte %#x", b)
+	}
+
+	// Padding without the 0x80 marker is invalid
+	_, err := dnscryptUnpad(make([]byte, 64))
+	require.Error(t, err)
+	_, err = dnscryptUnpad([]byte{0x12, 0x01, 0x00})
+	require.Error(t, err)
+}
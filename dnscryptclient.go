@@ -0,0 +1,299 @@
+package rdns
+
+import (
+	"crypto/rand"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"sync"
+	"time"
+
+	"github.com/miekg/dns"
+	"github.com/sirupsen/logrus"
+)
+
+// DNSCryptClient is a DNSCrypt v2 resolver. The server is identified by an
+// sdns:// stamp which contains the address, the provider name and the
+// provider public key used to verify the server certificates. Certificates
+// are fetched when needed and refreshed regularly to pick up key rotations.
+type DNSCryptClient struct {
+	id       string
+	endpoint string
+	stamp    DNSCryptStamp
+	opt      DNSCryptClientOptions
+	metrics  *ListenerMetrics
+
+	mu      sync.Mutex
+	session *dnscryptSession
+}
+
+var _ Resolver = &DNSCryptClient{}
+
+// DNSCryptClientOptions contain settings for the DNSCrypt resolver.
+type DNSCryptClientOptions struct {
+	// Local IP to use for outbound connections. If nil, a local address is chosen.
+	LocalAddr net.IP
+
+	// Query timeout, default 2 seconds.
+	QueryTimeout time.Duration
+
+	// Send queries over TCP instead of UDP.
+	TCP bool
+}
+
+// Time after which the certificates are fetched again.
+const dnscryptCertRefresh = time.Hour
+
+// Keys for queries using one server certificate.
+type dnscryptSession struct {
+	cert      *dnscryptCert
+	clientPK  [32]byte
+	sharedKey [32]byte
+	expires   time.Time
+}
+
+// NewDNSCryptClient returns a new DNSCrypt resolver for the server in the stamp.
+func NewDNSCryptClient(id, stamp string, opt DNSCryptClientOptions) (*DNSCryptClient, error) {
+	s, err := ParseDNSCryptStamp(stamp)
+	if err != nil {
+		return nil, err
+	}
+	if opt.QueryTimeout == 0 {
+		opt.QueryTimeout = 2 * time.Second
+	}
+	return &DNSCryptClient{
+		id:       id,
+		endpoint: s.Address,
+		stamp:    s,
+		opt:      opt,
+		metrics:  NewListenerMetrics("client", id),
+	}, nil
+}
+
+// Resolve a DNS query by encrypting it and sending it to the server.
+func (d *DNSCryptClient) Resolve(q *dns.Msg, ci ClientInfo) (*dns.Msg, error) {
+	log := logger(d.id, q, ci).WithFields(logrus.Fields{"resolver": d.endpoint, "protocol": "dnscrypt"})
+	d.metrics.query.Add(1)
+
+	session, err := d.currentSession(log)
+	if err != nil {
+		d.metrics.err.Add("cert", 1)
+		return nil, err
+	}
+	timeout := queryTimeout(d.opt.QueryTimeout, ci.Deadline)
+	if timeout <= 0 {
+		d.metrics.err.Add("deadline", 1)
+		return nil, QueryTimeoutError{q}
+	}
+	deadline := time.Now().Add(timeout)
+	log.Debug("querying upstream resolver")
+	a, err := d.exchange(session, q, d.opt.TCP, deadline)
+	if err == nil && a.Truncated && !d.opt.TCP {
+		log.Debug("response truncated, retrying over tcp")
+		a, err = d.exchange(session, q, true, deadline)
+	}
+	if err != nil {
+		d.metrics.err.Add("query", 1)
+		return nil, err
+	}
+	d.metrics.response.Add(rCode(a), 1)
+	return a, nil
+}
+
+func (d *DNSCryptClient) String() string {
+	return d.id
+}
+
+// Returns the session for the newest valid certificate, fetching the
+// certificates again if needed.
+func (d *DNSCryptClient) currentSession(log *logrus.Entry) (*dnscryptSession, error) {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	now := time.Now()
+	if d.session != nil && now.Before(d.session.expires) && d.session.cert.validAt(now) {
+		return d.session, nil
+	}
+	log.WithField("provider", d.stamp.ProviderName).Debug("fetching dnscrypt certificates")
+	cert, err := d.fetchCert()
+	if err != nil {
+		return nil, err
+	}
+	sk, pk, err := dnscryptKeyPair()
+	if err != nil {
+		return nil, err
+	}
+	key, err := dnscryptSharedKey(cert.esVersion, sk, cert.resolverPK)
+	if err != nil {
+		return nil, err
+	}
+	d.session = &dnscryptSession{
+		cert:      cert,
+		clientPK:  pk,
+		sharedKey: key,
+		expires:   now.Add(dnscryptCertRefresh),
+	}
+	return d.session, nil
+}
+
+// Query the server for its certificates and return the valid one with the
+// highest serial.
+func (d *DNSCryptClient) fetchCert() (*dnscryptCert, error) {
+	q := new(dns.Msg)
+	q.SetQuestion(dns.Fqdn(d.stamp.ProviderName), dns.TypeTXT)
+	client := &dns.Client{Net: "udp", Timeout: d.opt.QueryTimeout}
+	if d.opt.TCP {
+		client.Net = "tcp"
+	}
+	if d.opt.LocalAddr != nil {
+		client.Dialer = &net.Dialer{LocalAddr: d.localAddr(client.Net)}
+	}
+	a, _, err := client.Exchange(q, d.endpoint)
+	if err == nil && a.Truncated && client.Net == "udp" {
+		client.Net = "tcp"
+		if d.opt.LocalAddr != nil {
+			client.Dialer = &net.Dialer{LocalAddr: d.localAddr(client.Net)}
+		}
+		a, _, err = client.Exchange(q, d.endpoint)
+	}
+	if err != nil {
+		return nil, fmt.Errorf("failed to fetch dnscrypt certificates: %w", err)
+	}
+
+	var cert *dnscryptCert
+	now := time.Now()
+	for _, rr := range a.Answer {
+		txt, ok := rr.(*dns.TXT)
+		if !ok {
+			continue
+		}
+		var s string
+		for _, t := range txt.Txt {
+			s += t
+		}
+		b, err := txtUnescape(s)
+		if err != nil {
+			continue
+		}
+		c, err := parseDNSCryptCert(b, d.stamp.ProviderKey)
+		if err != nil {
+			Log.WithFields(logrus.Fields{"id": d.id, "resolver": d.endpoint}).WithError(err).Warn("ignoring dnscrypt certificate")
+			continue
+		}
+		if !c.validAt(now) {
+			continue
+		}
+		if c.esVersion != dnscryptXSalsa20Poly1305 && c.esVersion != dnscryptXChacha20Poly1305 {
+			continue
+		}
+		if cert == nil || c.serial > cert.serial {
+			cert = c
+		}
+	}
+	if cert == nil {
+		return nil, fmt.Errorf("no valid dnscrypt certificate from %s", d.endpoint)
+	}
+	return cert, nil
+}
+
+// Encrypt the query, send it and decrypt the response.
+func (d *DNSCryptClient) exchange(session *dnscryptSession, q *dns.Msg, tcp bool, deadline time.Time) (*dns.Msg, error) {
+	b, err := q.Pack()
+	if err != nil {
+		return nil, err
+	}
+	var clientNonce [12]byte
+	if _, err := rand.Read(clientNonce[:]); err != nil {
+		return nil, err
+	}
+	var nonce [24]byte
+	copy(nonce[:], clientNonce[:])
+	minLen := dnscryptMinQuerySize
+	if tcp {
+		minLen = 0
+	}
+	box := dnscryptSeal(session.cert.esVersion, &session.sharedKey, &nonce, dnscryptPad(b, minLen))
+	packet := make([]byte, 0, dnscryptQueryHeaderSize+len(box))
+	packet = append(packet, session.cert.clientMagic[:]...)
+	packet = append(packet, session.clientPK[:]...)
+	packet = append(packet, clientNonce[:]...)
+	packet = append(packet, box...)
+
+	network := "udp"
+	if tcp {
+		network = "tcp"
+	}
+	dialer := &net.Dialer{Deadline: deadline, LocalAddr: d.localAddr(network)}
+	conn, err := dialer.Dial(network, d.endpoint)
+	if err != nil {
+		return nil, err
+	}
+	defer conn.Close()
+	if err := conn.SetDeadline(deadline); err != nil {
+		return nil, err
+	}
+
+	var resp []byte
+	if tcp {
+		if _, err := conn.Write(binary.BigEndian.AppendUint16(nil, uint16(len(packet)))); err != nil {
+			return nil, err
+		}
+		if _, err := conn.Write(packet); err != nil {
+			return nil, err
+		}
+		var l [2]byte
+		if _, err := io.ReadFull(conn, l[:]); err != nil {
+			return nil, err
+		}
+		resp = make([]byte, binary.BigEndian.Uint16(l[:]))
+		if _, err := io.ReadFull(conn, resp); err != nil {
+			return nil, err
+		}
+	} else {
+		if _, err := conn.Write(packet); err != nil {
+			return nil, err
+		}
+		resp = make([]byte, dns.MaxMsgSize)
+		n, err := conn.Read(resp)
+		if err != nil {
+			return nil, err
+		}
+		resp = resp[:n]
+	}
+
+	// Check the response is for this query and decrypt it
+	if len(resp) < dnscryptRespHeaderSize || string(resp[:8]) != string(dnscryptResolverMagic) {
+		return nil, errors.New("invalid dnscrypt response")
+	}
+	copy(nonce[:], resp[8:32])
+	if string(nonce[:12]) != string(clientNonce[:]) {
+		return nil, errors.New("dnscrypt response nonce mismatch")
+	}
+	padded, err := dnscryptOpen(session.cert.esVersion, &session.sharedKey, &nonce, resp[dnscryptRespHeaderSize:])
+	if err != nil {
+		return nil, err
+	}
+	msg, err := dnscryptUnpad(padded)
+	if err != nil {
+		return nil, err
+	}
+	a := new(dns.Msg)
+	if err := a.Unpack(msg); err != nil {
+		return nil, err
+	}
+	if a.Id != q.Id {
+		return nil, errors.New("dnscrypt response id mismatch")
+	}
+	return a, nil
+}
+
+func (d *DNSCryptClient) localAddr(network string) net.Addr {
+	if d.opt.LocalAddr == nil {
+		return nil
+	}
+	if network == "tcp" {
+		return &net.TCPAddr{IP: d.opt.LocalAddr}
+	}
+	return &net.UDPAddr{IP: d.opt.LocalAddr}
+}
@@ -0,0 +1,381 @@
+package rdns
+
+import (
+	"bytes"
+	"crypto/ed25519"
+	"crypto/rand"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/miekg/dns"
+	"github.com/sirupsen/logrus"
+)
+
+// DNSCryptListener is a DNSCrypt v2 server accepting queries over UDP and TCP
+// on the same address. Short-term keys and certificates are generated on start
+// and rotated regularly, the certificates are signed with the provider key.
+// Clients fetch the certificates with an unencrypted TXT query for the
+// provider name. Any other unencrypted query is dropped.
+type DNSCryptListener struct {
+	id       string
+	addr     string
+	resolver Resolver
+	opt      DNSCryptListenerOptions
+	metrics  *ListenerMetrics
+	log      *logrus.Entry
+
+	mu    sync.Mutex
+	certs []*dnscryptServerCert
+	udp   net.PacketConn
+	tcp   net.Listener
+}
+
+var _ Listener = &DNSCryptListener{}
+
+// DNSCryptListenerOptions contain settings for the DNSCrypt server.
+type DNSCryptListenerOptions struct {
+	ListenOptions
+
+	// Provider name in the form 2.dnscrypt-cert.<domain>.
+	ProviderName string
+
+	// Long-term key used to sign the certificates. The public part of it has
+	// to be given to clients, typically in the server stamp.
+	ProviderKey ed25519.PrivateKey
+
+	// Validity of certificates, default 24 hours. A new certificate is
+	// generated after half of that.
+	CertLifetime time.Duration
+
+	// Use X25519-XSalsa20Poly1305 instead of X25519-XChacha20Poly1305.
+	XSalsa20 bool
+}
+
+// Certificate with the corresponding short-term secret key.
+type dnscryptServerCert struct {
+	dnscryptCert
+	sk  [32]byte
+	txt string // signed certificate as TXT string
+}
+
+// NewDNSCryptListener returns an instance of a DNSCrypt listener.
+func NewDNSCryptListener(id, addr string, opt DNSCryptListenerOptions, resolver Resolver) (*DNSCryptListener, error) {
+	if !strings.HasPrefix(opt.ProviderName, "2.dnscrypt-cert.") {
+		return nil, fmt.Errorf("invalid dnscrypt provider name %q, expected 2.dnscrypt-cert.<domain>", opt.ProviderName)
+	}
+	if len(opt.ProviderKey) != ed25519.PrivateKeySize {
+		return nil, errors.New("invalid dnscrypt provider key")
+	}
+	opt.ProviderName = strings.TrimSuffix(opt.ProviderName, ".")
+	if opt.CertLifetime == 0 {
+		opt.CertLifetime = 24 * time.Hour
+	}
+	l := &DNSCryptListener{
+		id:       id,
+		addr:     addr,
+		resolver: resolver,
+		opt:      opt,
+		metrics:  NewListenerMetrics("listener", id),
+		log:      Log.WithFields(logrus.Fields{"id": id, "protocol": "dnscrypt", "addr": addr}),
+	}
+	// Generate the first certificate right away to catch any issues early
+	if _, err := l.certificates(time.Now()); err != nil {
+		return nil, err
+	}
+	return l, nil
+}
+
+// Start the DNSCrypt server.
+func (s *DNSCryptListener) Start() error {
+	s.log.WithField("stamp", s.Stamp().String()).Info("starting listener")
+	udp, err := net.ListenPacket("udp", s.addr)
+	if err != nil {
+		return err
+	}
+	tcp, err := net.Listen("tcp", s.addr)
+	if err != nil {
+		udp.Close()
+		return err
+	}
+	s.mu.Lock()
+	s.udp, s.tcp = udp, tcp
+	s.mu.Unlock()
+
+	errCh := make(chan error, 2)
+	go func() { errCh <- s.serveUDP(udp) }()
+	go func() { errCh <- s.serveTCP(tcp) }()
+	err = <-errCh
+	udp.Close()
+	tcp.Close()
+	return err
+}
+
+// Stop the server.
+func (s *DNSCryptListener) Stop() error {
+	s.log.Info("stopping listener")
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if s.udp != nil {
+		s.udp.Close()
+	}
+	if s.tcp != nil {
+		s.tcp.Close()
+	}
+	return nil
+}
+
+func (s *DNSCryptListener) String() string {
+	return s.id
+}
+
+// Stamp returns the server stamp clients can use to connect to this listener.
+func (s *DNSCryptListener) Stamp() DNSCryptStamp {
+	return DNSCryptStamp{
+		Address:      s.addr,
+		ProviderKey:  s.opt.ProviderKey.Public().(ed25519.PublicKey),
+		ProviderName: s.opt.ProviderName,
+	}
+}
+
+func (s *DNSCryptListener) serveUDP(conn net.PacketConn) error {
+	for {
+		buf := make([]byte, dns.MaxMsgSize)
+		n, addr, err := conn.ReadFrom(buf)
+		if err != nil {
+			return err
+		}
+		go func() {
+			if b := s.handle(buf[:n], addr, true); b != nil {
+				_, _ = conn.WriteTo(b, addr)
+			}
+		}()
+	}
+}
+
+func (s *DNSCryptListener) serveTCP(ln net.Listener) error {
+	for {
+		conn, err := ln.Accept()
+		if err != nil {
+			return err
+		}
+		go s.handleTCP(conn)
+	}
+}
+
+// Read length-prefixed queries from a TCP connection until it's closed or idle.
+func (s *DNSCryptListener) handleTCP(conn net.Conn) {
+	defer conn.Close()
+	for {
+		_ = conn.SetDeadline(time.Now().Add(10 * time.Second))
+		var l [2]byte
+		if _, err := io.ReadFull(conn, l[:]); err != nil {
+			return
+		}
+		b := make([]byte, binary.BigEndian.Uint16(l[:]))
+		if _, err := io.ReadFull(conn, b); err != nil {
+			s.metrics.err.Add("read", 1)
+			return
+		}
+		resp := s.handle(b, conn.RemoteAddr(), false)
+		if resp == nil {
+			return
+		}
+		out := binary.BigEndian.AppendUint16(make([]byte, 0, 2+len(resp)), uint16(len(resp)))
+		if _, err := conn.Write(append(out, resp...)); err != nil {
+			s.metrics.err.Add("send", 1)
+			return
+		}
+	}
+}
+
+// Process a packet and return the response to send, or nil if nothing
+// should be sent.
+func (s *DNSCryptListener) handle(packet []byte, addr net.Addr, udp bool) []byte {
+	ci := ClientInfo{Listener: s.id, Deadline: s.opt.queryDeadline()}
+	switch addr := addr.(type) {
+	case *net.TCPAddr:
+		ci.SourceIP = addr.IP
+	case *net.UDPAddr:
+		ci.SourceIP = addr.IP
+	}
+	log := s.log.WithField("client", ci.SourceIP)
+	if s.opt.access(ci.SourceIP) != ACLAllow {
+		log.Debug("refusing client ip")
+		s.metrics.err.Add("acl", 1)
+		return nil
+	}
+
+	certs, err := s.certificates(time.Now())
+	if err != nil {
+		log.WithError(err).Error("failed to rotate dnscrypt certificate")
+		s.metrics.err.Add("cert", 1)
+		return nil
+	}
+	if len(packet) >= dnscryptQueryHeaderSize {
+		for _, cert := range certs {
+			if bytes.Equal(packet[:8], cert.clientMagic[:]) {
+				return s.handleEncrypted(log, cert, packet, ci, udp)
+			}
+		}
+	}
+	return s.handleCertQuery(log, certs, packet, udp)
+}
+
+// Decrypt the query, resolve it and return the encrypted response.
+func (s *DNSCryptListener) handleEncrypted(log *logrus.Entry, cert *dnscryptServerCert, packet []byte, ci ClientInfo, udp bool) []byte {
+	var clientPK [32]byte
+	copy(clientPK[:], packet[8:40])
+	var nonce [24]byte
+	copy(nonce[:12], packet[40:52])
+	key, err := dnscryptSharedKey(cert.esVersion, cert.sk, clientPK)
+	if err != nil {
+		s.metrics.err.Add("decrypt", 1)
+		return nil
+	}
+	padded, err := dnscryptOpen(cert.esVersion, &key, &nonce, packet[dnscryptQueryHeaderSize:])
+	if err != nil {
+		log.WithError(err).Debug("failed to decrypt query")
+		s.metrics.err.Add("decrypt", 1)
+		return nil
+	}
+	b, err := dnscryptUnpad(padded)
+	if err != nil {
+		s.metrics.err.Add("decrypt", 1)
+		return nil
+	}
+	q := new(dns.Msg)
+	if err := q.Unpack(b); err != nil || len(q.Question) == 0 {
+		s.metrics.err.Add("unpack", 1)
+		return nil
+	}
+	log = log.WithField("qname", qName(q))
+	log.Debug("received query")
+	s.metrics.query.Add(1)
+
+	a, err := s.resolver.Resolve(q, ci)
+	if err != nil {
+		log.WithError(err).Error("failed to resolve")
+		s.metrics.err.Add("resolve", 1)
+		a = servfail(q)
+	}
+	// A nil response from the resolvers means "drop"
+	if a == nil {
+		s.metrics.drop.Add(1)
+		return nil
+	}
+	stripPadding(a)
+	out, err := a.Pack()
+	if err != nil {
+		s.metrics.err.Add("encode", 1)
+		return nil
+	}
+
+	// UDP responses can't be larger than the query, send a truncated response
+	// so the client retries over TCP
+	if udp && dnscryptRespHeaderSize+16+len(dnscryptPad(out, 0)) > len(packet) {
+		tc := new(dns.Msg)
+		tc.SetReply(q)
+		tc.Truncated = true
+		if out, err = tc.Pack(); err != nil {
+			return nil
+		}
+	}
+
+	if _, err := rand.Read(nonce[12:]); err != nil {
+		return nil
+	}
+	resp := make([]byte, 0, dnscryptRespHeaderSize+16+len(out)+64)
+	resp = append(resp, dnscryptResolverMagic...)
+	resp = append(resp, nonce[:]...)
+	resp = append(resp, dnscryptSeal(cert.esVersion, &key, &nonce, dnscryptPad(out, 0))...)
+	s.metrics.response.Add(rCode(a), 1)
+	return resp
+}
+
+// Respond to unencrypted TXT queries for the provider name with the current
+// certificates.
+func (s *DNSCryptListener) handleCertQuery(log *logrus.Entry, certs []*dnscryptServerCert, packet []byte, udp bool) []byte {
+	q := new(dns.Msg)
+	if err := q.Unpack(packet); err != nil || len(q.Question) != 1 {
+		s.metrics.err.Add("unpack", 1)
+		return nil
+	}
+	question := q.Question[0]
+	if question.Qtype != dns.TypeTXT || !strings.EqualFold(question.Name, s.opt.ProviderName+".") {
+		log.WithField("qname", qName(q)).Debug("dropping unencrypted query")
+		s.metrics.drop.Add(1)
+		return nil
+	}
+	log.Debug("received certificate query")
+	a := new(dns.Msg)
+	a.SetReply(q)
+	a.Authoritative = true
+	for _, cert := range certs {
+		a.Answer = append(a.Answer, &dns.TXT{
+			Hdr: dns.RR_Header{Name: question.Name, Rrtype: dns.TypeTXT, Class: dns.ClassINET, Ttl: 600},
+			Txt: []string{cert.txt},
+		})
+	}
+	if udp {
+		maxSize := dns.MinMsgSize
+		if edns0 := q.IsEdns0(); edns0 != nil {
+			maxSize = int(edns0.UDPSize())
+		}
+		a.Truncate(maxSize)
+	}
+	out, err := a.Pack()
+	if err != nil {
+		s.metrics.err.Add("encode", 1)
+		return nil
+	}
+	return out
+}
+
+// Returns the currently valid certificates, newest first. Generates a new one
+// if the newest has reached half its lifetime and drops expired ones.
+func (s *DNSCryptListener) certificates(now time.Time) ([]*dnscryptServerCert, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	var valid []*dnscryptServerCert
+	for _, cert := range s.certs {
+		if cert.validAt(now) {
+			valid = append(valid, cert)
+		}
+	}
+	s.certs = valid
+	if len(s.certs) > 0 && now.Before(s.certs[0].notBefore.Add(s.opt.CertLifetime/2)) {
+		return s.certs, nil
+	}
+
+	sk, pk, err := dnscryptKeyPair()
+	if err != nil {
+		return nil, err
+	}
+	cert := &dnscryptServerCert{
+		dnscryptCert: dnscryptCert{
+			esVersion:  dnscryptXChacha20Poly1305,
+			resolverPK: pk,
+			serial:     uint32(now.Unix()),
+			notBefore:  now.Truncate(time.Second),
+			notAfter:   now.Add(s.opt.CertLifetime).Truncate(time.Second),
+		},
+		sk: sk,
+	}
+	if s.opt.XSalsa20 {
+		cert.esVersion = dnscryptXSalsa20Poly1305
+	}
+	if len(s.certs) > 0 && cert.serial <= s.certs[0].serial {
+		cert.serial = s.certs[0].serial + 1
+	}
+	copy(cert.clientMagic[:], pk[:8])
+	cert.txt = txtEscape(cert.marshal(s.opt.ProviderKey))
+	s.log.WithField("serial", cert.serial).Info("generated new dnscrypt certificate")
+	s.certs = append([]*dnscryptServerCert{cert}, s.certs...)
+	return s.certs, nil
+}
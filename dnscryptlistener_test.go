@@ -0,0 +1,110 @@
+package rdns
+
+import (
+	"crypto/ed25519"
+	"fmt"
+	"testing"
+	"time"
+
+	"github.com/miekg/dns"
+	"github.com/stretchr/testify/require"
+)
+
+func TestDNSCryptListener(t *testing.T) {
+	upstream := &TestResolver{
+		ResolveFunc: func(q *dns.Msg, ci ClientInfo) (*dns.Msg, error) {
+			a := new(dns.Msg)
+			a.SetReply(q)
+			// Large responses don't fit into a UDP response
+			n := 1
+			if q.Question[0].Name == "large.example.com." {
+				n = 50
+			}
+			for i := 0; i < n; i++ {
+				rr, err := dns.NewRR(fmt.Sprintf("%s 60 IN A 192.0.2.%d", q.Question[0].Name, i))
+				if err != nil {
+					return nil, err
+				}
+				a.Answer = append(a.Answer, rr)
+			}
+			return a, nil
+		},
+	}
+
+	addr, err := getUDPLnAddress()
+	require.NoError(t, err)
+	_, key, err := ed25519.GenerateKey(nil)
+	require.NoError(t, err)
+	s, err := NewDNSCryptListener("test-dnscrypt-ln", addr, DNSCryptListenerOptions{
+		ProviderName: "2.dnscrypt-cert.example.com",
+		ProviderKey:  key,
+	}, upstream)
+	require.NoError(t, err)
+	go func() { _ = s.Start() }()
+	defer s.Stop()
+	time.Sleep(100 * time.Millisecond)
+
+	for _, tcp := range []bool{false, true} {
+		c, err := NewDNSCryptClient("test-dnscrypt", s.Stamp().String(), DNSCryptClientOptions{TCP: tcp})
+		require.NoError(t, err)
+
+		q := new(dns.Msg)
+		q.SetQuestion("www.example.com.", dns.TypeA)
+		a, err := c.Resolve(q, ClientInfo{})
+		require.NoError(t, err)
+		require.Equal(t, q.Id, a.Id)
+		require.Len(t, a.Answer, 1)
+
+		// Truncated UDP responses are retried over TCP
+		q.SetQuestion("large.example.com.", dns.TypeA)
+		a, err = c.Resolve(q, ClientInfo{})
+		require.NoError(t, err)
+		require.False(t, a.Truncated)
+		require.Len(t, a.Answer, 50)
+	}
+
+	// Unencrypted queries other than for the certificates are dropped
+	q := new(dns.Msg)
+	q.SetQuestion("www.example.com.", dns.TypeA)
+	_, _, err = (&dns.Client{Timeout: 100 * time.Millisecond}).Exchange(q, addr)
+	require.Error(t, err)
+	require.Equal(t, 5, upstream.HitCount())
+}
+
+func TestDNSCryptListenerCertRotation(t *testing.T) {
+	_, key, err := ed25519.GenerateKey(nil)
+	require.NoError(t, err)
+	s, err := NewDNSCryptListener("test-dnscrypt-rotation", "127.0.0.1:0", DNSCryptListenerOptions{
+		ProviderName: "2.dnscrypt-cert.example.com.",
+		ProviderKey:  key,
+		CertLifetime: time.Hour,
+	}, new(TestResolver))
+	require.NoError(t, err)
+
+	now := time.Now()
+	certs, err := s.certificates(now)
+	require.NoError(t, err)
+	require.Len(t, certs, 1)
+	first := certs[0]
+
+	// After half the lifetime, a new certificate is added
+	certs, err = s.certificates(now.Add(31 * time.Minute))
+	require.NoError(t, err)
+	require.Len(t, certs, 2)
+	require.Greater(t, certs[0].serial, first.serial)
+	require.NotEqual(t, first.resolverPK, certs[0].resolverPK)
+
+	// Expired certificates are removed
+	certs, err = s.certificates(now.Add(61 * time.Minute))
+	require.NoError(t, err)
+	require.Len(t, certs, 2)
+	for _, cert := range certs {
+		require.NotEqual(t, first.serial, cert.serial)
+	}
+
+	_, err = NewDNSCryptListener("test-dnscrypt-invalid", "127.0.0.1:0", DNSCryptListenerOptions{
+		ProviderName: "example.com",
+		ProviderKey:  key,
+	}, new(TestResolver))
+	require.Error(t, err)
+}
@@ -3,6 +3,7 @@ package rdns
 import (
 	"crypto/tls"
 	"net"
+	"time"
 
 	"github.com/miekg/dns"
 	"github.com/sirupsen/logrus"
@@ -11,7 +12,9 @@ import (
 // DNSListener is a standard DNS listener for UDP or TCP.
 type DNSListener struct {
 	*dns.Server
-	id string
+	id     string
+	opt    ListenOptions
+	ifaces *interfaceServers // Set when listening on the addresses of an interface
 }
 
 var _ Listener = &DNSListener{}
@@ -19,47 +22,136 @@ var _ Listener = &DNSListener{}
 type ListenOptions struct {
 	// Network allowed to query this listener.
 	AllowedNet []*net.IPNet
+
+	// Optional, ordered allow/deny rules for clients. Checked after
+	// AllowedNet.
+	ACL *ACL
+
+	// Read the client address from PROXY protocol headers sent by load
+	// balancers. Only supported on TCP-based listeners.
+	ProxyProtocol bool
+
+	// Networks of load balancers that send PROXY protocol headers. If empty,
+	// all connections are expected to start with a header.
+	ProxyProtocolNet []*net.IPNet
+
+	// Bind the sockets to this network interface with SO_BINDTODEVICE, so
+	// only queries received on it are answered. Linux only.
+	BindInterface string
+
+	// Listen on all addresses of this network interface instead of the host
+	// in the listen address. Servers are started and stopped as addresses
+	// are added and removed. Only supported by UDP, TCP and DoT listeners.
+	InterfaceAddrs string
+
+	// Interval in which the addresses of InterfaceAddrs are checked for
+	// changes. Defaults to 10 seconds.
+	InterfaceRefresh time.Duration
+
+	// Largest response sent over UDP, even if the client advertises a larger
+	// EDNS0 buffer. Larger responses are truncated so the client retries over
+	// TCP. Only limited by the client if 0. Only used by UDP and DTLS
+	// listeners.
+	MaxUDPSize uint16
+
+	// Max time a query can take from the moment it's received, across all
+	// groups, routers and upstream resolvers it passes through. Upstream
+	// queries that are still outstanding then fail. No limit if 0.
+	QueryDeadline time.Duration
+}
+
+// Returns the deadline of a query that was just received.
+func (opt ListenOptions) queryDeadline() time.Time {
+	if opt.QueryDeadline <= 0 {
+		return time.Time{}
+	}
+	return time.Now().Add(opt.QueryDeadline)
 }
 
 // NewDNSListener returns an instance of either a UDP or TCP DNS listener.
 func NewDNSListener(id, addr, net string, opt ListenOptions, resolver Resolver) *DNSListener {
-	return &DNSListener{
-		id: id,
+	l := &DNSListener{
+		id:  id,
+		opt: opt,
 		Server: &dns.Server{
 			Addr:    addr,
 			Net:     net,
-			Handler: listenHandler(id, net, addr, resolver, opt.AllowedNet),
+			Handler: listenHandler(id, net, addr, resolver, opt),
 		},
 	}
+	if opt.InterfaceAddrs != "" {
+		l.ifaces = newInterfaceServers(id, opt.InterfaceAddrs, addr, opt.InterfaceRefresh, l.newServer)
+	}
+	return l
 }
 
 // Start the DNS listener.
-func (s DNSListener) Start() error {
+func (s *DNSListener) Start() error {
 	Log.WithFields(logrus.Fields{
 		"id":       s.id,
 		"protocol": s.Net,
 		"addr":     s.Addr}).Info("starting listener")
-	return s.ListenAndServe()
+	if s.ifaces != nil {
+		return s.ifaces.run()
+	}
+	if err := s.bind(s.Server); err != nil {
+		return err
+	}
+	return s.ActivateAndServe()
+}
+
+// Shutdown stops the listener.
+func (s *DNSListener) Shutdown() error {
+	if s.ifaces != nil {
+		return s.ifaces.stop()
+	}
+	return s.Server.Shutdown()
 }
 
-func (s DNSListener) String() string {
+// Returns a server for one address of an interface.
+func (s *DNSListener) newServer(addr string) (*dns.Server, error) {
+	srv := &dns.Server{Addr: addr, Net: s.Net, Handler: s.Handler}
+	return srv, s.bind(srv)
+}
+
+// Open the socket of a server.
+func (s *DNSListener) bind(srv *dns.Server) error {
+	if srv.Net == "udp" {
+		pc, err := s.opt.listenUDP(srv.Addr)
+		if err != nil {
+			return err
+		}
+		srv.PacketConn = pc
+		return nil
+	}
+	ln, err := s.opt.listenTCP(srv.Addr)
+	if err != nil {
+		return err
+	}
+	srv.Listener = ln
+	return nil
+}
+
+func (s *DNSListener) String() string {
 	return s.id
 }
 
 // DNS handler to forward all incoming requests to a given resolver.
-func listenHandler(id, protocol, addr string, r Resolver, allowedNet []*net.IPNet) dns.HandlerFunc {
+func listenHandler(id, protocol, addr string, r Resolver, opt ListenOptions) dns.HandlerFunc {
 	metrics := NewListenerMetrics("listener", id)
 	return func(w dns.ResponseWriter, req *dns.Msg) {
 		var err error
 
 		ci := ClientInfo{
 			Listener: id,
+			Deadline: opt.queryDeadline(),
 		}
 
 		if r, ok := w.(interface{ ConnectionState() *tls.ConnectionState }); ok {
 			connState := r.ConnectionState()
 			if connState != nil {
 				ci.TLSServerName = connState.ServerName
+				ci.TLSClientNames = tlsClientNames(connState)
 			}
 		}
 
@@ -75,7 +167,8 @@ func listenHandler(id, protocol, addr string, r Resolver, allowedNet []*net.IPNe
 		metrics.query.Add(1)
 
 		a := new(dns.Msg)
-		if isAllowed(allowedNet, ci.SourceIP) {
+		switch opt.access(ci.SourceIP) {
+		case ACLAllow:
 			log.WithField("resolver", r.String()).Trace("forwarding query to resolver")
 			a, err = r.Resolve(req, ci)
 			if err != nil {
@@ -83,10 +176,15 @@ func listenHandler(id, protocol, addr string, r Resolver, allowedNet []*net.IPNe
 				log.WithError(err).Error("failed to resolve")
 				a = servfail(req)
 			}
-		} else {
+		case ACLDrop:
+			metrics.err.Add("acl", 1)
+			log.Debug("dropping query from client ip")
+			a = nil
+		default:
 			metrics.err.Add("acl", 1)
 			log.Debug("refusing client ip")
 			a.SetRcode(req, dns.RcodeRefused)
+			addEDE(a, req, dns.ExtendedErrorCodeProhibited, "")
 		}
 
 		// A nil response from the resolvers means "drop", close the connection
@@ -106,11 +204,7 @@ func listenHandler(id, protocol, addr string, r Resolver, allowedNet []*net.IPNe
 
 		// Check the response actually fits if the query was sent over UDP. If not, respond with TC flag.
 		if protocol == "udp" || protocol == "dtls" {
-			maxSize := dns.MinMsgSize
-			if edns0 := req.IsEdns0(); edns0 != nil {
-				maxSize = int(edns0.UDPSize())
-			}
-			a.Truncate(maxSize)
+			truncateResponse(a, udpResponseSize(req, opt.MaxUDPSize))
 		}
 
 		metrics.response.Add(rCode(a), 1)
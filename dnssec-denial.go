@@ -0,0 +1,241 @@
+package rdns
+
+import (
+	"errors"
+	"fmt"
+	"slices"
+	"strings"
+
+	"github.com/miekg/dns"
+)
+
+// Opt-out flag of NSEC3 records, RFC 5155
+const nsec3OptOut = 1
+
+// Max number of NSEC3 iterations, RFC 9276 section 3.2. Every name in a proof is
+// hashed this many times, so proofs with more iterations are treated as
+// insecure rather than letting a zone make validation expensive.
+const nsec3MaxIterations = 150
+
+// Returns an error if the NSEC3 record uses more iterations than are checked.
+// Such records are bogus if they also use a salt, RFC 9276 recommends neither.
+func checkNSEC3Iterations(rr *dns.NSEC3) error {
+	if rr.Iterations <= nsec3MaxIterations {
+		return nil
+	}
+	if rr.SaltLength > 0 {
+		return fmt.Errorf("%w: NSEC3 for %s with %d iterations and a salt", errDNSSECBogus, rr.Hdr.Name, rr.Iterations)
+	}
+	return fmt.Errorf("%w: NSEC3 for %s with %d iterations", errNSEC3Iterations, rr.Hdr.Name, rr.Iterations)
+}
+
+// Checks that the NSEC or NSEC3 records in the authority section of a negative
+// response prove that the name, or the type for the name, doesn't exist. The
+// signatures of the records have to be validated already. Only records signed
+// by the zone of the name are used, the zone of the SOA record if there is one.
+// Wildcard expansions of negative responses are not supported and fail.
+func verifyDenial(q dns.Question, a *dns.Msg) error {
+	name := strings.ToLower(q.Name)
+	zone := ""
+	signers := make(map[string][]string)
+	for _, rr := range a.Ns {
+		switch rr := rr.(type) {
+		case *dns.SOA:
+			zone = rr.Hdr.Name
+		case *dns.RRSIG:
+			key := rrsetKey(rr.Hdr.Name, rr.Hdr.Class, rr.TypeCovered)
+			signers[key] = append(signers[key], rr.SignerName)
+		}
+	}
+	signedByZone := func(rr dns.RR) bool {
+		h := rr.Header()
+		return slices.ContainsFunc(signers[rrsetKey(h.Name, h.Class, h.Rrtype)], func(signer string) bool {
+			if zone != "" && !strings.EqualFold(signer, zone) {
+				return false
+			}
+			return dns.IsSubDomain(signer, name)
+		})
+	}
+	var (
+		nsecs  []*dns.NSEC
+		nsec3s []*dns.NSEC3
+	)
+	for _, rr := range a.Ns {
+		if !signedByZone(rr) {
+			continue
+		}
+		switch rr := rr.(type) {
+		case *dns.NSEC:
+			nsecs = append(nsecs, rr)
+		case *dns.NSEC3:
+			if err := checkNSEC3Iterations(rr); err != nil {
+				return err
+			}
+			nsec3s = append(nsec3s, rr)
+		}
+	}
+	if a.Rcode == dns.RcodeNameError {
+		if nsecNameError(name, nsecs) || nsec3NameError(name, nsec3s) {
+			return nil
+		}
+		return fmt.Errorf("%w: no proof that %s doesn't exist", errNSECMissing, q.Name)
+	}
+	if nsecNoData(name, q.Qtype, nsecs) || nsec3NoData(name, q.Qtype, nsec3s) {
+		return nil
+	}
+	return fmt.Errorf("%w: no proof that %s %s doesn't exist", errNSECMissing, q.Name, dns.TypeToString[q.Qtype])
+}
+
+// An NSEC record proves that the name doesn't exist if it covers the name, and
+// one covers the wildcard at the closest encloser.
+func nsecNameError(name string, nsecs []*dns.NSEC) bool {
+	for _, nsec := range nsecs {
+		if !nsecCovers(nsec, name) {
+			continue
+		}
+		// The closest encloser is the longest ancestor the name shares with
+		// the names on either side of the gap
+		labels := dns.SplitDomainName(name)
+		n := max(dns.CompareDomainName(name, nsec.Hdr.Name), dns.CompareDomainName(name, nsec.NextDomain))
+		wildcard := "*." + dns.Fqdn(strings.Join(labels[len(labels)-n:], "."))
+		if n == 0 {
+			wildcard = "*."
+		}
+		for _, w := range nsecs {
+			if nsecCovers(w, wildcard) {
+				return true
+			}
+		}
+	}
+	return false
+}
+
+// An NSEC record proves that the type doesn't exist if it matches the name
+// and doesn't list the type or a CNAME. Empty non-terminals are proven by an
+// NSEC record covering the name with a next name below it.
+func nsecNoData(name string, qtype uint16, nsecs []*dns.NSEC) bool {
+	for _, nsec := range nsecs {
+		if strings.EqualFold(nsec.Hdr.Name, name) {
+			if !provesNoDataFor(name, qtype, nsec.TypeBitMap) {
+				continue
+			}
+			if !slices.Contains(nsec.TypeBitMap, qtype) && !slices.Contains(nsec.TypeBitMap, dns.TypeCNAME) {
+				return true
+			}
+			continue
+		}
+		if nsecCovers(nsec, name) && dns.IsSubDomain(name, nsec.NextDomain) {
+			return true
+		}
+	}
+	return false
+}
+
+// A closest encloser proof, RFC 5155 section 7.2.1. An NSEC3 record matches
+// the closest encloser, and others cover the next closer name and the
+// wildcard at the closest encloser.
+func nsec3NameError(name string, nsec3s []*dns.NSEC3) bool {
+	if len(nsec3s) == 0 {
+		return false
+	}
+	labels := dns.SplitDomainName(name)
+	for i := 1; i <= len(labels); i++ {
+		encloser := dns.Fqdn(strings.Join(labels[i:], "."))
+		if !slices.ContainsFunc(nsec3s, func(rr *dns.NSEC3) bool { return rr.Match(encloser) }) {
+			continue
+		}
+		nextCloser := dns.Fqdn(strings.Join(labels[i-1:], "."))
+		wildcard := "*." + encloser
+		if encloser == "." {
+			wildcard = "*."
+		}
+		return slices.ContainsFunc(nsec3s, func(rr *dns.NSEC3) bool { return rr.Cover(nextCloser) }) &&
+			slices.ContainsFunc(nsec3s, func(rr *dns.NSEC3) bool { return rr.Cover(wildcard) })
+	}
+	return false
+}
+
+// An NSEC3 record proves that the type doesn't exist if it matches the name
+// and doesn't list the type or a CNAME. For DS queries, an opt-out NSEC3 that
+// covers the name is also accepted.
+func nsec3NoData(name string, qtype uint16, nsec3s []*dns.NSEC3) bool {
+	for _, rr := range nsec3s {
+		if rr.Match(name) {
+			if !provesNoDataFor(name, qtype, rr.TypeBitMap) {
+				continue
+			}
+			if !slices.Contains(rr.TypeBitMap, qtype) && !slices.Contains(rr.TypeBitMap, dns.TypeCNAME) {
+				return true
+			}
+			continue
+		}
+		if qtype == dns.TypeDS && rr.Flags&nsec3OptOut != 0 && rr.Cover(name) {
+			return true
+		}
+	}
+	return false
+}
+
+// Returns false if an NSEC or NSEC3 record for the name comes from the wrong
+// side of a zone cut to prove the absence of the type, RFC 4035 section 5.4.
+// Records at a delegation in the parent zone (NS without SOA) only prove the
+// absence of DS records, and those at the apex of the child zone (with SOA)
+// can't prove that.
+func provesNoDataFor(name string, qtype uint16, types []uint16) bool {
+	delegation := slices.Contains(types, dns.TypeNS) && !slices.Contains(types, dns.TypeSOA)
+	if qtype == dns.TypeDS {
+		return name == "." || !slices.Contains(types, dns.TypeSOA)
+	}
+	return !delegation
+}
+
+// Returns true if the NSEC or NSEC3 record proves that the zone is delegated
+// without DS records, i.e. the zone is unsigned.
+func provesInsecureDelegation(zone string, rr dns.RR) bool {
+	switch rr := rr.(type) {
+	case *dns.NSEC:
+		return strings.EqualFold(rr.Hdr.Name, zone) && isUnsignedDelegation(rr.TypeBitMap)
+	case *dns.NSEC3:
+		// Zones with too many iterations are treated as insecure
+		if err := checkNSEC3Iterations(rr); err != nil {
+			return errors.Is(err, errNSEC3Iterations)
+		}
+		if rr.Match(zone) {
+			return isUnsignedDelegation(rr.TypeBitMap)
+		}
+		return rr.Flags&nsec3OptOut != 0 && rr.Cover(zone)
+	}
+	return false
+}
+
+// Returns true if the types in an NSEC bitmap are those of a delegation point
+// without DS records.
+func isUnsignedDelegation(types []uint16) bool {
+	return slices.Contains(types, dns.TypeNS) &&
+		!slices.Contains(types, dns.TypeDS) &&
+		!slices.Contains(types, dns.TypeSOA)
+}
+
+// Returns true if the name falls between the owner and next name of the NSEC
+// record in canonical order. The last NSEC record of a zone points back to the
+// apex and covers everything after its owner.
+func nsecCovers(nsec *dns.NSEC, name string) bool {
+	owner, next := nsec.Hdr.Name, nsec.NextDomain
+	if canonicalCompare(owner, next) < 0 {
+		return canonicalCompare(owner, name) < 0 && canonicalCompare(name, next) < 0
+	}
+	return dns.IsSubDomain(next, name) && (canonicalCompare(owner, name) < 0 || canonicalCompare(name, next) < 0)
+}
+
+// Compares two names in canonical DNS order as defined in RFC 4034 section
+// 6.1, label by label starting from the rightmost one.
+func canonicalCompare(a, b string) int {
+	la := dns.SplitDomainName(strings.ToLower(a))
+	lb := dns.SplitDomainName(strings.ToLower(b))
+	for i, j := len(la)-1, len(lb)-1; i >= 0 && j >= 0; i, j = i-1, j-1 {
+		if c := strings.Compare(la[i], lb[j]); c != 0 {
+			return c
+		}
+	}
+	return len(la) - len(lb)
+}
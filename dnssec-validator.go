@@ -0,0 +1,707 @@
+package rdns
+
+import (
+	"errors"
+	"expvar"
+	"fmt"
+	"slices"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/miekg/dns"
+)
+
+// DNSSECValidator forwards queries with the DO bit set and validates the
+// signatures in the responses. The keys of the signing zone are authenticated
+// by following the chain of DS and DNSKEY records up to a trust anchor.
+// Responses that fail validation are replaced with SERVFAIL and an extended
+// error code.
+//
+// Negative responses need valid signatures on the records in the authority
+// section, and NSEC or NSEC3 records that prove the name or type doesn't exist.
+// Responses without signatures are only accepted if AllowUnsigned is set and
+// the absence of DS records at a delegation above the name is authenticated,
+// so that signatures can't be stripped from responses for signed zones.
+type DNSSECValidator struct {
+	id       string
+	resolver Resolver
+	opt      DNSSECOptions
+	anchors  map[string][]*dns.DS
+	metrics  *DNSSECMetrics
+
+	mu   sync.Mutex
+	keys map[string]dnskeyCacheEntry
+
+	// Delegations proven to be insecure, with the time the proof expires
+	insecure map[string]time.Time
+}
+
+var _ Resolver = &DNSSECValidator{}
+
+type DNSSECOptions struct {
+	// DS records of the keys to trust. Defaults to the IANA root zone KSKs.
+	TrustAnchors []dns.DS
+
+	// Pass through responses without signatures, for zones that are not signed.
+	// Such responses are returned without the AD flag. The zone has to be
+	// proven unsigned by an authenticated delegation without DS records. If
+	// false, unsigned responses fail validation.
+	AllowUnsigned bool
+
+	// Max time validated DNSKEYs and proofs of unsigned zones are kept in the
+	// cache, limited by the TTL of the DNSKEY records. Defaults to 1 hour.
+	KeyCacheTTL time.Duration
+}
+
+type DNSSECMetrics struct {
+	// Responses that were validated successfully.
+	secure *expvar.Int
+	// Unsigned responses that were passed through.
+	insecure *expvar.Int
+	// Responses that failed validation.
+	bogus *expvar.Int
+}
+
+// IANA root zone trust anchors, see https://data.iana.org/root-anchors/root-anchors.xml
+var DefaultTrustAnchors = []string{
+	". IN DS 20326 8 2 E06D44B80B8F1D39A95C0B0D7C65D08458E880409BBC683457104237C7F8EC8D",
+	". IN DS 38696 8 2 683D2D0ACB8C9B712A1948B27F741219298D0A450D612C483AF444A4C0FB2B16",
+}
+
+var (
+	errDNSSECBogus   = errors.New("dnssec bogus")
+	errDNSKEYMissing = errors.New("dnskey missing")
+	errRRSIGsMissing = errors.New("rrsigs missing")
+	errNSECMissing   = errors.New("nsec missing")
+
+	// Proofs that use more NSEC3 iterations than are checked, treated as insecure
+	errNSEC3Iterations = errors.New("unsupported nsec3 iterations")
+)
+
+// Extended error code for NSEC3 proofs with too many iterations, RFC 9276
+const edeUnsupportedNSEC3Iterations = 27
+
+// Max number of zones DNSKEYs and proofs of unsigned delegations are cached
+// for. Once reached, expired entries are removed, and if that's not enough,
+// random others.
+const dnssecMaxCachedZones = 10000
+
+type dnskeyCacheEntry struct {
+	keys   []*dns.DNSKEY
+	expiry time.Time
+}
+
+// NewDNSSECValidator returns a new instance of a DNSSEC validating resolver.
+func NewDNSSECValidator(id string, resolver Resolver, opt DNSSECOptions) (*DNSSECValidator, error) {
+	if len(opt.TrustAnchors) == 0 {
+		for _, s := range DefaultTrustAnchors {
+			rr, err := dns.NewRR(s)
+			if err != nil {
+				return nil, err
+			}
+			opt.TrustAnchors = append(opt.TrustAnchors, *rr.(*dns.DS))
+		}
+	}
+	if opt.KeyCacheTTL == 0 {
+		opt.KeyCacheTTL = time.Hour
+	}
+	anchors := make(map[string][]*dns.DS)
+	for i := range opt.TrustAnchors {
+		ds := &opt.TrustAnchors[i]
+		zone := strings.ToLower(dns.Fqdn(ds.Hdr.Name))
+		anchors[zone] = append(anchors[zone], ds)
+	}
+	return &DNSSECValidator{
+		id:       id,
+		resolver: resolver,
+		opt:      opt,
+		anchors:  anchors,
+		metrics: &DNSSECMetrics{
+			secure:   getVarInt("dnssec", id, "secure"),
+			insecure: getVarInt("dnssec", id, "insecure"),
+			bogus:    getVarInt("dnssec", id, "bogus"),
+		},
+		keys:     make(map[string]dnskeyCacheEntry),
+		insecure: make(map[string]time.Time),
+	}, nil
+}
+
+// Resolve a DNS query and validate the signatures in the response.
+func (r *DNSSECValidator) Resolve(q *dns.Msg, ci ClientInfo) (*dns.Msg, error) {
+	if len(q.Question) < 1 {
+		return nil, errors.New("no question in query")
+	}
+	log := logger(r.id, q, ci)
+	var clientDO bool
+	if edns0 := q.IsEdns0(); edns0 != nil {
+		clientDO = edns0.Do()
+	}
+
+	// Request signatures from upstream, and disable validation there so that
+	// failures can be reported here.
+	upstreamQ := q.Copy()
+	if edns0 := upstreamQ.IsEdns0(); edns0 != nil {
+		edns0.SetDo()
+	} else {
+		upstreamQ.SetEdns0(4096, true)
+	}
+	upstreamQ.CheckingDisabled = true
+
+	log.WithField("resolver", r.resolver.String()).Debug("forwarding query to resolver")
+	a, err := r.resolver.Resolve(upstreamQ, ci)
+	if err != nil || a == nil {
+		return a, err
+	}
+
+	// Clients that validate themselves get the response unvalidated (RFC 4035
+	// section 3.2.2)
+	if q.CheckingDisabled {
+		a.AuthenticatedData = false
+		if !clientDO {
+			stripDNSSEC(a, q.Question[0].Qtype)
+		}
+		return a, nil
+	}
+	switch a.Rcode {
+	case dns.RcodeSuccess, dns.RcodeNameError:
+	default:
+		return a, nil
+	}
+
+	secure, err := r.validate(a, ci)
+	if err != nil {
+		log.WithError(err).Debug("dnssec validation failed")
+		r.metrics.bogus.Add(1)
+		return dnssecFailure(q, err), nil
+	}
+	if secure {
+		r.metrics.secure.Add(1)
+	} else {
+		log.Debug("response is not signed")
+		r.metrics.insecure.Add(1)
+	}
+	a.AuthenticatedData = secure
+	a.CheckingDisabled = q.CheckingDisabled
+	if !clientDO {
+		stripDNSSEC(a, q.Question[0].Qtype)
+	}
+	return a, nil
+}
+
+func (r *DNSSECValidator) String() string {
+	return r.id
+}
+
+// Validate the RRsets in the answer that lead from the query name to the
+// records of the query type, via CNAMEs and DNAMEs. Records in the answer for
+// other names are removed. If the chain doesn't end in records of the query
+// type, the response is negative and the authority section has to prove that
+// the type or name at the end of the chain doesn't exist. Returns false if the
+// response isn't signed and AllowUnsigned is set.
+func (r *DNSSECValidator) validate(a *dns.Msg, ci ClientInfo) (bool, error) {
+	q := a.Question[0]
+	chain := followAnswerChain(q, a.Answer)
+	a.Answer = chain.records
+	negative := a.Rcode == dns.RcodeNameError || !chain.found
+	section := a.Answer
+	if negative {
+		section = append(slices.Clone(a.Answer), a.Ns...)
+	}
+	sets, sigs := rrsets(section)
+
+	// NSEC3 proofs with too many iterations make a response insecure
+	insecureOr := func(err error) (bool, error) {
+		if errors.Is(err, errNSEC3Iterations) && r.opt.AllowUnsigned {
+			return false, nil
+		}
+		return false, err
+	}
+	var unsigned []string
+	for key, set := range sets {
+		if chain.synthesized[key] {
+			continue
+		}
+		if len(sigs[key]) == 0 {
+			unsigned = append(unsigned, set[0].Header().Name)
+			continue
+		}
+		if err := r.verifyRRset(set, sigs[key], a.Ns, ci); err != nil {
+			return insecureOr(err)
+		}
+	}
+	if len(sets) == 0 {
+		unsigned = append(unsigned, qName(a))
+	}
+	if len(unsigned) > 0 {
+		if !r.opt.AllowUnsigned {
+			return false, fmt.Errorf("%w: response for %s", errRRSIGsMissing, qName(a))
+		}
+		for _, name := range unsigned {
+			if err := r.proveInsecure(name, ci); err != nil {
+				return false, err
+			}
+		}
+		return false, nil
+	}
+	if negative {
+		target := dns.Question{Name: chain.target, Qtype: q.Qtype, Qclass: q.Qclass}
+		if err := verifyDenial(target, a); err != nil {
+			return insecureOr(err)
+		}
+	}
+	return true, nil
+}
+
+// Proves that records without signatures are in an unsigned zone. Walks down
+// from the closest trust anchor and looks for a delegation where the absence
+// of DS records is authenticated. Names that aren't below any trust anchor
+// can't be validated and are considered unsigned.
+func (r *DNSSECValidator) proveInsecure(name string, ci ClientInfo) error {
+	labels := dns.SplitDomainName(strings.ToLower(dns.Fqdn(name)))
+	anchor := -1
+	for i := 0; i <= len(labels); i++ {
+		if _, ok := r.anchors[dns.Fqdn(strings.Join(labels[i:], "."))]; ok {
+			anchor = i
+			break
+		}
+	}
+	if anchor < 0 {
+		return nil
+	}
+	for i := anchor - 1; i >= 0; i-- {
+		zone := dns.Fqdn(strings.Join(labels[i:], "."))
+		r.mu.Lock()
+		expiry, ok := r.insecure[zone]
+		r.mu.Unlock()
+		if ok && time.Now().Before(expiry) {
+			return nil
+		}
+		a, err := r.query(zone, dns.TypeDS, ci)
+		if err != nil {
+			return err
+		}
+		insecure, err := r.insecureDelegation(zone, a, ci)
+		if err != nil {
+			return err
+		}
+		if insecure {
+			r.mu.Lock()
+			if _, ok := r.insecure[zone]; !ok && len(r.insecure) >= dnssecMaxCachedZones {
+				pruneZoneCache(r.insecure, func(expiry time.Time) time.Time { return expiry })
+			}
+			r.insecure[zone] = time.Now().Add(r.opt.KeyCacheTTL)
+			r.mu.Unlock()
+			return nil
+		}
+	}
+	return fmt.Errorf("%w: %s is in a signed zone", errRRSIGsMissing, name)
+}
+
+// Returns true if the response to a DS query for the zone proves that it is
+// delegated without DS records. Signed DS records are validated, and an error
+// is returned if they're invalid.
+func (r *DNSSECValidator) insecureDelegation(zone string, a *dns.Msg, ci ClientInfo) (bool, error) {
+	sets, _ := rrsets(a.Answer)
+	if len(sets[rrsetKey(zone, dns.ClassINET, dns.TypeDS)]) > 0 {
+		_, err := r.authenticateDS(zone, a, ci)
+		return false, err
+	}
+	sets, sigs := rrsets(a.Ns)
+	for key, set := range sets {
+		switch set[0].Header().Rrtype {
+		case dns.TypeNSEC, dns.TypeNSEC3:
+		default:
+			continue
+		}
+		if len(sigs[key]) == 0 || r.verifyRRset(set, sigs[key], nil, ci) != nil {
+			continue
+		}
+		for _, rr := range set {
+			if provesInsecureDelegation(zone, rr) {
+				return true, nil
+			}
+		}
+	}
+	return false, nil
+}
+
+// Verify an RRset using any of its signatures. RRsets expanded from a wildcard
+// need an NSEC or NSEC3 record in proof that shows there's no closer match for
+// the name, RFC 4035 section 5.3.4.
+func (r *DNSSECValidator) verifyRRset(set []dns.RR, sigs []*dns.RRSIG, proof []dns.RR, ci ClientInfo) error {
+	var err error
+	for _, sig := range sigs {
+		if !dns.IsSubDomain(sig.SignerName, sig.Hdr.Name) {
+			err = fmt.Errorf("%w: %s signed by unrelated zone %s", errDNSSECBogus, sig.Hdr.Name, sig.SignerName)
+			continue
+		}
+		labels := dns.CountLabel(sig.Hdr.Name)
+		if int(sig.Labels) > labels {
+			err = fmt.Errorf("%w: signature for %s has too many labels", errDNSSECBogus, sig.Hdr.Name)
+			continue
+		}
+		var keys []*dns.DNSKEY
+		keys, err = r.zoneKeys(sig.SignerName, ci)
+		if err != nil {
+			continue
+		}
+		if err = verifyRRSIG(sig, keys, set); err != nil {
+			continue
+		}
+		if int(sig.Labels) < labels {
+			if err = r.verifyWildcard(sig, proof, ci); err != nil {
+				continue
+			}
+		}
+		return nil
+	}
+	return err
+}
+
+// Checks that the records in proof show that no name closer to the owner of a
+// wildcard expansion exists, by covering the next closer name.
+func (r *DNSSECValidator) verifyWildcard(sig *dns.RRSIG, proof []dns.RR, ci ClientInfo) error {
+	labels := dns.SplitDomainName(strings.ToLower(sig.Hdr.Name))
+	nextCloser := dns.Fqdn(strings.Join(labels[len(labels)-int(sig.Labels)-1:], "."))
+	sets, sigs := rrsets(proof)
+	for key, set := range sets {
+		var covers bool
+		for _, rr := range set {
+			switch rr := rr.(type) {
+			case *dns.NSEC:
+				covers = covers || nsecCovers(rr, nextCloser)
+			case *dns.NSEC3:
+				if err := checkNSEC3Iterations(rr); err != nil {
+					return err
+				}
+				covers = covers || rr.Cover(nextCloser)
+			}
+		}
+		// The proof can't be a wildcard expansion itself
+		if covers && len(sigs[key]) > 0 && r.verifyRRset(set, sigs[key], nil, ci) == nil {
+			return nil
+		}
+	}
+	return fmt.Errorf("%w: no proof that %s doesn't exist for wildcard expansion of %s", errNSECMissing, nextCloser, sig.Hdr.Name)
+}
+
+// Returns the authenticated DNSKEYs of a zone, from cache if possible.
+func (r *DNSSECValidator) zoneKeys(zone string, ci ClientInfo) ([]*dns.DNSKEY, error) {
+	zone = strings.ToLower(dns.Fqdn(zone))
+	r.mu.Lock()
+	e, ok := r.keys[zone]
+	r.mu.Unlock()
+	if ok && time.Now().Before(e.expiry) {
+		return e.keys, nil
+	}
+
+	ds, err := r.zoneDS(zone, ci)
+	if err != nil {
+		return nil, err
+	}
+	a, err := r.query(zone, dns.TypeDNSKEY, ci)
+	if err != nil {
+		return nil, err
+	}
+	sets, sigs := rrsets(a.Answer)
+	setKey := rrsetKey(zone, dns.ClassINET, dns.TypeDNSKEY)
+	keyRRs := sets[setKey]
+	if len(keyRRs) == 0 {
+		return nil, fmt.Errorf("%w: no DNSKEY for %s", errDNSKEYMissing, zone)
+	}
+	keys := make([]*dns.DNSKEY, 0, len(keyRRs))
+	for _, rr := range keyRRs {
+		keys = append(keys, rr.(*dns.DNSKEY))
+	}
+
+	// The keys are trusted if the DNSKEY RRset is signed by a key matching a DS
+	var trusted []*dns.DNSKEY
+	for _, k := range keys {
+		for _, d := range ds {
+			if matchesDS(k, d) {
+				trusted = append(trusted, k)
+				break
+			}
+		}
+	}
+	if len(trusted) == 0 {
+		return nil, fmt.Errorf("%w: no DNSKEY for %s matches its DS records", errDNSKEYMissing, zone)
+	}
+	err = fmt.Errorf("%w: DNSKEY records of %s not signed", errDNSSECBogus, zone)
+	for _, sig := range sigs[setKey] {
+		if err = verifyRRSIG(sig, trusted, keyRRs); err == nil {
+			break
+		}
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	ttl := r.opt.KeyCacheTTL
+	if keyTTL := time.Duration(keyRRs[0].Header().Ttl) * time.Second; keyTTL < ttl {
+		ttl = keyTTL
+	}
+	r.mu.Lock()
+	if _, ok := r.keys[zone]; !ok && len(r.keys) >= dnssecMaxCachedZones {
+		pruneZoneCache(r.keys, func(e dnskeyCacheEntry) time.Time { return e.expiry })
+	}
+	r.keys[zone] = dnskeyCacheEntry{keys: keys, expiry: time.Now().Add(ttl)}
+	r.mu.Unlock()
+	return keys, nil
+}
+
+// Removes expired entries from a full cache of zones, then random others until
+// it's at most three quarters full, so it's not done again for every new zone.
+func pruneZoneCache[V any](cache map[string]V, expiry func(V) time.Time) {
+	now := time.Now()
+	for zone, v := range cache {
+		if !now.Before(expiry(v)) {
+			delete(cache, zone)
+		}
+	}
+	for zone := range cache {
+		if len(cache) <= dnssecMaxCachedZones*3/4 {
+			break
+		}
+		delete(cache, zone)
+	}
+}
+
+// Returns the DS records for a zone, either from the trust anchors or
+// authenticated by the keys of the parent zone.
+func (r *DNSSECValidator) zoneDS(zone string, ci ClientInfo) ([]*dns.DS, error) {
+	if ds, ok := r.anchors[zone]; ok {
+		return ds, nil
+	}
+	if zone == "." {
+		return nil, fmt.Errorf("%w: no trust anchor for the root zone", errDNSKEYMissing)
+	}
+	a, err := r.query(zone, dns.TypeDS, ci)
+	if err != nil {
+		return nil, err
+	}
+	return r.authenticateDS(zone, a, ci)
+}
+
+// Returns the DS records of a zone from a response, after validating their
+// signature with the keys of the parent zone.
+func (r *DNSSECValidator) authenticateDS(zone string, a *dns.Msg, ci ClientInfo) ([]*dns.DS, error) {
+	sets, sigs := rrsets(a.Answer)
+	setKey := rrsetKey(zone, dns.ClassINET, dns.TypeDS)
+	dsRRs := sets[setKey]
+	if len(dsRRs) == 0 {
+		return nil, fmt.Errorf("%w: no DS for %s", errDNSKEYMissing, zone)
+	}
+
+	// The DS records are signed by the parent zone, the signer has to be above
+	// this zone to avoid loops.
+	err := fmt.Errorf("%w: DS records of %s not signed", errDNSSECBogus, zone)
+	for _, sig := range sigs[setKey] {
+		if strings.EqualFold(sig.SignerName, zone) || !dns.IsSubDomain(sig.SignerName, zone) {
+			continue
+		}
+		var keys []*dns.DNSKEY
+		keys, err = r.zoneKeys(sig.SignerName, ci)
+		if err != nil {
+			continue
+		}
+		if err = verifyRRSIG(sig, keys, dsRRs); err == nil {
+			break
+		}
+	}
+	if err != nil {
+		return nil, err
+	}
+	ds := make([]*dns.DS, 0, len(dsRRs))
+	for _, rr := range dsRRs {
+		ds = append(ds, rr.(*dns.DS))
+	}
+	return ds, nil
+}
+
+// Send a query for DNSSEC records upstream.
+func (r *DNSSECValidator) query(name string, qtype uint16, ci ClientInfo) (*dns.Msg, error) {
+	q := new(dns.Msg)
+	q.SetQuestion(name, qtype)
+	q.SetEdns0(4096, true)
+	q.CheckingDisabled = true
+	a, err := r.resolver.Resolve(q, ci)
+	if err != nil {
+		return nil, fmt.Errorf("%w: failed to query %s %s: %w", errDNSKEYMissing, dns.TypeToString[qtype], name, err)
+	}
+	if a == nil {
+		return nil, fmt.Errorf("%w: no response for %s %s", errDNSKEYMissing, dns.TypeToString[qtype], name)
+	}
+	return a, nil
+}
+
+// Verify a signature over an RRset with one of the keys.
+func verifyRRSIG(sig *dns.RRSIG, keys []*dns.DNSKEY, set []dns.RR) error {
+	if !sig.ValidityPeriod(time.Now()) {
+		return fmt.Errorf("%w: signature for %s %s is outside its validity period", errDNSSECBogus, sig.Hdr.Name, dns.TypeToString[sig.TypeCovered])
+	}
+	for _, k := range keys {
+		if k.KeyTag() != sig.KeyTag || k.Algorithm != sig.Algorithm {
+			continue
+		}
+		if err := sig.Verify(k, set); err == nil {
+			return nil
+		}
+	}
+	return fmt.Errorf("%w: invalid signature for %s %s", errDNSSECBogus, sig.Hdr.Name, dns.TypeToString[sig.TypeCovered])
+}
+
+// Returns true if the DS record refers to the key.
+func matchesDS(k *dns.DNSKEY, d *dns.DS) bool {
+	if k.Algorithm != d.Algorithm || k.KeyTag() != d.KeyTag {
+		return false
+	}
+	kds := k.ToDS(d.DigestType)
+	return kds != nil && strings.EqualFold(kds.Digest, d.Digest)
+}
+
+// Records in an answer that lead from the query name to the answer.
+type answerChain struct {
+	records []dns.RR // Records on the chain, with their signatures
+
+	// Keys of CNAME RRsets synthesized from a DNAME, these aren't signed
+	synthesized map[string]bool
+
+	target string // Name at the end of the chain
+	found  bool   // The answer has records of the query type for the target
+}
+
+// Follows the CNAME and DNAME records in the answer, starting at the query name.
+func followAnswerChain(q dns.Question, answer []dns.RR) answerChain {
+	chain := answerChain{target: q.Name, synthesized: make(map[string]bool)}
+
+	// Returns the records with the given owner and type, and their signatures
+	find := func(owner string, rrtype uint16) []dns.RR {
+		var rrs []dns.RR
+		for _, rr := range answer {
+			h := rr.Header()
+			if !strings.EqualFold(h.Name, owner) {
+				continue
+			}
+			t := h.Rrtype
+			if sig, ok := rr.(*dns.RRSIG); ok {
+				t = sig.TypeCovered
+			}
+			if t == rrtype || (rrtype == dns.TypeANY && h.Rrtype != dns.TypeRRSIG) {
+				rrs = append(rrs, rr)
+			}
+		}
+		return rrs
+	}
+	// Returns the first record of the given type in a list
+	first := func(rrs []dns.RR, rrtype uint16) dns.RR {
+		for _, rr := range rrs {
+			if rr.Header().Rrtype == rrtype {
+				return rr
+			}
+		}
+		return nil
+	}
+
+	// Every step takes at least one record, more steps than records are a loop
+	for i := 0; i <= len(answer); i++ {
+		name := chain.target
+		if rrs := find(name, q.Qtype); len(rrs) > 0 {
+			if q.Qtype == dns.TypeANY {
+				rrs = append(rrs, find(name, dns.TypeRRSIG)...)
+			}
+			chain.records = append(chain.records, rrs...)
+			chain.found = true
+			return chain
+		}
+
+		// A DNAME at an ancestor of the name, the CNAME for the name is
+		// synthesized from it and not signed
+		var dname *dns.DNAME
+		for _, rr := range answer {
+			if d, ok := rr.(*dns.DNAME); ok && !strings.EqualFold(d.Hdr.Name, name) && dns.IsSubDomain(d.Hdr.Name, name) {
+				dname = d
+				break
+			}
+		}
+		if dname != nil {
+			chain.records = append(chain.records, find(dname.Hdr.Name, dns.TypeDNAME)...)
+			if cname := find(name, dns.TypeCNAME); len(cname) > 0 {
+				chain.records = append(chain.records, cname...)
+				chain.synthesized[rrsetKey(name, cname[0].Header().Class, dns.TypeCNAME)] = true
+			}
+			prefix := name[:len(name)-len(dname.Hdr.Name)]
+			chain.target = prefix + dns.Fqdn(dname.Target)
+			continue
+		}
+
+		cname := find(name, dns.TypeCNAME)
+		rr := first(cname, dns.TypeCNAME)
+		if rr == nil {
+			break
+		}
+		chain.records = append(chain.records, cname...)
+		chain.target = rr.(*dns.CNAME).Target
+	}
+	return chain
+}
+
+// Group records into RRsets, and collect the signatures for each.
+func rrsets(rrs []dns.RR) (map[string][]dns.RR, map[string][]*dns.RRSIG) {
+	sets := make(map[string][]dns.RR)
+	sigs := make(map[string][]*dns.RRSIG)
+	for _, rr := range rrs {
+		h := rr.Header()
+		if sig, ok := rr.(*dns.RRSIG); ok {
+			key := rrsetKey(h.Name, h.Class, sig.TypeCovered)
+			sigs[key] = append(sigs[key], sig)
+			continue
+		}
+		key := rrsetKey(h.Name, h.Class, h.Rrtype)
+		sets[key] = append(sets[key], rr)
+	}
+	return sets, sigs
+}
+
+func rrsetKey(name string, class, rrtype uint16) string {
+	return fmt.Sprintf("%s/%d/%d", strings.ToLower(name), class, rrtype)
+}
+
+// Remove DNSSEC records that weren't asked for from a response.
+func stripDNSSEC(a *dns.Msg, qtype uint16) {
+	filter := func(rrs []dns.RR) []dns.RR {
+		out := make([]dns.RR, 0, len(rrs))
+		for _, rr := range rrs {
+			switch rr.Header().Rrtype {
+			case dns.TypeRRSIG, dns.TypeNSEC, dns.TypeNSEC3:
+				if rr.Header().Rrtype != qtype {
+					continue
+				}
+			}
+			out = append(out, rr)
+		}
+		return out
+	}
+	a.Answer = filter(a.Answer)
+	a.Ns = filter(a.Ns)
+	a.Extra = filter(a.Extra)
+}
+
+// Build a SERVFAIL response with an extended error code for a validation failure.
+func dnssecFailure(q *dns.Msg, err error) *dns.Msg {
+	code := dns.ExtendedErrorCodeDNSBogus
+	switch {
+	case errors.Is(err, errDNSKEYMissing):
+		code = dns.ExtendedErrorCodeDNSKEYMissing
+	case errors.Is(err, errRRSIGsMissing):
+		code = dns.ExtendedErrorCodeRRSIGsMissing
+	case errors.Is(err, errNSECMissing):
+		code = dns.ExtendedErrorCodeNSECMissing
+	case errors.Is(err, errNSEC3Iterations):
+		code = edeUnsupportedNSEC3Iterations
+	}
+	a := servfail(q)
+	addEDE(a, q, code, err.Error())
+	return a
+}
@@ -0,0 +1,380 @@
+package rdns
+
+import (
+	"crypto"
+	"fmt"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/miekg/dns"
+	"github.com/stretchr/testify/require"
+)
+
+// Signing key of a zone used in tests.
+type testSigner struct {
+	zone string
+	key  *dns.DNSKEY
+	priv crypto.Signer
+}
+
+func newTestSigner(t *testing.T, zone string) *testSigner {
+	key := &dns.DNSKEY{
+		Hdr:       dns.RR_Header{Name: zone, Rrtype: dns.TypeDNSKEY, Class: dns.ClassINET, Ttl: 3600},
+		Flags:     257,
+		Protocol:  3,
+		Algorithm: dns.ECDSAP256SHA256,
+	}
+	priv, err := key.Generate(256)
+	require.NoError(t, err)
+	return &testSigner{zone: zone, key: key, priv: priv.(crypto.Signer)}
+}
+
+// Returns the records along with their signature.
+func (s *testSigner) sign(t *testing.T, rrs ...dns.RR) []dns.RR {
+	sig := &dns.RRSIG{
+		Hdr:        dns.RR_Header{Ttl: rrs[0].Header().Ttl},
+		Algorithm:  s.key.Algorithm,
+		KeyTag:     s.key.KeyTag(),
+		SignerName: s.zone,
+		Inception:  uint32(time.Now().Add(-time.Hour).Unix()),
+		Expiration: uint32(time.Now().Add(time.Hour).Unix()),
+	}
+	require.NoError(t, sig.Sign(s.priv, rrs))
+	return append(rrs, sig)
+}
+
+func mustRR(t *testing.T, s string) dns.RR {
+	rr, err := dns.NewRR(s)
+	require.NoError(t, err)
+	return rr
+}
+
+// Builds an upstream resolver serving a signed root and example. zone. Returns
+// the resolver and the trust anchor for the root.
+func newTestSignedZones(t *testing.T) (*TestResolver, dns.DS, map[string]int) {
+	root := newTestSigner(t, ".")
+	example := newTestSigner(t, "example.")
+
+	records := map[string][]dns.RR{
+		". DNSKEY":         root.sign(t, root.key),
+		"example. DNSKEY":  example.sign(t, example.key),
+		"example. DS":      root.sign(t, example.key.ToDS(dns.SHA256)),
+		"www.example. A":   example.sign(t, mustRR(t, "www.example. 300 IN A 192.0.2.1")),
+		"plain.example. A": {mustRR(t, "plain.example. 300 IN A 192.0.2.2")},
+		"www.insecure. A":  {mustRR(t, "www.insecure. 300 IN A 192.0.2.6")},
+	}
+
+	// CNAME and DNAME chains, and an answer that only has records for another name
+	www := example.sign(t, mustRR(t, "www.example. 300 IN A 192.0.2.1"))
+	records["alias.example. A"] = append(example.sign(t, mustRR(t, "alias.example. 300 IN CNAME www.example.")), www...)
+	records["www.dname.example. A"] = append(append(
+		example.sign(t, mustRR(t, "dname.example. 300 IN DNAME example.")),
+		mustRR(t, "www.dname.example. 300 IN CNAME www.example.")),
+		www...)
+	records["unrelated.example. A"] = www
+
+	// Answers expanded from a wildcard, with and without proof that there's
+	// no closer match
+	wildcard := example.sign(t, mustRR(t, "*.example. 300 IN A 192.0.2.7"))
+	for _, name := range []string{"wild.example.", "nowild.example."} {
+		var rrs []dns.RR
+		for _, rr := range wildcard {
+			rr = dns.Copy(rr)
+			rr.Header().Name = name
+			rrs = append(rrs, rr)
+		}
+		records[name+" A"] = rrs
+	}
+
+	// Signature that doesn't match the record
+	bad := example.sign(t, mustRR(t, "bad.example. 300 IN A 192.0.2.3"))
+	bad[0].(*dns.A).A[3] = 4
+	records["bad.example. A"] = bad
+
+	// Signed by a zone that has a DS but doesn't publish a DNSKEY
+	other := newTestSigner(t, "other.")
+	records["other. DS"] = root.sign(t, other.key.ToDS(dns.SHA256))
+	records["www.other. A"] = other.sign(t, mustRR(t, "www.other. 300 IN A 192.0.2.5"))
+
+	// Negative responses with their authority section, NODATA unless listed
+	// in nxdomain
+	soa := example.sign(t, mustRR(t, "example. 3600 IN SOA ns.example. hostmaster.example. 1 3600 600 86400 300"))
+	authority := map[string][]dns.RR{
+		// Closer match proof for a wildcard expansion
+		"wild.example. A": example.sign(t, mustRR(t, "alias.example. 3600 IN NSEC www.example. CNAME RRSIG NSEC")),
+
+		// Unsigned zone delegated from the root
+		"insecure. DS": root.sign(t, mustRR(t, "insecure. 3600 IN NSEC other. NS RRSIG NSEC")),
+
+		// NSEC proofs
+		"www.example. AAAA": append(soa, example.sign(t, mustRR(t, "www.example. 3600 IN NSEC example. A TXT RRSIG NSEC"))...),
+		"www.example. TXT":  append(soa, example.sign(t, mustRR(t, "www.example. 3600 IN NSEC example. A TXT RRSIG NSEC"))...),
+		"nx.example. A":     append(soa, example.sign(t, mustRR(t, "example. 3600 IN NSEC www.example. NS SOA RRSIG NSEC DNSKEY"))...),
+		"nsoa.example. A":   soa,
+
+		// NSEC at a delegation, only proves the absence of DS records
+		"deleg.example. MX": append(soa, example.sign(t, mustRR(t, "deleg.example. 3600 IN NSEC www.example. NS RRSIG NSEC"))...),
+		"deleg.example. DS": append(soa, example.sign(t, mustRR(t, "deleg.example. 3600 IN NSEC www.example. NS RRSIG NSEC"))...),
+
+		// NSEC signed by another zone than the SOA
+		"signer.example. AAAA": append(soa, root.sign(t, mustRR(t, "signer.example. 3600 IN NSEC www.example. A RRSIG NSEC"))...),
+	}
+	nxdomain := map[string]bool{"nx.example. A": true, "nsoa.example. A": true, "nx3.example. A": true}
+
+	// NSEC3 proofs, a single record that matches the apex and covers all other names
+	hash := dns.HashName("example.", dns.SHA1, 0, "")
+	nsec3 := example.sign(t, &dns.NSEC3{
+		Hdr:        dns.RR_Header{Name: strings.ToLower(hash) + ".example.", Rrtype: dns.TypeNSEC3, Class: dns.ClassINET, Ttl: 3600},
+		Hash:       dns.SHA1,
+		HashLength: 20,
+		NextDomain: hash,
+		TypeBitMap: []uint16{dns.TypeNS, dns.TypeSOA, dns.TypeRRSIG, dns.TypeDNSKEY, dns.TypeNSEC3PARAM},
+	})
+	authority["nx3.example. A"] = append(soa, nsec3...)
+	authority["example. MX"] = append(soa, nsec3...)
+
+	// NSEC3 proofs with more iterations than are checked, with and without salt
+	for qtype, salt := range map[string]string{"TXT": "", "CAA": "aabb"} {
+		hash := dns.HashName("example.", dns.SHA1, 151, salt)
+		authority["example. "+qtype] = append(soa, example.sign(t, &dns.NSEC3{
+			Hdr:        dns.RR_Header{Name: strings.ToLower(hash) + ".example.", Rrtype: dns.TypeNSEC3, Class: dns.ClassINET, Ttl: 3600},
+			Hash:       dns.SHA1,
+			Iterations: 151,
+			SaltLength: uint8(len(salt) / 2),
+			Salt:       salt,
+			HashLength: 20,
+			NextDomain: hash,
+			TypeBitMap: []uint16{dns.TypeNS, dns.TypeSOA, dns.TypeRRSIG, dns.TypeDNSKEY, dns.TypeNSEC3PARAM},
+		})...)
+	}
+
+	queries := make(map[string]int)
+	r := &TestResolver{
+		ResolveFunc: func(q *dns.Msg, ci ClientInfo) (*dns.Msg, error) {
+			key := q.Question[0].Name + " " + dns.TypeToString[q.Question[0].Qtype]
+			queries[key]++
+			a := new(dns.Msg)
+			a.SetReply(q)
+			rrs, ok := records[key]
+			ns, negative := authority[key]
+			if !ok && (!negative || nxdomain[key]) {
+				a.Rcode = dns.RcodeNameError
+			}
+			a.Answer = rrs
+			a.Ns = ns
+			return a, nil
+		},
+	}
+	return r, *root.key.ToDS(dns.SHA256), queries
+}
+
+func requireEDE(t *testing.T, a *dns.Msg, code uint16) {
+	require.Equal(t, dns.RcodeServerFailure, a.Rcode)
+	opt := a.IsEdns0()
+	require.NotNil(t, opt)
+	require.Len(t, opt.Option, 1)
+	ede, ok := opt.Option[0].(*dns.EDNS0_EDE)
+	require.True(t, ok)
+	require.Equal(t, code, ede.InfoCode, ede.ExtraText)
+}
+
+func TestDNSSECValidator(t *testing.T) {
+	var ci ClientInfo
+	upstream, anchor, queries := newTestSignedZones(t)
+	v, err := NewDNSSECValidator("test-dnssec", upstream, DNSSECOptions{
+		TrustAnchors: []dns.DS{anchor},
+	})
+	require.NoError(t, err)
+
+	// Valid signature, the response is authenticated and signatures removed
+	// since the client didn't ask for them
+	q := new(dns.Msg)
+	q.SetQuestion("www.example.", dns.TypeA)
+	a, err := v.Resolve(q, ci)
+	require.NoError(t, err)
+	require.Equal(t, dns.RcodeSuccess, a.Rcode)
+	require.True(t, a.AuthenticatedData)
+	require.Len(t, a.Answer, 1)
+
+	// Signatures are returned if the client set the DO bit
+	q.SetEdns0(4096, true)
+	a, err = v.Resolve(q, ci)
+	require.NoError(t, err)
+	require.True(t, a.AuthenticatedData)
+	require.Len(t, a.Answer, 2)
+
+	// Keys are cached
+	require.Equal(t, 1, queries["example. DNSKEY"])
+	require.Equal(t, 1, queries[". DNSKEY"])
+
+	// Invalid signature, the error is only attached if the query uses EDNS0
+	q = new(dns.Msg)
+	q.SetQuestion("bad.example.", dns.TypeA)
+	a, err = v.Resolve(q, ci)
+	require.NoError(t, err)
+	require.Equal(t, dns.RcodeServerFailure, a.Rcode)
+	require.Nil(t, a.IsEdns0())
+	q.SetEdns0(4096, false)
+	a, err = v.Resolve(q, ci)
+	require.NoError(t, err)
+	requireEDE(t, a, dns.ExtendedErrorCodeDNSBogus)
+
+	// Clients that set CD get the response without validation
+	q.CheckingDisabled = true
+	a, err = v.Resolve(q, ci)
+	require.NoError(t, err)
+	require.Equal(t, dns.RcodeSuccess, a.Rcode)
+	require.False(t, a.AuthenticatedData)
+	require.True(t, a.CheckingDisabled)
+	require.Len(t, a.Answer, 1)
+	q.CheckingDisabled = false
+
+	// No DNSKEY for the signer
+	q.SetQuestion("www.other.", dns.TypeA)
+	a, err = v.Resolve(q, ci)
+	require.NoError(t, err)
+	requireEDE(t, a, dns.ExtendedErrorCodeDNSKEYMissing)
+
+	// Unsigned response
+	q.SetQuestion("plain.example.", dns.TypeA)
+	a, err = v.Resolve(q, ci)
+	require.NoError(t, err)
+	requireEDE(t, a, dns.ExtendedErrorCodeRRSIGsMissing)
+
+	// CNAME and DNAME chains to a signed answer
+	for _, name := range []string{"alias.example.", "www.dname.example."} {
+		q.SetQuestion(name, dns.TypeA)
+		a, err = v.Resolve(q, ci)
+		require.NoError(t, err)
+		require.Equal(t, dns.RcodeSuccess, a.Rcode, name)
+		require.True(t, a.AuthenticatedData, name)
+		require.Equal(t, "192.0.2.1", a.Answer[len(a.Answer)-1].(*dns.A).A.String(), name)
+	}
+
+	// Wildcard expansions need proof that there's no closer match
+	q.SetQuestion("wild.example.", dns.TypeA)
+	a, err = v.Resolve(q, ci)
+	require.NoError(t, err)
+	require.Equal(t, dns.RcodeSuccess, a.Rcode)
+	require.True(t, a.AuthenticatedData)
+	q.SetQuestion("nowild.example.", dns.TypeA)
+	a, err = v.Resolve(q, ci)
+	require.NoError(t, err)
+	requireEDE(t, a, dns.ExtendedErrorCodeNSECMissing)
+
+	// Signed records for another name don't answer the query, the response
+	// is negative without proof
+	q.SetQuestion("unrelated.example.", dns.TypeA)
+	a, err = v.Resolve(q, ci)
+	require.NoError(t, err)
+	requireEDE(t, a, dns.ExtendedErrorCodeRRSIGsMissing)
+}
+
+func TestDNSSECValidatorAllowUnsigned(t *testing.T) {
+	var ci ClientInfo
+	upstream, anchor, queries := newTestSignedZones(t)
+	v, err := NewDNSSECValidator("test-dnssec-unsigned", upstream, DNSSECOptions{
+		TrustAnchors:  []dns.DS{anchor},
+		AllowUnsigned: true,
+	})
+	require.NoError(t, err)
+
+	// Unsigned responses from unsigned zones pass, but aren't authenticated
+	q := new(dns.Msg)
+	q.SetQuestion("www.insecure.", dns.TypeA)
+	q.SetEdns0(4096, false)
+	a, err := v.Resolve(q, ci)
+	require.NoError(t, err)
+	require.Equal(t, dns.RcodeSuccess, a.Rcode)
+	require.False(t, a.AuthenticatedData)
+
+	// The proof that the zone is unsigned is cached
+	_, err = v.Resolve(q, ci)
+	require.NoError(t, err)
+	require.Equal(t, 1, queries["insecure. DS"])
+
+	// Unsigned responses for names in signed zones fail, the signatures could
+	// have been stripped
+	q.SetQuestion("plain.example.", dns.TypeA)
+	a, err = v.Resolve(q, ci)
+	require.NoError(t, err)
+	requireEDE(t, a, dns.ExtendedErrorCodeRRSIGsMissing)
+
+	// Invalid signatures still fail
+	q.SetQuestion("bad.example.", dns.TypeA)
+	a, err = v.Resolve(q, ci)
+	require.NoError(t, err)
+	requireEDE(t, a, dns.ExtendedErrorCodeDNSBogus)
+
+	// NSEC3 proofs with too many iterations are insecure, unless they're salted
+	q.SetQuestion("example.", dns.TypeTXT)
+	a, err = v.Resolve(q, ci)
+	require.NoError(t, err)
+	require.Equal(t, dns.RcodeSuccess, a.Rcode)
+	require.False(t, a.AuthenticatedData)
+	q.SetQuestion("example.", dns.TypeCAA)
+	a, err = v.Resolve(q, ci)
+	require.NoError(t, err)
+	requireEDE(t, a, dns.ExtendedErrorCodeDNSBogus)
+}
+
+func TestDNSSECValidatorDenial(t *testing.T) {
+	var ci ClientInfo
+	upstream, anchor, _ := newTestSignedZones(t)
+	v, err := NewDNSSECValidator("test-dnssec-denial", upstream, DNSSECOptions{
+		TrustAnchors: []dns.DS{anchor},
+	})
+	require.NoError(t, err)
+
+	tests := []struct {
+		name  string
+		qtype uint16
+		rcode int
+		ede   uint16
+	}{
+		{name: "www.example.", qtype: dns.TypeAAAA, rcode: dns.RcodeSuccess},                  // NSEC without the type
+		{name: "www.example.", qtype: dns.TypeTXT, ede: dns.ExtendedErrorCodeNSECMissing},     // NSEC lists the type
+		{name: "nx.example.", qtype: dns.TypeA, rcode: dns.RcodeNameError},                    // NSEC covers the name and wildcard
+		{name: "nsoa.example.", qtype: dns.TypeA, ede: dns.ExtendedErrorCodeNSECMissing},      // Only a signed SOA
+		{name: "nx3.example.", qtype: dns.TypeA, rcode: dns.RcodeNameError},                   // NSEC3 closest encloser proof
+		{name: "example.", qtype: dns.TypeMX, rcode: dns.RcodeSuccess},                        // NSEC3 without the type
+		{name: "deleg.example.", qtype: dns.TypeMX, ede: dns.ExtendedErrorCodeNSECMissing},    // NSEC of the parent side of a delegation
+		{name: "deleg.example.", qtype: dns.TypeDS, rcode: dns.RcodeSuccess},                  // which does prove there's no DS
+		{name: "signer.example.", qtype: dns.TypeAAAA, ede: dns.ExtendedErrorCodeNSECMissing}, // NSEC signed by the wrong zone
+		{name: "example.", qtype: dns.TypeTXT, ede: edeUnsupportedNSEC3Iterations},            // NSEC3 with too many iterations
+		{name: "example.", qtype: dns.TypeCAA, ede: dns.ExtendedErrorCodeDNSBogus},            // and a salt
+	}
+	for _, test := range tests {
+		q := new(dns.Msg)
+		q.SetQuestion(test.name, test.qtype)
+		q.SetEdns0(4096, false)
+		a, err := v.Resolve(q, ci)
+		require.NoError(t, err)
+		if test.ede != 0 {
+			requireEDE(t, a, test.ede)
+			continue
+		}
+		require.Equal(t, test.rcode, a.Rcode, test.name)
+		require.True(t, a.AuthenticatedData, test.name)
+	}
+}
+
+func TestDNSSECZoneCacheLimit(t *testing.T) {
+	cache := map[string]time.Time{"expired.": time.Now().Add(-time.Second)}
+	for i := 0; i < dnssecMaxCachedZones; i++ {
+		cache[fmt.Sprintf("zone%d.", i)] = time.Now().Add(time.Hour)
+	}
+	pruneZoneCache(cache, func(expiry time.Time) time.Time { return expiry })
+	require.NotContains(t, cache, "expired.")
+	require.Len(t, cache, dnssecMaxCachedZones*3/4)
+}
+
+func TestDNSSECValidatorDefaultAnchors(t *testing.T) {
+	v, err := NewDNSSECValidator("test-dnssec-default", new(TestResolver), DNSSECOptions{})
+	require.NoError(t, err)
+	require.Len(t, v.anchors["."], len(DefaultTrustAnchors))
+	for _, ds := range v.anchors["."] {
+		require.True(t, strings.HasPrefix(ds.Hdr.Name, "."))
+	}
+}
@@ -0,0 +1,232 @@
+package rdns
+
+import (
+	"errors"
+	"expvar"
+	"fmt"
+	"io"
+	"net"
+	"sync"
+	"time"
+
+	"github.com/miekg/dns"
+	"google.golang.org/protobuf/encoding/protowire"
+)
+
+// DnstapContentType is the Frame Streams content type of dnstap streams.
+const DnstapContentType = "protobuf:dnstap.Dnstap"
+
+// Dnstap forwards every query unmodified and emits the query and response as
+// dnstap messages, see https://dnstap.info. Placed behind a listener it logs
+// client queries, placed in front of a resolver it logs the queries forwarded
+// upstream. Messages are written asynchronously and dropped if the buffer is
+// full.
+type Dnstap struct {
+	id       string
+	resolver Resolver
+	opt      DnstapOptions
+	typ      dnstapType
+
+	mu       sync.RWMutex
+	closed   bool
+	messages chan []byte
+	done     chan struct{}
+
+	// Number of messages dropped because the buffer was full
+	dropped *expvar.Int
+}
+
+var _ Resolver = &Dnstap{}
+
+type DnstapOptions struct {
+	// Destination of the dnstap messages, every write is one message. Usually
+	// a FrameStreamWriter. Closed when the element is closed.
+	Output io.WriteCloser
+
+	// Identity and version of the server in messages. Optional.
+	Identity string
+	Version  string
+
+	// Kind of messages, "client" for queries received from clients, or
+	// "forwarder" for queries sent upstream. Defaults to "client".
+	MessageType string
+
+	// Number of messages that can be buffered before new ones are dropped.
+	// Defaults to 1024.
+	BufferSize int
+}
+
+// Message types as defined in dnstap.proto
+type dnstapType struct {
+	query, response uint64
+}
+
+var dnstapTypes = map[string]dnstapType{
+	"client":    {query: 5, response: 6},
+	"forwarder": {query: 7, response: 8},
+}
+
+// Field numbers from dnstap.proto
+const (
+	dnstapFieldIdentity = 1
+	dnstapFieldVersion  = 2
+	dnstapFieldMessage  = 14
+	dnstapFieldType     = 15
+
+	dnstapMessageType             = 1
+	dnstapMessageSocketFamily     = 2
+	dnstapMessageSocketProtocol   = 3
+	dnstapMessageQueryAddress     = 4
+	dnstapMessageQueryTimeSec     = 8
+	dnstapMessageQueryTimeNsec    = 9
+	dnstapMessageQueryMessage     = 10
+	dnstapMessageResponseTimeSec  = 12
+	dnstapMessageResponseTimeNsec = 13
+	dnstapMessageResponseMessage  = 14
+
+	dnstapTypeMessage = 1
+
+	dnstapSocketFamilyINET  = 1
+	dnstapSocketFamilyINET6 = 2
+
+	dnstapSocketProtocolDOH = 4
+)
+
+// NewDnstap returns a new instance of a dnstap element.
+func NewDnstap(id string, resolver Resolver, opt DnstapOptions) (*Dnstap, error) {
+	if opt.Output == nil {
+		return nil, errors.New("no dnstap output")
+	}
+	if opt.MessageType == "" {
+		opt.MessageType = "client"
+	}
+	typ, ok := dnstapTypes[opt.MessageType]
+	if !ok {
+		return nil, fmt.Errorf("unsupported dnstap message type %q", opt.MessageType)
+	}
+	if opt.BufferSize <= 0 {
+		opt.BufferSize = 1024
+	}
+	r := &Dnstap{
+		id:       id,
+		resolver: resolver,
+		opt:      opt,
+		typ:      typ,
+		messages: make(chan []byte, opt.BufferSize),
+		done:     make(chan struct{}),
+		dropped:  getVarInt("dnstap", id, "dropped"),
+	}
+	go r.run()
+	return r, nil
+}
+
+// Resolve passes a DNS query through unmodified and queues dnstap messages for
+// the query and response.
+func (r *Dnstap) Resolve(q *dns.Msg, ci ClientInfo) (*dns.Msg, error) {
+	// Pack the query before forwarding it, later elements may change it
+	start := time.Now()
+	query, _ := q.Pack()
+	r.queue(r.message(r.typ.query, ci, start, query, time.Time{}, nil))
+
+	a, err := r.resolver.Resolve(q, ci)
+	if a != nil {
+		response, _ := a.Pack()
+		r.queue(r.message(r.typ.response, ci, start, query, time.Now(), response))
+	}
+	return a, err
+}
+
+// Close stops accepting new messages, writes all buffered ones and closes the
+// output.
+func (r *Dnstap) Close() error {
+	r.mu.Lock()
+	if r.closed {
+		r.mu.Unlock()
+		return nil
+	}
+	r.closed = true
+	close(r.messages)
+	r.mu.Unlock()
+	<-r.done
+	return r.opt.Output.Close()
+}
+
+func (r *Dnstap) String() string {
+	return r.id
+}
+
+func (r *Dnstap) queue(msg []byte) {
+	r.mu.RLock()
+	defer r.mu.RUnlock()
+	if r.closed {
+		return
+	}
+	select {
+	case r.messages <- msg:
+	default:
+		r.dropped.Add(1)
+	}
+}
+
+// Write messages to the output until the element is closed.
+func (r *Dnstap) run() {
+	defer close(r.done)
+	for msg := range r.messages {
+		if _, err := r.opt.Output.Write(msg); err != nil {
+			Log.WithField("id", r.id).WithError(err).Error("failed to write dnstap message")
+		}
+	}
+}
+
+// Encode a dnstap message. The response fields are only set if response is
+// not nil.
+func (r *Dnstap) message(typ uint64, ci ClientInfo, queryTime time.Time, query []byte, responseTime time.Time, response []byte) []byte {
+	var m []byte
+	m = protowire.AppendTag(m, dnstapMessageType, protowire.VarintType)
+	m = protowire.AppendVarint(m, typ)
+	if ip := ci.SourceIP; ip != nil {
+		family, addr := uint64(dnstapSocketFamilyINET6), ip.To16()
+		if ip4 := ip.To4(); ip4 != nil {
+			family, addr = dnstapSocketFamilyINET, ip4
+		}
+		m = protowire.AppendTag(m, dnstapMessageSocketFamily, protowire.VarintType)
+		m = protowire.AppendVarint(m, family)
+		m = protowire.AppendTag(m, dnstapMessageQueryAddress, protowire.BytesType)
+		m = protowire.AppendBytes(m, []byte(net.IP(addr)))
+	}
+	if ci.DoHPath != "" {
+		m = protowire.AppendTag(m, dnstapMessageSocketProtocol, protowire.VarintType)
+		m = protowire.AppendVarint(m, dnstapSocketProtocolDOH)
+	}
+	m = protowire.AppendTag(m, dnstapMessageQueryTimeSec, protowire.VarintType)
+	m = protowire.AppendVarint(m, uint64(queryTime.Unix()))
+	m = protowire.AppendTag(m, dnstapMessageQueryTimeNsec, protowire.Fixed32Type)
+	m = protowire.AppendFixed32(m, uint32(queryTime.Nanosecond()))
+	if query != nil {
+		m = protowire.AppendTag(m, dnstapMessageQueryMessage, protowire.BytesType)
+		m = protowire.AppendBytes(m, query)
+	}
+	if response != nil {
+		m = protowire.AppendTag(m, dnstapMessageResponseTimeSec, protowire.VarintType)
+		m = protowire.AppendVarint(m, uint64(responseTime.Unix()))
+		m = protowire.AppendTag(m, dnstapMessageResponseTimeNsec, protowire.Fixed32Type)
+		m = protowire.AppendFixed32(m, uint32(responseTime.Nanosecond()))
+		m = protowire.AppendTag(m, dnstapMessageResponseMessage, protowire.BytesType)
+		m = protowire.AppendBytes(m, response)
+	}
+
+	var b []byte
+	if r.opt.Identity != "" {
+		b = protowire.AppendTag(b, dnstapFieldIdentity, protowire.BytesType)
+		b = protowire.AppendString(b, r.opt.Identity)
+	}
+	if r.opt.Version != "" {
+		b = protowire.AppendTag(b, dnstapFieldVersion, protowire.BytesType)
+		b = protowire.AppendString(b, r.opt.Version)
+	}
+	b = protowire.AppendTag(b, dnstapFieldMessage, protowire.BytesType)
+	b = protowire.AppendBytes(b, m)
+	b = protowire.AppendTag(b, dnstapFieldType, protowire.VarintType)
+	b = protowire.AppendVarint(b, dnstapTypeMessage)
+	return b
+}
@@ -0,0 +1,167 @@
+package rdns
+
+import (
+	"bufio"
+	"encoding/binary"
+	"io"
+	"net"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/miekg/dns"
+	"github.com/stretchr/testify/require"
+	"google.golang.org/protobuf/encoding/protowire"
+)
+
+// Reads one frame, returns the control type for control frames or the data.
+func readTestFrame(t *testing.T, r io.Reader) (uint32, []byte) {
+	var n uint32
+	require.NoError(t, binary.Read(r, binary.BigEndian, &n))
+	if n == 0 {
+		require.NoError(t, binary.Read(r, binary.BigEndian, &n))
+		body := make([]byte, n)
+		_, err := io.ReadFull(r, body)
+		require.NoError(t, err)
+		return binary.BigEndian.Uint32(body), body[4:]
+	}
+	data := make([]byte, n)
+	_, err := io.ReadFull(r, data)
+	require.NoError(t, err)
+	return 0, data
+}
+
+// Decodes the fields of a protobuf message into a map by field number. Only
+// the last value of each field is kept.
+func decodeTestProto(t *testing.T, b []byte) map[protowire.Number]any {
+	fields := make(map[protowire.Number]any)
+	for len(b) > 0 {
+		num, typ, n := protowire.ConsumeTag(b)
+		require.True(t, n > 0)
+		b = b[n:]
+		switch typ {
+		case protowire.VarintType:
+			v, n := protowire.ConsumeVarint(b)
+			fields[num] = v
+			b = b[n:]
+		case protowire.Fixed32Type:
+			v, n := protowire.ConsumeFixed32(b)
+			fields[num] = v
+			b = b[n:]
+		case protowire.BytesType:
+			v, n := protowire.ConsumeBytes(b)
+			fields[num] = v
+			b = b[n:]
+		default:
+			t.Fatalf("unexpected wire type %d", typ)
+		}
+	}
+	return fields
+}
+
+func TestDnstapSocket(t *testing.T) {
+	addr := filepath.Join(t.TempDir(), "dnstap.sock")
+	l, err := net.Listen("unix", addr)
+	require.NoError(t, err)
+	defer l.Close()
+
+	// Collector side of the handshake, returns the data frames it received
+	frames := make(chan [][]byte, 1)
+	go func() {
+		conn, err := l.Accept()
+		if err != nil {
+			return
+		}
+		defer conn.Close()
+		r := bufio.NewReader(conn)
+		typ, _ := readTestFrame(t, r)
+		require.Equal(t, uint32(fstrmControlReady), typ)
+		conn.Write(fstrmControlFrame(fstrmControlAccept, DnstapContentType))
+		typ, _ = readTestFrame(t, r)
+		require.Equal(t, uint32(fstrmControlStart), typ)
+		var data [][]byte
+		for {
+			typ, b := readTestFrame(t, r)
+			if typ == fstrmControlStop {
+				conn.Write(fstrmControlFrame(fstrmControlFinish, ""))
+				frames <- data
+				return
+			}
+			data = append(data, b)
+		}
+	}()
+
+	out, err := NewFrameStreamSocket("unix", addr, DnstapContentType, 0)
+	require.NoError(t, err)
+	d, err := NewDnstap("test-dnstap", new(TestResolver), DnstapOptions{
+		Output:   out,
+		Identity: "routedns",
+	})
+	require.NoError(t, err)
+
+	q := new(dns.Msg)
+	q.SetQuestion("example.com.", dns.TypeA)
+	_, err = d.Resolve(q, ClientInfo{SourceIP: net.ParseIP("192.168.1.1")})
+	require.NoError(t, err)
+	require.NoError(t, d.Close())
+
+	data := <-frames
+	require.Len(t, data, 2)
+
+	// Client query
+	tap := decodeTestProto(t, data[0])
+	require.Equal(t, []byte("routedns"), tap[dnstapFieldIdentity])
+	require.Equal(t, uint64(dnstapTypeMessage), tap[dnstapFieldType])
+	msg := decodeTestProto(t, tap[dnstapFieldMessage].([]byte))
+	require.Equal(t, uint64(5), msg[dnstapMessageType])
+	require.Equal(t, uint64(dnstapSocketFamilyINET), msg[dnstapMessageSocketFamily])
+	require.Equal(t, []byte{192, 168, 1, 1}, msg[dnstapMessageQueryAddress])
+	query := new(dns.Msg)
+	require.NoError(t, query.Unpack(msg[dnstapMessageQueryMessage].([]byte)))
+	require.Equal(t, "example.com.", query.Question[0].Name)
+	require.NotContains(t, msg, protowire.Number(dnstapMessageResponseMessage))
+
+	// Client response
+	tap = decodeTestProto(t, data[1])
+	msg = decodeTestProto(t, tap[dnstapFieldMessage].([]byte))
+	require.Equal(t, uint64(6), msg[dnstapMessageType])
+	response := new(dns.Msg)
+	require.NoError(t, response.Unpack(msg[dnstapMessageResponseMessage].([]byte)))
+	require.Equal(t, "example.com.", response.Question[0].Name)
+	require.Contains(t, msg, protowire.Number(dnstapMessageResponseTimeSec))
+}
+
+func TestDnstapFile(t *testing.T) {
+	filename := filepath.Join(t.TempDir(), "dnstap.fstrm")
+	out, err := NewFrameStreamFile(filename, DnstapContentType)
+	require.NoError(t, err)
+	d, err := NewDnstap("test-dnstap-file", new(TestResolver), DnstapOptions{
+		Output:      out,
+		MessageType: "forwarder",
+	})
+	require.NoError(t, err)
+
+	q := new(dns.Msg)
+	q.SetQuestion("example.com.", dns.TypeA)
+	_, err = d.Resolve(q, ClientInfo{})
+	require.NoError(t, err)
+	require.NoError(t, d.Close())
+
+	f, err := os.Open(filename)
+	require.NoError(t, err)
+	defer f.Close()
+	typ, _ := readTestFrame(t, f)
+	require.Equal(t, uint32(fstrmControlStart), typ)
+	for _, expected := range []uint64{7, 8} {
+		typ, b := readTestFrame(t, f)
+		require.Zero(t, typ)
+		tap := decodeTestProto(t, b)
+		msg := decodeTestProto(t, tap[dnstapFieldMessage].([]byte))
+		require.Equal(t, expected, msg[dnstapMessageType])
+	}
+	typ, _ = readTestFrame(t, f)
+	require.Equal(t, uint32(fstrmControlStop), typ)
+
+	_, err = NewDnstap("test-dnstap-invalid", new(TestResolver), DnstapOptions{Output: out, MessageType: "auth"})
+	require.Error(t, err)
+}
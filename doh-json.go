@@ -0,0 +1,113 @@
+package rdns
+
+import (
+	"errors"
+	"fmt"
+	"net/url"
+	"strconv"
+	"strings"
+
+	"github.com/miekg/dns"
+)
+
+// Content type of DoH queries and responses in JSON format, as used by the
+// Google and Cloudflare public resolvers. This is not the format defined in
+// RFC 8427.
+const dohJSONContentType = "application/dns-json"
+
+// dohJSONResponse is the JSON representation of a DNS response.
+type dohJSONResponse struct {
+	Status     int
+	TC         bool
+	RD         bool
+	RA         bool
+	AD         bool
+	CD         bool
+	Question   []dohJSONQuestion
+	Answer     []dohJSONRR `json:",omitempty"`
+	Authority  []dohJSONRR `json:",omitempty"`
+	Additional []dohJSONRR `json:",omitempty"`
+}
+
+type dohJSONQuestion struct {
+	Name string `json:"name"`
+	Type uint16 `json:"type"`
+}
+
+type dohJSONRR struct {
+	Name string `json:"name"`
+	Type uint16 `json:"type"`
+	TTL  uint32
+	Data string `json:"data"`
+}
+
+// Build a query from the parameters of a JSON request. Supported are "name",
+// "type" (name or number, default A), "do", and "cd".
+func dohJSONQuery(params url.Values) (*dns.Msg, error) {
+	name := params.Get("name")
+	if name == "" {
+		return nil, errors.New("no name query parameter found")
+	}
+	if _, ok := dns.IsDomainName(name); !ok {
+		return nil, fmt.Errorf("invalid name %q", name)
+	}
+	qtype := dns.TypeA
+	if t := params.Get("type"); t != "" {
+		if n, err := strconv.ParseUint(t, 10, 16); err == nil {
+			qtype = uint16(n)
+		} else if v, ok := dns.StringToType[strings.ToUpper(t)]; ok {
+			qtype = v
+		} else {
+			return nil, fmt.Errorf("invalid type %q", t)
+		}
+	}
+	q := new(dns.Msg)
+	q.SetQuestion(dns.Fqdn(name), qtype)
+	if isTrue(params.Get("do")) {
+		q.SetEdns0(4096, true)
+	}
+	q.CheckingDisabled = isTrue(params.Get("cd"))
+	return q, nil
+}
+
+func isTrue(s string) bool {
+	return s == "1" || strings.EqualFold(s, "true")
+}
+
+// Convert a DNS response into its JSON representation. The record data uses the
+// presentation format of the record.
+func newDoHJSONResponse(a *dns.Msg) dohJSONResponse {
+	resp := dohJSONResponse{
+		Status: a.Rcode,
+		TC:     a.Truncated,
+		RD:     a.RecursionDesired,
+		RA:     a.RecursionAvailable,
+		AD:     a.AuthenticatedData,
+		CD:     a.CheckingDisabled,
+	}
+	for _, q := range a.Question {
+		resp.Question = append(resp.Question, dohJSONQuestion{Name: q.Name, Type: q.Qtype})
+	}
+	resp.Answer = dohJSONRRs(a.Answer)
+	resp.Authority = dohJSONRRs(a.Ns)
+	resp.Additional = dohJSONRRs(a.Extra)
+	return resp
+}
+
+func dohJSONRRs(rrs []dns.RR) []dohJSONRR {
+	var out []dohJSONRR
+	for _, rr := range rrs {
+		// The OPT pseudo-record is represented by the flags
+		if _, ok := rr.(*dns.OPT); ok {
+			continue
+		}
+		h := rr.Header()
+		out = append(out, dohJSONRR{
+			Name: h.Name,
+			Type: h.Rrtype,
+			TTL:  h.Ttl,
+			Data: strings.TrimPrefix(rr.String(), h.String()),
+		})
+	}
+	return out
+}
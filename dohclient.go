@@ -56,6 +56,7 @@ type DoHClient struct {
 	client   *http.Client
 	opt      DoHClientOptions
 	metrics  *ListenerMetrics
+	latency  *varHistogram
 }
 
 var _ Resolver = &DoHClient{}
@@ -104,6 +105,7 @@ func NewDoHClient(id, endpoint string, opt DoHClientOptions) (*DoHClient, error)
 		client:   client,
 		opt:      opt,
 		metrics:  NewListenerMetrics("client", id),
+		latency:  getVarHistogram("client", id, "latency"),
 	}, nil
 }
 
@@ -122,17 +124,40 @@ func (d *DoHClient) Resolve(q *dns.Msg, ci ClientInfo) (*dns.Msg, error) {
 	padQuery(q)
 
 	d.metrics.query.Add(1)
+	start := time.Now()
+	var (
+		a   *dns.Msg
+		err error
+	)
+	timeout := queryTimeout(d.opt.QueryTimeout, ci.Deadline)
+	if timeout <= 0 {
+		d.metrics.err.Add("deadline", 1)
+		return nil, QueryTimeoutError{q}
+	}
+	ctx, cancel := queryContext(timeout, ci.Done)
+	defer cancel()
 	switch d.opt.Method {
 	case "POST":
-		return d.ResolvePOST(q)
+		a, err = d.resolvePOST(ctx, q)
 	case "GET":
-		return d.ResolveGET(q)
+		a, err = d.resolveGET(ctx, q)
+	default:
+		return nil, errors.New("unsupported method")
+	}
+	if err == nil {
+		d.latency.observe(time.Since(start))
 	}
-	return nil, errors.New("unsupported method")
+	return a, err
 }
 
 // ResolvePOST resolves a DNS query via DNS-over-HTTP using the POST method.
 func (d *DoHClient) ResolvePOST(q *dns.Msg) (*dns.Msg, error) {
+	ctx, cancel := context.WithTimeout(context.Background(), d.opt.QueryTimeout)
+	defer cancel()
+	return d.resolvePOST(ctx, q)
+}
+
+func (d *DoHClient) resolvePOST(ctx context.Context, q *dns.Msg) (*dns.Msg, error) {
 	// Pack the DNS query into wire format
 	b, err := q.Pack()
 	if err != nil {
@@ -146,9 +171,6 @@ func (d *DoHClient) ResolvePOST(q *dns.Msg) (*dns.Msg, error) {
 		return nil, err
 	}
 
-	ctx, cancel := context.WithTimeout(context.Background(), d.opt.QueryTimeout)
-	defer cancel()
-
 	req, err := http.NewRequestWithContext(ctx, "POST", u, bytes.NewReader(b))
 	if err != nil {
 		d.metrics.err.Add("http", 1)
@@ -167,6 +189,12 @@ func (d *DoHClient) ResolvePOST(q *dns.Msg) (*dns.Msg, error) {
 
 // ResolveGET resolves a DNS query via DNS-over-HTTP using the GET method.
 func (d *DoHClient) ResolveGET(q *dns.Msg) (*dns.Msg, error) {
+	ctx, cancel := context.WithTimeout(context.Background(), d.opt.QueryTimeout)
+	defer cancel()
+	return d.resolveGET(ctx, q)
+}
+
+func (d *DoHClient) resolveGET(ctx context.Context, q *dns.Msg) (*dns.Msg, error) {
 	// Pack the DNS query into wire format
 	b, err := q.Pack()
 	if err != nil {
@@ -183,9 +211,6 @@ func (d *DoHClient) ResolveGET(q *dns.Msg) (*dns.Msg, error) {
 		return nil, err
 	}
 
-	ctx, cancel := context.WithTimeout(context.Background(), d.opt.QueryTimeout)
-	defer cancel()
-
 	method := http.MethodGet
 	if d.opt.Use0RTT && d.opt.Transport == "quic" {
 		method = http3.MethodGet0RTT
@@ -288,7 +313,7 @@ func dohQuicTransport(endpoint string, opt DoHClientOptions) (http.RoundTripper,
 	}
 
 	dialer := func(ctx context.Context, addr string, tlsConfig *tls.Config, config *quic.Config) (quic.EarlyConnection, error) {
-		return newQuicConnection(u.Hostname(), addr, lAddr, tlsConfig, config)
+		return newQuicConnection(ctx, u.Hostname(), addr, lAddr, tlsConfig, config)
 	}
 	if opt.BootstrapAddr != "" {
 		dialer = func(ctx context.Context, addr string, tlsConfig *tls.Config, config *quic.Config) (quic.EarlyConnection, error) {
@@ -297,7 +322,7 @@ func dohQuicTransport(endpoint string, opt DoHClientOptions) (http.RoundTripper,
 				return nil, err
 			}
 			addr = net.JoinHostPort(opt.BootstrapAddr, port)
-			return newQuicConnection(u.Hostname(), addr, lAddr, tlsConfig, config)
+			return newQuicConnection(ctx, u.Hostname(), addr, lAddr, tlsConfig, config)
 		}
 	}
 
@@ -327,8 +352,10 @@ type quicConnection struct {
 	udpConn   *net.UDPConn
 }
 
-func newQuicConnection(hostname, rAddr string, lAddr net.IP, tlsConfig *tls.Config, config *quic.Config) (quic.EarlyConnection, error) {
-	connection, udpConn, err := quicDial(context.TODO(), hostname, rAddr, lAddr, tlsConfig, config)
+// The context only applies to the initial handshake, it bounds the time the first
+// query waits for the connection.
+func newQuicConnection(ctx context.Context, hostname, rAddr string, lAddr net.IP, tlsConfig *tls.Config, config *quic.Config) (quic.EarlyConnection, error) {
+	connection, udpConn, err := quicDial(ctx, hostname, rAddr, lAddr, tlsConfig, config)
 	if err != nil {
 		return nil, err
 	}
@@ -4,6 +4,7 @@ import (
 	"context"
 	"crypto/tls"
 	"encoding/base64"
+	"encoding/json"
 	"expvar"
 	"fmt"
 	"io/ioutil"
@@ -32,6 +33,7 @@ type DoHListener struct {
 	opt  DoHListenerOptions
 
 	handler http.Handler
+	paths   map[string]struct{} // Paths of wire-format queries, any path if empty
 
 	metrics *DoHListenerMetrics
 }
@@ -52,6 +54,19 @@ type DoHListenerOptions struct {
 
 	// Disable TLS on the server (insecure, for testing purposes only).
 	NoTLS bool
+
+	// Answer GET requests in JSON format (application/dns-json) if they ask
+	// for it with the Accept header.
+	EnableJSON bool
+
+	// URL path JSON requests are accepted on in addition to Paths. Defaults
+	// to "/resolve".
+	JSONPath string
+
+	// URL paths wire-format queries are accepted on, for example
+	// "/dns-query". Requests to other paths are answered with 404. Queries
+	// are accepted on any path if empty.
+	Paths []string
 }
 
 type DoHListenerMetrics struct {
@@ -60,6 +75,7 @@ type DoHListenerMetrics struct {
 	// HTTP method used for query.
 	get  *expvar.Int
 	post *expvar.Int
+	json *expvar.Int
 }
 
 func NewDoHListenerMetrics(id string) *DoHListenerMetrics {
@@ -72,6 +88,7 @@ func NewDoHListenerMetrics(id string) *DoHListenerMetrics {
 		},
 		get:  getVarInt("listener", id, "get"),
 		post: getVarInt("listener", id, "post"),
+		json: getVarInt("listener", id, "json"),
 	}
 }
 
@@ -85,14 +102,24 @@ func NewDoHListener(id, addr string, opt DoHListenerOptions, resolver Resolver)
 	default:
 		return nil, fmt.Errorf("unknown protocol: '%s'", opt.Transport)
 	}
+	if opt.JSONPath == "" {
+		opt.JSONPath = "/resolve"
+	}
 
 	l := &DoHListener{
 		id:      id,
 		addr:    addr,
 		r:       resolver,
 		opt:     opt,
+		paths:   make(map[string]struct{}, len(opt.Paths)),
 		metrics: NewDoHListenerMetrics(id),
 	}
+	for _, path := range opt.Paths {
+		if !strings.HasPrefix(path, "/") {
+			return nil, fmt.Errorf("invalid path '%s', must start with '/'", path)
+		}
+		l.paths[path] = struct{}{}
+	}
 	l.handler = http.HandlerFunc(l.dohHandler)
 	return l, nil
 }
@@ -116,7 +143,7 @@ func (s *DoHListener) startTCP() error {
 		WriteTimeout: dohServerTimeout,
 	}
 
-	ln, err := net.Listen("tcp", s.addr)
+	ln, err := s.opt.listenTCP(s.addr)
 	if err != nil {
 		return err
 	}
@@ -152,9 +179,19 @@ func (s *DoHListener) String() string {
 }
 
 func (s *DoHListener) dohHandler(w http.ResponseWriter, r *http.Request) {
+	if !s.servesPath(r.URL.Path) {
+		s.metrics.err.Add("path", 1)
+		http.NotFound(w, r)
+		return
+	}
 	switch r.Method {
 	case "GET":
 		s.metrics.get.Add(1)
+		if s.isJSONRequest(r) {
+			s.metrics.json.Add(1)
+			s.jsonHandler(w, r)
+			return
+		}
 		s.getHandler(w, r)
 	case "POST":
 		s.metrics.post.Add(1)
@@ -175,7 +212,9 @@ func (s *DoHListener) getHandler(w http.ResponseWriter, r *http.Request) {
 		http.Error(w, "no dns query value found", http.StatusBadRequest)
 		return
 	}
-	b, err := base64.RawURLEncoding.DecodeString(b64[0])
+	// The parameter is sent without padding, but accept it from clients that
+	// add it anyway
+	b, err := base64.RawURLEncoding.DecodeString(strings.TrimRight(b64[0], "="))
 	if err != nil {
 		http.Error(w, err.Error(), http.StatusBadRequest)
 		return
@@ -183,6 +222,49 @@ func (s *DoHListener) getHandler(w http.ResponseWriter, r *http.Request) {
 	s.parseAndRespond(b, w, r)
 }
 
+// Returns true if queries are accepted on the URL path.
+func (s *DoHListener) servesPath(path string) bool {
+	if len(s.paths) == 0 {
+		return true
+	}
+	if s.opt.EnableJSON && path == s.opt.JSONPath {
+		return true
+	}
+	_, ok := s.paths[path]
+	return ok
+}
+
+// Returns true if the request should be answered in JSON format.
+func (s *DoHListener) isJSONRequest(r *http.Request) bool {
+	if !s.opt.EnableJSON {
+		return false
+	}
+	return strings.Contains(r.Header.Get("Accept"), dohJSONContentType)
+}
+
+func (s *DoHListener) jsonHandler(w http.ResponseWriter, r *http.Request) {
+	s.metrics.query.Add(1)
+	q, err := dohJSONQuery(r.URL.Query())
+	if err != nil {
+		s.metrics.err.Add("query", 1)
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	a, ok := s.resolve(q, w, r)
+	if !ok {
+		return
+	}
+	out, err := json.Marshal(newDoHJSONResponse(a))
+	if err != nil {
+		s.metrics.err.Add("pack", 1)
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	w.Header().Set("content-type", dohJSONContentType)
+	w.Header().Set("cache-control", dohCacheControl(a))
+	_, _ = w.Write(out)
+}
+
 func (s *DoHListener) postHandler(w http.ResponseWriter, r *http.Request) {
 	b, err := ioutil.ReadAll(r.Body)
 	if err != nil {
@@ -233,22 +315,60 @@ func (s *DoHListener) parseAndRespond(b []byte, w http.ResponseWriter, r *http.R
 		http.Error(w, err.Error(), http.StatusBadRequest)
 		return
 	}
+	a, ok := s.resolve(q, w, r)
+	if !ok {
+		return
+	}
+
+	// Pad the packet according to rfc8467 and rfc7830
+	padAnswer(q, a)
+	out, err := a.Pack()
+	if err != nil {
+		s.metrics.err.Add("pack", 1)
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	w.Header().Set("content-type", "application/dns-message")
+	w.Header().Set("cache-control", dohCacheControl(a))
+	_, _ = w.Write(out)
+}
+
+// Returns the Cache-Control header for a response. As per RFC8484, HTTP
+// caches must not keep it longer than the lowest TTL of its records, which
+// includes the SOA of negative answers. Failures and responses without
+// records are not to be cached.
+func dohCacheControl(a *dns.Msg) string {
+	if a.Rcode != dns.RcodeSuccess && a.Rcode != dns.RcodeNameError {
+		return "no-store"
+	}
+	ttl, ok := minTTL(a)
+	if !ok {
+		return "no-store"
+	}
+	return fmt.Sprintf("max-age=%d", ttl)
+}
+
+// Resolve a query on behalf of the HTTP client. Returns false if an error
+// response was already written to the client.
+func (s *DoHListener) resolve(q *dns.Msg, w http.ResponseWriter, r *http.Request) (*dns.Msg, bool) {
 	// Extract the remote host address from the HTTP headers.
 	clientIP := s.extractClientAddress(r)
 	if clientIP == nil {
 		s.metrics.err.Add("remoteaddr", 1)
 		http.Error(w, "Invalid RemoteAddr", http.StatusBadRequest)
-		return
+		return nil, false
 	}
 	var tlsServerName string
 	if r.TLS != nil {
 		tlsServerName = r.TLS.ServerName
 	}
 	ci := ClientInfo{
-		SourceIP:      clientIP,
-		DoHPath:       r.URL.Path,
-		TLSServerName: tlsServerName,
-		Listener:      s.id,
+		SourceIP:       clientIP,
+		DoHPath:        r.URL.Path,
+		TLSServerName:  tlsServerName,
+		TLSClientNames: tlsClientNames(r.TLS),
+		Listener:       s.id,
+		Deadline:       s.opt.queryDeadline(),
 	}
 	log := Log.WithFields(logrus.Fields{
 		"id":       s.id,
@@ -263,7 +383,8 @@ func (s *DoHListener) parseAndRespond(b []byte, w http.ResponseWriter, r *http.R
 
 	var err error
 	a := new(dns.Msg)
-	if isAllowed(s.opt.AllowedNet, ci.SourceIP) {
+	switch s.opt.access(ci.SourceIP) {
+	case ACLAllow:
 		log.WithField("resolver", s.r.String()).Debug("forwarding query to resolver")
 		a, err = s.r.Resolve(q, ci)
 		if err != nil {
@@ -271,28 +392,21 @@ func (s *DoHListener) parseAndRespond(b []byte, w http.ResponseWriter, r *http.R
 			a = new(dns.Msg)
 			a.SetRcode(q, dns.RcodeServerFailure)
 		}
-	} else {
+	case ACLDrop:
+		log.Debug("dropping query from client ip")
+		a = nil
+	default:
 		log.Debug("refusing client ip")
 		a.SetRcode(q, dns.RcodeRefused)
+		addEDE(a, q, dns.ExtendedErrorCodeProhibited, "")
 	}
 
 	// A nil response from the resolvers means "drop", return blank response
 	if a == nil {
 		s.metrics.drop.Add(1)
 		w.WriteHeader(http.StatusForbidden)
-		return
+		return nil, false
 	}
-
-	// Pad the packet according to rfc8467 and rfc7830
-	padAnswer(q, a)
-
 	s.metrics.response.Add(rCode(a), 1)
-	out, err := a.Pack()
-	if err != nil {
-		s.metrics.err.Add("pack", 1)
-		http.Error(w, err.Error(), http.StatusInternalServerError)
-		return
-	}
-	w.Header().Set("content-type", "application/dns-message")
-	_, _ = w.Write(out)
+	return a, true
 }
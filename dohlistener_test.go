@@ -1,8 +1,11 @@
 package rdns
 
 import (
+	"encoding/base64"
+	"encoding/json"
 	"net"
 	"net/http"
+	"net/http/httptest"
 	"testing"
 	"time"
 
@@ -256,3 +259,163 @@ func TestIPv6Proxy(t *testing.T) {
 	client = s.extractClientAddress(r)
 	require.Equal(t, net.IPv4(10, 0, 1, 5), client)
 }
+
+func TestDoHListenerJSON(t *testing.T) {
+	upstream := &TestResolver{
+		ResolveFunc: func(q *dns.Msg, ci ClientInfo) (*dns.Msg, error) {
+			a := new(dns.Msg)
+			a.SetReply(q)
+			a.RecursionAvailable = true
+			a.AuthenticatedData = true
+			var rr string
+			switch q.Question[0].Qtype {
+			case dns.TypeA:
+				rr = "example.com. 300 IN A 192.0.2.1"
+			case dns.TypeAAAA:
+				rr = "example.com. 300 IN AAAA 2001:db8::1"
+			case dns.TypeMX:
+				rr = "example.com. 300 IN MX 10 mail.example.com."
+			case dns.TypeTXT:
+				rr = `example.com. 300 IN TXT "hello world"`
+			}
+			a.Answer = []dns.RR{mustRR(t, rr)}
+			return a, nil
+		},
+	}
+	s, err := NewDoHListener("test-doh-json", "", DoHListenerOptions{EnableJSON: true}, upstream)
+	require.NoError(t, err)
+
+	query := func(target string, header http.Header) (*httptest.ResponseRecorder, dohJSONResponse) {
+		req := httptest.NewRequest("GET", target, nil)
+		for k, v := range header {
+			req.Header[k] = v
+		}
+		w := httptest.NewRecorder()
+		s.handler.ServeHTTP(w, req)
+		var resp dohJSONResponse
+		if w.Header().Get("content-type") == dohJSONContentType {
+			require.NoError(t, json.Unmarshal(w.Body.Bytes(), &resp))
+		}
+		return w, resp
+	}
+
+	tests := []struct {
+		target string
+		qtype  uint16
+		data   string
+	}{
+		{"/resolve?name=example.com", dns.TypeA, "192.0.2.1"},
+		{"/resolve?name=example.com&type=AAAA", dns.TypeAAAA, "2001:db8::1"},
+		{"/resolve?name=example.com&type=mx", dns.TypeMX, "10 mail.example.com."},
+		{"/resolve?name=example.com&type=16", dns.TypeTXT, `"hello world"`},
+	}
+	accept := http.Header{"Accept": {dohJSONContentType}}
+	for _, test := range tests {
+		w, resp := query(test.target, accept)
+		require.Equal(t, http.StatusOK, w.Code, test.target)
+		require.Equal(t, dohJSONContentType, w.Header().Get("content-type"))
+		require.Equal(t, dns.RcodeSuccess, resp.Status)
+		require.True(t, resp.RD)
+		require.True(t, resp.RA)
+		require.True(t, resp.AD)
+		require.False(t, resp.CD)
+		require.Equal(t, []dohJSONQuestion{{Name: "example.com.", Type: test.qtype}}, resp.Question)
+		require.Equal(t, []dohJSONRR{{Name: "example.com.", Type: test.qtype, TTL: 300, Data: test.data}}, resp.Answer)
+	}
+
+	// Checking disabled flag is passed on
+	_, resp := query("/resolve?name=example.com&cd=1", accept)
+	require.True(t, resp.CD)
+
+	// JSON is selected by the Accept header on other paths
+	w, resp := query("/dns-query?name=example.com", accept)
+	require.Equal(t, http.StatusOK, w.Code)
+	require.Len(t, resp.Answer, 1)
+
+	// Without it, requests on the JSON path are wire-format queries
+	w, _ = query("/resolve?name=example.com", nil)
+	require.Equal(t, http.StatusBadRequest, w.Code)
+	require.NotEqual(t, dohJSONContentType, w.Header().Get("content-type"))
+
+	// Invalid requests
+	w, _ = query("/resolve?type=A", accept)
+	require.Equal(t, http.StatusBadRequest, w.Code)
+	w, _ = query("/resolve?name=example.com&type=invalid", accept)
+	require.Equal(t, http.StatusBadRequest, w.Code)
+
+	// Wire-format requests are still supported
+	q := new(dns.Msg)
+	q.SetQuestion("example.com.", dns.TypeA)
+	b, err := q.Pack()
+	require.NoError(t, err)
+	w, _ = query("/dns-query?dns="+base64.RawURLEncoding.EncodeToString(b), nil)
+	require.Equal(t, http.StatusOK, w.Code)
+	require.Equal(t, "application/dns-message", w.Header().Get("content-type"))
+}
+
+func TestDoHListenerPathsAndCaching(t *testing.T) {
+	upstream := &TestResolver{
+		ResolveFunc: func(q *dns.Msg, ci ClientInfo) (*dns.Msg, error) {
+			a := new(dns.Msg)
+			a.SetReply(q)
+			switch q.Question[0].Name {
+			case "example.com.":
+				a.Answer = []dns.RR{
+					mustRR(t, "example.com. 300 IN A 192.0.2.1"),
+					mustRR(t, "example.com. 120 IN A 192.0.2.2"),
+				}
+			case "missing.example.com.":
+				a.Rcode = dns.RcodeNameError
+				a.Ns = []dns.RR{mustRR(t, "example.com. 60 IN SOA ns.example.com. admin.example.com. 1 3600 600 86400 60")}
+			default:
+				a.Rcode = dns.RcodeServerFailure
+			}
+			return a, nil
+		},
+	}
+	s, err := NewDoHListener("test-doh-paths", "", DoHListenerOptions{
+		Paths:      []string{"/dns-query", "/kids"},
+		EnableJSON: true,
+	}, upstream)
+	require.NoError(t, err)
+
+	get := func(path, name string) *httptest.ResponseRecorder {
+		q := new(dns.Msg)
+		q.SetQuestion(name, dns.TypeA)
+		b, err := q.Pack()
+		require.NoError(t, err)
+		req := httptest.NewRequest("GET", path+"?dns="+base64.RawURLEncoding.EncodeToString(b), nil)
+		w := httptest.NewRecorder()
+		s.handler.ServeHTTP(w, req)
+		return w
+	}
+
+	// Configured paths are served, the max-age is the lowest TTL
+	w := get("/dns-query", "example.com.")
+	require.Equal(t, http.StatusOK, w.Code)
+	require.Equal(t, "max-age=120", w.Header().Get("cache-control"))
+	w = get("/kids", "example.com.")
+	require.Equal(t, http.StatusOK, w.Code)
+
+	// Negative answers are cached for the TTL of the SOA, failures not at all
+	w = get("/dns-query", "missing.example.com.")
+	require.Equal(t, "max-age=60", w.Header().Get("cache-control"))
+	w = get("/dns-query", "fail.example.com.")
+	require.Equal(t, "no-store", w.Header().Get("cache-control"))
+
+	// Other paths aren't
+	w = get("/other", "example.com.")
+	require.Equal(t, http.StatusNotFound, w.Code)
+
+	// The JSON path is served even if not in the list
+	req := httptest.NewRequest("GET", "/resolve?name=example.com", nil)
+	req.Header.Set("Accept", dohJSONContentType)
+	w = httptest.NewRecorder()
+	s.handler.ServeHTTP(w, req)
+	require.Equal(t, http.StatusOK, w.Code)
+	require.Equal(t, "max-age=120", w.Header().Get("cache-control"))
+
+	// Paths have to be absolute
+	_, err = NewDoHListener("test-doh-paths", "", DoHListenerOptions{Paths: []string{"dns-query"}}, upstream)
+	require.Error(t, err)
+}
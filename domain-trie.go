@@ -0,0 +1,237 @@
+package rdns
+
+import (
+	"cmp"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"hash/maphash"
+	"slices"
+	"strings"
+)
+
+// domainTrie holds a set of domain rules in a trie of labels, stored right to
+// left (com -> example -> www). The trie is kept in a flat byte arena with
+// offsets instead of pointers so that large lists with millions of entries
+// don't add to GC pressure, and every distinct label is stored only once.
+// It's built in one go from a sorted list of rules and can't be modified.
+type domainTrie struct {
+	arena []byte
+}
+
+// Rule flags
+const (
+	trieExact      = 1 << 0 // the name itself is on the list
+	trieSubdomains = 1 << 1 // all subdomains of the name are on the list
+)
+
+// Layout of a node in the arena:
+//
+//	count     uint32, number of children
+//	children  count x (label offset uint32, node offset uint32), sorted by label
+//
+// The flags of a child are kept in the top bits of its label offset. The node
+// offset is 0 for children without children of their own, so names that are
+// only on the list by themselves don't need a node. Labels are stored as one
+// byte length followed by the label. The root node is at offset 0.
+const (
+	trieNodeHeader = 4
+	trieChildEntry = 8
+	trieFlagsShift = 30
+	trieOffsetMask = 1<<trieFlagsShift - 1
+)
+
+// Rule in a domain trie while it's being built.
+type domainTrieRule struct {
+	name       string // without leading "." or "*."
+	start, end int32  // next label to be added, the rightmost one not yet in the trie
+	flags      byte
+}
+
+// Turns a rule in domain format into a name and flags. Rules with a leading "*."
+// match subdomains only, those with a leading "." the name and its subdomains.
+// If subdomains is true, all other rules are treated as if they started with ".".
+func parseDomainTrieRule(r string, subdomains bool) (domainTrieRule, error) {
+	var flags byte
+	switch {
+	case strings.HasPrefix(r, "*."):
+		r = r[2:]
+		flags = trieSubdomains
+	case strings.HasPrefix(r, "."):
+		r = r[1:]
+		flags = trieExact | trieSubdomains
+	case subdomains:
+		flags = trieExact | trieSubdomains
+	default:
+		flags = trieExact
+	}
+	for end := len(r); end > 0; {
+		start := strings.LastIndexByte(r[:end], '.') + 1
+		label := r[start:end]
+		if label == "" || len(label) > 63 || strings.Contains(label, "*") {
+			return domainTrieRule{}, fmt.Errorf("invalid blocklist item: '%s'", r)
+		}
+		end = start - 1
+	}
+	return domainTrieRule{
+		name:  r,
+		start: int32(strings.LastIndexByte(r, '.') + 1),
+		end:   int32(len(r)),
+		flags: flags,
+	}, nil
+}
+
+// newDomainTrie builds a trie from a list of rules. The list is modified in
+// the process. Rules with an empty name are ignored.
+func newDomainTrie(rules []domainTrieRule) (*domainTrie, error) {
+	rules = slices.DeleteFunc(rules, func(r domainTrieRule) bool { return r.name == "" })
+	b := &domainTrieBuilder{
+		labels: make(map[uint64]uint32),
+		seed:   maphash.MakeSeed(),
+	}
+	b.node(rules)
+	if len(b.arena) > trieOffsetMask {
+		return nil, errors.New("blocklist too large")
+	}
+	// Growing the arena while building it leaves up to half of it unused
+	return &domainTrie{arena: slices.Clone(b.arena)}, nil
+}
+
+// lookup returns the most general rule that matches the name, as the part of the
+// name it matched and the flags of the rule.
+func (t *domainTrie) lookup(name string) (string, byte, bool) {
+	node := 0
+	for end := len(name); end > 0; {
+		start := strings.LastIndexByte(name[:end], '.') + 1
+		flags, next, ok := t.child(node, name[start:end])
+		if !ok {
+			return "", 0, false
+		}
+		if start > 0 && flags&trieSubdomains != 0 {
+			return name[start:], flags, true
+		}
+		if start == 0 && flags&trieExact != 0 {
+			return name, flags, true
+		}
+		if next == 0 {
+			return "", 0, false
+		}
+		node = next
+		end = start - 1
+	}
+	return "", 0, false
+}
+
+// Binary search for the child of a node with the given label. Returns the
+// flags of the child and the offset of its node.
+func (t *domainTrie) child(node int, label string) (byte, int, bool) {
+	count := int(binary.LittleEndian.Uint32(t.arena[node:]))
+	table := node + trieNodeHeader
+	lo, hi := 0, count
+	for lo < hi {
+		mid := int(uint(lo+hi) >> 1)
+		entry := table + mid*trieChildEntry
+		v := binary.LittleEndian.Uint32(t.arena[entry:])
+		l := arenaLabel(t.arena, int(v&trieOffsetMask))
+		switch {
+		case string(l) == label:
+			return byte(v >> trieFlagsShift), int(binary.LittleEndian.Uint32(t.arena[entry+4:])), true
+		case string(l) < label:
+			lo = mid + 1
+		default:
+			hi = mid
+		}
+	}
+	return 0, 0, false
+}
+
+func arenaLabel(arena []byte, offset int) []byte {
+	n := int(arena[offset])
+	return arena[offset+1 : offset+1+n]
+}
+
+type domainTrieBuilder struct {
+	arena []byte
+
+	// Offsets of the labels already in the arena, by hash of the label
+	labels map[uint64]uint32
+	seed   maphash.Seed
+}
+
+// Writes a node with the given rules below it into the arena. All rules share
+// the labels that were already added. Returns the offset of the node.
+func (b *domainTrieBuilder) node(rules []domainTrieRule) int {
+	// Sort by the next label, rules that end with it first
+	slices.SortFunc(rules, func(a, b domainTrieRule) int {
+		if c := strings.Compare(a.label(), b.label()); c != 0 {
+			return c
+		}
+		return cmp.Compare(a.start, b.start)
+	})
+	count := 0
+	for i := 0; i < len(rules); {
+		i += len(nextLabelGroup(rules[i:]))
+		count++
+	}
+	offset := len(b.arena)
+	b.arena = binary.LittleEndian.AppendUint32(b.arena, uint32(count))
+	table := len(b.arena)
+	b.arena = append(b.arena, make([]byte, count*trieChildEntry)...)
+	for i := 0; i < count; i++ {
+		group := nextLabelGroup(rules)
+		rules = rules[len(group):]
+		label := group[0].label()
+
+		// Rules that end with this label decide the flags of the child, the
+		// others are added below it.
+		var flags byte
+		for len(group) > 0 && group[0].start == 0 {
+			flags |= group[0].flags
+			group = group[1:]
+		}
+		var child int
+		if len(group) > 0 {
+			for j := range group {
+				r := &group[j]
+				r.end = r.start - 1
+				r.start = int32(strings.LastIndexByte(r.name[:r.end], '.') + 1)
+			}
+			child = b.node(group)
+		}
+		labelOffset := b.label(label)
+		entry := table + i*trieChildEntry
+		binary.LittleEndian.PutUint32(b.arena[entry:], labelOffset|uint32(flags)<<trieFlagsShift)
+		binary.LittleEndian.PutUint32(b.arena[entry+4:], uint32(child))
+	}
+	return offset
+}
+
+// Returns the offset of a label in the arena, adding it if it's not there yet.
+// Labels are looked up by hash to keep the map small, a label with the same
+// hash as a different one is added again.
+func (b *domainTrieBuilder) label(label string) uint32 {
+	h := maphash.String(b.seed, label)
+	if offset, ok := b.labels[h]; ok && string(arenaLabel(b.arena, int(offset))) == label {
+		return offset
+	}
+	offset := uint32(len(b.arena))
+	b.arena = append(b.arena, byte(len(label)))
+	b.arena = append(b.arena, label...)
+	b.labels[h] = offset
+	return offset
+}
+
+// Returns the next label of a rule to be added.
+func (r domainTrieRule) label() string {
+	return r.name[r.start:r.end]
+}
+
+// Returns the rules at the start of the list that have the same next label.
+func nextLabelGroup(rules []domainTrieRule) []domainTrieRule {
+	label := rules[0].label()
+	n := 1
+	for n < len(rules) && rules[n].label() == label {
+		n++
+	}
+	return rules[:n]
+}
@@ -0,0 +1,116 @@
+package rdns
+
+import (
+	"bytes"
+	"fmt"
+	"testing"
+
+	"github.com/stretchr/testify/require"
+)
+
+func TestDomainTrie(t *testing.T) {
+	var rules []domainTrieRule
+	for _, r := range []string{
+		"example.com",
+		"www.example.com",
+		"*.ads.example.com",
+		".tracker.net",
+		"www.tracker.net",
+		"www.other.org",
+		"",
+	} {
+		rule, err := parseDomainTrieRule(r, false)
+		require.NoError(t, err)
+		rules = append(rules, rule)
+	}
+	trie, err := newDomainTrie(rules)
+	require.NoError(t, err)
+
+	tests := []struct {
+		name   string
+		domain string
+		flags  byte
+		match  bool
+	}{
+		// Exact rules aren't hidden by longer ones
+		{"example.com", "example.com", trieExact, true},
+		{"www.example.com", "www.example.com", trieExact, true},
+		{"sub.www.example.com", "", 0, false},
+
+		{"ads.example.com", "", 0, false},
+		{"x.ads.example.com", "ads.example.com", trieSubdomains, true},
+
+		// The most general rule wins
+		{"tracker.net", "tracker.net", trieExact | trieSubdomains, true},
+		{"www.tracker.net", "tracker.net", trieExact | trieSubdomains, true},
+
+		{"other.org", "", 0, false},
+		{"www.other.org", "www.other.org", trieExact, true},
+		{"com", "", 0, false},
+		{"", "", 0, false},
+	}
+	for _, test := range tests {
+		domain, flags, ok := trie.lookup(test.name)
+		require.Equal(t, test.match, ok, test.name)
+		require.Equal(t, test.domain, domain, test.name)
+		require.Equal(t, test.flags, flags, test.name)
+	}
+
+	// Labels are only stored once
+	require.Equal(t, 1, bytes.Count(trie.arena, []byte("\x03www")))
+}
+
+func TestDomainTrieEmpty(t *testing.T) {
+	trie, err := newDomainTrie(nil)
+	require.NoError(t, err)
+	_, _, ok := trie.lookup("example.com")
+	require.False(t, ok)
+}
+
+// Domain lists should take up no more than 32MB per million rules. The rules
+// are similar to those in public lists, where most names are unique and
+// subdomains use a few common labels.
+func TestDomainTrieSize(t *testing.T) {
+	rules := realisticDomainRules(100000)
+	parsed := make([]domainTrieRule, 0, len(rules))
+	for _, r := range rules {
+		rule, err := parseDomainTrieRule(r, false)
+		require.NoError(t, err)
+		parsed = append(parsed, rule)
+	}
+	trie, err := newDomainTrie(parsed)
+	require.NoError(t, err)
+	require.LessOrEqual(t, len(trie.arena)/len(rules), 32)
+}
+
+// Rules for a list of trackers, half of them with subdomains.
+func realisticDomainRules(n int) []string {
+	tlds := []string{"com", "net", "org", "io", "de", "co.uk", "info", "xyz"}
+	subdomains := []string{"www", "ads", "cdn", "api", "track", "m", "static", "pixel"}
+	rules := make([]string, 0, n)
+	for i := 0; i < n; i++ {
+		domain := fmt.Sprintf("tracker-%x.%s", uint64(i/2)*2654435761%1000000007, tlds[i%len(tlds)])
+		if i%2 == 1 {
+			domain = subdomains[i%len(subdomains)] + "." + domain
+		}
+		rules = append(rules, domain)
+	}
+	return rules
+}
+
+func BenchmarkDomainTrieBuild(b *testing.B) {
+	rules := realisticDomainRules(1000000)
+	parsed := make([]domainTrieRule, len(rules))
+	b.ReportAllocs()
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		parsed = parsed[:0]
+		for _, r := range rules {
+			rule, _ := parseDomainTrieRule(r, false)
+			parsed = append(parsed, rule)
+		}
+		trie, err := newDomainTrie(parsed)
+		require.NoError(b, err)
+		b.ReportMetric(float64(len(trie.arena))/(1<<20), "MB/1M-rules")
+	}
+}
@@ -4,6 +4,7 @@ import (
 	"context"
 	"crypto/tls"
 	"encoding/binary"
+	"expvar"
 	"io"
 	"net"
 	"time"
@@ -26,6 +27,13 @@ type DoQClient struct {
 	requests chan *request
 	log      *logrus.Entry
 	metrics  *ListenerMetrics
+	latency  *varHistogram
+
+	// Connections opened, connections that resumed a TLS session and those
+	// where the server accepted 0-RTT data
+	connections *expvar.Int
+	resumed     *expvar.Int
+	early       *expvar.Int
 
 	connection quicConnection
 }
@@ -43,7 +51,9 @@ type DoQClientOptions struct {
 
 	QueryTimeout time.Duration
 
-	Use0RTT       bool
+	// Send queries in 0-RTT data when resuming a TLS session. Sessions are
+	// resumed regardless, this only saves the round trip before the first query.
+	Use0RTT bool
 }
 
 var _ Resolver = &DoQClient{}
@@ -80,7 +90,7 @@ func NewDoQClient(id, endpoint string, opt DoQClientOptions) (*DoQClient, error)
 	tlsConfig.ServerName = host
 
 	// enable TLS session caching for session resumption and 0-RTT
-	if opt.Use0RTT {
+	if tlsConfig.ClientSessionCache == nil {
 		tlsConfig.ClientSessionCache = tls.NewLRUClientSessionCache(100)
 	}
 
@@ -99,11 +109,15 @@ func NewDoQClient(id, endpoint string, opt DoQClientOptions) (*DoQClient, error)
 			lAddr:     lAddr,
 			tlsConfig: tlsConfig,
 			config: &quic.Config{
-				TokenStore: quic.NewLRUTokenStore(10, 10),
+				TokenStore:           quic.NewLRUTokenStore(10, 10),
 				HandshakeIdleTimeout: opt.QueryTimeout,
 			},
 		},
-		metrics: NewListenerMetrics("client", id),
+		metrics:     NewListenerMetrics("client", id),
+		latency:     getVarHistogram("client", id, "latency"),
+		connections: getVarInt("client", id, "session"),
+		resumed:     getVarInt("client", id, "resumed"),
+		early:       getVarInt("client", id, "early"),
 	}, nil
 }
 
@@ -115,6 +129,7 @@ func (d *DoQClient) Resolve(q *dns.Msg, ci ClientInfo) (*dns.Msg, error) {
 	}).Debug("querying upstream resolver")
 
 	d.metrics.query.Add(1)
+	start := time.Now()
 
 	// When sending queries over a DoQ, the DNS Message ID MUST be set to zero.
 	// Make a deep copy because if there are multiple upstreams second
@@ -136,7 +151,12 @@ func (d *DoQClient) Resolve(q *dns.Msg, ci ClientInfo) (*dns.Msg, error) {
 		edns0.Option = newOpt
 	}
 
-	deadlineTime := time.Now().Add(d.DoQClientOptions.QueryTimeout)
+	timeout := queryTimeout(d.DoQClientOptions.QueryTimeout, ci.Deadline)
+	if timeout <= 0 {
+		d.metrics.err.Add("deadline", 1)
+		return nil, QueryTimeoutError{q}
+	}
+	deadlineTime := time.Now().Add(timeout)
 
 	// Encode the query
 	p, err := qc.Pack()
@@ -151,7 +171,7 @@ func (d *DoQClient) Resolve(q *dns.Msg, ci ClientInfo) (*dns.Msg, error) {
 	copy(b[2:], p)
 
 	// Get a new stream in the connection
-	stream, err := d.connection.getStream(d.endpoint, d.log)
+	stream, err := d.getStream()
 	if err != nil {
 		d.metrics.err.Add("getstream", 1)
 		return nil, err
@@ -201,6 +221,7 @@ func (d *DoQClient) Resolve(q *dns.Msg, ci ClientInfo) (*dns.Msg, error) {
 		}
 	}
 	d.metrics.response.Add(rCode(a), 1)
+	d.latency.observe(time.Since(start))
 
 	return a, err
 }
@@ -209,25 +230,30 @@ func (d *DoQClient) String() string {
 	return d.id
 }
 
-func (s *quicConnection) getStream(endpoint string, log *logrus.Entry) (quic.Stream, error) {
+// Returns a new stream, opening a new connection if there is none or the
+// current one failed.
+func (d *DoQClient) getStream() (quic.Stream, error) {
+	s := &d.connection
 	s.mu.Lock()
 	defer s.mu.Unlock()
+	log := d.log
 
 	// If we don't have a connection yet, make one
 	if s.EarlyConnection == nil {
 		var err error
-		s.EarlyConnection, s.udpConn, err = quicDial(context.TODO(), s.hostname, endpoint, s.lAddr, s.tlsConfig, s.config)
+		s.EarlyConnection, s.udpConn, err = quicDial(context.TODO(), s.hostname, d.endpoint, s.lAddr, s.tlsConfig, s.config)
 		if err != nil {
 			log.WithFields(logrus.Fields{
 				"hostname": s.hostname,
 			}).WithError(err).Error("failed to open connection")
 			return nil, err
 		}
-		s.rAddr = endpoint
+		s.rAddr = d.endpoint
+		d.countConnection(s.EarlyConnection)
 	}
 
 	// If we can't get a stream then restart the connection and try again once
-	stream, err := s.EarlyConnection.OpenStream()
+	stream, err := d.openStream()
 	if err != nil {
 		log.WithError(err).Debug("temporary fail when trying to open stream, attempting new connection")
 		if err = quicRestart(s); err != nil {
@@ -236,10 +262,46 @@ func (s *quicConnection) getStream(endpoint string, log *logrus.Entry) (quic.Str
 			}).WithError(err).Error("failed to open connection")
 			return nil, err
 		}
-		stream, err = s.EarlyConnection.OpenStream()
+		d.countConnection(s.EarlyConnection)
+		stream, err = d.openStream()
 		if err != nil {
 			log.WithError(err).Error("failed to open stream")
 		}
 	}
 	return stream, err
 }
+
+// Opens a stream in the current connection. Unless 0-RTT is enabled, this
+// waits for the handshake so the query isn't sent in 0-RTT data. Must be
+// called with the connection locked.
+func (d *DoQClient) openStream() (quic.Stream, error) {
+	conn := d.connection.EarlyConnection
+	if !d.Use0RTT {
+		select {
+		case <-conn.HandshakeComplete():
+		case <-conn.Context().Done():
+			return nil, context.Cause(conn.Context())
+		}
+	}
+	return conn.OpenStream()
+}
+
+// Counts a new connection, and once the handshake is done, whether the
+// session was resumed and the server accepted 0-RTT data.
+func (d *DoQClient) countConnection(conn quic.EarlyConnection) {
+	d.connections.Add(1)
+	go func() {
+		select {
+		case <-conn.HandshakeComplete():
+		case <-conn.Context().Done():
+			return
+		}
+		state := conn.ConnectionState()
+		if state.TLS.DidResume {
+			d.resumed.Add(1)
+		}
+		if state.Used0RTT {
+			d.early.Add(1)
+		}
+	}()
+}
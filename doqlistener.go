@@ -4,9 +4,11 @@ import (
 	"context"
 	"crypto/tls"
 	"encoding/binary"
+	"errors"
 	"expvar"
 	"io"
 	"net"
+	"sync"
 	"time"
 
 	"github.com/miekg/dns"
@@ -20,9 +22,12 @@ type DoQListener struct {
 	addr    string
 	r       Resolver
 	opt     DoQListenerOptions
-	ln      *quic.Listener
 	log     *logrus.Entry
 	metrics *DoQListenerMetrics
+
+	mu     sync.Mutex
+	ln     io.Closer
+	accept func(context.Context) (quic.Connection, error)
 }
 
 var _ Listener = &DoQListener{}
@@ -32,8 +37,22 @@ type DoQListenerOptions struct {
 	ListenOptions
 
 	TLSConfig *tls.Config
+
+	// Accept queries in 0-RTT data from clients resuming a TLS session. Saves
+	// a round trip when clients reconnect, but 0-RTT data can be replayed.
+	Allow0RTT bool
+
+	// Max number of concurrent streams, and with that queries, per connection.
+	// Default 100.
+	MaxStreams int64
+
+	// Time a connection is kept open without new queries. Default 2s.
+	IdleTimeout time.Duration
 }
 
+// Default time a DoQ connection without new queries is kept open.
+const defaultDoQIdleTimeout = 2 * time.Second
+
 type DoQListenerMetrics struct {
 	ListenerMetrics
 
@@ -41,6 +60,12 @@ type DoQListenerMetrics struct {
 	connection *expvar.Int
 	// Count of streams seen in all connections.
 	stream *expvar.Int
+	// Currently open connections.
+	open *expvar.Int
+	// Connections that resumed a TLS session.
+	resumed *expvar.Int
+	// Connections that sent queries in 0-RTT data.
+	early *expvar.Int
 }
 
 func NewDoQListenerMetrics(id string) *DoQListenerMetrics {
@@ -53,6 +78,9 @@ func NewDoQListenerMetrics(id string) *DoQListenerMetrics {
 		},
 		connection: getVarInt("listener", id, "session"),
 		stream:     getVarInt("listener", id, "stream"),
+		open:       getVarInt("listener", id, "connections"),
+		resumed:    getVarInt("listener", id, "resumed"),
+		early:      getVarInt("listener", id, "early"),
 	}
 }
 
@@ -62,6 +90,9 @@ func NewQUICListener(id, addr string, opt DoQListenerOptions, resolver Resolver)
 		opt.TLSConfig = new(tls.Config)
 	}
 	opt.TLSConfig.NextProtos = []string{"doq"}
+	if opt.IdleTimeout == 0 {
+		opt.IdleTimeout = defaultDoQIdleTimeout
+	}
 	l := &DoQListener{
 		id:      id,
 		addr:    addr,
@@ -74,16 +105,42 @@ func NewQUICListener(id, addr string, opt DoQListenerOptions, resolver Resolver)
 }
 
 // Start the QUIC server.
-func (s DoQListener) Start() error {
-	var err error
-	s.ln, err = quic.ListenAddr(s.addr, s.opt.TLSConfig, &quic.Config{})
-	if err != nil {
-		return err
+func (s *DoQListener) Start() error {
+	config := &quic.Config{
+		Allow0RTT:          s.opt.Allow0RTT,
+		MaxIncomingStreams: s.opt.MaxStreams,
+	}
+	// Don't let QUIC close connections before they're idle for long enough
+	if s.opt.IdleTimeout > 30*time.Second {
+		config.MaxIdleTimeout = s.opt.IdleTimeout
+	}
+	s.mu.Lock()
+	if s.opt.Allow0RTT {
+		ln, err := quic.ListenAddrEarly(s.addr, s.opt.TLSConfig, config)
+		if err != nil {
+			s.mu.Unlock()
+			return err
+		}
+		s.ln = ln
+		s.accept = func(ctx context.Context) (quic.Connection, error) { return ln.Accept(ctx) }
+	} else {
+		ln, err := quic.ListenAddr(s.addr, s.opt.TLSConfig, config)
+		if err != nil {
+			s.mu.Unlock()
+			return err
+		}
+		s.ln = ln
+		s.accept = ln.Accept
 	}
+	accept := s.accept
+	s.mu.Unlock()
 	s.log.Info("starting listener")
 
 	for {
-		connection, err := s.ln.Accept(context.Background())
+		connection, err := accept(context.Background())
+		if errors.Is(err, quic.ErrServerClosed) {
+			return nil
+		}
 		if err != nil {
 			s.log.WithError(err).Warn("failed to accept")
 			continue
@@ -99,17 +156,39 @@ func (s DoQListener) Start() error {
 }
 
 // Stop the server.
-func (s DoQListener) Stop() error {
+func (s *DoQListener) Stop() error {
 	Log.WithFields(logrus.Fields{"protocol": "quic", "addr": s.addr}).Info("stopping listener")
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if s.ln == nil {
+		return nil
+	}
 	return s.ln.Close()
 }
 
-func (s DoQListener) handleConnection(connection quic.Connection) {
-	tlsServerName := connection.ConnectionState().TLS.ServerName
+func (s *DoQListener) handleConnection(connection quic.Connection) {
+	s.metrics.open.Add(1)
+	defer s.metrics.open.Add(-1)
+
+	// Connections with 0-RTT data are accepted before the handshake is done.
+	// Client certificates are only known after it.
+	early, ok := connection.(quic.EarlyConnection)
+	if ok && s.opt.Allow0RTT && s.opt.TLSConfig.ClientAuth != tls.NoClientCert {
+		select {
+		case <-early.HandshakeComplete():
+		case <-connection.Context().Done():
+			return
+		}
+	}
+	if ok {
+		go s.countHandshake(early)
+	}
+	tlsState := connection.ConnectionState().TLS
 
 	ci := ClientInfo{
-		Listener:      s.id,
-		TLSServerName: tlsServerName,
+		Listener:       s.id,
+		TLSServerName:  tlsState.ServerName,
+		TLSClientNames: tlsClientNames(&tlsState),
 	}
 	switch addr := connection.RemoteAddr().(type) {
 	case *net.TCPAddr:
@@ -119,7 +198,7 @@ func (s DoQListener) handleConnection(connection quic.Connection) {
 	}
 	log := s.log.WithField("client", connection.RemoteAddr())
 
-	if !isAllowed(s.opt.AllowedNet, ci.SourceIP) {
+	if s.opt.access(ci.SourceIP) != ACLAllow {
 		log.Debug("rejecting incoming connection")
 		s.metrics.drop.Add(1)
 		return
@@ -128,7 +207,7 @@ func (s DoQListener) handleConnection(connection quic.Connection) {
 	s.metrics.connection.Add(1)
 
 	for {
-		ctx, cancel := context.WithTimeout(context.Background(), 2*time.Second) // TODO: configurable
+		ctx, cancel := context.WithTimeout(context.Background(), s.opt.IdleTimeout)
 		stream, err := connection.AcceptStream(ctx)
 		if err != nil {
 			cancel()
@@ -143,7 +222,23 @@ func (s DoQListener) handleConnection(connection quic.Connection) {
 	}
 }
 
-func (s DoQListener) handleStream(stream quic.Stream, log *logrus.Entry, ci ClientInfo) {
+// Count resumed sessions and 0-RTT connections once the handshake is done.
+func (s *DoQListener) countHandshake(connection quic.EarlyConnection) {
+	select {
+	case <-connection.HandshakeComplete():
+	case <-connection.Context().Done():
+		return
+	}
+	state := connection.ConnectionState()
+	if state.TLS.DidResume {
+		s.metrics.resumed.Add(1)
+	}
+	if state.Used0RTT {
+		s.metrics.early.Add(1)
+	}
+}
+
+func (s *DoQListener) handleStream(stream quic.Stream, log *logrus.Entry, ci ClientInfo) {
 	// DNS over QUIC uses one stream per query/response.
 	defer stream.Close()
 	s.metrics.stream.Add(1)
@@ -175,6 +270,7 @@ func (s DoQListener) handleStream(stream quic.Stream, log *logrus.Entry, ci Clie
 	log = log.WithField("qname", qName(q))
 	log.Debug("received query")
 	s.metrics.query.Add(1)
+	ci.Deadline = s.opt.queryDeadline()
 
 	// Receiving a edns-tcp-keepalive EDNS(0) option is a fatal error according to the RFC
 	edns0 := q.IsEdns0()
@@ -217,6 +313,6 @@ func (s DoQListener) handleStream(stream quic.Stream, log *logrus.Entry, ci Clie
 	s.metrics.response.Add(rCode(a), 1)
 }
 
-func (s DoQListener) String() string {
+func (s *DoQListener) String() string {
 	return s.id
 }
@@ -0,0 +1,51 @@
+package rdns
+
+import (
+	"testing"
+	"time"
+
+	"github.com/miekg/dns"
+	"github.com/stretchr/testify/require"
+)
+
+func TestDoQListenerResumption(t *testing.T) {
+	upstream := new(TestResolver)
+
+	addr, err := getUDPLnAddress()
+	require.NoError(t, err)
+
+	tlsServerConfig, err := TLSServerConfig("", "testdata/server.crt", "testdata/server.key", false)
+	require.NoError(t, err)
+	s := NewQUICListener("test-doq-ln-resume", addr, DoQListenerOptions{
+		TLSConfig:   tlsServerConfig,
+		Allow0RTT:   true,
+		MaxStreams:  10,
+		IdleTimeout: time.Minute,
+	}, upstream)
+	go s.Start()
+	defer s.Stop()
+	time.Sleep(time.Second)
+
+	tlsClientConfig, err := TLSClientConfig("testdata/ca.crt", "", "", "")
+	require.NoError(t, err)
+	c, err := NewDoQClient("test-doq-resume", addr, DoQClientOptions{TLSConfig: tlsClientConfig, Use0RTT: true})
+	require.NoError(t, err)
+
+	q := new(dns.Msg)
+	q.SetQuestion("example.com.", dns.TypeA)
+	_, err = c.Resolve(q, ClientInfo{})
+	require.NoError(t, err)
+	require.Equal(t, int64(1), s.metrics.query.Value())
+	require.Eventually(t, func() bool { return s.metrics.open.Value() == 1 }, time.Second, 10*time.Millisecond)
+
+	// Close the connection, the next query resumes the TLS session with 0-RTT
+	time.Sleep(100 * time.Millisecond) // Let the session ticket arrive
+	require.NoError(t, c.connection.CloseWithError(DOQNoError, ""))
+	_, err = c.Resolve(q, ClientInfo{})
+	require.NoError(t, err)
+	require.Equal(t, int64(2), s.metrics.query.Value())
+
+	require.Equal(t, int64(2), c.connections.Value())
+	require.Eventually(t, func() bool { return c.resumed.Value() == 1 && c.early.Value() == 1 }, time.Second, 10*time.Millisecond)
+	require.Eventually(t, func() bool { return s.metrics.resumed.Value() == 1 && s.metrics.early.Value() == 1 }, 3*time.Second, 10*time.Millisecond)
+}
@@ -33,6 +33,11 @@ type DoTClientOptions struct {
 
 	// Optional dialer, e.g. proxy
 	Dialer Dialer
+
+	// Connection pool settings, see PipelineOptions.
+	Connections int
+	IdleTimeout time.Duration
+	MaxInFlight int
 }
 
 var _ Resolver = &DoTClient{}
@@ -64,7 +69,12 @@ func NewDoTClient(id, endpoint string, opt DoTClientOptions) (*DoTClient, error)
 	return &DoTClient{
 		id:       id,
 		endpoint: endpoint,
-		pipeline: NewPipeline(id, endpoint, client, opt.QueryTimeout),
+		pipeline: NewPipelineWithOptions(id, endpoint, client, PipelineOptions{
+			QueryTimeout: opt.QueryTimeout,
+			Connections:  opt.Connections,
+			IdleTimeout:  opt.IdleTimeout,
+			MaxInFlight:  opt.MaxInFlight,
+		}),
 	}, nil
 }
 
@@ -80,7 +90,7 @@ func (d *DoTClient) Resolve(q *dns.Msg, ci ClientInfo) (*dns.Msg, error) {
 
 	// Add padding to the query before sending over TLS
 	padQuery(q)
-	return d.pipeline.Resolve(q)
+	return d.pipeline.resolve(q, ci.Deadline, ci.Done)
 }
 
 func (d *DoTClient) String() string {
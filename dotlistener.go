@@ -10,7 +10,9 @@ import (
 // DoTListener is a DNS listener/server for DNS-over-TLS.
 type DoTListener struct {
 	*dns.Server
-	id string
+	id     string
+	opt    DoTListenerOptions
+	ifaces *interfaceServers // Set when listening on the addresses of an interface
 }
 
 var _ Listener = &DoTListener{}
@@ -24,29 +26,59 @@ type DoTListenerOptions struct {
 
 // NewDoTListener returns an instance of a DNS-over-TLS listener.
 func NewDoTListener(id, addr string, opt DoTListenerOptions, resolver Resolver) *DoTListener {
-	return &DoTListener{
-		id: id,
+	l := &DoTListener{
+		id:  id,
+		opt: opt,
 		Server: &dns.Server{
 			Addr:      addr,
 			Net:       "tcp-tls",
 			TLSConfig: opt.TLSConfig,
-			Handler:   listenHandler(id, "dot", addr, resolver, opt.AllowedNet),
+			Handler:   listenHandler(id, "dot", addr, resolver, opt.ListenOptions),
 		},
 	}
+	if opt.InterfaceAddrs != "" {
+		l.ifaces = newInterfaceServers(id, opt.InterfaceAddrs, addr, opt.InterfaceRefresh, l.newServer)
+	}
+	return l
 }
 
 // Start the Dot server.
-func (s DoTListener) Start() error {
+func (s *DoTListener) Start() error {
 	Log.WithFields(logrus.Fields{"id": s.id, "protocol": "dot", "addr": s.Addr}).Info("starting listener")
-	return s.ListenAndServe()
+	if s.ifaces != nil {
+		return s.ifaces.run()
+	}
+	if err := s.bind(s.Server); err != nil {
+		return err
+	}
+	return s.ActivateAndServe()
 }
 
 // Stop the server.
-func (s DoTListener) Stop() error {
+func (s *DoTListener) Stop() error {
 	Log.WithFields(logrus.Fields{"id": s.id, "protocol": "dot", "addr": s.Addr}).Info("stopping listener")
+	if s.ifaces != nil {
+		return s.ifaces.stop()
+	}
 	return s.Shutdown()
 }
 
-func (s DoTListener) String() string {
+// Returns a server for one address of an interface.
+func (s *DoTListener) newServer(addr string) (*dns.Server, error) {
+	srv := &dns.Server{Addr: addr, Net: s.Net, TLSConfig: s.TLSConfig, Handler: s.Handler}
+	return srv, s.bind(srv)
+}
+
+// Open the TLS listener of a server.
+func (s *DoTListener) bind(srv *dns.Server) error {
+	ln, err := s.opt.listenTCP(srv.Addr)
+	if err != nil {
+		return err
+	}
+	srv.Listener = tls.NewListener(ln, srv.TLSConfig)
+	return nil
+}
+
+func (s *DoTListener) String() string {
 	return s.id
 }
@@ -145,3 +145,35 @@ func getUDPLnAddress() (string, error) {
 	defer l.Close()
 	return l.LocalAddr().String(), nil
 }
+
+func TestDoTListenerClientNames(t *testing.T) {
+	var names []string
+	upstream := &TestResolver{
+		ResolveFunc: func(q *dns.Msg, ci ClientInfo) (*dns.Msg, error) {
+			names = ci.TLSClientNames
+			return q, nil
+		},
+	}
+
+	addr, err := getLnAddress()
+	require.NoError(t, err)
+
+	tlsServerConfig, err := TLSServerConfig("testdata/ca.crt", "testdata/server.crt", "testdata/server.key", true)
+	require.NoError(t, err)
+	s := NewDoTListener("test-ln", addr, DoTListenerOptions{TLSConfig: tlsServerConfig}, upstream)
+	go s.Start()
+	defer s.Stop()
+	time.Sleep(time.Second)
+
+	tlsClientConfig, err := TLSClientConfig("testdata/ca.crt", "testdata/client.crt", "testdata/client.key", "")
+	require.NoError(t, err)
+	c, _ := NewDoTClient("test-dot", addr, DoTClientOptions{TLSConfig: tlsClientConfig})
+
+	q := new(dns.Msg)
+	q.SetQuestion("cloudflare.com.", dns.TypeA)
+	_, err = c.Resolve(q, ClientInfo{})
+	require.NoError(t, err)
+
+	// The identity from the client certificate is passed to the resolver
+	require.Equal(t, []string{"localhost"}, names)
+}
@@ -105,7 +105,7 @@ func (d *DTLSClient) Resolve(q *dns.Msg, ci ClientInfo) (*dns.Msg, error) {
 
 	// Add padding to the query before sending over TLS
 	padQuery(q)
-	return d.pipeline.Resolve(q)
+	return d.pipeline.resolve(q, ci.Deadline, ci.Done)
 }
 
 func (d *DTLSClient) String() string {
@@ -3,6 +3,7 @@ package rdns
 import (
 	"errors"
 	"net"
+	"strings"
 
 	"github.com/miekg/dns"
 	"github.com/sirupsen/logrus"
@@ -80,6 +81,11 @@ func ECSModifierAdd(addr net.IP, prefix4, prefix6 uint8) ECSModifierFunc {
 		if sourceIP == nil {
 			sourceIP = ci.SourceIP
 		}
+		// Nothing to add if the client address isn't known, i.e. for internally
+		// generated queries
+		if sourceIP == nil {
+			return
+		}
 
 		var (
 			family uint16
@@ -162,17 +168,21 @@ func ECSModifierPrivacy(prefix4, prefix6 uint8) ECSModifierFunc {
 			if !ok {
 				continue
 			}
+			// Only ever truncate, a client that sent fewer bits than the
+			// configured prefix already reveals less.
 			switch ecs.Family {
 			case 1: // ip4
+				mask := min(prefix4, ecs.SourceNetmask)
 				beforeAddr = ecs.Address.To4()
-				afterAddr = beforeAddr.Mask(net.CIDRMask(int(prefix4), 32))
+				afterAddr = beforeAddr.Mask(net.CIDRMask(int(mask), 32))
 				ecs.Address = afterAddr
-				ecs.SourceNetmask = prefix4
+				ecs.SourceNetmask = mask
 			case 2: // ip6
+				mask := min(prefix6, ecs.SourceNetmask)
 				beforeAddr = ecs.Address
-				afterAddr = beforeAddr.Mask(net.CIDRMask(int(prefix6), 128))
+				afterAddr = beforeAddr.Mask(net.CIDRMask(int(mask), 128))
 				ecs.Address = afterAddr
-				ecs.SourceNetmask = prefix6
+				ecs.SourceNetmask = mask
 			}
 			hasECS = true
 		}
@@ -187,3 +197,27 @@ func ECSModifierPrivacy(prefix4, prefix6 uint8) ECSModifierFunc {
 		}
 	}
 }
+
+// ECSModifierDomains applies a modifier to queries for names in the given
+// domains, or their subdomains, and another to all other queries. Either can
+// be nil to leave the queries unchanged. Used to only send the client subnet
+// for domains that benefit from it, such as CDNs.
+func ECSModifierDomains(domains []string, f, other ECSModifierFunc) ECSModifierFunc {
+	names := make([]string, 0, len(domains))
+	for _, d := range domains {
+		names = append(names, dns.Fqdn(strings.ToLower(d)))
+	}
+	return func(id string, q *dns.Msg, ci ClientInfo) {
+		name := strings.ToLower(q.Question[0].Name)
+		modifier := other
+		for _, d := range names {
+			if dns.IsSubDomain(d, name) {
+				modifier = f
+				break
+			}
+		}
+		if modifier != nil {
+			modifier(id, q, ci)
+		}
+	}
+}
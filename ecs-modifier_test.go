@@ -0,0 +1,162 @@
+package rdns
+
+import (
+	"net"
+	"testing"
+
+	"github.com/miekg/dns"
+	"github.com/stretchr/testify/require"
+)
+
+// Returns the ECS option of the query after a round-trip through the wire
+// format, or nil if there is none.
+func wireECS(t *testing.T, q *dns.Msg) *dns.EDNS0_SUBNET {
+	b, err := q.Pack()
+	require.NoError(t, err)
+	m := new(dns.Msg)
+	require.NoError(t, m.Unpack(b))
+	edns0 := m.IsEdns0()
+	if edns0 == nil {
+		return nil
+	}
+	var found *dns.EDNS0_SUBNET
+	for _, opt := range edns0.Option {
+		if ecs, ok := opt.(*dns.EDNS0_SUBNET); ok {
+			require.Nil(t, found, "more than one ecs option")
+			found = ecs
+		}
+	}
+	return found
+}
+
+func requireECS(t *testing.T, q *dns.Msg, family uint16, mask uint8, addr string) {
+	ecs := wireECS(t, q)
+	require.NotNil(t, ecs)
+	require.Equal(t, family, ecs.Family)
+	require.Equal(t, mask, ecs.SourceNetmask)
+	require.Equal(t, uint8(0), ecs.SourceScope)
+	require.True(t, net.ParseIP(addr).Equal(ecs.Address), "expected %s, got %s", addr, ecs.Address)
+}
+
+// Build a query with an existing ECS option.
+func ecsQuery(addr string, mask uint8) *dns.Msg {
+	q := new(dns.Msg)
+	q.SetQuestion("test.com.", dns.TypeA)
+	q.SetEdns0(4096, false)
+	ip := net.ParseIP(addr)
+	family := uint16(2)
+	if ip4 := ip.To4(); ip4 != nil {
+		family = 1
+		ip = ip4
+	}
+	q.IsEdns0().Option = append(q.IsEdns0().Option, &dns.EDNS0_SUBNET{
+		Code:          dns.EDNS0SUBNET,
+		Family:        family,
+		SourceNetmask: mask,
+		Address:       ip,
+	})
+	return q
+}
+
+func TestECSModifierDelete(t *testing.T) {
+	var upstreamQ *dns.Msg
+	r := &TestResolver{ResolveFunc: func(q *dns.Msg, ci ClientInfo) (*dns.Msg, error) {
+		upstreamQ = q
+		a := new(dns.Msg)
+		return a.SetReply(q), nil
+	}}
+	m, err := NewECSModifier("test-ecs", r, ECSModifierDelete)
+	require.NoError(t, err)
+
+	_, err = m.Resolve(ecsQuery("192.168.1.100", 32), ClientInfo{})
+	require.NoError(t, err)
+	require.NotNil(t, upstreamQ.IsEdns0())
+	require.Nil(t, wireECS(t, upstreamQ))
+}
+
+func TestECSModifierPrivacy(t *testing.T) {
+	var upstreamQ *dns.Msg
+	r := &TestResolver{ResolveFunc: func(q *dns.Msg, ci ClientInfo) (*dns.Msg, error) {
+		upstreamQ = q
+		return q, nil
+	}}
+	m, err := NewECSModifier("test-ecs", r, ECSModifierPrivacy(24, 48))
+	require.NoError(t, err)
+
+	// IPv4, the address is truncated to /24
+	_, err = m.Resolve(ecsQuery("192.168.1.100", 32), ClientInfo{})
+	require.NoError(t, err)
+	requireECS(t, upstreamQ, 1, 24, "192.168.1.0")
+
+	// IPv6, truncated to /48
+	_, err = m.Resolve(ecsQuery("2001:db8:1:2:3:4:5:6", 128), ClientInfo{})
+	require.NoError(t, err)
+	requireECS(t, upstreamQ, 2, 48, "2001:db8:1::")
+
+	// A prefix shorter than the configured one is left alone
+	_, err = m.Resolve(ecsQuery("10.0.0.0", 8), ClientInfo{})
+	require.NoError(t, err)
+	requireECS(t, upstreamQ, 1, 8, "10.0.0.0")
+}
+
+func TestECSModifierAdd(t *testing.T) {
+	var upstreamQ *dns.Msg
+	upstreamA := new(dns.Msg)
+	r := &TestResolver{ResolveFunc: func(q *dns.Msg, ci ClientInfo) (*dns.Msg, error) {
+		upstreamQ = q
+		upstreamA.SetReply(q)
+		return upstreamA, nil
+	}}
+	m, err := NewECSModifier("test-ecs", r, ECSModifierAdd(nil, 24, 56))
+	require.NoError(t, err)
+
+	// No ECS in the query, add one from the client address
+	q := new(dns.Msg)
+	q.SetQuestion("test.com.", dns.TypeA)
+	a, err := m.Resolve(q, ClientInfo{SourceIP: net.ParseIP("10.1.2.3")})
+	require.NoError(t, err)
+	requireECS(t, upstreamQ, 1, 24, "10.1.2.0")
+
+	// The response is passed through unmodified
+	require.Same(t, upstreamA, a)
+
+	// An existing option is replaced, not appended
+	_, err = m.Resolve(ecsQuery("192.168.1.100", 32), ClientInfo{SourceIP: net.ParseIP("2001:db8:1:2::1")})
+	require.NoError(t, err)
+	requireECS(t, upstreamQ, 2, 56, "2001:db8:1::")
+
+	// Without a client address, nothing is added
+	q = new(dns.Msg)
+	q.SetQuestion("test.com.", dns.TypeA)
+	_, err = m.Resolve(q, ClientInfo{})
+	require.NoError(t, err)
+	require.Nil(t, wireECS(t, upstreamQ))
+}
+
+func TestECSModifierDomains(t *testing.T) {
+	var upstreamQ *dns.Msg
+	r := &TestResolver{ResolveFunc: func(q *dns.Msg, ci ClientInfo) (*dns.Msg, error) {
+		upstreamQ = q
+		return q, nil
+	}}
+	f := ECSModifierDomains([]string{"cdn.example.com"}, ECSModifierAdd(nil, 24, 56), ECSModifierDelete)
+	m, err := NewECSModifier("test-ecs", r, f)
+	require.NoError(t, err)
+	ci := ClientInfo{SourceIP: net.ParseIP("10.1.2.3")}
+
+	// The client subnet is added for the domain and its subdomains
+	for _, name := range []string{"cdn.example.com.", "img.CDN.example.com."} {
+		q := new(dns.Msg)
+		q.SetQuestion(name, dns.TypeA)
+		_, err = m.Resolve(q, ci)
+		require.NoError(t, err)
+		requireECS(t, upstreamQ, 1, 24, "10.1.2.0")
+	}
+
+	// All other queries have ECS removed
+	q := ecsQuery("192.168.1.100", 32)
+	q.Question[0].Name = "www.example.com."
+	_, err = m.Resolve(q, ci)
+	require.NoError(t, err)
+	require.Nil(t, wireECS(t, upstreamQ))
+}
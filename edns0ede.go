@@ -36,12 +36,51 @@ func (t *EDNS0EDETemplate) Apply(msg, q *dns.Msg) error {
 	if err != nil {
 		return err
 	}
-	ede := &dns.EDNS0_EDE{
-		InfoCode:  t.infoCode,
-		ExtraText: extraText,
+	if msg.IsEdns0() == nil {
+		msg.SetEdns0(4096, false)
 	}
-	msg.SetEdns0(4096, false)
-	opt := msg.IsEdns0()
-	opt.Option = append(opt.Option, ede)
+	addEDE(msg, q, t.infoCode, extraText)
 	return nil
 }
+
+// Attach an extended DNS error (RFC8914) to a response. Elements use it to
+// report why a query was blocked or failed, the errors then travel back
+// through the pipeline with the response where they can be seen by other
+// elements and the access log, and finally reach the client. Nothing is added
+// if neither the query nor the response use EDNS0. Errors already present in
+// the response aren't added again.
+func addEDE(a, q *dns.Msg, code uint16, text string) {
+	opt := a.IsEdns0()
+	if opt == nil {
+		edns0 := q.IsEdns0()
+		if edns0 == nil {
+			return
+		}
+		a.SetEdns0(edns0.UDPSize(), false)
+		opt = a.IsEdns0()
+	}
+	for _, ede := range extendedErrors(a) {
+		if ede.InfoCode == code && ede.ExtraText == text {
+			return
+		}
+	}
+	opt.Option = append(opt.Option, &dns.EDNS0_EDE{
+		InfoCode:  code,
+		ExtraText: text,
+	})
+}
+
+// Returns the extended DNS errors in a response, in the order they were added.
+func extendedErrors(a *dns.Msg) []*dns.EDNS0_EDE {
+	opt := a.IsEdns0()
+	if opt == nil {
+		return nil
+	}
+	var errs []*dns.EDNS0_EDE
+	for _, o := range opt.Option {
+		if ede, ok := o.(*dns.EDNS0_EDE); ok {
+			errs = append(errs, ede)
+		}
+	}
+	return errs
+}
@@ -1,6 +1,7 @@
 package rdns
 
 import (
+	"errors"
 	"fmt"
 
 	"github.com/miekg/dns"
@@ -14,3 +15,7 @@ type QueryTimeoutError struct {
 func (e QueryTimeoutError) Error() string {
 	return fmt.Sprintf("query for '%s' timed out", qName(e.query))
 }
+
+// errQueryCancelled is returned when the response to a query is no longer
+// needed, see ClientInfo.Done.
+var errQueryCancelled = errors.New("query cancelled")
@@ -2,6 +2,7 @@ package rdns
 
 import (
 	"expvar"
+	"slices"
 	"sync"
 	"time"
 
@@ -21,9 +22,13 @@ type FailBack struct {
 	resolvers []Resolver
 	mu        sync.RWMutex
 	failCh    chan struct{} // signal the timer to reset on failure
-	active    int
+	pool      []int         // indexes of the resolvers in the order they're used, the active one first
+	done      chan struct{} // closed to stop the reset timer
+	closeOnce sync.Once
 	opt       FailBackOptions
 	metrics   *FailRouterMetrics
+	health    *healthChecker
+	backoff   *backoffTracker
 }
 
 // FailBackOptions contain group-specific options.
@@ -35,6 +40,19 @@ type FailBackOptions struct {
 	// Determines if a SERVFAIL returned by a resolver should be considered an
 	// error response and trigger a failover.
 	ServfailError bool
+
+	// Optional active health probes. Resolvers that fail the health-check are
+	// skipped until they recover. If the active resolver is marked down, the
+	// group fails over right away without waiting for a query to fail. A
+	// resolver that is healthy again is moved to the back of the pool rather
+	// than becoming active right away, to avoid flapping. Disabled if the
+	// interval is 0.
+	HealthCheck HealthCheckOptions
+
+	// Optional back-off for failed resolvers. A resolver that failed is skipped
+	// until its back-off has expired, unless every resolver is either backing
+	// off or unhealthy.
+	RetryPolicy
 }
 
 var _ Resolver = &FailBack{}
@@ -63,12 +81,20 @@ func NewFailBack(id string, opt FailBackOptions, resolvers ...Resolver) *FailBac
 	if opt.ResetAfter == 0 {
 		opt.ResetAfter = time.Minute
 	}
-	return &FailBack{
+	r := &FailBack{
 		id:        id,
 		resolvers: resolvers,
+		pool:      make([]int, len(resolvers)),
+		done:      make(chan struct{}),
 		opt:       opt,
 		metrics:   NewFailRouterMetrics(id, len(resolvers)),
+		backoff:   newBackoffTracker(opt.RetryPolicy, len(resolvers)),
 	}
+	for i := range r.pool {
+		r.pool[i] = i
+	}
+	r.health = newHealthChecker(id, opt.HealthCheck, r.healthChanged, resolvers...)
+	return r
 }
 
 // Resolve a DNS query using a failover resolver group that switches to the next
@@ -79,16 +105,30 @@ func (r *FailBack) Resolve(q *dns.Msg, ci ClientInfo) (*dns.Msg, error) {
 		err error
 		a   *dns.Msg
 	)
+	var attempts int
 	for i := 0; i < len(r.resolvers); i++ {
 		resolver, active := r.current()
+
+		// Skip resolvers that failed the health-check or are backing off after
+		// a failure, as long as another one is neither. The last resolver is
+		// queried if none were so far, so there's always a response or error.
+		last := i == len(r.resolvers)-1 && attempts == 0
+		if !r.usable(active) && r.anyUsable() && !last {
+			log.WithField("resolver", resolver.String()).Debug("skipping unhealthy resolver or resolver in back-off")
+			r.errorFrom(active)
+			continue
+		}
+		attempts++
 		log.WithField("resolver", resolver.String()).Debug("forwarding query to resolver")
 		r.metrics.route.Add(resolver.String(), 1)
 		a, err = resolver.Resolve(q, ci)
 		if err == nil && r.isSuccessResponse(a) { // Return immediately if successful
+			r.backoff.reset(active)
 			return a, err
 		}
 		log.WithField("resolver", resolver.String()).WithError(err).Debug("resolver returned failure")
 		r.metrics.failure.Add(resolver.String(), 1)
+		r.backoff.failure(active)
 
 		r.errorFrom(active)
 	}
@@ -99,11 +139,55 @@ func (r *FailBack) String() string {
 	return r.id
 }
 
+// Close stops the health probes and the reset timer.
+func (r *FailBack) Close() error {
+	r.closeOnce.Do(func() {
+		r.health.close()
+		close(r.done)
+	})
+	return nil
+}
+
+// Returns true if resolver i is healthy and not backing off.
+func (r *FailBack) usable(i int) bool {
+	return r.health.isHealthy(i) && !r.backoff.skip(i)
+}
+
+// Returns true if at least one resolver is healthy and not backing off.
+func (r *FailBack) anyUsable() bool {
+	for i := range r.resolvers {
+		if r.usable(i) {
+			return true
+		}
+	}
+	return false
+}
+
+// Healthy returns the health state of the resolvers in the group, in the order
+// they were added. All resolvers are reported as healthy if health-checks are
+// disabled.
+func (r *FailBack) Healthy() []bool {
+	return r.health.state(len(r.resolvers))
+}
+
+// ResetBackoff clears the back-off of the resolver with the given index, so
+// that it is used again right away.
+func (r *FailBack) ResetBackoff(upstreamIndex int) {
+	r.backoff.reset(upstreamIndex)
+}
+
 // Thread-safe method to return the currently active resolver.
 func (r *FailBack) current() (Resolver, int) {
 	r.mu.RLock()
 	defer r.mu.RUnlock()
-	return r.resolvers[r.active], r.active
+	return r.resolvers[r.pool[0]], r.pool[0]
+}
+
+// Moves resolver i to the back of the pool. Must be called with the lock held.
+func (r *FailBack) moveToBack(i int) {
+	j := slices.Index(r.pool, i)
+	copy(r.pool[j:], r.pool[j+1:])
+	r.pool[len(r.pool)-1] = i
 }
 
 // Fail over to the next available resolver after receiving an error from i (the active). We
@@ -112,24 +196,50 @@ func (r *FailBack) current() (Resolver, int) {
 // (no longer) the active store.
 func (r *FailBack) errorFrom(i int) {
 	r.mu.Lock()
-	if i != r.active {
+	if i != r.pool[0] {
 		r.mu.Unlock()
 		return
 	}
 	if r.failCh == nil { // lazy start the reset timer
 		r.failCh = r.startResetTimer()
 	}
-	r.active = (r.active + 1) % len(r.resolvers)
+	r.moveToBack(i)
 	Log.WithFields(logrus.Fields{
 		"id":       r.id,
-		"resolver": r.resolvers[r.active].String(),
+		"resolver": r.resolvers[r.pool[0]].String(),
 	}).Debug("failing over to resolver")
 	r.mu.Unlock()
 	r.metrics.failover.Add(1)
 	r.metrics.available.Add(-1)
-	r.failCh <- struct{}{} // signal the timer to wait some more before switching back
+
+	// Signal the timer to wait some more before switching back. If a signal
+	// is already pending, that does the same.
+	select {
+	case r.failCh <- struct{}{}:
+	default:
+	}
 }
 
+// Called by the health-checker when resolver i changes state. Fails over if the
+// active resolver went down. A resolver that recovered is moved to the back of
+// the pool so it's only used again once the others fail or the reset timer
+// expires.
+func (r *FailBack) healthChanged(i int, healthy bool) {
+	if !healthy {
+		r.errorFrom(i)
+		return
+	}
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	if i == r.pool[0] {
+		return
+	}
+	r.moveToBack(i)
+	Log.WithFields(logrus.Fields{
+		"id":       r.id,
+		"resolver": r.resolvers[i].String(),
+	}).Debug("resolver recovered, moving to the back of the pool")
+}
 
 // Set active=0 regularly after the reset timer has expired without further failures. Any failure,
 // as signalled by the channel resets the timer again.
@@ -137,20 +247,29 @@ func (r *FailBack) startResetTimer() chan struct{} {
 	failCh := make(chan struct{}, 1)
 	go func() {
 		timer := time.NewTimer(r.opt.ResetAfter)
+		defer timer.Stop()
 		for {
 			select {
+			case <-r.done:
+				return
 			case <-failCh:
 				if !timer.Stop() {
 					<-timer.C
 				}
 			case <-timer.C:
 				r.mu.Lock()
-				r.active = 0
-				Log.WithField("resolver", r.resolvers[r.active].String()).Debug("failing back to resolver")
+				for i := range r.pool {
+					r.pool[i] = i
+				}
+				Log.WithField("resolver", r.resolvers[0].String()).Debug("failing back to resolver")
 				r.mu.Unlock()
 				r.metrics.available.Add(1)
 				// we just reset to the first resolver, let's wait for another failure before running again
-				<-failCh
+				select {
+				case <-r.done:
+					return
+				case <-failCh:
+				}
 			}
 			timer.Reset(r.opt.ResetAfter)
 		}
@@ -1,11 +1,14 @@
 package rdns
 
 import (
+	"errors"
+	"sync/atomic"
 	"testing"
 	"time"
 
 	"github.com/miekg/dns"
 	"github.com/stretchr/testify/require"
+	"go.uber.org/goleak"
 )
 
 func TestFailBack(t *testing.T) {
@@ -130,3 +133,171 @@ func TestFailBackServfailOKOption(t *testing.T) {
 	require.NotEqual(t, dns.RcodeServerFailure, a.Rcode)
 	require.Equal(t, 1, goodResolver.hitCount)
 }
+
+func TestFailBackHealthCheck(t *testing.T) {
+	var ci ClientInfo
+	opt := StaticResolverOptions{
+		RCode: dns.RcodeServerFailure,
+	}
+	r1, err := NewStaticResolver("test-static", opt)
+	require.NoError(t, err)
+	r2 := new(TestResolver)
+
+	g := NewFailBack("test-fb", FailBackOptions{
+		HealthCheck: HealthCheckOptions{
+			Interval:       20 * time.Millisecond,
+			ThresholdFails: 2,
+		},
+	}, r1, r2)
+	q := new(dns.Msg)
+	q.SetQuestion("test.com.", dns.TypeA)
+
+	// Before any probes ran, all resolvers are healthy and the SERVFAIL is returned
+	require.Equal(t, []bool{true, true}, g.Healthy())
+	a, err := g.Resolve(q, ci)
+	require.NoError(t, err)
+	require.Equal(t, dns.RcodeServerFailure, a.Rcode)
+
+	// Wait for the probes to mark the first resolver unhealthy, queries should skip it
+	require.Eventually(t, func() bool {
+		h := g.Healthy()
+		return !h[0] && h[1]
+	}, time.Second, 10*time.Millisecond)
+	require.Equal(t, "0", getVarMap("upstream", "test-fb", "health").Get(r1.String()).String())
+	a, err = g.Resolve(q, ci)
+	require.NoError(t, err)
+	require.Equal(t, dns.RcodeSuccess, a.Rcode)
+}
+
+func TestFailBackHealthCheckRecovery(t *testing.T) {
+	var down1, down2 atomic.Bool
+	resolver := func(down *atomic.Bool) *TestResolver {
+		return &TestResolver{
+			ResolveFunc: func(q *dns.Msg, ci ClientInfo) (*dns.Msg, error) {
+				if down.Load() {
+					return nil, errors.New("down")
+				}
+				return q, nil
+			},
+		}
+	}
+	r1, r2, r3 := resolver(&down1), resolver(&down2), new(TestResolver)
+
+	g := NewFailBack("test-fb-health-recovery", FailBackOptions{
+		ResetAfter: time.Hour,
+		HealthCheck: HealthCheckOptions{
+			Interval:         10 * time.Millisecond,
+			ThresholdSuccess: 2,
+		},
+	}, r1, r2, r3)
+	defer g.Close()
+	active := func() int {
+		_, i := g.current()
+		return i
+	}
+
+	// The group fails over without any queries once the first resolver is down
+	down1.Store(true)
+	require.Eventually(t, func() bool { return active() == 1 }, time.Second, 5*time.Millisecond)
+
+	// Once it's healthy again, it's moved to the back of the pool instead of
+	// becoming active right away
+	down1.Store(false)
+	require.Eventually(t, func() bool { return g.Healthy()[0] }, time.Second, 5*time.Millisecond)
+	require.Equal(t, 1, active())
+
+	// It's only used again after the resolvers ahead of it failed
+	down2.Store(true)
+	require.Eventually(t, func() bool { return active() == 2 }, time.Second, 5*time.Millisecond)
+	g.errorFrom(2)
+	require.Equal(t, 0, active())
+}
+
+func TestFailBackClose(t *testing.T) {
+	defer goleak.VerifyNone(t, goleak.IgnoreCurrent())
+	g := NewFailBack("test-fb-close", FailBackOptions{
+		HealthCheck: HealthCheckOptions{Interval: time.Millisecond},
+	}, new(TestResolver), new(TestResolver))
+	g.errorFrom(0) // starts the reset timer
+	require.NoError(t, g.Close())
+	require.NoError(t, g.Close())
+}
+
+func TestFailBackHealthCheckDisabled(t *testing.T) {
+	g := NewFailBack("test-fb", FailBackOptions{}, new(TestResolver), new(TestResolver))
+	require.Nil(t, g.health)
+	require.Equal(t, []bool{true, true}, g.Healthy())
+}
+
+func TestParseHealthCheckQuery(t *testing.T) {
+	q, err := parseHealthCheckQuery("")
+	require.NoError(t, err)
+	require.Equal(t, dns.Question{Name: "healthcheck.local.", Qtype: dns.TypeA, Qclass: dns.ClassINET}, q)
+
+	q, err = parseHealthCheckQuery("AAAA example.com")
+	require.NoError(t, err)
+	require.Equal(t, dns.Question{Name: "example.com.", Qtype: dns.TypeAAAA, Qclass: dns.ClassINET}, q)
+
+	_, err = parseHealthCheckQuery("XYZ example.com.")
+	require.Error(t, err)
+}
+
+func TestFailBackRetryPolicy(t *testing.T) {
+	var ci ClientInfo
+	r1 := new(TestResolver)
+	r2 := new(TestResolver)
+
+	g := NewFailBack("test-fb-backoff", FailBackOptions{
+		ResetAfter:  100 * time.Millisecond,
+		RetryPolicy: RetryPolicy{InitialBackoff: time.Hour},
+	}, r1, r2)
+	q := new(dns.Msg)
+	q.SetQuestion("test.com.", dns.TypeA)
+
+	// The first resolver fails and goes into back-off
+	r1.SetFail(true)
+	_, err := g.Resolve(q, ci)
+	require.NoError(t, err)
+	require.Equal(t, 1, r1.HitCount())
+	require.Equal(t, 1, r2.HitCount())
+	r1.SetFail(false)
+
+	// After failing back, the first resolver is still skipped
+	time.Sleep(200 * time.Millisecond)
+	_, err = g.Resolve(q, ci)
+	require.NoError(t, err)
+	require.Equal(t, 1, r1.HitCount())
+	require.Equal(t, 2, r2.HitCount())
+
+	// Once the back-off is cleared, it's used again
+	g.ResetBackoff(0)
+	time.Sleep(200 * time.Millisecond)
+	_, err = g.Resolve(q, ci)
+	require.NoError(t, err)
+	require.Equal(t, 2, r1.HitCount())
+	require.Equal(t, 2, r2.HitCount())
+}
+
+// A resolver is always queried, even if each one is either unhealthy or backing
+// off.
+func TestFailBackNoUsableResolver(t *testing.T) {
+	var ci ClientInfo
+	r1 := new(TestResolver)
+	r2 := new(TestResolver)
+
+	g := NewFailBack("test-fb-none-usable", FailBackOptions{
+		ResetAfter:  time.Hour,
+		HealthCheck: HealthCheckOptions{Interval: time.Hour},
+		RetryPolicy: RetryPolicy{InitialBackoff: time.Hour},
+	}, r1, r2)
+	defer g.Close()
+	g.health.update(0, errors.New("probe failed"))
+	g.backoff.failure(1)
+
+	q := new(dns.Msg)
+	q.SetQuestion("test.com.", dns.TypeA)
+	a, err := g.Resolve(q, ci)
+	require.NoError(t, err)
+	require.NotNil(t, a)
+	require.Equal(t, 1, r1.HitCount()+r2.HitCount())
+}
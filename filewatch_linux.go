@@ -0,0 +1,114 @@
+//go:build linux
+
+package rdns
+
+import (
+	"encoding/binary"
+	"errors"
+	"os"
+	"path/filepath"
+	"strings"
+	"syscall"
+)
+
+// Events that indicate a file was written, replaced or removed. Files are
+// written in place (close after write) or replaced atomically (moved into the
+// directory) by most tools.
+const fileWatchMask = syscall.IN_CLOSE_WRITE | syscall.IN_MOVED_TO | syscall.IN_MOVED_FROM | syscall.IN_DELETE
+
+// A watched directory and the names in it that are of interest.
+type dirWatch struct {
+	all   bool // Any file in the directory
+	names map[string]struct{}
+}
+
+// Calls changed whenever one of the files, or a file in one of the
+// directories, is written, replaced or removed. The parent directories of
+// files are watched with inotify so files that are replaced rather than
+// written in place are followed. Watching ends when stop is closed.
+func watchFiles(paths []string, changed func(), stop <-chan struct{}) error {
+	fd, err := syscall.InotifyInit1(syscall.IN_CLOEXEC | syscall.IN_NONBLOCK)
+	if err != nil {
+		return err
+	}
+	// Make the descriptor pollable by the runtime so reads don't block a thread
+	f := os.NewFile(uintptr(fd), "inotify")
+
+	dirs := make(map[string]*dirWatch)
+	for _, path := range paths {
+		path = filepath.Clean(path)
+		fi, err := os.Stat(path)
+		if err != nil {
+			f.Close()
+			return err
+		}
+		dir, name := path, ""
+		if !fi.IsDir() {
+			dir, name = filepath.Dir(path), filepath.Base(path)
+		}
+		w, ok := dirs[dir]
+		if !ok {
+			w = &dirWatch{names: make(map[string]struct{})}
+			dirs[dir] = w
+		}
+		if name == "" {
+			w.all = true
+		} else {
+			w.names[name] = struct{}{}
+		}
+	}
+	watches := make(map[int32]*dirWatch, len(dirs))
+	for dir, w := range dirs {
+		wd, err := syscall.InotifyAddWatch(fd, dir, fileWatchMask)
+		if err != nil {
+			f.Close()
+			return err
+		}
+		watches[int32(wd)] = w
+	}
+
+	// Closing the descriptor unblocks the read below
+	go func() {
+		<-stop
+		f.Close()
+	}()
+	go func() {
+		buf := make([]byte, 64*(syscall.SizeofInotifyEvent+syscall.NAME_MAX+1))
+		for {
+			n, err := f.Read(buf)
+			if errors.Is(err, os.ErrClosed) {
+				return
+			}
+			if err != nil {
+				Log.WithError(err).Error("failed to read file events")
+				return
+			}
+			var match bool
+			for off := 0; off+syscall.SizeofInotifyEvent <= n; {
+				wd := int32(binary.NativeEndian.Uint32(buf[off:]))
+				nameLen := int(binary.NativeEndian.Uint32(buf[off+12:]))
+				start := off + syscall.SizeofInotifyEvent
+				if start+nameLen > n {
+					break
+				}
+				name := strings.TrimRight(string(buf[start:start+nameLen]), "\x00")
+				if w, ok := watches[wd]; ok && w.matches(name) {
+					match = true
+				}
+				off = start + nameLen
+			}
+			if match {
+				changed()
+			}
+		}
+	}()
+	return nil
+}
+
+func (w *dirWatch) matches(name string) bool {
+	if w.all {
+		return !strings.HasPrefix(name, ".")
+	}
+	_, ok := w.names[name]
+	return ok
+}
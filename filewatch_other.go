@@ -0,0 +1,11 @@
+//go:build !linux
+
+package rdns
+
+import "errors"
+
+var errFileWatchUnsupported = errors.New("watching files is only supported on linux")
+
+func watchFiles(paths []string, changed func(), stop <-chan struct{}) error {
+	return errFileWatchUnsupported
+}
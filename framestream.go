@@ -0,0 +1,210 @@
+package rdns
+
+import (
+	"bufio"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"os"
+	"sync"
+	"time"
+)
+
+// Frame Streams control frame types, see
+// https://github.com/farsightsec/fstrm/blob/master/fstrm/control.h
+const (
+	fstrmControlAccept = 0x01
+	fstrmControlStart  = 0x02
+	fstrmControlStop   = 0x03
+	fstrmControlReady  = 0x04
+	fstrmControlFinish = 0x05
+
+	fstrmFieldContentType = 0x01
+
+	// Upper limit for control frames read from a socket
+	fstrmMaxControlFrame = 512
+)
+
+// FrameStreamWriter writes data frames in the Frame Streams protocol used by
+// dnstap. It writes to a unix or TCP socket using the bidirectional handshake,
+// or to a file. Every call to Write sends one data frame. Connections to
+// sockets are established on first use and re-established after errors.
+type FrameStreamWriter struct {
+	network     string
+	address     string
+	contentType string
+	timeout     time.Duration
+
+	mu   sync.Mutex
+	conn io.WriteCloser
+	rw   *bufio.ReadWriter // Set for sockets, nil for files
+}
+
+// NewFrameStreamSocket returns a writer that sends frames to a "unix" or "tcp"
+// socket. The timeout applies to connecting, the handshake, and each write.
+func NewFrameStreamSocket(network, address, contentType string, timeout time.Duration) (*FrameStreamWriter, error) {
+	switch network {
+	case "unix", "tcp":
+	default:
+		return nil, fmt.Errorf("unsupported frame stream network %q", network)
+	}
+	if timeout <= 0 {
+		timeout = 5 * time.Second
+	}
+	return &FrameStreamWriter{
+		network:     network,
+		address:     address,
+		contentType: contentType,
+		timeout:     timeout,
+	}, nil
+}
+
+// NewFrameStreamFile returns a writer that appends a unidirectional frame
+// stream to a new file, as read by tools like dnstap-read.
+func NewFrameStreamFile(filename, contentType string) (*FrameStreamWriter, error) {
+	f, err := os.Create(filename)
+	if err != nil {
+		return nil, err
+	}
+	if _, err := f.Write(fstrmControlFrame(fstrmControlStart, contentType)); err != nil {
+		f.Close()
+		return nil, err
+	}
+	return &FrameStreamWriter{
+		contentType: contentType,
+		conn:        f,
+	}, nil
+}
+
+// Write sends b as one data frame.
+func (w *FrameStreamWriter) Write(b []byte) (int, error) {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+	if w.conn == nil {
+		if w.network == "" {
+			return 0, os.ErrClosed
+		}
+		if err := w.connect(); err != nil {
+			return 0, err
+		}
+	}
+	frame := make([]byte, 4+len(b))
+	binary.BigEndian.PutUint32(frame, uint32(len(b)))
+	copy(frame[4:], b)
+	if err := w.write(frame); err != nil {
+		w.disconnect()
+		return 0, err
+	}
+	return len(b), nil
+}
+
+// Close ends the stream and closes the connection or file.
+func (w *FrameStreamWriter) Close() error {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+	if w.conn == nil {
+		w.network = ""
+		return nil
+	}
+	err := w.write(fstrmControlFrame(fstrmControlStop, ""))
+	if err == nil && w.rw != nil {
+		// Wait for the reader to acknowledge the end of the stream
+		err = w.expectControl(fstrmControlFinish)
+	}
+	if cerr := w.conn.Close(); err == nil {
+		err = cerr
+	}
+	w.conn, w.rw, w.network = nil, nil, ""
+	return err
+}
+
+// Must be called with the lock held.
+func (w *FrameStreamWriter) connect() error {
+	conn, err := net.DialTimeout(w.network, w.address, w.timeout)
+	if err != nil {
+		return err
+	}
+	w.conn = conn
+	w.rw = bufio.NewReadWriter(bufio.NewReader(conn), bufio.NewWriter(conn))
+	if err := w.write(fstrmControlFrame(fstrmControlReady, w.contentType)); err != nil {
+		w.disconnect()
+		return err
+	}
+	if err := w.expectControl(fstrmControlAccept); err != nil {
+		w.disconnect()
+		return err
+	}
+	if err := w.write(fstrmControlFrame(fstrmControlStart, w.contentType)); err != nil {
+		w.disconnect()
+		return err
+	}
+	return nil
+}
+
+// Must be called with the lock held.
+func (w *FrameStreamWriter) disconnect() {
+	if w.conn != nil {
+		w.conn.Close()
+	}
+	w.conn, w.rw = nil, nil
+}
+
+func (w *FrameStreamWriter) write(b []byte) error {
+	if w.rw == nil {
+		_, err := w.conn.Write(b)
+		return err
+	}
+	if c, ok := w.conn.(net.Conn); ok {
+		c.SetWriteDeadline(time.Now().Add(w.timeout))
+	}
+	if _, err := w.rw.Write(b); err != nil {
+		return err
+	}
+	return w.rw.Flush()
+}
+
+// Read a control frame from the socket and check its type.
+func (w *FrameStreamWriter) expectControl(typ uint32) error {
+	if c, ok := w.conn.(net.Conn); ok {
+		c.SetReadDeadline(time.Now().Add(w.timeout))
+	}
+	var header [8]byte
+	if _, err := io.ReadFull(w.rw, header[:]); err != nil {
+		return err
+	}
+	if binary.BigEndian.Uint32(header[:4]) != 0 {
+		return errors.New("expected frame stream control frame")
+	}
+	n := binary.BigEndian.Uint32(header[4:])
+	if n < 4 || n > fstrmMaxControlFrame {
+		return fmt.Errorf("invalid frame stream control frame length %d", n)
+	}
+	body := make([]byte, n)
+	if _, err := io.ReadFull(w.rw, body); err != nil {
+		return err
+	}
+	if got := binary.BigEndian.Uint32(body); got != typ {
+		return fmt.Errorf("unexpected frame stream control frame type %d, expected %d", got, typ)
+	}
+	return nil
+}
+
+// Returns an encoded control frame, with a content type field if not empty.
+func fstrmControlFrame(typ uint32, contentType string) []byte {
+	length := 4
+	if contentType != "" {
+		length += 8 + len(contentType)
+	}
+	b := make([]byte, 0, 8+length)
+	b = binary.BigEndian.AppendUint32(b, 0) // escape
+	b = binary.BigEndian.AppendUint32(b, uint32(length))
+	b = binary.BigEndian.AppendUint32(b, typ)
+	if contentType != "" {
+		b = binary.BigEndian.AppendUint32(b, fstrmFieldContentType)
+		b = binary.BigEndian.AppendUint32(b, uint32(len(contentType)))
+		b = append(b, contentType...)
+	}
+	return b
+}
@@ -1,6 +1,7 @@
 package rdns
 
 import (
+	"errors"
 	"fmt"
 	"net"
 	"strconv"
@@ -34,6 +35,7 @@ func NewGeoIPDB(name string, loader BlocklistLoader, geoDBFile string) (*GeoIPDB
 
 	rules, err := loader.Load()
 	if err != nil {
+		geoDB.Close()
 		return nil, err
 	}
 
@@ -61,7 +63,11 @@ func NewGeoIPDB(name string, loader BlocklistLoader, geoDBFile string) (*GeoIPDB
 }
 
 func (m *GeoIPDB) Reload() (IPBlocklistDB, error) {
-	return NewGeoIPDB(m.name, m.loader, m.geoDBFile)
+	db, err := NewGeoIPDB(m.name, m.loader, m.geoDBFile)
+	if errors.Is(err, ErrNotModified) {
+		return m, nil
+	}
+	return db, err
 }
 
 func (m *GeoIPDB) Match(ip net.IP) (*BlocklistMatch, bool) {
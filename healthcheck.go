@@ -0,0 +1,257 @@
+package rdns
+
+import (
+	"expvar"
+	"fmt"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/miekg/dns"
+	"github.com/sirupsen/logrus"
+)
+
+// HealthCheckOptions contain settings for active health probes of resolvers
+// in a group. Probes are disabled if Interval is 0.
+type HealthCheckOptions struct {
+	// Time between probes. Disabled if 0.
+	Interval time.Duration
+
+	// Max time a probe can take before it's considered failed. Default 2 seconds.
+	Timeout time.Duration
+
+	// Query sent to the resolvers, in the form "<type> <name>", or just "<name>"
+	// for an A query. Default "A healthcheck.local.".
+	Query string
+
+	// Number of consecutive failed probes before a resolver is marked as down.
+	// Default 1.
+	ThresholdFails int
+
+	// Number of consecutive successful probes before a resolver that is down
+	// is marked as healthy again. Default 1.
+	ThresholdSuccess int
+}
+
+const defaultHealthCheckQuery = "A healthcheck.local."
+
+// healthChecker regularly sends probes to a list of resolvers and keeps track
+// of which ones are healthy. A nil *healthChecker considers all resolvers healthy.
+type healthChecker struct {
+	id        string
+	resolvers []Resolver
+	opt       HealthCheckOptions
+	query     dns.Question
+
+	mu      sync.RWMutex
+	healthy []bool
+	fails   []int
+	success []int
+	gauge   []*expvar.Int
+	failure *expvar.Map
+
+	// Called when the health state of a resolver changes
+	onChange func(i int, healthy bool)
+
+	stop     chan struct{}
+	stopOnce sync.Once
+}
+
+// newHealthChecker returns a health checker for the resolvers and starts probing
+// in the background. Returns nil if probes are disabled in the options.
+func newHealthChecker(id string, opt HealthCheckOptions, onChange func(int, bool), resolvers ...Resolver) *healthChecker {
+	if opt.Interval == 0 {
+		return nil
+	}
+	if opt.Timeout == 0 {
+		opt.Timeout = 2 * time.Second
+	}
+	if opt.ThresholdFails < 1 {
+		opt.ThresholdFails = 1
+	}
+	if opt.ThresholdSuccess < 1 {
+		opt.ThresholdSuccess = 1
+	}
+	query, err := parseHealthCheckQuery(opt.Query)
+	if err != nil {
+		Log.WithField("id", id).WithError(err).Errorf("invalid health-check query, using %q", defaultHealthCheckQuery)
+		query, _ = parseHealthCheckQuery(defaultHealthCheckQuery)
+	}
+	h := &healthChecker{
+		id:        id,
+		resolvers: resolvers,
+		opt:       opt,
+		query:     query,
+		healthy:   make([]bool, len(resolvers)),
+		fails:     make([]int, len(resolvers)),
+		success:   make([]int, len(resolvers)),
+		gauge:     make([]*expvar.Int, len(resolvers)),
+		failure:   getVarMap("router", id, "health-check-failure"),
+		onChange:  onChange,
+		stop:      make(chan struct{}),
+	}
+	health := getVarMap("upstream", id, "health")
+	for i, resolver := range resolvers {
+		h.healthy[i] = true
+		h.gauge[i] = new(expvar.Int)
+		h.gauge[i].Set(1)
+		health.Set(resolver.String(), h.gauge[i])
+	}
+	go h.run()
+	return h
+}
+
+// Parse a probe query in the form "<type> <name>" or "<name>".
+func parseHealthCheckQuery(s string) (dns.Question, error) {
+	if s == "" {
+		s = defaultHealthCheckQuery
+	}
+	fields := strings.Fields(s)
+	q := dns.Question{Qtype: dns.TypeA, Qclass: dns.ClassINET}
+	switch len(fields) {
+	case 1:
+		q.Name = dns.Fqdn(fields[0])
+	case 2:
+		types, err := stringToType(fields[:1])
+		if err != nil {
+			return q, err
+		}
+		q.Qtype = types[0]
+		q.Name = dns.Fqdn(fields[1])
+	default:
+		return q, fmt.Errorf("invalid health-check query %q", s)
+	}
+	return q, nil
+}
+
+// Probe the resolvers every interval until the checker is closed.
+func (h *healthChecker) run() {
+	ticker := time.NewTicker(h.opt.Interval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-h.stop:
+			return
+		case <-ticker.C:
+		}
+		var wg sync.WaitGroup
+		for i := range h.resolvers {
+			wg.Add(1)
+			go func(i int) {
+				defer wg.Done()
+				h.update(i, h.probe(h.resolvers[i]))
+			}(i)
+		}
+		wg.Wait()
+	}
+}
+
+// Send a probe to the resolver and return an error if it fails or takes too long.
+func (h *healthChecker) probe(resolver Resolver) error {
+	q := new(dns.Msg)
+	q.Question = []dns.Question{h.query}
+	q.Id = dns.Id()
+	q.RecursionDesired = true
+
+	type result struct {
+		a   *dns.Msg
+		err error
+	}
+	resultCh := make(chan result, 1)
+	go func() {
+		a, err := resolver.Resolve(q, ClientInfo{Listener: h.id})
+		resultCh <- result{a, err}
+	}()
+
+	timer := time.NewTimer(h.opt.Timeout)
+	defer timer.Stop()
+	select {
+	case res := <-resultCh:
+		if res.err != nil {
+			return res.err
+		}
+		if res.a == nil {
+			return fmt.Errorf("no response to health-check from %s", resolver)
+		}
+		switch res.a.Rcode {
+		case dns.RcodeServerFailure, dns.RcodeRefused:
+			return fmt.Errorf("health-check response from %s with %s", resolver, rCode(res.a))
+		}
+		return nil
+	case <-timer.C:
+		return fmt.Errorf("health-check for %s timed out after %s", resolver, h.opt.Timeout)
+	}
+}
+
+// Record the result of a probe for resolver i and flip the state if needed.
+func (h *healthChecker) update(i int, err error) {
+	log := Log.WithFields(logrus.Fields{"id": h.id, "resolver": h.resolvers[i].String()})
+	h.mu.Lock()
+	wasHealthy := h.healthy[i]
+	if err != nil {
+		h.fails[i]++
+		h.success[i] = 0
+		if h.fails[i] >= h.opt.ThresholdFails {
+			h.healthy[i] = false
+		}
+		log.WithError(err).Debug("health-check failed")
+	} else {
+		h.fails[i] = 0
+		h.success[i]++
+		if h.success[i] >= h.opt.ThresholdSuccess {
+			h.healthy[i] = true
+		}
+	}
+	isHealthy := h.healthy[i]
+	h.mu.Unlock()
+	if err != nil {
+		h.failure.Add(h.resolvers[i].String(), 1)
+	}
+
+	if wasHealthy == isHealthy {
+		return
+	}
+	if isHealthy {
+		log.Info("resolver is healthy")
+		h.gauge[i].Set(1)
+	} else {
+		log.Warn("resolver is unhealthy")
+		h.gauge[i].Set(0)
+	}
+	if h.onChange != nil {
+		h.onChange(i, isHealthy)
+	}
+}
+
+// Stops the probes. Safe to call more than once, and on a nil checker.
+func (h *healthChecker) close() {
+	if h == nil {
+		return
+	}
+	h.stopOnce.Do(func() { close(h.stop) })
+}
+
+// Returns true if resolver i is currently considered healthy.
+func (h *healthChecker) isHealthy(i int) bool {
+	if h == nil {
+		return true
+	}
+	h.mu.RLock()
+	defer h.mu.RUnlock()
+	return h.healthy[i]
+}
+
+// Returns the health state of all resolvers, in order.
+func (h *healthChecker) state(n int) []bool {
+	states := make([]bool, n)
+	if h == nil {
+		for i := range states {
+			states[i] = true
+		}
+		return states
+	}
+	h.mu.RLock()
+	defer h.mu.RUnlock()
+	copy(states, h.healthy)
+	return states
+}
@@ -0,0 +1,271 @@
+package rdns
+
+import (
+	"bufio"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/miekg/dns"
+)
+
+// Time between checks for changed hosts files on systems where they can't be
+// watched.
+const hostsPollInterval = 10 * time.Second
+
+// Hosts is a resolver that answers A, AAAA, and PTR queries from files in
+// /etc/hosts format. The files are watched and loaded again when they change.
+// Names that aren't in the files are answered with NXDOMAIN.
+type Hosts struct {
+	id string
+	HostsOptions
+
+	mu          sync.RWMutex
+	byName      map[string][]net.IP
+	byAddr      map[string]string // Canonical name by reverse lookup name
+	fingerprint string            // Names, sizes and modification times of the loaded files
+	loops       stopper           // Stops polling the files for changes
+}
+
+var _ Resolver = &Hosts{}
+var _ ReloadableResolver = &Hosts{}
+
+type HostsOptions struct {
+	// Hosts files, or directories with hosts files. Files in directories are
+	// loaded in lexical order, hidden files are skipped.
+	Paths []string
+
+	// TTL of the records in responses, default 60.
+	TTL uint32
+}
+
+// NewHosts loads the hosts files and returns a new instance of the resolver.
+func NewHosts(id string, opt HostsOptions) (*Hosts, error) {
+	if len(opt.Paths) == 0 {
+		return nil, errors.New("no hosts files")
+	}
+	if opt.TTL == 0 {
+		opt.TTL = 60
+	}
+	r := &Hosts{
+		id:           id,
+		HostsOptions: opt,
+	}
+	if err := r.ReloadAll(); err != nil {
+		return nil, err
+	}
+	log := Log.WithField("id", id)
+	err := watchFiles(opt.Paths, func() {
+		if err := r.ReloadAll(); err != nil {
+			log.WithError(err).Error("failed to reload hosts files")
+		}
+	}, r.loops.done())
+	if err != nil {
+		log.WithError(err).Debug("can't watch hosts files, checking for changes periodically")
+		go r.pollLoop()
+	}
+	return r, nil
+}
+
+// Resolve a query with the names and addresses in the hosts files.
+func (r *Hosts) Resolve(q *dns.Msg, ci ClientInfo) (*dns.Msg, error) {
+	if len(q.Question) < 1 {
+		return nil, errors.New("no question in query")
+	}
+	question := q.Question[0]
+	name := strings.ToLower(question.Name)
+	log := logger(r.id, q, ci)
+
+	a := new(dns.Msg)
+	a.SetReply(q)
+	a.Authoritative = true
+
+	r.mu.RLock()
+	defer r.mu.RUnlock()
+
+	// Reverse lookups
+	if strings.HasSuffix(name, ".in-addr.arpa.") || strings.HasSuffix(name, ".ip6.arpa.") {
+		host, ok := r.byAddr[name]
+		if !ok {
+			log.Debug("address not in hosts files")
+			a.Rcode = dns.RcodeNameError
+			return a, nil
+		}
+		if question.Qtype == dns.TypePTR {
+			a.Answer = append(a.Answer, &dns.PTR{
+				Hdr: dns.RR_Header{Name: question.Name, Rrtype: dns.TypePTR, Class: dns.ClassINET, Ttl: r.TTL},
+				Ptr: host,
+			})
+		}
+		log.WithField("name", host).Debug("responding with hosts name")
+		return a, nil
+	}
+
+	ips, ok := r.byName[name]
+	if !ok {
+		log.Debug("name not in hosts files")
+		a.Rcode = dns.RcodeNameError
+		return a, nil
+	}
+	for _, ip := range ips {
+		hdr := dns.RR_Header{Name: question.Name, Class: dns.ClassINET, Ttl: r.TTL}
+		if ip4 := ip.To4(); ip4 != nil && question.Qtype == dns.TypeA {
+			hdr.Rrtype = dns.TypeA
+			a.Answer = append(a.Answer, &dns.A{Hdr: hdr, A: ip4})
+		} else if ip4 == nil && question.Qtype == dns.TypeAAAA {
+			hdr.Rrtype = dns.TypeAAAA
+			a.Answer = append(a.Answer, &dns.AAAA{Hdr: hdr, AAAA: ip})
+		}
+	}
+	log.WithField("answers", len(a.Answer)).Debug("responding with hosts addresses")
+	return a, nil
+}
+
+func (r *Hosts) String() string {
+	return r.id
+}
+
+// Close stops watching the hosts files for changes.
+func (r *Hosts) Close() error {
+	r.loops.stop()
+	return nil
+}
+
+// ReloadAll reads all hosts files again. The current entries are kept if any
+// of them fail to load.
+func (r *Hosts) ReloadAll() error {
+	files, fingerprint, err := r.files()
+	if err != nil {
+		return err
+	}
+	byName := make(map[string][]net.IP)
+	byAddr := make(map[string]string)
+	for _, file := range files {
+		if err := loadHostsFile(file, byName, byAddr); err != nil {
+			return fmt.Errorf("%s: %w", file, err)
+		}
+	}
+	r.mu.Lock()
+	r.byName = byName
+	r.byAddr = byAddr
+	r.fingerprint = fingerprint
+	r.mu.Unlock()
+	Log.WithField("id", r.id).WithField("names", len(byName)).Debug("loaded hosts files")
+	return nil
+}
+
+// Returns the hosts files in the configured paths, and a fingerprint that
+// changes when any of them is added, removed or modified.
+func (r *Hosts) files() ([]string, string, error) {
+	var (
+		files       []string
+		fingerprint strings.Builder
+	)
+	add := func(path string, fi os.FileInfo) {
+		files = append(files, path)
+		fmt.Fprintf(&fingerprint, "%s:%d:%d\n", path, fi.Size(), fi.ModTime().UnixNano())
+	}
+	for _, path := range r.Paths {
+		fi, err := os.Stat(path)
+		if err != nil {
+			return nil, "", err
+		}
+		if !fi.IsDir() {
+			add(path, fi)
+			continue
+		}
+		entries, err := os.ReadDir(path)
+		if err != nil {
+			return nil, "", err
+		}
+		sort.Slice(entries, func(i, j int) bool { return entries[i].Name() < entries[j].Name() })
+		for _, e := range entries {
+			if strings.HasPrefix(e.Name(), ".") {
+				continue
+			}
+			file := filepath.Join(path, e.Name())
+			fi, err := os.Stat(file)
+			if err != nil || !fi.Mode().IsRegular() {
+				continue
+			}
+			add(file, fi)
+		}
+	}
+	return files, fingerprint.String(), nil
+}
+
+// Checks the files for changes and loads them again if there are any.
+func (r *Hosts) pollLoop() {
+	log := Log.WithField("id", r.id)
+	newRefresher(log, hostsPollInterval).run(r.loops.done(), func() error {
+		_, fingerprint, err := r.files()
+		if err != nil {
+			return err
+		}
+		r.mu.RLock()
+		changed := fingerprint != r.fingerprint
+		r.mu.RUnlock()
+		if !changed {
+			return nil
+		}
+		return r.ReloadAll()
+	})
+}
+
+func loadHostsFile(path string, byName map[string][]net.IP, byAddr map[string]string) error {
+	f, err := os.Open(path)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+	return parseHosts(f, byName, byAddr)
+}
+
+// Reads lines like "192.168.1.10 nas.lan nas" into the maps. The first name
+// of a line is the one used in reverse lookups, unless an earlier line already
+// has the address. Lines that don't start with a valid address are skipped.
+func parseHosts(rd io.Reader, byName map[string][]net.IP, byAddr map[string]string) error {
+	scanner := bufio.NewScanner(rd)
+	for scanner.Scan() {
+		line, _, _ := strings.Cut(scanner.Text(), "#")
+		fields := strings.Fields(line)
+		if len(fields) < 2 {
+			continue
+		}
+		// Link-local addresses can have a zone which isn't used here
+		addr, _, _ := strings.Cut(fields[0], "%")
+		ip := net.ParseIP(addr)
+		if ip == nil {
+			continue
+		}
+		var names []string
+		for _, name := range fields[1:] {
+			name = dns.Fqdn(strings.ToLower(name))
+			if _, ok := dns.IsDomainName(name); !ok {
+				continue
+			}
+			names = append(names, name)
+			if !containsIP(byName[name], ip) {
+				byName[name] = append(byName[name], ip)
+			}
+		}
+		if len(names) == 0 || ip.IsUnspecified() {
+			continue
+		}
+		reverse, err := dns.ReverseAddr(ip.String())
+		if err != nil {
+			continue
+		}
+		if _, ok := byAddr[reverse]; !ok {
+			byAddr[reverse] = names[0]
+		}
+	}
+	return scanner.Err()
+}
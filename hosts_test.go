@@ -0,0 +1,127 @@
+package rdns
+
+import (
+	"os"
+	"path/filepath"
+	"runtime"
+	"testing"
+	"time"
+
+	"github.com/miekg/dns"
+	"github.com/stretchr/testify/require"
+)
+
+func TestHosts(t *testing.T) {
+	dir := t.TempDir()
+	file := filepath.Join(dir, "hosts")
+	require.NoError(t, os.WriteFile(file, []byte(`# Local hosts
+127.0.0.1   localhost
+192.168.1.10 NAS.lan nas   # File server
+fd00::10     nas.lan
+192.168.1.20 printer.lan
+192.168.1.10 storage.lan
+0.0.0.0      ads.example.com
+invalid      broken.lan
+`), 0644))
+	hostsDir := filepath.Join(dir, "hosts.d")
+	require.NoError(t, os.Mkdir(hostsDir, 0755))
+	require.NoError(t, os.WriteFile(filepath.Join(hostsDir, "tv"), []byte("192.168.1.30 tv.lan\n"), 0644))
+	require.NoError(t, os.WriteFile(filepath.Join(hostsDir, ".hidden"), []byte("192.168.1.40 hidden.lan\n"), 0644))
+
+	r, err := NewHosts("test-hosts", HostsOptions{Paths: []string{file, hostsDir}})
+	require.NoError(t, err)
+
+	resolve := func(name string, qtype uint16) *dns.Msg {
+		q := new(dns.Msg)
+		q.SetQuestion(name, qtype)
+		a, err := r.Resolve(q, ClientInfo{})
+		require.NoError(t, err)
+		return a
+	}
+
+	// IPv4 and IPv6, names and aliases are case-insensitive
+	a := resolve("Nas.lan.", dns.TypeA)
+	require.Len(t, a.Answer, 1)
+	require.Equal(t, "192.168.1.10", a.Answer[0].(*dns.A).A.String())
+	require.Equal(t, uint32(60), a.Answer[0].Header().Ttl)
+	a = resolve("nas.lan.", dns.TypeAAAA)
+	require.Len(t, a.Answer, 1)
+	require.Equal(t, "fd00::10", a.Answer[0].(*dns.AAAA).AAAA.String())
+	a = resolve("nas.", dns.TypeA)
+	require.Len(t, a.Answer, 1)
+
+	// NODATA for other types
+	a = resolve("printer.lan.", dns.TypeAAAA)
+	require.Equal(t, dns.RcodeSuccess, a.Rcode)
+	require.Empty(t, a.Answer)
+
+	// Files in directories, except hidden ones
+	a = resolve("tv.lan.", dns.TypeA)
+	require.Equal(t, "192.168.1.30", a.Answer[0].(*dns.A).A.String())
+	a = resolve("hidden.lan.", dns.TypeA)
+	require.Equal(t, dns.RcodeNameError, a.Rcode)
+
+	// Unknown names and lines without a valid address
+	a = resolve("broken.lan.", dns.TypeA)
+	require.Equal(t, dns.RcodeNameError, a.Rcode)
+	a = resolve("unknown.lan.", dns.TypeA)
+	require.Equal(t, dns.RcodeNameError, a.Rcode)
+
+	// Reverse lookups use the first name of the first line with the address
+	a = resolve("10.1.168.192.in-addr.arpa.", dns.TypePTR)
+	require.Len(t, a.Answer, 1)
+	require.Equal(t, "nas.lan.", a.Answer[0].(*dns.PTR).Ptr)
+	reverse, err := dns.ReverseAddr("fd00::10")
+	require.NoError(t, err)
+	a = resolve(reverse, dns.TypePTR)
+	require.Equal(t, "nas.lan.", a.Answer[0].(*dns.PTR).Ptr)
+	a = resolve("0.0.0.0.in-addr.arpa.", dns.TypePTR)
+	require.Equal(t, dns.RcodeNameError, a.Rcode)
+
+	// Missing files fail
+	_, err = NewHosts("test-hosts", HostsOptions{Paths: []string{filepath.Join(dir, "missing")}})
+	require.Error(t, err)
+}
+
+func TestHostsWatch(t *testing.T) {
+	if runtime.GOOS != "linux" {
+		t.Skip("files are only watched on linux")
+	}
+	dir := t.TempDir()
+	file := filepath.Join(dir, "hosts")
+	require.NoError(t, os.WriteFile(file, []byte("192.168.1.10 nas.lan\n"), 0644))
+	hostsDir := filepath.Join(dir, "hosts.d")
+	require.NoError(t, os.Mkdir(hostsDir, 0755))
+
+	r, err := NewHosts("test-hosts-watch", HostsOptions{Paths: []string{file, hostsDir}})
+	require.NoError(t, err)
+
+	lookup := func(name string) string {
+		q := new(dns.Msg)
+		q.SetQuestion(name, dns.TypeA)
+		a, err := r.Resolve(q, ClientInfo{})
+		require.NoError(t, err)
+		if len(a.Answer) == 0 {
+			return ""
+		}
+		return a.Answer[0].(*dns.A).A.String()
+	}
+	require.Equal(t, "192.168.1.10", lookup("nas.lan."))
+
+	// Written in place
+	require.NoError(t, os.WriteFile(file, []byte("192.168.1.20 nas.lan\n"), 0644))
+	require.Eventually(t, func() bool { return lookup("nas.lan.") == "192.168.1.20" }, time.Second, 10*time.Millisecond)
+
+	// Replaced by renaming a new file
+	tmp := filepath.Join(dir, "hosts.tmp")
+	require.NoError(t, os.WriteFile(tmp, []byte("192.168.1.30 nas.lan\n"), 0644))
+	require.NoError(t, os.Rename(tmp, file))
+	require.Eventually(t, func() bool { return lookup("nas.lan.") == "192.168.1.30" }, time.Second, 10*time.Millisecond)
+
+	// Added to and removed from a directory
+	tv := filepath.Join(hostsDir, "tv")
+	require.NoError(t, os.WriteFile(tv, []byte("192.168.1.40 tv.lan\n"), 0644))
+	require.Eventually(t, func() bool { return lookup("tv.lan.") == "192.168.1.40" }, time.Second, 10*time.Millisecond)
+	require.NoError(t, os.Remove(tv))
+	require.Eventually(t, func() bool { return lookup("tv.lan.") == "" }, time.Second, 10*time.Millisecond)
+}
@@ -0,0 +1,72 @@
+package rdns
+
+import (
+	"sync/atomic"
+	"time"
+
+	"github.com/miekg/dns"
+)
+
+// HotSwapResolver forwards queries to a resolver that can be replaced at
+// runtime, for example when the configuration is reloaded. Listeners can keep
+// their sockets and client connections open while the pipeline behind them is
+// rebuilt.
+type HotSwapResolver struct {
+	current atomic.Pointer[hotSwapTarget]
+}
+
+var _ Resolver = &HotSwapResolver{}
+
+// Resolver that queries are forwarded to, and the number of queries it's
+// currently handling.
+type hotSwapTarget struct {
+	resolver Resolver
+	inflight atomic.Int64
+}
+
+// NewHotSwapResolver returns a new instance of a resolver that forwards to r
+// until it's replaced.
+func NewHotSwapResolver(r Resolver) *HotSwapResolver {
+	h := new(HotSwapResolver)
+	h.current.Store(&hotSwapTarget{resolver: r})
+	return h
+}
+
+// Resolve forwards the query to the current resolver.
+func (r *HotSwapResolver) Resolve(q *dns.Msg, ci ClientInfo) (*dns.Msg, error) {
+	for {
+		t := r.current.Load()
+		t.inflight.Add(1)
+
+		// The resolver could have been swapped after it was loaded, in which
+		// case Swap may already have seen no queries in flight and returned.
+		// Only use it if it's still the current one after counting the query.
+		if r.current.Load() != t {
+			t.inflight.Add(-1)
+			continue
+		}
+		defer t.inflight.Add(-1)
+		return t.resolver.Resolve(q, ci)
+	}
+}
+
+// Swap replaces the resolver. New queries are sent to the new resolver right
+// away. The call blocks until the queries still being handled by the previous
+// resolver are completed, or the timeout expires. Returns false if the timeout
+// expired first.
+func (r *HotSwapResolver) Swap(resolver Resolver, timeout time.Duration) bool {
+	old := r.current.Swap(&hotSwapTarget{resolver: resolver})
+	deadline := time.Now().Add(timeout)
+	for old.inflight.Load() > 0 {
+		if time.Now().After(deadline) {
+			return false
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+	return true
+}
+
+// String returns the name of the current resolver.
+func (r *HotSwapResolver) String() string {
+	return r.current.Load().resolver.String()
+}
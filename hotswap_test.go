@@ -0,0 +1,115 @@
+package rdns
+
+import (
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/miekg/dns"
+	"github.com/stretchr/testify/require"
+)
+
+// Returns a resolver that blocks until released, and a channel that is closed
+// once it received a query.
+func blockingTestResolver(release chan struct{}) (*TestResolver, chan struct{}) {
+	started := make(chan struct{})
+	return &TestResolver{
+		ResolveFunc: func(q *dns.Msg, ci ClientInfo) (*dns.Msg, error) {
+			close(started)
+			<-release
+			return q, nil
+		},
+	}, started
+}
+
+func TestHotSwapResolver(t *testing.T) {
+	q := new(dns.Msg)
+	q.SetQuestion("example.com.", dns.TypeA)
+
+	release := make(chan struct{})
+	r1, started := blockingTestResolver(release)
+	r2 := new(TestResolver)
+	h := NewHotSwapResolver(r1)
+
+	done := make(chan error, 1)
+	go func() {
+		_, err := h.Resolve(q, ClientInfo{})
+		done <- err
+	}()
+	<-started
+
+	// Swap waits for the query in the old resolver to complete
+	go func() {
+		time.Sleep(20 * time.Millisecond)
+		close(release)
+	}()
+	require.True(t, h.Swap(r2, time.Second))
+	require.NoError(t, <-done)
+
+	// New queries go to the new resolver
+	_, err := h.Resolve(q, ClientInfo{})
+	require.NoError(t, err)
+	require.Equal(t, 1, r1.HitCount())
+	require.Equal(t, 1, r2.HitCount())
+}
+
+func TestHotSwapResolverTimeout(t *testing.T) {
+	q := new(dns.Msg)
+	q.SetQuestion("example.com.", dns.TypeA)
+
+	release := make(chan struct{})
+	defer close(release)
+	r1, started := blockingTestResolver(release)
+	h := NewHotSwapResolver(r1)
+
+	go h.Resolve(q, ClientInfo{})
+	<-started
+
+	// The query is still in progress when the timeout expires
+	require.False(t, h.Swap(new(TestResolver), 50*time.Millisecond))
+}
+
+// Queries that start while the resolver is swapped either complete before Swap
+// returns, or go to the new resolver.
+func TestHotSwapResolverConcurrentSwap(t *testing.T) {
+	q := new(dns.Msg)
+	q.SetQuestion("example.com.", dns.TypeA)
+
+	for i := 0; i < 100; i++ {
+		var swapped atomic.Bool
+		late := make(chan struct{}, 1)
+		old := &TestResolver{
+			ResolveFunc: func(q *dns.Msg, ci ClientInfo) (*dns.Msg, error) {
+				if swapped.Load() {
+					select {
+					case late <- struct{}{}:
+					default:
+					}
+				}
+				return q, nil
+			},
+		}
+		h := NewHotSwapResolver(old)
+
+		var wg sync.WaitGroup
+		for j := 0; j < 4; j++ {
+			wg.Add(1)
+			go func() {
+				defer wg.Done()
+				for k := 0; k < 50; k++ {
+					h.Resolve(q, ClientInfo{})
+				}
+			}()
+		}
+		require.True(t, h.Swap(new(TestResolver), time.Second))
+		swapped.Store(true)
+		wg.Wait()
+
+		select {
+		case <-late:
+			t.Fatal("old resolver used after swap completed")
+		default:
+		}
+	}
+}
@@ -0,0 +1,109 @@
+package rdns
+
+import (
+	"bufio"
+	"encoding/base64"
+	"fmt"
+	"net"
+	"net/http"
+	"net/url"
+	"time"
+)
+
+// HTTPProxyDialer opens TCP connections through an HTTP proxy with the CONNECT
+// method. UDP is not supported.
+type HTTPProxyDialer struct {
+	addr string
+	opt  HTTPProxyDialerOptions
+}
+
+type HTTPProxyDialerOptions struct {
+	// Credentials for basic authentication with the proxy, optional.
+	Username string
+	Password string
+
+	// Timeout for connecting to the proxy and establishing the tunnel.
+	// Defaults to 10 seconds.
+	Timeout time.Duration
+
+	LocalAddr net.IP
+}
+
+var _ Dialer = (*HTTPProxyDialer)(nil)
+
+const defaultHTTPProxyTimeout = 10 * time.Second
+
+// NewHTTPProxyDialer returns a dialer for the HTTP proxy at addr (host:port).
+func NewHTTPProxyDialer(addr string, opt HTTPProxyDialerOptions) *HTTPProxyDialer {
+	if opt.Timeout == 0 {
+		opt.Timeout = defaultHTTPProxyTimeout
+	}
+	return &HTTPProxyDialer{addr: addr, opt: opt}
+}
+
+func (d *HTTPProxyDialer) Dial(network string, address string) (net.Conn, error) {
+	switch network {
+	case "tcp", "tcp4", "tcp6":
+	default:
+		return nil, fmt.Errorf("network %q not supported by http proxy", network)
+	}
+	dialer := net.Dialer{Timeout: d.opt.Timeout}
+	if d.opt.LocalAddr != nil {
+		dialer.LocalAddr = &net.TCPAddr{IP: d.opt.LocalAddr}
+	}
+	conn, err := dialer.Dial(network, d.addr)
+	if err != nil {
+		return nil, err
+	}
+	if err := conn.SetDeadline(time.Now().Add(d.opt.Timeout)); err != nil {
+		conn.Close()
+		return nil, err
+	}
+
+	req := &http.Request{
+		Method: http.MethodConnect,
+		URL:    &url.URL{Opaque: address},
+		Host:   address,
+		Header: make(http.Header),
+	}
+	if d.opt.Username != "" || d.opt.Password != "" {
+		credentials := base64.StdEncoding.EncodeToString([]byte(d.opt.Username + ":" + d.opt.Password))
+		req.Header.Set("Proxy-Authorization", "Basic "+credentials)
+	}
+	if err := req.Write(conn); err != nil {
+		conn.Close()
+		return nil, err
+	}
+	br := bufio.NewReader(conn)
+	resp, err := http.ReadResponse(br, req)
+	if err != nil {
+		conn.Close()
+		return nil, err
+	}
+	resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		conn.Close()
+		return nil, fmt.Errorf("http proxy %s failed to connect to %s: %s", d.addr, address, resp.Status)
+	}
+	if err := conn.SetDeadline(time.Time{}); err != nil {
+		conn.Close()
+		return nil, err
+	}
+
+	// The server could have sent data right after the response, which would
+	// already be in the buffer
+	if br.Buffered() > 0 {
+		return &bufferedConn{Conn: conn, r: br}, nil
+	}
+	return conn, nil
+}
+
+// Connection with data that was read ahead in a buffer.
+type bufferedConn struct {
+	net.Conn
+	r *bufio.Reader
+}
+
+func (c *bufferedConn) Read(b []byte) (int, error) {
+	return c.r.Read(b)
+}
@@ -0,0 +1,88 @@
+package rdns
+
+import (
+	"bufio"
+	"encoding/base64"
+	"io"
+	"net"
+	"net/http"
+	"testing"
+
+	"github.com/stretchr/testify/require"
+)
+
+// Start a proxy that supports CONNECT and requires basic authentication.
+func startTestHTTPProxy(t *testing.T, username, password string) net.Listener {
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	require.NoError(t, err)
+	go func() {
+		for {
+			conn, err := ln.Accept()
+			if err != nil {
+				return
+			}
+			go func() {
+				defer conn.Close()
+				req, err := http.ReadRequest(bufio.NewReader(conn))
+				if err != nil {
+					return
+				}
+				if req.Header.Get("Proxy-Authorization") != "Basic "+base64.StdEncoding.EncodeToString([]byte(username+":"+password)) {
+					_, _ = io.WriteString(conn, "HTTP/1.1 407 Proxy Authentication Required\r\n\r\n")
+					return
+				}
+				upstream, err := net.Dial("tcp", req.Host)
+				if err != nil {
+					_, _ = io.WriteString(conn, "HTTP/1.1 502 Bad Gateway\r\n\r\n")
+					return
+				}
+				defer upstream.Close()
+				_, _ = io.WriteString(conn, "HTTP/1.1 200 Connection established\r\n\r\n")
+				go func() { _, _ = io.Copy(upstream, conn) }()
+				_, _ = io.Copy(conn, upstream)
+			}()
+		}
+	}()
+	return ln
+}
+
+func TestHTTPProxyDialer(t *testing.T) {
+	// Echo server as upstream
+	echo, err := net.Listen("tcp", "127.0.0.1:0")
+	require.NoError(t, err)
+	defer echo.Close()
+	go func() {
+		for {
+			conn, err := echo.Accept()
+			if err != nil {
+				return
+			}
+			go func() {
+				defer conn.Close()
+				_, _ = io.Copy(conn, conn)
+			}()
+		}
+	}()
+	proxy := startTestHTTPProxy(t, "user", "secret")
+	defer proxy.Close()
+
+	d := NewHTTPProxyDialer(proxy.Addr().String(), HTTPProxyDialerOptions{Username: "user", Password: "secret"})
+	conn, err := d.Dial("tcp", echo.Addr().String())
+	require.NoError(t, err)
+	defer conn.Close()
+	_, err = conn.Write([]byte("hello"))
+	require.NoError(t, err)
+	b := make([]byte, 5)
+	_, err = io.ReadFull(conn, b)
+	require.NoError(t, err)
+	require.Equal(t, "hello", string(b))
+
+	// Wrong credentials
+	d = NewHTTPProxyDialer(proxy.Addr().String(), HTTPProxyDialerOptions{Username: "user", Password: "wrong"})
+	_, err = d.Dial("tcp", echo.Addr().String())
+	require.ErrorContains(t, err, "407")
+
+	// UDP can't be proxied
+	_, err = d.Dial("udp", echo.Addr().String())
+	require.Error(t, err)
+}
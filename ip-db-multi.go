@@ -50,3 +50,26 @@ func (m MultiIPDB) Close() error {
 func (m MultiIPDB) String() string {
 	return "Multi-IP-blocklist"
 }
+
+// Closes the parts of an IP blocklist DB that were replaced in a reload. DBs
+// return themselves from Reload if their rules haven't changed, those need to
+// stay open.
+func closeReplacedIPDB(old, reloaded IPBlocklistDB) error {
+	if oldMulti, ok := old.(MultiIPDB); ok {
+		reloadedMulti, ok := reloaded.(MultiIPDB)
+		if !ok || len(oldMulti.dbs) != len(reloadedMulti.dbs) {
+			return old.Close()
+		}
+		var closeErr error
+		for i := range oldMulti.dbs {
+			if err := closeReplacedIPDB(oldMulti.dbs[i], reloadedMulti.dbs[i]); closeErr == nil {
+				closeErr = err
+			}
+		}
+		return closeErr
+	}
+	if old == reloaded {
+		return nil
+	}
+	return old.Close()
+}
@@ -0,0 +1,109 @@
+package rdns
+
+import "net"
+
+// Binary trie used to find the most specific (longest prefix) network an IP is
+// contained in. Unlike ipBlocklistTrie which only needs to know if an IP is
+// covered at all, this trie keeps all networks and stores an index with each
+// of them. Callers use the index to look up what is associated with the network.
+type ipPrefixTrie struct {
+	root *ipPrefixNode
+}
+
+type ipPrefixNode struct {
+	left, right *ipPrefixNode
+	leaf        bool
+	index       int
+}
+
+// Add a network to the trie. If the same network is added more than once,
+// the first index is kept.
+func (t *ipPrefixTrie) add(n *net.IPNet, index int) {
+	if t.root == nil {
+		t.root = new(ipPrefixNode)
+	}
+	ip := n.IP
+	if addr := ip.To4(); addr != nil {
+		ip = addr
+	}
+	prefix, _ := n.Mask.Size()
+	p := t.root
+	for i := 0; i < prefix; i++ {
+		if bit(ip, i) == 1 {
+			if p.right == nil {
+				p.right = new(ipPrefixNode)
+			}
+			p = p.right
+		} else {
+			if p.left == nil {
+				p.left = new(ipPrefixNode)
+			}
+			p = p.left
+		}
+	}
+	if p.leaf {
+		return
+	}
+	p.leaf = true
+	p.index = index
+}
+
+// Returns the index of the most specific network containing the IP.
+func (t *ipPrefixTrie) lookup(ip net.IP) (int, bool) {
+	if t.root == nil {
+		return 0, false
+	}
+	size := 8 * len(ip)
+	var (
+		index int
+		found bool
+	)
+	p := t.root
+	for i := 0; ; i++ {
+		if p.leaf {
+			index, found = p.index, true
+		}
+		if i >= size {
+			break
+		}
+		if bit(ip, i) == 1 {
+			p = p.right
+		} else {
+			p = p.left
+		}
+		if p == nil {
+			break
+		}
+	}
+	return index, found
+}
+
+// ipNetworks holds IPv4 and IPv6 networks in separate tries. IPv4-mapped IPv6
+// addresses are matched against IPv4 networks.
+type ipNetworks struct {
+	ip4, ip6 ipPrefixTrie
+}
+
+func (n *ipNetworks) add(network *net.IPNet, index int) {
+	if len(network.IP) == net.IPv4len || isIPv4Net(network) {
+		n.ip4.add(network, index)
+		return
+	}
+	n.ip6.add(network, index)
+}
+
+func (n *ipNetworks) lookup(ip net.IP) (int, bool) {
+	if ip4 := ip.To4(); ip4 != nil {
+		return n.ip4.lookup(ip4)
+	}
+	if len(ip) != net.IPv6len {
+		return 0, false
+	}
+	return n.ip6.lookup(ip)
+}
+
+// Returns true if the network is an IPv4 network stored in 16-byte form.
+func isIPv4Net(n *net.IPNet) bool {
+	_, bits := n.Mask.Size()
+	return bits == 32
+}
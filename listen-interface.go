@@ -0,0 +1,215 @@
+package rdns
+
+import (
+	"context"
+	"fmt"
+	"net"
+	"sort"
+	"sync"
+	"time"
+
+	"github.com/miekg/dns"
+	"github.com/sirupsen/logrus"
+)
+
+// Default interval in which the addresses of an interface are checked for
+// changes.
+const defaultInterfaceRefresh = 10 * time.Second
+
+// Opens a TCP listener on the address, bound to the interface and reading
+// PROXY protocol headers if configured.
+func (opt ListenOptions) listenTCP(addr string) (net.Listener, error) {
+	ln, err := opt.listenConfig().Listen(context.Background(), "tcp", addr)
+	if err != nil {
+		return nil, err
+	}
+	if opt.ProxyProtocol {
+		ln = NewProxyProtocolListener(ln, opt.ProxyProtocolNet)
+	}
+	return ln, nil
+}
+
+// Opens a UDP socket on the address, bound to the interface if configured.
+func (opt ListenOptions) listenUDP(addr string) (net.PacketConn, error) {
+	return opt.listenConfig().ListenPacket(context.Background(), "udp", addr)
+}
+
+func (opt ListenOptions) listenConfig() *net.ListenConfig {
+	lc := new(net.ListenConfig)
+	if opt.BindInterface != "" {
+		lc.Control = bindToDevice(opt.BindInterface)
+	}
+	return lc
+}
+
+// interfaceServers runs a DNS server on every address of a network interface,
+// including link-local IPv6 addresses with zone. The addresses are checked
+// periodically, servers are started for new addresses and stopped for those
+// that went away, for example after a DHCP or prefix delegation change.
+type interfaceServers struct {
+	iface     string
+	addr      string
+	refresh   time.Duration
+	newServer func(addr string) (*dns.Server, error)
+	lookup    func(iface string) ([]string, error)
+	log       *logrus.Entry
+
+	mu      sync.Mutex
+	servers map[string]*dns.Server
+	done    chan struct{}
+	once    sync.Once
+}
+
+// Returns servers for the interface. The port is taken from addr, which must
+// not have a host. newServer is called with the address of every server and
+// has to return it ready to be activated.
+func newInterfaceServers(id, iface, addr string, refresh time.Duration, newServer func(addr string) (*dns.Server, error)) *interfaceServers {
+	if refresh == 0 {
+		refresh = defaultInterfaceRefresh
+	}
+	return &interfaceServers{
+		iface:     iface,
+		addr:      addr,
+		refresh:   refresh,
+		newServer: newServer,
+		lookup:    interfaceAddrs,
+		log:       Log.WithFields(logrus.Fields{"id": id, "interface": iface}),
+		servers:   make(map[string]*dns.Server),
+		done:      make(chan struct{}),
+	}
+}
+
+// Run the servers and follow address changes until stopped.
+func (s *interfaceServers) run() error {
+	host, port, err := net.SplitHostPort(s.addr)
+	if err != nil {
+		return err
+	}
+	if host != "" {
+		return fmt.Errorf("address '%s' can't have a host when listening on the addresses of an interface", s.addr)
+	}
+	ticker := time.NewTicker(s.refresh)
+	defer ticker.Stop()
+	for {
+		s.update(port)
+		select {
+		case <-s.done:
+			return nil
+		case <-ticker.C:
+		}
+	}
+}
+
+// Stop all servers.
+func (s *interfaceServers) stop() error {
+	s.once.Do(func() { close(s.done) })
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	for addr, srv := range s.servers {
+		_ = srv.Shutdown()
+		delete(s.servers, addr)
+	}
+	return nil
+}
+
+// Returns the addresses servers are currently running on, sorted.
+func (s *interfaceServers) addrs() []string {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	addrs := make([]string, 0, len(s.servers))
+	for addr := range s.servers {
+		addrs = append(addrs, addr)
+	}
+	sort.Strings(addrs)
+	return addrs
+}
+
+// Start and stop servers to match the current addresses of the interface.
+func (s *interfaceServers) update(port string) {
+	hosts, err := s.lookup(s.iface)
+	if err != nil {
+		// Keep the current servers, the interface may only be down for now
+		s.log.WithError(err).Warn("failed to read interface addresses")
+		return
+	}
+	want := make(map[string]struct{}, len(hosts))
+	for _, host := range hosts {
+		want[net.JoinHostPort(host, port)] = struct{}{}
+	}
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	select {
+	case <-s.done:
+		return
+	default:
+	}
+	for addr, srv := range s.servers {
+		if _, ok := want[addr]; ok {
+			continue
+		}
+		s.log.WithField("addr", addr).Info("address removed, stopping server")
+		_ = srv.Shutdown()
+		delete(s.servers, addr)
+	}
+	for addr := range want {
+		if _, ok := s.servers[addr]; ok {
+			continue
+		}
+		srv, err := s.newServer(addr)
+		if err != nil {
+			// New IPv6 addresses can't be bound to until duplicate address
+			// detection is done, try again later
+			s.log.WithError(err).WithField("addr", addr).Warn("failed to bind to address")
+			continue
+		}
+		s.log.WithField("addr", addr).Info("starting server on interface address")
+		s.servers[addr] = srv
+		go s.serve(addr, srv)
+	}
+	if len(want) == 0 {
+		s.log.Warn("no addresses on interface")
+	}
+}
+
+func (s *interfaceServers) serve(addr string, srv *dns.Server) {
+	err := srv.ActivateAndServe()
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if s.servers[addr] != srv {
+		return
+	}
+	// The server failed on its own, it's started again on the next update
+	s.log.WithError(err).WithField("addr", addr).Error("server failed")
+	delete(s.servers, addr)
+}
+
+// Returns the unicast addresses of an interface. Link-local IPv6 addresses
+// contain the interface as zone.
+func interfaceAddrs(name string) ([]string, error) {
+	ifi, err := net.InterfaceByName(name)
+	if err != nil {
+		return nil, err
+	}
+	addrs, err := ifi.Addrs()
+	if err != nil {
+		return nil, err
+	}
+	var hosts []string
+	for _, addr := range addrs {
+		ipNet, ok := addr.(*net.IPNet)
+		if !ok {
+			continue
+		}
+		ip := ipNet.IP
+		switch {
+		case ip.IsMulticast() || ip.IsUnspecified():
+			continue
+		case ip.To4() == nil && ip.IsLinkLocalUnicast():
+			hosts = append(hosts, ip.String()+"%"+name)
+		default:
+			hosts = append(hosts, ip.String())
+		}
+	}
+	return hosts, nil
+}
@@ -0,0 +1,100 @@
+//go:build linux
+
+package rdns
+
+import (
+	"errors"
+	"net"
+	"strings"
+	"syscall"
+	"testing"
+	"time"
+
+	"github.com/miekg/dns"
+	"github.com/stretchr/testify/require"
+)
+
+func TestInterfaceAddrs(t *testing.T) {
+	hosts, err := interfaceAddrs("lo")
+	require.NoError(t, err)
+	require.Contains(t, hosts, "127.0.0.1")
+
+	_, err = interfaceAddrs("does-not-exist")
+	require.Error(t, err)
+}
+
+func TestDNSListenerInterfaceAddrs(t *testing.T) {
+	addr, err := getLnAddress()
+	require.NoError(t, err)
+	_, port, err := net.SplitHostPort(addr)
+	require.NoError(t, err)
+
+	upstream := new(TestResolver)
+	s := NewDNSListener("test-interface-addrs", ":"+port, "udp", ListenOptions{InterfaceAddrs: "lo"}, upstream)
+
+	// Simulate the address of the interface changing
+	hosts := []string{"127.0.0.1"}
+	s.ifaces.lookup = func(string) ([]string, error) { return hosts, nil }
+	s.ifaces.update(port)
+	defer s.Shutdown()
+	require.Equal(t, []string{net.JoinHostPort("127.0.0.1", port)}, s.ifaces.addrs())
+
+	c := &dns.Client{Timeout: time.Second}
+	q := new(dns.Msg)
+	q.SetQuestion("example.com.", dns.TypeA)
+	require.Eventually(t, func() bool {
+		_, _, err := c.Exchange(q, net.JoinHostPort("127.0.0.1", port))
+		return err == nil
+	}, 2*time.Second, 50*time.Millisecond)
+
+	// The server moves to the new address
+	hosts = []string{"127.0.0.2"}
+	s.ifaces.update(port)
+	require.Equal(t, []string{net.JoinHostPort("127.0.0.2", port)}, s.ifaces.addrs())
+	require.Eventually(t, func() bool {
+		_, _, err := c.Exchange(q, net.JoinHostPort("127.0.0.2", port))
+		return err == nil
+	}, 2*time.Second, 50*time.Millisecond)
+	_, _, err = c.Exchange(q, net.JoinHostPort("127.0.0.1", port))
+	require.Error(t, err)
+
+	// Failing lookups keep the current servers
+	s.ifaces.lookup = func(string) ([]string, error) { return nil, errors.New("interface down") }
+	s.ifaces.update(port)
+	require.Equal(t, []string{net.JoinHostPort("127.0.0.2", port)}, s.ifaces.addrs())
+
+	require.NoError(t, s.Shutdown())
+	require.Empty(t, s.ifaces.addrs())
+}
+
+func TestDNSListenerBindInterface(t *testing.T) {
+	addr, err := getLnAddress()
+	require.NoError(t, err)
+	upstream := new(TestResolver)
+	s := NewDNSListener("test-bind-interface", addr, "tcp", ListenOptions{BindInterface: "lo"}, upstream)
+	errs := make(chan error, 1)
+	go func() { errs <- s.Start() }()
+	defer s.Shutdown()
+
+	select {
+	case err := <-errs:
+		if errors.Is(err, syscall.EPERM) {
+			t.Skip("no permission to bind to an interface")
+		}
+		require.NoError(t, err)
+	case <-time.After(500 * time.Millisecond):
+	}
+
+	c := &dns.Client{Net: "tcp", Timeout: time.Second}
+	q := new(dns.Msg)
+	q.SetQuestion("example.com.", dns.TypeA)
+	_, _, err = c.Exchange(q, addr)
+	require.NoError(t, err)
+	require.Equal(t, 1, upstream.HitCount())
+
+	// Binding to an interface that doesn't exist fails
+	s2 := NewDNSListener("test-bind-interface-missing", addr, "udp", ListenOptions{BindInterface: "does-not-exist"}, upstream)
+	err = s2.Start()
+	require.Error(t, err)
+	require.True(t, strings.Contains(err.Error(), "no such device"), err.Error())
+}
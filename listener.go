@@ -1,9 +1,12 @@
 package rdns
 
 import (
+	"crypto/tls"
 	"expvar"
 	"fmt"
 	"net"
+	"regexp"
+	"time"
 )
 
 // Listener is an interface for a DNS listener.
@@ -24,9 +27,57 @@ type ClientInfo struct {
 	// TLS SNI server name
 	TLSServerName string
 
+	// Identities in the verified TLS client certificate, the subject common
+	// name followed by the DNS, email and URI SANs. Only populated when the
+	// listener requires client certificates (mutual TLS).
+	TLSClientNames []string
+
 	// Listener ID of the listener that first received the request. Can be
 	// used to route queries.
 	Listener string
+
+	// Time by which the response is needed, set by listeners with a
+	// QueryDeadline. Clients don't wait for upstream responses past it. No
+	// limit if zero.
+	Deadline time.Time
+
+	// Closed when the response is no longer needed, for example because
+	// another resolver in a racing group answered first. Clients that
+	// support it stop waiting for the upstream response. Never closed if nil.
+	Done <-chan struct{}
+}
+
+// Returns the identities of the verified client certificate of a TLS
+// connection. Certificates that weren't verified are ignored.
+func tlsClientNames(cs *tls.ConnectionState) []string {
+	if cs == nil || len(cs.VerifiedChains) == 0 || len(cs.VerifiedChains[0]) == 0 {
+		return nil
+	}
+	cert := cs.VerifiedChains[0][0]
+	candidates := []string{cert.Subject.CommonName}
+	candidates = append(candidates, cert.DNSNames...)
+	candidates = append(candidates, cert.EmailAddresses...)
+	for _, u := range cert.URIs {
+		candidates = append(candidates, u.String())
+	}
+	var names []string
+	for _, name := range candidates {
+		if name != "" {
+			names = append(names, name)
+		}
+	}
+	return names
+}
+
+// Returns true if any of the client certificate identities matches the
+// regexp.
+func matchTLSClientName(re *regexp.Regexp, names []string) bool {
+	for _, name := range names {
+		if re.MatchString(name) {
+			return true
+		}
+	}
+	return false
 }
 
 // Metrics that are available from listeners and clients.
@@ -0,0 +1,192 @@
+package rdns
+
+import (
+	"expvar"
+	"slices"
+	"sync"
+	"time"
+
+	"github.com/miekg/dns"
+)
+
+// LowestLatency is a resolver group that measures the response time of its
+// resolvers and sends queries to the one with the lowest latency. Response
+// times are tracked as exponentially weighted moving average. To notice when
+// a slower resolver becomes faster, for example after moving to a different
+// network, a copy of a query is sent to each of the other resolvers in the
+// background at regular intervals. Failed queries are retried on the next
+// fastest resolver.
+type LowestLatency struct {
+	id        string
+	resolvers []Resolver
+	opt       LowestLatencyOptions
+
+	mu    sync.Mutex
+	stats []latencyStats
+
+	route   *expvar.Map
+	failure *expvar.Map
+}
+
+var _ Resolver = &LowestLatency{}
+
+// LowestLatencyOptions contain settings for the lowest-latency resolver group.
+type LowestLatencyOptions struct {
+	// Weight of a new measurement in the moving average, between 0 and 1.
+	// Higher values react quicker to changes. Default 0.3.
+	Smoothing float64
+
+	// Send a copy of a query to a resolver that isn't the fastest if its last
+	// measurement is older than this. Default 1 minute.
+	ReprobeInterval time.Duration
+
+	// Response time recorded for a resolver when a query fails. Default 2 seconds.
+	FailurePenalty time.Duration
+
+	// Determines if a SERVFAIL returned by a resolver should be considered an
+	// error response.
+	ServfailError bool
+}
+
+type latencyStats struct {
+	rtt      time.Duration // moving average
+	measured bool
+	last     time.Time // time of the last measurement
+	gauge    *expvar.Int
+}
+
+// NewLowestLatency returns a new instance of a resolver group that sends queries
+// to the resolver with the lowest response time.
+func NewLowestLatency(id string, opt LowestLatencyOptions, resolvers ...Resolver) *LowestLatency {
+	if opt.Smoothing <= 0 || opt.Smoothing > 1 {
+		opt.Smoothing = 0.3
+	}
+	if opt.ReprobeInterval == 0 {
+		opt.ReprobeInterval = time.Minute
+	}
+	if opt.FailurePenalty == 0 {
+		opt.FailurePenalty = 2 * time.Second
+	}
+	r := &LowestLatency{
+		id:        id,
+		resolvers: resolvers,
+		opt:       opt,
+		stats:     make([]latencyStats, len(resolvers)),
+		route:     getVarMap("router", id, "route"),
+		failure:   getVarMap("router", id, "failure"),
+	}
+	latency := getVarMap("router", id, "latency")
+	for i, resolver := range resolvers {
+		r.stats[i].gauge = new(expvar.Int)
+		latency.Set(resolver.String(), r.stats[i].gauge)
+	}
+	return r
+}
+
+// Resolve a DNS query with the fastest resolver, trying the others in order
+// of their response time if it fails.
+func (r *LowestLatency) Resolve(q *dns.Msg, ci ClientInfo) (*dns.Msg, error) {
+	log := logger(r.id, q, ci)
+	order := r.order()
+	r.reprobe(q, ci, order[0])
+
+	var (
+		a   *dns.Msg
+		err error
+	)
+	for _, i := range order {
+		resolver := r.resolvers[i]
+		log.WithField("resolver", resolver.String()).Debug("forwarding query to resolver")
+		r.route.Add(resolver.String(), 1)
+		start := time.Now()
+		a, err = resolver.Resolve(q, ci)
+		if err == nil && r.isSuccessResponse(a) {
+			r.record(i, time.Since(start))
+			return a, nil
+		}
+		log.WithField("resolver", resolver.String()).WithError(err).Debug("resolver returned failure")
+		r.failure.Add(resolver.String(), 1)
+		r.record(i, r.opt.FailurePenalty)
+	}
+	return a, err
+}
+
+func (r *LowestLatency) String() string {
+	return r.id
+}
+
+// Returns the resolver indexes ordered by response time. Resolvers that
+// haven't been measured yet come first so they're tried right away.
+func (r *LowestLatency) order() []int {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	order := make([]int, len(r.resolvers))
+	for i := range order {
+		order[i] = i
+	}
+	slices.SortStableFunc(order, func(a, b int) int {
+		sa, sb := r.stats[a], r.stats[b]
+		switch {
+		case sa.measured != sb.measured:
+			if !sa.measured {
+				return -1
+			}
+			return 1
+		case sa.rtt < sb.rtt:
+			return -1
+		case sa.rtt > sb.rtt:
+			return 1
+		}
+		return 0
+	})
+	return order
+}
+
+// Send a copy of the query to all resolvers other than the selected one that
+// haven't been measured recently. The responses are only used to update the
+// response times.
+func (r *LowestLatency) reprobe(q *dns.Msg, ci ClientInfo, selected int) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	now := time.Now()
+	for i, resolver := range r.resolvers {
+		if i == selected || now.Sub(r.stats[i].last) < r.opt.ReprobeInterval {
+			continue
+		}
+		// Mark it as measured now so concurrent queries don't probe it as well
+		r.stats[i].last = now
+		probeCI := ci
+		probeCI.Done = nil // the probe outlives the client query
+		go func(i int, resolver Resolver) {
+			logger(r.id, q, ci).WithField("resolver", resolver.String()).Debug("probing resolver latency")
+			start := time.Now()
+			a, err := resolver.Resolve(q.Copy(), probeCI)
+			if err == nil && r.isSuccessResponse(a) {
+				r.record(i, time.Since(start))
+				return
+			}
+			r.failure.Add(resolver.String(), 1)
+			r.record(i, r.opt.FailurePenalty)
+		}(i, resolver)
+	}
+}
+
+// Add a response time measurement for resolver i to its moving average.
+func (r *LowestLatency) record(i int, rtt time.Duration) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	s := &r.stats[i]
+	if s.measured {
+		s.rtt = time.Duration(r.opt.Smoothing*float64(rtt) + (1-r.opt.Smoothing)*float64(s.rtt))
+	} else {
+		s.rtt = rtt
+		s.measured = true
+	}
+	s.last = time.Now()
+	s.gauge.Set(s.rtt.Milliseconds())
+}
+
+// Returns true is the response is considered successful given the options.
+func (r *LowestLatency) isSuccessResponse(a *dns.Msg) bool {
+	return a == nil || !(r.opt.ServfailError && a.Rcode == dns.RcodeServerFailure)
+}
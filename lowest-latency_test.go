@@ -0,0 +1,79 @@
+package rdns
+
+import (
+	"errors"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/miekg/dns"
+	"github.com/stretchr/testify/require"
+)
+
+func TestLowestLatency(t *testing.T) {
+	var slowHits, fastHits atomic.Int32
+	var fastFail atomic.Bool
+	slow := &TestResolver{
+		ResolveFunc: func(q *dns.Msg, ci ClientInfo) (*dns.Msg, error) {
+			slowHits.Add(1)
+			time.Sleep(50 * time.Millisecond)
+			return q, nil
+		},
+	}
+	fast := &TestResolver{
+		ResolveFunc: func(q *dns.Msg, ci ClientInfo) (*dns.Msg, error) {
+			fastHits.Add(1)
+			if fastFail.Load() {
+				return nil, errors.New("failed")
+			}
+			return q, nil
+		},
+	}
+	g := NewLowestLatency("test-lowest-latency", LowestLatencyOptions{ReprobeInterval: time.Hour}, slow, fast)
+	q := new(dns.Msg)
+	q.SetQuestion("test.com.", dns.TypeA)
+
+	// The first query goes to the first resolver, the other is probed in the background
+	_, err := g.Resolve(q, ClientInfo{})
+	require.NoError(t, err)
+	require.Equal(t, int32(1), slowHits.Load())
+	require.Eventually(t, func() bool {
+		return g.order()[0] == 1
+	}, time.Second, 5*time.Millisecond)
+	require.Equal(t, int32(1), fastHits.Load())
+
+	// Now the faster one is used, without probing the slow one again
+	_, err = g.Resolve(q, ClientInfo{})
+	require.NoError(t, err)
+	require.Equal(t, int32(1), slowHits.Load())
+	require.Equal(t, int32(2), fastHits.Load())
+
+	// A failure is retried on the slower resolver and moves the failed one to the end
+	fastFail.Store(true)
+	_, err = g.Resolve(q, ClientInfo{})
+	require.NoError(t, err)
+	require.Equal(t, int32(2), slowHits.Load())
+	require.Equal(t, int32(3), fastHits.Load())
+	require.Equal(t, []int{0, 1}, g.order())
+}
+
+// Probes aren't cancelled along with the query that triggered them
+func TestLowestLatencyProbeNotCancelled(t *testing.T) {
+	probed := make(chan bool, 1)
+	selected := new(TestResolver)
+	other := &TestResolver{
+		ResolveFunc: func(q *dns.Msg, ci ClientInfo) (*dns.Msg, error) {
+			probed <- ci.Done == nil
+			return q, nil
+		},
+	}
+	g := NewLowestLatency("test-lowest-latency-cancel", LowestLatencyOptions{}, selected, other)
+	q := new(dns.Msg)
+	q.SetQuestion("test.com.", dns.TypeA)
+
+	done := make(chan struct{})
+	close(done)
+	_, err := g.Resolve(q, ClientInfo{Done: done})
+	require.NoError(t, err)
+	require.True(t, <-probed)
+}
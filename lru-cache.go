@@ -30,6 +30,7 @@ type cacheAnswer struct {
 	Timestamp        time.Time // Time the record was cached. Needed to adjust TTL
 	Expiry           time.Time // Time the record expires and should be removed
 	PrefetchEligible bool      // The cache can prefetch this record
+	StaleTTL         uint32    // TTL of records served after they expired, until Expiry. Not served stale if 0
 	Msg              *dns.Msg
 }
 
@@ -169,15 +170,32 @@ func (c *lruCache) reset() {
 // Iterate over the cached answers and call the provided function. If it
 // returns true, the item is deleted from the cache.
 func (c *lruCache) deleteFunc(f func(*cacheAnswer) bool) {
+	c.deleteItemFunc(func(item *cacheItem) bool { return f(item.Answer) })
+}
+
+// Iterate over the cached items and call the provided function. If it returns
+// true, the item is deleted from the cache. Returns the number of deleted
+// items.
+func (c *lruCache) deleteItemFunc(f func(*cacheItem) bool) int {
+	var n int
 	item := c.head.next
 	for item != c.tail {
-		if f(item.Answer) {
+		if f(item) {
 			item.prev.next = item.next
 			item.next.prev = item.prev
 			delete(c.items, item.Key)
+			n++
 		}
 		item = item.next
 	}
+	return n
+}
+
+// Call the provided function for all items, most recently used first.
+func (c *lruCache) each(f func(*cacheItem)) {
+	for item := c.head.next; item != c.tail; item = item.next {
+		f(item)
+	}
 }
 
 func (c *lruCache) size() int {
@@ -194,20 +212,28 @@ func (c *lruCache) serialize(w io.Writer) error {
 	return nil
 }
 
-func (c *lruCache) deserialize(r io.Reader) error {
+// Reads items written by serialize into the cache. Items that have expired
+// since they were written are skipped. Returns the number of items added.
+func (c *lruCache) deserialize(r io.Reader) (int, error) {
 	dec := json.NewDecoder(r)
+	now := time.Now()
+	var n int
 	for dec.More() {
 		item := new(cacheItem)
 		if err := dec.Decode(item); err != nil {
-			return err
+			return n, err
 		}
 		// Skip bad (or incompatible) records
 		if item.Key.Question.Name == "" || item.Answer == nil {
 			continue
 		}
+		if now.After(item.Answer.Expiry) {
+			continue
+		}
 		c.addKey(item.Key, item.Answer)
+		n++
 	}
-	return nil
+	return n, nil
 }
 
 func lruKeyFromQuery(q *dns.Msg) lruKey {
@@ -0,0 +1,250 @@
+package rdns
+
+import (
+	"errors"
+	"fmt"
+	"net"
+	"strings"
+	"time"
+
+	"github.com/miekg/dns"
+	"github.com/sirupsen/logrus"
+	"golang.org/x/net/ipv4"
+)
+
+// MDNSClient resolves names of devices on the local network with multicast DNS
+// as defined in RFC 6762. Queries are sent as one-shot queries from an
+// ephemeral port, which responders answer with unicast. Only queries for names
+// under the configured suffix are answered, others are refused.
+type MDNSClient struct {
+	id       string
+	endpoint *net.UDPAddr
+	suffix   string
+	opt      MDNSClientOptions
+	metrics  *ListenerMetrics
+}
+
+var _ Resolver = &MDNSClient{}
+
+type MDNSClientOptions struct {
+	// Domain of the names to resolve, default "local.". If it's anything else,
+	// the suffix is replaced with "local." in queries and in the responses.
+	Suffix string
+
+	// Network interface to send queries on. If empty, the system default for
+	// multicast is used.
+	Interface string
+
+	// Local IP to send queries from. If nil, a local address is chosen.
+	LocalAddr net.IP
+
+	// Time to wait for a response, default 1 second. Names that no device
+	// responds to in that time are answered with NXDOMAIN.
+	QueryTimeout time.Duration
+}
+
+const mdnsDomain = "local."
+
+// NewMDNSClient returns a new mDNS resolver. The endpoint is the multicast group
+// to send queries to, typically 224.0.0.251:5353 or [ff02::fb%eth0]:5353.
+func NewMDNSClient(id, endpoint string, opt MDNSClientOptions) (*MDNSClient, error) {
+	addr, err := net.ResolveUDPAddr("udp", endpoint)
+	if err != nil {
+		return nil, err
+	}
+	if opt.QueryTimeout == 0 {
+		opt.QueryTimeout = time.Second
+	}
+	suffix := mdnsDomain
+	if opt.Suffix != "" {
+		suffix = strings.ToLower(dns.Fqdn(strings.TrimPrefix(opt.Suffix, ".")))
+		if suffix == "." {
+			return nil, errors.New("mdns suffix can not be the root domain")
+		}
+	}
+	if opt.Interface != "" {
+		if _, err := net.InterfaceByName(opt.Interface); err != nil {
+			return nil, err
+		}
+	}
+	return &MDNSClient{
+		id:       id,
+		endpoint: addr,
+		suffix:   suffix,
+		opt:      opt,
+		metrics:  NewListenerMetrics("client", id),
+	}, nil
+}
+
+// Resolve a DNS query by sending it to the multicast group and waiting for the
+// first response.
+func (d *MDNSClient) Resolve(q *dns.Msg, ci ClientInfo) (*dns.Msg, error) {
+	if len(q.Question) < 1 {
+		return nil, errors.New("no question in query")
+	}
+	question := q.Question[0]
+	name := strings.ToLower(question.Name)
+	log := logger(d.id, q, ci).WithField("resolver", d.endpoint.String())
+	if !dns.IsSubDomain(d.suffix, name) {
+		log.Debug("name not under mdns suffix, refusing")
+		return responseWithCode(q, dns.RcodeRefused), nil
+	}
+	d.metrics.query.Add(1)
+
+	// Send the query with the .local suffix, RD flag and EDNS0 aren't used
+	// in mDNS
+	mdnsName := strings.TrimSuffix(name, d.suffix) + mdnsDomain
+	m := new(dns.Msg)
+	m.SetQuestion(mdnsName, question.Qtype)
+	m.RecursionDesired = false
+
+	log.WithField("name", mdnsName).Debug("sending mdns query")
+	a, err := d.query(m)
+	if err != nil {
+		d.metrics.err.Add("query", 1)
+		return nil, err
+	}
+	if a == nil {
+		log.Debug("no mdns response, name not found")
+		d.metrics.response.Add(dns.RcodeToString[dns.RcodeNameError], 1)
+		return responseWithCode(q, dns.RcodeNameError), nil
+	}
+
+	answer := new(dns.Msg)
+	answer.SetReply(q)
+	answer.Answer = d.fromMDNS(mdnsAnswerChain(mdnsName, a.Answer))
+	answer.Extra = d.fromMDNS(mdnsLocalRecords(a.Extra))
+	d.metrics.response.Add(dns.RcodeToString[answer.Rcode], 1)
+	log.WithFields(logrus.Fields{"answers": len(answer.Answer)}).Debug("received mdns response")
+	return answer, nil
+}
+
+func (d *MDNSClient) String() string {
+	return d.id
+}
+
+// Send the query and return the first response with records for the name, or
+// nil if there's none before the timeout.
+func (d *MDNSClient) query(m *dns.Msg) (*dns.Msg, error) {
+	b, err := m.Pack()
+	if err != nil {
+		return nil, err
+	}
+	network := "udp4"
+	if d.endpoint.IP.To4() == nil {
+		network = "udp6"
+	}
+	conn, err := net.ListenUDP(network, &net.UDPAddr{IP: d.opt.LocalAddr})
+	if err != nil {
+		return nil, err
+	}
+	defer conn.Close()
+	if d.opt.Interface != "" && network == "udp4" {
+		ifi, err := net.InterfaceByName(d.opt.Interface)
+		if err != nil {
+			return nil, err
+		}
+		if err := ipv4.NewPacketConn(conn).SetMulticastInterface(ifi); err != nil {
+			return nil, fmt.Errorf("failed to set multicast interface: %w", err)
+		}
+	}
+	if err := conn.SetDeadline(time.Now().Add(d.opt.QueryTimeout)); err != nil {
+		return nil, err
+	}
+	if _, err := conn.WriteTo(b, d.endpoint); err != nil {
+		return nil, err
+	}
+
+	// Several devices can respond, use the first one that has records for the
+	// name and ignore anything else received on the socket
+	buf := make([]byte, dns.MaxMsgSize)
+	for {
+		n, _, err := conn.ReadFrom(buf)
+		if err != nil {
+			var netErr net.Error
+			if errors.As(err, &netErr) && netErr.Timeout() {
+				return nil, nil
+			}
+			return nil, err
+		}
+		a := new(dns.Msg)
+		if err := a.Unpack(buf[:n]); err != nil || !a.Response || a.Id != m.Id {
+			continue
+		}
+		for _, rr := range a.Answer {
+			if strings.EqualFold(rr.Header().Name, m.Question[0].Name) {
+				return a, nil
+			}
+		}
+	}
+}
+
+// Converts records from an mDNS response for the client. Removes the cache-flush
+// bit and replaces the .local suffix with the configured one.
+func (d *MDNSClient) fromMDNS(rrs []dns.RR) []dns.RR {
+	out := make([]dns.RR, 0, len(rrs))
+	for _, rr := range rrs {
+		if rr.Header().Rrtype == dns.TypeOPT {
+			continue
+		}
+		h := rr.Header()
+		h.Class &^= 1 << 15
+		h.Name = d.toSuffix(h.Name)
+		switch rr := rr.(type) {
+		case *dns.CNAME:
+			rr.Target = d.toSuffix(rr.Target)
+		case *dns.PTR:
+			rr.Ptr = d.toSuffix(rr.Ptr)
+		case *dns.SRV:
+			rr.Target = d.toSuffix(rr.Target)
+		}
+		out = append(out, rr)
+	}
+	return out
+}
+
+// Returns the records for the name and its CNAME chain. Any device on the
+// network can respond, so records for other names aren't passed on to the
+// client.
+func mdnsAnswerChain(name string, rrs []dns.RR) []dns.RR {
+	names := map[string]bool{strings.ToLower(name): true}
+	for added := true; added; {
+		added = false
+		for _, rr := range rrs {
+			cname, ok := rr.(*dns.CNAME)
+			if !ok || !names[strings.ToLower(cname.Hdr.Name)] {
+				continue
+			}
+			target := strings.ToLower(cname.Target)
+			if !names[target] && dns.IsSubDomain(mdnsDomain, target) {
+				names[target] = true
+				added = true
+			}
+		}
+	}
+	out := make([]dns.RR, 0, len(rrs))
+	for _, rr := range rrs {
+		if names[strings.ToLower(rr.Header().Name)] {
+			out = append(out, rr)
+		}
+	}
+	return out
+}
+
+// Returns the records for names under .local.
+func mdnsLocalRecords(rrs []dns.RR) []dns.RR {
+	out := make([]dns.RR, 0, len(rrs))
+	for _, rr := range rrs {
+		if dns.IsSubDomain(mdnsDomain, strings.ToLower(rr.Header().Name)) {
+			out = append(out, rr)
+		}
+	}
+	return out
+}
+
+func (d *MDNSClient) toSuffix(name string) string {
+	if d.suffix == mdnsDomain || !dns.IsSubDomain(mdnsDomain, strings.ToLower(name)) {
+		return name
+	}
+	return name[:len(name)-len(mdnsDomain)] + d.suffix
+}
@@ -0,0 +1,114 @@
+package rdns
+
+import (
+	"net"
+	"testing"
+	"time"
+
+	"github.com/miekg/dns"
+	"github.com/stretchr/testify/require"
+)
+
+// Starts a fake mDNS responder on a unicast address that answers A queries for
+// printer.local.
+func startMDNSResponder(t *testing.T) string {
+	conn, err := net.ListenUDP("udp4", &net.UDPAddr{IP: net.ParseIP("127.0.0.1")})
+	require.NoError(t, err)
+	t.Cleanup(func() { conn.Close() })
+	go func() {
+		buf := make([]byte, dns.MaxMsgSize)
+		for {
+			n, addr, err := conn.ReadFrom(buf)
+			if err != nil {
+				return
+			}
+			q := new(dns.Msg)
+			if err := q.Unpack(buf[:n]); err != nil || q.Question[0].Name != "printer.local." {
+				continue
+			}
+			// Another device sends an unrelated response first
+			other := new(dns.Msg)
+			other.SetReply(q)
+			b, _ := other.Pack()
+			_, _ = conn.WriteTo(b, addr)
+
+			a := new(dns.Msg)
+			a.SetReply(q)
+			a.Authoritative = true
+			rr, _ := dns.NewRR("printer.local. 10 IN A 192.168.1.20")
+			rr.Header().Class |= 1 << 15 // cache-flush
+			// Records for other names are included as well
+			injected, _ := dns.NewRR("www.example.com. 10 IN A 192.0.2.66")
+			aaaa, _ := dns.NewRR("printer.local. 10 IN AAAA fe80::20")
+			a.Answer = []dns.RR{rr, injected}
+			a.Extra = []dns.RR{aaaa, injected}
+			b, _ = a.Pack()
+			_, _ = conn.WriteTo(b, addr)
+		}
+	}()
+	return conn.LocalAddr().String()
+}
+
+func TestMDNSClient(t *testing.T) {
+	addr := startMDNSResponder(t)
+	c, err := NewMDNSClient("test-mdns", addr, MDNSClientOptions{QueryTimeout: 200 * time.Millisecond})
+	require.NoError(t, err)
+
+	q := new(dns.Msg)
+	q.SetQuestion("printer.local.", dns.TypeA)
+	a, err := c.Resolve(q, ClientInfo{})
+	require.NoError(t, err)
+	require.Equal(t, q.Id, a.Id)
+	require.Len(t, a.Answer, 1)
+	require.Equal(t, uint16(dns.ClassINET), a.Answer[0].Header().Class)
+	require.Equal(t, "192.168.1.20", a.Answer[0].(*dns.A).A.String())
+
+	// Records for names outside .local are dropped
+	require.Len(t, a.Extra, 1)
+	require.Equal(t, "printer.local.", a.Extra[0].Header().Name)
+
+	// No response
+	q.SetQuestion("missing.local.", dns.TypeA)
+	a, err = c.Resolve(q, ClientInfo{})
+	require.NoError(t, err)
+	require.Equal(t, dns.RcodeNameError, a.Rcode)
+
+	// Names outside the suffix are refused
+	q.SetQuestion("printer.example.com.", dns.TypeA)
+	a, err = c.Resolve(q, ClientInfo{})
+	require.NoError(t, err)
+	require.Equal(t, dns.RcodeRefused, a.Rcode)
+}
+
+func TestMDNSClientSuffix(t *testing.T) {
+	addr := startMDNSResponder(t)
+	c, err := NewMDNSClient("test-mdns-suffix", addr, MDNSClientOptions{
+		Suffix:       "home.lan",
+		QueryTimeout: 200 * time.Millisecond,
+	})
+	require.NoError(t, err)
+
+	q := new(dns.Msg)
+	q.SetQuestion("printer.home.lan.", dns.TypeA)
+	a, err := c.Resolve(q, ClientInfo{})
+	require.NoError(t, err)
+	require.Len(t, a.Answer, 1)
+	require.Equal(t, "printer.home.lan.", a.Answer[0].Header().Name)
+
+	// .local isn't answered with a different suffix
+	q.SetQuestion("printer.local.", dns.TypeA)
+	a, err = c.Resolve(q, ClientInfo{})
+	require.NoError(t, err)
+	require.Equal(t, dns.RcodeRefused, a.Rcode)
+}
+
+func TestMDNSAnswerChain(t *testing.T) {
+	rrs := []dns.RR{
+		mustRR(t, "Printer.local. 10 IN CNAME office-printer.local."),
+		mustRR(t, "office-printer.local. 10 IN CNAME www.example.com."),
+		mustRR(t, "office-printer.local. 10 IN A 192.168.1.20"),
+		mustRR(t, "www.example.com. 10 IN A 192.0.2.66"),
+		mustRR(t, "other.local. 10 IN A 192.168.1.21"),
+	}
+	require.Equal(t, rrs[:3], mdnsAnswerChain("printer.local.", rrs))
+}
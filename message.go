@@ -53,7 +53,7 @@ func responseWithCode(q *dns.Msg, rcode int) *dns.Msg {
 }
 
 // Answers a PTR query with a name
-func ptr(q *dns.Msg, names []string) *dns.Msg {
+func ptr(q *dns.Msg, names []string, ttl uint32) *dns.Msg {
 	a := new(dns.Msg)
 	a.SetReply(q)
 	answer := make([]dns.RR, 0, len(names))
@@ -63,7 +63,7 @@ func ptr(q *dns.Msg, names []string) *dns.Msg {
 				Name:   q.Question[0].Name,
 				Rrtype: dns.TypePTR,
 				Class:  dns.ClassINET,
-				Ttl:    3600,
+				Ttl:    ttl,
 			},
 			Ptr: dns.Fqdn(name),
 		}
@@ -87,7 +87,53 @@ func setUDPSize(q *dns.Msg, size uint16) *dns.Msg {
 	if edns0 != nil {
 		edns0.SetUDPSize(size)
 	} else {
-		q.SetEdns0(size, false)
+		copy.SetEdns0(size, false)
 	}
 	return copy
 }
+
+// Returns the largest UDP response for a query, the size advertised by the
+// client in EDNS0 or 512 bytes without EDNS0, limited by max if it's not 0.
+func udpResponseSize(q *dns.Msg, max uint16) int {
+	size := dns.MinMsgSize
+	if edns0 := q.IsEdns0(); edns0 != nil && int(edns0.UDPSize()) > size {
+		size = int(edns0.UDPSize())
+	}
+	if max > 0 && int(max) < size {
+		size = int(max)
+	}
+	if size < dns.MinMsgSize {
+		size = dns.MinMsgSize
+	}
+	return size
+}
+
+// Makes the response fit into size bytes. Records in the additional section
+// are removed first since they're optional. If it still doesn't fit, all
+// records are removed and the TC flag is set so the client retries over TCP.
+// Unlike removing records one by one, this never leaves partial RRsets or
+// RRSIGs without the records they cover. The OPT record is kept.
+func truncateResponse(a *dns.Msg, size int) {
+	if a.IsTsig() != nil {
+		return
+	}
+	a.Compress = false
+	if a.Len() <= size {
+		return
+	}
+	a.Compress = true
+	if a.Len() <= size {
+		return
+	}
+	opt := a.IsEdns0()
+	a.Extra = nil
+	if opt != nil {
+		a.Extra = []dns.RR{opt}
+	}
+	if a.Len() <= size {
+		return
+	}
+	a.Truncated = true
+	a.Answer = nil
+	a.Ns = nil
+}
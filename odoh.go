@@ -0,0 +1,391 @@
+package rdns
+
+import (
+	"bytes"
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/ecdh"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+
+	"golang.org/x/crypto/hkdf"
+)
+
+// Implementation of Oblivious DNS over HTTPS (RFC 9230) messages. Only the
+// mandatory HPKE (RFC 9180) cipher suite is supported: DHKEM(X25519,
+// HKDF-SHA256), HKDF-SHA256 and AES-128-GCM.
+
+const (
+	odohContentType = "application/oblivious-dns-message"
+	odohConfigPath  = "/.well-known/odohconfigs"
+
+	odohVersion      uint16 = 0x0001
+	odohTypeQuery    byte   = 0x01
+	odohTypeResponse byte   = 0x02
+
+	hpkeKEMX25519     uint16 = 0x0020
+	hpkeKDFHKDFSHA256 uint16 = 0x0001
+	hpkeAEADAES128GCM uint16 = 0x0001
+
+	hpkeNk = 16 // AES-128-GCM key size
+	hpkeNn = 12 // AES-128-GCM nonce size
+	hpkeNh = 32 // SHA256 size
+)
+
+// odohConfig is the public key configuration of an ODoH target.
+type odohConfig struct {
+	publicKey *ecdh.PublicKey
+	contents  []byte // serialized ObliviousDoHConfigContents
+	keyID     []byte
+}
+
+// Parse an ObliviousDoHConfigs structure and return the first configuration
+// with a supported version and cipher suite.
+func parseODoHConfigs(b []byte) (*odohConfig, error) {
+	if len(b) < 2 || int(binary.BigEndian.Uint16(b)) != len(b)-2 {
+		return nil, errors.New("invalid odoh configs")
+	}
+	b = b[2:]
+	for len(b) >= 4 {
+		version := binary.BigEndian.Uint16(b)
+		length := int(binary.BigEndian.Uint16(b[2:]))
+		if len(b) < 4+length {
+			return nil, errors.New("invalid odoh config length")
+		}
+		contents := b[4 : 4+length]
+		b = b[4+length:]
+		if version != odohVersion || len(contents) < 8 {
+			continue
+		}
+		kem := binary.BigEndian.Uint16(contents)
+		kdf := binary.BigEndian.Uint16(contents[2:])
+		aead := binary.BigEndian.Uint16(contents[4:])
+		if kem != hpkeKEMX25519 || kdf != hpkeKDFHKDFSHA256 || aead != hpkeAEADAES128GCM {
+			continue
+		}
+		keyLen := int(binary.BigEndian.Uint16(contents[6:]))
+		if len(contents) != 8+keyLen {
+			return nil, errors.New("invalid odoh config public key")
+		}
+		pk, err := ecdh.X25519().NewPublicKey(contents[8:])
+		if err != nil {
+			return nil, err
+		}
+		return newODoHConfig(pk), nil
+	}
+	return nil, errors.New("no supported odoh config")
+}
+
+func newODoHConfig(pk *ecdh.PublicKey) *odohConfig {
+	contents := binary.BigEndian.AppendUint16(nil, hpkeKEMX25519)
+	contents = binary.BigEndian.AppendUint16(contents, hpkeKDFHKDFSHA256)
+	contents = binary.BigEndian.AppendUint16(contents, hpkeAEADAES128GCM)
+	contents = appendUint16Prefixed(contents, pk.Bytes())
+	return &odohConfig{
+		publicKey: pk,
+		contents:  contents,
+		keyID:     hkdfExpand(hkdf.Extract(sha256.New, contents, nil), []byte("odoh key id"), hpkeNh),
+	}
+}
+
+// Serialize the configuration as ObliviousDoHConfigs with a single entry.
+func (c *odohConfig) marshal() []byte {
+	config := binary.BigEndian.AppendUint16(nil, odohVersion)
+	config = appendUint16Prefixed(config, c.contents)
+	return appendUint16Prefixed(nil, config)
+}
+
+// ObliviousDoHMessage
+type odohMessage struct {
+	messageType byte
+	keyID       []byte
+	encrypted   []byte
+}
+
+func (m odohMessage) marshal() []byte {
+	b := []byte{m.messageType}
+	b = appendUint16Prefixed(b, m.keyID)
+	return appendUint16Prefixed(b, m.encrypted)
+}
+
+func parseODoHMessage(b []byte) (odohMessage, error) {
+	var m odohMessage
+	if len(b) < 1 {
+		return m, errors.New("empty odoh message")
+	}
+	m.messageType = b[0]
+	var err error
+	b = b[1:]
+	if m.keyID, b, err = readUint16Prefixed(b); err != nil {
+		return m, err
+	}
+	if m.encrypted, b, err = readUint16Prefixed(b); err != nil {
+		return m, err
+	}
+	if len(b) > 0 {
+		return m, errors.New("trailing data in odoh message")
+	}
+	return m, nil
+}
+
+// ObliviousDoHMessagePlaintext, the padding is left empty since the queries
+// are already padded with EDNS0.
+func odohPlaintext(dnsMsg []byte) []byte {
+	b := appendUint16Prefixed(nil, dnsMsg)
+	return appendUint16Prefixed(b, nil)
+}
+
+func parseODoHPlaintext(b []byte) ([]byte, error) {
+	dnsMsg, rest, err := readUint16Prefixed(b)
+	if err != nil {
+		return nil, err
+	}
+	padding, rest, err := readUint16Prefixed(rest)
+	if err != nil || len(rest) > 0 {
+		return nil, errors.New("invalid odoh plaintext")
+	}
+	if len(bytes.Trim(padding, "\x00")) > 0 {
+		return nil, errors.New("invalid odoh padding")
+	}
+	return dnsMsg, nil
+}
+
+// odohQueryContext holds the state needed to decrypt the response to a query.
+type odohQueryContext struct {
+	plaintext []byte
+	secret    []byte
+}
+
+// Encrypt a DNS query for the target. Returns the ObliviousDoHMessage and the
+// context to decrypt the response with.
+func (c *odohConfig) encryptQuery(dnsMsg []byte) ([]byte, *odohQueryContext, error) {
+	enc, ctx, err := hpkeSetupBaseS(c.publicKey, []byte("odoh query"))
+	if err != nil {
+		return nil, nil, err
+	}
+	plaintext := odohPlaintext(dnsMsg)
+	aad := appendUint16Prefixed([]byte{odohTypeQuery}, c.keyID)
+	ct, err := ctx.seal(aad, plaintext)
+	if err != nil {
+		return nil, nil, err
+	}
+	m := odohMessage{
+		messageType: odohTypeQuery,
+		keyID:       c.keyID,
+		encrypted:   append(enc, ct...),
+	}
+	return m.marshal(), &odohQueryContext{
+		plaintext: plaintext,
+		secret:    ctx.export([]byte("odoh response"), hpkeNk),
+	}, nil
+}
+
+// Decrypt the response to the query.
+func (q *odohQueryContext) decryptResponse(b []byte) ([]byte, error) {
+	m, err := parseODoHMessage(b)
+	if err != nil {
+		return nil, err
+	}
+	if m.messageType != odohTypeResponse {
+		return nil, fmt.Errorf("unexpected odoh message type %d", m.messageType)
+	}
+	aead, nonce, err := q.responseKey(m.keyID)
+	if err != nil {
+		return nil, err
+	}
+	aad := appendUint16Prefixed([]byte{odohTypeResponse}, m.keyID)
+	plaintext, err := aead.Open(nil, nonce, m.encrypted, aad)
+	if err != nil {
+		return nil, fmt.Errorf("failed to decrypt odoh response: %w", err)
+	}
+	return parseODoHPlaintext(plaintext)
+}
+
+// Encrypt the response to the query, used by targets.
+func (q *odohQueryContext) encryptResponse(dnsMsg []byte) ([]byte, error) {
+	responseNonce := make([]byte, max(hpkeNn, hpkeNk))
+	if _, err := rand.Read(responseNonce); err != nil {
+		return nil, err
+	}
+	aead, nonce, err := q.responseKey(responseNonce)
+	if err != nil {
+		return nil, err
+	}
+	aad := appendUint16Prefixed([]byte{odohTypeResponse}, responseNonce)
+	m := odohMessage{
+		messageType: odohTypeResponse,
+		keyID:       responseNonce,
+		encrypted:   aead.Seal(nil, nonce, odohPlaintext(dnsMsg), aad),
+	}
+	return m.marshal(), nil
+}
+
+// Derive the response key and nonce as per RFC 9230, section 6.4.
+func (q *odohQueryContext) responseKey(responseNonce []byte) (cipher.AEAD, []byte, error) {
+	salt := appendUint16Prefixed(bytes.Clone(q.plaintext), responseNonce)
+	prk := hkdf.Extract(sha256.New, q.secret, salt)
+	key := hkdfExpand(prk, []byte("odoh key"), hpkeNk)
+	nonce := hkdfExpand(prk, []byte("odoh nonce"), hpkeNn)
+	aead, err := newAESGCM(key)
+	return aead, nonce, err
+}
+
+// Decrypt a query with the target's private key, used by targets.
+func decryptODoHQuery(sk *ecdh.PrivateKey, config *odohConfig, b []byte) ([]byte, *odohQueryContext, error) {
+	m, err := parseODoHMessage(b)
+	if err != nil {
+		return nil, nil, err
+	}
+	if m.messageType != odohTypeQuery || !bytes.Equal(m.keyID, config.keyID) {
+		return nil, nil, errors.New("invalid odoh query")
+	}
+	if len(m.encrypted) < 32 {
+		return nil, nil, errors.New("odoh query too short")
+	}
+	ctx, err := hpkeSetupBaseR(m.encrypted[:32], sk, []byte("odoh query"))
+	if err != nil {
+		return nil, nil, err
+	}
+	aad := appendUint16Prefixed([]byte{odohTypeQuery}, m.keyID)
+	plaintext, err := ctx.open(aad, m.encrypted[32:])
+	if err != nil {
+		return nil, nil, err
+	}
+	dnsMsg, err := parseODoHPlaintext(plaintext)
+	if err != nil {
+		return nil, nil, err
+	}
+	return dnsMsg, &odohQueryContext{
+		plaintext: plaintext,
+		secret:    ctx.export([]byte("odoh response"), hpkeNk),
+	}, nil
+}
+
+// hpkeContext is an HPKE encryption context for a single message.
+type hpkeContext struct {
+	aead           cipher.AEAD
+	baseNonce      []byte
+	exporterSecret []byte
+}
+
+func (c *hpkeContext) seal(aad, pt []byte) ([]byte, error) {
+	return c.aead.Seal(nil, c.baseNonce, pt, aad), nil
+}
+
+func (c *hpkeContext) open(aad, ct []byte) ([]byte, error) {
+	return c.aead.Open(nil, c.baseNonce, ct, aad)
+}
+
+func (c *hpkeContext) export(exporterContext []byte, length int) []byte {
+	return hpkeLabeledExpand(hpkeSuiteID(), c.exporterSecret, "sec", exporterContext, length)
+}
+
+// SetupBaseS from RFC 9180, returns the encapsulated key and the context.
+func hpkeSetupBaseS(pkR *ecdh.PublicKey, info []byte) ([]byte, *hpkeContext, error) {
+	skE, err := ecdh.X25519().GenerateKey(rand.Reader)
+	if err != nil {
+		return nil, nil, err
+	}
+	dh, err := skE.ECDH(pkR)
+	if err != nil {
+		return nil, nil, err
+	}
+	enc := skE.PublicKey().Bytes()
+	sharedSecret := hpkeExtractAndExpand(dh, append(bytes.Clone(enc), pkR.Bytes()...))
+	ctx, err := hpkeKeySchedule(sharedSecret, info)
+	return enc, ctx, err
+}
+
+// SetupBaseR from RFC 9180.
+func hpkeSetupBaseR(enc []byte, skR *ecdh.PrivateKey, info []byte) (*hpkeContext, error) {
+	pkE, err := ecdh.X25519().NewPublicKey(enc)
+	if err != nil {
+		return nil, err
+	}
+	dh, err := skR.ECDH(pkE)
+	if err != nil {
+		return nil, err
+	}
+	sharedSecret := hpkeExtractAndExpand(dh, append(bytes.Clone(enc), skR.PublicKey().Bytes()...))
+	return hpkeKeySchedule(sharedSecret, info)
+}
+
+func hpkeExtractAndExpand(dh, kemContext []byte) []byte {
+	suiteID := binary.BigEndian.AppendUint16([]byte("KEM"), hpkeKEMX25519)
+	prk := hpkeLabeledExtract(suiteID, nil, "eae_prk", dh)
+	return hpkeLabeledExpand(suiteID, prk, "shared_secret", kemContext, hpkeNh)
+}
+
+// KeySchedule in base mode, without PSK.
+func hpkeKeySchedule(sharedSecret, info []byte) (*hpkeContext, error) {
+	suiteID := hpkeSuiteID()
+	keyScheduleContext := []byte{0x00} // mode_base
+	keyScheduleContext = append(keyScheduleContext, hpkeLabeledExtract(suiteID, nil, "psk_id_hash", nil)...)
+	keyScheduleContext = append(keyScheduleContext, hpkeLabeledExtract(suiteID, nil, "info_hash", info)...)
+	secret := hpkeLabeledExtract(suiteID, sharedSecret, "secret", nil)
+	aead, err := newAESGCM(hpkeLabeledExpand(suiteID, secret, "key", keyScheduleContext, hpkeNk))
+	if err != nil {
+		return nil, err
+	}
+	return &hpkeContext{
+		aead:           aead,
+		baseNonce:      hpkeLabeledExpand(suiteID, secret, "base_nonce", keyScheduleContext, hpkeNn),
+		exporterSecret: hpkeLabeledExpand(suiteID, secret, "exp", keyScheduleContext, hpkeNh),
+	}, nil
+}
+
+func hpkeSuiteID() []byte {
+	id := binary.BigEndian.AppendUint16([]byte("HPKE"), hpkeKEMX25519)
+	id = binary.BigEndian.AppendUint16(id, hpkeKDFHKDFSHA256)
+	return binary.BigEndian.AppendUint16(id, hpkeAEADAES128GCM)
+}
+
+func hpkeLabeledExtract(suiteID, salt []byte, label string, ikm []byte) []byte {
+	labeled := append([]byte("HPKE-v1"), suiteID...)
+	labeled = append(labeled, label...)
+	labeled = append(labeled, ikm...)
+	return hkdf.Extract(sha256.New, labeled, salt)
+}
+
+func hpkeLabeledExpand(suiteID, prk []byte, label string, info []byte, length int) []byte {
+	labeled := binary.BigEndian.AppendUint16(nil, uint16(length))
+	labeled = append(labeled, "HPKE-v1"...)
+	labeled = append(labeled, suiteID...)
+	labeled = append(labeled, label...)
+	labeled = append(labeled, info...)
+	return hkdfExpand(prk, labeled, length)
+}
+
+func hkdfExpand(prk, info []byte, length int) []byte {
+	out := make([]byte, length)
+	_, _ = io.ReadFull(hkdf.Expand(sha256.New, prk, info), out)
+	return out
+}
+
+func newAESGCM(key []byte) (cipher.AEAD, error) {
+	block, err := aes.NewCipher(key)
+	if err != nil {
+		return nil, err
+	}
+	return cipher.NewGCM(block)
+}
+
+func appendUint16Prefixed(b, data []byte) []byte {
+	b = binary.BigEndian.AppendUint16(b, uint16(len(data)))
+	return append(b, data...)
+}
+
+func readUint16Prefixed(b []byte) ([]byte, []byte, error) {
+	if len(b) < 2 {
+		return nil, nil, errors.New("invalid length prefix")
+	}
+	n := int(binary.BigEndian.Uint16(b))
+	if len(b) < 2+n {
+		return nil, nil, errors.New("invalid length prefix")
+	}
+	return b[2 : 2+n], b[2+n:], nil
+}
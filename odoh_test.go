@@ -0,0 +1,133 @@
+package rdns
+
+import (
+	"crypto/ecdh"
+	"crypto/rand"
+	"crypto/tls"
+	"crypto/x509"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/miekg/dns"
+	"github.com/stretchr/testify/require"
+)
+
+// Start an ODoH target answering queries from the resolver.
+func newTestODoHTarget(t *testing.T, resolver Resolver) *httptest.Server {
+	sk, err := ecdh.X25519().GenerateKey(rand.Reader)
+	require.NoError(t, err)
+	config := newODoHConfig(sk.PublicKey())
+
+	mux := http.NewServeMux()
+	mux.HandleFunc(odohConfigPath, func(w http.ResponseWriter, r *http.Request) {
+		_, _ = w.Write(config.marshal())
+	})
+	mux.HandleFunc("/dns-query", func(w http.ResponseWriter, r *http.Request) {
+		b, _ := io.ReadAll(r.Body)
+		dnsMsg, queryCtx, err := decryptODoHQuery(sk, config, b)
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusUnauthorized)
+			return
+		}
+		q := new(dns.Msg)
+		require.NoError(t, q.Unpack(dnsMsg))
+		a, err := resolver.Resolve(q, ClientInfo{})
+		require.NoError(t, err)
+		out, err := a.Pack()
+		require.NoError(t, err)
+		resp, err := queryCtx.encryptResponse(out)
+		require.NoError(t, err)
+		w.Header().Set("content-type", odohContentType)
+		_, _ = w.Write(resp)
+	})
+	return httptest.NewTLSServer(mux)
+}
+
+func TestODoHClientRelay(t *testing.T) {
+	var hits atomic.Int32
+	upstream := &TestResolver{
+		ResolveFunc: func(q *dns.Msg, ci ClientInfo) (*dns.Msg, error) {
+			hits.Add(1)
+			a := new(dns.Msg)
+			a.SetReply(q)
+			a.Answer = append(a.Answer, &dns.A{
+				Hdr: dns.RR_Header{Name: q.Question[0].Name, Rrtype: dns.TypeA, Class: dns.ClassINET, Ttl: 60},
+				A:   []byte{192, 0, 2, 1},
+			})
+			return a, nil
+		},
+	}
+	target := newTestODoHTarget(t, upstream)
+	defer target.Close()
+	roots := x509.NewCertPool()
+	roots.AddCert(target.Certificate())
+
+	// Start the relay
+	addr, err := getLnAddress()
+	require.NoError(t, err)
+	relay, err := NewODoHRelay("test-odoh-relay", addr, ODoHRelayOptions{
+		NoTLS:           true,
+		TargetTLSConfig: &tls.Config{RootCAs: roots},
+	})
+	require.NoError(t, err)
+	go relay.Start()
+	defer relay.Stop()
+	time.Sleep(time.Second)
+
+	c, err := NewODoHClient("test-odoh", target.URL+"/dns-query", ODoHClientOptions{
+		Relay:     "http://" + addr + "/proxy",
+		TLSConfig: &tls.Config{RootCAs: roots},
+	})
+	require.NoError(t, err)
+
+	q := new(dns.Msg)
+	q.SetQuestion("example.com.", dns.TypeA)
+	for i := 0; i < 2; i++ {
+		a, err := c.Resolve(q, ClientInfo{})
+		require.NoError(t, err)
+		require.Equal(t, q.Id, a.Id)
+		require.Len(t, a.Answer, 1)
+		require.Equal(t, "192.0.2.1", a.Answer[0].(*dns.A).A.String())
+	}
+	require.Equal(t, int32(2), hits.Load())
+
+	// Queries with an unknown key are rejected by the target, which causes
+	// the configuration to be fetched again
+	sk, err := ecdh.X25519().GenerateKey(rand.Reader)
+	require.NoError(t, err)
+	c.config = newODoHConfig(sk.PublicKey())
+	_, err = c.Resolve(q, ClientInfo{})
+	require.Error(t, err)
+	require.Nil(t, c.config)
+	_, err = c.Resolve(q, ClientInfo{})
+	require.NoError(t, err)
+}
+
+func TestODoHRelayAllowedTargets(t *testing.T) {
+	addr, err := getLnAddress()
+	require.NoError(t, err)
+	relay, err := NewODoHRelay("test-odoh-relay-targets", addr, ODoHRelayOptions{
+		NoTLS:          true,
+		AllowedTargets: []string{"odoh.example.com."},
+	})
+	require.NoError(t, err)
+	go relay.Start()
+	defer relay.Stop()
+	time.Sleep(time.Second)
+
+	post := func(query, contentType string) int {
+		resp, err := http.Post("http://"+addr+"/proxy?"+query, contentType, strings.NewReader("query"))
+		require.NoError(t, err)
+		resp.Body.Close()
+		return resp.StatusCode
+	}
+	require.Equal(t, http.StatusForbidden, post("targethost=other.example.com&targetpath=/dns-query", odohContentType))
+	require.Equal(t, http.StatusBadRequest, post("targethost=odoh.example.com", odohContentType))
+	require.Equal(t, http.StatusUnsupportedMediaType, post("targethost=odoh.example.com&targetpath=/dns-query", "application/dns-message"))
+	require.True(t, relay.isAllowedTarget("ODOH.example.com:443"))
+}
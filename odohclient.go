@@ -0,0 +1,257 @@
+package rdns
+
+import (
+	"bytes"
+	"context"
+	"crypto/tls"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"net/url"
+	"sync"
+	"time"
+
+	"github.com/miekg/dns"
+	"github.com/sirupsen/logrus"
+)
+
+// ODoHClientOptions contains options used by the Oblivious DoH resolver.
+type ODoHClientOptions struct {
+	// URL of the relay (proxy) the encrypted queries are sent to. The target
+	// is passed to the relay in the targethost and targetpath parameters.
+	Relay string
+
+	// Bootstrap address - IP to use for the relay instead of looking up
+	// the relay's hostname with potentially plain DNS.
+	BootstrapAddr string
+
+	// Local IP to use for outbound connections. If nil, a local address is chosen.
+	LocalAddr net.IP
+
+	TLSConfig *tls.Config
+
+	QueryTimeout time.Duration
+
+	// Optional dialer, e.g. proxy
+	Dialer Dialer
+}
+
+// ODoHClient is an Oblivious DNS-over-HTTPS resolver (RFC 9230). Queries are
+// encrypted with the public key of the target and sent via a relay, so the
+// relay doesn't see the queries and the target doesn't see the client address.
+type ODoHClient struct {
+	id       string
+	endpoint string
+	target   *url.URL
+	relay    *url.URL
+	client   *http.Client
+	opt      ODoHClientOptions
+	metrics  *ListenerMetrics
+
+	// Used to fetch the target configuration, directly from the target
+	configClient *http.Client
+
+	mu            sync.Mutex
+	config        *odohConfig
+	configExpires time.Time
+}
+
+var _ Resolver = &ODoHClient{}
+
+// Time after which the target configuration is fetched again.
+const odohConfigRefresh = time.Hour
+
+// NewODoHClient returns a new ODoH resolver for the target URL.
+func NewODoHClient(id, target string, opt ODoHClientOptions) (*ODoHClient, error) {
+	targetURL, err := url.Parse(target)
+	if err != nil {
+		return nil, err
+	}
+	if targetURL.Scheme != "https" || targetURL.Host == "" {
+		return nil, fmt.Errorf("invalid odoh target '%s'", target)
+	}
+	if opt.Relay == "" {
+		return nil, errors.New("odoh resolver requires a relay")
+	}
+	relayURL, err := url.Parse(opt.Relay)
+	if err != nil {
+		return nil, err
+	}
+	if opt.QueryTimeout == 0 {
+		opt.QueryTimeout = defaultQueryTimeout
+	}
+
+	tr, err := dohTcpTransport(DoHClientOptions{
+		BootstrapAddr: opt.BootstrapAddr,
+		LocalAddr:     opt.LocalAddr,
+		TLSConfig:     opt.TLSConfig,
+		Dialer:        opt.Dialer,
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	// The bootstrap address and server name are for the relay, don't use them
+	// when connecting to the target
+	configTLS := opt.TLSConfig
+	if configTLS != nil {
+		configTLS = configTLS.Clone()
+		configTLS.ServerName = ""
+	}
+	configTr, err := dohTcpTransport(DoHClientOptions{
+		LocalAddr: opt.LocalAddr,
+		TLSConfig: configTLS,
+		Dialer:    opt.Dialer,
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	return &ODoHClient{
+		id:           id,
+		endpoint:     target,
+		target:       targetURL,
+		relay:        relayURL,
+		client:       &http.Client{Transport: tr},
+		configClient: &http.Client{Transport: configTr},
+		opt:          opt,
+		metrics:      NewListenerMetrics("client", id),
+	}, nil
+}
+
+// Resolve a DNS query by encrypting it and sending it to the target via the relay.
+func (d *ODoHClient) Resolve(q *dns.Msg, ci ClientInfo) (*dns.Msg, error) {
+	// Packing a message is not always a read-only operation, make a copy
+	q = q.Copy()
+
+	log := logger(d.id, q, ci).WithFields(logrus.Fields{
+		"resolver": d.endpoint,
+		"relay":    d.relay.Host,
+		"protocol": "odoh",
+	})
+
+	// Add padding before encrypting the query
+	padQuery(q)
+
+	d.metrics.query.Add(1)
+	config, err := d.targetConfig(log)
+	if err != nil {
+		d.metrics.err.Add("config", 1)
+		return nil, err
+	}
+	b, err := q.Pack()
+	if err != nil {
+		d.metrics.err.Add("pack", 1)
+		return nil, err
+	}
+	msg, queryCtx, err := config.encryptQuery(b)
+	if err != nil {
+		d.metrics.err.Add("encrypt", 1)
+		return nil, err
+	}
+
+	// Build the relay URL with the target
+	u := *d.relay
+	values := u.Query()
+	values.Set("targethost", d.target.Host)
+	values.Set("targetpath", d.target.EscapedPath())
+	u.RawQuery = values.Encode()
+
+	timeout := queryTimeout(d.opt.QueryTimeout, ci.Deadline)
+	if timeout <= 0 {
+		d.metrics.err.Add("deadline", 1)
+		return nil, QueryTimeoutError{q}
+	}
+	ctx, cancel := context.WithTimeout(context.Background(), timeout)
+	defer cancel()
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, u.String(), bytes.NewReader(msg))
+	if err != nil {
+		d.metrics.err.Add("http", 1)
+		return nil, err
+	}
+	req.Header.Add("accept", odohContentType)
+	req.Header.Add("content-type", odohContentType)
+
+	log.Debug("querying upstream resolver")
+	resp, err := d.client.Do(req)
+	if err != nil {
+		d.metrics.err.Add("post", 1)
+		return nil, err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode == http.StatusUnauthorized {
+		// The target doesn't know the key, possibly rotated. Fetch the
+		// configuration again on the next query.
+		d.resetConfig()
+	}
+	if resp.StatusCode < 200 || resp.StatusCode > 299 {
+		d.metrics.err.Add(fmt.Sprintf("http%d", resp.StatusCode), 1)
+		return nil, fmt.Errorf("unexpected status code %d", resp.StatusCode)
+	}
+	rb, err := io.ReadAll(resp.Body)
+	if err != nil {
+		d.metrics.err.Add("read", 1)
+		return nil, err
+	}
+	plaintext, err := queryCtx.decryptResponse(rb)
+	if err != nil {
+		d.metrics.err.Add("decrypt", 1)
+		return nil, err
+	}
+	a := new(dns.Msg)
+	if err := a.Unpack(plaintext); err != nil {
+		d.metrics.err.Add("unpack", 1)
+		return nil, err
+	}
+	d.metrics.response.Add(rCode(a), 1)
+	return a, nil
+}
+
+func (d *ODoHClient) String() string {
+	return d.id
+}
+
+// Returns the configuration of the target, fetching it if needed.
+func (d *ODoHClient) targetConfig(log *logrus.Entry) (*odohConfig, error) {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	if d.config != nil && time.Now().Before(d.configExpires) {
+		return d.config, nil
+	}
+	u := url.URL{Scheme: d.target.Scheme, Host: d.target.Host, Path: odohConfigPath}
+	log.WithField("url", u.String()).Debug("fetching odoh target configuration")
+
+	ctx, cancel := context.WithTimeout(context.Background(), d.opt.QueryTimeout)
+	defer cancel()
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, u.String(), nil)
+	if err != nil {
+		return nil, err
+	}
+	resp, err := d.configClient.Do(req)
+	if err != nil {
+		return nil, fmt.Errorf("failed to fetch odoh configuration: %w", err)
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return nil, fmt.Errorf("failed to fetch odoh configuration: unexpected status code %d", resp.StatusCode)
+	}
+	b, err := io.ReadAll(io.LimitReader(resp.Body, 64*1024))
+	if err != nil {
+		return nil, err
+	}
+	config, err := parseODoHConfigs(b)
+	if err != nil {
+		return nil, err
+	}
+	d.config = config
+	d.configExpires = time.Now().Add(odohConfigRefresh)
+	return config, nil
+}
+
+func (d *ODoHClient) resetConfig() {
+	d.mu.Lock()
+	d.config = nil
+	d.mu.Unlock()
+}
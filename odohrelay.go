@@ -0,0 +1,196 @@
+package rdns
+
+import (
+	"bytes"
+	"context"
+	"crypto/tls"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"strings"
+
+	"github.com/sirupsen/logrus"
+)
+
+// ODoHRelay is a listener acting as Oblivious DoH relay (RFC 9230). It
+// forwards encrypted queries from clients to the target given in the request
+// and returns the encrypted responses, without being able to read either.
+// The target only sees the address of the relay.
+type ODoHRelay struct {
+	httpServer *http.Server
+	client     *http.Client
+
+	id   string
+	addr string
+	opt  ODoHRelayOptions
+
+	metrics *ListenerMetrics
+}
+
+var _ Listener = &ODoHRelay{}
+
+// ODoHRelayOptions contains options used by the ODoH relay.
+type ODoHRelayOptions struct {
+	ListenOptions
+
+	TLSConfig *tls.Config
+
+	// Disable TLS on the server (insecure, for testing purposes only).
+	NoTLS bool
+
+	// Hostnames of targets queries can be relayed to. If empty, all targets
+	// are allowed.
+	AllowedTargets []string
+
+	// TLS configuration used to connect to targets, optional.
+	TargetTLSConfig *tls.Config
+}
+
+// Max size of relayed messages.
+const odohMaxMessageSize = 64 * 1024
+
+// NewODoHRelay returns an instance of an ODoH relay.
+func NewODoHRelay(id, addr string, opt ODoHRelayOptions) (*ODoHRelay, error) {
+	tr, err := dohTcpTransport(DoHClientOptions{TLSConfig: opt.TargetTLSConfig})
+	if err != nil {
+		return nil, err
+	}
+	return &ODoHRelay{
+		id:      id,
+		addr:    addr,
+		opt:     opt,
+		client:  &http.Client{Transport: tr, Timeout: dohServerTimeout},
+		metrics: NewListenerMetrics("listener", id),
+	}, nil
+}
+
+// Start the relay.
+func (s *ODoHRelay) Start() error {
+	Log.WithFields(logrus.Fields{"id": s.id, "protocol": "odoh-relay", "addr": s.addr}).Info("starting listener")
+	s.httpServer = &http.Server{
+		Addr:         s.addr,
+		TLSConfig:    s.opt.TLSConfig,
+		Handler:      http.HandlerFunc(s.relayHandler),
+		ReadTimeout:  dohServerTimeout,
+		WriteTimeout: 2 * dohServerTimeout,
+	}
+	ln, err := net.Listen("tcp", s.addr)
+	if err != nil {
+		return err
+	}
+	defer ln.Close()
+	if s.opt.NoTLS {
+		return s.httpServer.Serve(ln)
+	}
+	return s.httpServer.ServeTLS(ln, "", "")
+}
+
+// Stop the relay.
+func (s *ODoHRelay) Stop() error {
+	Log.WithFields(logrus.Fields{"id": s.id, "protocol": "odoh-relay", "addr": s.addr}).Info("stopping listener")
+	return s.httpServer.Shutdown(context.Background())
+}
+
+func (s *ODoHRelay) String() string {
+	return s.id
+}
+
+func (s *ODoHRelay) relayHandler(w http.ResponseWriter, r *http.Request) {
+	s.metrics.query.Add(1)
+	client, _, _ := net.SplitHostPort(r.RemoteAddr)
+	clientIP := net.ParseIP(client)
+	targetHost := r.URL.Query().Get("targethost")
+	targetPath := r.URL.Query().Get("targetpath")
+	log := Log.WithFields(logrus.Fields{
+		"id":       s.id,
+		"client":   clientIP,
+		"protocol": "odoh-relay",
+		"addr":     s.addr,
+		"target":   targetHost + targetPath,
+	})
+	log.Debug("received query")
+
+	if s.opt.access(clientIP) != ACLAllow {
+		log.Debug("refusing client ip")
+		s.metrics.drop.Add(1)
+		http.Error(w, "client not allowed", http.StatusForbidden)
+		return
+	}
+	if r.Method != http.MethodPost {
+		s.metrics.err.Add("httpmethod", 1)
+		http.Error(w, "only POST allowed", http.StatusMethodNotAllowed)
+		return
+	}
+	if r.Header.Get("content-type") != odohContentType {
+		s.metrics.err.Add("contenttype", 1)
+		http.Error(w, "unsupported content type", http.StatusUnsupportedMediaType)
+		return
+	}
+	if targetHost == "" || !strings.HasPrefix(targetPath, "/") {
+		s.metrics.err.Add("target", 1)
+		http.Error(w, "invalid targethost or targetpath", http.StatusBadRequest)
+		return
+	}
+	if !s.isAllowedTarget(targetHost) {
+		log.Debug("refusing target")
+		s.metrics.drop.Add(1)
+		http.Error(w, "target not allowed", http.StatusForbidden)
+		return
+	}
+	b, err := io.ReadAll(http.MaxBytesReader(w, r.Body, odohMaxMessageSize))
+	if err != nil {
+		s.metrics.err.Add("read", 1)
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	// Forward the query to the target without any information about the client
+	req, err := http.NewRequestWithContext(r.Context(), http.MethodPost, "https://"+targetHost+targetPath, bytes.NewReader(b))
+	if err != nil {
+		s.metrics.err.Add("target", 1)
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	req.Header.Set("accept", odohContentType)
+	req.Header.Set("content-type", odohContentType)
+	log.Debug("forwarding query to target")
+	resp, err := s.client.Do(req)
+	if err != nil {
+		log.WithError(err).Error("failed to forward query")
+		s.metrics.err.Add("forward", 1)
+		http.Error(w, "failed to reach target", http.StatusBadGateway)
+		return
+	}
+	defer resp.Body.Close()
+	rb, err := io.ReadAll(io.LimitReader(resp.Body, odohMaxMessageSize))
+	if err != nil {
+		s.metrics.err.Add("forward", 1)
+		http.Error(w, "failed to read response from target", http.StatusBadGateway)
+		return
+	}
+	s.metrics.response.Add(fmt.Sprintf("http%d", resp.StatusCode), 1)
+	if ct := resp.Header.Get("content-type"); ct != "" {
+		w.Header().Set("content-type", ct)
+	}
+	w.WriteHeader(resp.StatusCode)
+	_, _ = w.Write(rb)
+}
+
+// Returns true if queries can be relayed to the target host.
+func (s *ODoHRelay) isAllowedTarget(targetHost string) bool {
+	if len(s.opt.AllowedTargets) == 0 {
+		return true
+	}
+	host := targetHost
+	if h, _, err := net.SplitHostPort(targetHost); err == nil {
+		host = h
+	}
+	for _, allowed := range s.opt.AllowedTargets {
+		allowed = strings.TrimSuffix(allowed, ".")
+		if strings.EqualFold(allowed, host) || strings.EqualFold(allowed, targetHost) {
+			return true
+		}
+	}
+	return false
+}
@@ -1,6 +1,8 @@
 package rdns
 
 import (
+	"context"
+	"expvar"
 	"fmt"
 	"io"
 	"net"
@@ -13,19 +15,70 @@ import (
 // Defines how long to wait for a response from the resolver if no other timeout is given.
 const defaultQueryTimeout = 2 * time.Second
 
+// Returns how long to wait for a response from an upstream server, the query
+// timeout of the client or the time left until the deadline of the query,
+// whichever is shorter. Not positive if the deadline has passed already.
+func queryTimeout(timeout time.Duration, deadline time.Time) time.Duration {
+	if deadline.IsZero() {
+		return timeout
+	}
+	if left := time.Until(deadline); left < timeout {
+		return left
+	}
+	return timeout
+}
+
+// Returns a context for an upstream query that ends after the timeout, or when
+// done is closed.
+func queryContext(timeout time.Duration, done <-chan struct{}) (context.Context, context.CancelFunc) {
+	ctx, cancel := context.WithTimeout(context.Background(), timeout)
+	if done != nil {
+		go func() {
+			select {
+			case <-done:
+				cancel()
+			case <-ctx.Done():
+			}
+		}()
+	}
+	return ctx, cancel
+}
+
 // Tear down an upstream connection if nothing has been received for this long.
 const idleTimeout = 10 * time.Second
 
 // Pipeline is a DNS client that is able to use pipelining for multiple requests over
 // one connection, handle out-of-order responses and deals with disconnects
-// gracefully. It opens a single connection on demand and uses it for all queries.
-// It can manage UDP, TCP, DNS-over-TLS, and DNS-over-DTLS connections.
+// gracefully. It opens connections on demand, up to a configurable number, and
+// uses them for all queries. Additional connections are only opened while the
+// existing ones are busy. It can manage UDP, TCP, DNS-over-TLS, and DNS-over-DTLS
+// connections.
 type Pipeline struct {
-	addr     string
-	client   DNSDialer
-	requests chan *request
-	metrics  *ListenerMetrics
-	timeout  time.Duration
+	addr        string
+	client      DNSDialer
+	requests    chan *request // taken by connections that are open and can accept queries
+	dial        chan *request // taken by idle connection slots, opening a connection
+	metrics     *ListenerMetrics
+	latency     *varHistogram
+	connections *expvar.Int
+	opt         PipelineOptions
+}
+
+// PipelineOptions contains settings for a Pipeline.
+type PipelineOptions struct {
+	// Time to wait for a response, default 2 seconds.
+	QueryTimeout time.Duration
+
+	// Max number of connections to the upstream server, default 1.
+	Connections int
+
+	// Close a connection if nothing has been received for this long,
+	// default 10 seconds.
+	IdleTimeout time.Duration
+
+	// Max number of queries waiting for a response on one connection. More
+	// queries are sent over other connections or wait. Default 0 (unlimited).
+	MaxInFlight int
 }
 
 // DNSDialer is an abstraction for a dns.Client that returns a *dns.Conn.
@@ -33,58 +86,103 @@ type DNSDialer interface {
 	Dial(address string) (*dns.Conn, error)
 }
 
-// NewPipeline returns an initialized (and running) DNS connection manager.
+// NewPipeline returns an initialized (and running) DNS connection manager
+// using a single connection.
 func NewPipeline(id string, addr string, client DNSDialer, timeout time.Duration) *Pipeline {
-	if timeout == 0 {
-		timeout = defaultQueryTimeout
+	return NewPipelineWithOptions(id, addr, client, PipelineOptions{QueryTimeout: timeout})
+}
+
+// NewPipelineWithOptions returns an initialized (and running) DNS connection manager.
+func NewPipelineWithOptions(id string, addr string, client DNSDialer, opt PipelineOptions) *Pipeline {
+	if opt.QueryTimeout == 0 {
+		opt.QueryTimeout = defaultQueryTimeout
+	}
+	if opt.Connections < 1 {
+		opt.Connections = 1
+	}
+	if opt.IdleTimeout == 0 {
+		opt.IdleTimeout = idleTimeout
 	}
 	c := &Pipeline{
-		addr:     addr,
-		client:   client,
-		requests: make(chan *request),
-		metrics:  NewListenerMetrics("client", id),
-		timeout:  timeout,
+		addr:        addr,
+		client:      client,
+		requests:    make(chan *request),
+		dial:        make(chan *request),
+		metrics:     NewListenerMetrics("client", id),
+		latency:     getVarHistogram("client", id, "latency"),
+		connections: getVarInt("client", id, "connections"),
+		opt:         opt,
+	}
+	for i := 0; i < opt.Connections; i++ {
+		go c.start()
 	}
-	go c.start()
 	return c
 }
 
 // Resolve a single query using this connection.
 func (c *Pipeline) Resolve(q *dns.Msg) (*dns.Msg, error) {
+	return c.resolve(q, time.Time{}, nil)
+}
+
+// Resolve a query, waiting for the response until the query timeout or the
+// deadline, whichever comes first, or until done is closed.
+func (c *Pipeline) resolve(q *dns.Msg, deadline time.Time, done <-chan struct{}) (*dns.Msg, error) {
+	start := time.Now()
+	d := queryTimeout(c.opt.QueryTimeout, deadline)
+	if d <= 0 {
+		c.metrics.err.Add("deadline", 1)
+		return nil, QueryTimeoutError{q}
+	}
 	r := newRequest(q)
 
-	timeout := time.NewTimer(c.timeout)
+	timeout := time.NewTimer(d)
 	defer timeout.Stop()
 
-	// Queue up the request or time out
+	// Queue up the request or time out. Prefer connections that are already
+	// open, and only open a new one if they're all busy.
 	select {
 	case c.requests <- r:
-	case <-timeout.C:
-		c.metrics.err.Add("querytimeout", 1)
-		return nil, QueryTimeoutError{q}
+	default:
+		select {
+		case c.requests <- r:
+		case c.dial <- r:
+		case <-timeout.C:
+			c.metrics.err.Add("querytimeout", 1)
+			return nil, QueryTimeoutError{q}
+		case <-done:
+			return nil, errQueryCancelled
+		}
 	}
 
 	// Wait for the request to complete or time out
 	select {
 	case <-r.done:
 	case <-timeout.C:
+		r.cancel() // don't keep waiting for the response on the connection
 		c.metrics.err.Add("querytimeout", 1)
 		return nil, QueryTimeoutError{q}
+	case <-done:
+		r.cancel()
+		return nil, errQueryCancelled
 	}
 
-	return r.waitFor()
+	a, err := r.waitFor()
+	if err == nil {
+		c.latency.observe(time.Since(start))
+	}
+	return a, err
 }
 
 // Starts a loop that will wait for queries and open an upstream connection on-demand, writing queries
 // and reading answers concurrently using the same connection. It also handles errors like idle
-// close from upstream.
+// close from upstream. One loop runs per connection in the pool.
 func (c *Pipeline) start() {
 	var (
 		wg       sync.WaitGroup
 		inFlight inFlightQueue
 	)
 	log := Log.WithField("addr", c.addr)
-	for req := range c.requests { // Lazy connection. Only open a real connection if there's a request
+	for req := range c.dial { // Lazy connection. Only open a real connection if there's a request
 		done := make(chan struct{})
 		log.Trace("opening connection")
 		conn, err := c.client.Dial(c.addr)
@@ -94,39 +192,62 @@ func (c *Pipeline) start() {
 			req.markDone(nil, err)
 			continue
 		}
+		c.connections.Add(1)
 		wg.Add(2)
 
-		go func(r *request) { c.requests <- r }(req) // re-queue the request that triggered the upstream connection
+		// Limits the number of queries waiting for a response on this connection
+		var slots chan struct{}
+		if c.opt.MaxInFlight > 0 {
+			slots = make(chan struct{}, c.opt.MaxInFlight)
+		}
 
-		go func() { // writer
+		go func(req *request) { // writer
+			defer wg.Done()
 			for {
-				select {
-				case req := <-c.requests:
-					query := inFlight.add(req)
-					log.WithField("qname", qName(query)).Trace("sending query")
-					c.metrics.query.Add(1)
-					if err := conn.WriteMsg(query); err != nil {
-						req.markDone(nil, err) // fail the request
-						inFlight.get(query)    // clean up the in-flight queue so it doesn't keep growing
-						conn.Close()           // throw away this connection, should wake up the reader as well
-						wg.Done()
-						c.metrics.err.Add("send_query", 1)
-						log.WithField("qname", qName(query)).WithError(err).Trace("failed sending query")
+				if slots != nil {
+					select {
+					case slots <- struct{}{}:
+					case <-done:
+						return
+					}
+				}
+				if req == nil { // the request that triggered the connection is sent first
+					select {
+					case req = <-c.requests:
+					case <-done: // the reader ran into an error and we want to stop using this connection
 						return
 					}
-				case <-done: // the reader ran into an error and we want to stop using this connection
-					wg.Done()
+				}
+				query := inFlight.add(req)
+				id := query.Id
+				req.onCancel(func() {
+					// Free up the slot if the response didn't arrive yet
+					if inFlight.remove(id) && slots != nil {
+						<-slots
+					}
+				})
+				log.WithField("qname", qName(query)).Trace("sending query")
+				c.metrics.query.Add(1)
+				if err := conn.WriteMsg(query); err != nil {
+					req.markDone(nil, err) // fail the request
+					inFlight.get(query)    // clean up the in-flight queue so it doesn't keep growing
+					conn.Close()           // throw away this connection, should wake up the reader as well
+					c.metrics.err.Add("send_query", 1)
+					log.WithField("qname", qName(query)).WithError(err).Trace("failed sending query")
 					return
 				}
+				req = nil
 			}
-		}()
+		}(req)
 		go func() { // reader
+			defer wg.Done()
+			defer close(done) // tell the writer to not use this connection anymore
 			for {
 				// Set the idle deadline on the reader, not the writer since when using UDP "connections",
 				// a network topology change wouldn't be noticed. Putting the idle timeout here ensures
 				// a reconnect in that case as well. This does create a very slight race however if the
 				// sender is using the connection right at the time of the timeout in the receiver.
-				_ = conn.SetReadDeadline(time.Now().Add(idleTimeout))
+				_ = conn.SetReadDeadline(time.Now().Add(c.opt.IdleTimeout))
 				a, err := conn.ReadMsg()
 				if err != nil {
 					switch e := err.(type) {
@@ -137,15 +258,11 @@ func (c *Pipeline) start() {
 							c.metrics.err.Add("server_term", 1)
 							log.Trace("connection terminated by server")
 						}
-						close(done) // tell the writer to not use this connection anymore
-						wg.Done()
 						return
 					default:
 						if err == io.EOF {
 							c.metrics.err.Add("server_eof", 1)
 							log.Trace("connection terminated by server")
-							close(done) // tell the writer to not use this connection anymore
-							wg.Done()
 							return
 						}
 						// It's possible the response can't be correctly parsed, but we do have a response.
@@ -154,8 +271,6 @@ func (c *Pipeline) start() {
 						if a == nil {
 							c.metrics.err.Add("read", 1)
 							log.WithError(err).Error("read failed")
-							close(done) // tell the writer to not use this connection anymore
-							wg.Done()
 							return
 						}
 						log.WithField("qname", qName(a)).Warn(err)
@@ -167,6 +282,9 @@ func (c *Pipeline) start() {
 					log.WithField("qname", qName(a)).Warn("unexpected answer received, ignoring")
 					continue
 				}
+				if slots != nil {
+					<-slots
+				}
 				c.metrics.response.Add(rCode(a), 1)
 				req.markDone(a, nil)
 				ql := inFlight.maxQueueLen()
@@ -178,6 +296,8 @@ func (c *Pipeline) start() {
 
 		// wait for both, sender and receiver to terminate before trying to reconnect
 		wg.Wait()
+		conn.Close()
+		c.connections.Add(-1)
 	}
 }
 
@@ -187,6 +307,11 @@ type request struct {
 	q, a *dns.Msg
 	err  error
 	done chan struct{}
+
+	// Called when the client stops waiting for the response
+	mu        sync.Mutex
+	cancelled bool
+	cancelFn  func()
 }
 
 func newRequest(q *dns.Msg) *request {
@@ -215,6 +340,30 @@ func (r *request) waitFor() (*dns.Msg, error) {
 	return r.a, r.err
 }
 
+// Stop waiting for the response, releasing the resources it holds on the
+// connection it was sent over.
+func (r *request) cancel() {
+	r.mu.Lock()
+	r.cancelled = true
+	fn := r.cancelFn
+	r.mu.Unlock()
+	if fn != nil {
+		fn()
+	}
+}
+
+// Sets the function that's called when the request is cancelled. It's called
+// right away if that happened already.
+func (r *request) onCancel(fn func()) {
+	r.mu.Lock()
+	r.cancelFn = fn
+	cancelled := r.cancelled
+	r.mu.Unlock()
+	if cancelled {
+		fn()
+	}
+}
+
 // Mark the request as complete.
 func (r *request) markDone(a *dns.Msg, err error) {
 	if a != nil {
@@ -268,6 +417,18 @@ func (q *inFlightQueue) get(a *dns.Msg) *request {
 	return r
 }
 
+// Removes the request with the given query ID from the queue. Returns false if
+// it wasn't in the queue, for example because the response arrived already.
+func (q *inFlightQueue) remove(id uint16) bool {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+	if _, ok := q.requests[id]; !ok {
+		return false
+	}
+	delete(q.requests, id)
+	return true
+}
+
 func (q *inFlightQueue) maxQueueLen() int64 {
 	q.mu.Lock()
 	defer q.mu.Unlock()
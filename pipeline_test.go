@@ -2,6 +2,9 @@ package rdns
 
 import (
 	"errors"
+	"net"
+	"sync"
+	"sync/atomic"
 	"testing"
 	"time"
 
@@ -37,3 +40,168 @@ func TestPipelineQueryTimeout(t *testing.T) {
 	require.ErrorAs(t, err, &QueryTimeoutError{})
 	require.WithinDuration(t, start.Add(time.Second), time.Now(), 10*time.Millisecond)
 }
+
+func TestPipelineDeadline(t *testing.T) {
+	df := func(address string) (*dns.Conn, error) {
+		time.Sleep(2 * time.Second)
+		return nil, errors.New("failed")
+	}
+	p := NewPipeline("test-deadline", "localhost:53", testDialer(df), time.Second)
+
+	q := new(dns.Msg)
+	q.SetQuestion("example.com.", dns.TypeA)
+
+	// The deadline of the query ends the wait before the query timeout
+	start := time.Now()
+	_, err := p.resolve(q, start.Add(100*time.Millisecond), nil)
+	require.ErrorAs(t, err, &QueryTimeoutError{})
+	require.WithinDuration(t, start.Add(100*time.Millisecond), time.Now(), 20*time.Millisecond)
+
+	// Queries past their deadline fail right away
+	_, err = p.resolve(q, time.Now().Add(-time.Second), nil)
+	require.ErrorAs(t, err, &QueryTimeoutError{})
+
+	// Cancelled queries stop waiting right away
+	done := make(chan struct{})
+	time.AfterFunc(50*time.Millisecond, func() { close(done) })
+	start = time.Now()
+	_, err = p.resolve(q, time.Time{}, done)
+	require.ErrorIs(t, err, errQueryCancelled)
+	require.WithinDuration(t, start.Add(50*time.Millisecond), time.Now(), 20*time.Millisecond)
+}
+
+// Returns a dialer for connections to a fake server. The handler is called
+// with the server side of each connection.
+func pipeDialer(dials *atomic.Int32, handler func(conn *dns.Conn)) testDialer {
+	return func(address string) (*dns.Conn, error) {
+		dials.Add(1)
+		client, server := net.Pipe()
+		go func() {
+			defer server.Close()
+			handler(&dns.Conn{Conn: server})
+		}()
+		return &dns.Conn{Conn: client}, nil
+	}
+}
+
+func TestPipelineOutOfOrder(t *testing.T) {
+	var dials atomic.Int32
+	// Answer queries in pairs, in reverse order
+	df := pipeDialer(&dials, func(conn *dns.Conn) {
+		for {
+			q1, err := conn.ReadMsg()
+			if err != nil {
+				return
+			}
+			q2, err := conn.ReadMsg()
+			if err != nil {
+				return
+			}
+			for _, q := range []*dns.Msg{q2, q1} {
+				a := new(dns.Msg)
+				a.SetReply(q)
+				_ = conn.WriteMsg(a)
+			}
+		}
+	})
+	p := NewPipeline("test-out-of-order", "localhost:53", df, time.Second)
+
+	var wg sync.WaitGroup
+	for _, name := range []string{"one.example.com.", "two.example.com."} {
+		wg.Add(1)
+		go func(name string) {
+			defer wg.Done()
+			q := new(dns.Msg)
+			q.SetQuestion(name, dns.TypeA)
+			a, err := p.Resolve(q)
+			require.NoError(t, err)
+			require.Equal(t, q.Id, a.Id)
+			require.Equal(t, name, a.Question[0].Name)
+		}(name)
+	}
+	wg.Wait()
+	require.Equal(t, int32(1), dials.Load())
+}
+
+func TestPipelineConnectionPool(t *testing.T) {
+	var (
+		dials    atomic.Int32
+		received sync.WaitGroup
+	)
+	// Hold all responses until both queries have been received, which can
+	// only happen if a second connection is opened
+	received.Add(2)
+	df := pipeDialer(&dials, func(conn *dns.Conn) {
+		for {
+			q, err := conn.ReadMsg()
+			if err != nil {
+				return
+			}
+			received.Done()
+			received.Wait()
+			a := new(dns.Msg)
+			a.SetReply(q)
+			_ = conn.WriteMsg(a)
+		}
+	})
+	p := NewPipelineWithOptions("test-pool", "localhost:53", df, PipelineOptions{
+		QueryTimeout: time.Second,
+		Connections:  2,
+		MaxInFlight:  1,
+		IdleTimeout:  200 * time.Millisecond,
+	})
+
+	var wg sync.WaitGroup
+	for i := 0; i < 2; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			q := new(dns.Msg)
+			q.SetQuestion("example.com.", dns.TypeA)
+			_, err := p.Resolve(q)
+			require.NoError(t, err)
+		}()
+	}
+	wg.Wait()
+	require.Equal(t, int32(2), dials.Load())
+	require.Equal(t, int64(2), p.connections.Value())
+
+	// Idle connections are closed
+	require.Eventually(t, func() bool { return p.connections.Value() == 0 }, time.Second, 10*time.Millisecond)
+}
+
+func TestPipelineMaxInFlightTimeout(t *testing.T) {
+	var dials atomic.Int32
+	// Never answer the first query
+	df := pipeDialer(&dials, func(conn *dns.Conn) {
+		for {
+			q, err := conn.ReadMsg()
+			if err != nil {
+				return
+			}
+			if q.Question[0].Name == "lost.example.com." {
+				continue
+			}
+			a := new(dns.Msg)
+			a.SetReply(q)
+			_ = conn.WriteMsg(a)
+		}
+	})
+	p := NewPipelineWithOptions("test-inflight-timeout", "localhost:53", df, PipelineOptions{
+		QueryTimeout: 200 * time.Millisecond,
+		MaxInFlight:  1,
+		IdleTimeout:  5 * time.Second,
+	})
+
+	q := new(dns.Msg)
+	q.SetQuestion("lost.example.com.", dns.TypeA)
+	_, err := p.Resolve(q)
+	require.ErrorAs(t, err, &QueryTimeoutError{})
+
+	// The slot of the lost query is free again, the connection isn't stalled
+	// until the idle timeout
+	q.SetQuestion("example.com.", dns.TypeA)
+	_, err = p.Resolve(q)
+	require.NoError(t, err)
+	require.Equal(t, int32(1), dials.Load())
+}
@@ -0,0 +1,196 @@
+package rdns
+
+import (
+	"errors"
+	"expvar"
+	"strconv"
+	"strings"
+	"sync"
+
+	"github.com/prometheus/client_golang/prometheus"
+)
+
+// Blocklist metrics by resolver id, exported by the Prometheus collector.
+var blocklistMetrics sync.Map
+
+// BlocklistCollector is a Prometheus collector for the metrics of all blocklists.
+// It reads the expvar counters of the blocklists whenever it's scraped.
+type BlocklistCollector struct {
+	blocked       *prometheus.Desc
+	allowed       *prometheus.Desc
+	blockedByList *prometheus.Desc
+	blockedByRule *prometheus.Desc
+	topBlocked    *prometheus.Desc
+}
+
+var _ prometheus.Collector = &BlocklistCollector{}
+
+// NewBlocklistCollector returns a Prometheus collector for blocklist metrics.
+func NewBlocklistCollector() *BlocklistCollector {
+	return &BlocklistCollector{
+		blocked: prometheus.NewDesc(
+			"routedns_blocklist_blocked_total",
+			"Number of blocked queries.",
+			[]string{"id"}, nil,
+		),
+		allowed: prometheus.NewDesc(
+			"routedns_blocklist_allowed_total",
+			"Number of allowed queries.",
+			[]string{"id"}, nil,
+		),
+		blockedByList: prometheus.NewDesc(
+			"routedns_blocklist_list_blocked_total",
+			"Number of blocked queries by the list that matched.",
+			[]string{"id", "list"}, nil,
+		),
+		blockedByRule: prometheus.NewDesc(
+			"routedns_blocklist_rule_blocked_total",
+			"Number of blocked queries by the list and rule that matched.",
+			[]string{"id", "list", "rule"}, nil,
+		),
+		topBlocked: prometheus.NewDesc(
+			"routedns_blocklist_top_blocked",
+			"Number of blocked queries in the last one to two hours for the most blocked names.",
+			[]string{"id", "name"}, nil,
+		),
+	}
+}
+
+// RegisterPrometheus registers the blocklist and expvar collectors with the
+// default Prometheus registry. Registering more than once is not an error.
+func RegisterPrometheus() error {
+	for _, c := range []prometheus.Collector{NewBlocklistCollector(), NewExpvarCollector()} {
+		err := prometheus.Register(c)
+		var are prometheus.AlreadyRegisteredError
+		if err != nil && !errors.As(err, &are) {
+			return err
+		}
+	}
+	return nil
+}
+
+func (c *BlocklistCollector) Describe(ch chan<- *prometheus.Desc) {
+	ch <- c.blocked
+	ch <- c.allowed
+	ch <- c.blockedByList
+	ch <- c.blockedByRule
+	ch <- c.topBlocked
+}
+
+func (c *BlocklistCollector) Collect(ch chan<- prometheus.Metric) {
+	blocklistMetrics.Range(func(key, value any) bool {
+		id := key.(string)
+		m := value.(*BlocklistMetrics)
+		ch <- prometheus.MustNewConstMetric(c.blocked, prometheus.CounterValue, float64(m.blocked.Value()), id)
+		ch <- prometheus.MustNewConstMetric(c.allowed, prometheus.CounterValue, float64(m.allowed.Value()), id)
+		m.blockedByList.Do(func(kv expvar.KeyValue) {
+			v, err := strconv.ParseFloat(kv.Value.String(), 64)
+			if err != nil {
+				return
+			}
+			ch <- prometheus.MustNewConstMetric(c.blockedByList, prometheus.CounterValue, v, id, kv.Key)
+		})
+		for list, rules := range m.blockedByRule.snapshot() {
+			for rule, n := range rules {
+				ch <- prometheus.MustNewConstMetric(c.blockedByRule, prometheus.CounterValue, float64(n), id, list, rule)
+			}
+		}
+		for _, t := range m.topBlocked.top(topBlockedExport) {
+			ch <- prometheus.MustNewConstMetric(c.topBlocked, prometheus.GaugeValue, float64(t.Count), id, t.Name)
+		}
+		return true
+	})
+}
+
+// ExpvarCollector is a Prometheus collector for the metrics of all elements. It
+// exports every metric published as routedns.<base>.<id>.<name> in expvar as
+// routedns_<base>_<name> with the element ID in the "id" label. Values of maps
+// are exported with the key as an additional label.
+type ExpvarCollector struct{}
+
+var _ prometheus.Collector = ExpvarCollector{}
+
+// NewExpvarCollector returns a Prometheus collector for all expvar metrics.
+func NewExpvarCollector() ExpvarCollector {
+	return ExpvarCollector{}
+}
+
+// Metrics that hold a current value rather than a count.
+var expvarGauges = map[string]bool{
+	"available":   true,
+	"clients":     true,
+	"connections": true,
+	"entries":     true,
+	"maxqueue":    true,
+	"health":      true,
+	"latency":     true,
+	"state":       true,
+}
+
+// Label names for the keys of map metrics. Defaults to "key".
+var expvarMapLabels = map[string]string{
+	"deny-by-list": "list",
+	"error":        "error",
+	"failure":      "resolver",
+	"health":       "upstream",
+	"latency":      "resolver",
+	"response":     "rcode",
+	"route":        "route",
+	"state":        "state",
+	"wins":         "resolver",
+}
+
+// Describe sends no descriptions, the metrics depend on the configuration so
+// the collector is unchecked.
+func (c ExpvarCollector) Describe(ch chan<- *prometheus.Desc) {}
+
+func (c ExpvarCollector) Collect(ch chan<- prometheus.Metric) {
+	expvar.Do(func(kv expvar.KeyValue) {
+		fields := strings.Split(kv.Key, ".")
+		if len(fields) < 4 || fields[0] != "routedns" {
+			return
+		}
+		// IDs can contain dots, the base and name can't
+		base, name := fields[1], fields[len(fields)-1]
+		id := strings.Join(fields[2:len(fields)-1], ".")
+		metric := "routedns_" + promName(base) + "_" + promName(name)
+		help := "RouteDNS " + base + " " + name + "."
+
+		valueType, suffix := prometheus.CounterValue, "_total"
+		if expvarGauges[name] {
+			valueType, suffix = prometheus.GaugeValue, ""
+		}
+		switch v := kv.Value.(type) {
+		case *expvar.Int:
+			desc := prometheus.NewDesc(metric+suffix, help, []string{"id"}, nil)
+			ch <- prometheus.MustNewConstMetric(desc, valueType, float64(v.Value()), id)
+		case *expvar.Map:
+			label, ok := expvarMapLabels[name]
+			if !ok {
+				label = "key"
+			}
+			desc := prometheus.NewDesc(metric+suffix, help, []string{"id", label}, nil)
+			v.Do(func(kv expvar.KeyValue) {
+				f, err := strconv.ParseFloat(kv.Value.String(), 64)
+				if err != nil {
+					return
+				}
+				ch <- prometheus.MustNewConstMetric(desc, valueType, f, id, kv.Key)
+			})
+		case *varHistogram:
+			desc := prometheus.NewDesc(metric+"_seconds", help, []string{"id"}, nil)
+			count, sum, buckets := v.snapshot()
+			ch <- prometheus.MustNewConstHistogram(desc, count, sum, buckets, id)
+		}
+	})
+}
+
+// Replace characters that aren't valid in Prometheus metric names.
+func promName(s string) string {
+	return strings.Map(func(r rune) rune {
+		if r >= 'a' && r <= 'z' || r >= 'A' && r <= 'Z' || r >= '0' && r <= '9' || r == '_' {
+			return r
+		}
+		return '_'
+	}, s)
+}
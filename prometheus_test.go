@@ -0,0 +1,125 @@
+package rdns
+
+import (
+	"testing"
+	"time"
+
+	"github.com/miekg/dns"
+	"github.com/prometheus/client_golang/prometheus"
+	dto "github.com/prometheus/client_model/go"
+	"github.com/stretchr/testify/require"
+)
+
+func TestBlocklistCollector(t *testing.T) {
+	var ci ClientInfo
+	db, err := NewDomainDB("ads", NewStaticLoader([]string{"ads.test"}))
+	require.NoError(t, err)
+	b, err := NewBlocklist("test-bl-prometheus", new(TestResolver), BlocklistOptions{BlocklistDB: db})
+	require.NoError(t, err)
+
+	reg := prometheus.NewRegistry()
+	require.NoError(t, reg.Register(NewBlocklistCollector()))
+
+	// Returns the value of a metric by name and labels in the registry
+	scrape := func(name string, labels map[string]string) float64 {
+		families, err := reg.Gather()
+		require.NoError(t, err)
+		for _, f := range families {
+			if f.GetName() != name {
+				continue
+			}
+		metrics:
+			for _, m := range f.GetMetric() {
+				for _, l := range m.GetLabel() {
+					if labels[l.GetName()] != l.GetValue() {
+						continue metrics
+					}
+				}
+				if m.Gauge != nil {
+					return m.GetGauge().GetValue()
+				}
+				return m.GetCounter().GetValue()
+			}
+		}
+		return -1
+	}
+	id := map[string]string{"id": "test-bl-prometheus"}
+	require.Equal(t, float64(0), scrape("routedns_blocklist_blocked_total", id))
+	require.Equal(t, float64(0), scrape("routedns_blocklist_allowed_total", id))
+
+	q := new(dns.Msg)
+	for _, name := range []string{"ads.test.", "ads.test.", "other.test."} {
+		q.SetQuestion(name, dns.TypeA)
+		_, err = b.Resolve(q, ci)
+		require.NoError(t, err)
+	}
+	require.Equal(t, float64(2), scrape("routedns_blocklist_blocked_total", id))
+	require.Equal(t, float64(1), scrape("routedns_blocklist_allowed_total", id))
+	require.Equal(t, float64(2), scrape("routedns_blocklist_list_blocked_total", map[string]string{"id": "test-bl-prometheus", "list": "ads"}))
+	require.Equal(t, float64(2), scrape("routedns_blocklist_rule_blocked_total", map[string]string{"id": "test-bl-prometheus", "list": "ads", "rule": "ads.test"}))
+	require.Equal(t, float64(2), scrape("routedns_blocklist_top_blocked", map[string]string{"id": "test-bl-prometheus", "name": "ads.test."}))
+
+	// Registering with the default registry more than once is fine
+	require.NoError(t, RegisterPrometheus())
+	require.NoError(t, RegisterPrometheus())
+}
+
+func TestExpvarCollector(t *testing.T) {
+	var ci ClientInfo
+	c := NewCache("test-cache-prometheus", new(TestResolver), CacheOptions{})
+	q := new(dns.Msg)
+	q.SetQuestion("example.com.", dns.TypeA)
+	for i := 0; i < 3; i++ {
+		_, err := c.Resolve(q, ci)
+		require.NoError(t, err)
+	}
+	getVarMap("router", "test-router-prometheus", "route").Add("example", 2)
+	getVarHistogram("client", "test-client-prometheus", "latency").observe(3 * time.Millisecond)
+	NewLowestLatency("test-lowest-latency-prometheus", LowestLatencyOptions{}, &StaticResolver{id: "static"})
+
+	reg := prometheus.NewRegistry()
+	require.NoError(t, reg.Register(NewExpvarCollector()))
+	families, err := reg.Gather()
+	require.NoError(t, err)
+
+	// Returns the metric by name and labels
+	find := func(name string, labels map[string]string) *dto.Metric {
+		for _, f := range families {
+			if f.GetName() != name {
+				continue
+			}
+		metrics:
+			for _, m := range f.GetMetric() {
+				for _, l := range m.GetLabel() {
+					if v, ok := labels[l.GetName()]; ok && v != l.GetValue() {
+						continue metrics
+					}
+				}
+				return m
+			}
+		}
+		t.Fatalf("metric %s %v not found", name, labels)
+		return nil
+	}
+	cache := map[string]string{"id": "test-cache-prometheus"}
+	require.Equal(t, float64(2), find("routedns_cache_hit_total", cache).GetCounter().GetValue())
+	require.Equal(t, float64(1), find("routedns_cache_miss_total", cache).GetCounter().GetValue())
+	require.NotNil(t, find("routedns_cache_entries", cache).GetGauge())
+
+	route := find("routedns_router_route_total", map[string]string{"id": "test-router-prometheus", "route": "example"})
+	require.Equal(t, float64(2), route.GetCounter().GetValue())
+
+	// The moving average of the response time is a gauge
+	latency := find("routedns_router_latency", map[string]string{"id": "test-lowest-latency-prometheus", "resolver": "static"})
+	require.NotNil(t, latency.GetGauge())
+
+	h := find("routedns_client_latency_seconds", map[string]string{"id": "test-client-prometheus"}).GetHistogram()
+	require.Equal(t, uint64(1), h.GetSampleCount())
+	for _, b := range h.GetBucket() {
+		if b.GetUpperBound() < 0.003 {
+			require.Zero(t, b.GetCumulativeCount())
+		} else {
+			require.Equal(t, uint64(1), b.GetCumulativeCount())
+		}
+	}
+}
@@ -0,0 +1,233 @@
+package rdns
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// Time a client has to send the PROXY protocol header.
+const proxyHeaderTimeout = 10 * time.Second
+
+// Signature of PROXY protocol v2 headers.
+var proxyV2Signature = []byte("\r\n\r\n\x00\r\nQUIT\n")
+
+// proxyProtocolListener accepts connections that start with a PROXY protocol
+// (v1 or v2) header, as sent by load balancers like HAProxy. The remote
+// address of the connections is the client address from the header.
+type proxyProtocolListener struct {
+	net.Listener
+
+	// Only connections from these networks are expected to send a header,
+	// all connections if empty.
+	trusted []*net.IPNet
+}
+
+// NewProxyProtocolListener wraps a listener and reads PROXY protocol headers
+// from connections in the trusted networks, or all connections if no trusted
+// networks are given.
+func NewProxyProtocolListener(ln net.Listener, trusted []*net.IPNet) net.Listener {
+	return &proxyProtocolListener{Listener: ln, trusted: trusted}
+}
+
+func (l *proxyProtocolListener) Accept() (net.Conn, error) {
+	conn, err := l.Listener.Accept()
+	if err != nil {
+		return nil, err
+	}
+	if len(l.trusted) > 0 {
+		addr, ok := conn.RemoteAddr().(*net.TCPAddr)
+		if !ok || !isAllowed(l.trusted, addr.IP) {
+			return conn, nil
+		}
+	}
+	return &proxyProtocolConn{Conn: conn, r: bufio.NewReader(conn)}, nil
+}
+
+// proxyProtocolConn reads the PROXY protocol header on first use.
+type proxyProtocolConn struct {
+	net.Conn
+	r *bufio.Reader
+
+	once       sync.Once
+	err        error
+	remoteAddr net.Addr
+	localAddr  net.Addr
+
+	// Deadlines set before the header was read, restored once it's read
+	mu           sync.Mutex
+	readDeadline time.Time
+}
+
+func (c *proxyProtocolConn) Read(b []byte) (int, error) {
+	c.once.Do(c.readHeader)
+	if c.err != nil {
+		return 0, c.err
+	}
+	return c.r.Read(b)
+}
+
+func (c *proxyProtocolConn) RemoteAddr() net.Addr {
+	c.once.Do(c.readHeader)
+	if c.remoteAddr != nil {
+		return c.remoteAddr
+	}
+	return c.Conn.RemoteAddr()
+}
+
+func (c *proxyProtocolConn) LocalAddr() net.Addr {
+	c.once.Do(c.readHeader)
+	if c.localAddr != nil {
+		return c.localAddr
+	}
+	return c.Conn.LocalAddr()
+}
+
+func (c *proxyProtocolConn) SetDeadline(t time.Time) error {
+	c.mu.Lock()
+	c.readDeadline = t
+	c.mu.Unlock()
+	return c.Conn.SetDeadline(t)
+}
+
+func (c *proxyProtocolConn) SetReadDeadline(t time.Time) error {
+	c.mu.Lock()
+	c.readDeadline = t
+	c.mu.Unlock()
+	return c.Conn.SetReadDeadline(t)
+}
+
+func (c *proxyProtocolConn) readHeader() {
+	_ = c.Conn.SetReadDeadline(time.Now().Add(proxyHeaderTimeout))
+	c.remoteAddr, c.localAddr, c.err = readProxyHeader(c.r)
+	c.mu.Lock()
+	_ = c.Conn.SetReadDeadline(c.readDeadline)
+	c.mu.Unlock()
+	if c.err != nil {
+		Log.WithError(c.err).WithField("client", c.Conn.RemoteAddr().String()).Debug("invalid proxy protocol header")
+		c.Conn.Close()
+	}
+}
+
+// Reads a v1 or v2 PROXY protocol header. Returns nil addresses for headers
+// that don't carry addresses, like LOCAL or UNKNOWN.
+func readProxyHeader(r *bufio.Reader) (net.Addr, net.Addr, error) {
+	b, err := r.Peek(len(proxyV2Signature))
+	if err != nil {
+		return nil, nil, err
+	}
+	if bytes.Equal(b, proxyV2Signature) {
+		return readProxyHeaderV2(r)
+	}
+	if bytes.HasPrefix(b, []byte("PROXY ")) {
+		return readProxyHeaderV1(r)
+	}
+	return nil, nil, errors.New("no proxy protocol header")
+}
+
+// Parses a text header like "PROXY TCP4 192.0.2.1 192.0.2.2 56324 53\r\n".
+func readProxyHeaderV1(r *bufio.Reader) (net.Addr, net.Addr, error) {
+	// The header can be at most 107 bytes long
+	var line []byte
+	for {
+		c, err := r.ReadByte()
+		if err != nil {
+			return nil, nil, err
+		}
+		line = append(line, c)
+		if c == '\n' {
+			break
+		}
+		if len(line) >= 107 {
+			return nil, nil, errors.New("proxy protocol header too long")
+		}
+	}
+	s, ok := strings.CutSuffix(string(line), "\r\n")
+	if !ok {
+		return nil, nil, errors.New("invalid proxy protocol header")
+	}
+	fields := strings.Split(s, " ")
+	if len(fields) >= 2 && fields[1] == "UNKNOWN" {
+		return nil, nil, nil
+	}
+	if len(fields) != 6 || (fields[1] != "TCP4" && fields[1] != "TCP6") {
+		return nil, nil, fmt.Errorf("invalid proxy protocol header %q", s)
+	}
+	src, err := parseProxyAddr(fields[2], fields[4])
+	if err != nil {
+		return nil, nil, err
+	}
+	dst, err := parseProxyAddr(fields[3], fields[5])
+	if err != nil {
+		return nil, nil, err
+	}
+	return src, dst, nil
+}
+
+func parseProxyAddr(ip, port string) (*net.TCPAddr, error) {
+	addr := net.ParseIP(ip)
+	if addr == nil {
+		return nil, fmt.Errorf("invalid address %q in proxy protocol header", ip)
+	}
+	p, err := strconv.ParseUint(port, 10, 16)
+	if err != nil {
+		return nil, fmt.Errorf("invalid port %q in proxy protocol header", port)
+	}
+	return &net.TCPAddr{IP: addr, Port: int(p)}, nil
+}
+
+// Parses a binary v2 header.
+func readProxyHeaderV2(r *bufio.Reader) (net.Addr, net.Addr, error) {
+	header := make([]byte, 16)
+	if _, err := io.ReadFull(r, header); err != nil {
+		return nil, nil, err
+	}
+	if header[12]>>4 != 2 {
+		return nil, nil, fmt.Errorf("unsupported proxy protocol version %d", header[12]>>4)
+	}
+	command := header[12] & 0x0f
+	family := header[13]
+	payload := make([]byte, binary.BigEndian.Uint16(header[14:]))
+	if _, err := io.ReadFull(r, payload); err != nil {
+		return nil, nil, err
+	}
+
+	// LOCAL connections come from the proxy itself, e.g. health checks
+	if command == 0 {
+		return nil, nil, nil
+	}
+	if command != 1 {
+		return nil, nil, fmt.Errorf("unsupported proxy protocol command %d", command)
+	}
+	var ipLen int
+	switch family {
+	case 0x11: // TCP over IPv4
+		ipLen = net.IPv4len
+	case 0x21: // TCP over IPv6
+		ipLen = net.IPv6len
+	case 0x00: // Unspecified
+		return nil, nil, nil
+	default:
+		return nil, nil, fmt.Errorf("unsupported proxy protocol address family 0x%02x", family)
+	}
+	if len(payload) < 2*ipLen+4 {
+		return nil, nil, errors.New("proxy protocol header too short")
+	}
+	src := &net.TCPAddr{
+		IP:   net.IP(payload[:ipLen]),
+		Port: int(binary.BigEndian.Uint16(payload[2*ipLen:])),
+	}
+	dst := &net.TCPAddr{
+		IP:   net.IP(payload[ipLen : 2*ipLen]),
+		Port: int(binary.BigEndian.Uint16(payload[2*ipLen+2:])),
+	}
+	return src, dst, nil
+}
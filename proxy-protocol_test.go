@@ -0,0 +1,132 @@
+package rdns
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/binary"
+	"net"
+	"strings"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/miekg/dns"
+	"github.com/stretchr/testify/require"
+)
+
+// Build a v2 header for a TCP over IPv4 connection.
+func proxyHeaderV2(src, dst *net.TCPAddr) []byte {
+	b := append([]byte(nil), proxyV2Signature...)
+	b = append(b, 0x21, 0x11)
+	b = binary.BigEndian.AppendUint16(b, 12)
+	b = append(b, src.IP.To4()...)
+	b = append(b, dst.IP.To4()...)
+	b = binary.BigEndian.AppendUint16(b, uint16(src.Port))
+	b = binary.BigEndian.AppendUint16(b, uint16(dst.Port))
+	return b
+}
+
+func TestReadProxyHeader(t *testing.T) {
+	src := &net.TCPAddr{IP: net.ParseIP("192.0.2.10"), Port: 56324}
+	dst := &net.TCPAddr{IP: net.ParseIP("192.0.2.1"), Port: 53}
+
+	tests := map[string]struct {
+		header string
+		src    string
+		err    bool
+	}{
+		"v1 tcp4":    {header: "PROXY TCP4 192.0.2.10 192.0.2.1 56324 53\r\n", src: "192.0.2.10:56324"},
+		"v1 tcp6":    {header: "PROXY TCP6 2001:db8::10 2001:db8::1 56324 53\r\n", src: "[2001:db8::10]:56324"},
+		"v1 unknown": {header: "PROXY UNKNOWN\r\n"},
+		"v1 invalid": {header: "PROXY TCP4 192.0.2.10\r\n", err: true},
+		"v2 proxy":   {header: string(proxyHeaderV2(src, dst)), src: "192.0.2.10:56324"},
+		"v2 local":   {header: string(proxyV2Signature) + "\x20\x00\x00\x00"},
+		"none":       {header: "\x00\x1cDNS query payload", err: true},
+	}
+	for name, test := range tests {
+		r := bufio.NewReader(strings.NewReader(test.header + "payload"))
+		addr, _, err := readProxyHeader(r)
+		if test.err {
+			require.Error(t, err, name)
+			continue
+		}
+		require.NoError(t, err, name)
+		if test.src == "" {
+			require.Nil(t, addr, name)
+		} else {
+			require.Equal(t, test.src, addr.String(), name)
+		}
+		rest, _ := r.ReadString(0)
+		require.Equal(t, "payload", rest, name)
+	}
+}
+
+func TestDNSListenerProxyProtocol(t *testing.T) {
+	var sourceIP atomic.Value
+	upstream := &TestResolver{
+		ResolveFunc: func(q *dns.Msg, ci ClientInfo) (*dns.Msg, error) {
+			sourceIP.Store(ci.SourceIP.String())
+			a := new(dns.Msg)
+			a.SetReply(q)
+			return a, nil
+		},
+	}
+	addr, err := getLnAddress()
+	require.NoError(t, err)
+	s := NewDNSListener("test-proxy-protocol", addr, "tcp", ListenOptions{ProxyProtocol: true}, upstream)
+	go s.Start()
+	defer s.Shutdown()
+	time.Sleep(time.Second)
+
+	conn, err := net.Dial("tcp", addr)
+	require.NoError(t, err)
+	defer conn.Close()
+	src := &net.TCPAddr{IP: net.ParseIP("192.0.2.10"), Port: 56324}
+	dst := &net.TCPAddr{IP: net.ParseIP("192.0.2.1"), Port: 53}
+	_, err = conn.Write(proxyHeaderV2(src, dst))
+	require.NoError(t, err)
+
+	q := new(dns.Msg)
+	q.SetQuestion("example.com.", dns.TypeA)
+	dc := &dns.Conn{Conn: conn}
+	require.NoError(t, dc.WriteMsg(q))
+	a, err := dc.ReadMsg()
+	require.NoError(t, err)
+	require.Equal(t, q.Id, a.Id)
+	require.Equal(t, "192.0.2.10", sourceIP.Load())
+
+	// Connections without a header are closed
+	conn2, err := net.Dial("tcp", addr)
+	require.NoError(t, err)
+	defer conn2.Close()
+	dc = &dns.Conn{Conn: conn2}
+	require.NoError(t, dc.WriteMsg(q))
+	_, err = dc.ReadMsg()
+	require.Error(t, err)
+}
+
+func TestProxyProtocolListenerTrusted(t *testing.T) {
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	require.NoError(t, err)
+	_, trusted, _ := net.ParseCIDR("192.0.2.0/24")
+	pln := NewProxyProtocolListener(ln, []*net.IPNet{trusted})
+	defer pln.Close()
+
+	go func() {
+		conn, err := net.Dial("tcp", ln.Addr().String())
+		if err == nil {
+			_, _ = conn.Write([]byte("PROXY TCP4 192.0.2.10 192.0.2.1 56324 53\r\n"))
+			conn.Close()
+		}
+	}()
+
+	// The client isn't in a trusted network, the header is not parsed
+	conn, err := pln.Accept()
+	require.NoError(t, err)
+	defer conn.Close()
+	require.Equal(t, "127.0.0.1", conn.RemoteAddr().(*net.TCPAddr).IP.String())
+	b := make([]byte, 6)
+	_, err = conn.Read(b)
+	require.NoError(t, err)
+	require.True(t, bytes.HasPrefix(b, []byte("PROXY")))
+}
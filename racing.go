@@ -0,0 +1,171 @@
+package rdns
+
+import (
+	"expvar"
+	"fmt"
+	"sync"
+	"time"
+
+	"github.com/miekg/dns"
+)
+
+// RacingResolver is a resolver group that sends the same query to multiple
+// resolvers concurrently and returns the first successful response. Queries
+// that are still in progress once a response was returned are cancelled.
+type RacingResolver struct {
+	id        string
+	resolvers []Resolver
+	opt       RacingOptions
+
+	// Number of times each resolver had the fastest response.
+	wins *expvar.Map
+}
+
+var _ Resolver = &RacingResolver{}
+
+// RacingOptions contain settings for a racing resolver group.
+type RacingOptions struct {
+	// Send the query to the next resolver only if no successful response was
+	// received from the previous one within this time. Resolvers are started
+	// immediately if one of the others fails. All resolvers are queried at
+	// once if 0.
+	StartDelay time.Duration
+
+	// Only accept responses that have the AD (authenticated data) flag set.
+	RequireAD bool
+}
+
+// NewRacingResolver returns a new instance of a resolver group that returns the
+// fastest successful response from its resolvers.
+func NewRacingResolver(id string, resolvers []Resolver, opt RacingOptions) (*RacingResolver, error) {
+	if len(resolvers) == 0 {
+		return nil, fmt.Errorf("no resolvers defined for racing group %q", id)
+	}
+	if opt.StartDelay < 0 {
+		return nil, fmt.Errorf("invalid start delay in racing group %q", id)
+	}
+	return newRacingResolver(id, resolvers, opt), nil
+}
+
+func newRacingResolver(id string, resolvers []Resolver, opt RacingOptions) *RacingResolver {
+	return &RacingResolver{
+		id:        id,
+		resolvers: resolvers,
+		opt:       opt,
+		wins:      getVarMap("router", id, "wins"),
+	}
+}
+
+// Resolve a DNS query by sending it to the resolvers and returning the fastest
+// non-error response
+func (r *RacingResolver) Resolve(q *dns.Msg, ci ClientInfo) (*dns.Msg, error) {
+	log := logger(r.id, q, ci)
+
+	// Signal to the upstream resolvers that the AD flag is understood
+	if r.opt.RequireAD && !q.AuthenticatedData {
+		q = q.Copy()
+		q.AuthenticatedData = true
+	}
+
+	// Queries that are still in progress are cancelled once this returns, or
+	// when the query to this group is cancelled itself
+	done := make(chan struct{})
+	var once sync.Once
+	cancel := func() { once.Do(func() { close(done) }) }
+	defer cancel()
+	if parent := ci.Done; parent != nil {
+		go func() {
+			select {
+			case <-parent:
+				cancel()
+			case <-done:
+			}
+		}()
+	}
+	ci.Done = done
+
+	type response struct {
+		r   Resolver
+		a   *dns.Msg
+		err error
+	}
+
+	// The responses are collected in a buffered channel so that cancelled requests
+	// can complete without blocking.
+	responseCh := make(chan response, len(r.resolvers))
+	var started int
+	startNext := func() {
+		resolver := r.resolvers[started]
+		started++
+		go func() {
+			a, err := resolver.Resolve(q, ci)
+			responseCh <- response{resolver, a, err}
+		}()
+	}
+
+	// Send the query to all resolvers, or just the first if they are staggered
+	var next <-chan time.Time
+	if r.opt.StartDelay > 0 {
+		startNext()
+		timer := time.NewTimer(r.opt.StartDelay)
+		defer timer.Stop()
+		next = timer.C
+	} else {
+		for started < len(r.resolvers) {
+			startNext()
+		}
+	}
+
+	// Wait for responses, the first one that is successful is returned while the remaining open requests
+	// are cancelled. Resolvers that haven't been started yet are not queried.
+	var i int
+	for {
+		select {
+		case <-next:
+			if started < len(r.resolvers) {
+				startNext()
+				next = time.After(r.opt.StartDelay)
+			}
+		case <-done:
+			return nil, errQueryCancelled
+		case resolverResponse := <-responseCh:
+			resolver, a, err := resolverResponse.r, resolverResponse.a, resolverResponse.err
+			if r.accept(a, err) { // Return immediately if successful
+				log.WithField("resolver", resolver.String()).Trace("using response from resolver")
+				r.wins.Add(resolver.String(), 1)
+				return a, err
+			}
+			log.WithField("resolver", resolver.String()).WithError(err).Debug("resolver returned failure, waiting for next response")
+
+			// If all responses were bad, return the last one. Unauthenticated responses
+			// are not used if AD is required.
+			if i++; i >= len(r.resolvers) {
+				if err == nil && a != nil && a.Rcode != dns.RcodeServerFailure {
+					return servfail(q), nil
+				}
+				return a, err
+			}
+
+			// Don't wait for the delay if all started resolvers have failed
+			if i == started {
+				startNext()
+				next = time.After(r.opt.StartDelay)
+			}
+		}
+	}
+}
+
+func (r *RacingResolver) String() string {
+	return r.id
+}
+
+// Returns true if the response can be used.
+func (r *RacingResolver) accept(a *dns.Msg, err error) bool {
+	if err != nil {
+		return false
+	}
+	if r.opt.RequireAD {
+		return a != nil && a.Rcode != dns.RcodeServerFailure && a.AuthenticatedData
+	}
+	return a == nil || a.Rcode != dns.RcodeServerFailure
+}
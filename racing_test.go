@@ -0,0 +1,148 @@
+package rdns
+
+import (
+	"errors"
+	"expvar"
+	"testing"
+	"time"
+
+	"github.com/miekg/dns"
+	"github.com/stretchr/testify/require"
+	"go.uber.org/goleak"
+)
+
+func TestRacingResolverStartDelay(t *testing.T) {
+	defer goleak.VerifyNone(t, goleak.IgnoreCurrent())
+
+	var ci ClientInfo
+	cancelled := make(chan struct{})
+	slow := &TestResolver{
+		ResolveFunc: func(q *dns.Msg, ci ClientInfo) (*dns.Msg, error) {
+			select {
+			case <-ci.Done:
+				close(cancelled)
+				return nil, errQueryCancelled
+			case <-time.After(time.Hour):
+				return new(dns.Msg).SetReply(q), nil
+			}
+		},
+	}
+	fast := new(TestResolver)
+	unused := new(TestResolver)
+
+	g, err := NewRacingResolver("test-racing-delay", []Resolver{slow, fast, unused}, RacingOptions{StartDelay: 20 * time.Millisecond})
+	require.NoError(t, err)
+	q := new(dns.Msg)
+	q.SetQuestion("test.com.", dns.TypeA)
+
+	// The first resolver is too slow, the second one is started after the delay
+	// and wins. The third is never queried.
+	a, err := g.Resolve(q, ci)
+	require.NoError(t, err)
+	require.NotNil(t, a)
+
+	// The query to the slow resolver is cancelled instead of left running
+	select {
+	case <-cancelled:
+	case <-time.After(time.Second):
+		t.Fatal("query to the slow resolver wasn't cancelled")
+	}
+	require.Equal(t, 1, slow.HitCount())
+	require.Equal(t, 1, fast.HitCount())
+	require.Equal(t, 0, unused.HitCount())
+	require.Equal(t, int64(1), g.wins.Get(fast.String()).(*expvar.Int).Value())
+}
+
+// Queries of a racing group are cancelled when the query to the group is.
+func TestRacingResolverCancel(t *testing.T) {
+	defer goleak.VerifyNone(t, goleak.IgnoreCurrent())
+
+	started := make(chan struct{})
+	blocking := &TestResolver{
+		ResolveFunc: func(q *dns.Msg, ci ClientInfo) (*dns.Msg, error) {
+			close(started)
+			<-ci.Done
+			return nil, errQueryCancelled
+		},
+	}
+	g, err := NewRacingResolver("test-racing-cancel", []Resolver{blocking}, RacingOptions{})
+	require.NoError(t, err)
+	q := new(dns.Msg)
+	q.SetQuestion("test.com.", dns.TypeA)
+
+	done := make(chan struct{})
+	errCh := make(chan error, 1)
+	go func() {
+		_, err := g.Resolve(q, ClientInfo{Done: done})
+		errCh <- err
+	}()
+	<-started
+	close(done)
+	require.ErrorIs(t, <-errCh, errQueryCancelled)
+}
+
+func TestRacingResolverOptions(t *testing.T) {
+	_, err := NewRacingResolver("test-racing-options", nil, RacingOptions{})
+	require.Error(t, err)
+	_, err = NewRacingResolver("test-racing-options", []Resolver{new(TestResolver)}, RacingOptions{StartDelay: -1})
+	require.Error(t, err)
+}
+
+func TestRacingResolverStartDelayFailure(t *testing.T) {
+	var ci ClientInfo
+	failing := &TestResolver{
+		ResolveFunc: func(q *dns.Msg, ci ClientInfo) (*dns.Msg, error) {
+			return nil, errors.New("failed")
+		},
+	}
+	r2 := new(TestResolver)
+
+	// The second resolver is started right away when the first one fails
+	g, err := NewRacingResolver("test-racing-delay-fail", []Resolver{failing, r2}, RacingOptions{StartDelay: time.Hour})
+	require.NoError(t, err)
+	q := new(dns.Msg)
+	q.SetQuestion("test.com.", dns.TypeA)
+	start := time.Now()
+	_, err = g.Resolve(q, ci)
+	require.NoError(t, err)
+	require.Less(t, time.Since(start), time.Second)
+	require.Equal(t, 1, r2.HitCount())
+}
+
+func TestRacingResolverRequireAD(t *testing.T) {
+	var ci ClientInfo
+	var queryAD bool
+	unauthenticated := &TestResolver{
+		ResolveFunc: func(q *dns.Msg, ci ClientInfo) (*dns.Msg, error) {
+			a := new(dns.Msg).SetReply(q)
+			a.AuthenticatedData = false
+			return a, nil
+		},
+	}
+	authenticated := &TestResolver{
+		ResolveFunc: func(q *dns.Msg, ci ClientInfo) (*dns.Msg, error) {
+			queryAD = q.AuthenticatedData
+			time.Sleep(10 * time.Millisecond)
+			a := new(dns.Msg).SetReply(q)
+			a.AuthenticatedData = true
+			return a, nil
+		},
+	}
+
+	// The faster response without AD is ignored
+	g, err := NewRacingResolver("test-racing-ad", []Resolver{unauthenticated, authenticated}, RacingOptions{RequireAD: true})
+	require.NoError(t, err)
+	q := new(dns.Msg)
+	q.SetQuestion("test.com.", dns.TypeA)
+	a, err := g.Resolve(q, ci)
+	require.NoError(t, err)
+	require.True(t, a.AuthenticatedData)
+	require.True(t, queryAD)
+
+	// SERVFAIL if no resolver returns an authenticated response
+	g, err = NewRacingResolver("test-racing-ad-fail", []Resolver{unauthenticated}, RacingOptions{RequireAD: true})
+	require.NoError(t, err)
+	a, err = g.Resolve(q, ci)
+	require.NoError(t, err)
+	require.Equal(t, dns.RcodeServerFailure, a.Rcode)
+}
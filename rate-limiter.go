@@ -1,16 +1,23 @@
 package rdns
 
 import (
+	"container/list"
 	"expvar"
+	"math"
 	"net"
+	"strings"
 	"sync"
+	"sync/atomic"
 	"time"
 
 	"github.com/miekg/dns"
+	"golang.org/x/time/rate"
 )
 
 // RateLimiter is a resolver that limits the number of queries by a client (network)
-// that are passed to the upstream resolver per timeframe.
+// that are passed to the upstream resolver per timeframe. By default it uses fixed
+// windows, or a token bucket per client if a Rate is configured. Queries can also
+// be limited by query name, or by the combination of client and name.
 type RateLimiter struct {
 	id       string
 	resolver Resolver
@@ -20,16 +27,69 @@ type RateLimiter struct {
 	currWinID int64
 	counters  map[string]*uint
 	metrics   *RateLimiterMetrics
+
+	// Token buckets by client, most recently used first
+	buckets   *list.List
+	bucketIdx map[string]*list.Element
+
+	exempt ipNetworks
+
+	// Number of dropped queries, used to pick the ones to slip
+	dropped atomic.Uint64
+}
+
+type rateBucket struct {
+	key     string
+	limiter *rate.Limiter
 }
 
 var _ Resolver = &RateLimiter{}
 
+// RateLimitKey defines what queries are counted against the same limit.
+type RateLimitKey int
+
+const (
+	// Limit queries by client network
+	RateLimitKeyClient RateLimitKey = iota
+	// Limit queries by query name, regardless of the client
+	RateLimitKeyName
+	// Limit queries by client network and query name
+	RateLimitKeyClientName
+)
+
 type RateLimiterOptions struct {
 	Requests      uint     // Number of requests allwed per time period
 	Window        uint     // Time period in seconds
 	Prefix4       uint8    // Netmask to identify IP4 clients
 	Prefix6       uint8    // Netmask to identify IP6 clients
 	LimitResolver Resolver // Alternate resolver for rate-limited requests
+
+	// Queries per second allowed for each client. If set, a token bucket is used
+	// instead of fixed windows, and Requests and Window are ignored.
+	Rate float64
+
+	// Max number of queries a client can send at once in token bucket mode.
+	// Defaults to Rate, rounded up.
+	Burst int
+
+	// Max number of clients to keep token buckets for. The least recently seen
+	// client is removed when the limit is reached. Default 100000.
+	MaxClients int
+
+	// Respond to rate-limited queries with this code instead of dropping them.
+	// Not used if a LimitResolver is configured.
+	ExceededRcode int
+
+	// Clients in these networks are not rate-limited.
+	Exempt []*net.IPNet
+
+	// What the limit applies to, the client network by default.
+	Key RateLimitKey
+
+	// Respond to every Nth query that would be dropped with an empty truncated
+	// response instead, so legitimate clients whose address is abused in a
+	// reflection attack can retry over TCP. 1 truncates all of them, 0 drops all.
+	Slip uint
 }
 
 type RateLimiterMetrics struct {
@@ -39,6 +99,10 @@ type RateLimiterMetrics struct {
 	exceed *expvar.Int
 	// Count of dropped queries.
 	drop *expvar.Int
+	// Number of clients with a token bucket.
+	clients *expvar.Int
+	// Count of truncated responses sent instead of dropping queries.
+	slip *expvar.Int
 }
 
 // NewRateLimiterIP returns a new instance of a query rate limiter.
@@ -52,16 +116,30 @@ func NewRateLimiter(id string, resolver Resolver, opt RateLimiterOptions) *RateL
 	if opt.Prefix6 == 0 {
 		opt.Prefix6 = 56
 	}
-	return &RateLimiter{
+	if opt.Burst == 0 {
+		opt.Burst = int(math.Ceil(opt.Rate))
+	}
+	if opt.MaxClients == 0 {
+		opt.MaxClients = 100000
+	}
+	r := &RateLimiter{
 		id:                 id,
 		resolver:           resolver,
 		RateLimiterOptions: opt,
 		metrics: &RateLimiterMetrics{
-			query:  getVarInt("router", id, "query"),
-			exceed: getVarInt("router", id, "exceed"),
-			drop:   getVarInt("router", id, "drop"),
+			query:   getVarInt("router", id, "query"),
+			exceed:  getVarInt("router", id, "exceed"),
+			drop:    getVarInt("router", id, "drop"),
+			clients: getVarInt("router", id, "clients"),
+			slip:    getVarInt("router", id, "slip"),
 		},
+		buckets:   list.New(),
+		bucketIdx: make(map[string]*list.Element),
 	}
+	for _, n := range opt.Exempt {
+		r.exempt.add(n, 0)
+	}
+	return r
 }
 
 // Resolve a DNS query while limiting the query rate per time period.
@@ -69,6 +147,60 @@ func (r *RateLimiter) Resolve(q *dns.Msg, ci ClientInfo) (*dns.Msg, error) {
 	log := logger(r.id, q, ci)
 	r.metrics.query.Add(1)
 
+	if _, ok := r.exempt.lookup(ci.SourceIP); ok {
+		log.WithField("resolver", r.resolver).Debug("client exempt from rate-limit, forwarding query to resolver")
+		return r.resolver.Resolve(q, ci)
+	}
+
+	key := r.key(q, ci)
+
+	var reject bool
+	if r.Rate > 0 {
+		reject = !r.bucket(key).Allow()
+	} else {
+		reject = r.windowExceeded(key)
+	}
+
+	if reject {
+		r.metrics.exceed.Add(1)
+		if r.LimitResolver != nil {
+			log.WithField("resolver", r.LimitResolver).Debug("rate-limit exceeded, forwarding to limit-resolver")
+			return r.LimitResolver.Resolve(q, ci)
+		}
+		if r.ExceededRcode != 0 {
+			log.Debug("rate-limit reached, responding with rcode")
+			a := responseWithCode(q, r.ExceededRcode)
+			addEDE(a, q, dns.ExtendedErrorCodeOther, "rate limit exceeded")
+			return a, nil
+		}
+		if r.Slip > 0 && r.dropped.Add(1)%uint64(r.Slip) == 0 {
+			r.metrics.slip.Add(1)
+			log.Debug("rate-limit reached, responding with truncated response")
+			a := new(dns.Msg)
+			a.SetReply(q)
+			a.Truncated = true
+			addEDE(a, q, dns.ExtendedErrorCodeOther, "rate limit exceeded")
+			return a, nil
+		}
+		r.metrics.drop.Add(1)
+		log.Debug("rate-limit reached, dropping")
+		return nil, nil
+	}
+	log.WithField("resolver", r.resolver).Debug("forwarding query to resolver")
+	return r.resolver.Resolve(q, ci)
+}
+
+// Build the key that identifies the client (network) and/or query name the
+// limit is applied to.
+func (r *RateLimiter) key(q *dns.Msg, ci ClientInfo) string {
+	var name string
+	if len(q.Question) > 0 {
+		name = strings.ToLower(q.Question[0].Name)
+	}
+	if r.Key == RateLimitKeyName {
+		return name
+	}
+
 	// Apply the desired mask to the client IP to build a key it identify the client (network)
 	source := ci.SourceIP
 	if ip4 := source.To4(); len(ip4) == net.IPv4len {
@@ -76,8 +208,15 @@ func (r *RateLimiter) Resolve(q *dns.Msg, ci ClientInfo) (*dns.Msg, error) {
 	} else {
 		source = source.Mask(net.CIDRMask(int(r.Prefix6), 128))
 	}
-	key := source.String()
+	if r.Key == RateLimitKeyClientName {
+		return source.String() + " " + name
+	}
+	return source.String()
+}
 
+// Count a query in the current fixed window and return true if the client has
+// made too many.
+func (r *RateLimiter) windowExceeded(key string) bool {
 	// Calculate the current (fixed) window
 	windowID := time.Now().Unix() / int64(r.Window)
 
@@ -103,19 +242,27 @@ func (r *RateLimiter) Resolve(q *dns.Msg, ci ClientInfo) (*dns.Msg, error) {
 	}
 	*v++
 	r.mu.Unlock()
+	return reject
+}
 
-	if reject {
-		r.metrics.exceed.Add(1)
-		if r.LimitResolver != nil {
-			log.WithField("resolver", r.LimitResolver).Debug("rate-limit exceeded, forwarding to limit-resolver")
-			return r.LimitResolver.Resolve(q, ci)
-		}
-		r.metrics.drop.Add(1)
-		log.Debug("rate-limit reached, dropping")
-		return nil, nil
+// Returns the token bucket for a client, creating it if needed. Removes the
+// least recently used bucket if there are too many.
+func (r *RateLimiter) bucket(key string) *rate.Limiter {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	if e, ok := r.bucketIdx[key]; ok {
+		r.buckets.MoveToFront(e)
+		return e.Value.(*rateBucket).limiter
 	}
-	log.WithField("resolver", r.resolver).Debug("forwarding query to resolver")
-	return r.resolver.Resolve(q, ci)
+	b := &rateBucket{key: key, limiter: rate.NewLimiter(rate.Limit(r.Rate), r.Burst)}
+	r.bucketIdx[key] = r.buckets.PushFront(b)
+	for r.buckets.Len() > r.MaxClients {
+		oldest := r.buckets.Back()
+		r.buckets.Remove(oldest)
+		delete(r.bucketIdx, oldest.Value.(*rateBucket).key)
+	}
+	r.metrics.clients.Set(int64(r.buckets.Len()))
+	return b.limiter
 }
 
 func (r *RateLimiter) String() string {
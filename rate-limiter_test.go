@@ -0,0 +1,182 @@
+package rdns
+
+import (
+	"net"
+	"testing"
+
+	"github.com/miekg/dns"
+	"github.com/stretchr/testify/require"
+)
+
+func TestRateLimiterBurst(t *testing.T) {
+	r := new(TestResolver)
+	l := NewRateLimiter("test-rl-burst", r, RateLimiterOptions{
+		Rate:          1,
+		Burst:         3,
+		ExceededRcode: dns.RcodeRefused,
+	})
+	q := new(dns.Msg)
+	q.SetQuestion("example.com.", dns.TypeA)
+	ci := ClientInfo{SourceIP: net.ParseIP("192.0.2.1")}
+
+	// The burst is allowed, the query after that is refused
+	for i := 0; i < 3; i++ {
+		a, err := l.Resolve(q, ci)
+		require.NoError(t, err)
+		require.Equal(t, dns.RcodeSuccess, a.Rcode)
+	}
+	a, err := l.Resolve(q, ci)
+	require.NoError(t, err)
+	require.Equal(t, dns.RcodeRefused, a.Rcode)
+	require.Equal(t, 3, r.HitCount())
+	require.Equal(t, int64(1), l.metrics.exceed.Value())
+}
+
+func TestRateLimiterEDE(t *testing.T) {
+	r := new(TestResolver)
+	l := NewRateLimiter("test-rl-ede", r, RateLimiterOptions{
+		Rate:          1,
+		Burst:         1,
+		ExceededRcode: dns.RcodeRefused,
+	})
+	q := new(dns.Msg)
+	q.SetQuestion("example.com.", dns.TypeA)
+	q.SetEdns0(1232, false)
+	ci := ClientInfo{SourceIP: net.ParseIP("192.0.2.1")}
+
+	a, err := l.Resolve(q, ci)
+	require.NoError(t, err)
+	require.Empty(t, extendedErrors(a))
+
+	// The refused response names the reason
+	a, err = l.Resolve(q, ci)
+	require.NoError(t, err)
+	require.Equal(t, dns.RcodeRefused, a.Rcode)
+	errs := extendedErrors(a)
+	require.Len(t, errs, 1)
+	require.Equal(t, dns.ExtendedErrorCodeOther, errs[0].InfoCode)
+	require.Equal(t, "rate limit exceeded", errs[0].ExtraText)
+	require.Equal(t, uint16(1232), a.IsEdns0().UDPSize())
+}
+
+func TestRateLimiterSubnet(t *testing.T) {
+	_, exempt, err := net.ParseCIDR("198.51.100.0/24")
+	require.NoError(t, err)
+	r := new(TestResolver)
+	l := NewRateLimiter("test-rl-subnet", r, RateLimiterOptions{
+		Rate:    1,
+		Burst:   2,
+		Prefix4: 24,
+		Exempt:  []*net.IPNet{exempt},
+	})
+	q := new(dns.Msg)
+	q.SetQuestion("example.com.", dns.TypeA)
+
+	// Clients in the same /24 share a bucket, queries beyond the burst are dropped
+	for _, ip := range []string{"192.0.2.1", "192.0.2.2", "192.0.2.3"} {
+		_, err := l.Resolve(q, ClientInfo{SourceIP: net.ParseIP(ip)})
+		require.NoError(t, err)
+	}
+	require.Equal(t, 2, r.HitCount())
+	require.Equal(t, int64(1), l.metrics.drop.Value())
+
+	// A client in a different network has its own bucket
+	_, err = l.Resolve(q, ClientInfo{SourceIP: net.ParseIP("192.0.3.1")})
+	require.NoError(t, err)
+	require.Equal(t, 3, r.HitCount())
+
+	// Exempt clients are never limited
+	for i := 0; i < 5; i++ {
+		_, err := l.Resolve(q, ClientInfo{SourceIP: net.ParseIP("198.51.100.1")})
+		require.NoError(t, err)
+	}
+	require.Equal(t, 8, r.HitCount())
+}
+
+func TestRateLimiterEviction(t *testing.T) {
+	r := new(TestResolver)
+	l := NewRateLimiter("test-rl-evict", r, RateLimiterOptions{
+		Rate:       1,
+		Burst:      1,
+		Prefix4:    32,
+		MaxClients: 2,
+	})
+	q := new(dns.Msg)
+	q.SetQuestion("example.com.", dns.TypeA)
+	resolve := func(ip string) {
+		_, err := l.Resolve(q, ClientInfo{SourceIP: net.ParseIP(ip)})
+		require.NoError(t, err)
+	}
+
+	resolve("192.0.2.1")
+	resolve("192.0.2.2")
+	require.Equal(t, int64(2), l.metrics.clients.Value())
+
+	// A third client evicts the least recently used one
+	resolve("192.0.2.3")
+	require.Equal(t, int64(2), l.metrics.clients.Value())
+	require.NotContains(t, l.bucketIdx, "192.0.2.1")
+
+	// The evicted client starts over with a full bucket
+	resolve("192.0.2.1")
+	require.Equal(t, 4, r.HitCount())
+	resolve("192.0.2.1")
+	require.Equal(t, 4, r.HitCount())
+}
+
+func TestRateLimiterByName(t *testing.T) {
+	r := new(TestResolver)
+	l := NewRateLimiter("test-rl-name", r, RateLimiterOptions{
+		Rate:  1,
+		Burst: 1,
+		Key:   RateLimitKeyName,
+	})
+	resolve := func(name, ip string) {
+		q := new(dns.Msg)
+		q.SetQuestion(name, dns.TypeA)
+		_, err := l.Resolve(q, ClientInfo{SourceIP: net.ParseIP(ip)})
+		require.NoError(t, err)
+	}
+
+	// Queries for the same name share a bucket, regardless of the client
+	resolve("example.com.", "192.0.2.1")
+	resolve("EXAMPLE.com.", "198.51.100.1")
+	require.Equal(t, 1, r.HitCount())
+
+	// Other names have their own bucket
+	resolve("example.net.", "192.0.2.1")
+	require.Equal(t, 2, r.HitCount())
+}
+
+func TestRateLimiterSlip(t *testing.T) {
+	r := new(TestResolver)
+	l := NewRateLimiter("test-rl-slip", r, RateLimiterOptions{
+		Rate:  1,
+		Burst: 1,
+		Slip:  2,
+	})
+	q := new(dns.Msg)
+	q.SetQuestion("example.com.", dns.TypeA)
+	ci := ClientInfo{SourceIP: net.ParseIP("192.0.2.1")}
+
+	a, err := l.Resolve(q, ci)
+	require.NoError(t, err)
+	require.False(t, a.Truncated)
+
+	// Every second query over the limit gets a truncated response, the others
+	// are dropped
+	var truncated int
+	for i := 0; i < 4; i++ {
+		a, err := l.Resolve(q, ci)
+		require.NoError(t, err)
+		if a != nil {
+			require.True(t, a.Truncated)
+			require.Empty(t, a.Answer)
+			truncated++
+		}
+	}
+	require.Equal(t, 2, truncated)
+	require.Equal(t, int64(2), l.metrics.drop.Value())
+	require.Equal(t, int64(2), l.metrics.slip.Value())
+	require.Equal(t, 1, r.HitCount())
+}
@@ -0,0 +1,123 @@
+package rdns
+
+import (
+	"fmt"
+	"net"
+	"strings"
+
+	"github.com/miekg/dns"
+)
+
+// RebindingBlocker is a resolver that protects against DNS rebinding attacks. It
+// blocks responses for public names that contain private, loopback, or link-local
+// addresses.
+type RebindingBlocker struct {
+	id       string
+	resolver Resolver
+	RebindingOptions
+	allowlist []string
+	metrics   *BlocklistMetrics
+}
+
+var _ Resolver = &RebindingBlocker{}
+
+type RebindingOptions struct {
+	// Domain suffixes that are allowed to resolve to private addresses, in
+	// addition to localhost, local, and home.arpa. A leading "*." or "." is
+	// ignored, "internal" matches internal. and all its sub-domains.
+	Allowlist []string
+
+	// Response code for blocked responses. dns.RcodeRefused (default) or
+	// dns.RcodeServerFailure.
+	BlockRcode int
+}
+
+// Names that are private by definition and can always have private addresses.
+var rebindingPrivateDomains = []string{"localhost.", "local.", "home.arpa."}
+
+// NewRebindingBlocker returns a new instance of a DNS rebinding blocker.
+func NewRebindingBlocker(id string, resolver Resolver, opt RebindingOptions) (*RebindingBlocker, error) {
+	switch opt.BlockRcode {
+	case dns.RcodeSuccess:
+		opt.BlockRcode = dns.RcodeRefused
+	case dns.RcodeRefused, dns.RcodeServerFailure:
+	default:
+		return nil, fmt.Errorf("unsupported response code %d for blocked responses, must be REFUSED or SERVFAIL", opt.BlockRcode)
+	}
+	allowlist := append([]string{}, rebindingPrivateDomains...)
+	for _, domain := range opt.Allowlist {
+		s := strings.TrimPrefix(domain, "*")
+		s = strings.TrimPrefix(s, ".")
+		if s == "" || s == "." {
+			return nil, fmt.Errorf("invalid domain %q in rebinding allowlist", domain)
+		}
+		allowlist = append(allowlist, strings.ToLower(dns.Fqdn(s)))
+	}
+	return &RebindingBlocker{
+		id:               id,
+		resolver:         resolver,
+		RebindingOptions: opt,
+		allowlist:        allowlist,
+		metrics:          NewBlocklistMetrics(id),
+	}, nil
+}
+
+// Resolve a DNS query using the upstream resolver and block the response if it
+// contains private addresses for a name that isn't private itself.
+func (r *RebindingBlocker) Resolve(q *dns.Msg, ci ClientInfo) (*dns.Msg, error) {
+	answer, err := r.resolver.Resolve(q, ci)
+	if err != nil || answer == nil {
+		return answer, err
+	}
+	if r.isAllowed(qName(q)) {
+		r.metrics.allowed.Add(1)
+		return answer, nil
+	}
+
+	// Look at all address records in the answer, not just those of the query
+	// name, to include the targets of CNAME chains.
+	for _, rr := range answer.Answer {
+		var ip net.IP
+		switch record := rr.(type) {
+		case *dns.A:
+			ip = record.A
+		case *dns.AAAA:
+			ip = record.AAAA
+		default:
+			continue
+		}
+		if !isRebindingIP(ip) {
+			continue
+		}
+		log := logger(r.id, q, ci).WithField("ip", ip.String())
+		log.Debug("private address in response, blocking")
+		r.metrics.countBlocked(q, nil)
+		return responseWithCode(q, r.BlockRcode), nil
+	}
+	r.metrics.allowed.Add(1)
+	return answer, nil
+}
+
+func (r *RebindingBlocker) String() string {
+	return r.id
+}
+
+// Returns true if the name is on the allowlist or one of its sub-domains.
+func (r *RebindingBlocker) isAllowed(name string) bool {
+	name = strings.ToLower(name)
+	for _, suffix := range r.allowlist {
+		if name == suffix || strings.HasSuffix(name, "."+suffix) {
+			return true
+		}
+	}
+	return false
+}
+
+// Returns true if the address is private (RFC1918 or ULA), loopback, link-local,
+// or unspecified.
+func isRebindingIP(ip net.IP) bool {
+	return ip.IsPrivate() ||
+		ip.IsLoopback() ||
+		ip.IsLinkLocalUnicast() ||
+		ip.IsUnspecified()
+}
@@ -0,0 +1,87 @@
+package rdns
+
+import (
+	"testing"
+
+	"github.com/miekg/dns"
+	"github.com/stretchr/testify/require"
+)
+
+func TestRebindingBlocker(t *testing.T) {
+	var ci ClientInfo
+	upstream := &TestResolver{ResolveFunc: func(q *dns.Msg, ci ClientInfo) (*dns.Msg, error) {
+		a := new(dns.Msg)
+		a.SetReply(q)
+		var records []string
+		switch qName(q) {
+		case "public.test.":
+			records = []string{"public.test. 60 IN A 1.2.3.4"}
+		case "cname.test.", "router.internal.":
+			records = []string{
+				qName(q) + " 60 IN CNAME target.test.",
+				"target.test. 60 IN A 1.2.3.4",
+				"target.test. 60 IN A 192.168.1.1",
+			}
+		case "v6.test.":
+			records = []string{"v6.test. 60 IN AAAA fd00::1"}
+		case "loop.test.":
+			records = []string{"loop.test. 60 IN A 127.0.0.1"}
+		case "printer.local.":
+			records = []string{"printer.local. 60 IN A 10.0.0.5"}
+		}
+		for _, s := range records {
+			rr, err := dns.NewRR(s)
+			if err != nil {
+				return nil, err
+			}
+			a.Answer = append(a.Answer, rr)
+		}
+		return a, nil
+	}}
+
+	r, err := NewRebindingBlocker("test-rebinding", upstream, RebindingOptions{
+		Allowlist: []string{"*.internal"},
+	})
+	require.NoError(t, err)
+
+	tests := []struct {
+		name  string
+		rcode int
+	}{
+		{"public.test.", dns.RcodeSuccess},
+		{"cname.test.", dns.RcodeRefused},      // Private address at the end of a CNAME chain
+		{"v6.test.", dns.RcodeRefused},         // ULA
+		{"loop.test.", dns.RcodeRefused},       // Loopback
+		{"router.internal.", dns.RcodeSuccess}, // On the allowlist
+		{"printer.local.", dns.RcodeSuccess},   // Private by definition
+	}
+	for _, test := range tests {
+		q := new(dns.Msg)
+		q.SetQuestion(test.name, dns.TypeA)
+		a, err := r.Resolve(q, ci)
+		require.NoError(t, err)
+		require.Equal(t, test.rcode, a.Rcode, test.name)
+		if test.rcode != dns.RcodeSuccess {
+			require.Empty(t, a.Answer)
+		}
+	}
+	require.Equal(t, int64(3), r.metrics.blocked.Value())
+	require.Equal(t, int64(3), r.metrics.allowed.Value())
+
+	// Blocking with SERVFAIL instead
+	r, err = NewRebindingBlocker("test-rebinding-servfail", upstream, RebindingOptions{
+		BlockRcode: dns.RcodeServerFailure,
+	})
+	require.NoError(t, err)
+	q := new(dns.Msg)
+	q.SetQuestion("loop.test.", dns.TypeA)
+	a, err := r.Resolve(q, ci)
+	require.NoError(t, err)
+	require.Equal(t, dns.RcodeServerFailure, a.Rcode)
+
+	// Other response codes aren't supported
+	_, err = NewRebindingBlocker("test-rebinding-invalid", upstream, RebindingOptions{
+		BlockRcode: dns.RcodeNameError,
+	})
+	require.Error(t, err)
+}
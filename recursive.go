@@ -0,0 +1,495 @@
+package rdns
+
+import (
+	"errors"
+	"fmt"
+	"net"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/miekg/dns"
+	"github.com/sirupsen/logrus"
+)
+
+// Recursive is a resolver that doesn't forward queries to an upstream resolver
+// but resolves them iteratively itself, starting at the root servers. Known
+// delegations are cached. By default, QNAME minimization as per RFC 9156 is
+// used so that servers only learn as much of the query name as they need to
+// answer. Responses are not cached, a cache should be placed in front of it.
+type Recursive struct {
+	id      string
+	opt     RecursiveOptions
+	hints   []string
+	metrics *ListenerMetrics
+
+	mu    sync.Mutex
+	zones map[string]*delegation
+
+	// Sends a query to a single server, can be replaced in tests
+	exchange func(q *dns.Msg, server string) (*dns.Msg, error)
+}
+
+var _ Resolver = &Recursive{}
+
+// RecursiveOptions contain settings for the recursive resolver.
+type RecursiveOptions struct {
+	// IP addresses of the root servers used to prime the resolver. Defaults to
+	// the IPv4 addresses of the IANA root servers.
+	RootHints []string
+
+	// Send the full query name to all servers instead of only the labels
+	// needed at each step.
+	NoQNameMinimization bool
+
+	// Also use IPv6 addresses of name servers. Only IPv4 is used by default.
+	IPv6 bool
+
+	// Time to wait for a response from a name server, default 2 seconds.
+	QueryTimeout time.Duration
+
+	// Local IP to send queries from.
+	LocalAddr net.IP
+}
+
+// IPv4 addresses of a.root-servers.net to m.root-servers.net.
+var defaultRootHints = []string{
+	"198.41.0.4",
+	"170.247.170.2",
+	"192.33.4.12",
+	"199.7.91.13",
+	"192.203.230.10",
+	"192.5.5.241",
+	"192.112.36.4",
+	"198.97.190.53",
+	"192.36.148.17",
+	"192.58.128.30",
+	"193.0.14.129",
+	"199.7.83.42",
+	"202.12.27.33",
+}
+
+const (
+	// Max number of referrals and minimization steps while resolving a name
+	recursiveMaxSteps = 32
+
+	// Max depth of nested lookups, for CNAMEs and name server addresses
+	recursiveMaxDepth = 8
+
+	// Max number of queries sent to name servers for one client query,
+	// including those for name server addresses and retries with other
+	// servers
+	recursiveMaxQueries = 100
+
+	// Max number of cached delegations. Once reached, expired ones are
+	// removed, and if that's not enough, random others.
+	recursiveMaxZones = 10000
+)
+
+var errRecursiveQueryLimit = errors.New("too many queries to name servers")
+
+// State of the resolution of one client query.
+type resolution struct {
+	log     *logrus.Entry
+	queries int // remaining queries to name servers
+}
+
+// Name servers of a zone.
+type delegation struct {
+	zone    string
+	servers []string
+	expires time.Time
+}
+
+// NewRecursive returns a new instance of a recursive resolver.
+func NewRecursive(id string, opt RecursiveOptions) (*Recursive, error) {
+	if opt.QueryTimeout == 0 {
+		opt.QueryTimeout = 2 * time.Second
+	}
+	hints := opt.RootHints
+	if len(hints) == 0 {
+		hints = defaultRootHints
+	}
+	r := &Recursive{
+		id:      id,
+		opt:     opt,
+		metrics: NewListenerMetrics("client", id),
+		zones:   make(map[string]*delegation),
+	}
+	for _, hint := range hints {
+		ip := net.ParseIP(hint)
+		if ip == nil {
+			return nil, fmt.Errorf("invalid root hint %q", hint)
+		}
+		r.hints = append(r.hints, net.JoinHostPort(ip.String(), PlainDNSPort))
+	}
+	r.exchange = r.exchangeNet
+	return r, nil
+}
+
+// Resolve a DNS query by iterating from the root servers.
+func (r *Recursive) Resolve(q *dns.Msg, ci ClientInfo) (*dns.Msg, error) {
+	if len(q.Question) < 1 {
+		return nil, errors.New("no question in query")
+	}
+	question := q.Question[0]
+	log := logger(r.id, q, ci)
+	r.metrics.query.Add(1)
+
+	res := &resolution{log: log, queries: recursiveMaxQueries}
+	a, err := r.resolve(res, dns.CanonicalName(question.Name), question.Qtype, 0)
+	if err != nil {
+		r.metrics.err.Add("resolve", 1)
+		return nil, err
+	}
+	answer := new(dns.Msg)
+	answer.SetReply(q)
+	answer.RecursionAvailable = true
+	answer.Rcode = a.Rcode
+	answer.Answer = a.Answer
+	answer.Ns = a.Ns
+	r.metrics.response.Add(rCode(answer), 1)
+	return answer, nil
+}
+
+func (r *Recursive) String() string {
+	return r.id
+}
+
+// Resolve a name by following referrals starting at the closest known
+// delegation, and follow CNAMEs.
+func (r *Recursive) resolve(res *resolution, name string, qtype uint16, depth int) (*dns.Msg, error) {
+	if depth > recursiveMaxDepth {
+		return nil, fmt.Errorf("max recursion depth exceeded resolving %s", name)
+	}
+	zone, err := r.closest(res, name)
+	if err != nil {
+		return nil, err
+	}
+
+	// Number of labels below the zone to send, only used with minimization
+	extra := 1
+	for step := 0; step < recursiveMaxSteps; step++ {
+		qname, qt := name, qtype
+		if !r.opt.NoQNameMinimization {
+			qname = minimizedName(zone.zone, name, extra)
+			if qname != name {
+				qt = dns.TypeA
+			}
+		}
+		res.log.WithFields(logrus.Fields{"qname": qname, "zone": zone.zone}).Trace("querying name servers")
+		a, err := r.query(res, zone.servers, qname, qt)
+		if err != nil {
+			return nil, err
+		}
+
+		// Follow the referral to the child zone
+		if child := r.referral(a, zone.zone, qname); child != "" {
+			servers, err := r.serverAddrs(res, a, zone.zone, depth)
+			if err != nil {
+				return nil, err
+			}
+			if len(servers) == 0 {
+				return nil, fmt.Errorf("no usable name servers for %s", child)
+			}
+			zone = r.addDelegation(child, servers, lowestTTL(a.Ns))
+			extra = 1
+			continue
+		}
+
+		// An answer for a shortened name means there's no zone cut at this
+		// level, add another label. NXDOMAIN means nothing exists below it
+		// either (RFC 8020).
+		if qname != name {
+			if a.Rcode == dns.RcodeNameError {
+				return a, nil
+			}
+			extra++
+			continue
+		}
+
+		// Follow CNAMEs unless the target records are already included
+		if target := cnameTarget(a, name, qtype); target != "" {
+			res.log.WithField("target", target).Trace("following cname")
+			b, err := r.resolve(res, dns.CanonicalName(target), qtype, depth+1)
+			if err != nil {
+				return nil, err
+			}
+			b.Answer = append(a.Answer, b.Answer...)
+			return b, nil
+		}
+		return a, nil
+	}
+	return nil, fmt.Errorf("too many steps resolving %s", name)
+}
+
+// Returns the closest cached delegation for the name. Primes the root zone if
+// needed.
+func (r *Recursive) closest(res *resolution, name string) (*delegation, error) {
+	now := time.Now()
+	r.mu.Lock()
+	for z := name; ; {
+		if d, ok := r.zones[z]; ok && now.Before(d.expires) {
+			r.mu.Unlock()
+			return d, nil
+		}
+		if z == "." {
+			break
+		}
+		off, end := dns.NextLabel(z, 0)
+		if end {
+			z = "."
+		} else {
+			z = z[off:]
+		}
+	}
+	r.mu.Unlock()
+	return r.prime(res)
+}
+
+// Query the root hints for the current list of root servers.
+func (r *Recursive) prime(res *resolution) (*delegation, error) {
+	res.log.Debug("priming root servers")
+	a, err := r.query(res, r.hints, ".", dns.TypeNS)
+	if err != nil {
+		return nil, fmt.Errorf("failed to prime root servers: %w", err)
+	}
+	servers := r.glue(a, ".")
+	if len(servers) == 0 {
+		// Keep using the hints if the response didn't contain any addresses
+		servers = r.hints
+	}
+	return r.addDelegation(".", servers, lowestTTL(a.Answer)), nil
+}
+
+// Adds a delegation to the cache.
+func (r *Recursive) addDelegation(zone string, servers []string, ttl uint32) *delegation {
+	d := &delegation{
+		zone:    zone,
+		servers: servers,
+		expires: time.Now().Add(time.Duration(ttl) * time.Second),
+	}
+	r.mu.Lock()
+	if _, ok := r.zones[zone]; !ok && len(r.zones) >= recursiveMaxZones {
+		r.evictZones()
+	}
+	r.zones[zone] = d
+	r.mu.Unlock()
+	return d
+}
+
+// Removes expired delegations, then random others until the cache is at most
+// three quarters full, so it's not done again for every new zone. Must be
+// called with the lock held.
+func (r *Recursive) evictZones() {
+	now := time.Now()
+	for zone, d := range r.zones {
+		if !now.Before(d.expires) {
+			delete(r.zones, zone)
+		}
+	}
+	for zone := range r.zones {
+		if len(r.zones) <= recursiveMaxZones*3/4 {
+			break
+		}
+		delete(r.zones, zone)
+	}
+}
+
+// Returns the name of the child zone if the response is a referral from zone
+// for the query name.
+func (r *Recursive) referral(a *dns.Msg, zone, qname string) string {
+	if a.Authoritative || a.Rcode != dns.RcodeSuccess || len(a.Answer) > 0 {
+		return ""
+	}
+	for _, rr := range a.Ns {
+		if rr.Header().Rrtype != dns.TypeNS {
+			continue
+		}
+		child := dns.CanonicalName(rr.Header().Name)
+		if child != zone && dns.IsSubDomain(zone, child) && dns.IsSubDomain(child, qname) {
+			return child
+		}
+	}
+	return ""
+}
+
+// Returns the addresses of the name servers in a referral. Glue records are
+// used if available, otherwise the name server names are resolved until one
+// of them has an address. Fails once the query limit is reached.
+func (r *Recursive) serverAddrs(res *resolution, a *dns.Msg, zone string, depth int) ([]string, error) {
+	if servers := r.glue(a, zone); len(servers) > 0 {
+		return servers, nil
+	}
+	for _, rr := range a.Ns {
+		ns, ok := rr.(*dns.NS)
+		if !ok {
+			continue
+		}
+		var servers []string
+		for _, qtype := range r.addrTypes() {
+			b, err := r.resolve(res, dns.CanonicalName(ns.Ns), qtype, depth+1)
+			if errors.Is(err, errRecursiveQueryLimit) {
+				return nil, err
+			}
+			if err != nil {
+				res.log.WithField("ns", ns.Ns).WithError(err).Debug("failed to resolve name server")
+				continue
+			}
+			servers = append(servers, addrs(b.Answer)...)
+		}
+		if len(servers) > 0 {
+			return servers, nil
+		}
+	}
+	return nil, nil
+}
+
+// Returns the addresses of the name servers from the additional section of a
+// response. Only records for names in the zone that was queried are accepted.
+func (r *Recursive) glue(a *dns.Msg, zone string) []string {
+	names := make(map[string]bool)
+	for _, rr := range append(a.Answer, a.Ns...) {
+		if ns, ok := rr.(*dns.NS); ok {
+			names[dns.CanonicalName(ns.Ns)] = true
+		}
+	}
+	var glue []dns.RR
+	for _, rr := range a.Extra {
+		name := dns.CanonicalName(rr.Header().Name)
+		if !names[name] || !dns.IsSubDomain(zone, name) {
+			continue
+		}
+		if rr.Header().Rrtype == dns.TypeAAAA && !r.opt.IPv6 {
+			continue
+		}
+		glue = append(glue, rr)
+	}
+	return addrs(glue)
+}
+
+func (r *Recursive) addrTypes() []uint16 {
+	if r.opt.IPv6 {
+		return []uint16{dns.TypeA, dns.TypeAAAA}
+	}
+	return []uint16{dns.TypeA}
+}
+
+// Send a query to the servers in order until one of them responds. Every
+// server that is tried counts towards the query limit.
+func (r *Recursive) query(res *resolution, servers []string, name string, qtype uint16) (*dns.Msg, error) {
+	q := new(dns.Msg)
+	q.SetQuestion(name, qtype)
+	q.RecursionDesired = false
+	q.SetEdns0(1232, false)
+
+	err := fmt.Errorf("no name servers to query for %s", name)
+	for _, server := range servers {
+		if res.queries <= 0 {
+			return nil, fmt.Errorf("%w resolving %s", errRecursiveQueryLimit, name)
+		}
+		res.queries--
+		var a *dns.Msg
+		a, err = r.exchange(q, server)
+		if err != nil {
+			continue
+		}
+		// Try the next server if this one can't answer
+		if a.Rcode == dns.RcodeServerFailure || a.Rcode == dns.RcodeRefused {
+			err = fmt.Errorf("name server %s responded with %s", server, rCode(a))
+			continue
+		}
+		return a, nil
+	}
+	return nil, err
+}
+
+// Send a query over UDP and retry over TCP if the response is truncated.
+func (r *Recursive) exchangeNet(q *dns.Msg, server string) (*dns.Msg, error) {
+	for _, network := range []string{"udp", "tcp"} {
+		client := &dns.Client{
+			Net:     network,
+			Timeout: r.opt.QueryTimeout,
+		}
+		if r.opt.LocalAddr != nil {
+			if network == "udp" {
+				client.Dialer = &net.Dialer{LocalAddr: &net.UDPAddr{IP: r.opt.LocalAddr}}
+			} else {
+				client.Dialer = &net.Dialer{LocalAddr: &net.TCPAddr{IP: r.opt.LocalAddr}}
+			}
+		}
+		a, _, err := client.Exchange(q, server)
+		if err != nil {
+			return nil, err
+		}
+		if !a.Truncated {
+			return a, nil
+		}
+	}
+	return nil, fmt.Errorf("truncated response from %s", server)
+}
+
+// Returns the name made up of the zone and the given number of labels of name
+// below it.
+func minimizedName(zone, name string, extra int) string {
+	labels := dns.SplitDomainName(name)
+	n := dns.CountLabel(zone) + extra
+	if n >= len(labels) {
+		return name
+	}
+	return strings.Join(labels[len(labels)-n:], ".") + "."
+}
+
+// Returns the target of a CNAME for name in the response, unless the response
+// already contains records of the queried type for it.
+func cnameTarget(a *dns.Msg, name string, qtype uint16) string {
+	if qtype == dns.TypeCNAME || a.Rcode != dns.RcodeSuccess {
+		return ""
+	}
+	var target string
+	for i := 0; i <= len(a.Answer); i++ {
+		var next string
+		for _, rr := range a.Answer {
+			if !strings.EqualFold(rr.Header().Name, name) {
+				continue
+			}
+			if rr.Header().Rrtype == qtype {
+				return ""
+			}
+			if cname, ok := rr.(*dns.CNAME); ok {
+				next = cname.Target
+			}
+		}
+		if next == "" {
+			return target
+		}
+		name, target = next, next
+	}
+	// CNAME loop
+	return ""
+}
+
+// Returns the addresses in A and AAAA records as host:port.
+func addrs(rrs []dns.RR) []string {
+	var out []string
+	for _, rr := range rrs {
+		switch rr := rr.(type) {
+		case *dns.A:
+			out = append(out, net.JoinHostPort(rr.A.String(), PlainDNSPort))
+		case *dns.AAAA:
+			out = append(out, net.JoinHostPort(rr.AAAA.String(), PlainDNSPort))
+		}
+	}
+	return out
+}
+
+// Returns the lowest TTL of the records, or 0 if there are none.
+func lowestTTL(rrs []dns.RR) uint32 {
+	var ttl uint32
+	for i, rr := range rrs {
+		if i == 0 || rr.Header().Ttl < ttl {
+			ttl = rr.Header().Ttl
+		}
+	}
+	return ttl
+}
@@ -0,0 +1,234 @@
+package rdns
+
+import (
+	"fmt"
+	"strings"
+	"sync"
+	"testing"
+
+	"github.com/miekg/dns"
+	"github.com/stretchr/testify/require"
+)
+
+// Fake name server hierarchy for recursive resolver tests. Maps server
+// addresses to functions that answer queries.
+type fakeNameServers struct {
+	mu      sync.Mutex
+	servers map[string]func(q *dns.Msg) *dns.Msg
+	queries []string // "<server> <qname> <qtype>"
+}
+
+func (f *fakeNameServers) exchange(q *dns.Msg, server string) (*dns.Msg, error) {
+	f.mu.Lock()
+	f.queries = append(f.queries, fmt.Sprintf("%s %s %s", server, q.Question[0].Name, dns.TypeToString[q.Question[0].Qtype]))
+	answer, ok := f.servers[server]
+	f.mu.Unlock()
+	if !ok {
+		return nil, fmt.Errorf("no server at %s", server)
+	}
+	return answer(q), nil
+}
+
+func newFakeNameServers(t *testing.T) *fakeNameServers {
+	reply := func(q *dns.Msg, auth bool, answer, ns, extra []string) *dns.Msg {
+		a := new(dns.Msg)
+		a.SetReply(q)
+		a.Authoritative = auth
+		for _, s := range answer {
+			a.Answer = append(a.Answer, mustRR(t, s))
+		}
+		for _, s := range ns {
+			a.Ns = append(a.Ns, mustRR(t, s))
+		}
+		for _, s := range extra {
+			a.Extra = append(a.Extra, mustRR(t, s))
+		}
+		return a
+	}
+	return &fakeNameServers{
+		servers: map[string]func(q *dns.Msg) *dns.Msg{
+			// Root
+			"10.0.0.1:53": func(q *dns.Msg) *dns.Msg {
+				name := q.Question[0].Name
+				switch {
+				case name == "." && q.Question[0].Qtype == dns.TypeNS:
+					return reply(q, true, []string{". 3600 IN NS a.root."}, nil, []string{"a.root. 3600 IN A 10.0.0.1"})
+				case dns.IsSubDomain("com.", name):
+					return reply(q, false, nil, []string{"com. 3600 IN NS ns.com."}, []string{"ns.com. 3600 IN A 10.0.0.2"})
+				}
+				a := reply(q, true, nil, []string{". 3600 IN SOA a.root. admin. 1 3600 600 86400 3600"}, nil)
+				a.Rcode = dns.RcodeNameError
+				return a
+			},
+			// com.
+			"10.0.0.2:53": func(q *dns.Msg) *dns.Msg {
+				name := q.Question[0].Name
+				switch {
+				case dns.IsSubDomain("example.com.", name):
+					// Includes out-of-bailiwick glue that must be ignored
+					return reply(q, false, nil, []string{"example.com. 3600 IN NS ns1.example.com."}, []string{"ns1.example.com. 3600 IN A 10.0.0.3", "a.root. 3600 IN A 10.9.9.9"})
+				case dns.IsSubDomain("other.com.", name):
+					// Glueless delegation to a name server in another zone
+					return reply(q, false, nil, []string{"other.com. 3600 IN NS ns.example.com."}, nil)
+				}
+				a := reply(q, true, nil, []string{"com. 3600 IN SOA ns.com. admin. 1 3600 600 86400 3600"}, nil)
+				a.Rcode = dns.RcodeNameError
+				return a
+			},
+			// example.com.
+			"10.0.0.3:53": func(q *dns.Msg) *dns.Msg {
+				switch q.Question[0].Name {
+				case "www.example.com.":
+					return reply(q, true, []string{"www.example.com. 300 IN A 192.0.2.1"}, nil, nil)
+				case "alias.example.com.":
+					return reply(q, true, []string{"alias.example.com. 300 IN CNAME www.other.com."}, nil, nil)
+				case "ns.example.com.":
+					return reply(q, true, []string{"ns.example.com. 300 IN A 10.0.0.4"}, nil, nil)
+				case "sub.example.com.":
+					// Empty non-terminal
+					return reply(q, true, nil, []string{"example.com. 3600 IN SOA ns1.example.com. admin. 1 3600 600 86400 3600"}, nil)
+				case "host.sub.example.com.":
+					return reply(q, true, []string{"host.sub.example.com. 300 IN A 192.0.2.3"}, nil, nil)
+				}
+				a := reply(q, true, nil, []string{"example.com. 3600 IN SOA ns1.example.com. admin. 1 3600 600 86400 3600"}, nil)
+				a.Rcode = dns.RcodeNameError
+				return a
+			},
+			// other.com.
+			"10.0.0.4:53": func(q *dns.Msg) *dns.Msg {
+				if q.Question[0].Name == "www.other.com." {
+					return reply(q, true, []string{"www.other.com. 300 IN A 192.0.2.2"}, nil, nil)
+				}
+				a := reply(q, true, nil, []string{"other.com. 3600 IN SOA ns.example.com. admin. 1 3600 600 86400 3600"}, nil)
+				a.Rcode = dns.RcodeNameError
+				return a
+			},
+		},
+	}
+}
+
+func TestRecursive(t *testing.T) {
+	ns := newFakeNameServers(t)
+	r, err := NewRecursive("test-recursive", RecursiveOptions{RootHints: []string{"10.0.0.1"}})
+	require.NoError(t, err)
+	r.exchange = ns.exchange
+
+	resolve := func(name string) *dns.Msg {
+		q := new(dns.Msg)
+		q.SetQuestion(name, dns.TypeA)
+		a, err := r.Resolve(q, ClientInfo{})
+		require.NoError(t, err)
+		require.True(t, a.RecursionAvailable)
+		return a
+	}
+
+	// Priming, then following the referrals with minimized query names
+	a := resolve("www.example.com.")
+	require.Len(t, a.Answer, 1)
+	require.Equal(t, "192.0.2.1", a.Answer[0].(*dns.A).A.String())
+	require.Equal(t, []string{
+		"10.0.0.1:53 . NS",
+		"10.0.0.1:53 com. A",
+		"10.0.0.2:53 example.com. A",
+		"10.0.0.3:53 www.example.com. A",
+	}, ns.queries)
+
+	// Known delegations are cached
+	ns.queries = nil
+	a = resolve("WWW.example.com.")
+	require.Len(t, a.Answer, 1)
+	require.Equal(t, []string{"10.0.0.3:53 www.example.com. A"}, ns.queries)
+
+	// CNAME into a zone with a glueless delegation
+	a = resolve("alias.example.com.")
+	require.Len(t, a.Answer, 2)
+	require.Equal(t, "www.other.com.", a.Answer[0].(*dns.CNAME).Target)
+	require.Equal(t, "192.0.2.2", a.Answer[1].(*dns.A).A.String())
+
+	// Names below empty non-terminals
+	a = resolve("host.sub.example.com.")
+	require.Equal(t, "192.0.2.3", a.Answer[0].(*dns.A).A.String())
+
+	// NXDOMAIN for a minimized name ends the resolution
+	ns.queries = nil
+	a = resolve("a.b.missing.example.com.")
+	require.Equal(t, dns.RcodeNameError, a.Rcode)
+	require.Equal(t, []string{"10.0.0.3:53 missing.example.com. A"}, ns.queries)
+
+	// Out-of-bailiwick glue was not used
+	for _, d := range r.zones {
+		for _, server := range d.servers {
+			require.False(t, strings.HasPrefix(server, "10.9.9.9"))
+		}
+	}
+}
+
+func TestRecursiveNoQNameMinimization(t *testing.T) {
+	ns := newFakeNameServers(t)
+	r, err := NewRecursive("test-recursive-nomin", RecursiveOptions{
+		RootHints:           []string{"10.0.0.1"},
+		NoQNameMinimization: true,
+	})
+	require.NoError(t, err)
+	r.exchange = ns.exchange
+
+	q := new(dns.Msg)
+	q.SetQuestion("www.example.com.", dns.TypeA)
+	a, err := r.Resolve(q, ClientInfo{})
+	require.NoError(t, err)
+	require.Len(t, a.Answer, 1)
+	require.Equal(t, []string{
+		"10.0.0.1:53 . NS",
+		"10.0.0.1:53 www.example.com. A",
+		"10.0.0.2:53 www.example.com. A",
+		"10.0.0.3:53 www.example.com. A",
+	}, ns.queries)
+}
+
+// Glueless delegations that point at each other end once the query limit is
+// reached.
+func TestRecursiveQueryLimit(t *testing.T) {
+	ns := &fakeNameServers{
+		servers: map[string]func(q *dns.Msg) *dns.Msg{
+			"10.0.0.1:53": func(q *dns.Msg) *dns.Msg {
+				a := new(dns.Msg)
+				a.SetReply(q)
+				if q.Question[0].Name == "." {
+					a.Answer = []dns.RR{mustRR(t, ". 3600 IN NS a.root.")}
+					a.Extra = []dns.RR{mustRR(t, "a.root. 3600 IN A 10.0.0.1")}
+					return a
+				}
+				labels := dns.SplitDomainName(q.Question[0].Name)
+				tld := labels[len(labels)-1]
+				other := "a"
+				if tld == "a" {
+					other = "b"
+				}
+				for i := 0; i < 5; i++ {
+					a.Ns = append(a.Ns, mustRR(t, fmt.Sprintf("%s. 3600 IN NS ns%d.%s.", tld, i, other)))
+				}
+				return a
+			},
+		},
+	}
+	r, err := NewRecursive("test-recursive-limit", RecursiveOptions{RootHints: []string{"10.0.0.1"}})
+	require.NoError(t, err)
+	r.exchange = ns.exchange
+
+	q := new(dns.Msg)
+	q.SetQuestion("www.a.", dns.TypeA)
+	_, err = r.Resolve(q, ClientInfo{})
+	require.ErrorIs(t, err, errRecursiveQueryLimit)
+	require.Len(t, ns.queries, recursiveMaxQueries)
+}
+
+func TestRecursiveMaxZones(t *testing.T) {
+	r, err := NewRecursive("test-recursive-zones", RecursiveOptions{})
+	require.NoError(t, err)
+	r.addDelegation("expired.", nil, 0)
+	for i := 0; i < 2*recursiveMaxZones; i++ {
+		r.addDelegation(fmt.Sprintf("zone%d.", i), nil, 3600)
+		require.LessOrEqual(t, len(r.zones), recursiveMaxZones)
+	}
+	require.NotContains(t, r.zones, "expired.")
+}
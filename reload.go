@@ -0,0 +1,201 @@
+package rdns
+
+import (
+	"os"
+	"os/signal"
+	"sync"
+	"syscall"
+	"time"
+
+	"github.com/sirupsen/logrus"
+)
+
+// ReloadableResolver is implemented by resolvers that can reload their rules
+// on demand.
+type ReloadableResolver interface {
+	ReloadAll() error
+	String() string
+}
+
+var (
+	_ ReloadableResolver = &Blocklist{}
+	_ ReloadableResolver = &ResponseBlocklistIP{}
+	_ ReloadableResolver = &ResponseBlocklistName{}
+	_ ReloadableResolver = &ClientBlocklist{}
+)
+
+// RegisterSignalReload reloads the rules of all resolvers whenever the process
+// receives SIGHUP.
+func RegisterSignalReload(resolvers ...ReloadableResolver) {
+	sig := make(chan os.Signal, 1)
+	signal.Notify(sig, syscall.SIGHUP)
+	go func() {
+		for range sig {
+			reloadAll(resolvers)
+		}
+	}()
+}
+
+func reloadAll(resolvers []ReloadableResolver) {
+	for _, r := range resolvers {
+		log := Log.WithField("id", r.String())
+		if err := r.ReloadAll(); err != nil {
+			log.WithError(err).Error("failed to reload rules")
+			continue
+		}
+		log.Info("reloaded rules")
+	}
+}
+
+// reloadGroup collapses concurrent reloads of the same DB, for example when a
+// reload is triggered by a signal while the refresh timer fires. While a
+// reload is in progress, other callers wait for it and share its result.
+type reloadGroup struct {
+	mu       sync.Mutex
+	inflight map[string]*inflightReload
+}
+
+type inflightReload struct {
+	db   BlocklistDB
+	err  error
+	done chan struct{}
+}
+
+// Reload the DB, or wait for an in-progress reload with the same key to finish.
+func (g *reloadGroup) do(key string, db BlocklistDB) (BlocklistDB, error) {
+	g.mu.Lock()
+	if g.inflight == nil {
+		g.inflight = make(map[string]*inflightReload)
+	}
+	if c, ok := g.inflight[key]; ok {
+		g.mu.Unlock()
+		<-c.done
+		return c.db, c.err
+	}
+	c := &inflightReload{done: make(chan struct{})}
+	g.inflight[key] = c
+	g.mu.Unlock()
+
+	c.db, c.err = db.Reload()
+
+	g.mu.Lock()
+	delete(g.inflight, key)
+	g.mu.Unlock()
+	close(c.done)
+	return c.db, c.err
+}
+
+const (
+	// Upper limit of the retry interval after repeated refresh failures. The
+	// configured refresh interval is used if it's longer.
+	refreshMaxBackoff = time.Hour
+
+	// Identical consecutive refresh errors are logged at most once per window.
+	refreshLogWindow = 10 * time.Minute
+)
+
+// refresher runs periodic reloads of rules. After a failed reload, the retry
+// interval is doubled up to refreshMaxBackoff and repeated identical errors are
+// only logged once per refreshLogWindow. Both are reset on the next successful
+// reload.
+type refresher struct {
+	log      *logrus.Entry
+	interval time.Duration
+	now      func() time.Time
+
+	failures   int
+	lastErr    string
+	lastLogged time.Time
+}
+
+func newRefresher(log *logrus.Entry, interval time.Duration) *refresher {
+	return &refresher{
+		log:      log,
+		interval: interval,
+		now:      time.Now,
+	}
+}
+
+// Reload until stop is closed, waiting for the refresh interval between
+// attempts. Runs forever if stop is nil.
+func (r *refresher) run(stop <-chan struct{}, reload func() error) {
+	for {
+		timer := time.NewTimer(r.delay())
+		select {
+		case <-stop:
+			timer.Stop()
+			return
+		case <-timer.C:
+		}
+		r.attempt(reload)
+	}
+}
+
+// stopper is used by elements with background loops to stop them when the
+// element is closed, for example after it was replaced by a configuration
+// reload. The zero value is ready to use.
+type stopper struct {
+	mu     sync.Mutex
+	ch     chan struct{}
+	closed bool
+}
+
+// Returns a channel that is closed once stop is called.
+func (s *stopper) done() <-chan struct{} {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if s.ch == nil {
+		s.ch = make(chan struct{})
+	}
+	return s.ch
+}
+
+// Stops the loops. Safe to call more than once.
+func (s *stopper) stop() {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if s.ch == nil {
+		s.ch = make(chan struct{})
+	}
+	if !s.closed {
+		close(s.ch)
+		s.closed = true
+	}
+}
+
+// Time to wait until the next reload.
+func (r *refresher) delay() time.Duration {
+	if r.failures == 0 || r.interval >= refreshMaxBackoff {
+		return r.interval
+	}
+	d := r.interval
+	for i := 0; i < r.failures && d < refreshMaxBackoff; i++ {
+		d *= 2
+	}
+	if d > refreshMaxBackoff {
+		d = refreshMaxBackoff
+	}
+	return d
+}
+
+func (r *refresher) attempt(reload func() error) {
+	err := reload()
+	if err == nil {
+		if r.failures > 0 {
+			r.log.WithField("failures", r.failures).Info("recovered from failure to load rules")
+		}
+		r.failures = 0
+		r.lastErr = ""
+		return
+	}
+	r.failures++
+	now := r.now()
+	log := r.log.WithError(err).WithFields(logrus.Fields{"failures": r.failures, "retry": r.delay()})
+	if err.Error() == r.lastErr && now.Sub(r.lastLogged) < refreshLogWindow {
+		log.Debug("failed to load rules")
+		return
+	}
+	log.Error("failed to load rules")
+	r.lastErr = err.Error()
+	r.lastLogged = now
+}
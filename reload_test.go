@@ -0,0 +1,172 @@
+//go:build !windows
+
+package rdns
+
+import (
+	"errors"
+	"os"
+	"path/filepath"
+	"syscall"
+	"testing"
+	"time"
+
+	"github.com/miekg/dns"
+	"github.com/sirupsen/logrus"
+	"github.com/sirupsen/logrus/hooks/test"
+	"github.com/stretchr/testify/require"
+	"go.uber.org/goleak"
+)
+
+func TestBlocklistReloadAll(t *testing.T) {
+	dir := t.TempDir()
+	blockFile := filepath.Join(dir, "block.list")
+	allowFile := filepath.Join(dir, "allow.list")
+	require.NoError(t, os.WriteFile(blockFile, []byte("old.test\n"), 0644))
+	require.NoError(t, os.WriteFile(allowFile, []byte("good.test\n"), 0644))
+
+	blockDB, err := NewDomainDB("block", NewFileLoader(blockFile, FileLoaderOptions{}))
+	require.NoError(t, err)
+	allowDB, err := NewDomainDB("allow", NewFileLoader(allowFile, FileLoaderOptions{}))
+	require.NoError(t, err)
+	b, err := NewBlocklist("test-bl-reload", new(TestResolver), BlocklistOptions{
+		BlocklistDB: blockDB,
+		AllowlistDB: allowDB,
+	})
+	require.NoError(t, err)
+
+	// Both lists load, the new rules are used
+	require.NoError(t, os.WriteFile(blockFile, []byte("new.test\n"), 0644))
+	require.NoError(t, b.ReloadAll())
+	require.False(t, isBlocked(t, b, "old.test."))
+	require.True(t, isBlocked(t, b, "new.test."))
+
+	// The allowlist fails to load, neither list is replaced
+	require.NoError(t, os.WriteFile(blockFile, []byte("newer.test\n"), 0644))
+	require.NoError(t, os.Remove(allowFile))
+	require.Error(t, b.ReloadAll())
+	require.True(t, isBlocked(t, b, "new.test."))
+	require.False(t, isBlocked(t, b, "newer.test."))
+}
+
+func TestRegisterSignalReload(t *testing.T) {
+	blockFile := filepath.Join(t.TempDir(), "block.list")
+	require.NoError(t, os.WriteFile(blockFile, []byte("old.test\n"), 0644))
+
+	blockDB, err := NewDomainDB("block", NewFileLoader(blockFile, FileLoaderOptions{}))
+	require.NoError(t, err)
+	b, err := NewBlocklist("test-bl-sighup", new(TestResolver), BlocklistOptions{
+		BlocklistDB: blockDB,
+	})
+	require.NoError(t, err)
+	RegisterSignalReload(b)
+
+	require.NoError(t, os.WriteFile(blockFile, []byte("new.test\n"), 0644))
+	require.NoError(t, syscall.Kill(os.Getpid(), syscall.SIGHUP))
+	require.Eventually(t, func() bool {
+		return isBlocked(t, b, "new.test.")
+	}, 2*time.Second, 10*time.Millisecond)
+	require.False(t, isBlocked(t, b, "old.test."))
+}
+
+func isBlocked(t *testing.T, b *Blocklist, name string) bool {
+	q := new(dns.Msg)
+	q.SetQuestion(name, dns.TypeA)
+	a, err := b.Resolve(q, ClientInfo{})
+	require.NoError(t, err)
+	return a.Rcode == dns.RcodeNameError
+}
+
+func TestRefresherBackoff(t *testing.T) {
+	logger, hook := test.NewNullLogger()
+	logger.SetLevel(logrus.DebugLevel)
+
+	now := time.Date(2024, 1, 1, 0, 0, 0, 0, time.UTC)
+	r := newRefresher(logrus.NewEntry(logger), time.Minute)
+	r.now = func() time.Time { return now }
+
+	var reloadErr error
+	reload := func() error { return reloadErr }
+	next := func() {
+		now = now.Add(r.delay())
+		r.attempt(reload)
+	}
+	lastLevel := func() logrus.Level {
+		return hook.LastEntry().Level
+	}
+
+	// Successful reloads use the configured interval and don't log anything
+	next()
+	require.Empty(t, hook.AllEntries())
+	require.Equal(t, time.Minute, r.delay())
+
+	// The first failure is logged, identical failures within the log window
+	// are not. The retry interval doubles with every failure.
+	reloadErr = errors.New("source unavailable")
+	next() // 1m after the last success
+	require.Equal(t, logrus.ErrorLevel, lastLevel())
+	require.Equal(t, 2*time.Minute, r.delay())
+	next() // 2m later
+	require.Equal(t, logrus.DebugLevel, lastLevel())
+	require.Equal(t, 4*time.Minute, r.delay())
+	next() // 6m since the first logged failure
+	require.Equal(t, logrus.DebugLevel, lastLevel())
+	require.Equal(t, 8*time.Minute, r.delay())
+	next() // 14m since the first logged failure
+	require.Equal(t, logrus.ErrorLevel, lastLevel())
+
+	// A different error is logged right away
+	reloadErr = errors.New("connection refused")
+	r.now = func() time.Time { return now } // no time passes
+	r.attempt(reload)
+	require.Equal(t, logrus.ErrorLevel, lastLevel())
+
+	// The retry interval is capped
+	for i := 0; i < 10; i++ {
+		next()
+	}
+	require.Equal(t, refreshMaxBackoff, r.delay())
+
+	// Recovery is logged once and the interval is reset
+	reloadErr = nil
+	hook.Reset()
+	next()
+	require.Len(t, hook.AllEntries(), 1)
+	require.Equal(t, logrus.InfoLevel, lastLevel())
+	require.Equal(t, "recovered from failure to load rules", hook.LastEntry().Message)
+	require.Equal(t, time.Minute, r.delay())
+	next()
+	require.Len(t, hook.AllEntries(), 1)
+}
+
+func TestRefresherLongInterval(t *testing.T) {
+	logger, _ := test.NewNullLogger()
+	r := newRefresher(logrus.NewEntry(logger), 24*time.Hour)
+
+	// Intervals longer than the backoff limit are not extended
+	r.attempt(func() error { return errors.New("failed") })
+	require.Equal(t, 24*time.Hour, r.delay())
+}
+
+func TestCloseStopsBackgroundLoops(t *testing.T) {
+	defer goleak.VerifyNone(t, goleak.IgnoreCurrent())
+
+	db, err := NewDomainDB("block", NewStaticLoader([]string{"ads.test"}))
+	require.NoError(t, err)
+	b, err := NewBlocklist("test-bl-close", new(TestResolver), BlocklistOptions{
+		BlocklistDB:      db,
+		BlocklistRefresh: time.Hour,
+	})
+	require.NoError(t, err)
+	c := NewCache("test-cache-close", b, CacheOptions{})
+	hostsFile := filepath.Join(t.TempDir(), "hosts")
+	require.NoError(t, os.WriteFile(hostsFile, []byte("192.0.2.1 host.test\n"), 0644))
+	h, err := NewHosts("test-hosts-close", HostsOptions{Paths: []string{hostsFile}})
+	require.NoError(t, err)
+
+	// The refresh, metrics, garbage collection and file watching loops stop,
+	// closing again is fine
+	require.NoError(t, c.Close())
+	require.NoError(t, b.Close())
+	require.NoError(t, b.Close())
+	require.NoError(t, h.Close())
+}
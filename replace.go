@@ -68,18 +68,30 @@ func (r *Replace) Resolve(q *dns.Msg, ci ClientInfo) (*dns.Msg, error) {
 		return r.resolver.Resolve(q, ci)
 	}
 
-	// Modify the query string
-	q.Question[0].Name = newName
+	// The replacement could have produced something that can't be sent upstream
+	if _, ok := dns.IsDomainName(newName); !ok {
+		log.WithField("new-qname", newName).Debug("invalid name after replace, responding with FORMERR")
+		return responseWithCode(q, dns.RcodeFormatError), nil
+	}
+	newName = dns.Fqdn(newName)
+
+	// Modify the query string in a copy, the original query belongs to the caller
+	newQ := q.Copy()
+	newQ.Question[0].Name = newName
 
 	// Send the query upstream
 	log.WithField("new-qname", newName).WithField("resolver", r.resolver).Debug("forwarding modified query to resolver")
-	a, err := r.resolver.Resolve(q, ci)
+	a, err := r.resolver.Resolve(newQ, ci)
 	if err != nil || a == nil {
 		return nil, err
 	}
 
 	// Set the question back to the original name
-	a.Question[0].Name = oldName
+	for i := range a.Question {
+		if a.Question[i].Name == newName {
+			a.Question[i].Name = oldName
+		}
+	}
 
 	// Now put the original name in all answer records that have the
 	// new name
@@ -55,3 +55,45 @@ func TestReplace(t *testing.T) {
 	require.Equal(t, "my.test.com.", a.Question[0].Name)
 	require.Equal(t, "your.test.com.", actualQueryName)
 }
+
+func TestReplaceInvalidName(t *testing.T) {
+	var ci ClientInfo
+	r := new(TestResolver)
+
+	b, err := NewReplace("test-replace", r, ReplaceOperation{From: `^(.*)\.vpn\.`, To: `${1}..`})
+	require.NoError(t, err)
+
+	// The replacement produces an empty label, the query is answered with FORMERR
+	q := new(dns.Msg)
+	q.SetQuestion("host.vpn.", dns.TypeA)
+	a, err := b.Resolve(q, ci)
+	require.NoError(t, err)
+	require.Equal(t, dns.RcodeFormatError, a.Rcode)
+	require.Equal(t, "host.vpn.", a.Question[0].Name)
+	require.Equal(t, 0, r.HitCount())
+}
+
+func TestReplaceQueryUnmodified(t *testing.T) {
+	var ci ClientInfo
+	var actualQueryName string
+	r := &TestResolver{
+		ResolveFunc: func(req *dns.Msg, ci ClientInfo) (*dns.Msg, error) {
+			actualQueryName = req.Question[0].Name
+			a := new(dns.Msg)
+			return a.SetReply(req), nil
+		},
+	}
+
+	b, err := NewReplace("test-replace", r, ReplaceOperation{From: `\.corp\.example\.$`, To: `.example.`})
+	require.NoError(t, err)
+
+	q := new(dns.Msg)
+	q.SetQuestion("host.corp.example.", dns.TypeA)
+	a, err := b.Resolve(q, ci)
+	require.NoError(t, err)
+	require.Equal(t, "host.example.", actualQueryName)
+	require.Equal(t, "host.corp.example.", a.Question[0].Name)
+
+	// The query passed in by the caller isn't changed
+	require.Equal(t, "host.corp.example.", q.Question[0].Name)
+}
@@ -2,7 +2,10 @@ package rdns
 
 import (
 	"encoding/binary"
+	"expvar"
+	"strings"
 	"sync"
+	"time"
 
 	"github.com/miekg/dns"
 )
@@ -10,6 +13,8 @@ import (
 type dedupKey struct {
 	name        string
 	qtype       uint16
+	qclass      uint16
+	do, cd      bool
 	ecs_ipv4    uint32
 	ecs_ipv6_hi uint64
 	ecs_ipv6_lo uint64
@@ -26,12 +31,16 @@ type inflightRequest struct {
 // queries for the same name are being held until the first query
 // returns. In that case, all waiting requests are answered with
 // the same response. This element is used to smooth out spikes
-// of queries for the same name.
+// of queries for the same name, for example behind a cache when a
+// popular record expires.
 type requestDedup struct {
 	id       string
 	resolver Resolver
 	mu       sync.Mutex
 	inflight map[dedupKey]*inflightRequest
+
+	// Number of queries that were answered with the response to another query
+	deduplicated *expvar.Int
 }
 
 var _ Resolver = &requestDedup{}
@@ -41,6 +50,8 @@ func NewRequestDedup(id string, resolver Resolver) *requestDedup {
 		id:       id,
 		resolver: resolver,
 		inflight: make(map[dedupKey]*inflightRequest),
+
+		deduplicated: getVarInt("router", id, "deduplicated"),
 	}
 }
 
@@ -51,8 +62,10 @@ func (r *requestDedup) Resolve(q *dns.Msg, ci ClientInfo) (*dns.Msg, error) {
 		ecsMask              uint8
 	)
 
+	var do bool
 	edns0 := q.IsEdns0()
 	if edns0 != nil {
+		do = edns0.Do()
 		// Find the ECS option
 		for _, opt := range edns0.Option {
 			ecs, ok := opt.(*dns.EDNS0_SUBNET)
@@ -70,9 +83,13 @@ func (r *requestDedup) Resolve(q *dns.Msg, ci ClientInfo) (*dns.Msg, error) {
 			break
 		}
 	}
+	// Names are case-insensitive, and the DO and CD bits change the response
 	k := dedupKey{
-		name:        q.Question[0].Name,
+		name:        strings.ToLower(q.Question[0].Name),
 		qtype:       q.Question[0].Qtype,
+		qclass:      q.Question[0].Qclass,
+		do:          do,
+		cd:          q.CheckingDisabled,
 		ecs_ipv4:    ecsIPv4,
 		ecs_ipv6_hi: ecsIPv6Hi,
 		ecs_ipv6_lo: ecsIPv6Lo,
@@ -94,17 +111,39 @@ func (r *requestDedup) Resolve(q *dns.Msg, ci ClientInfo) (*dns.Msg, error) {
 	// return the same answer.
 	if ok {
 		log.Debug("duplicated request, waiting for first answer")
-		<-req.done
+		r.deduplicated.Add(1)
+
+		// Don't wait past the deadline of this query, or once it's cancelled
+		var deadline <-chan time.Time
+		if !ci.Deadline.IsZero() {
+			timer := time.NewTimer(time.Until(ci.Deadline))
+			defer timer.Stop()
+			deadline = timer.C
+		}
+		select {
+		case <-req.done:
+		case <-deadline:
+			return nil, QueryTimeoutError{q}
+		case <-ci.Done:
+			return nil, errQueryCancelled
+		}
 		a, err := req.answer, req.err
-		// Return a copy of the answer as other elements might be modifying it
+		// Return a copy of the answer as other elements might be modifying it,
+		// with the ID and question of this query
 		if a != nil {
 			a = a.Copy()
+			a.Id = q.Id
+			if len(a.Question) > 0 {
+				a.Question = q.Copy().Question
+			}
 		}
 		return a, err
 	}
 	log.WithField("resolver", r.resolver).Debug("forwarding query to resolver")
 
-	// Not already in flight, make the request
+	// Not already in flight, make the request. Other queries wait for the same
+	// response, so it's not cancelled along with this one.
+	ci.Done = nil
 	a, err := r.resolver.Resolve(q, ci)
 	req.answer = a
 	req.err = err
@@ -2,6 +2,7 @@ package rdns
 
 import (
 	"sync"
+	"sync/atomic"
 	"testing"
 	"time"
 
@@ -24,16 +25,126 @@ func TestRequestDedup(t *testing.T) {
 
 	// Send a batch of queries
 	var wg sync.WaitGroup
+	errs := make(chan error, 10)
 	for i := 0; i < 10; i++ {
 		wg.Add(1)
 		go func() {
 			defer wg.Done()
 			_, err := g.Resolve(q, ci)
-			require.NoError(t, err)
+			errs <- err
 		}()
 	}
 	wg.Wait()
+	close(errs)
+	for err := range errs {
+		require.NoError(t, err)
+	}
 
 	// Only one request should have hit the resolver
 	require.Equal(t, 1, r.HitCount())
 }
+
+func TestRequestDedupResponseID(t *testing.T) {
+	var hits atomic.Int32
+	r := &TestResolver{
+		ResolveFunc: func(q *dns.Msg, ci ClientInfo) (*dns.Msg, error) {
+			hits.Add(1)
+			time.Sleep(500 * time.Millisecond)
+			a := new(dns.Msg)
+			a.SetReply(q)
+			return a, nil
+		},
+	}
+	g := NewRequestDedup("test-dedup-id", r)
+	deduplicated := g.deduplicated.Value()
+
+	// Responses are checked in the test goroutine once all queries are done
+	type result struct {
+		q   *dns.Msg
+		a   *dns.Msg
+		err error
+	}
+	results := make(chan result, 4)
+	var wg sync.WaitGroup
+	resolve := func(name string, id uint16, do bool) {
+		defer wg.Done()
+		q := new(dns.Msg)
+		q.SetQuestion(name, dns.TypeA)
+		q.Id = id
+		if do {
+			q.SetEdns0(1232, true)
+		}
+		a, err := g.Resolve(q, ClientInfo{})
+		results <- result{q, a, err}
+	}
+
+	// Queries that only differ in ID and case are answered once, queries with
+	// the DO bit are sent separately
+	for i, name := range []string{"example.com.", "EXAMPLE.com.", "Example.COM."} {
+		wg.Add(1)
+		go resolve(name, uint16(i+1), false)
+	}
+	wg.Add(1)
+	go resolve("example.com.", 10, true)
+	wg.Wait()
+	close(results)
+	for res := range results {
+		require.NoError(t, res.err)
+		require.Equal(t, res.q.Id, res.a.Id)
+		require.Equal(t, res.q.Question[0].Name, res.a.Question[0].Name)
+	}
+	require.Equal(t, int32(2), hits.Load())
+	require.Equal(t, deduplicated+2, g.deduplicated.Value())
+}
+
+// The shared query isn't cancelled when the query that started it is.
+func TestRequestDedupCancel(t *testing.T) {
+	r := &TestResolver{
+		ResolveFunc: func(q *dns.Msg, ci ClientInfo) (*dns.Msg, error) {
+			if ci.Done != nil {
+				return nil, errQueryCancelled
+			}
+			return nil, nil
+		},
+	}
+	g := NewRequestDedup("test-dedup-cancel", r)
+	q := new(dns.Msg)
+	q.SetQuestion("example.com.", dns.TypeA)
+
+	done := make(chan struct{})
+	_, err := g.Resolve(q, ClientInfo{Done: done})
+	require.NoError(t, err)
+}
+
+// Queries waiting for the response of another one give up at their own
+// deadline or when they're cancelled.
+func TestRequestDedupWaitDeadline(t *testing.T) {
+	release := make(chan struct{})
+	r := &TestResolver{
+		ResolveFunc: func(q *dns.Msg, ci ClientInfo) (*dns.Msg, error) {
+			<-release
+			return nil, nil
+		},
+	}
+	g := NewRequestDedup("test-dedup-deadline", r)
+	q := new(dns.Msg)
+	q.SetQuestion("example.com.", dns.TypeA)
+
+	leader := make(chan error, 1)
+	go func() {
+		_, err := g.Resolve(q, ClientInfo{})
+		leader <- err
+	}()
+	require.Eventually(t, func() bool { return r.HitCount() == 1 }, time.Second, time.Millisecond)
+
+	_, err := g.Resolve(q, ClientInfo{Deadline: time.Now().Add(10 * time.Millisecond)})
+	require.ErrorAs(t, err, &QueryTimeoutError{})
+
+	done := make(chan struct{})
+	close(done)
+	_, err = g.Resolve(q, ClientInfo{Done: done})
+	require.ErrorIs(t, err, errQueryCancelled)
+
+	close(release)
+	require.NoError(t, <-leader)
+}
@@ -25,6 +25,8 @@ type ResponseBlocklistIP struct {
 	ResponseBlocklistIPOptions
 	resolver Resolver
 	mu       sync.RWMutex
+	metrics  *BlocklistMetrics
+	loops    stopper // stops the refresh loop
 }
 
 var _ Resolver = &ResponseBlocklistIP{}
@@ -52,7 +54,12 @@ type ResponseBlocklistIPOptions struct {
 
 // NewResponseBlocklistIP returns a new instance of a response blocklist resolver.
 func NewResponseBlocklistIP(id string, resolver Resolver, opt ResponseBlocklistIPOptions) (*ResponseBlocklistIP, error) {
-	blocklist := &ResponseBlocklistIP{id: id, resolver: resolver, ResponseBlocklistIPOptions: opt}
+	blocklist := &ResponseBlocklistIP{
+		id:                         id,
+		resolver:                   resolver,
+		ResponseBlocklistIPOptions: opt,
+		metrics:                    NewBlocklistMetrics(id),
+	}
 
 	// Start the refresh goroutines if we have a list and a refresh period was given
 	if blocklist.BlocklistDB != nil && blocklist.BlocklistRefresh > 0 {
@@ -71,34 +78,58 @@ func (r *ResponseBlocklistIP) Resolve(q *dns.Msg, ci ClientInfo) (*dns.Msg, erro
 	if answer.Rcode != dns.RcodeSuccess {
 		return answer, err
 	}
+	r.mu.RLock()
+	db := r.BlocklistDB
+	r.mu.RUnlock()
 	if r.Filter {
-		return r.filterMatch(q, answer, ci)
+		return r.filterMatch(db, q, answer, ci)
 	}
-	return r.blockIfMatch(q, answer, ci)
+	return r.blockIfMatch(db, q, answer, ci)
 }
 
 func (r *ResponseBlocklistIP) String() string {
 	return r.id
 }
 
+// Close stops the periodic refresh of the blocklist.
+func (r *ResponseBlocklistIP) Close() error {
+	r.loops.stop()
+	return nil
+}
+
+// ReloadAll reloads the blocklist immediately.
+func (r *ResponseBlocklistIP) ReloadAll() error {
+	r.mu.RLock()
+	db := r.BlocklistDB
+	r.mu.RUnlock()
+	db, err := db.Reload()
+	if err != nil {
+		return err
+	}
+	r.mu.Lock()
+	closeReplacedIPDB(r.BlocklistDB, db)
+	r.BlocklistDB = db
+	r.mu.Unlock()
+	return nil
+}
+
 func (r *ResponseBlocklistIP) refreshLoopBlocklist(refresh time.Duration) {
-	for {
-		time.Sleep(refresh)
-		log := Log.WithField("id", r.id)
+	log := Log.WithField("id", r.id)
+	newRefresher(log, refresh).run(r.loops.done(), func() error {
 		log.Debug("reloading blocklist")
 		db, err := r.BlocklistDB.Reload()
 		if err != nil {
-			Log.WithError(err).Error("failed to load rules")
-			continue
+			return err
 		}
 		r.mu.Lock()
-		r.BlocklistDB.Close()
+		closeReplacedIPDB(r.BlocklistDB, db)
 		r.BlocklistDB = db
 		r.mu.Unlock()
-	}
+		return nil
+	})
 }
 
-func (r *ResponseBlocklistIP) blockIfMatch(query, answer *dns.Msg, ci ClientInfo) (*dns.Msg, error) {
+func (r *ResponseBlocklistIP) blockIfMatch(db IPBlocklistDB, query, answer *dns.Msg, ci ClientInfo) (*dns.Msg, error) {
 	for _, records := range [][]dns.RR{answer.Answer, answer.Ns, answer.Extra} {
 		for _, rr := range records {
 			var ip net.IP
@@ -110,8 +141,9 @@ func (r *ResponseBlocklistIP) blockIfMatch(query, answer *dns.Msg, ci ClientInfo
 			default:
 				continue
 			}
-			if match, ok := r.BlocklistDB.Match(ip); ok != r.Inverted {
+			if match, ok := db.Match(ip); ok != r.Inverted {
 				log := logger(r.id, query, ci).WithFields(logrus.Fields{"list": match.GetList(), "rule": match.GetRule(), "ip": ip})
+				r.metrics.countBlocked(query, match)
 				if r.BlocklistResolver != nil {
 					log.WithField("resolver", r.BlocklistResolver).Debug("blocklist match, forwarding to blocklist-resolver")
 					return r.BlocklistResolver.Resolve(query, ci)
@@ -125,13 +157,16 @@ func (r *ResponseBlocklistIP) blockIfMatch(query, answer *dns.Msg, ci ClientInfo
 			}
 		}
 	}
+	r.metrics.allowed.Add(1)
 	return answer, nil
 }
 
-func (r *ResponseBlocklistIP) filterMatch(query, answer *dns.Msg, ci ClientInfo) (*dns.Msg, error) {
-	answer.Answer = r.filterRR(query, ci, answer.Answer)
+func (r *ResponseBlocklistIP) filterMatch(db IPBlocklistDB, query, answer *dns.Msg, ci ClientInfo) (*dns.Msg, error) {
+	var filtered bool
+	answer.Answer, filtered = r.filterRR(db, query, ci, answer.Answer)
 	// If there's nothing left after applying the filter, return NXDOMAIN or send to the alternative resolver
 	if len(answer.Answer) == 0 {
+		r.metrics.countBlocked(query, nil)
 		log := Log.WithFields(logrus.Fields{"qname": qName(query)})
 		if r.BlocklistResolver != nil {
 			log.WithField("resolver", r.BlocklistResolver).Debug("no answers after filtering, forwarding to blocklist-resolver")
@@ -140,12 +175,20 @@ func (r *ResponseBlocklistIP) filterMatch(query, answer *dns.Msg, ci ClientInfo)
 		log.Debug("no answers after filtering, blocking response")
 		return nxdomain(query), nil
 	}
-	answer.Ns = r.filterRR(query, ci, answer.Ns)
-	answer.Extra = r.filterRR(query, ci, answer.Extra)
+	answer.Ns, _ = r.filterRR(db, query, ci, answer.Ns)
+	answer.Extra, _ = r.filterRR(db, query, ci, answer.Extra)
+	if filtered {
+		r.metrics.countBlocked(query, nil)
+	} else {
+		r.metrics.allowed.Add(1)
+	}
 	return answer, nil
 }
 
-func (r *ResponseBlocklistIP) filterRR(query *dns.Msg, ci ClientInfo, rrs []dns.RR) []dns.RR {
+// Removes any A/AAAA records that match the blocklist. Returns true if at least
+// one record was removed.
+func (r *ResponseBlocklistIP) filterRR(db IPBlocklistDB, query *dns.Msg, ci ClientInfo, rrs []dns.RR) ([]dns.RR, bool) {
+	var filtered bool
 	newRRs := make([]dns.RR, 0, len(rrs))
 	for _, rr := range rrs {
 		var ip net.IP
@@ -158,11 +201,12 @@ func (r *ResponseBlocklistIP) filterRR(query *dns.Msg, ci ClientInfo, rrs []dns.
 			newRRs = append(newRRs, rr)
 			continue
 		}
-		if match, ok := r.BlocklistDB.Match(ip); ok != r.Inverted {
+		if match, ok := db.Match(ip); ok != r.Inverted {
 			logger(r.id, query, ci).WithFields(logrus.Fields{"list": match.GetList(), "rule": match.GetRule(), "ip": ip}).Debug("filtering response")
+			filtered = true
 			continue
 		}
 		newRRs = append(newRRs, rr)
 	}
-	return newRRs
+	return newRRs, filtered
 }
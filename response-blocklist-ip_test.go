@@ -0,0 +1,91 @@
+package rdns
+
+import (
+	"testing"
+
+	"github.com/miekg/dns"
+	"github.com/stretchr/testify/require"
+)
+
+func TestResponseBlocklistIP(t *testing.T) {
+	var ci ClientInfo
+	upstream, err := NewStaticResolver("test-static", StaticResolverOptions{
+		Answer: []string{
+			"test.com. 3600 IN A 1.2.3.4",
+			"test.com. 3600 IN A 192.168.1.1",
+		},
+	})
+	require.NoError(t, err)
+
+	db, err := NewCidrDB("testlist", NewStaticLoader([]string{"192.168.1.0/24"}))
+	require.NoError(t, err)
+
+	q := new(dns.Msg)
+	q.SetQuestion("test.com.", dns.TypeA)
+
+	// One of the IPs in the response is listed, the whole response is blocked
+	b, err := NewResponseBlocklistIP("test-rbl-ip-block", upstream, ResponseBlocklistIPOptions{
+		BlocklistDB: db,
+	})
+	require.NoError(t, err)
+	a, err := b.Resolve(q, ci)
+	require.NoError(t, err)
+	require.Equal(t, dns.RcodeNameError, a.Rcode)
+	require.Empty(t, a.Answer)
+	require.Equal(t, int64(1), b.metrics.blocked.Value())
+	require.Equal(t, int64(0), b.metrics.allowed.Value())
+
+	// With filtering, only the unlisted IP should be left in the response
+	f, err := NewResponseBlocklistIP("test-rbl-ip-filter", upstream, ResponseBlocklistIPOptions{
+		BlocklistDB: db,
+		Filter:      true,
+	})
+	require.NoError(t, err)
+	a, err = f.Resolve(q, ci)
+	require.NoError(t, err)
+	require.Equal(t, dns.RcodeSuccess, a.Rcode)
+	require.Len(t, a.Answer, 1)
+	require.Equal(t, "1.2.3.4", a.Answer[0].(*dns.A).A.String())
+	require.Equal(t, int64(1), f.metrics.blocked.Value())
+}
+
+func TestResponseBlocklistIPResolver(t *testing.T) {
+	var ci ClientInfo
+	upstream, err := NewStaticResolver("test-static", StaticResolverOptions{
+		Answer: []string{"test.com. 3600 IN A 192.168.1.1"},
+	})
+	require.NoError(t, err)
+	clean, err := NewStaticResolver("test-static", StaticResolverOptions{
+		Answer: []string{"test.com. 3600 IN A 1.2.3.4"},
+	})
+	require.NoError(t, err)
+	blockResolver := new(TestResolver)
+
+	db, err := NewCidrDB("testlist", NewStaticLoader([]string{"192.168.1.0/24"}))
+	require.NoError(t, err)
+
+	q := new(dns.Msg)
+	q.SetQuestion("test.com.", dns.TypeA)
+
+	// Listed response should be sent to the blocklist-resolver
+	b, err := NewResponseBlocklistIP("test-rbl-ip-resolver", upstream, ResponseBlocklistIPOptions{
+		BlocklistDB:       db,
+		BlocklistResolver: blockResolver,
+	})
+	require.NoError(t, err)
+	_, err = b.Resolve(q, ci)
+	require.NoError(t, err)
+	require.Equal(t, 1, blockResolver.HitCount())
+
+	// Unlisted response is passed through
+	b, err = NewResponseBlocklistIP("test-rbl-ip-resolver-clean", clean, ResponseBlocklistIPOptions{
+		BlocklistDB:       db,
+		BlocklistResolver: blockResolver,
+	})
+	require.NoError(t, err)
+	a, err := b.Resolve(q, ci)
+	require.NoError(t, err)
+	require.Len(t, a.Answer, 1)
+	require.Equal(t, 1, blockResolver.HitCount())
+	require.Equal(t, int64(1), b.metrics.allowed.Value())
+}
@@ -6,6 +6,7 @@ import (
 	"time"
 
 	"github.com/miekg/dns"
+	"github.com/sirupsen/logrus"
 )
 
 // ResponseBlocklistName is a resolver that filters by matching the strings in CNAME, MX,
@@ -15,6 +16,8 @@ type ResponseBlocklistName struct {
 	ResponseBlocklistNameOptions
 	resolver Resolver
 	mu       sync.RWMutex
+	metrics  *BlocklistMetrics
+	loops    stopper // stops the refresh loop
 }
 
 var _ Resolver = &ResponseBlocklistName{}
@@ -38,7 +41,12 @@ type ResponseBlocklistNameOptions struct {
 
 // NewResponseBlocklistName returns a new instance of a response blocklist resolver.
 func NewResponseBlocklistName(id string, resolver Resolver, opt ResponseBlocklistNameOptions) (*ResponseBlocklistName, error) {
-	blocklist := &ResponseBlocklistName{id: id, resolver: resolver, ResponseBlocklistNameOptions: opt}
+	blocklist := &ResponseBlocklistName{
+		id:                           id,
+		resolver:                     resolver,
+		ResponseBlocklistNameOptions: opt,
+		metrics:                      NewBlocklistMetrics(id),
+	}
 
 	// Start the refresh goroutines if we have a list and a refresh period was given
 	if blocklist.BlocklistDB != nil && blocklist.BlocklistRefresh > 0 {
@@ -54,30 +62,53 @@ func (r *ResponseBlocklistName) Resolve(q *dns.Msg, ci ClientInfo) (*dns.Msg, er
 	if err != nil || answer == nil {
 		return answer, err
 	}
-	return r.blockIfMatch(q, answer, ci)
+	r.mu.RLock()
+	db := r.BlocklistDB
+	r.mu.RUnlock()
+	return r.blockIfMatch(db, q, answer, ci)
 }
 
 func (r *ResponseBlocklistName) String() string {
 	return r.id
 }
 
+// Close stops the periodic refresh of the blocklist.
+func (r *ResponseBlocklistName) Close() error {
+	r.loops.stop()
+	return nil
+}
+
+// ReloadAll reloads the blocklist immediately.
+func (r *ResponseBlocklistName) ReloadAll() error {
+	r.mu.RLock()
+	db := r.BlocklistDB
+	r.mu.RUnlock()
+	db, err := db.Reload()
+	if err != nil {
+		return err
+	}
+	r.mu.Lock()
+	r.BlocklistDB = db
+	r.mu.Unlock()
+	return nil
+}
+
 func (r *ResponseBlocklistName) refreshLoopBlocklist(refresh time.Duration) {
-	for {
-		time.Sleep(refresh)
-		log := Log.WithField("id", r.id)
+	log := Log.WithField("id", r.id)
+	newRefresher(log, refresh).run(r.loops.done(), func() error {
 		log.Debug("reloading blocklist")
 		db, err := r.BlocklistDB.Reload()
 		if err != nil {
-			Log.WithError(err).Error("failed to load rules")
-			continue
+			return err
 		}
 		r.mu.Lock()
 		r.BlocklistDB = db
 		r.mu.Unlock()
-	}
+		return nil
+	})
 }
 
-func (r *ResponseBlocklistName) blockIfMatch(query, answer *dns.Msg, ci ClientInfo) (*dns.Msg, error) {
+func (r *ResponseBlocklistName) blockIfMatch(db BlocklistDB, query, answer *dns.Msg, ci ClientInfo) (*dns.Msg, error) {
 	for _, records := range [][]dns.RR{answer.Answer, answer.Ns, answer.Extra} {
 		for _, rr := range records {
 			var name string
@@ -103,8 +134,9 @@ func (r *ResponseBlocklistName) blockIfMatch(query, answer *dns.Msg, ci ClientIn
 			default:
 				continue
 			}
-			if _, _, rule, ok := r.BlocklistDB.Match(dns.Question{Name: name}); ok != r.Inverted {
-				log := logger(r.id, query, ci).WithField("rule", rule.GetRule())
+			if _, _, match, ok := db.Match(dns.Question{Name: name}); ok != r.Inverted {
+				log := logger(r.id, query, ci).WithFields(logrus.Fields{"list": match.GetList(), "rule": match.GetRule(), "name": name})
+				r.metrics.countBlocked(query, match)
 				if r.BlocklistResolver != nil {
 					log.WithField("resolver", r.BlocklistResolver).Debug("blocklist match, forwarding to blocklist-resolver")
 					return r.BlocklistResolver.Resolve(query, ci)
@@ -118,6 +150,7 @@ func (r *ResponseBlocklistName) blockIfMatch(query, answer *dns.Msg, ci ClientIn
 			}
 		}
 	}
+	r.metrics.allowed.Add(1)
 	return answer, nil
 }
 
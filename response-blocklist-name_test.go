@@ -0,0 +1,55 @@
+package rdns
+
+import (
+	"testing"
+
+	"github.com/miekg/dns"
+	"github.com/stretchr/testify/require"
+)
+
+func TestResponseBlocklistName(t *testing.T) {
+	var ci ClientInfo
+
+	// Tracker hidden behind a CNAME of a first-party name
+	upstream, err := NewStaticResolver("test-static", StaticResolverOptions{
+		Answer: []string{
+			"metrics.test.com. 3600 IN CNAME test.tracker.net.",
+			"test.tracker.net. 3600 IN A 1.2.3.4",
+		},
+	})
+	require.NoError(t, err)
+	db, err := NewDomainDB("trackers", NewStaticLoader([]string{".tracker.net"}))
+	require.NoError(t, err)
+	ede, err := NewEDNS0EDETemplate(dns.ExtendedErrorCodeBlocked, "cname blocked")
+	require.NoError(t, err)
+
+	q := new(dns.Msg)
+	q.SetQuestion("metrics.test.com.", dns.TypeA)
+	q.SetEdns0(4096, false)
+
+	b, err := NewResponseBlocklistName("test-rbl-name", upstream, ResponseBlocklistNameOptions{
+		BlocklistDB:      db,
+		EDNS0EDETemplate: ede,
+	})
+	require.NoError(t, err)
+	a, err := b.Resolve(q, ci)
+	require.NoError(t, err)
+	require.Equal(t, dns.RcodeNameError, a.Rcode)
+	require.Empty(t, a.Answer)
+	require.Equal(t, int64(1), b.metrics.blocked.Value())
+	require.Equal(t, "1", b.metrics.blockedByList.Get("trackers").String())
+	require.Equal(t, dns.ExtendedErrorCodeBlocked, a.IsEdns0().Option[0].(*dns.EDNS0_EDE).InfoCode)
+
+	// Inverted, only names on the list are allowed
+	i, err := NewResponseBlocklistName("test-rbl-name-inverted", upstream, ResponseBlocklistNameOptions{
+		BlocklistDB: db,
+		Inverted:    true,
+	})
+	require.NoError(t, err)
+	a, err = i.Resolve(q, ci)
+	require.NoError(t, err)
+	require.Equal(t, dns.RcodeSuccess, a.Rcode)
+	require.Len(t, a.Answer, 2)
+	require.Equal(t, int64(1), i.metrics.allowed.Value())
+	require.Equal(t, int64(0), i.metrics.blocked.Value())
+}
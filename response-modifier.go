@@ -0,0 +1,133 @@
+package rdns
+
+import (
+	"regexp"
+	"slices"
+
+	"github.com/miekg/dns"
+)
+
+// ResponseModifier passes queries to upstream resolvers and changes the
+// responses according to rules that match on the query name and type. Rules
+// can limit TTLs, remove records of some types, and remove EDNS0 options. All
+// matching rules are applied, in the order they're defined.
+type ResponseModifier struct {
+	id string
+	ResponseModifierOptions
+	resolver Resolver
+}
+
+var _ Resolver = &ResponseModifier{}
+
+type ResponseModifierOptions struct {
+	Rules []ResponseModifierRule
+}
+
+// ResponseModifierRule defines which responses to modify and how.
+type ResponseModifierRule struct {
+	// Regexp matched against the query name. Matches all names if nil.
+	Name *regexp.Regexp
+
+	// Query types the rule applies to. Matches all types if empty.
+	Types []uint16
+
+	// Minimum and maximum TTL of records in the response. The limits aren't
+	// applied to SOA records, and a maximum of 0 disables it.
+	MinTTL uint32
+	MaxTTL uint32
+
+	// Records of these types are removed from all sections of the response.
+	StripTypes []uint16
+
+	// EDNS0 options with these codes are removed from the response.
+	StripEDNS0 []uint16
+}
+
+// NewResponseModifier returns a new instance of a response modifier.
+func NewResponseModifier(id string, resolver Resolver, opt ResponseModifierOptions) *ResponseModifier {
+	return &ResponseModifier{
+		id:                      id,
+		ResponseModifierOptions: opt,
+		resolver:                resolver,
+	}
+}
+
+// Resolve a DNS query by first resolving it upstream, then applying the
+// matching rules to the response.
+func (r *ResponseModifier) Resolve(q *dns.Msg, ci ClientInfo) (*dns.Msg, error) {
+	a, err := r.resolver.Resolve(q, ci)
+	if err != nil || a == nil || len(q.Question) < 1 {
+		return a, err
+	}
+	question := q.Question[0]
+	var modified bool
+	for _, rule := range r.Rules {
+		if !rule.match(question) {
+			continue
+		}
+		if rule.apply(a) {
+			modified = true
+		}
+	}
+	if modified {
+		logger(r.id, q, ci).Debug("modified response")
+	}
+	return a, nil
+}
+
+func (r *ResponseModifier) String() string {
+	return r.id
+}
+
+func (r ResponseModifierRule) match(q dns.Question) bool {
+	if len(r.Types) > 0 && !slices.Contains(r.Types, q.Qtype) {
+		return false
+	}
+	return r.Name == nil || r.Name.MatchString(q.Name)
+}
+
+// Apply the rule to a response, returns true if anything was changed.
+func (r ResponseModifierRule) apply(a *dns.Msg) bool {
+	var modified bool
+	if len(r.StripTypes) > 0 {
+		strip := func(rrs []dns.RR) []dns.RR {
+			return slices.DeleteFunc(rrs, func(rr dns.RR) bool {
+				if slices.Contains(r.StripTypes, rr.Header().Rrtype) && rr.Header().Rrtype != dns.TypeOPT {
+					modified = true
+					return true
+				}
+				return false
+			})
+		}
+		a.Answer = strip(a.Answer)
+		a.Ns = strip(a.Ns)
+		a.Extra = strip(a.Extra)
+	}
+	if len(r.StripEDNS0) > 0 {
+		if opt := a.IsEdns0(); opt != nil {
+			opt.Option = slices.DeleteFunc(opt.Option, func(o dns.EDNS0) bool {
+				if slices.Contains(r.StripEDNS0, o.Option()) {
+					modified = true
+					return true
+				}
+				return false
+			})
+		}
+	}
+	if r.MinTTL > 0 || r.MaxTTL > 0 {
+		iterateOverAnswerRRHeader(a, func(h *dns.RR_Header) {
+			if h.Rrtype == dns.TypeSOA {
+				return
+			}
+			if h.Ttl < r.MinTTL {
+				h.Ttl = r.MinTTL
+				modified = true
+			}
+			if r.MaxTTL > 0 && h.Ttl > r.MaxTTL {
+				h.Ttl = r.MaxTTL
+				modified = true
+			}
+		})
+	}
+	return modified
+}
@@ -0,0 +1,78 @@
+package rdns
+
+import (
+	"regexp"
+	"testing"
+
+	"github.com/miekg/dns"
+	"github.com/stretchr/testify/require"
+)
+
+func TestResponseModifier(t *testing.T) {
+	var ci ClientInfo
+	upstream := &TestResolver{
+		ResolveFunc: func(q *dns.Msg, ci ClientInfo) (*dns.Msg, error) {
+			a := new(dns.Msg)
+			a.SetReply(q)
+			name := q.Question[0].Name
+			a.Answer = []dns.RR{
+				mustRR(t, "cdn.example.com. 0 IN A 1.2.3.4"),
+				mustRR(t, "cdn.example.com. 0 IN RRSIG A 8 3 0 20300101000000 20200101000000 1 example.com. AAAA"),
+			}
+			a.Answer[0].Header().Name = name
+			a.Ns = []dns.RR{
+				mustRR(t, "example.com. 0 IN SOA ns.example.com. hostmaster.example.com. 1 7200 3600 1209600 2"),
+			}
+			a.SetEdns0(4096, false)
+			opt := a.IsEdns0()
+			opt.Option = append(opt.Option,
+				&dns.EDNS0_PADDING{Padding: []byte{0}},
+				&dns.EDNS0_EDE{InfoCode: dns.ExtendedErrorCodeOther},
+			)
+			return a, nil
+		},
+	}
+
+	r := NewResponseModifier("test-modifier", upstream, ResponseModifierOptions{
+		Rules: []ResponseModifierRule{
+			{
+				Name:   regexp.MustCompile(`(^|\.)cdn\.example\.com\.$`),
+				MinTTL: 30,
+			},
+			{
+				Types:      []uint16{dns.TypeA},
+				MaxTTL:     10,
+				StripTypes: []uint16{dns.TypeRRSIG},
+				StripEDNS0: []uint16{dns.EDNS0PADDING},
+			},
+		},
+	})
+
+	// Both rules match, the min is raised first and then limited by the max
+	q := new(dns.Msg)
+	q.SetQuestion("cdn.example.com.", dns.TypeA)
+	a, err := r.Resolve(q, ci)
+	require.NoError(t, err)
+	require.Len(t, a.Answer, 1)
+	require.Equal(t, uint32(10), a.Answer[0].Header().Ttl)
+	require.Equal(t, uint32(0), a.Ns[0].Header().Ttl)
+	opt := a.IsEdns0()
+	require.NotNil(t, opt)
+	require.Len(t, opt.Option, 1)
+	require.Equal(t, uint16(dns.EDNS0EDE), opt.Option[0].Option())
+
+	// Only the name rule matches
+	q.SetQuestion("cdn.example.com.", dns.TypeAAAA)
+	a, err = r.Resolve(q, ci)
+	require.NoError(t, err)
+	require.Len(t, a.Answer, 2)
+	require.Equal(t, uint32(30), a.Answer[0].Header().Ttl)
+	require.Len(t, a.IsEdns0().Option, 2)
+
+	// No rule matches
+	q.SetQuestion("www.example.com.", dns.TypeAAAA)
+	a, err = r.Resolve(q, ci)
+	require.NoError(t, err)
+	require.Len(t, a.Answer, 2)
+	require.Equal(t, uint32(0), a.Answer[0].Header().Ttl)
+}
@@ -0,0 +1,139 @@
+package rdns
+
+import (
+	"expvar"
+	"net"
+
+	"github.com/miekg/dns"
+	"github.com/sirupsen/logrus"
+)
+
+// ResponseRouter sends queries to a resolver and checks the response. If the
+// response code or one of the addresses in the answer match, the query is sent
+// to another resolver, whose response is used instead. This works around
+// upstream resolvers that answer some names incorrectly, for example with
+// NXDOMAIN or with private addresses.
+type ResponseRouter struct {
+	id string
+	ResponseRouterOptions
+	resolver      Resolver
+	retryResolver Resolver
+	retried       *expvar.Int
+}
+
+var _ Resolver = &ResponseRouter{}
+
+type ResponseRouterOptions struct {
+	// Response codes that are retried, e.g. dns.RcodeNameError.
+	Rcodes []int
+
+	// Responses with A or AAAA records in any of these networks are retried.
+	Networks []*net.IPNet
+
+	// Responses with A or AAAA records in private, loopback, link-local, or
+	// other reserved ranges are retried.
+	Bogons bool
+}
+
+// Address ranges that aren't routed on the internet, in addition to the private,
+// loopback, link-local and unspecified addresses.
+var bogonNetworks = mustParseCIDRs(
+	"0.0.0.0/8",
+	"100.64.0.0/10",
+	"192.0.0.0/24",
+	"192.0.2.0/24",
+	"198.18.0.0/15",
+	"198.51.100.0/24",
+	"203.0.113.0/24",
+	"224.0.0.0/3",
+	"100::/64",
+	"2001:db8::/32",
+	"ff00::/8",
+)
+
+// NewResponseRouter returns a new instance of a response router.
+func NewResponseRouter(id string, resolver, retryResolver Resolver, opt ResponseRouterOptions) *ResponseRouter {
+	return &ResponseRouter{
+		id:                    id,
+		ResponseRouterOptions: opt,
+		resolver:              resolver,
+		retryResolver:         retryResolver,
+		retried:               getVarInt("router", id, "retry"),
+	}
+}
+
+// Resolve a DNS query with the first resolver, and retry it with the other
+// one if the response matches.
+func (r *ResponseRouter) Resolve(q *dns.Msg, ci ClientInfo) (*dns.Msg, error) {
+	a, err := r.resolver.Resolve(q, ci)
+	if err != nil || a == nil {
+		return a, err
+	}
+	reason, ok := r.match(a)
+	if !ok {
+		return a, nil
+	}
+	logger(r.id, q, ci).WithFields(logrus.Fields{"reason": reason, "resolver": r.retryResolver}).Debug("response matched, forwarding to retry-resolver")
+	r.retried.Add(1)
+	return r.retryResolver.Resolve(q, ci)
+}
+
+func (r *ResponseRouter) String() string {
+	return r.id
+}
+
+// Returns a description of why the response should be retried.
+func (r *ResponseRouter) match(a *dns.Msg) (string, bool) {
+	for _, rcode := range r.Rcodes {
+		if a.Rcode == rcode {
+			return "rcode " + dns.RcodeToString[rcode], true
+		}
+	}
+	if len(r.Networks) == 0 && !r.Bogons {
+		return "", false
+	}
+	for _, rr := range a.Answer {
+		var ip net.IP
+		switch rr := rr.(type) {
+		case *dns.A:
+			ip = rr.A
+		case *dns.AAAA:
+			ip = rr.AAAA
+		default:
+			continue
+		}
+		for _, n := range r.Networks {
+			if n.Contains(ip) {
+				return "address " + ip.String(), true
+			}
+		}
+		if r.Bogons && isBogonIP(ip) {
+			return "bogon address " + ip.String(), true
+		}
+	}
+	return "", false
+}
+
+func isBogonIP(ip net.IP) bool {
+	if isRebindingIP(ip) {
+		return true
+	}
+	for _, n := range bogonNetworks {
+		if n.Contains(ip) {
+			return true
+		}
+	}
+	return false
+}
+
+func mustParseCIDRs(networks ...string) []*net.IPNet {
+	out := make([]*net.IPNet, 0, len(networks))
+	for _, s := range networks {
+		_, n, err := net.ParseCIDR(s)
+		if err != nil {
+			panic(err)
+		}
+		out = append(out, n)
+	}
+	return out
+}
@@ -0,0 +1,71 @@
+package rdns
+
+import (
+	"net"
+	"testing"
+
+	"github.com/miekg/dns"
+	"github.com/stretchr/testify/require"
+)
+
+func TestResponseRouter(t *testing.T) {
+	var ci ClientInfo
+	primary := &TestResolver{
+		ResolveFunc: func(q *dns.Msg, ci ClientInfo) (*dns.Msg, error) {
+			a := new(dns.Msg)
+			a.SetReply(q)
+			switch q.Question[0].Name {
+			case "missing.test.":
+				a.Rcode = dns.RcodeNameError
+			case "search.test.":
+				a.Answer = []dns.RR{mustRR(t, "search.test. 60 IN A 198.51.100.1")}
+			case "private.test.":
+				a.Answer = []dns.RR{mustRR(t, "private.test. 60 IN AAAA fd00::1")}
+			case "cgnat.test.":
+				a.Answer = []dns.RR{mustRR(t, "cgnat.test. 60 IN A 100.64.0.1")}
+			default:
+				a.Answer = []dns.RR{mustRR(t, q.Question[0].Name+" 60 IN A 1.1.1.1")}
+			}
+			return a, nil
+		},
+	}
+	retry := new(TestResolver)
+	_, search, _ := net.ParseCIDR("198.51.100.0/24")
+
+	r := NewResponseRouter("test-response-router", primary, retry, ResponseRouterOptions{
+		Rcodes:   []int{dns.RcodeNameError},
+		Networks: []*net.IPNet{search},
+		Bogons:   true,
+	})
+
+	q := new(dns.Msg)
+	for _, test := range []struct {
+		name    string
+		retried bool
+	}{
+		{"good.test.", false},
+		{"missing.test.", true},
+		{"search.test.", true},
+		{"private.test.", true},
+		{"cgnat.test.", true},
+	} {
+		q.SetQuestion(test.name, dns.TypeA)
+		before := retry.HitCount()
+		_, err := r.Resolve(q, ci)
+		require.NoError(t, err)
+		require.Equal(t, test.retried, retry.HitCount() > before, test.name)
+	}
+	require.Equal(t, int64(4), r.retried.Value())
+
+	// Without bogons, only the configured networks are retried
+	r = NewResponseRouter("test-response-router-networks", primary, retry, ResponseRouterOptions{
+		Networks: []*net.IPNet{search},
+	})
+	before := retry.HitCount()
+	for _, name := range []string{"missing.test.", "private.test."} {
+		q.SetQuestion(name, dns.TypeA)
+		_, err := r.Resolve(q, ci)
+		require.NoError(t, err)
+	}
+	require.Equal(t, before, retry.HitCount())
+}
@@ -0,0 +1,166 @@
+package rdns
+
+import (
+	"math/rand"
+	"sync/atomic"
+	"time"
+)
+
+// RetryPolicy defines how long resolvers of a group are skipped after they
+// fail. The back-off starts at InitialBackoff and is multiplied with every
+// further failure, up to MaxBackoff. A successful response resets it.
+type RetryPolicy struct {
+	// Back-off after the first failure. Disabled if 0.
+	InitialBackoff time.Duration
+
+	// Upper limit of the back-off. Defaults to 1 minute, or InitialBackoff if
+	// that is longer.
+	MaxBackoff time.Duration
+
+	// Factor applied to the back-off with every consecutive failure. Defaults to 2.
+	Multiplier float64
+
+	// Randomize the back-off to between half and all of the computed value so
+	// that instances don't retry in lockstep.
+	Jitter bool
+}
+
+// Per-resolver back-off state. All fields are accessed atomically so the skip
+// decision doesn't need a lock.
+type upstreamBackoff struct {
+	lastFailure atomic.Int64 // Unix time in nanoseconds
+	backoff     atomic.Int64 // Current back-off, before jitter
+	wait        atomic.Int64 // Current back-off, after jitter
+}
+
+// backoffTracker tracks the back-off of the resolvers in a group.
+type backoffTracker struct {
+	policy    RetryPolicy
+	upstreams []upstreamBackoff
+	now       func() time.Time
+	jitter    func(d time.Duration) time.Duration
+}
+
+// Returns the policy with defaults for the values that aren't set.
+func (p RetryPolicy) withDefaults() RetryPolicy {
+	if p.MaxBackoff <= 0 {
+		p.MaxBackoff = time.Minute
+	}
+	if p.MaxBackoff < p.InitialBackoff {
+		p.MaxBackoff = p.InitialBackoff
+	}
+	if p.Multiplier < 1 {
+		p.Multiplier = 2
+	}
+	return p
+}
+
+// Returns the back-off before the nth retry, starting at 1. The policy is
+// expected to have its defaults applied.
+func (p RetryPolicy) backoff(n int) time.Duration {
+	d := p.InitialBackoff
+	for i := 1; i < n && d < p.MaxBackoff; i++ {
+		d = time.Duration(float64(d) * p.Multiplier)
+	}
+	if d > p.MaxBackoff || d < 0 {
+		d = p.MaxBackoff
+	}
+	if p.Jitter {
+		d = jitter(d)
+	}
+	return d
+}
+
+// Randomizes a duration to between half and all of it.
+func jitter(d time.Duration) time.Duration {
+	half := d / 2
+	return half + time.Duration(rand.Int63n(int64(d-half)+1))
+}
+
+func newBackoffTracker(policy RetryPolicy, n int) *backoffTracker {
+	if policy.InitialBackoff <= 0 {
+		return nil
+	}
+	return &backoffTracker{
+		policy:    policy.withDefaults(),
+		upstreams: make([]upstreamBackoff, n),
+		now:       time.Now,
+		jitter:    jitter,
+	}
+}
+
+// Returns true if the resolver is still backing off after a failure.
+func (t *backoffTracker) skip(i int) bool {
+	if t == nil {
+		return false
+	}
+	u := &t.upstreams[i]
+	wait := u.wait.Load()
+	if wait == 0 {
+		return false
+	}
+	return t.now().UnixNano()-u.lastFailure.Load() < wait
+}
+
+// Returns true if all resolvers are backing off.
+func (t *backoffTracker) allSkipped() bool {
+	if t == nil {
+		return false
+	}
+	for i := range t.upstreams {
+		if !t.skip(i) {
+			return false
+		}
+	}
+	return true
+}
+
+// Record a failure of a resolver and extend its back-off.
+func (t *backoffTracker) failure(i int) {
+	if t == nil {
+		return
+	}
+	u := &t.upstreams[i]
+	for {
+		old := u.backoff.Load()
+		next := t.policy.InitialBackoff
+		if old > 0 {
+			next = time.Duration(float64(old) * t.policy.Multiplier)
+			if next > t.policy.MaxBackoff || next <= 0 {
+				next = t.policy.MaxBackoff
+			}
+		}
+		if !u.backoff.CompareAndSwap(old, int64(next)) {
+			continue
+		}
+		wait := next
+		if t.policy.Jitter {
+			wait = t.jitter(next)
+		}
+		u.lastFailure.Store(t.now().UnixNano())
+		u.wait.Store(int64(wait))
+		return
+	}
+}
+
+// Clear the back-off of a resolver after a success, or when reset manually.
+func (t *backoffTracker) reset(i int) {
+	if t == nil || i < 0 || i >= len(t.upstreams) {
+		return
+	}
+	u := &t.upstreams[i]
+	if u.backoff.Load() == 0 {
+		return
+	}
+	u.wait.Store(0)
+	u.backoff.Store(0)
+	u.lastFailure.Store(0)
+}
+
+// Returns the current back-off of a resolver, before jitter.
+func (t *backoffTracker) current(i int) time.Duration {
+	if t == nil {
+		return 0
+	}
+	return time.Duration(t.upstreams[i].backoff.Load())
+}
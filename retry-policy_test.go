@@ -0,0 +1,80 @@
+package rdns
+
+import (
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/require"
+)
+
+func TestBackoffProgression(t *testing.T) {
+	tr := newBackoffTracker(RetryPolicy{
+		InitialBackoff: time.Second,
+		MaxBackoff:     10 * time.Second,
+		Multiplier:     2,
+	}, 2)
+	now := time.Unix(1700000000, 0)
+	tr.now = func() time.Time { return now }
+
+	// The back-off grows exponentially up to the limit
+	for _, expected := range []time.Duration{1, 2, 4, 8, 10, 10} {
+		tr.failure(0)
+		require.Equal(t, expected*time.Second, tr.current(0))
+	}
+	require.True(t, tr.skip(0))
+	require.False(t, tr.skip(1))
+	require.False(t, tr.allSkipped())
+
+	// The resolver is skipped until the back-off expires
+	now = now.Add(9 * time.Second)
+	require.True(t, tr.skip(0))
+	now = now.Add(time.Second)
+	require.False(t, tr.skip(0))
+
+	// A success resets the back-off
+	tr.reset(0)
+	require.Zero(t, tr.current(0))
+	tr.failure(0)
+	require.Equal(t, time.Second, tr.current(0))
+
+	// Disabled without initial back-off
+	require.Nil(t, newBackoffTracker(RetryPolicy{}, 2))
+	var disabled *backoffTracker
+	disabled.failure(0)
+	require.False(t, disabled.skip(0))
+}
+
+func TestRetryPolicyBackoff(t *testing.T) {
+	p := RetryPolicy{InitialBackoff: 100 * time.Millisecond, MaxBackoff: time.Second}.withDefaults()
+	for i, expected := range []time.Duration{100, 200, 400, 800, 1000, 1000} {
+		require.Equal(t, expected*time.Millisecond, p.backoff(i+1))
+	}
+
+	// No wait between retries without initial back-off
+	require.Zero(t, RetryPolicy{}.withDefaults().backoff(3))
+}
+
+func TestBackoffJitter(t *testing.T) {
+	tr := newBackoffTracker(RetryPolicy{
+		InitialBackoff: time.Second,
+		MaxBackoff:     time.Minute,
+		Jitter:         true,
+	}, 1)
+	now := time.Unix(1700000000, 0)
+	tr.now = func() time.Time { return now }
+
+	// The effective back-off is between half and all of the nominal one
+	for i := 0; i < 1000; i++ {
+		tr.reset(0)
+		for j := 0; j < i%6; j++ {
+			tr.failure(0)
+		}
+		if i%6 == 0 {
+			continue
+		}
+		nominal := tr.current(0)
+		wait := time.Duration(tr.upstreams[0].wait.Load())
+		require.GreaterOrEqual(t, wait, nominal/2)
+		require.LessOrEqual(t, wait, nominal)
+	}
+}
@@ -0,0 +1,168 @@
+package rdns
+
+import (
+	"errors"
+	"fmt"
+	"strings"
+
+	"github.com/miekg/dns"
+)
+
+// Rewrite is a resolver that maps query names in one domain to another, for
+// example example.internal. to real.example.com., and forwards the queries to
+// another resolver. Owner names and CNAME targets in the response are mapped
+// back, so clients only see names in the domain they queried.
+type Rewrite struct {
+	id       string
+	resolver Resolver
+	rules    []RewriteRule
+}
+
+var _ Resolver = &Rewrite{}
+
+// RewriteRule maps a domain and all names below it to another domain.
+type RewriteRule struct {
+	From string // Domain of the query names, e.g. "example.internal."
+	To   string // Domain the names are mapped to in queries sent upstream
+}
+
+// NewRewrite returns a new instance of a Rewrite resolver. The first rule
+// with a domain that matches the query name is used.
+func NewRewrite(id string, resolver Resolver, rules ...RewriteRule) (*Rewrite, error) {
+	normalized := make([]RewriteRule, 0, len(rules))
+	for _, rule := range rules {
+		for _, name := range []string{rule.From, rule.To} {
+			if _, ok := dns.IsDomainName(name); !ok || name == "" || name == "." {
+				return nil, fmt.Errorf("invalid domain '%s' in rewrite rule", name)
+			}
+		}
+		normalized = append(normalized, RewriteRule{
+			From: strings.ToLower(dns.Fqdn(rule.From)),
+			To:   strings.ToLower(dns.Fqdn(rule.To)),
+		})
+	}
+	return &Rewrite{id: id, resolver: resolver, rules: normalized}, nil
+}
+
+// Resolve a DNS query by mapping the query name to the other domain, sending
+// it upstream and mapping the names in the response back.
+func (r *Rewrite) Resolve(q *dns.Msg, ci ClientInfo) (*dns.Msg, error) {
+	if len(q.Question) < 1 {
+		return nil, errors.New("no question in query")
+	}
+	oldName := q.Question[0].Name
+	log := logger(r.id, q, ci)
+
+	var (
+		rule    RewriteRule
+		newName string
+		ok      bool
+	)
+	for _, rule = range r.rules {
+		if newName, ok = replaceDomain(oldName, rule.From, rule.To); ok {
+			break
+		}
+	}
+	if !ok {
+		log.Debug("forwarding unmodified query to resolver")
+		return r.resolver.Resolve(q, ci)
+	}
+
+	// Names close to the length limit can get too long in the other domain
+	if _, ok := dns.IsDomainName(newName); !ok {
+		log.WithField("new-qname", newName).Debug("invalid name after rewrite, responding with FORMERR")
+		return responseWithCode(q, dns.RcodeFormatError), nil
+	}
+
+	// Modify the query name in a copy, the original query belongs to the caller
+	newQ := q.Copy()
+	newQ.Question[0].Name = newName
+
+	log.WithField("new-qname", newName).WithField("resolver", r.resolver).Debug("forwarding rewritten query to resolver")
+	a, err := r.resolver.Resolve(newQ, ci)
+	if err != nil || a == nil {
+		return nil, err
+	}
+
+	for i := range a.Question {
+		if strings.EqualFold(a.Question[i].Name, newName) {
+			a.Question[i].Name = oldName
+		}
+	}
+	m := rewriteMapping{rule: rule, oldName: oldName, newName: newName}
+	a.Answer = m.restore(a.Answer)
+	a.Ns = m.restore(a.Ns)
+	a.Extra = m.restore(a.Extra)
+	return a, nil
+}
+
+func (r *Rewrite) String() string {
+	return r.id
+}
+
+// Maps names in a response back to the domain of the query.
+type rewriteMapping struct {
+	rule    RewriteRule
+	oldName string // Query name sent by the client
+	newName string // Query name sent upstream
+}
+
+// Returns the name in the original domain. The query name itself is restored
+// exactly as the client sent it.
+func (m rewriteMapping) name(name string) (string, bool) {
+	if strings.EqualFold(name, m.newName) {
+		return m.oldName, true
+	}
+	return replaceDomain(name, m.rule.To, m.rule.From)
+}
+
+// Maps the owner names and CNAME targets of the records back. Signatures of
+// modified records can't be valid anymore and are removed.
+func (m rewriteMapping) restore(rrs []dns.RR) []dns.RR {
+	type rrset struct {
+		name  string
+		rtype uint16
+	}
+	modified := make(map[rrset]struct{})
+	for _, rr := range rrs {
+		if _, ok := rr.(*dns.RRSIG); ok {
+			continue
+		}
+		h := rr.Header()
+		set := rrset{strings.ToLower(h.Name), h.Rrtype}
+		if name, ok := m.name(h.Name); ok {
+			h.Name = name
+			modified[set] = struct{}{}
+		}
+		if cname, ok := rr.(*dns.CNAME); ok {
+			if target, ok := m.name(cname.Target); ok {
+				cname.Target = target
+				modified[set] = struct{}{}
+			}
+		}
+	}
+	out := rrs[:0]
+	for _, rr := range rrs {
+		if sig, ok := rr.(*dns.RRSIG); ok {
+			if _, ok := modified[rrset{strings.ToLower(sig.Hdr.Name), sig.TypeCovered}]; ok {
+				continue
+			}
+		}
+		out = append(out, rr)
+	}
+	return out
+}
+
+// Replaces the domain of a name that is equal to or below it. Both domains
+// are expected to be lowercase and fully qualified, the labels in front of
+// the domain keep their case.
+func replaceDomain(name, from, to string) (string, bool) {
+	lower := strings.ToLower(dns.Fqdn(name))
+	switch {
+	case lower == from:
+		return to, true
+	case strings.HasSuffix(lower, "."+from):
+		return dns.Fqdn(name)[:len(lower)-len(from)] + to, true
+	}
+	return name, false
+}
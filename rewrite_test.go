@@ -0,0 +1,92 @@
+package rdns
+
+import (
+	"strings"
+	"testing"
+
+	"github.com/miekg/dns"
+	"github.com/stretchr/testify/require"
+)
+
+func TestRewrite(t *testing.T) {
+	var ci ClientInfo
+	var upstreamName string
+	r := &TestResolver{
+		ResolveFunc: func(q *dns.Msg, ci ClientInfo) (*dns.Msg, error) {
+			upstreamName = q.Question[0].Name
+			a := new(dns.Msg)
+			a.SetReply(q)
+			switch strings.ToLower(q.Question[0].Name) {
+			case "app.real.example.com.":
+				a.Answer = []dns.RR{
+					mustRR(t, "app.real.example.com. 300 IN CNAME web.real.example.com."),
+					mustRR(t, "app.real.example.com. 300 IN RRSIG CNAME 13 4 300 20300101000000 20200101000000 1234 real.example.com. AAAA"),
+					mustRR(t, "web.real.example.com. 300 IN CNAME cdn.example.net."),
+					mustRR(t, "cdn.example.net. 300 IN A 192.0.2.1"),
+					mustRR(t, "cdn.example.net. 300 IN RRSIG A 13 3 300 20300101000000 20200101000000 1234 example.net. AAAA"),
+				}
+			default:
+				a.Rcode = dns.RcodeNameError
+				a.Ns = []dns.RR{
+					mustRR(t, "real.example.com. 300 IN SOA ns.real.example.com. admin.example.com. 1 3600 600 86400 300"),
+				}
+			}
+			return a, nil
+		},
+	}
+
+	rw, err := NewRewrite("test-rewrite", r, RewriteRule{From: "example.internal", To: "Real.Example.com."})
+	require.NoError(t, err)
+
+	// Names outside the domain are forwarded unmodified
+	q := new(dns.Msg)
+	q.SetQuestion("test.com.", dns.TypeA)
+	_, err = rw.Resolve(q, ci)
+	require.NoError(t, err)
+	require.Equal(t, "test.com.", upstreamName)
+	q.SetQuestion("notexample.internal.", dns.TypeA)
+	_, err = rw.Resolve(q, ci)
+	require.NoError(t, err)
+	require.Equal(t, "notexample.internal.", upstreamName)
+
+	// Owner names and CNAME targets are mapped back, names outside the
+	// upstream domain are unchanged
+	q.SetQuestion("App.example.internal.", dns.TypeA)
+	a, err := rw.Resolve(q, ci)
+	require.NoError(t, err)
+	require.Equal(t, "App.real.example.com.", upstreamName)
+	require.Equal(t, "App.example.internal.", a.Question[0].Name)
+	require.Len(t, a.Answer, 4)
+	require.Equal(t, "App.example.internal.", a.Answer[0].Header().Name)
+	require.Equal(t, "web.example.internal.", a.Answer[0].(*dns.CNAME).Target)
+	require.Equal(t, "web.example.internal.", a.Answer[1].Header().Name)
+	require.Equal(t, "cdn.example.net.", a.Answer[1].(*dns.CNAME).Target)
+	require.Equal(t, "cdn.example.net.", a.Answer[2].Header().Name)
+
+	// The signature of the modified CNAME is removed, the other one is kept
+	require.IsType(t, &dns.RRSIG{}, a.Answer[3])
+	require.Equal(t, dns.TypeA, a.Answer[3].(*dns.RRSIG).TypeCovered)
+
+	// Authority section
+	q.SetQuestion("missing.example.internal.", dns.TypeA)
+	a, err = rw.Resolve(q, ci)
+	require.NoError(t, err)
+	require.Equal(t, dns.RcodeNameError, a.Rcode)
+	require.Equal(t, "example.internal.", a.Ns[0].Header().Name)
+
+	// The rewritten name would be too long
+	rw, err = NewRewrite("test-rewrite", r, RewriteRule{From: "example.internal.", To: "internal.real.example.com."})
+	require.NoError(t, err)
+	label := strings.Repeat("a", 63) + "."
+	q.SetQuestion(strings.Repeat(label, 3)+strings.Repeat("b", 44)+".example.internal.", dns.TypeA)
+	a, err = rw.Resolve(q, ci)
+	require.NoError(t, err)
+	require.Equal(t, dns.RcodeFormatError, a.Rcode)
+}
+
+func TestRewriteInvalidRule(t *testing.T) {
+	_, err := NewRewrite("test-rewrite", new(TestResolver), RewriteRule{From: "example.internal.", To: ""})
+	require.Error(t, err)
+	_, err = NewRewrite("test-rewrite", new(TestResolver), RewriteRule{From: ".", To: "example.com."})
+	require.Error(t, err)
+}
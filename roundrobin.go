@@ -1,38 +1,73 @@
 package rdns
 
 import (
+	"hash/fnv"
+	"math"
+	"net"
 	"sync"
 
 	"github.com/miekg/dns"
 )
 
-// RoundRobin is a group of resolvers that will receive equal amounts of queries.
-// Failed queries are not retried.
+// RoundRobin is a group of resolvers that will receive equal amounts of queries,
+// or amounts according to their weights. Failed queries are not retried.
 type RoundRobin struct {
 	id        string
 	resolvers []Resolver
+	opt       RoundRobinOptions
 	mu        sync.Mutex
-	current   int
+	current   []int // Current weights for smooth weighted round-robin
 	metrics   *RouterMetrics
 }
 
 var _ Resolver = &RoundRobin{}
 
+// RoundRobinOptions contain settings for the round-robin resolver group.
+type RoundRobinOptions struct {
+	// Relative weights of the resolvers, in the same order as the resolvers.
+	// A resolver with weight 2 receives twice as many queries as one with
+	// weight 1. All resolvers have the same weight if empty.
+	Weights []int
+
+	// Send all queries of a client to the same resolver, picked by a hash of
+	// the client IP that takes the weights into account. Queries without a
+	// client IP are distributed normally.
+	Sticky bool
+}
+
 // NewRoundRobin returns a new instance of a round-robin resolver group.
 func NewRoundRobin(id string, resolvers ...Resolver) *RoundRobin {
+	return NewRoundRobinWithOptions(id, RoundRobinOptions{}, resolvers...)
+}
+
+// NewRoundRobinWithOptions returns a new instance of a round-robin resolver
+// group with weights or sticky clients.
+func NewRoundRobinWithOptions(id string, opt RoundRobinOptions, resolvers ...Resolver) *RoundRobin {
+	weights := make([]int, len(resolvers))
+	for i := range weights {
+		weights[i] = 1
+		if i < len(opt.Weights) && opt.Weights[i] > 0 {
+			weights[i] = opt.Weights[i]
+		}
+	}
+	opt.Weights = weights
 	return &RoundRobin{
 		id:        id,
 		resolvers: resolvers,
+		opt:       opt,
+		current:   make([]int, len(resolvers)),
 		metrics:   NewRouterMetrics(id, len(resolvers)),
 	}
 }
 
 // Resolve a DNS query using a round-robin resolver group.
 func (r *RoundRobin) Resolve(q *dns.Msg, ci ClientInfo) (*dns.Msg, error) {
-	r.mu.Lock()
-	resolver := r.resolvers[r.current]
-	r.current = (r.current + 1) % len(r.resolvers)
-	r.mu.Unlock()
+	var resolver Resolver
+	if r.opt.Sticky && ci.SourceIP != nil {
+		resolver = r.resolvers[r.pickSticky(ci.SourceIP)]
+	} else {
+		resolver = r.resolvers[r.pickNext()]
+	}
 	logger(r.id, q, ci).WithField("resolver", resolver).Debug("forwarding query to resolver")
 	r.metrics.route.Add(resolver.String(), 1)
 	msg, err := resolver.Resolve(q, ci)
@@ -45,3 +80,57 @@ func (r *RoundRobin) Resolve(q *dns.Msg, ci ClientInfo) (*dns.Msg, error) {
 func (r *RoundRobin) String() string {
 	return r.id
 }
+
+// Returns the index of the next resolver with smooth weighted round-robin,
+// which spreads the queries of resolvers with higher weights evenly instead
+// of sending them in bursts.
+func (r *RoundRobin) pickNext() int {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	var total, best int
+	for i, w := range r.opt.Weights {
+		r.current[i] += w
+		total += w
+		if r.current[i] > r.current[best] {
+			best = i
+		}
+	}
+	r.current[best] -= total
+	return best
+}
+
+// Returns the index of the resolver for a client using weighted rendezvous
+// hashing over the client IP and resolver names. Each client is consistently
+// mapped to the same resolver, and only the clients of a resolver move when
+// it is removed from the group.
+func (r *RoundRobin) pickSticky(ip net.IP) int {
+	var (
+		best      int
+		bestScore = math.Inf(-1)
+	)
+	for i, w := range r.opt.Weights {
+		h := fnv.New64a()
+		h.Write([]byte(r.resolvers[i].String()))
+		h.Write([]byte{0})
+		h.Write(normalizeIP(ip))
+
+		// Map the hash to (0,1) and scale it by the weight
+		u := (float64(mix64(h.Sum64())>>11) + 0.5) / (1 << 53)
+		score := float64(w) / -math.Log(u)
+		if score > bestScore {
+			best, bestScore = i, score
+		}
+	}
+	return best
+}
+
+// Finalizer of MurmurHash3. FNV hashes of similar inputs only differ in their
+// lower bits, this spreads the differences over all bits.
+func mix64(h uint64) uint64 {
+	h ^= h >> 33
+	h *= 0xff51afd7ed558ccd
+	h ^= h >> 33
+	h *= 0xc4ceb9fe1a85ec53
+	h ^= h >> 33
+	return h
+}
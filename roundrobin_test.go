@@ -1,6 +1,7 @@
 package rdns
 
 import (
+	"net"
 	"testing"
 
 	"github.com/miekg/dns"
@@ -26,3 +27,82 @@ func TestRoundRobin(t *testing.T) {
 	require.Equal(t, 5, r1.HitCount())
 	require.Equal(t, 5, r2.HitCount())
 }
+
+func TestRoundRobinWeighted(t *testing.T) {
+	r1 := new(TestResolver)
+	r2 := new(TestResolver)
+
+	g := NewRoundRobinWithOptions("test-rr-weighted", RoundRobinOptions{Weights: []int{3, 1}}, r1, r2)
+	q := new(dns.Msg)
+	q.SetQuestion("test.com.", dns.TypeA)
+
+	// The second resolver gets every 4th query, not in bursts
+	for i := 0; i < 8; i++ {
+		_, err := g.Resolve(q, ClientInfo{})
+		require.NoError(t, err)
+		if i == 3 {
+			require.Equal(t, 3, r1.HitCount())
+			require.Equal(t, 1, r2.HitCount())
+		}
+	}
+	require.Equal(t, 6, r1.HitCount())
+	require.Equal(t, 2, r2.HitCount())
+}
+
+func TestRoundRobinSticky(t *testing.T) {
+	resolvers := []*namedTestResolver{
+		{TestResolver: new(TestResolver), name: "r1"},
+		{TestResolver: new(TestResolver), name: "r2"},
+		{TestResolver: new(TestResolver), name: "r3"},
+	}
+	g := NewRoundRobinWithOptions("test-rr-sticky", RoundRobinOptions{Sticky: true}, resolvers[0], resolvers[1], resolvers[2])
+	q := new(dns.Msg)
+	q.SetQuestion("test.com.", dns.TypeA)
+
+	// Every client is sent to the same resolver each time
+	used := make(map[int]struct{})
+	for i := 1; i <= 50; i++ {
+		ci := ClientInfo{SourceIP: net.IPv4(192, 0, 2, byte(i))}
+		before := make([]int, len(resolvers))
+		for j, r := range resolvers {
+			before[j] = r.HitCount()
+		}
+		for k := 0; k < 3; k++ {
+			_, err := g.Resolve(q, ci)
+			require.NoError(t, err)
+		}
+		var hit int
+		for j, r := range resolvers {
+			if n := r.HitCount() - before[j]; n > 0 {
+				require.Equal(t, 3, n)
+				hit++
+				used[j] = struct{}{}
+			}
+		}
+		require.Equal(t, 1, hit)
+	}
+
+	// The clients are spread over all resolvers
+	require.Len(t, used, 3)
+
+	// Clients keep their resolver when one of the others is removed
+	g2 := NewRoundRobinWithOptions("test-rr-sticky-2", RoundRobinOptions{Sticky: true}, resolvers[0], resolvers[1])
+	for i := 1; i <= 50; i++ {
+		ip := net.IPv4(192, 0, 2, byte(i))
+		before := g.resolvers[g.pickSticky(ip)]
+		if before == resolvers[2] {
+			continue
+		}
+		require.Equal(t, before, g2.resolvers[g2.pickSticky(ip)])
+	}
+}
+
+// TestResolver with a name, for groups that tell resolvers apart by name
+type namedTestResolver struct {
+	*TestResolver
+	name string
+}
+
+func (r *namedTestResolver) String() string {
+	return r.name
+}
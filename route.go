@@ -7,6 +7,7 @@ import (
 	"regexp"
 	"strconv"
 	"strings"
+	"sync/atomic"
 	"time"
 
 	"github.com/miekg/dns"
@@ -20,11 +21,17 @@ type route struct {
 	weekdays      []time.Weekday
 	before        *TimeOfDay
 	after         *TimeOfDay
+	schedule      *Schedule
 	inverted      bool // invert the matching behavior
 	dohPath       *regexp.Regexp
 	resolver      Resolver
 	listenerID    *regexp.Regexp
 	tlsServerName *regexp.Regexp
+	tlsClientName *regexp.Regexp
+	conditions    QueryConditions
+
+	// Unix time in nanoseconds until which the route is skipped, 0 if enabled
+	disabledUntil atomic.Int64
 }
 
 // NewRoute initializes a route from string parameters.
@@ -113,6 +120,9 @@ func (r *route) match(q *dns.Msg, ci ClientInfo) bool {
 	if !r.tlsServerName.MatchString(ci.TLSServerName) {
 		return r.inverted
 	}
+	if r.tlsClientName != nil && !matchTLSClientName(r.tlsClientName, ci.TLSClientNames) {
+		return r.inverted
+	}
 	if len(r.weekdays) > 0 || r.before != nil || r.after != nil {
 		now := time.Now().Local()
 		hour := now.Hour()
@@ -137,13 +147,44 @@ func (r *route) match(q *dns.Msg, ci ClientInfo) bool {
 			return r.inverted
 		}
 	}
+	if !r.conditions.match(q) {
+		return r.inverted
+	}
+	if !r.schedule.Active() {
+		return r.inverted
+	}
 	return !r.inverted
 }
 
+// Returns true if the route was disabled at runtime.
+func (r *route) disabled() bool {
+	until := r.disabledUntil.Load()
+	return until != 0 && time.Now().UnixNano() < until
+}
+
 func (r *route) Invert(value bool) {
 	r.inverted = value
 }
 
+// SetSchedule limits the route to the time windows of the schedule. The route
+// matches at any time if the schedule is nil.
+func (r *route) SetSchedule(s *Schedule) {
+	r.schedule = s
+}
+
+// SetTLSClientName limits the route to clients with a verified TLS
+// certificate that has an identity, common name or SAN, matching the regexp.
+// The route matches any client if it's nil.
+func (r *route) SetTLSClientName(re *regexp.Regexp) {
+	r.tlsClientName = re
+}
+
+// SetQueryConditions limits the route to queries with the given flags and
+// EDNS0 options.
+func (r *route) SetQueryConditions(c QueryConditions) {
+	r.conditions = c
+}
+
 func (r *route) String() string {
 	if r.isDefault() {
 		return "(default)"
@@ -175,6 +216,9 @@ func (r *route) String() string {
 	if r.tlsServerName.String() != "" {
 		fragments = append(fragments, "servername="+r.tlsServerName.String())
 	}
+	if r.tlsClientName != nil {
+		fragments = append(fragments, "tls-client-name="+r.tlsClientName.String())
+	}
 	if len(r.weekdays) > 0 {
 		fragments = append(fragments, fmt.Sprintf("weekdays=%v", r.weekdays))
 	}
@@ -184,6 +228,10 @@ func (r *route) String() string {
 	if r.before != nil {
 		fragments = append(fragments, "before="+r.before.String())
 	}
+	if r.schedule != nil {
+		fragments = append(fragments, "schedule=true")
+	}
+	fragments = append(fragments, r.conditions.fragments()...)
 	if r.inverted {
 		fragments = append(fragments, "invert=true")
 	}
@@ -191,7 +239,8 @@ func (r *route) String() string {
 }
 
 func (r *route) isDefault() bool {
-	return r.class == 0 && len(r.types) == 0 && r.name.String() == ""
+	return r.class == 0 && len(r.types) == 0 && r.name.String() == "" && r.schedule == nil &&
+		r.tlsClientName == nil && len(r.conditions.fragments()) == 0
 }
 
 func (r *route) matchType(typ uint16) bool {
@@ -327,3 +376,76 @@ func (t *TimeOfDay) isAfter(hour, minute int) bool {
 func (t *TimeOfDay) String() string {
 	return fmt.Sprintf("%2d:%2d", t.hour, t.minute)
 }
+
+// QueryConditions match on the flags, EDNS0 options and size of a query. The
+// zero value matches all queries.
+type QueryConditions struct {
+	// Match queries with (true) or without (false) the DNSSEC OK bit. Any
+	// query if nil.
+	DO *bool
+
+	// Match queries with (true) or without (false) the Checking Disabled
+	// flag. Any query if nil.
+	CD *bool
+
+	// Codes of EDNS0 options that have to be present in the query, for
+	// example 8 for client subnet or 10 for cookies.
+	EDNS0Options []uint16
+
+	// Limits of the query size in bytes in wire format. Not limited if 0.
+	MinSize, MaxSize int
+}
+
+func (c QueryConditions) match(q *dns.Msg) bool {
+	edns0 := q.IsEdns0()
+	if c.DO != nil && *c.DO != (edns0 != nil && edns0.Do()) {
+		return false
+	}
+	if c.CD != nil && *c.CD != q.CheckingDisabled {
+		return false
+	}
+	for _, code := range c.EDNS0Options {
+		if !hasEDNS0Option(edns0, code) {
+			return false
+		}
+	}
+	if c.MinSize > 0 || c.MaxSize > 0 {
+		size := q.Len()
+		if size < c.MinSize || (c.MaxSize > 0 && size > c.MaxSize) {
+			return false
+		}
+	}
+	return true
+}
+
+func (c QueryConditions) fragments() []string {
+	var fragments []string
+	if c.DO != nil {
+		fragments = append(fragments, fmt.Sprintf("do=%t", *c.DO))
+	}
+	if c.CD != nil {
+		fragments = append(fragments, fmt.Sprintf("cd=%t", *c.CD))
+	}
+	if len(c.EDNS0Options) > 0 {
+		fragments = append(fragments, fmt.Sprintf("edns0-options=%v", c.EDNS0Options))
+	}
+	if c.MinSize > 0 {
+		fragments = append(fragments, fmt.Sprintf("min-size=%d", c.MinSize))
+	}
+	if c.MaxSize > 0 {
+		fragments = append(fragments, fmt.Sprintf("max-size=%d", c.MaxSize))
+	}
+	return fragments
+}
+
+func hasEDNS0Option(edns0 *dns.OPT, code uint16) bool {
+	if edns0 == nil {
+		return false
+	}
+	for _, opt := range edns0.Option {
+		if opt.Option() == code {
+			return true
+		}
+	}
+	return false
+}
@@ -1,6 +1,7 @@
 package rdns
 
 import (
+	"net"
 	"testing"
 
 	"github.com/miekg/dns"
@@ -91,3 +92,48 @@ func TestRoute(t *testing.T) {
 		require.Equal(t, test.match, match)
 	}
 }
+
+func TestRouteQueryConditions(t *testing.T) {
+	yes, no := true, false
+	query := func(do, cd bool, opts ...dns.EDNS0) *dns.Msg {
+		q := new(dns.Msg)
+		q.SetQuestion("example.com.", dns.TypeA)
+		q.CheckingDisabled = cd
+		if do || len(opts) > 0 {
+			q.SetEdns0(4096, do)
+			edns0 := q.IsEdns0()
+			edns0.Option = append(edns0.Option, opts...)
+		}
+		return q
+	}
+	ecs := &dns.EDNS0_SUBNET{Code: dns.EDNS0SUBNET, Family: 1, SourceNetmask: 24, Address: net.ParseIP("192.0.2.0").To4()}
+	cookie := &dns.EDNS0_COOKIE{Code: dns.EDNS0COOKIE, Cookie: "0102030405060708"}
+
+	tests := []struct {
+		conditions QueryConditions
+		q          *dns.Msg
+		match      bool
+	}{
+		{QueryConditions{}, query(false, false), true},
+		{QueryConditions{DO: &yes}, query(true, false), true},
+		{QueryConditions{DO: &yes}, query(false, false), false},
+		{QueryConditions{DO: &no}, query(false, false), true},
+		{QueryConditions{DO: &no}, query(true, false), false},
+		{QueryConditions{CD: &yes}, query(false, true), true},
+		{QueryConditions{CD: &yes}, query(false, false), false},
+		{QueryConditions{EDNS0Options: []uint16{dns.EDNS0SUBNET}}, query(false, false, ecs), true},
+		{QueryConditions{EDNS0Options: []uint16{dns.EDNS0SUBNET}}, query(false, false, cookie), false},
+		{QueryConditions{EDNS0Options: []uint16{dns.EDNS0SUBNET, dns.EDNS0COOKIE}}, query(false, false, ecs, cookie), true},
+		{QueryConditions{EDNS0Options: []uint16{dns.EDNS0COOKIE}}, query(false, false), false},
+		{QueryConditions{MinSize: 40}, query(false, false), false},
+		{QueryConditions{MinSize: 40}, query(true, false, cookie), true},
+		{QueryConditions{MaxSize: 40}, query(false, false), true},
+		{QueryConditions{MaxSize: 40}, query(true, false, cookie), false},
+	}
+	for i, test := range tests {
+		r, err := NewRoute("", "", nil, nil, "", "", "", "", "", "", &TestResolver{})
+		require.NoError(t, err)
+		r.SetQueryConditions(test.conditions)
+		require.Equal(t, test.match, r.match(test.q, ClientInfo{}), "test %d", i)
+	}
+}
@@ -4,6 +4,8 @@ import (
 	"errors"
 	"expvar"
 	"fmt"
+	"math"
+	"time"
 
 	"github.com/miekg/dns"
 	"github.com/sirupsen/logrus"
@@ -54,7 +56,7 @@ func (r *Router) Resolve(q *dns.Msg, ci ClientInfo) (*dns.Msg, error) {
 	question := q.Question[0]
 	log := logger(r.id, q, ci)
 	for _, route := range r.routes {
-		if !route.match(q, ci) {
+		if route.disabled() || !route.match(q, ci) {
 			continue
 		}
 		log.WithFields(logrus.Fields{
@@ -82,6 +84,58 @@ func (r *Router) Add(routes ...*route) {
 	r.metrics.available.Add(1)
 }
 
+// RouteStatus describes a route of a router.
+type RouteStatus struct {
+	Route    string `json:"route"`
+	Resolver string `json:"resolver"`
+
+	// Set if the route is disabled, zero if disabled until enabled again.
+	DisabledUntil *time.Time `json:"disabled-until,omitempty"`
+}
+
+// Routes returns the routes of the router in the order they're evaluated.
+func (r *Router) Routes() []RouteStatus {
+	routes := make([]RouteStatus, 0, len(r.routes))
+	for _, route := range r.routes {
+		status := RouteStatus{Route: route.String(), Resolver: route.resolver.String()}
+		if route.disabled() {
+			var until time.Time
+			if n := route.disabledUntil.Load(); n != math.MaxInt64 {
+				until = time.Unix(0, n)
+			}
+			status.DisabledUntil = &until
+		}
+		routes = append(routes, status)
+	}
+	return routes
+}
+
+// DisableRoute skips the route with the given index for a period of time, or
+// until it is enabled again if the duration is 0. Queries that would have
+// matched it are evaluated against the following routes instead.
+func (r *Router) DisableRoute(index int, d time.Duration) error {
+	if index < 0 || index >= len(r.routes) {
+		return fmt.Errorf("route %d not found in %q", index, r.id)
+	}
+	until := int64(math.MaxInt64)
+	if d > 0 {
+		until = time.Now().Add(d).UnixNano()
+	}
+	r.routes[index].disabledUntil.Store(until)
+	Log.WithFields(logrus.Fields{"id": r.id, "route": r.routes[index].String(), "duration": d}).Info("disabled route")
+	return nil
+}
+
+// EnableRoute enables a route that was disabled with DisableRoute.
+func (r *Router) EnableRoute(index int) error {
+	if index < 0 || index >= len(r.routes) {
+		return fmt.Errorf("route %d not found in %q", index, r.id)
+	}
+	r.routes[index].disabledUntil.Store(0)
+	Log.WithFields(logrus.Fields{"id": r.id, "route": r.routes[index].String()}).Info("enabled route")
+	return nil
+}
+
 func (r *Router) String() string {
 	return r.id
 }
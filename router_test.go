@@ -2,7 +2,9 @@ package rdns
 
 import (
 	"net"
+	"regexp"
 	"testing"
+	"time"
 
 	"github.com/miekg/dns"
 	"github.com/stretchr/testify/require"
@@ -56,7 +58,7 @@ func TestRouterClass(t *testing.T) {
 
 	// ClassAny should go to r1
 	q.Question = make([]dns.Question, 1)
-	q.Question[0] = dns.Question{"miek.nl.", dns.TypeMX, dns.ClassANY}
+	q.Question[0] = dns.Question{Name: "miek.nl.", Qtype: dns.TypeMX, Qclass: dns.ClassANY}
 	_, err = router.Resolve(q, ci)
 	require.NoError(t, err)
 	require.Equal(t, 1, r1.HitCount())
@@ -114,3 +116,113 @@ func TestRouterSource(t *testing.T) {
 	require.Equal(t, 1, r1.HitCount())
 	require.Equal(t, 1, r2.HitCount())
 }
+
+func TestRouterDisableRoute(t *testing.T) {
+	r1 := new(TestResolver)
+	r2 := new(TestResolver)
+	q := new(dns.Msg)
+	q.SetQuestion("acme.test.", dns.TypeA)
+	var ci ClientInfo
+
+	route1, _ := NewRoute("", "", nil, nil, "", "", "", "", "", "", r1)
+	route2, _ := NewRoute("", "", nil, nil, "", "", "", "", "", "", r2)
+	router := NewRouter("my-router")
+	router.Add(route1, route2)
+
+	// Disabled route is skipped until enabled again
+	require.NoError(t, router.DisableRoute(0, 0))
+	_, err := router.Resolve(q, ci)
+	require.NoError(t, err)
+	require.Equal(t, 0, r1.HitCount())
+	require.Equal(t, 1, r2.HitCount())
+	routes := router.Routes()
+	require.NotNil(t, routes[0].DisabledUntil)
+	require.True(t, routes[0].DisabledUntil.IsZero())
+	require.Nil(t, routes[1].DisabledUntil)
+
+	require.NoError(t, router.EnableRoute(0))
+	_, err = router.Resolve(q, ci)
+	require.NoError(t, err)
+	require.Equal(t, 1, r1.HitCount())
+
+	// Disabled for a period of time
+	require.NoError(t, router.DisableRoute(0, 50*time.Millisecond))
+	_, err = router.Resolve(q, ci)
+	require.NoError(t, err)
+	require.Equal(t, 1, r1.HitCount())
+	time.Sleep(60 * time.Millisecond)
+	_, err = router.Resolve(q, ci)
+	require.NoError(t, err)
+	require.Equal(t, 2, r1.HitCount())
+
+	require.Error(t, router.DisableRoute(2, 0))
+}
+
+func TestRouterSchedule(t *testing.T) {
+	r1 := new(TestResolver)
+	r2 := new(TestResolver)
+	q := new(dns.Msg)
+	q.SetQuestion("game.test.", dns.TypeA)
+	var ci ClientInfo
+
+	// School nights, crossing midnight
+	window, err := NewScheduleWindow([]string{"sun", "mon", "tue", "wed", "thu"}, "21:00", "07:00")
+	require.NoError(t, err)
+	schedule := NewSchedule(time.UTC, window)
+
+	route1, err := NewRoute("", "", nil, nil, "", "", "", "", "", "", r1)
+	require.NoError(t, err)
+	route1.SetSchedule(schedule)
+	route2, err := NewRoute("", "", nil, nil, "", "", "", "", "", "", r2)
+	require.NoError(t, err)
+	router := NewRouter("my-router")
+	router.Add(route1, route2)
+
+	tests := []struct {
+		now      time.Time
+		expected *TestResolver
+	}{
+		{time.Date(2024, 5, 12, 22, 30, 0, 0, time.UTC), r1}, // Sunday night
+		{time.Date(2024, 5, 13, 6, 59, 0, 0, time.UTC), r1},  // Monday morning
+		{time.Date(2024, 5, 13, 7, 0, 0, 0, time.UTC), r2},   // Monday after the window
+		{time.Date(2024, 5, 17, 22, 30, 0, 0, time.UTC), r2}, // Friday night
+		{time.Date(2024, 5, 18, 1, 0, 0, 0, time.UTC), r2},   // Saturday morning
+	}
+	for _, test := range tests {
+		now := test.now
+		schedule.now = func() time.Time { return now }
+		before := test.expected.HitCount()
+		_, err := router.Resolve(q, ci)
+		require.NoError(t, err)
+		require.Equal(t, before+1, test.expected.HitCount(), "time: %s", now)
+	}
+}
+
+func TestRouterTLSClientName(t *testing.T) {
+	r1 := new(TestResolver)
+	r2 := new(TestResolver)
+	q := new(dns.Msg)
+	q.SetQuestion("example.com.", dns.TypeA)
+
+	route1, err := NewRoute("", "", nil, nil, "", "", "", "", "", "", r1)
+	require.NoError(t, err)
+	route1.SetTLSClientName(regexp.MustCompile(`^(laptop|phone)\.alice\.example$`))
+	route2, err := NewRoute("", "", nil, nil, "", "", "", "", "", "", r2)
+	require.NoError(t, err)
+	router := NewRouter("my-router")
+	router.Add(route1, route2)
+
+	// Any identity in the certificate can match
+	_, err = router.Resolve(q, ClientInfo{TLSClientNames: []string{"Alice", "phone.alice.example"}})
+	require.NoError(t, err)
+	require.Equal(t, 1, r1.HitCount())
+
+	_, err = router.Resolve(q, ClientInfo{TLSClientNames: []string{"tv.bob.example"}})
+	require.NoError(t, err)
+	require.Equal(t, 1, r2.HitCount())
+
+	// Clients without a certificate don't match
+	_, err = router.Resolve(q, ClientInfo{SourceIP: net.ParseIP("192.0.2.1")})
+	require.NoError(t, err)
+	require.Equal(t, 2, r2.HitCount())
+}
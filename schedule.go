@@ -0,0 +1,119 @@
+package rdns
+
+import (
+	"fmt"
+	"time"
+)
+
+// Schedule is a set of weekly time windows. It's considered active if the current
+// time falls into at least one of the windows.
+type Schedule struct {
+	windows  []ScheduleWindow
+	location *time.Location
+
+	// Returns the current time, can be replaced in tests
+	now func() time.Time
+}
+
+// ScheduleWindow is a time window on specific weekdays. Windows with a start
+// time after the end time cross midnight and end on the following day. If start
+// and end are the same, the window covers the whole day.
+type ScheduleWindow struct {
+	weekdays   []time.Weekday
+	start, end int // Minutes since midnight
+}
+
+// NewScheduleWindow returns a window between start and end, in "HH:MM" format,
+// on the given weekdays ("mon", "tue", ..). Applies to every day if no weekdays
+// are provided.
+func NewScheduleWindow(weekdays []string, start, end string) (ScheduleWindow, error) {
+	w, err := stringsToWeekdays(weekdays)
+	if err != nil {
+		return ScheduleWindow{}, err
+	}
+	s, err := parseScheduleTime(start)
+	if err != nil {
+		return ScheduleWindow{}, err
+	}
+	e, err := parseScheduleTime(end)
+	if err != nil {
+		return ScheduleWindow{}, err
+	}
+	return ScheduleWindow{weekdays: w, start: s, end: e}, nil
+}
+
+// NewSchedule returns a schedule made up of the windows. Times are evaluated in
+// the given location, or the local timezone if nil.
+func NewSchedule(location *time.Location, windows ...ScheduleWindow) *Schedule {
+	if location == nil {
+		location = time.Local
+	}
+	return &Schedule{
+		windows:  windows,
+		location: location,
+		now:      time.Now,
+	}
+}
+
+// Active returns true if the current time is inside any of the windows. A nil
+// schedule is always active.
+func (s *Schedule) Active() bool {
+	if s == nil {
+		return true
+	}
+	now := s.now().In(s.location)
+	for _, w := range s.windows {
+		if w.contains(now) {
+			return true
+		}
+	}
+	return false
+}
+
+func (w ScheduleWindow) contains(t time.Time) bool {
+	minute := t.Hour()*60 + t.Minute()
+	weekday := t.Weekday()
+	switch {
+	case w.start == w.end:
+		return w.onDay(weekday)
+	case w.start < w.end:
+		return w.onDay(weekday) && minute >= w.start && minute < w.end
+	default:
+		// Crosses midnight, the early part of the day belongs to a window that
+		// started the day before.
+		if minute >= w.start {
+			return w.onDay(weekday)
+		}
+		if minute < w.end {
+			return w.onDay((weekday + 6) % 7)
+		}
+		return false
+	}
+}
+
+func (w ScheduleWindow) onDay(day time.Weekday) bool {
+	if len(w.weekdays) == 0 {
+		return true
+	}
+	for _, wd := range w.weekdays {
+		if wd == day {
+			return true
+		}
+	}
+	return false
+}
+
+// Parse a time in "HH:MM" format and return the minutes since midnight.
+func parseScheduleTime(s string) (int, error) {
+	t, err := parseTimeOfDay(s)
+	if err != nil {
+		return 0, fmt.Errorf("invalid time %q: %w", s, err)
+	}
+	if t == nil {
+		return 0, fmt.Errorf("missing start or end time in schedule")
+	}
+	if t.hour < 0 || t.hour > 23 || t.minute < 0 || t.minute > 59 {
+		return 0, fmt.Errorf("invalid time %q", s)
+	}
+	return t.hour*60 + t.minute, nil
+}
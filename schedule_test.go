@@ -0,0 +1,63 @@
+package rdns
+
+import (
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/require"
+)
+
+func TestScheduleWindow(t *testing.T) {
+	// Fri 21:00 to Sat 07:00 and every day 12:00-13:00
+	night, err := NewScheduleWindow([]string{"fri"}, "21:00", "07:00")
+	require.NoError(t, err)
+	lunch, err := NewScheduleWindow(nil, "12:00", "13:00")
+	require.NoError(t, err)
+	s := NewSchedule(time.UTC, night, lunch)
+
+	tests := []struct {
+		time   string
+		active bool
+	}{
+		{"2024-05-10T20:59:00Z", false}, // Fri
+		{"2024-05-10T21:00:00Z", true},  // Fri
+		{"2024-05-10T23:59:00Z", true},  // Fri
+		{"2024-05-11T00:00:00Z", true},  // Sat, after midnight
+		{"2024-05-11T06:59:00Z", true},  // Sat
+		{"2024-05-11T07:00:00Z", false}, // Sat, end is exclusive
+		{"2024-05-11T21:30:00Z", false}, // Sat evening, not in the window
+		{"2024-05-10T06:00:00Z", false}, // Fri morning, window starts on Friday
+		{"2024-05-13T12:30:00Z", true},  // Mon lunch
+		{"2024-05-13T13:00:00Z", false}, // Mon
+	}
+	for _, test := range tests {
+		now, err := time.Parse(time.RFC3339, test.time)
+		require.NoError(t, err)
+		s.now = func() time.Time { return now }
+		require.Equal(t, test.active, s.Active(), test.time)
+	}
+}
+
+func TestScheduleTimezone(t *testing.T) {
+	loc := time.FixedZone("UTC+10", 10*60*60)
+	w, err := NewScheduleWindow([]string{"mon"}, "08:00", "09:00")
+	require.NoError(t, err)
+	s := NewSchedule(loc, w)
+
+	// Sun 22:30 UTC is Mon 08:30 in UTC+10
+	s.now = func() time.Time { return time.Date(2024, 5, 12, 22, 30, 0, 0, time.UTC) }
+	require.True(t, s.Active())
+
+	// Mon 08:30 UTC is outside the window
+	s.now = func() time.Time { return time.Date(2024, 5, 13, 8, 30, 0, 0, time.UTC) }
+	require.False(t, s.Active())
+}
+
+func TestScheduleWindowInvalid(t *testing.T) {
+	_, err := NewScheduleWindow([]string{"monday"}, "08:00", "09:00")
+	require.Error(t, err)
+	_, err = NewScheduleWindow(nil, "24:00", "09:00")
+	require.Error(t, err)
+	_, err = NewScheduleWindow(nil, "08:00", "")
+	require.Error(t, err)
+}
@@ -0,0 +1,442 @@
+package rdns
+
+import (
+	"bytes"
+	"errors"
+	"expvar"
+	"fmt"
+	"net"
+	"regexp"
+	"strconv"
+	"strings"
+	"text/template"
+	"text/template/parse"
+
+	"github.com/miekg/dns"
+)
+
+// Script is a resolver that runs scripts to decide what to do with a query
+// and its response. Scripts are templates (text/template) with access to the
+// query, the client and the response, rather than code in an embedded
+// language like Lua or CEL, to avoid the dependency. Their output is a list of
+// commands, one per line, that block or drop the query, route it to another
+// resolver, or modify the response. This allows policies that can't be
+// expressed with the other elements without changing the code.
+type Script struct {
+	id       string
+	resolver Resolver
+	ScriptOptions
+	query    *template.Template
+	response *template.Template
+	actions  *expvar.Map
+}
+
+var _ Resolver = &Script{}
+
+type ScriptOptions struct {
+	// Script run for every query before it is forwarded. Optional.
+	Query string
+
+	// Script run for every response from the resolver. Optional.
+	Response string
+
+	// Resolvers the scripts can route queries to, by ID.
+	Resolvers map[string]Resolver
+}
+
+// Data available to scripts.
+type scriptInput struct {
+	ID            uint16
+	Question      string
+	QuestionClass string
+	QuestionType  string
+
+	// Client information
+	Client         string
+	Listener       string
+	DoHPath        string
+	TLSServerName  string
+	TLSClientNames []string
+
+	// Response, only set in response scripts
+	Rcode  string
+	Answer []string // Answer records in text format
+	IPs    []string // Addresses in A and AAAA records of the answer
+}
+
+// Outcome of a script.
+type scriptResult struct {
+	action string // Command that ends processing, "" to continue
+	route  string // Resolver for "route"
+	maxTTL *uint32
+	ede    *dns.EDNS0_EDE
+}
+
+// Commands a script can output. All but max-ttl and ede end the script and
+// decide the response.
+const (
+	scriptPass     = "pass"
+	scriptBlock    = "block"
+	scriptNoData   = "nodata"
+	scriptRefuse   = "refuse"
+	scriptServfail = "servfail"
+	scriptDrop     = "drop"
+	scriptRoute    = "route"
+	scriptMaxTTL   = "max-ttl"
+	scriptEDE      = "ede"
+)
+
+// Functions available to scripts in addition to those of other templates.
+var scriptFuncs = template.FuncMap{
+	"lower":     strings.ToLower,
+	"hasPrefix": strings.HasPrefix,
+	"hasSuffix": strings.HasSuffix,
+	"contains":  strings.Contains,
+	"match":     scriptMatchFunc(nil),
+	"inNet":     scriptInNet,
+}
+
+// NewScript returns a new instance of a script resolver.
+func NewScript(id string, resolver Resolver, opt ScriptOptions) (*Script, error) {
+	if opt.Query == "" && opt.Response == "" {
+		return nil, errors.New("no query or response script")
+	}
+	r := &Script{
+		id:            id,
+		resolver:      resolver,
+		ScriptOptions: opt,
+		actions:       getVarMap("router", id, "action"),
+	}
+	var err error
+	if opt.Query != "" {
+		if r.query, err = parseScript("query", opt.Query); err != nil {
+			return nil, err
+		}
+	}
+	if opt.Response != "" {
+		if r.response, err = parseScript("response", opt.Response); err != nil {
+			return nil, err
+		}
+	}
+	return r, nil
+}
+
+func parseScript(name, text string) (*template.Template, error) {
+	t, err := template.New(name).Funcs(templateFuncs).Funcs(scriptFuncs).Parse(text)
+	if err != nil {
+		return nil, fmt.Errorf("failed to parse %s script: %w", name, err)
+	}
+
+	// Compile the constant expressions used with match once
+	regexps := make(map[string]*regexp.Regexp)
+	for _, tmpl := range t.Templates() {
+		if tmpl.Tree == nil {
+			continue
+		}
+		if err := scriptRegexps(tmpl.Tree.Root, regexps); err != nil {
+			return nil, fmt.Errorf("failed to parse %s script: %w", name, err)
+		}
+	}
+	return t.Funcs(template.FuncMap{"match": scriptMatchFunc(regexps)}), nil
+}
+
+// Compiles the expressions given as string constants to match in the nodes
+// and adds them to the map.
+func scriptRegexps(node parse.Node, regexps map[string]*regexp.Regexp) error {
+	switch n := node.(type) {
+	case *parse.ListNode:
+		if n == nil {
+			return nil
+		}
+		for _, c := range n.Nodes {
+			if err := scriptRegexps(c, regexps); err != nil {
+				return err
+			}
+		}
+	case *parse.ActionNode:
+		return scriptRegexps(n.Pipe, regexps)
+	case *parse.IfNode:
+		return scriptRegexpsBranch(&n.BranchNode, regexps)
+	case *parse.RangeNode:
+		return scriptRegexpsBranch(&n.BranchNode, regexps)
+	case *parse.WithNode:
+		return scriptRegexpsBranch(&n.BranchNode, regexps)
+	case *parse.TemplateNode:
+		return scriptRegexps(n.Pipe, regexps)
+	case *parse.PipeNode:
+		if n == nil {
+			return nil
+		}
+		for _, cmd := range n.Cmds {
+			if err := scriptRegexps(cmd, regexps); err != nil {
+				return err
+			}
+		}
+	case *parse.CommandNode:
+		if len(n.Args) > 1 {
+			fn, ok := n.Args[0].(*parse.IdentifierNode)
+			expr, isString := n.Args[1].(*parse.StringNode)
+			if ok && isString && fn.Ident == "match" {
+				re, err := regexp.Compile(expr.Text)
+				if err != nil {
+					return err
+				}
+				regexps[expr.Text] = re
+			}
+		}
+		for _, arg := range n.Args {
+			if err := scriptRegexps(arg, regexps); err != nil {
+				return err
+			}
+		}
+	}
+	return nil
+}
+
+func scriptRegexpsBranch(n *parse.BranchNode, regexps map[string]*regexp.Regexp) error {
+	for _, node := range []parse.Node{n.Pipe, n.List, n.ElseList} {
+		if err := scriptRegexps(node, regexps); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// Resolve a DNS query by running the query script, forwarding the query if
+// the script doesn't decide the response, and then running the response script.
+func (r *Script) Resolve(q *dns.Msg, ci ClientInfo) (*dns.Msg, error) {
+	log := logger(r.id, q, ci)
+
+	var res scriptResult
+	if r.query != nil {
+		var err error
+		res, err = r.run(r.query, newScriptInput(q, ci, nil))
+		if err != nil {
+			return nil, err
+		}
+	}
+	resolver := r.resolver
+	switch res.action {
+	case "", scriptPass:
+	case scriptRoute:
+		if resolver = r.Resolvers[res.route]; resolver == nil {
+			return nil, fmt.Errorf("script routes to unknown resolver '%s'", res.route)
+		}
+	default:
+		log.WithField("action", res.action).Debug("query script decided the response")
+		return res.apply(q, r.respond(q, res.action)), nil
+	}
+
+	log.WithField("resolver", resolver.String()).Debug("forwarding query to resolver")
+	a, err := resolver.Resolve(q, ci)
+	if err != nil || a == nil {
+		return a, err
+	}
+	if r.response != nil {
+		responseRes, err := r.run(r.response, newScriptInput(q, ci, a))
+		if err != nil {
+			return nil, err
+		}
+		res = res.merge(responseRes)
+		switch responseRes.action {
+		case "", scriptPass:
+		case scriptRoute:
+			if resolver = r.Resolvers[responseRes.route]; resolver == nil {
+				return nil, fmt.Errorf("script routes to unknown resolver '%s'", responseRes.route)
+			}
+			log.WithField("resolver", resolver.String()).Debug("response script routed query to resolver")
+			if a, err = resolver.Resolve(q, ci); err != nil || a == nil {
+				return a, err
+			}
+		default:
+			log.WithField("action", responseRes.action).Debug("response script replaced the response")
+			a = r.respond(q, responseRes.action)
+		}
+	}
+	return res.apply(q, a), nil
+}
+
+func (r *Script) String() string {
+	return r.id
+}
+
+// Run a script and parse its output.
+func (r *Script) run(t *template.Template, in scriptInput) (scriptResult, error) {
+	var out bytes.Buffer
+	if err := t.Execute(&out, in); err != nil {
+		r.actions.Add("error", 1)
+		return scriptResult{}, fmt.Errorf("failed to run %s script: %w", t.Name(), err)
+	}
+	res, err := parseScriptOutput(out.String())
+	if err != nil {
+		r.actions.Add("error", 1)
+		return scriptResult{}, fmt.Errorf("invalid output of %s script: %w", t.Name(), err)
+	}
+	action := res.action
+	if action == "" {
+		action = scriptPass
+	}
+	r.actions.Add(action, 1)
+	return res, nil
+}
+
+// Returns the response for a command that replaces it, nil to drop the query.
+func (r *Script) respond(q *dns.Msg, action string) *dns.Msg {
+	switch action {
+	case scriptBlock:
+		return responseWithCode(q, dns.RcodeNameError)
+	case scriptRefuse:
+		return responseWithCode(q, dns.RcodeRefused)
+	case scriptServfail:
+		return responseWithCode(q, dns.RcodeServerFailure)
+	case scriptNoData:
+		a := new(dns.Msg)
+		a.SetReply(q)
+		return a
+	}
+	return nil
+}
+
+func newScriptInput(q *dns.Msg, ci ClientInfo, a *dns.Msg) scriptInput {
+	var question dns.Question
+	if len(q.Question) > 0 {
+		question = q.Question[0]
+	}
+	in := scriptInput{
+		ID:             q.Id,
+		Question:       question.Name,
+		QuestionClass:  dns.ClassToString[question.Qclass],
+		QuestionType:   dns.TypeToString[question.Qtype],
+		Listener:       ci.Listener,
+		DoHPath:        ci.DoHPath,
+		TLSServerName:  ci.TLSServerName,
+		TLSClientNames: ci.TLSClientNames,
+	}
+	if ci.SourceIP != nil {
+		in.Client = ci.SourceIP.String()
+	}
+	if a != nil {
+		in.Rcode = dns.RcodeToString[a.Rcode]
+		for _, rr := range a.Answer {
+			in.Answer = append(in.Answer, rr.String())
+			switch rr := rr.(type) {
+			case *dns.A:
+				in.IPs = append(in.IPs, rr.A.String())
+			case *dns.AAAA:
+				in.IPs = append(in.IPs, rr.AAAA.String())
+			}
+		}
+	}
+	return in
+}
+
+// Parse the commands in the output of a script. Empty lines are ignored.
+func parseScriptOutput(out string) (scriptResult, error) {
+	var res scriptResult
+	for _, line := range strings.Split(out, "\n") {
+		fields := strings.Fields(line)
+		if len(fields) == 0 {
+			continue
+		}
+		cmd, args := fields[0], fields[1:]
+		switch cmd {
+		case scriptMaxTTL:
+			if len(args) != 1 {
+				return res, fmt.Errorf("expected '%s <seconds>'", cmd)
+			}
+			ttl, err := strconv.ParseUint(args[0], 10, 32)
+			if err != nil {
+				return res, fmt.Errorf("invalid ttl '%s'", args[0])
+			}
+			v := uint32(ttl)
+			res.maxTTL = &v
+			continue
+		case scriptEDE:
+			if len(args) < 1 {
+				return res, fmt.Errorf("expected '%s <code> [<text>]'", cmd)
+			}
+			code, err := strconv.ParseUint(args[0], 10, 16)
+			if err != nil {
+				return res, fmt.Errorf("invalid ede code '%s'", args[0])
+			}
+			res.ede = &dns.EDNS0_EDE{InfoCode: uint16(code), ExtraText: strings.Join(args[1:], " ")}
+			continue
+		case scriptPass, scriptBlock, scriptNoData, scriptRefuse, scriptServfail, scriptDrop:
+			if len(args) != 0 {
+				return res, fmt.Errorf("unexpected arguments for '%s'", cmd)
+			}
+		case scriptRoute:
+			if len(args) != 1 {
+				return res, fmt.Errorf("expected '%s <resolver>'", cmd)
+			}
+		default:
+			return res, fmt.Errorf("unknown command '%s'", cmd)
+		}
+		// The first command that decides the response wins
+		if res.action == "" {
+			res.action = cmd
+			if cmd == scriptRoute {
+				res.route = args[0]
+			}
+		}
+	}
+	return res, nil
+}
+
+// Combines the modifications of the query and response scripts, the response
+// script takes precedence.
+func (res scriptResult) merge(other scriptResult) scriptResult {
+	if other.maxTTL != nil {
+		res.maxTTL = other.maxTTL
+	}
+	if other.ede != nil {
+		res.ede = other.ede
+	}
+	return res
+}
+
+// Apply the modifications of the scripts to the response.
+func (res scriptResult) apply(q, a *dns.Msg) *dns.Msg {
+	if a == nil {
+		return nil
+	}
+	if res.maxTTL != nil {
+		for _, section := range [][]dns.RR{a.Answer, a.Ns, a.Extra} {
+			for _, rr := range section {
+				if h := rr.Header(); h.Rrtype != dns.TypeOPT && h.Ttl > *res.maxTTL {
+					h.Ttl = *res.maxTTL
+				}
+			}
+		}
+	}
+	if res.ede != nil {
+		addEDE(a, q, res.ede.InfoCode, res.ede.ExtraText)
+	}
+	return a
+}
+
+// Returns the match function of a script, which checks if a string matches a
+// regular expression. Constant expressions are compiled when the script is
+// parsed, others every time they're used so they don't accumulate.
+func scriptMatchFunc(regexps map[string]*regexp.Regexp) func(expr, s string) (bool, error) {
+	return func(expr, s string) (bool, error) {
+		re, ok := regexps[expr]
+		if !ok {
+			var err error
+			if re, err = regexp.Compile(expr); err != nil {
+				return false, err
+			}
+		}
+		return re.MatchString(s), nil
+	}
+}
+
+// Returns true if the IP is in the network, given in CIDR notation.
+func scriptInNet(network, ip string) (bool, error) {
+	_, n, err := net.ParseCIDR(network)
+	if err != nil {
+		return false, err
+	}
+	addr := net.ParseIP(ip)
+	return addr != nil && n.Contains(addr), nil
+}
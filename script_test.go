@@ -0,0 +1,137 @@
+package rdns
+
+import (
+	"net"
+	"regexp"
+	"testing"
+
+	"github.com/miekg/dns"
+	"github.com/stretchr/testify/require"
+)
+
+func TestScript(t *testing.T) {
+	upstream := &TestResolver{
+		ResolveFunc: func(q *dns.Msg, ci ClientInfo) (*dns.Msg, error) {
+			a := new(dns.Msg)
+			a.SetReply(q)
+			switch q.Question[0].Name {
+			case "private.example.com.":
+				a.Answer = []dns.RR{mustRR(t, "private.example.com. 3600 IN A 10.0.0.1")}
+			default:
+				a.Answer = []dns.RR{mustRR(t, q.Question[0].Name+" 3600 IN A 192.0.2.1")}
+			}
+			return a, nil
+		},
+	}
+	internal := new(TestResolver)
+	s, err := NewScript("test-script", upstream, ScriptOptions{
+		Query: `
+{{- if hasSuffix .Question "corp.example.com." }}route internal{{ end }}
+{{- if and (eq .QuestionType "ANY") (not (inNet "192.168.0.0/16" .Client)) }}refuse{{ end }}
+{{- if match "^ads[0-9]*\\." .Question }}block
+ede 15 blocked by script{{ end }}
+{{- if eq .Question "drop.example.com." }}drop{{ end }}`,
+		Response: `
+{{- range .IPs }}{{ if inNet "10.0.0.0/8" . }}nodata{{ end }}{{ end }}
+max-ttl 300`,
+		Resolvers: map[string]Resolver{"internal": internal},
+	})
+	require.NoError(t, err)
+
+	resolve := func(name string, qtype uint16, ip string) *dns.Msg {
+		q := new(dns.Msg)
+		q.SetQuestion(name, qtype)
+		q.SetEdns0(4096, false)
+		a, err := s.Resolve(q, ClientInfo{SourceIP: net.ParseIP(ip)})
+		require.NoError(t, err)
+		return a
+	}
+
+	// Passed through, with the response script limiting the TTL
+	a := resolve("www.example.com.", dns.TypeA, "192.0.2.100")
+	require.Len(t, a.Answer, 1)
+	require.Equal(t, uint32(300), a.Answer[0].Header().Ttl)
+
+	// Routed to another resolver
+	_ = resolve("host.corp.example.com.", dns.TypeA, "192.0.2.100")
+	require.Equal(t, 1, internal.HitCount())
+
+	// Refused for some clients only
+	a = resolve("www.example.com.", dns.TypeANY, "192.0.2.100")
+	require.Equal(t, dns.RcodeRefused, a.Rcode)
+	a = resolve("www.example.com.", dns.TypeANY, "192.168.1.1")
+	require.Equal(t, dns.RcodeSuccess, a.Rcode)
+
+	// Blocked with an extended error
+	a = resolve("ads1.example.com.", dns.TypeA, "192.0.2.100")
+	require.Equal(t, dns.RcodeNameError, a.Rcode)
+	require.Len(t, a.IsEdns0().Option, 1)
+	ede := a.IsEdns0().Option[0].(*dns.EDNS0_EDE)
+	require.Equal(t, dns.ExtendedErrorCodeBlocked, ede.InfoCode)
+	require.Equal(t, "blocked by script", ede.ExtraText)
+
+	// Dropped
+	a = resolve("drop.example.com.", dns.TypeA, "192.0.2.100")
+	require.Nil(t, a)
+
+	// Response replaced based on the addresses in the answer
+	a = resolve("private.example.com.", dns.TypeA, "192.0.2.100")
+	require.Equal(t, dns.RcodeSuccess, a.Rcode)
+	require.Empty(t, a.Answer)
+}
+
+func TestScriptErrors(t *testing.T) {
+	_, err := NewScript("test-script-empty", new(TestResolver), ScriptOptions{})
+	require.Error(t, err)
+
+	_, err = NewScript("test-script-syntax", new(TestResolver), ScriptOptions{Query: "{{ if }}"})
+	require.Error(t, err)
+
+	// Constant regular expressions are checked when the script is parsed
+	_, err = NewScript("test-script-regexp", new(TestResolver), ScriptOptions{Query: `{{ if match "(" .Question }}block{{ end }}`})
+	require.Error(t, err)
+
+	q := new(dns.Msg)
+	q.SetQuestion("example.com.", dns.TypeA)
+	for _, script := range []string{
+		"unknown-command",
+		"route missing",
+		"max-ttl abc",
+		"block now",
+	} {
+		s, err := NewScript("test-script-output", new(TestResolver), ScriptOptions{Query: script})
+		require.NoError(t, err)
+		_, err = s.Resolve(q, ClientInfo{})
+		require.Error(t, err, script)
+	}
+}
+
+// Expressions built from the query aren't kept after the script ran
+func TestScriptDynamicRegexp(t *testing.T) {
+	s, err := NewScript("test-script-dynamic", new(TestResolver), ScriptOptions{
+		Query: `{{ if match (printf "^%s$" .Question) .Question }}block{{ end }}{{ with .Client }}{{ if match "^10\\." . }}refuse{{ end }}{{ end }}`,
+	})
+	require.NoError(t, err)
+	q := new(dns.Msg)
+	q.SetQuestion("example.com.", dns.TypeA)
+	a, err := s.Resolve(q, ClientInfo{})
+	require.NoError(t, err)
+	require.Equal(t, dns.RcodeNameError, a.Rcode)
+
+	regexps := make(map[string]*regexp.Regexp)
+	require.NoError(t, scriptRegexps(s.query.Tree.Root, regexps))
+	require.Len(t, regexps, 1)
+	require.Contains(t, regexps, `^10\.`)
+}
+
+func TestParseScriptOutput(t *testing.T) {
+	res, err := parseScriptOutput("\n  max-ttl 60\nroute other\nblock\n")
+	require.NoError(t, err)
+	require.Equal(t, scriptRoute, res.action)
+	require.Equal(t, "other", res.route)
+	require.Equal(t, uint32(60), *res.maxTTL)
+
+	res, err = parseScriptOutput("")
+	require.NoError(t, err)
+	require.Empty(t, res.action)
+}
@@ -0,0 +1,291 @@
+package rdns
+
+import (
+	"errors"
+	"fmt"
+	"os"
+	"strings"
+	"sync"
+
+	"github.com/miekg/dns"
+)
+
+// StaticZone is a resolver that answers authoritatively for zones loaded from
+// RFC 1035 zone files. Queries for names outside the zones are refused.
+type StaticZone struct {
+	id string
+	StaticZoneOptions
+
+	mu    sync.RWMutex
+	zones []*zone
+}
+
+var _ Resolver = &StaticZone{}
+var _ ReloadableResolver = &StaticZone{}
+
+type StaticZoneOptions struct {
+	// Zone files to load. Each file has to contain one zone, starting with its
+	// SOA record. $ORIGIN and $INCLUDE are supported.
+	Files []string
+}
+
+// Records of a zone, by lower-case owner name.
+type zone struct {
+	origin  string
+	soa     *dns.SOA
+	records map[string][]dns.RR
+	names   map[string]struct{} // Owner names and empty non-terminals
+}
+
+// NewStaticZone loads the zone files and returns a new instance of a static
+// zone resolver.
+func NewStaticZone(id string, opt StaticZoneOptions) (*StaticZone, error) {
+	if len(opt.Files) == 0 {
+		return nil, errors.New("no zone files")
+	}
+	r := &StaticZone{id: id, StaticZoneOptions: opt}
+	if err := r.ReloadAll(); err != nil {
+		return nil, err
+	}
+	return r, nil
+}
+
+// ReloadAll loads the zone files again. The currently loaded zones are kept if
+// any of the files fail to load.
+func (r *StaticZone) ReloadAll() error {
+	var zones []*zone
+	for _, name := range r.Files {
+		z, err := loadZone(name)
+		if err != nil {
+			return err
+		}
+		for _, other := range zones {
+			if other.origin == z.origin {
+				return fmt.Errorf("zone %s is defined more than once", z.origin)
+			}
+		}
+		zones = append(zones, z)
+	}
+	r.mu.Lock()
+	r.zones = zones
+	r.mu.Unlock()
+	return nil
+}
+
+// Resolve a DNS query with the records of the zone it belongs to.
+func (r *StaticZone) Resolve(q *dns.Msg, ci ClientInfo) (*dns.Msg, error) {
+	if len(q.Question) < 1 {
+		return nil, errors.New("no question in query")
+	}
+	question := q.Question[0]
+	log := logger(r.id, q, ci)
+
+	z := r.findZone(question.Name)
+	if z == nil || question.Qclass != dns.ClassINET {
+		log.Debug("not authoritative, refusing")
+		return responseWithCode(q, dns.RcodeRefused), nil
+	}
+	a := z.answer(q)
+	log.WithField("rcode", dns.RcodeToString[a.Rcode]).Debug("responding")
+	return a, nil
+}
+
+func (r *StaticZone) String() string {
+	return r.id
+}
+
+// Returns the most specific zone the name belongs to, or nil.
+func (r *StaticZone) findZone(name string) *zone {
+	r.mu.RLock()
+	defer r.mu.RUnlock()
+	var found *zone
+	for _, z := range r.zones {
+		if dns.IsSubDomain(z.origin, name) && (found == nil || len(z.origin) > len(found.origin)) {
+			found = z
+		}
+	}
+	return found
+}
+
+func loadZone(name string) (*zone, error) {
+	f, err := os.Open(name)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+
+	z := &zone{
+		records: make(map[string][]dns.RR),
+		names:   make(map[string]struct{}),
+	}
+	zp := dns.NewZoneParser(f, ".", name)
+	zp.SetIncludeAllowed(true)
+	for rr, ok := zp.Next(); ok; rr, ok = zp.Next() {
+		owner := strings.ToLower(rr.Header().Name)
+		if z.soa == nil {
+			soa, ok := rr.(*dns.SOA)
+			if !ok {
+				return nil, fmt.Errorf("%s: zone doesn't start with a SOA record", name)
+			}
+			z.soa = soa
+			z.origin = owner
+		} else if !dns.IsSubDomain(z.origin, owner) {
+			return nil, fmt.Errorf("%s: record %q is outside of zone %s", name, rr.String(), z.origin)
+		}
+		z.records[owner] = append(z.records[owner], rr)
+		for n := owner; n != z.origin; {
+			z.names[n] = struct{}{}
+			i, end := dns.NextLabel(n, 0)
+			if end {
+				break
+			}
+			n = n[i:]
+		}
+	}
+	if err := zp.Err(); err != nil {
+		return nil, fmt.Errorf("%s: %w", name, err)
+	}
+	if z.soa == nil {
+		return nil, fmt.Errorf("%s: no records in zone", name)
+	}
+	return z, nil
+}
+
+// Build the response to a query for a name in the zone.
+func (z *zone) answer(q *dns.Msg) *dns.Msg {
+	question := q.Question[0]
+	a := new(dns.Msg)
+	a.SetReply(q)
+	a.Authoritative = true
+
+	name := strings.ToLower(question.Name)
+	for i := 0; i < 8; i++ { // Limit the length of CNAME chains
+		// Names at or below a delegation get a referral
+		if ns := z.delegation(name, question.Qtype); ns != nil {
+			a.Authoritative = false
+			a.Ns = ns
+			a.Extra = z.glue(ns)
+			return a
+		}
+
+		rrs, ok := z.records[name]
+		if !ok {
+			rrs, ok = z.wildcard(name)
+		}
+		if !ok {
+			if !z.exists(name) {
+				a.Rcode = dns.RcodeNameError
+			}
+			a.Ns = []dns.RR{z.negativeSOA()}
+			return a
+		}
+
+		var (
+			cname  *dns.CNAME
+			answer []dns.RR
+		)
+		for _, rr := range rrs {
+			switch {
+			case question.Qtype == dns.TypeANY || rr.Header().Rrtype == question.Qtype:
+				answer = append(answer, withName(rr, name))
+			case rr.Header().Rrtype == dns.TypeCNAME:
+				cname = rr.(*dns.CNAME)
+			}
+		}
+		if len(answer) == 0 && cname != nil {
+			a.Answer = append(a.Answer, withName(cname, name))
+			name = strings.ToLower(cname.Target)
+			// Only follow CNAMEs within the zone, the client resolves the rest
+			if !dns.IsSubDomain(z.origin, name) {
+				return a
+			}
+			continue
+		}
+		if len(answer) == 0 {
+			a.Ns = []dns.RR{z.negativeSOA()}
+			return a
+		}
+		a.Answer = append(a.Answer, answer...)
+		return a
+	}
+	return a
+}
+
+// Returns the NS records if the name is at or below a delegation point in the
+// zone. DS records are served by the parent side of the delegation.
+func (z *zone) delegation(name string, qtype uint16) []dns.RR {
+	labels := dns.SplitDomainName(name)
+	originLabels := dns.CountLabel(z.origin)
+	for i := len(labels) - originLabels - 1; i >= 0; i-- {
+		cut := dns.Fqdn(strings.Join(labels[i:], "."))
+		if i == 0 && qtype == dns.TypeDS {
+			return nil
+		}
+		var ns []dns.RR
+		for _, rr := range z.records[cut] {
+			if rr.Header().Rrtype == dns.TypeNS {
+				ns = append(ns, dns.Copy(rr))
+			}
+		}
+		if len(ns) > 0 {
+			return ns
+		}
+	}
+	return nil
+}
+
+// Returns the address records of NS targets that are in the zone.
+func (z *zone) glue(ns []dns.RR) []dns.RR {
+	var glue []dns.RR
+	for _, rr := range ns {
+		for _, g := range z.records[strings.ToLower(rr.(*dns.NS).Ns)] {
+			if t := g.Header().Rrtype; t == dns.TypeA || t == dns.TypeAAAA {
+				glue = append(glue, dns.Copy(g))
+			}
+		}
+	}
+	return glue
+}
+
+// Returns the records of the wildcard at the closest encloser of a name that
+// doesn't exist, RFC 4592.
+func (z *zone) wildcard(name string) ([]dns.RR, bool) {
+	labels := dns.SplitDomainName(name)
+	for i := 1; i < len(labels); i++ {
+		encloser := dns.Fqdn(strings.Join(labels[i:], "."))
+		if !dns.IsSubDomain(z.origin, encloser) {
+			break
+		}
+		if z.exists(encloser) {
+			rrs, ok := z.records["*."+encloser]
+			return rrs, ok
+		}
+	}
+	return nil, false
+}
+
+// Returns true if the name has records, or is an empty non-terminal with
+// records below it.
+func (z *zone) exists(name string) bool {
+	if name == z.origin {
+		return true
+	}
+	_, ok := z.names[name]
+	return ok
+}
+
+// SOA for negative responses, with the TTL limited to the minimum field as per
+// RFC 2308.
+func (z *zone) negativeSOA() dns.RR {
+	soa := dns.Copy(z.soa).(*dns.SOA)
+	soa.Hdr.Ttl = min(soa.Hdr.Ttl, soa.Minttl)
+	return soa
+}
+
+// Returns a copy of the record with the owner name set. Records of wildcards
+// are expanded to the name in the query.
+func withName(rr dns.RR, name string) dns.RR {
+	rr = dns.Copy(rr)
+	rr.Header().Name = name
+	return rr
+}
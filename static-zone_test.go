@@ -0,0 +1,111 @@
+package rdns
+
+import (
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/miekg/dns"
+	"github.com/stretchr/testify/require"
+)
+
+func TestStaticZone(t *testing.T) {
+	r, err := NewStaticZone("test-zone", StaticZoneOptions{Files: []string{"testdata/zone.example.db"}})
+	require.NoError(t, err)
+
+	resolve := func(name string, qtype uint16) *dns.Msg {
+		q := new(dns.Msg)
+		q.SetQuestion(name, qtype)
+		a, err := r.Resolve(q, ClientInfo{})
+		require.NoError(t, err)
+		return a
+	}
+
+	// Positive answers are authoritative
+	a := resolve("www.zone.example.", dns.TypeA)
+	require.Equal(t, dns.RcodeSuccess, a.Rcode)
+	require.True(t, a.Authoritative)
+	require.Len(t, a.Answer, 1)
+	require.Equal(t, "192.0.2.1", a.Answer[0].(*dns.A).A.String())
+	require.Equal(t, uint32(3600), a.Answer[0].Header().Ttl)
+
+	a = resolve("zone.example.", dns.TypeSOA)
+	require.IsType(t, &dns.SOA{}, a.Answer[0])
+	a = resolve("zone.example.", dns.TypeNS)
+	require.Equal(t, "ns1.zone.example.", a.Answer[0].(*dns.NS).Ns)
+
+	// Records from included files
+	a = resolve("mail.zone.example.", dns.TypeA)
+	require.Len(t, a.Answer, 1)
+
+	// NODATA
+	a = resolve("www.zone.example.", dns.TypeMX)
+	require.Equal(t, dns.RcodeSuccess, a.Rcode)
+	require.Empty(t, a.Answer)
+	require.Len(t, a.Ns, 1)
+	require.Equal(t, uint32(300), a.Ns[0].Header().Ttl)
+
+	// Empty non-terminals exist
+	a = resolve("b.c.zone.example.", dns.TypeA)
+	require.Equal(t, dns.RcodeSuccess, a.Rcode)
+
+	// NXDOMAIN
+	a = resolve("missing.zone.example.", dns.TypeA)
+	require.Equal(t, dns.RcodeNameError, a.Rcode)
+	require.True(t, a.Authoritative)
+	require.IsType(t, &dns.SOA{}, a.Ns[0])
+
+	// CNAMEs are followed within the zone
+	a = resolve("alias.zone.example.", dns.TypeA)
+	require.Len(t, a.Answer, 2)
+	require.IsType(t, &dns.CNAME{}, a.Answer[0])
+	require.Equal(t, "www.zone.example.", a.Answer[1].Header().Name)
+	a = resolve("outside.zone.example.", dns.TypeA)
+	require.Len(t, a.Answer, 1)
+	require.IsType(t, &dns.CNAME{}, a.Answer[0])
+
+	// Wildcards
+	a = resolve("anything.wild.zone.example.", dns.TypeA)
+	require.Len(t, a.Answer, 1)
+	require.Equal(t, "anything.wild.zone.example.", a.Answer[0].Header().Name)
+
+	// Delegations return a referral with glue
+	a = resolve("www.sub.zone.example.", dns.TypeA)
+	require.False(t, a.Authoritative)
+	require.Empty(t, a.Answer)
+	require.Len(t, a.Ns, 1)
+	require.Len(t, a.Extra, 1)
+
+	// Names outside the zone are refused
+	a = resolve("www.example.com.", dns.TypeA)
+	require.Equal(t, dns.RcodeRefused, a.Rcode)
+}
+
+func TestStaticZoneReload(t *testing.T) {
+	file := filepath.Join(t.TempDir(), "zone.db")
+	write := func(s string) {
+		require.NoError(t, os.WriteFile(file, []byte(s), 0644))
+	}
+	write("reload.example. 60 IN SOA ns hostmaster 1 7200 3600 1209600 60\nwww.reload.example. 60 IN A 192.0.2.1\n")
+	r, err := NewStaticZone("test-zone-reload", StaticZoneOptions{Files: []string{file}})
+	require.NoError(t, err)
+
+	q := new(dns.Msg)
+	q.SetQuestion("www.reload.example.", dns.TypeA)
+	a, err := r.Resolve(q, ClientInfo{})
+	require.NoError(t, err)
+	require.Equal(t, "192.0.2.1", a.Answer[0].(*dns.A).A.String())
+
+	// A zone without a SOA fails to load and the old records are kept
+	write("www.reload.example. 60 IN A 192.0.2.2\n")
+	require.Error(t, r.ReloadAll())
+	a, err = r.Resolve(q, ClientInfo{})
+	require.NoError(t, err)
+	require.Equal(t, "192.0.2.1", a.Answer[0].(*dns.A).A.String())
+
+	write("reload.example. 60 IN SOA ns hostmaster 2 7200 3600 1209600 60\nwww.reload.example. 60 IN A 192.0.2.2\n")
+	require.NoError(t, r.ReloadAll())
+	a, err = r.Resolve(q, ClientInfo{})
+	require.NoError(t, err)
+	require.Equal(t, "192.0.2.2", a.Answer[0].(*dns.A).A.String())
+}
@@ -0,0 +1,174 @@
+package rdns
+
+import (
+	"slices"
+	"strings"
+
+	"github.com/miekg/dns"
+)
+
+// SVCBFilter is a resolver that removes parameters from SVCB and HTTPS records
+// in responses, or the records altogether. Clients can use the parameters to
+// connect without looking up A or AAAA records (IP hints) or to hide the name
+// of the server they connect to (ECH), which bypasses filtering based on those.
+type SVCBFilter struct {
+	id       string
+	resolver Resolver
+	SVCBFilterOptions
+}
+
+var _ Resolver = &SVCBFilter{}
+
+type SVCBFilterOptions struct {
+	// Remove the ech parameter.
+	StripECH bool
+
+	// Remove the ipv4hint and ipv6hint parameters.
+	StripIPHints bool
+
+	// Protocols removed from the alpn parameter, e.g. "h3". Records that end up
+	// without any protocol and that don't allow the default one are removed.
+	StripALPN []string
+
+	// Remove all SVCB and HTTPS records.
+	Drop bool
+}
+
+// NewSVCBFilter returns a new instance of an SVCB and HTTPS record filter.
+func NewSVCBFilter(id string, resolver Resolver, opt SVCBFilterOptions) *SVCBFilter {
+	return &SVCBFilter{id: id, resolver: resolver, SVCBFilterOptions: opt}
+}
+
+// Resolve a DNS query with the upstream resolver and filter the SVCB and HTTPS
+// records in the response.
+func (r *SVCBFilter) Resolve(q *dns.Msg, ci ClientInfo) (*dns.Msg, error) {
+	a, err := r.resolver.Resolve(q, ci)
+	if err != nil || a == nil {
+		return a, err
+	}
+	var modified bool
+	a.Answer, modified = r.filter(a.Answer)
+	a.Ns, _ = r.filter(a.Ns)
+	a.Extra, _ = r.filter(a.Extra)
+	if modified {
+		logger(r.id, q, ci).Debug("filtered svcb records in response")
+	}
+	return a, nil
+}
+
+func (r *SVCBFilter) String() string {
+	return r.id
+}
+
+// Filters the SVCB and HTTPS records in a section. Signatures of modified or
+// removed records can't be valid anymore and are removed as well.
+func (r *SVCBFilter) filter(rrs []dns.RR) ([]dns.RR, bool) {
+	type rrset struct {
+		name  string
+		rtype uint16
+	}
+	modified := make(map[rrset]struct{})
+	out := rrs[:0]
+	for _, rr := range rrs {
+		var svcb *dns.SVCB
+		switch rr := rr.(type) {
+		case *dns.SVCB:
+			svcb = rr
+		case *dns.HTTPS:
+			svcb = &rr.SVCB
+		}
+		if svcb == nil {
+			out = append(out, rr)
+			continue
+		}
+		keep, changed := r.filterRecord(svcb)
+		if changed {
+			modified[rrset{strings.ToLower(rr.Header().Name), rr.Header().Rrtype}] = struct{}{}
+		}
+		if keep {
+			out = append(out, rr)
+		}
+	}
+	if len(modified) == 0 {
+		return out, false
+	}
+	filtered := out[:0]
+	for _, rr := range out {
+		if sig, ok := rr.(*dns.RRSIG); ok {
+			if _, ok := modified[rrset{strings.ToLower(sig.Hdr.Name), sig.TypeCovered}]; ok {
+				continue
+			}
+		}
+		filtered = append(filtered, rr)
+	}
+	return filtered, true
+}
+
+// Removes parameters from a record. Returns false if the whole record should be
+// removed, and true as second value if it was modified.
+func (r *SVCBFilter) filterRecord(rr *dns.SVCB) (keep bool, modified bool) {
+	if r.Drop {
+		return false, true
+	}
+	var (
+		removed      []dns.SVCBKey
+		noDefault    bool
+		alpnRemains  bool
+		alpnStripped bool
+	)
+	values := make([]dns.SVCBKeyValue, 0, len(rr.Value))
+	for _, kv := range rr.Value {
+		switch kv := kv.(type) {
+		case *dns.SVCBECHConfig:
+			if r.StripECH {
+				removed = append(removed, kv.Key())
+				continue
+			}
+		case *dns.SVCBIPv4Hint, *dns.SVCBIPv6Hint:
+			if r.StripIPHints {
+				removed = append(removed, kv.Key())
+				continue
+			}
+		case *dns.SVCBAlpn:
+			alpn := slices.DeleteFunc(slices.Clone(kv.Alpn), func(s string) bool {
+				return slices.Contains(r.StripALPN, s)
+			})
+			if len(alpn) != len(kv.Alpn) {
+				alpnStripped = true
+			}
+			if len(alpn) == 0 {
+				removed = append(removed, kv.Key())
+				continue
+			}
+			kv.Alpn = alpn
+			alpnRemains = true
+		case *dns.SVCBNoDefaultAlpn:
+			noDefault = true
+		}
+		values = append(values, kv)
+	}
+	if len(removed) == 0 && !alpnStripped {
+		return true, false
+	}
+
+	// Without any protocol left, clients can't connect to the endpoint
+	if noDefault && !alpnRemains {
+		return false, true
+	}
+
+	// Keys that are gone can't be mandatory anymore
+	out := values[:0]
+	for _, kv := range values {
+		if m, ok := kv.(*dns.SVCBMandatory); ok {
+			m.Code = slices.DeleteFunc(m.Code, func(k dns.SVCBKey) bool {
+				return slices.Contains(removed, k)
+			})
+			if len(m.Code) == 0 {
+				continue
+			}
+		}
+		out = append(out, kv)
+	}
+	rr.Value = out
+	return true, true
+}
@@ -0,0 +1,63 @@
+package rdns
+
+import (
+	"testing"
+
+	"github.com/miekg/dns"
+	"github.com/stretchr/testify/require"
+)
+
+func TestSVCBFilter(t *testing.T) {
+	var ci ClientInfo
+	r := &TestResolver{
+		ResolveFunc: func(q *dns.Msg, ci ClientInfo) (*dns.Msg, error) {
+			a := new(dns.Msg)
+			a.SetReply(q)
+			a.Answer = []dns.RR{
+				mustRR(t, `example.com. 300 IN HTTPS 1 . mandatory=alpn,ech alpn="h3,h2" ipv4hint=192.0.2.1 ech=AAAA ipv6hint=2001:db8::1`),
+				mustRR(t, `example.com. 300 IN HTTPS 2 . alpn="h3" no-default-alpn`),
+				mustRR(t, "example.com. 300 IN RRSIG HTTPS 13 2 300 20300101000000 20200101000000 1234 example.com. AAAA"),
+				mustRR(t, "example.com. 300 IN A 192.0.2.1"),
+			}
+			return a, nil
+		},
+	}
+	q := new(dns.Msg)
+	q.SetQuestion("example.com.", dns.TypeHTTPS)
+
+	f := NewSVCBFilter("test-svcb", r, SVCBFilterOptions{
+		StripECH:     true,
+		StripIPHints: true,
+		StripALPN:    []string{"h3"},
+	})
+	a, err := f.Resolve(q, ci)
+	require.NoError(t, err)
+
+	// The second record has no protocol left and the signature is invalid
+	require.Len(t, a.Answer, 2)
+	https, ok := a.Answer[0].(*dns.HTTPS)
+	require.True(t, ok)
+	require.Equal(t, `example.com.	300	IN	HTTPS	1 . mandatory="alpn" alpn="h2"`, https.String())
+	require.IsType(t, &dns.A{}, a.Answer[1])
+
+	// Records without any of the parameters aren't modified
+	r.ResolveFunc = func(q *dns.Msg, ci ClientInfo) (*dns.Msg, error) {
+		a := new(dns.Msg)
+		a.SetReply(q)
+		a.Answer = []dns.RR{
+			mustRR(t, `example.com. 300 IN HTTPS 1 . alpn="h2"`),
+			mustRR(t, "example.com. 300 IN RRSIG HTTPS 13 2 300 20300101000000 20200101000000 1234 example.com. AAAA"),
+		}
+		return a, nil
+	}
+	a, err = f.Resolve(q, ci)
+	require.NoError(t, err)
+	require.Len(t, a.Answer, 2)
+
+	// Drop all of them
+	f = NewSVCBFilter("test-svcb-drop", r, SVCBFilterOptions{Drop: true})
+	a, err = f.Resolve(q, ci)
+	require.NoError(t, err)
+	require.Equal(t, dns.RcodeSuccess, a.Rcode)
+	require.Empty(t, a.Answer)
+}
@@ -12,15 +12,17 @@ type Template struct {
 	textTemplate *template.Template
 }
 
+// Functions available in all templates.
+var templateFuncs = template.FuncMap{
+	"replaceAll": strings.ReplaceAll,
+	"trimPrefix": strings.TrimPrefix,
+	"trimSuffix": strings.TrimSuffix,
+	"split":      strings.Split,
+	"join":       strings.Join,
+}
+
 func NewTemplate(text string) (*Template, error) {
-	funcMap := template.FuncMap{
-		"replaceAll": strings.ReplaceAll,
-		"trimPrefix": strings.TrimPrefix,
-		"trimSuffix": strings.TrimSuffix,
-		"split":      strings.Split,
-		"join":       strings.Join,
-	}
-	textTemplate := template.New("template").Funcs(funcMap)
+	textTemplate := template.New("template").Funcs(templateFuncs)
 	textTemplate, err := textTemplate.Parse(text)
 	if err != nil {
 		return nil, err
@@ -30,6 +30,10 @@ type TTLModifierOptions struct {
 	// Maximum TTL, any RR with a TTL higher than this will have their value
 	// set to the max. A value of 0 disables the limit. Default 0.
 	MaxTTL uint32
+
+	// Optional maximum TTL by record type, used instead of MaxTTL for records
+	// of that type.
+	OverrideMap map[uint16]uint32
 }
 
 // NewTTLModifier returns a new instance of a TTL modifier.
@@ -58,14 +62,22 @@ func (r *TTLModifier) Resolve(q *dns.Msg, ci ClientInfo) (*dns.Msg, error) {
 		modified = r.SelectFunc(r, a)
 	}
 
-	// Apply min/max to the results
+	// Apply min/max to the results. SOA records are left alone since their TTL
+	// and minimum field determine how long negative responses are cached.
 	iterateOverAnswerRRHeader(a, func(h *dns.RR_Header) {
+		if h.Rrtype == dns.TypeSOA {
+			return
+		}
+		maxTTL := r.MaxTTL
+		if override, ok := r.OverrideMap[h.Rrtype]; ok {
+			maxTTL = override
+		}
 		if h.Ttl < r.MinTTL {
 			h.Ttl = r.MinTTL
 			modified = true
 		}
-		if h.Ttl > r.MaxTTL {
-			h.Ttl = r.MaxTTL
+		if h.Ttl > maxTTL {
+			h.Ttl = maxTTL
 			modified = true
 		}
 	})
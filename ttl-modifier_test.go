@@ -0,0 +1,50 @@
+package rdns
+
+import (
+	"testing"
+
+	"github.com/miekg/dns"
+	"github.com/stretchr/testify/require"
+)
+
+func TestTTLModifier(t *testing.T) {
+	var ci ClientInfo
+	upstream, err := NewStaticResolver("test-static", StaticResolverOptions{
+		Answer: []string{
+			"test.com. 1 IN A 1.2.3.4",
+			"test.com. 86400 IN TXT \"text\"",
+		},
+		NS: []string{
+			"test.com. 86400 IN NS ns.test.com.",
+			"test.com. 5 IN SOA ns.test.com. hostmaster.test.com. 1 7200 3600 1209600 2",
+		},
+		Extra: []string{
+			"ns.test.com. 86400 IN A 1.2.3.5",
+		},
+	})
+	require.NoError(t, err)
+
+	r := NewTTLModifier("test-ttl", upstream, TTLModifierOptions{
+		MinTTL:      60,
+		MaxTTL:      3600,
+		OverrideMap: map[uint16]uint32{dns.TypeTXT: 300},
+	})
+
+	q := new(dns.Msg)
+	q.SetQuestion("test.com.", dns.TypeA)
+	a, err := r.Resolve(q, ci)
+	require.NoError(t, err)
+
+	// Answer, raised to the min and TXT limited by the override
+	require.Equal(t, uint32(60), a.Answer[0].Header().Ttl)
+	require.Equal(t, uint32(300), a.Answer[1].Header().Ttl)
+
+	// Authority, SOA is not modified, neither the TTL nor the minimum
+	require.Equal(t, uint32(3600), a.Ns[0].Header().Ttl)
+	soa := a.Ns[1].(*dns.SOA)
+	require.Equal(t, uint32(5), soa.Hdr.Ttl)
+	require.Equal(t, uint32(2), soa.Minttl)
+
+	// Additional
+	require.Equal(t, uint32(3600), a.Extra[0].Header().Ttl)
+}
@@ -0,0 +1,81 @@
+package rdns
+
+import (
+	"errors"
+	"expvar"
+	"time"
+
+	"github.com/miekg/dns"
+	"github.com/sirupsen/logrus"
+)
+
+// UpstreamRetry is a resolver that sends failed queries, for example those that
+// timed out, to its resolver again, waiting between attempts. It's used in
+// front of the upstream clients so all protocols retry the same way.
+type UpstreamRetry struct {
+	id       string
+	resolver Resolver
+	UpstreamRetryOptions
+	retries *expvar.Int
+}
+
+var _ Resolver = &UpstreamRetry{}
+
+type UpstreamRetryOptions struct {
+	// Number of times a failed query is retried.
+	Retries int
+
+	// Wait between attempts. Starts at InitialBackoff and is multiplied with
+	// every further retry, up to MaxBackoff. Retries immediately if
+	// InitialBackoff is 0.
+	RetryPolicy
+
+	// Max time for all attempts together. Limits the query timeout of the last
+	// attempt, and queries aren't retried if the back-off would end after it.
+	// No limit if 0.
+	Deadline time.Duration
+}
+
+// NewUpstreamRetry returns a new instance of an upstream retry resolver.
+func NewUpstreamRetry(id string, resolver Resolver, opt UpstreamRetryOptions) *UpstreamRetry {
+	opt.RetryPolicy = opt.RetryPolicy.withDefaults()
+	return &UpstreamRetry{
+		id:                   id,
+		resolver:             resolver,
+		UpstreamRetryOptions: opt,
+		retries:              getVarInt("client", id, "retry"),
+	}
+}
+
+// Resolve a DNS query, retrying it if the resolver fails.
+func (r *UpstreamRetry) Resolve(q *dns.Msg, ci ClientInfo) (*dns.Msg, error) {
+	if r.Deadline > 0 {
+		deadline := time.Now().Add(r.Deadline)
+		if ci.Deadline.IsZero() || deadline.Before(ci.Deadline) {
+			ci.Deadline = deadline
+		}
+	}
+	for n := 1; ; n++ {
+		a, err := r.resolver.Resolve(q, ci)
+		if err == nil || n > r.Retries || errors.Is(err, errQueryCancelled) {
+			return a, err
+		}
+		wait := r.backoff(n)
+		if !ci.Deadline.IsZero() && time.Now().Add(wait).After(ci.Deadline) {
+			return a, err
+		}
+		logger(r.id, q, ci).WithError(err).WithFields(logrus.Fields{"retry": n, "backoff": wait}).Debug("query failed, retrying")
+		r.retries.Add(1)
+		timer := time.NewTimer(wait)
+		select {
+		case <-timer.C:
+		case <-ci.Done:
+			timer.Stop()
+			return nil, errQueryCancelled
+		}
+	}
+}
+
+func (r *UpstreamRetry) String() string {
+	return r.id
+}
@@ -0,0 +1,97 @@
+package rdns
+
+import (
+	"errors"
+	"testing"
+	"time"
+
+	"github.com/miekg/dns"
+	"github.com/stretchr/testify/require"
+)
+
+func TestUpstreamRetry(t *testing.T) {
+	var ci ClientInfo
+	var failures int
+	r := &TestResolver{
+		ResolveFunc: func(q *dns.Msg, ci ClientInfo) (*dns.Msg, error) {
+			if failures > 0 {
+				failures--
+				return nil, errors.New("failed")
+			}
+			return q, nil
+		},
+	}
+	u := NewUpstreamRetry("test-upstream-retry", r, UpstreamRetryOptions{
+		Retries:     2,
+		RetryPolicy: RetryPolicy{InitialBackoff: 10 * time.Millisecond},
+	})
+	q := new(dns.Msg)
+	q.SetQuestion("example.com.", dns.TypeA)
+
+	// Succeeds on the last retry
+	failures = 2
+	start := time.Now()
+	_, err := u.Resolve(q, ci)
+	require.NoError(t, err)
+	require.Equal(t, 3, r.HitCount())
+	require.GreaterOrEqual(t, time.Since(start), 30*time.Millisecond)
+	require.Equal(t, int64(2), u.retries.Value())
+
+	// Gives up after the configured retries
+	failures = 3
+	_, err = u.Resolve(q, ci)
+	require.Error(t, err)
+	require.Equal(t, 6, r.HitCount())
+}
+
+func TestUpstreamRetryDeadline(t *testing.T) {
+	var deadline time.Time
+	r := &TestResolver{
+		ResolveFunc: func(q *dns.Msg, ci ClientInfo) (*dns.Msg, error) {
+			deadline = ci.Deadline
+			return nil, errors.New("failed")
+		},
+	}
+	u := NewUpstreamRetry("test-upstream-retry-deadline", r, UpstreamRetryOptions{
+		Retries:     10,
+		RetryPolicy: RetryPolicy{InitialBackoff: 40 * time.Millisecond},
+		Deadline:    100 * time.Millisecond,
+	})
+	q := new(dns.Msg)
+	q.SetQuestion("example.com.", dns.TypeA)
+
+	// Attempts at 0 and 40ms, the next one 80ms later would be past the deadline
+	start := time.Now()
+	_, err := u.Resolve(q, ClientInfo{})
+	require.Error(t, err)
+	require.Equal(t, 2, r.HitCount())
+	require.WithinDuration(t, start.Add(100*time.Millisecond), deadline, 10*time.Millisecond)
+
+	// The deadline of the listener is kept if it's earlier
+	listenerDeadline := time.Now().Add(10 * time.Millisecond)
+	_, err = u.Resolve(q, ClientInfo{Deadline: listenerDeadline})
+	require.Error(t, err)
+	require.Equal(t, listenerDeadline, deadline)
+	require.Equal(t, 3, r.HitCount())
+}
+
+// Cancelled queries aren't retried
+func TestUpstreamRetryCancel(t *testing.T) {
+	r := &TestResolver{
+		ResolveFunc: func(q *dns.Msg, ci ClientInfo) (*dns.Msg, error) {
+			return nil, errors.New("failed")
+		},
+	}
+	u := NewUpstreamRetry("test-upstream-retry-cancel", r, UpstreamRetryOptions{
+		Retries:     2,
+		RetryPolicy: RetryPolicy{InitialBackoff: time.Hour, MaxBackoff: time.Hour},
+	})
+	q := new(dns.Msg)
+	q.SetQuestion("example.com.", dns.TypeA)
+
+	done := make(chan struct{})
+	time.AfterFunc(10*time.Millisecond, func() { close(done) })
+	_, err := u.Resolve(q, ClientInfo{Done: done})
+	require.ErrorIs(t, err, errQueryCancelled)
+	require.Equal(t, 1, r.HitCount())
+}
@@ -3,6 +3,10 @@ package rdns
 import (
 	"expvar"
 	"fmt"
+	"sort"
+	"strings"
+	"sync/atomic"
+	"time"
 )
 
 // Get an *expvar.Int with the given path.
@@ -22,3 +26,94 @@ func getVarMap(base string, id string, name string) *expvar.Map {
 	}
 	return expvar.NewMap(fullname)
 }
+
+// Get a *varHistogram with the given path. Uses the default latency buckets.
+func getVarHistogram(base string, id string, name string) *varHistogram {
+	fullname := fmt.Sprintf("routedns.%s.%s.%s", base, id, name)
+	if v := expvar.Get(fullname); v != nil {
+		return v.(*varHistogram)
+	}
+	h := newVarHistogram(latencyBuckets)
+	expvar.Publish(fullname, h)
+	return h
+}
+
+// Get a *ruleCounters with the given path.
+func getVarRuleCounters(base string, id string, name string) *ruleCounters {
+	fullname := fmt.Sprintf("routedns.%s.%s.%s", base, id, name)
+	if v := expvar.Get(fullname); v != nil {
+		return v.(*ruleCounters)
+	}
+	c := &ruleCounters{counts: make(map[string]map[string]int64)}
+	expvar.Publish(fullname, c)
+	return c
+}
+
+// Get a *topCounter with the given path.
+func getVarTopCounter(base string, id string, name string) *topCounter {
+	fullname := fmt.Sprintf("routedns.%s.%s.%s", base, id, name)
+	if v := expvar.Get(fullname); v != nil {
+		return v.(*topCounter)
+	}
+	c := newTopCounter(topBlockedWindow, topBlockedCapacity)
+	expvar.Publish(fullname, c)
+	return c
+}
+
+// Upper bounds (in seconds) of the buckets used for latency histograms.
+var latencyBuckets = []float64{0.001, 0.0025, 0.005, 0.01, 0.025, 0.05, 0.1, 0.25, 0.5, 1, 2.5, 5}
+
+// varHistogram is a histogram of durations that can be published with expvar
+// and exported to Prometheus.
+type varHistogram struct {
+	buckets []float64       // Upper bounds in seconds
+	counts  []atomic.Uint64 // Observations per bucket, not cumulative
+	count   atomic.Uint64
+	sum     atomic.Int64 // In nanoseconds
+}
+
+var _ expvar.Var = &varHistogram{}
+
+func newVarHistogram(buckets []float64) *varHistogram {
+	return &varHistogram{
+		buckets: buckets,
+		counts:  make([]atomic.Uint64, len(buckets)),
+	}
+}
+
+// Record one observation.
+func (h *varHistogram) observe(d time.Duration) {
+	i := sort.SearchFloat64s(h.buckets, d.Seconds())
+	if i < len(h.counts) {
+		h.counts[i].Add(1)
+	}
+	h.count.Add(1)
+	h.sum.Add(int64(d))
+}
+
+// Returns the total count, the sum in seconds, and the cumulative counts by
+// upper bound of each bucket.
+func (h *varHistogram) snapshot() (uint64, float64, map[float64]uint64) {
+	buckets := make(map[float64]uint64, len(h.buckets))
+	var cumulative uint64
+	for i, b := range h.buckets {
+		cumulative += h.counts[i].Load()
+		buckets[b] = cumulative
+	}
+	return h.count.Load(), time.Duration(h.sum.Load()).Seconds(), buckets
+}
+
+// String returns the histogram as JSON for expvar.
+func (h *varHistogram) String() string {
+	count, sum, buckets := h.snapshot()
+	var b strings.Builder
+	fmt.Fprintf(&b, `{"count": %d, "sum": %g, "buckets": {`, count, sum)
+	for i, bound := range h.buckets {
+		if i > 0 {
+			b.WriteString(", ")
+		}
+		fmt.Fprintf(&b, `"%g": %d`, bound, buckets[bound])
+	}
+	b.WriteString("}}")
+	return b.String()
+}